@@ -13,6 +13,7 @@ import (
 const (
 	defaultISOdir = "/var/lib/libvirt/isos"
 	defaultSrcDir = "/tmp/iso2chroot"
+	defaultRoot   = "/tmp/iso2chroot.d"
 )
 
 func main() {
@@ -20,7 +21,15 @@ func main() {
 	flagSet.SetOutput(os.Stderr)
 
 	dir := flagSet.String("dir", defaultISOdir, "Directory containing ISO images")
-	src := flagSet.String("src", defaultSrcDir, "Directory to mount the selected ISO into")
+	src := flagSet.String("src", defaultSrcDir, "Directory to mount the selected ISO into, or extract its root filesystem into")
+	root := flagSet.String("root", defaultRoot, "Directory holding named chroot instances")
+	lock := flagSet.String("lock", "", "Lock file written by create (default <src>.lock)")
+	timeout := flagSet.String("timeout", "", "Per-operation timeouts as op=duration pairs, e.g. load=10s,command=1m (ops: load, inspect, command; 0 disables; default "+iso2chroot.DefaultTimeouts.String()+")")
+	wait := flagSet.Duration("wait", 0, "How long to wait for a lock held by another iso2chroot process (e.g. 30s)")
+	dryRun := flagSet.Bool("dry-run", false, "Print the privileged commands create, enter and destroy would run instead of running them")
+	planFormat := flagSet.String("plan-format", iso2chroot.PlanShell, "Format of the --dry-run plan: shell or json")
+	yes := flagSet.Bool("yes", false, "Answer yes to every confirmation, including typed ones")
+	noInput := flagSet.Bool("no-input", false, "Never prompt; fail when a confirmation would be needed (implied when stdin is not a terminal)")
 	experimentalTUI := flagSet.Bool("experimental-tui", false, "Launch the experimental TUI interface")
 
 	flagSet.Usage = func() {
@@ -28,48 +37,163 @@ func main() {
 
 Commands:
     list            List available ISO images (default)
-    select <index>  Print the ISO identified by its numeric index
-    create <index>  Mount the ISO for chroot preparation
+    select <iso>    Print the ISO identified by its index, as list prints it
+    create <iso>    Mount the ISO for chroot preparation
+    create --name <instance> <iso>
+                    Assemble a named, writable chroot under --root
+    create --extract <iso>
+                    Unpack the ISO's live root filesystem into --src without sudo
+    create --from-lock <file>
+                    Recreate a chroot from a lock file, refusing if any input differs
+    extract [--rootfs] [--include <pattern>] [--exclude <pattern>] <iso> <dest> [paths...]
+                    Copy files out of the ISO, or its live root filesystem, into dest without sudo
+    extract --boot-image <iso> <file>
+                    Write the ISO's EFI system partition image to file
+    info <iso>      Show the ISO's label, filesystems, live root filesystem and boot setup
+    boot-entries [--format text|json] <iso>
+                    List the kernel, initrd and command line of each GRUB and ISOLINUX menu entry
+    kernel [--entry <label>] --out <dir> <iso>
+                    Copy the kernel and initramfs out for direct boot, with a manifest of the command line
+    initrd ls <file>
+                    List the cpio archives of an initramfs, including early microcode ones
+    initrd extract <file> <dest>
+                    Unpack an initramfs; several archives go to dest/early, early2, ... and main
+    initrd repack [--compress gzip|xz|zstd|lz4|none] --out <file> <dir>...
+                    Pack each directory into an archive, reproducibly; all but the last stay uncompressed
+    remaster [--overlay <dir>] [--label <label>] [--publisher <name>] --out <file> <iso>
+                    Write a new bootable ISO with dir laid over the tree, keeping the boot records and hybrid partitions
+    autoinstall [--installer autoinstall|preseed|kickstart] --config <file> --out <file> <iso>
+                    Write a new ISO whose installer boots unattended with the given configuration
+    seed --user-data <file> --meta-data <file> [--network-config <file>] --out <file>
+                    Write a cloud-init NoCloud seed ISO labelled cidata
+    seed --from-instance <instance> [--user-data <file>] [--meta-data <file>] --out <file>
+                    Write a seed whose user-data and meta-data carry the instance's hostname and SSH keys
+    virt-xml [--name <name>] [--memory <size>] [--vcpus <n>] [--disk-size <size>] [--disk <file>]
+             [--network network=<name>|bridge=<name>|user|none] [--firmware auto|bios|uefi] [--out <file>] <iso>
+                    Print a libvirt domain that boots the ISO from a CD-ROM, with firmware and devices to suit it
+    serve-http [--listen <host:port>] [--rootfs] [--quiet] <iso>
+                    Serve the ISO's files over HTTP without mounting it, and its live root filesystem under /rootfs/
+    pxe [--listen <host:port>] [--http <host:port>] [--url <url>] [--entry <label>] [--loaders <dir>] [--quiet] <iso>
+                    Netboot the ISO: serve its kernel, initrd and generated PXELINUX and GRUB menus over TFTP,
+                    and the ISO over HTTP for the installer or live system to fetch the rest from
+    ls              List named instances
+    ls [--rootfs] <iso> [path]
+                    List a directory or file inside the ISO, or its live root filesystem
+    ls-iso [--rootfs] <iso> [path]
+                    Same as ls with an ISO
+    cat [--rootfs] <iso> <path>...
+                    Print files from inside the ISO
+    find [--rootfs] [--grep <regexp>] (--all | <iso>) <pattern>
+                    Print paths inside the ISO, or every ISO, that match pattern
+    rename <old> <new>
+                    Rename an instance
+    enter <instance> [command...]
+                    Run a shell or command inside an instance
+    destroy <instance>
+                    Unmount and delete an instance
 
 Flags:
 `, flagSet.Name())
 		flagSet.PrintDefaults()
 		fmt.Fprint(os.Stderr, `
+Environment:
+    ISO2CHROOT_TIMEOUT  Default for --timeout, in the same syntax; --timeout overrides it per op
+`)
+		fmt.Fprint(os.Stderr, "\nExit codes:\n")
+		iso2chroot.WriteExitCodes(os.Stderr)
+		fmt.Fprint(os.Stderr, `
 Examples:
     iso2chroot list
     iso2chroot select 2
     iso2chroot create 1
     iso2chroot --dir /path/to/isos --src /tmp/build-root create 2
+    iso2chroot create --from-lock /tmp/iso2chroot.lock
+    iso2chroot --src ~/rootfs/noble create --extract 3
+    iso2chroot extract 3 /tmp/noble-disc boot casper/vmlinuz
+    iso2chroot extract --rootfs --exclude '*.pyc' --exclude usr/share/doc 3 /tmp/noble-root etc usr
+    iso2chroot info 3
+    iso2chroot extract --boot-image 3 /tmp/noble-esp.img
+    iso2chroot boot-entries --format json 3
+    iso2chroot kernel --out /tmp/noble-kernel 3
+    iso2chroot initrd extract /tmp/noble-kernel/initrd /tmp/initrd
+    iso2chroot initrd repack --compress zstd --out /tmp/initrd.new /tmp/initrd/early /tmp/initrd/main
+    iso2chroot remaster --overlay ./extra --label NOBLE_CUSTOM --out /tmp/noble-custom.iso 3
+    iso2chroot autoinstall --config user-data --out /tmp/noble-unattended.iso 3
+    iso2chroot seed --user-data user-data --meta-data meta-data --out /tmp/seed.iso
+    iso2chroot seed --from-instance jammy --out /tmp/jammy-seed.iso
+    iso2chroot virt-xml --memory 8G --disk-size 40G 3 | virsh define /dev/stdin
+    iso2chroot serve-http --listen :8080 --rootfs 3
+    iso2chroot pxe --loaders ./netboot --http 192.0.2.1:8080 3
+    iso2chroot ls 3 boot/grub
+    iso2chroot cat --rootfs 3 /etc/os-release
+    iso2chroot find --all --rootfs --grep '^VERSION_ID="22.04"$' /usr/lib/os-release
+    iso2chroot create --name jammy 1
+    iso2chroot destroy jammy
+    iso2chroot --wait 1m create --name jammy 1
+    iso2chroot --dry-run --plan-format json create --name jammy 1
+    iso2chroot --yes destroy jammy
+    iso2chroot --timeout load=5s,command=30s list
 `)
 	}
 
 	if err := flagSet.Parse(os.Args[1:]); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
-			os.Exit(0)
+			os.Exit(iso2chroot.ExitOK)
+		}
+		os.Exit(iso2chroot.ExitUsage)
+	}
+
+	if *yes && *noInput {
+		fmt.Fprintln(os.Stderr, "iso2chroot: --yes and --no-input cannot be combined.")
+		os.Exit(iso2chroot.ExitUsage)
+	}
+
+	timeouts := iso2chroot.DefaultTimeouts
+	for _, spec := range []string{os.Getenv("ISO2CHROOT_TIMEOUT"), *timeout} {
+		var err error
+		if timeouts, err = iso2chroot.ParseTimeouts(spec, timeouts); err != nil {
+			fmt.Fprintf(os.Stderr, "iso2chroot: %v\n", err)
+			os.Exit(iso2chroot.ExitUsage)
 		}
-		os.Exit(2)
 	}
 
 	manager := iso2chroot.NewManager(*dir)
+	manager.SetInstanceRoot(*root)
+	manager.SetLockWait(*wait)
+	manager.SetTimeouts(timeouts)
 
 	if *experimentalTUI {
 		if len(flagSet.Args()) > 0 {
 			fmt.Fprintln(os.Stderr, "iso2chroot: experimental TUI cannot be combined with CLI commands.")
-			os.Exit(2)
+			os.Exit(iso2chroot.ExitUsage)
 		}
 		fmt.Fprintln(os.Stderr, "iso2chroot: launching experimental TUI (interface and behavior may change).")
 		menu := tui.NewMenu("iso2chroot — TUI (experimental)", os.Stdin, os.Stdout)
-		iso2chroot.RegisterMenu(menu, manager)
+		iso2chroot.RegisterMenu(menu, manager, iso2chroot.MenuOptions{})
 		if err := menu.Run(); err != nil {
 			fmt.Fprintf(os.Stderr, "iso2chroot: %v\n", err)
-			os.Exit(1)
+			os.Exit(iso2chroot.ExitCode(err))
 		}
 		return
 	}
 
+	var prompter tui.Prompter
+	switch {
+	case *yes:
+		prompter = tui.AssumeYes{}
+	case *noInput || !tui.IsTerminal(os.Stdin):
+		prompter = tui.NoInput{}
+	default:
+		prompter = tui.NewLinePrompter(os.Stdin, os.Stdout)
+	}
+
 	exitCode := iso2chroot.RunCLI(manager, flagSet.Args(), os.Stdout, os.Stderr, iso2chroot.CLIOptions{
-		MountDir: *src,
-		Stdin:    os.Stdin,
+		MountDir:   *src,
+		LockPath:   *lock,
+		Stdin:      os.Stdin,
+		Prompter:   prompter,
+		DryRun:     *dryRun,
+		PlanFormat: *planFormat,
 	})
 	if exitCode != 0 {
 		os.Exit(exitCode)
@@ -1,3 +1,11 @@
 module thatnerdjosh.com/devtools
 
 go 1.25.1
+
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/pierrec/lz4/v4 v4.1.33
+	github.com/ulikunitz/xz v0.5.17
+)
+
+require golang.org/x/sys v0.45.0
@@ -0,0 +1,128 @@
+package isotest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"unicode/utf16"
+)
+
+// Partition tables ISO.Hybrid can embed.
+const (
+	HybridMBR = "mbr"
+	HybridGPT = "gpt"
+)
+
+const (
+	mbrSector = 512
+	// gptEntries is the size of the GPT entry array, which starts in
+	// 512-byte sector 2.
+	gptEntries     = 128
+	gptEntrySize   = 128
+	gptFirstUsable = 64
+)
+
+// GPT partition type GUIDs, in mixed-endian on-disk order.
+var (
+	gptTypeBasicData = guid(0xEBD0A0A2, 0xB9E5, 0x4433, [8]byte{0x87, 0xC0, 0x68, 0xB6, 0xB7, 0x26, 0x99, 0xC7})
+	gptTypeESP       = guid(0xC12A7328, 0xF81F, 0x11D2, [8]byte{0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B})
+)
+
+func guid(a uint32, b, c uint16, d [8]byte) []byte {
+	g := make([]byte, 16)
+	binary.LittleEndian.PutUint32(g, a)
+	binary.LittleEndian.PutUint16(g[4:], b)
+	binary.LittleEndian.PutUint16(g[6:], c)
+	copy(g[8:], d[:])
+	return g
+}
+
+// hybridPartition is a partition of an embedded table, in 512-byte sectors.
+type hybridPartition struct {
+	name        string
+	mbrType     byte
+	gptType     []byte
+	start, size uint32
+}
+
+// partitions returns the partitions of the embedded table: one covering the
+// image and, with an EFI boot image, an EFI system partition over it.
+func (w *isoWriter) partitions() []hybridPartition {
+	total := w.sectors * (sectorSize / mbrSector)
+	parts := []hybridPartition{{name: "ISO9660", mbrType: 0x17, gptType: gptTypeBasicData, start: gptFirstUsable, size: total - gptFirstUsable}}
+	if w.iso.Hybrid == HybridMBR {
+		parts[0].start, parts[0].size = 0, total
+	}
+	if w.iso.EFIBoot != "" {
+		image := w.lookup(w.iso.EFIBoot)
+		parts = append(parts, hybridPartition{
+			name:    "Appended2",
+			mbrType: 0xEF,
+			gptType: gptTypeESP,
+			start:   w.fileLBA[image] * (sectorSize / mbrSector),
+			size:    uint32((len(image.file.Data) + mbrSector - 1) / mbrSector),
+		})
+	}
+	return parts
+}
+
+// partitionTable writes the MBR, and for HybridGPT the GPT without a
+// backup copy, into the system area of img.
+func (w *isoWriter) partitionTable(img []byte) {
+	parts := w.partitions()
+	mbr := img[:mbrSector]
+	mbr[510], mbr[511] = 0x55, 0xAA
+	entry := func(i int, active bool, typ byte, start, size uint32) {
+		e := mbr[446+16*i:]
+		if active {
+			e[0] = 0x80
+		}
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:], start)
+		binary.LittleEndian.PutUint32(e[12:], size)
+	}
+	if w.iso.Hybrid == HybridMBR {
+		for i, p := range parts {
+			entry(i, i == 0, p.mbrType, p.start, p.size)
+		}
+		return
+	}
+
+	total := w.sectors * (sectorSize / mbrSector)
+	entry(0, false, 0xEE, 1, total-1)
+	entries := img[2*mbrSector : 2*mbrSector+gptEntries*gptEntrySize]
+	for i, p := range parts {
+		e := entries[i*gptEntrySize:]
+		copy(e, p.gptType)
+		copy(e[16:], guid(uint32(i+1), 0x150C, 0x4B6F, [8]byte{'i', 's', 'o', 't', 'e', 's', 't', 0}))
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.start))
+		binary.LittleEndian.PutUint64(e[40:], uint64(p.start+p.size-1))
+		for j, u := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], u)
+		}
+	}
+
+	header := img[mbrSector : mbrSector+92]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint32(header[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:], 92)
+	binary.LittleEndian.PutUint64(header[24:], 1)
+	binary.LittleEndian.PutUint64(header[32:], uint64(total-1))
+	binary.LittleEndian.PutUint64(header[40:], gptFirstUsable)
+	binary.LittleEndian.PutUint64(header[48:], uint64(total-1))
+	copy(header[56:], guid(0x150C0000, 0, 0, [8]byte{'i', 's', 'o', 't', 'e', 's', 't', 0}))
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], gptEntries)
+	binary.LittleEndian.PutUint32(header[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header))
+}
+
+// checkHybrid validates ISO.Hybrid.
+func (iso ISO) checkHybrid() error {
+	switch iso.Hybrid {
+	case "", HybridMBR, HybridGPT:
+		return nil
+	}
+	return fmt.Errorf("isotest: unknown hybrid partition table %q", iso.Hybrid)
+}
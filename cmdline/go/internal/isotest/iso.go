@@ -0,0 +1,774 @@
+package isotest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize   = 2048
+	systemArea   = 16
+	maxRecord    = 255
+	defaultVolID = "ISOTEST"
+
+	// DefaultRootFSPath is where ISO.RootFS is stored unless RootFSPath says otherwise.
+	DefaultRootFSPath = "casper/filesystem.squashfs"
+	// DiskInfoPath is where ISO.DiskInfo is stored.
+	DiskInfoPath = ".disk/info"
+)
+
+// El Torito platform identifiers.
+const (
+	PlatformBIOS = 0x00
+	PlatformEFI  = 0xEF
+)
+
+// ISO describes an ISO9660 image to generate.
+type ISO struct {
+	// VolumeID is the volume label, at most 32 characters. It defaults to ISOTEST.
+	VolumeID  string
+	Publisher string
+	Files     []File
+	// RockRidge adds POSIX names, modes, owners, timestamps, symlinks and
+	// device nodes to the primary directory tree.
+	RockRidge bool
+	// Joliet adds a second directory tree with Unicode names.
+	Joliet bool
+	// DiskInfo, when set, is stored at .disk/info as on Debian and Ubuntu media.
+	DiskInfo string
+	// RootFS, when set, is packed as a squashfs image at RootFSPath, like the
+	// live root filesystem of an installer.
+	RootFS     *Squashfs
+	RootFSPath string
+	// BIOSBoot and EFIBoot name files of the image to list in an El Torito boot
+	// catalog as no-emulation BIOS and EFI boot images.
+	BIOSBoot string
+	EFIBoot  string
+	// ModTime stamps the volume descriptors. It defaults to a fixed date.
+	ModTime time.Time
+	// UDF, when set, adds a UDF filesystem.
+	UDF *UDF
+	// Hybrid embeds a partition table in the system area so the image also
+	// boots from a USB stick: HybridMBR or HybridGPT. The first partition
+	// covers the image; with EFIBoot set a second, EFI system partition
+	// covers the EFI boot image.
+	Hybrid string
+}
+
+// WriteISO generates iso and writes it to dir/name, returning the file's path.
+// It fails the test on error.
+func WriteISO(t testing.TB, dir, name string, iso ISO) string {
+	t.Helper()
+	data, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("generate ISO %s: %v", name, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write ISO %s: %v", path, err)
+	}
+	return path
+}
+
+// isoTree is one directory hierarchy of the image: the primary ISO9660 tree or
+// the Joliet tree. Both describe the same nodes and share file data.
+type isoTree struct {
+	joliet   bool
+	names    map[*node][]byte
+	children map[*node][]*node
+	// dirs lists directories in path table order.
+	dirs    []*node
+	dirNum  map[*node]int
+	extent  map[*node]uint32
+	size    map[*node]uint32
+	pathLen uint32
+	lPath   uint32
+	mPath   uint32
+}
+
+type isoWriter struct {
+	iso     ISO
+	root    *node
+	primary *isoTree
+	joliet  *isoTree
+	fileLBA map[*node]uint32
+	// links counts the hard links to each file.
+	links   map[*node]int
+	catalog uint32
+	sectors uint32
+	modTime time.Time
+	// udf writes the UDF filesystem, if any. Without ISO9660 trees primary is nil.
+	udf *udfWriter
+}
+
+// Bytes generates the image.
+func (iso ISO) Bytes() ([]byte, error) {
+	files := append([]File(nil), iso.Files...)
+	if iso.DiskInfo != "" {
+		files = append(files, Text(DiskInfoPath, iso.DiskInfo))
+	}
+	if iso.RootFS != nil {
+		data, err := iso.RootFS.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		p := iso.RootFSPath
+		if p == "" {
+			p = DefaultRootFSPath
+		}
+		files = append(files, File{Path: p, Data: data})
+	}
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	if err := iso.checkHybrid(); err != nil {
+		return nil, err
+	}
+	if len(iso.VolumeID) > 32 {
+		return nil, fmt.Errorf("isotest: volume ID %q is longer than 32 characters", iso.VolumeID)
+	}
+
+	w := &isoWriter{iso: iso, root: root, fileLBA: make(map[*node]uint32), links: linkCounts(root), modTime: iso.ModTime}
+	if w.modTime.IsZero() {
+		w.modTime = defaultModTime
+	}
+	volID := iso.VolumeID
+	if volID == "" {
+		volID = defaultVolID
+	}
+	if iso.UDF != nil {
+		udfRoot := root
+		if iso.UDF.Files != nil {
+			if udfRoot, err = buildTree(iso.UDF.Files); err != nil {
+				return nil, err
+			}
+		}
+		if iso.UDF.Only && w.bootable() {
+			return nil, fmt.Errorf("isotest: El Torito boot needs the ISO9660 volume descriptors")
+		}
+		w.udf = newUDFWriter(*iso.UDF, volID, udfRoot, w.modTime)
+	}
+	if iso.UDF == nil || !iso.UDF.Only {
+		w.primary = w.newTree(false)
+		if iso.Joliet {
+			w.joliet = w.newTree(true)
+		}
+	}
+	if err := w.layout(); err != nil {
+		return nil, err
+	}
+	return w.write()
+}
+
+func (w *isoWriter) newTree(joliet bool) *isoTree {
+	t := &isoTree{
+		joliet:   joliet,
+		names:    make(map[*node][]byte),
+		children: make(map[*node][]*node),
+		dirNum:   make(map[*node]int),
+		extent:   make(map[*node]uint32),
+		size:     make(map[*node]uint32),
+	}
+	w.root.walk(func(n *node) {
+		if !n.isDir() {
+			return
+		}
+		used := make(map[string]bool)
+		var kids []*node
+		for _, c := range n.children {
+			if (joliet || !w.iso.RockRidge) && !c.isDir() && !c.file.Mode.IsRegular() {
+				// Only Rock Ridge can describe symlinks and special files.
+				continue
+			}
+			var name []byte
+			if joliet {
+				name = jolietName(c.name, c.isDir())
+			} else {
+				name = []byte(uniqueISOName(c.name, c.isDir(), used))
+			}
+			t.names[c] = name
+			kids = append(kids, c)
+		}
+		sort.Slice(kids, func(i, j int) bool {
+			return bytes.Compare(t.names[kids[i]], t.names[kids[j]]) < 0
+		})
+		t.children[n] = kids
+	})
+
+	// Path tables list directories level by level, ordered by parent number
+	// and then by name, which a breadth-first walk of sorted children yields.
+	queue := []*node{w.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		t.dirs = append(t.dirs, n)
+		t.dirNum[n] = len(t.dirs)
+		for _, c := range t.children[n] {
+			if c.isDir() {
+				queue = append(queue, c)
+			}
+		}
+	}
+	for _, d := range t.dirs {
+		nameLen := uint32(len(t.names[d]))
+		if d == w.root {
+			nameLen = 1
+		}
+		t.pathLen += 8 + nameLen + nameLen%2
+	}
+	return t
+}
+
+// layout assigns sectors to every structure of the image.
+func (w *isoWriter) layout() error {
+	next := uint32(systemArea)
+	if w.primary != nil {
+		next++ // primary volume descriptor
+		if w.bootable() {
+			next++ // boot record
+		}
+		if w.joliet != nil {
+			next++ // supplementary volume descriptor
+		}
+		next++ // terminator
+	}
+	if w.udf != nil {
+		var err error
+		if next, err = w.udf.reserveDescriptors(next); err != nil {
+			return err
+		}
+	}
+	if w.bootable() {
+		w.catalog = next
+		next++
+	}
+
+	trees := w.trees()
+	for _, t := range trees {
+		sectors := (t.pathLen + sectorSize - 1) / sectorSize
+		t.lPath = next
+		next += sectors
+		t.mPath = next
+		next += sectors
+	}
+	for _, t := range trees {
+		for _, d := range t.dirs {
+			size, err := w.dirSize(t, d)
+			if err != nil {
+				return err
+			}
+			t.extent[d] = next
+			t.size[d] = size
+			next += size / sectorSize
+		}
+	}
+
+	var err error
+	w.root.walk(func(n *node) {
+		if !n.file.Mode.IsRegular() || n.link != nil || err != nil {
+			return
+		}
+		if len(n.file.Data) == 0 {
+			return
+		}
+		if uint64(len(n.file.Data)) > 1<<32-1 {
+			err = fmt.Errorf("isotest: %s is too large", n.file.Path)
+			return
+		}
+		w.fileLBA[n] = next
+		next += uint32((len(n.file.Data) + sectorSize - 1) / sectorSize)
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{w.iso.BIOSBoot, w.iso.EFIBoot} {
+		if p != "" && w.lookup(p) == nil {
+			return fmt.Errorf("isotest: boot image %s is not a regular file in the image", p)
+		}
+	}
+	if w.udf != nil {
+		if next, err = w.udf.layout(next, w.fileLBA); err != nil {
+			return err
+		}
+	}
+	w.sectors = next
+	return nil
+}
+
+// trees returns the ISO9660 directory trees of the image.
+func (w *isoWriter) trees() []*isoTree {
+	var trees []*isoTree
+	if w.primary != nil {
+		trees = append(trees, w.primary)
+	}
+	if w.joliet != nil {
+		trees = append(trees, w.joliet)
+	}
+	return trees
+}
+
+func (w *isoWriter) bootable() bool {
+	return w.iso.BIOSBoot != "" || w.iso.EFIBoot != ""
+}
+
+// lookup finds the regular file at p.
+func (w *isoWriter) lookup(p string) *node {
+	p = strings.Trim(filepath.ToSlash(filepath.Clean("/"+p)), "/")
+	var found *node
+	w.root.walk(func(n *node) {
+		if n.file.Path == p && n.file.Mode.IsRegular() {
+			found = n
+		}
+	})
+	return found
+}
+
+// dirSize returns the size of d's directory extent: its records packed into
+// sectors without crossing sector boundaries.
+func (w *isoWriter) dirSize(t *isoTree, d *node) (uint32, error) {
+	var size uint32
+	add := func(n int) {
+		if size%sectorSize+uint32(n) > sectorSize {
+			size += sectorSize - size%sectorSize
+		}
+		size += uint32(n)
+	}
+	for _, rec := range w.records(t, d) {
+		if len(rec) > maxRecord {
+			return 0, fmt.Errorf("isotest: directory record for %s is %d bytes; shorten the name or symlink target", d.file.Path, len(rec))
+		}
+		add(len(rec))
+	}
+	if size == 0 || size%sectorSize != 0 {
+		size += sectorSize - size%sectorSize
+	}
+	return size, nil
+}
+
+// records returns the directory records of d, starting with "." and "..".
+// Extent locations are filled in from the current layout, so it is called
+// once to size the directory and again to write it.
+func (w *isoWriter) records(t *isoTree, d *node) [][]byte {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	recs := [][]byte{
+		w.record(t, []byte{0}, d, t.extent[d], t.size[d], w.selfSU(t, d, d == w.root)),
+		w.record(t, []byte{1}, parent, t.extent[parent], t.size[parent], w.selfSU(t, parent, false)),
+	}
+	for _, c := range t.children[d] {
+		var lba, size uint32
+		if c.isDir() {
+			lba, size = t.extent[c], t.size[c]
+		} else if c.file.Mode.IsRegular() {
+			data := c
+			if c.link != nil {
+				// Hard links share the extent of the file they point at.
+				data = c.link
+			}
+			lba, size = w.fileLBA[data], uint32(len(data.file.Data))
+		}
+		recs = append(recs, w.record(t, t.names[c], c, lba, size, w.entrySU(t, c)))
+	}
+	return recs
+}
+
+func (w *isoWriter) record(t *isoTree, name []byte, n *node, lba, size uint32, su []byte) []byte {
+	length := 33 + len(name)
+	if len(name)%2 == 0 {
+		length++
+	}
+	length += len(su)
+	if length%2 != 0 {
+		length++
+	}
+	rec := make([]byte, length)
+	rec[0] = byte(min(length, 255))
+	putBoth32(rec[2:], lba)
+	putBoth32(rec[10:], size)
+	putRecordTime(rec[18:], n.file.ModTime)
+	if n.isDir() {
+		rec[25] = 0x02
+	}
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	suStart := 33 + len(name)
+	if len(name)%2 == 0 {
+		suStart++
+	}
+	copy(rec[suStart:], su)
+	return rec
+}
+
+// selfSU returns the System Use area of a "." or ".." record.
+func (w *isoWriter) selfSU(t *isoTree, n *node, root bool) []byte {
+	if t.joliet || !w.iso.RockRidge {
+		return nil
+	}
+	var su []byte
+	if root {
+		su = append(su, 'S', 'P', 7, 1, 0xBE, 0xEF, 0)
+		id, desc, src := "RRIP_1991A", "ROCK RIDGE", "ISOTEST"
+		su = append(su, 'E', 'R', byte(8+len(id)+len(desc)+len(src)), 1, byte(len(id)), byte(len(desc)), byte(len(src)), 1)
+		su = append(su, id...)
+		su = append(su, desc...)
+		su = append(su, src...)
+	}
+	su = append(su, w.px(n)...)
+	su = append(su, tf(n.file.ModTime)...)
+	return su
+}
+
+// entrySU returns the Rock Ridge System Use area of a named entry.
+func (w *isoWriter) entrySU(t *isoTree, n *node) []byte {
+	if t.joliet || !w.iso.RockRidge {
+		return nil
+	}
+	su := w.px(n)
+	su = append(su, tf(n.file.ModTime)...)
+	su = append(su, 'N', 'M', byte(5+len(n.name)), 1, 0)
+	su = append(su, n.name...)
+	if n.file.Mode&fs.ModeSymlink != 0 {
+		su = append(su, sl(n.file.Target)...)
+	}
+	if n.file.Mode&fs.ModeDevice != 0 {
+		pn := make([]byte, 20)
+		copy(pn, []byte{'P', 'N', 20, 1})
+		putBoth32(pn[4:], n.file.Major)
+		putBoth32(pn[12:], n.file.Minor)
+		su = append(su, pn...)
+	}
+	return su
+}
+
+func (w *isoWriter) px(n *node) []byte {
+	nlink := uint32(1)
+	if n.link != nil {
+		n = n.link
+	}
+	nlink += uint32(w.links[n])
+	if n.isDir() {
+		nlink = 2
+		for _, c := range n.children {
+			if c.isDir() {
+				nlink++
+			}
+		}
+	}
+	px := make([]byte, 36)
+	copy(px, []byte{'P', 'X', 36, 1})
+	putBoth32(px[4:], posixMode(n.file.Mode))
+	putBoth32(px[12:], nlink)
+	putBoth32(px[20:], n.file.UID)
+	putBoth32(px[28:], n.file.GID)
+	return px
+}
+
+func tf(t time.Time) []byte {
+	entry := []byte{'T', 'F', 12, 1, 0x02, 0, 0, 0, 0, 0, 0, 0}
+	putRecordTime(entry[5:], t)
+	return entry
+}
+
+// sl encodes a symlink target as Rock Ridge SL components.
+func sl(target string) []byte {
+	var comps []byte
+	parts := strings.Split(target, "/")
+	if strings.HasPrefix(target, "/") {
+		comps = append(comps, 0x08, 0)
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		switch part {
+		case "":
+			continue
+		case ".":
+			comps = append(comps, 0x02, 0)
+		case "..":
+			comps = append(comps, 0x04, 0)
+		default:
+			comps = append(comps, 0, byte(len(part)))
+			comps = append(comps, part...)
+		}
+	}
+	return append([]byte{'S', 'L', byte(5 + len(comps)), 1, 0}, comps...)
+}
+
+func (w *isoWriter) write() ([]byte, error) {
+	img := make([]byte, int(w.sectors)*sectorSize)
+	sector := func(n uint32) []byte {
+		return img[int(n)*sectorSize : int(n+1)*sectorSize]
+	}
+
+	if w.udf != nil {
+		w.udf.write(img, w.fileLBA)
+	}
+	if w.iso.Hybrid != "" {
+		w.partitionTable(img)
+	}
+	if w.primary == nil {
+		return img, nil
+	}
+
+	next := uint32(systemArea)
+	w.volumeDescriptor(sector(next), w.primary)
+	next++
+	if w.bootable() {
+		boot := sector(next)
+		boot[0] = 0
+		copy(boot[1:], "CD001")
+		boot[6] = 1
+		copy(boot[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(boot[71:], w.catalog)
+		next++
+	}
+	if w.joliet != nil {
+		w.volumeDescriptor(sector(next), w.joliet)
+		next++
+	}
+	term := sector(next)
+	term[0] = 255
+	copy(term[1:], "CD001")
+	term[6] = 1
+
+	if w.bootable() {
+		w.bootCatalog(sector(w.catalog))
+	}
+
+	for _, t := range w.trees() {
+		w.pathTable(img[int(t.lPath)*sectorSize:], t, binary.LittleEndian)
+		w.pathTable(img[int(t.mPath)*sectorSize:], t, binary.BigEndian)
+		for _, d := range t.dirs {
+			buf := img[int(t.extent[d])*sectorSize:]
+			var off uint32
+			for _, rec := range w.records(t, d) {
+				if off%sectorSize+uint32(len(rec)) > sectorSize {
+					off += sectorSize - off%sectorSize
+				}
+				copy(buf[off:], rec)
+				off += uint32(len(rec))
+			}
+		}
+	}
+
+	for n, lba := range w.fileLBA {
+		copy(img[int(lba)*sectorSize:], n.file.Data)
+	}
+	return img, nil
+}
+
+func (w *isoWriter) volumeDescriptor(d []byte, t *isoTree) {
+	if t.joliet {
+		d[0] = 2
+	} else {
+		d[0] = 1
+	}
+	copy(d[1:], "CD001")
+	d[6] = 1
+
+	volID := w.iso.VolumeID
+	if volID == "" {
+		volID = defaultVolID
+	}
+	text := func(field []byte, s string) {
+		if t.joliet {
+			enc := ucs2(s)
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, enc)
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+	}
+	text(d[8:40], "LINUX")
+	text(d[40:72], volID)
+	putBoth32(d[80:], w.sectors)
+	if t.joliet {
+		copy(d[88:], "%/E")
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], t.pathLen)
+	binary.LittleEndian.PutUint32(d[140:], t.lPath)
+	binary.BigEndian.PutUint32(d[148:], t.mPath)
+	root := w.record(t, []byte{0}, w.root, t.extent[w.root], t.size[w.root], nil)
+	copy(d[156:190], root)
+	text(d[190:318], "")
+	text(d[318:446], w.iso.Publisher)
+	text(d[446:574], "")
+	text(d[574:702], "ISO2CHROOT ISOTEST")
+	text(d[702:739], "")
+	text(d[739:776], "")
+	text(d[776:813], "")
+	stamp := []byte(w.modTime.UTC().Format("20060102150405") + "00")
+	copy(d[813:], stamp)
+	copy(d[830:], stamp)
+	copy(d[847:], "0000000000000000")
+	copy(d[864:], stamp)
+	d[881] = 1
+}
+
+func (w *isoWriter) pathTable(buf []byte, t *isoTree, order binary.ByteOrder) {
+	off := 0
+	for _, d := range t.dirs {
+		name := t.names[d]
+		parent := 1
+		if d != w.root {
+			parent = t.dirNum[d.parent]
+		} else {
+			name = []byte{0}
+		}
+		buf[off] = byte(len(name))
+		order.PutUint32(buf[off+2:], t.extent[d])
+		order.PutUint16(buf[off+6:], uint16(parent))
+		copy(buf[off+8:], name)
+		off += 8 + len(name) + len(name)%2
+	}
+}
+
+func (w *isoWriter) bootCatalog(cat []byte) {
+	type entry struct {
+		platform byte
+		image    *node
+	}
+	var entries []entry
+	if w.iso.BIOSBoot != "" {
+		entries = append(entries, entry{PlatformBIOS, w.lookup(w.iso.BIOSBoot)})
+	}
+	if w.iso.EFIBoot != "" {
+		entries = append(entries, entry{PlatformEFI, w.lookup(w.iso.EFIBoot)})
+	}
+
+	validation := cat[:32]
+	validation[0] = 1
+	validation[1] = entries[0].platform
+	copy(validation[4:28], "ISOTEST")
+	validation[30], validation[31] = 0x55, 0xAA
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(validation[i:])
+	}
+	binary.LittleEndian.PutUint16(validation[28:], -sum)
+
+	bootEntry := func(e []byte, image *node, platform byte) {
+		e[0] = 0x88 // bootable
+		e[1] = 0    // no emulation
+		count := 4  // the 2 KiB a BIOS loader such as isolinux.bin expects
+		if platform == PlatformEFI {
+			count = min((len(image.file.Data)+511)/512, 0xFFFF)
+		}
+		binary.LittleEndian.PutUint16(e[6:], uint16(count))
+		binary.LittleEndian.PutUint32(e[8:], w.fileLBA[image])
+	}
+	bootEntry(cat[32:64], entries[0].image, entries[0].platform)
+	if len(entries) > 1 {
+		header := cat[64:96]
+		header[0] = 0x91 // final section header
+		header[1] = entries[1].platform
+		binary.LittleEndian.PutUint16(header[2:], 1)
+		bootEntry(cat[96:128], entries[1].image, entries[1].platform)
+	}
+}
+
+// uniqueISOName maps name to an ISO9660 level 2 identifier that is not yet in used.
+func uniqueISOName(name string, dir bool, used map[string]bool) string {
+	clean := func(s string, max int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if b.Len() == max {
+				break
+			}
+			if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+				b.WriteRune(r)
+			} else {
+				b.WriteByte('_')
+			}
+		}
+		return b.String()
+	}
+
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+		ext = clean(ext, 8)
+	}
+	limit := 31
+	if !dir {
+		limit = 30 - len(ext)
+	}
+	base = clean(base, limit)
+
+	format := func(base string) string {
+		if dir {
+			return base
+		}
+		return base + "." + ext + ";1"
+	}
+	candidate := format(base)
+	for i := 1; used[candidate]; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		candidate = format(base[:min(len(base), limit-len(suffix))] + suffix)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+func jolietName(name string, dir bool) []byte {
+	if !dir {
+		name += ";1"
+	}
+	enc := ucs2(name)
+	if len(enc) > 128 {
+		enc = enc[:128]
+	}
+	return enc
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(buf[2*i:], u)
+	}
+	return buf
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func putRecordTime(b []byte, t time.Time) {
+	t = t.UTC()
+	b[0] = byte(t.Year() - 1900)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
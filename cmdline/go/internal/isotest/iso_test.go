@@ -0,0 +1,262 @@
+package isotest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// dirRecord is a decoded ISO9660 directory record.
+type dirRecord struct {
+	name   string
+	extent uint32
+	size   uint32
+	dir    bool
+	su     []byte
+}
+
+func readDir(t *testing.T, img []byte, extent, size uint32) []dirRecord {
+	t.Helper()
+	var recs []dirRecord
+	data := img[extent*sectorSize : extent*sectorSize+size]
+	for off := 0; off < len(data); {
+		n := int(data[off])
+		if n == 0 {
+			off += sectorSize - off%sectorSize
+			continue
+		}
+		rec := data[off : off+n]
+		nameLen := int(rec[32])
+		suStart := 33 + nameLen
+		if nameLen%2 == 0 {
+			suStart++
+		}
+		recs = append(recs, dirRecord{
+			name:   string(rec[33 : 33+nameLen]),
+			extent: binary.LittleEndian.Uint32(rec[2:]),
+			size:   binary.LittleEndian.Uint32(rec[10:]),
+			dir:    rec[25]&0x02 != 0,
+			su:     rec[suStart:],
+		})
+		off += n
+	}
+	return recs
+}
+
+// susp returns the System Use entry with the given signature.
+func susp(su []byte, sig string) []byte {
+	for len(su) >= 4 && su[2] >= 4 && int(su[2]) <= len(su) {
+		if string(su[:2]) == sig {
+			return su[:su[2]]
+		}
+		su = su[su[2]:]
+	}
+	return nil
+}
+
+func sampleISO() ISO {
+	return ISO{
+		VolumeID:  "Ubuntu 24.04 LTS amd64",
+		RockRidge: true,
+		Joliet:    true,
+		DiskInfo:  "Ubuntu 24.04 LTS \"Noble Numbat\"",
+		Files: []File{
+			Text("boot/grub/grub.cfg", "menuentry 'Try Ubuntu' {}\n"),
+			Text("isolinux/isolinux.bin", "bios loader"),
+			Text("EFI/boot/bootx64.efi", strings.Repeat("e", 3000)),
+			Symlink("ubuntu", "."),
+			{Path: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5, Minor: 1},
+		},
+		RootFS:   &Squashfs{Files: []File{Text("etc/os-release", "ID=ubuntu\n")}},
+		BIOSBoot: "isolinux/isolinux.bin",
+		EFIBoot:  "EFI/boot/bootx64.efi",
+	}
+}
+
+func TestISOVolumeDescriptors(t *testing.T) {
+	img, err := sampleISO().Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() error = %v", err)
+	}
+	if len(img)%sectorSize != 0 {
+		t.Fatalf("image size %d is not a multiple of the sector size", len(img))
+	}
+
+	var types []byte
+	for s := systemArea; ; s++ {
+		d := img[s*sectorSize : (s+1)*sectorSize]
+		if string(d[1:6]) != "CD001" {
+			t.Fatalf("sector %d has no CD001 magic", s)
+		}
+		types = append(types, d[0])
+		if d[0] == 255 {
+			break
+		}
+	}
+	if !bytes.Equal(types, []byte{1, 0, 2, 255}) {
+		t.Fatalf("descriptor types = %v, want primary, boot record, supplementary, terminator", types)
+	}
+
+	pvd := img[systemArea*sectorSize:]
+	if got := strings.TrimRight(string(pvd[40:72]), " "); got != "Ubuntu 24.04 LTS amd64" {
+		t.Fatalf("volume ID = %q", got)
+	}
+	if got := binary.LittleEndian.Uint32(pvd[80:]); int(got)*sectorSize != len(img) {
+		t.Fatalf("volume space size = %d sectors, image has %d", got, len(img)/sectorSize)
+	}
+	svd := img[(systemArea+2)*sectorSize:]
+	if string(svd[88:91]) != "%/E" {
+		t.Fatalf("Joliet escape sequence = %q", svd[88:91])
+	}
+}
+
+func TestISODirectoryTrees(t *testing.T) {
+	iso := sampleISO()
+	img, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() error = %v", err)
+	}
+	rootOf := func(desc int) (uint32, uint32) {
+		rec := img[desc*sectorSize+156:]
+		return binary.LittleEndian.Uint32(rec[2:]), binary.LittleEndian.Uint32(rec[10:])
+	}
+
+	extent, size := rootOf(systemArea)
+	root := readDir(t, img, extent, size)
+	if root[0].name != "\x00" || root[1].name != "\x01" {
+		t.Fatalf("root starts with %q and %q, want . and ..", root[0].name, root[1].name)
+	}
+	if susp(root[0].su, "SP") == nil || !bytes.Contains(susp(root[0].su, "ER"), []byte("RRIP_1991A")) {
+		t.Fatal("root . record lacks the SP and ER entries announcing Rock Ridge")
+	}
+
+	names := map[string]dirRecord{}
+	for _, rec := range root[2:] {
+		nm := susp(rec.su, "NM")
+		if nm == nil {
+			t.Fatalf("record %q has no NM entry", rec.name)
+		}
+		names[string(nm[5:])] = rec
+	}
+	if rec := names["ubuntu"]; !bytes.Equal(susp(rec.su, "SL"), []byte{'S', 'L', 7, 1, 0, 0x02, 0}) {
+		t.Fatalf("ubuntu symlink SL = %v", susp(rec.su, "SL"))
+	}
+	disk, ok := names[".disk"]
+	if !ok || disk.name != "_DISK" || !disk.dir {
+		t.Fatalf(".disk record = %+v", disk)
+	}
+	info := readDir(t, img, disk.extent, disk.size)[2]
+	if info.name != "INFO.;1" {
+		t.Fatalf("info name = %q, want INFO.;1", info.name)
+	}
+	if got := string(img[info.extent*sectorSize : info.extent*sectorSize+info.size]); got != iso.DiskInfo {
+		t.Fatalf(".disk/info = %q, want %q", got, iso.DiskInfo)
+	}
+
+	dev := names["dev"]
+	console := readDir(t, img, dev.extent, dev.size)[2]
+	pn := susp(console.su, "PN")
+	if pn == nil || binary.LittleEndian.Uint32(pn[4:]) != 5 || binary.LittleEndian.Uint32(pn[12:]) != 1 {
+		t.Fatalf("dev/console PN = %v, want 5:1", pn)
+	}
+	if px := susp(console.su, "PX"); binary.LittleEndian.Uint32(px[4:]) != 0o020600 {
+		t.Fatalf("dev/console mode = %o", binary.LittleEndian.Uint32(px[4:]))
+	}
+
+	extent, size = rootOf(systemArea + 2)
+	var joliet []string
+	for _, rec := range readDir(t, img, extent, size)[2:] {
+		units := make([]uint16, len(rec.name)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16([]byte(rec.name[2*i:]))
+		}
+		joliet = append(joliet, string(utf16.Decode(units)))
+	}
+	// Joliet cannot describe the symlink or device node.
+	want := []string{".disk", "EFI", "boot", "casper", "dev", "isolinux"}
+	if strings.Join(joliet, ",") != strings.Join(want, ",") {
+		t.Fatalf("Joliet root = %q, want %q", joliet, want)
+	}
+}
+
+func TestISOBootCatalog(t *testing.T) {
+	iso := sampleISO()
+	img, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() error = %v", err)
+	}
+	boot := img[(systemArea+1)*sectorSize:]
+	if !strings.HasPrefix(string(boot[7:]), "EL TORITO SPECIFICATION") {
+		t.Fatalf("boot record system ID = %q", boot[7:39])
+	}
+	cat := img[binary.LittleEndian.Uint32(boot[71:])*sectorSize:]
+
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(cat[i:])
+	}
+	if cat[0] != 1 || sum != 0 || cat[30] != 0x55 || cat[31] != 0xAA {
+		t.Fatalf("invalid validation entry % x", cat[:32])
+	}
+
+	image := func(e []byte) string {
+		lba := binary.LittleEndian.Uint32(e[8:])
+		return string(img[lba*sectorSize : lba*sectorSize+11])
+	}
+	if cat[32] != 0x88 || image(cat[32:]) != "bios loader" {
+		t.Fatalf("default entry % x does not boot isolinux.bin", cat[32:44])
+	}
+	if cat[64] != 0x91 || cat[65] != PlatformEFI {
+		t.Fatalf("section header % x, want a final EFI section", cat[64:68])
+	}
+	if got := binary.LittleEndian.Uint16(cat[102:]); got != 6 {
+		t.Fatalf("EFI sector count = %d, want 6", got)
+	}
+	if image(cat[96:]) != "eeeeeeeeeee" {
+		t.Fatal("EFI entry does not point at bootx64.efi")
+	}
+}
+
+func TestISOErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		iso  ISO
+		want string
+	}{
+		{name: "duplicate", iso: ISO{Files: []File{Text("a", "1"), Text("a", "2")}}, want: "duplicate path a"},
+		{name: "file as parent", iso: ISO{Files: []File{Text("a", "1"), Text("a/b", "2")}}, want: "a is not a directory"},
+		{name: "missing boot image", iso: ISO{BIOSBoot: "isolinux/isolinux.bin"}, want: "boot image"},
+		{name: "long volume ID", iso: ISO{VolumeID: strings.Repeat("x", 33)}, want: "longer than 32"},
+		{name: "unknown hybrid", iso: ISO{Hybrid: "apm"}, want: "unknown hybrid"},
+		{name: "UDF-only boot", iso: ISO{Files: []File{Text("boot.img", "x")}, BIOSBoot: "boot.img", UDF: &UDF{Only: true}}, want: "El Torito"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.iso.Bytes(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Bytes() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueISOName(t *testing.T) {
+	used := map[string]bool{}
+	for _, tt := range []struct {
+		name string
+		dir  bool
+		want string
+	}{
+		{"vmlinuz", false, "VMLINUZ.;1"},
+		{"initrd.gz", false, "INITRD.GZ;1"},
+		{"Initrd.GZ", false, "INITRD~1.GZ;1"},
+		{".disk", true, "_DISK"},
+		{"filesystem.manifest-remove", false, "FILESYSTEM.MANIFEST;1"},
+	} {
+		if got := uniqueISOName(tt.name, tt.dir, used); got != tt.want {
+			t.Errorf("uniqueISOName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
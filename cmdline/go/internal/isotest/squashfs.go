@@ -0,0 +1,665 @@
+package isotest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	squashfsMagic        = 0x73717368
+	squashfsSuperSize    = 96
+	metadataSize         = 8192
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+	invalidTable         = ^uint64(0)
+	noFragment           = ^uint32(0)
+	noXattr              = ^uint32(0)
+	defaultBlockSize     = 128 << 10
+)
+
+// Superblock flags.
+const (
+	flagUncompressedInodes    = 0x0001
+	flagUncompressedData      = 0x0002
+	flagUncompressedFragments = 0x0008
+	flagNoFragments           = 0x0010
+	flagNoXattrs              = 0x0200
+	flagCompressorOptions     = 0x0400
+	flagUncompressedIDs       = 0x0800
+)
+
+// Inode types. Extended types follow the basic ones at an offset of 7.
+const (
+	inodeDir = iota + 1
+	inodeFile
+	inodeSymlink
+	inodeBlockDev
+	inodeCharDev
+	inodeFifo
+	inodeSocket
+	inodeExtended = 7
+)
+
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// Compression selects how a squashfs image compresses its blocks.
+type Compression int
+
+const (
+	// Gzip compresses blocks with zlib, squashfs' default.
+	Gzip Compression = iota
+	// Uncompressed stores every block as is.
+	Uncompressed
+	Xz
+	LZ4
+	Zstd
+)
+
+// compressorIDs maps a Compression to the id stored in the superblock.
+// Uncompressed images still name a compressor, as mksquashfs does.
+var compressorIDs = map[Compression]uint16{Gzip: 1, Uncompressed: 1, Xz: 4, LZ4: 5, Zstd: 6}
+
+// Squashfs describes a squashfs 4.0 image to generate.
+type Squashfs struct {
+	Files       []File
+	Compression Compression
+	// BlockSize is the data block size, a power of two between 4 KiB and
+	// 1 MiB. It defaults to 128 KiB.
+	BlockSize int
+	// Fragments packs file tails shorter than a block into shared fragment
+	// blocks, as mksquashfs does by default.
+	Fragments bool
+	// ModTime stamps the superblock. It defaults to a fixed date.
+	ModTime time.Time
+}
+
+// sqfsInode is the position and number of a written inode.
+type sqfsInode struct {
+	number uint32
+	ref    uint64
+	typ    uint16
+}
+
+type squashfsWriter struct {
+	fs        Squashfs
+	blockSize int
+	compress  func([]byte) []byte
+	dataStart int
+	data      bytes.Buffer
+	inodes    *metadataWriter
+	dirs      *metadataWriter
+	ids       []uint32
+	idIndex   map[uint32]uint16
+	numbers   map[*node]uint32
+	written   map[*node]sqfsInode
+	links     map[*node]int
+
+	fragment  []byte
+	fragments [][2]uint64 // start and size word of each fragment block
+
+	xattrKV  *metadataWriter
+	xattrIDs [][3]uint64 // reference, count and size of each inode's xattrs
+}
+
+// Bytes generates the image.
+func (s Squashfs) Bytes() ([]byte, error) {
+	root, err := buildTree(s.Files)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := s.BlockSize
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	if blockSize < 4<<10 || blockSize > 1<<20 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("isotest: invalid squashfs block size %d", blockSize)
+	}
+	compress, err := compressor(s.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &squashfsWriter{
+		fs:        s,
+		blockSize: blockSize,
+		compress:  compress,
+		dataStart: squashfsSuperSize,
+		inodes:    &metadataWriter{compress: compress},
+		dirs:      &metadataWriter{compress: compress},
+		xattrKV:   &metadataWriter{compress: compress},
+		idIndex:   make(map[uint32]uint16),
+		numbers:   make(map[*node]uint32),
+		written:   make(map[*node]sqfsInode),
+		links:     linkCounts(root),
+	}
+	if s.Compression == LZ4 {
+		// LZ4 images always carry compressor options, stored as an
+		// uncompressed metadata block after the superblock.
+		w.dataStart += 2 + 8
+	}
+
+	// Inodes are numbered children before their directory, so the root
+	// comes last. Hard links share the number of the file they point at.
+	var count uint32
+	var number func(n *node)
+	number = func(n *node) {
+		for _, c := range n.children {
+			number(c)
+		}
+		if n.link == nil {
+			count++
+			w.numbers[n] = count
+		}
+	}
+	number(root)
+
+	rootInode, err := w.writeNode(root, count+1)
+	if err != nil {
+		return nil, err
+	}
+	w.flushFragment()
+	return w.assemble(rootInode, count)
+}
+
+// compressor returns the function compressing blocks for c, or nil when
+// blocks are stored uncompressed. Callers keep the original block when the
+// result is not smaller.
+func compressor(c Compression) (func([]byte) []byte, error) {
+	switch c {
+	case Uncompressed:
+		return nil, nil
+	case Gzip:
+		return func(b []byte) []byte {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			zw.Write(b)
+			zw.Close()
+			return buf.Bytes()
+		}, nil
+	case Xz:
+		return func(b []byte) []byte {
+			var buf bytes.Buffer
+			xw, err := xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(&buf)
+			if err != nil {
+				return b
+			}
+			xw.Write(b)
+			xw.Close()
+			return buf.Bytes()
+		}, nil
+	case LZ4:
+		return func(b []byte) []byte {
+			out := make([]byte, lz4.CompressBlockBound(len(b)))
+			n, err := lz4.CompressBlock(b, out, nil)
+			if err != nil || n == 0 {
+				return b
+			}
+			return out[:n]
+		}, nil
+	case Zstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) []byte {
+			return enc.EncodeAll(b, nil)
+		}, nil
+	}
+	return nil, fmt.Errorf("isotest: unsupported squashfs compression %d", c)
+}
+
+// writeNode writes n and, for directories, everything below it, returning
+// n's inode. Hard links resolve to the inode of their target.
+func (w *squashfsWriter) writeNode(n *node, parent uint32) (sqfsInode, error) {
+	if n.link != nil {
+		n = n.link
+	}
+	if inode, ok := w.written[n]; ok {
+		return inode, nil
+	}
+
+	f := n.file
+	number := w.numbers[n]
+	nlink := uint32(1 + w.links[n])
+	xattr, err := w.writeXattrs(n)
+	if err != nil {
+		return sqfsInode{}, err
+	}
+	extended := xattr != noXattr
+	var body []byte
+	var typ uint16
+	le := binary.LittleEndian
+
+	switch {
+	case n.isDir():
+		typ = inodeDir
+		var children []sqfsInode
+		for _, c := range n.children {
+			child, err := w.writeNode(c, number)
+			if err != nil {
+				return sqfsInode{}, err
+			}
+			children = append(children, child)
+		}
+		block, offset := w.dirs.position()
+		listing := w.dirListing(n, children)
+		w.dirs.write(listing)
+		if len(listing)+3 > 0xFFFF {
+			return sqfsInode{}, fmt.Errorf("isotest: directory %s is too large", f.Path)
+		}
+		nlink = 2
+		for _, c := range n.children {
+			if c.isDir() {
+				nlink++
+			}
+		}
+		if extended {
+			body = le.AppendUint32(body, nlink)
+			body = le.AppendUint32(body, uint32(len(listing)+3))
+			body = le.AppendUint32(body, uint32(block))
+			body = le.AppendUint32(body, parent)
+			body = le.AppendUint16(body, 0) // no directory index
+			body = le.AppendUint16(body, uint16(offset))
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, uint32(block))
+			body = le.AppendUint32(body, nlink)
+			body = le.AppendUint16(body, uint16(len(listing)+3))
+			body = le.AppendUint16(body, uint16(offset))
+			body = le.AppendUint32(body, parent)
+		}
+
+	case f.Mode.IsRegular():
+		typ = inodeFile
+		extended = extended || nlink > 1
+		if uint64(len(f.Data)) > 1<<32-1 {
+			return sqfsInode{}, fmt.Errorf("isotest: %s is too large", f.Path)
+		}
+		start := w.dataStart + w.data.Len()
+		full := len(f.Data)
+		fragIndex, fragOffset := noFragment, uint32(0)
+		if tail := len(f.Data) % w.blockSize; w.fs.Fragments && tail > 0 {
+			full -= tail
+			fragIndex, fragOffset = w.addFragment(f.Data[full:])
+		}
+		var sizes []uint32
+		for off := 0; off < full; off += w.blockSize {
+			sizes = append(sizes, w.writeBlock(f.Data[off:min(off+w.blockSize, full)]))
+		}
+		if extended {
+			body = le.AppendUint64(body, uint64(start))
+			body = le.AppendUint64(body, uint64(len(f.Data)))
+			body = le.AppendUint64(body, 0) // sparse bytes
+			body = le.AppendUint32(body, nlink)
+			body = le.AppendUint32(body, fragIndex)
+			body = le.AppendUint32(body, fragOffset)
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, uint32(start))
+			body = le.AppendUint32(body, fragIndex)
+			body = le.AppendUint32(body, fragOffset)
+			body = le.AppendUint32(body, uint32(len(f.Data)))
+		}
+		for _, size := range sizes {
+			body = le.AppendUint32(body, size)
+		}
+
+	case f.Mode&fs.ModeSymlink != 0:
+		typ = inodeSymlink
+		body = le.AppendUint32(body, nlink)
+		body = le.AppendUint32(body, uint32(len(f.Target)))
+		body = append(body, f.Target...)
+		if extended {
+			body = le.AppendUint32(body, xattr)
+		}
+
+	case f.Mode&fs.ModeDevice != 0:
+		typ = inodeBlockDev
+		if f.Mode&fs.ModeCharDevice != 0 {
+			typ = inodeCharDev
+		}
+		body = le.AppendUint32(body, nlink)
+		body = le.AppendUint32(body, encodeDev(f.Major, f.Minor))
+		if extended {
+			body = le.AppendUint32(body, xattr)
+		}
+
+	case f.Mode&fs.ModeNamedPipe != 0, f.Mode&fs.ModeSocket != 0:
+		typ = inodeFifo
+		if f.Mode&fs.ModeSocket != 0 {
+			typ = inodeSocket
+		}
+		body = le.AppendUint32(body, nlink)
+		if extended {
+			body = le.AppendUint32(body, xattr)
+		}
+
+	default:
+		return sqfsInode{}, fmt.Errorf("isotest: unsupported file type %v for %s", f.Mode.Type(), f.Path)
+	}
+
+	onDisk := typ
+	if extended {
+		onDisk += inodeExtended
+	}
+	header := make([]byte, 16)
+	le.PutUint16(header[0:], onDisk)
+	le.PutUint16(header[2:], uint16(posixMode(f.Mode)&0o7777))
+	le.PutUint16(header[4:], w.id(f.UID))
+	le.PutUint16(header[6:], w.id(f.GID))
+	le.PutUint32(header[8:], uint32(f.ModTime.Unix()))
+	le.PutUint32(header[12:], number)
+
+	block, offset := w.inodes.position()
+	w.inodes.write(append(header, body...))
+	// Directory entries always carry the basic type.
+	inode := sqfsInode{number: number, ref: uint64(block)<<16 | uint64(offset), typ: typ}
+	w.written[n] = inode
+	return inode, nil
+}
+
+// writeBlock appends one data block, compressed when that makes it smaller,
+// and returns its on-disk size word.
+func (w *squashfsWriter) writeBlock(b []byte) uint32 {
+	if w.compress != nil {
+		if c := w.compress(b); len(c) < len(b) {
+			w.data.Write(c)
+			return uint32(len(c))
+		}
+	}
+	w.data.Write(b)
+	return uint32(len(b)) | dataUncompressed
+}
+
+// addFragment stores a file tail in the current fragment block, starting a
+// new block when it does not fit, and returns where the tail landed.
+func (w *squashfsWriter) addFragment(tail []byte) (index, offset uint32) {
+	if len(w.fragment)+len(tail) > w.blockSize {
+		w.flushFragment()
+	}
+	index, offset = uint32(len(w.fragments)), uint32(len(w.fragment))
+	w.fragment = append(w.fragment, tail...)
+	return index, offset
+}
+
+func (w *squashfsWriter) flushFragment() {
+	if len(w.fragment) == 0 {
+		return
+	}
+	start := w.dataStart + w.data.Len()
+	size := w.writeBlock(w.fragment)
+	w.fragments = append(w.fragments, [2]uint64{uint64(start), uint64(size)})
+	w.fragment = nil
+}
+
+// writeXattrs stores n's extended attributes and returns their index in the
+// xattr id table, or noXattr when it has none.
+func (w *squashfsWriter) writeXattrs(n *node) (uint32, error) {
+	if len(n.file.Xattrs) == 0 {
+		return noXattr, nil
+	}
+	names := make([]string, 0, len(n.file.Xattrs))
+	for name := range n.file.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	block, offset := w.xattrKV.position()
+	var kv []byte
+	for _, name := range names {
+		typ := -1
+		for i, prefix := range xattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				typ = i
+				break
+			}
+		}
+		if typ < 0 {
+			return 0, fmt.Errorf("isotest: xattr %s of %s has no user., trusted. or security. prefix", name, n.file.Path)
+		}
+		suffix := strings.TrimPrefix(name, xattrPrefixes[typ])
+		value := n.file.Xattrs[name]
+		kv = binary.LittleEndian.AppendUint16(kv, uint16(typ))
+		kv = binary.LittleEndian.AppendUint16(kv, uint16(len(suffix)))
+		kv = append(kv, suffix...)
+		kv = binary.LittleEndian.AppendUint32(kv, uint32(len(value)))
+		kv = append(kv, value...)
+	}
+	w.xattrKV.write(kv)
+	w.xattrIDs = append(w.xattrIDs, [3]uint64{uint64(block)<<16 | uint64(offset), uint64(len(names)), uint64(len(kv))})
+	return uint32(len(w.xattrIDs) - 1), nil
+}
+
+// dirListing encodes the directory table entries of n. A new header starts
+// whenever the inodes move to another metadata block, after 256 entries, or
+// when an inode number no longer fits the 16-bit delta.
+func (w *squashfsWriter) dirListing(n *node, children []sqfsInode) []byte {
+	var out []byte
+	for i := 0; i < len(children); {
+		first := children[i]
+		j := i
+		for j < len(children) && j-i < 256 &&
+			children[j].ref>>16 == first.ref>>16 &&
+			int64(children[j].number)-int64(first.number) >= -32768 &&
+			int64(children[j].number)-int64(first.number) <= 32767 {
+			j++
+		}
+		out = binary.LittleEndian.AppendUint32(out, uint32(j-i-1))
+		out = binary.LittleEndian.AppendUint32(out, uint32(first.ref>>16))
+		out = binary.LittleEndian.AppendUint32(out, first.number)
+		for k := i; k < j; k++ {
+			c := children[k]
+			name := n.children[k].name
+			out = binary.LittleEndian.AppendUint16(out, uint16(c.ref&0xFFFF))
+			out = binary.LittleEndian.AppendUint16(out, uint16(int16(int64(c.number)-int64(first.number))))
+			out = binary.LittleEndian.AppendUint16(out, c.typ)
+			out = binary.LittleEndian.AppendUint16(out, uint16(len(name)-1))
+			out = append(out, name...)
+		}
+		i = j
+	}
+	return out
+}
+
+// id returns the id table index of a uid or gid, adding it when new.
+func (w *squashfsWriter) id(v uint32) uint16 {
+	if i, ok := w.idIndex[v]; ok {
+		return i
+	}
+	i := uint16(len(w.ids))
+	w.ids = append(w.ids, v)
+	w.idIndex[v] = i
+	return i
+}
+
+// writeTable appends entries to out as metadata blocks and returns the
+// positions of those blocks.
+func (w *squashfsWriter) writeTable(out *bytes.Buffer, entries []byte) []uint64 {
+	table := &metadataWriter{compress: w.compress}
+	var blocks []uint64
+	start := out.Len()
+	for off := 0; off < len(entries); off += metadataSize {
+		block, _ := table.position()
+		blocks = append(blocks, uint64(start+block))
+		table.write(entries[off:min(off+metadataSize, len(entries))])
+	}
+	out.Write(table.bytes())
+	return blocks
+}
+
+// writeLookupTable appends entries as metadata blocks followed by the index
+// of their positions, and returns the position of the index.
+func (w *squashfsWriter) writeLookupTable(out *bytes.Buffer, entries []byte) int {
+	blocks := w.writeTable(out, entries)
+	index := out.Len()
+	for _, b := range blocks {
+		out.Write(binary.LittleEndian.AppendUint64(nil, b))
+	}
+	return index
+}
+
+// assemble lays out the superblock, data, inode table, directory table and
+// the fragment, id and xattr tables, padding the image to 4 KiB as mksquashfs
+// does.
+func (w *squashfsWriter) assemble(root sqfsInode, count uint32) ([]byte, error) {
+	if len(w.ids) > 0xFFFF {
+		return nil, fmt.Errorf("isotest: too many uids and gids")
+	}
+	le := binary.LittleEndian
+	inodeTable := w.inodes.bytes()
+	dirTable := w.dirs.bytes()
+
+	var out bytes.Buffer
+	out.Write(make([]byte, squashfsSuperSize))
+	if w.fs.Compression == LZ4 {
+		opts := le.AppendUint16(nil, 8|metadataUncompressed)
+		opts = le.AppendUint32(opts, 1) // LZ4_LEGACY format
+		opts = le.AppendUint32(opts, 0) // no high-compression flag
+		out.Write(opts)
+	}
+	out.Write(w.data.Bytes())
+	inodeStart := out.Len()
+	out.Write(inodeTable)
+	dirStart := out.Len()
+	out.Write(dirTable)
+
+	var frags []byte
+	for _, f := range w.fragments {
+		frags = le.AppendUint64(frags, f[0])
+		frags = le.AppendUint32(frags, uint32(f[1]))
+		frags = le.AppendUint32(frags, 0)
+	}
+	// An empty fragment table still gets a position, as mksquashfs gives it.
+	fragStart := w.writeLookupTable(&out, frags)
+
+	var ids []byte
+	for _, id := range w.ids {
+		ids = le.AppendUint32(ids, id)
+	}
+	idStart := w.writeLookupTable(&out, ids)
+
+	xattrStart := invalidTable
+	if len(w.xattrIDs) > 0 {
+		kvStart := out.Len()
+		out.Write(w.xattrKV.bytes())
+		var entries []byte
+		for _, id := range w.xattrIDs {
+			entries = le.AppendUint64(entries, id[0])
+			entries = le.AppendUint32(entries, uint32(id[1]))
+			entries = le.AppendUint32(entries, uint32(id[2]))
+		}
+		blocks := w.writeTable(&out, entries)
+		xattrStart = uint64(out.Len())
+		out.Write(le.AppendUint64(nil, uint64(kvStart)))
+		out.Write(le.AppendUint32(nil, uint32(len(w.xattrIDs))))
+		out.Write(le.AppendUint32(nil, 0))
+		for _, b := range blocks {
+			out.Write(le.AppendUint64(nil, b))
+		}
+	}
+	used := out.Len()
+
+	var flags uint16
+	if len(w.fragments) == 0 {
+		flags |= flagNoFragments
+	}
+	if len(w.xattrIDs) == 0 {
+		flags |= flagNoXattrs
+	}
+	if w.fs.Compression == Uncompressed {
+		flags |= flagUncompressedInodes | flagUncompressedData | flagUncompressedFragments | flagUncompressedIDs
+	}
+	if w.fs.Compression == LZ4 {
+		flags |= flagCompressorOptions
+	}
+	modTime := w.fs.ModTime
+	if modTime.IsZero() {
+		modTime = defaultModTime
+	}
+
+	img := out.Bytes()
+	sb := img[:squashfsSuperSize]
+	le.PutUint32(sb[0:], squashfsMagic)
+	le.PutUint32(sb[4:], count)
+	le.PutUint32(sb[8:], uint32(modTime.Unix()))
+	le.PutUint32(sb[12:], uint32(w.blockSize))
+	le.PutUint32(sb[16:], uint32(len(w.fragments)))
+	le.PutUint16(sb[20:], compressorIDs[w.fs.Compression])
+	le.PutUint16(sb[22:], uint16(bits.TrailingZeros(uint(w.blockSize))))
+	le.PutUint16(sb[24:], flags)
+	le.PutUint16(sb[26:], uint16(len(w.ids)))
+	le.PutUint16(sb[28:], 4)
+	le.PutUint16(sb[30:], 0)
+	le.PutUint64(sb[32:], root.ref)
+	le.PutUint64(sb[40:], uint64(used))
+	le.PutUint64(sb[48:], uint64(idStart))
+	le.PutUint64(sb[56:], xattrStart)
+	le.PutUint64(sb[64:], uint64(inodeStart))
+	le.PutUint64(sb[72:], uint64(dirStart))
+	le.PutUint64(sb[80:], uint64(fragStart))
+	le.PutUint64(sb[88:], invalidTable) // export
+
+	if pad := len(img) % 4096; pad != 0 {
+		img = append(img, make([]byte, 4096-pad)...)
+	}
+	return img, nil
+}
+
+// encodeDev packs a device number the way Linux's new_encode_dev does.
+func encodeDev(major, minor uint32) uint32 {
+	return minor&0xFF | major<<8 | (minor&^0xFF)<<12
+}
+
+// metadataWriter builds a squashfs metadata table: a sequence of blocks of at
+// most 8 KiB, each prefixed by a 16-bit length word.
+type metadataWriter struct {
+	compress func([]byte) []byte
+	out      bytes.Buffer
+	pending  []byte
+}
+
+// position returns where the next byte written will land: the offset of its
+// metadata block from the start of the table and its offset within the
+// uncompressed block.
+func (m *metadataWriter) position() (block, offset int) {
+	return m.out.Len(), len(m.pending)
+}
+
+func (m *metadataWriter) write(b []byte) {
+	m.pending = append(m.pending, b...)
+	for len(m.pending) >= metadataSize {
+		m.flush(m.pending[:metadataSize])
+		m.pending = m.pending[metadataSize:]
+	}
+}
+
+func (m *metadataWriter) flush(b []byte) {
+	if m.compress != nil {
+		if c := m.compress(b); len(c) < len(b) {
+			m.out.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(c))))
+			m.out.Write(c)
+			return
+		}
+	}
+	m.out.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(b))|metadataUncompressed))
+	m.out.Write(b)
+}
+
+func (m *metadataWriter) bytes() []byte {
+	if len(m.pending) > 0 {
+		m.flush(m.pending)
+		m.pending = nil
+	}
+	return m.out.Bytes()
+}
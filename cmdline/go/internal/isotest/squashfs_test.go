@@ -0,0 +1,196 @@
+package isotest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// sqfsReader decodes just enough of a squashfs image to check the writer.
+type sqfsReader struct {
+	t      *testing.T
+	img    []byte
+	inodes []byte
+	dirs   []byte
+	// inodeBlocks and dirBlocks map the offset of a metadata block, relative to its
+	// table, to its offset in the decompressed table.
+	inodeBlocks, dirBlocks map[uint64]int
+}
+
+func newSqfsReader(t *testing.T, img []byte) *sqfsReader {
+	t.Helper()
+	r := &sqfsReader{t: t, img: img}
+	inodeStart := binary.LittleEndian.Uint64(img[64:])
+	dirStart := binary.LittleEndian.Uint64(img[72:])
+	fragStart := binary.LittleEndian.Uint64(img[80:])
+	r.inodes, r.inodeBlocks = r.table(img[inodeStart:dirStart])
+	r.dirs, r.dirBlocks = r.table(img[dirStart:fragStart])
+	return r
+}
+
+func (r *sqfsReader) table(raw []byte) ([]byte, map[uint64]int) {
+	var out []byte
+	blocks := map[uint64]int{}
+	for off := 0; off < len(raw); {
+		header := binary.LittleEndian.Uint16(raw[off:])
+		size := int(header &^ metadataUncompressed)
+		blocks[uint64(off)] = len(out)
+		block := raw[off+2 : off+2+size]
+		if header&metadataUncompressed == 0 {
+			block = r.inflate(block)
+		}
+		out = append(out, block...)
+		off += 2 + size
+	}
+	return out, blocks
+}
+
+func (r *sqfsReader) inflate(b []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		r.t.Fatalf("zlib: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		r.t.Fatalf("zlib: %v", err)
+	}
+	return out
+}
+
+func (r *sqfsReader) inode(ref uint64) []byte {
+	return r.inodes[r.inodeBlocks[ref>>16]+int(ref&0xFFFF):]
+}
+
+// list returns the names and inode references of a directory inode's entries.
+func (r *sqfsReader) list(inode []byte) (names []string, refs []uint64) {
+	if binary.LittleEndian.Uint16(inode) != inodeDir {
+		r.t.Fatalf("inode type %d is not a directory", binary.LittleEndian.Uint16(inode))
+	}
+	block := binary.LittleEndian.Uint32(inode[16:])
+	size := int(binary.LittleEndian.Uint16(inode[24:])) - 3
+	offset := binary.LittleEndian.Uint16(inode[26:])
+	data := r.dirs[r.dirBlocks[uint64(block)]+int(offset):][:size]
+	for len(data) > 0 {
+		count := int(binary.LittleEndian.Uint32(data)) + 1
+		start := binary.LittleEndian.Uint32(data[4:])
+		data = data[12:]
+		for i := 0; i < count; i++ {
+			nameLen := int(binary.LittleEndian.Uint16(data[6:])) + 1
+			names = append(names, string(data[8:8+nameLen]))
+			refs = append(refs, uint64(start)<<16|uint64(binary.LittleEndian.Uint16(data)))
+			data = data[8+nameLen:]
+		}
+	}
+	return names, refs
+}
+
+// lookup resolves a slash-separated path to its inode.
+func (r *sqfsReader) lookup(p string) []byte {
+	inode := r.inode(binary.LittleEndian.Uint64(r.img[32:]))
+	for _, part := range strings.Split(p, "/") {
+		names, refs := r.list(inode)
+		found := false
+		for i, name := range names {
+			if name == part {
+				inode, found = r.inode(refs[i]), true
+			}
+		}
+		if !found {
+			r.t.Fatalf("%s: %s not found", p, part)
+		}
+	}
+	return inode
+}
+
+// read returns the contents of a basic file inode.
+func (r *sqfsReader) read(inode []byte) []byte {
+	start := binary.LittleEndian.Uint32(inode[16:])
+	size := int(binary.LittleEndian.Uint32(inode[28:]))
+	var out []byte
+	pos := int(start)
+	for i := 0; len(out) < size; i++ {
+		word := binary.LittleEndian.Uint32(inode[32+4*i:])
+		n := int(word &^ dataUncompressed)
+		block := r.img[pos : pos+n]
+		if word&dataUncompressed == 0 {
+			block = r.inflate(block)
+		}
+		out = append(out, block...)
+		pos += n
+	}
+	return out
+}
+
+func TestSquashfsRoundTrip(t *testing.T) {
+	big := []byte(strings.Repeat("squashfs data block ", 1000))
+	files := []File{
+		Text("etc/os-release", "ID=ubuntu\nVERSION_ID=\"24.04\"\n"),
+		Symlink("bin", "usr/bin"),
+		{Path: "usr/bin/tool", Data: big, Mode: 0o755, UID: 1000, GID: 1000},
+		{Path: "dev/sda", Mode: fs.ModeDevice | 0o660, Major: 8, Minor: 300, GID: 6},
+		Dir("tmp"),
+	}
+	for i := 0; i < 300; i++ {
+		files = append(files, Text(fmt.Sprintf("usr/share/doc/package-with-a-long-name-%03d", i), "doc"))
+	}
+
+	for _, c := range []Compression{Gzip, Uncompressed} {
+		t.Run(fmt.Sprint(c), func(t *testing.T) {
+			img, err := Squashfs{Files: files, Compression: c, BlockSize: 4096}.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes() error = %v", err)
+			}
+			if binary.LittleEndian.Uint32(img) != squashfsMagic || binary.LittleEndian.Uint16(img[28:]) != 4 {
+				t.Fatal("missing squashfs 4.0 superblock")
+			}
+			if used := binary.LittleEndian.Uint64(img[40:]); used > uint64(len(img)) || len(img)%4096 != 0 {
+				t.Fatalf("bytes used %d, image %d bytes", used, len(img))
+			}
+			// Every file, directory and the root has an inode.
+			if got, want := binary.LittleEndian.Uint32(img[4:]), uint32(len(files)+7); got != want {
+				t.Fatalf("inode count = %d, want %d", got, want)
+			}
+
+			r := newSqfsReader(t, img)
+			if got := string(r.read(r.lookup("etc/os-release"))); got != "ID=ubuntu\nVERSION_ID=\"24.04\"\n" {
+				t.Fatalf("os-release = %q", got)
+			}
+			tool := r.lookup("usr/bin/tool")
+			if !bytes.Equal(r.read(tool), big) {
+				t.Fatal("usr/bin/tool contents differ")
+			}
+			if mode := binary.LittleEndian.Uint16(tool[2:]); mode != 0o755 {
+				t.Fatalf("usr/bin/tool mode = %o", mode)
+			}
+
+			link := r.lookup("bin")
+			if typ := binary.LittleEndian.Uint16(link); typ != inodeSymlink || string(link[24:31]) != "usr/bin" {
+				t.Fatalf("bin inode type %d target %q", typ, link[24:31])
+			}
+			dev := r.lookup("dev/sda")
+			if typ, rdev := binary.LittleEndian.Uint16(dev), binary.LittleEndian.Uint32(dev[20:]); typ != inodeBlockDev || rdev != encodeDev(8, 300) {
+				t.Fatalf("dev/sda type %d rdev %#x", typ, rdev)
+			}
+
+			names, _ := r.list(r.lookup("usr/share/doc"))
+			if len(names) != 300 || names[299] != "package-with-a-long-name-299" {
+				t.Fatalf("usr/share/doc lists %d entries", len(names))
+			}
+		})
+	}
+}
+
+func TestEncodeDev(t *testing.T) {
+	// Values match makedev(3) on Linux.
+	if got := encodeDev(8, 1); got != 0x801 {
+		t.Fatalf("encodeDev(8, 1) = %#x", got)
+	}
+	if got := encodeDev(259, 300); got != 0x11032c {
+		t.Fatalf("encodeDev(259, 300) = %#x", got)
+	}
+}
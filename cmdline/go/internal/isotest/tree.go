@@ -0,0 +1,221 @@
+// Package isotest builds small but valid ISO9660 and squashfs images at test
+// time, so tests can exercise real image parsing, extraction and mounting
+// without committing binary fixtures.
+package isotest
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultModTime is the timestamp given to entries without one, so generated
+// images are byte-for-byte reproducible.
+var defaultModTime = time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+// File is one entry of a generated image. Parent directories are created
+// implicitly with mode 0755.
+type File struct {
+	// Path is slash-separated and relative to the image root.
+	Path string
+	Data []byte
+	// Mode holds the permission bits and type. A zero type is a regular file;
+	// fs.ModeDir, fs.ModeSymlink, fs.ModeDevice (with fs.ModeCharDevice for
+	// character devices) and fs.ModeNamedPipe are also supported. Zero
+	// permission bits default to 0644, or 0755 for directories.
+	Mode fs.FileMode
+	// Target is the destination of a symlink.
+	Target string
+	// Major and Minor identify the device of a device node.
+	Major, Minor uint32
+	UID, GID     uint32
+	// ModTime defaults to a fixed date.
+	ModTime time.Time
+	// Link makes the entry a hard link to the regular file at that path; the
+	// other fields are ignored.
+	Link string
+	// Xattrs are stored in squashfs images. Names carry their user.,
+	// trusted. or security. prefix. ISO9660 has no place for them.
+	Xattrs map[string]string
+}
+
+// Dir returns a directory entry.
+func Dir(p string) File {
+	return File{Path: p, Mode: fs.ModeDir | 0o755}
+}
+
+// Text returns a regular file holding contents.
+func Text(p, contents string) File {
+	return File{Path: p, Data: []byte(contents)}
+}
+
+// HardLink returns a hard link to the regular file at target.
+func HardLink(p, target string) File {
+	return File{Path: p, Link: target}
+}
+
+// Symlink returns a symbolic link pointing at target.
+func Symlink(p, target string) File {
+	return File{Path: p, Mode: fs.ModeSymlink | 0o777, Target: target}
+}
+
+// node is a File placed in a directory tree.
+type node struct {
+	name     string
+	file     File
+	parent   *node
+	children []*node
+	// link is the file this entry is a hard link to.
+	link *node
+}
+
+func (n *node) isDir() bool {
+	return n.file.Mode.IsDir()
+}
+
+// buildTree arranges files into a tree rooted at an implicit directory,
+// creating missing parents and sorting every directory by name.
+func buildTree(files []File) (*node, error) {
+	root := &node{file: File{Mode: fs.ModeDir | 0o755, ModTime: defaultModTime}}
+	byPath := map[string]*node{"": root}
+
+	var ensureDir func(p string) (*node, error)
+	ensureDir = func(p string) (*node, error) {
+		if n, ok := byPath[p]; ok {
+			if !n.isDir() {
+				return nil, fmt.Errorf("isotest: %s is not a directory", p)
+			}
+			return n, nil
+		}
+		parent, err := ensureDir(parentPath(p))
+		if err != nil {
+			return nil, err
+		}
+		n := &node{name: path.Base(p), file: normalize(Dir(p)), parent: parent}
+		parent.children = append(parent.children, n)
+		byPath[p] = n
+		return n, nil
+	}
+
+	for _, f := range files {
+		p := strings.Trim(path.Clean("/"+f.Path), "/")
+		if p == "" {
+			return nil, fmt.Errorf("isotest: invalid path %q", f.Path)
+		}
+		f.Path = p
+		f = normalize(f)
+		if existing, ok := byPath[p]; ok {
+			if existing.isDir() && f.Mode.IsDir() {
+				existing.file = f
+				continue
+			}
+			return nil, fmt.Errorf("isotest: duplicate path %s", p)
+		}
+		parent, err := ensureDir(parentPath(p))
+		if err != nil {
+			return nil, err
+		}
+		n := &node{name: path.Base(p), file: f, parent: parent}
+		parent.children = append(parent.children, n)
+		byPath[p] = n
+	}
+
+	for _, n := range byPath {
+		if n.file.Link == "" {
+			continue
+		}
+		target, ok := byPath[strings.Trim(path.Clean("/"+n.file.Link), "/")]
+		if !ok || !target.file.Mode.IsRegular() || target.file.Link != "" {
+			return nil, fmt.Errorf("isotest: hard link %s must point at a regular file, not %q", n.file.Path, n.file.Link)
+		}
+		n.link = target
+		n.file.Mode = target.file.Mode
+	}
+
+	var sortTree func(n *node)
+	sortTree = func(n *node) {
+		sort.Slice(n.children, func(i, j int) bool {
+			return n.children[i].name < n.children[j].name
+		})
+		for _, c := range n.children {
+			sortTree(c)
+		}
+	}
+	sortTree(root)
+	return root, nil
+}
+
+func parentPath(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func normalize(f File) File {
+	if f.Mode.Perm() == 0 {
+		if f.Mode.IsDir() {
+			f.Mode |= 0o755
+		} else {
+			f.Mode |= 0o644
+		}
+	}
+	if f.ModTime.IsZero() {
+		f.ModTime = defaultModTime
+	}
+	return f
+}
+
+// walk visits n and its descendants depth first, parents before children.
+func (n *node) walk(fn func(*node)) {
+	fn(n)
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+// linkCounts returns how many hard links point at each file.
+func linkCounts(root *node) map[*node]int {
+	counts := make(map[*node]int)
+	root.walk(func(n *node) {
+		if n.link != nil {
+			counts[n.link]++
+		}
+	})
+	return counts
+}
+
+// posixMode converts an fs.FileMode to the st_mode bits stored on disk.
+func posixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	switch {
+	case mode.IsDir():
+		m |= 0o040000
+	case mode&fs.ModeSymlink != 0:
+		m |= 0o120000
+	case mode&fs.ModeCharDevice != 0:
+		m |= 0o020000
+	case mode&fs.ModeDevice != 0:
+		m |= 0o060000
+	case mode&fs.ModeNamedPipe != 0:
+		m |= 0o010000
+	case mode&fs.ModeSocket != 0:
+		m |= 0o140000
+	default:
+		m |= 0o100000
+	}
+	return m
+}
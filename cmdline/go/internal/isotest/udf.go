@@ -0,0 +1,806 @@
+package isotest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// UDF revisions, in the binary-coded decimal form recorded in images.
+const (
+	UDF102 = 0x0102
+	UDF150 = 0x0150
+	UDF201 = 0x0201
+	UDF250 = 0x0250
+	UDF260 = 0x0260
+)
+
+// UDF describes the UDF filesystem of a generated image. Together with the
+// ISO9660 one it makes a UDF bridge image, as on DVD and Windows media.
+type UDF struct {
+	// Revision is the UDF revision, such as UDF102 or UDF250. It defaults to
+	// UDF102. From UDF250 on, file entries and directories are stored in a
+	// metadata partition, and from UDF201 on as extended file entries.
+	Revision uint16
+	// Files, when set, are what the UDF filesystem describes instead of
+	// ISO.Files, like Windows media whose ISO9660 tree only holds a README.
+	Files []File
+	// Only leaves out the ISO9660 volume descriptors and directory trees,
+	// making a UDF-only image.
+	Only bool
+}
+
+// Descriptor tag identifiers of ECMA-167.
+const (
+	udfTagPVD  = 1
+	udfTagAVDP = 2
+	udfTagIUVD = 4
+	udfTagPD   = 5
+	udfTagLVD  = 6
+	udfTagUSD  = 7
+	udfTagTD   = 8
+	udfTagLVID = 9
+	udfTagFSD  = 256
+	udfTagFID  = 257
+	udfTagFE   = 261
+	udfTagEAHD = 262
+	udfTagEFE  = 266
+)
+
+// ICB file types.
+const (
+	udfTypeDir      = 4
+	udfTypeFile     = 5
+	udfTypeBlock    = 6
+	udfTypeChar     = 7
+	udfTypeFIFO     = 9
+	udfTypeSocket   = 10
+	udfTypeSymlink  = 12
+	udfTypeMetadata = 250
+	udfTypeMirror   = 251
+)
+
+const (
+	udfAnchor = 256
+	// udfVDSLength is the number of sectors of a volume descriptor sequence:
+	// primary, implementation use, partition, logical volume, unallocated
+	// space and terminating descriptors.
+	udfVDSLength = 6
+	udfEALength  = 48
+)
+
+// udfWriter lays out and writes the UDF structures of an image. Blocks are
+// the image's 2048-byte sectors; partition blocks count from partStart.
+type udfWriter struct {
+	rev      uint16
+	volID    string
+	root     *node
+	links    map[*node]int
+	modTime  time.Time
+	metadata bool
+
+	vrs, mainVDS, reserveVDS, lvid uint32
+	partStart, partLen             uint32
+	// fe and dirData hold the blocks of each file entry and directory
+	// listing, in the partition holding file entries: the metadata partition
+	// from UDF250 on, the physical one before.
+	fe       map[*node]uint32
+	dirData  map[*node]uint32
+	dirSize  map[*node]uint32
+	uniqueID map[*node]uint64
+	// metaStart and metaLen locate the metadata partition in the physical
+	// one; metaFile is the block of the metadata file's entry, followed by
+	// that of its mirror.
+	metaStart, metaLen uint32
+	metaFile           uint32
+	trailing           uint32
+}
+
+func newUDFWriter(u UDF, volID string, root *node, modTime time.Time) *udfWriter {
+	rev := u.Revision
+	if rev == 0 {
+		rev = UDF102
+	}
+	return &udfWriter{
+		rev:      rev,
+		volID:    volID,
+		root:     root,
+		links:    linkCounts(root),
+		modTime:  modTime,
+		metadata: rev >= UDF250,
+		fe:       make(map[*node]uint32),
+		dirData:  make(map[*node]uint32),
+		dirSize:  make(map[*node]uint32),
+		uniqueID: make(map[*node]uint64),
+	}
+}
+
+// reserveDescriptors places the volume recognition sequence at next and the
+// volume descriptor sequences after it, returning the first free sector.
+func (u *udfWriter) reserveDescriptors(next uint32) (uint32, error) {
+	u.vrs = next
+	next += 3
+	u.mainVDS = next
+	next += udfVDSLength
+	u.reserveVDS = next
+	next += udfVDSLength
+	u.lvid = next
+	next++
+	if next > udfAnchor {
+		return 0, fmt.Errorf("isotest: UDF descriptors overlap the anchor at sector %d", udfAnchor)
+	}
+	u.partStart = udfAnchor + 1
+	return u.partStart, nil
+}
+
+// layout assigns partition blocks to the file set, file entries, directory
+// listings and the data of files fileLBA does not place yet, starting at
+// sector next. It returns the first free sector.
+func (u *udfWriter) layout(next uint32, fileLBA map[*node]uint32) (uint32, error) {
+	var err error
+	id := uint64(16)
+	var entries, dirs []*node
+	u.root.walk(func(n *node) {
+		if n.link != nil {
+			return
+		}
+		entries = append(entries, n)
+		if n == u.root {
+			u.uniqueID[n] = 0
+		} else {
+			u.uniqueID[n] = id
+			id++
+		}
+		if n.isDir() {
+			dirs = append(dirs, n)
+			var size uint32
+			size += uint32(len(udfFID("", 0, 0, 0, 0, 0, 0)))
+			for _, c := range n.children {
+				size += uint32(len(udfFID(c.name, 0, 0, 0, 0, 0, 0)))
+			}
+			u.dirSize[n] = size
+		}
+	})
+
+	// File entries come first, then directory listings; in the metadata
+	// partition block 0 holds the file set descriptor and block 1 ends its
+	// sequence.
+	block := uint32(2)
+	if !u.metadata {
+		block = next - u.partStart + 2
+	}
+	for _, n := range entries {
+		u.fe[n] = block
+		block++
+	}
+	for _, d := range dirs {
+		u.dirData[d] = block
+		block += (u.dirSize[d] + sectorSize - 1) / sectorSize
+	}
+	if u.metadata {
+		u.metaStart = next - u.partStart
+		u.metaLen = block
+		next += block
+		u.metaFile = next - u.partStart
+		next += 2
+	} else {
+		next = u.partStart + block
+	}
+
+	for _, n := range entries {
+		if !n.file.Mode.IsRegular() || len(n.file.Data) == 0 || u.embedded(n) {
+			continue
+		}
+		if _, ok := fileLBA[n]; ok {
+			continue
+		}
+		if uint64(len(n.file.Data)) > 1<<30-sectorSize {
+			err = fmt.Errorf("isotest: %s is too large for a single UDF extent", n.file.Path)
+			break
+		}
+		fileLBA[n] = next
+		next += uint32((len(n.file.Data) + sectorSize - 1) / sectorSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range entries {
+		if n.file.Mode&fs.ModeSymlink != 0 && !u.embedded(n) {
+			return 0, fmt.Errorf("isotest: symlink target of %s is too long", n.file.Path)
+		}
+	}
+	u.trailing = next
+	u.partLen = u.trailing - u.partStart
+	return next + 1, nil
+}
+
+// fsdBlock returns the partition block of the file set descriptor.
+func (u *udfWriter) fsdBlock() uint32 {
+	if u.metadata {
+		return 0
+	}
+	return u.fe[u.root] - 2
+}
+
+// entryPartition is the partition reference of file entries and listings.
+func (u *udfWriter) entryPartition() uint16 {
+	if u.metadata {
+		return 1
+	}
+	return 0
+}
+
+// sector returns the image sector of a block in the file entry partition.
+func (u *udfWriter) sector(block uint32) uint32 {
+	if u.metadata {
+		return u.partStart + u.metaStart + block
+	}
+	return u.partStart + block
+}
+
+func (u *udfWriter) efe() bool {
+	return u.rev >= UDF201
+}
+
+func (u *udfWriter) headerSize() int {
+	if u.efe() {
+		return 216
+	}
+	return 176
+}
+
+func (u *udfWriter) eaLength(n *node) int {
+	if n.file.Mode&fs.ModeDevice != 0 {
+		return udfEALength
+	}
+	return 0
+}
+
+// embedded reports whether the contents of n are stored in its file entry.
+func (u *udfWriter) embedded(n *node) bool {
+	switch {
+	case n.file.Mode&fs.ModeSymlink != 0:
+		return len(udfPathComponents(n.file.Target)) <= sectorSize-u.headerSize()
+	case n.file.Mode.IsRegular():
+		return len(n.file.Data) > 0 && len(n.file.Data) <= sectorSize-u.headerSize()-u.eaLength(n)
+	}
+	return false
+}
+
+func (u *udfWriter) descVersion() uint16 {
+	if u.rev >= UDF201 {
+		return 3
+	}
+	return 2
+}
+
+func (u *udfWriter) write(img []byte, fileLBA map[*node]uint32) {
+	sector := func(n uint32) []byte {
+		return img[int(n)*sectorSize : int(n+1)*sectorSize]
+	}
+	nsr := "NSR02"
+	if u.rev >= UDF201 {
+		nsr = "NSR03"
+	}
+	for i, id := range []string{"BEA01", nsr, "TEA01"} {
+		d := sector(u.vrs + uint32(i))
+		copy(d[1:], id)
+		d[6] = 1
+	}
+
+	for _, start := range []uint32{u.mainVDS, u.reserveVDS} {
+		u.volumeDescriptors(img, start)
+	}
+	u.integrityDescriptor(sector(u.lvid))
+	for _, s := range []uint32{udfAnchor, u.trailing} {
+		d := sector(s)[:512]
+		binary.LittleEndian.PutUint32(d[16:], udfVDSLength*sectorSize)
+		binary.LittleEndian.PutUint32(d[20:], u.mainVDS)
+		binary.LittleEndian.PutUint32(d[24:], udfVDSLength*sectorSize)
+		binary.LittleEndian.PutUint32(d[28:], u.reserveVDS)
+		udfTag(d, udfTagAVDP, u.descVersion(), s)
+	}
+
+	fsd := sector(u.sector(u.fsdBlock()))[:512]
+	putUDFTime(fsd[16:], u.modTime)
+	binary.LittleEndian.PutUint16(fsd[28:], 3)
+	binary.LittleEndian.PutUint16(fsd[30:], 3)
+	binary.LittleEndian.PutUint32(fsd[32:], 1)
+	binary.LittleEndian.PutUint32(fsd[36:], 1)
+	putCharspec(fsd[48:])
+	putDString(fsd[112:240], u.volID)
+	putCharspec(fsd[240:])
+	putDString(fsd[304:336], u.volID)
+	putLongAD(fsd[400:], sectorSize, u.fe[u.root], u.entryPartition())
+	u.putDomain(fsd[416:])
+	udfTag(fsd, udfTagFSD, u.descVersion(), u.fsdBlock())
+	udfTag(sector(u.sector(u.fsdBlock() + 1))[:512], udfTagTD, u.descVersion(), u.fsdBlock()+1)
+
+	u.root.walk(func(n *node) {
+		if n.link != nil {
+			return
+		}
+		d := u.fileEntry(n, fileLBA)
+		copy(sector(u.sector(u.fe[n])), d)
+		if n.isDir() {
+			u.writeDir(img, n)
+		}
+	})
+	if u.metadata {
+		for i, fileType := range []byte{udfTypeMetadata, udfTypeMirror} {
+			block := u.metaFile + uint32(i)
+			copy(sector(u.partStart+block), u.metadataFileEntry(fileType, block))
+		}
+	}
+	for n, lba := range fileLBA {
+		copy(img[int(lba)*sectorSize:], n.file.Data)
+	}
+}
+
+// volumeDescriptors writes a volume descriptor sequence starting at sector start.
+func (u *udfWriter) volumeDescriptors(img []byte, start uint32) {
+	sector := func(i uint32) []byte {
+		s := start + i
+		return img[int(s)*sectorSize : int(s)*sectorSize+512]
+	}
+	version := u.descVersion()
+
+	pvd := sector(0)
+	binary.LittleEndian.PutUint32(pvd[16:], 1)
+	putDString(pvd[24:56], u.volID)
+	binary.LittleEndian.PutUint16(pvd[56:], 1)
+	binary.LittleEndian.PutUint16(pvd[58:], 1)
+	binary.LittleEndian.PutUint16(pvd[60:], 2)
+	binary.LittleEndian.PutUint16(pvd[62:], 3)
+	binary.LittleEndian.PutUint32(pvd[64:], 1)
+	binary.LittleEndian.PutUint32(pvd[68:], 1)
+	putDString(pvd[72:200], fmt.Sprintf("%016x%s", u.modTime.Unix(), u.volID))
+	putCharspec(pvd[200:])
+	putCharspec(pvd[264:])
+	putUDFTime(pvd[376:], u.modTime)
+	putRegID(pvd[388:], "*ISOTEST")
+	udfTag(pvd, udfTagPVD, version, start)
+
+	iuvd := sector(1)
+	binary.LittleEndian.PutUint32(iuvd[16:], 2)
+	putRegID(iuvd[20:], "*UDF LV Info", u.udfSuffix()...)
+	putCharspec(iuvd[52:])
+	putDString(iuvd[116:244], u.volID)
+	putRegID(iuvd[352:], "*ISOTEST")
+	udfTag(iuvd, udfTagIUVD, version, start+1)
+
+	pd := sector(2)
+	binary.LittleEndian.PutUint32(pd[16:], 3)
+	binary.LittleEndian.PutUint16(pd[20:], 1) // allocated
+	nsr := "+NSR02"
+	if u.rev >= UDF201 {
+		nsr = "+NSR03"
+	}
+	putRegID(pd[24:], nsr)
+	binary.LittleEndian.PutUint32(pd[184:], 1) // read-only
+	binary.LittleEndian.PutUint32(pd[188:], u.partStart)
+	binary.LittleEndian.PutUint32(pd[192:], u.partLen)
+	putRegID(pd[196:], "*ISOTEST")
+	udfTag(pd, udfTagPD, version, start+2)
+
+	lvd := sector(3)
+	binary.LittleEndian.PutUint32(lvd[16:], 4)
+	putCharspec(lvd[20:])
+	putDString(lvd[84:212], u.volID)
+	binary.LittleEndian.PutUint32(lvd[212:], sectorSize)
+	u.putDomain(lvd[216:])
+	putLongAD(lvd[248:], sectorSize, u.fsdBlock(), u.entryPartition())
+	putRegID(lvd[272:], "*ISOTEST")
+	binary.LittleEndian.PutUint32(lvd[432:], sectorSize)
+	binary.LittleEndian.PutUint32(lvd[436:], u.lvid)
+	maps := lvd[440:]
+	maps[0], maps[1] = 1, 6
+	binary.LittleEndian.PutUint16(maps[2:], 1)
+	mapLen, mapCount := 6, 1
+	if u.metadata {
+		meta := maps[6:70]
+		meta[0], meta[1] = 2, 64
+		putRegID(meta[4:], "*UDF Metadata Partition", u.udfSuffix()...)
+		binary.LittleEndian.PutUint16(meta[36:], 1)
+		binary.LittleEndian.PutUint32(meta[40:], u.metaFile)
+		binary.LittleEndian.PutUint32(meta[44:], u.metaFile+1)
+		binary.LittleEndian.PutUint32(meta[48:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(meta[52:], 32)
+		binary.LittleEndian.PutUint16(meta[56:], 1)
+		mapLen, mapCount = 70, 2
+	}
+	binary.LittleEndian.PutUint32(lvd[264:], uint32(mapLen))
+	binary.LittleEndian.PutUint32(lvd[268:], uint32(mapCount))
+	udfTag(lvd[:440+mapLen], udfTagLVD, version, start+3)
+
+	usd := sector(4)
+	binary.LittleEndian.PutUint32(usd[16:], 5)
+	udfTag(usd[:24], udfTagUSD, version, start+4)
+
+	udfTag(sector(5), udfTagTD, version, start+5)
+}
+
+func (u *udfWriter) integrityDescriptor(d []byte) {
+	maps := uint32(1)
+	if u.metadata {
+		maps = 2
+	}
+	putUDFTime(d[16:], u.modTime)
+	binary.LittleEndian.PutUint32(d[28:], 1) // closed
+	var next uint64
+	u.root.walk(func(*node) { next++ })
+	binary.LittleEndian.PutUint64(d[40:], next+16)
+	binary.LittleEndian.PutUint32(d[72:], maps)
+	binary.LittleEndian.PutUint32(d[76:], 46)
+	off := 80 + 8*int(maps)
+	for i := range int(maps) {
+		binary.LittleEndian.PutUint32(d[80+4*int(maps)+4*i:], u.partLen)
+	}
+	var files, dirs uint32
+	u.root.walk(func(n *node) {
+		if n.isDir() {
+			dirs++
+		} else {
+			files++
+		}
+	})
+	putRegID(d[off:], "*ISOTEST")
+	binary.LittleEndian.PutUint32(d[off+32:], files)
+	binary.LittleEndian.PutUint32(d[off+36:], dirs)
+	binary.LittleEndian.PutUint16(d[off+40:], u.rev)
+	binary.LittleEndian.PutUint16(d[off+42:], u.rev)
+	binary.LittleEndian.PutUint16(d[off+44:], u.rev)
+	udfTag(d[:off+46], udfTagLVID, u.descVersion(), u.lvid)
+}
+
+// fileEntry encodes the file entry of n.
+func (u *udfWriter) fileEntry(n *node, fileLBA map[*node]uint32) []byte {
+	f := n.file
+	header := u.headerSize()
+	lEA := u.eaLength(n)
+
+	var (
+		ad       []byte
+		adType   uint16
+		size     uint64
+		recorded uint64
+	)
+	switch {
+	case n.isDir():
+		size = uint64(u.dirSize[n])
+		ad = make([]byte, 8)
+		binary.LittleEndian.PutUint32(ad, uint32(size))
+		binary.LittleEndian.PutUint32(ad[4:], u.dirData[n])
+	case f.Mode&fs.ModeSymlink != 0:
+		ad = udfPathComponents(f.Target)
+		adType, size = 3, uint64(len(ad))
+	case f.Mode.IsRegular() && u.embedded(n):
+		ad = append([]byte(nil), f.Data...)
+		adType, size = 3, uint64(len(ad))
+	case f.Mode.IsRegular() && len(f.Data) > 0:
+		size = uint64(len(f.Data))
+		lba := fileLBA[n] - u.partStart
+		if u.metadata {
+			ad = make([]byte, 16)
+			putLongAD(ad, uint32(size), lba, 0)
+			adType = 1
+		} else {
+			ad = make([]byte, 8)
+			binary.LittleEndian.PutUint32(ad, uint32(size))
+			binary.LittleEndian.PutUint32(ad[4:], lba)
+		}
+	}
+	if adType != 3 {
+		recorded = (size + sectorSize - 1) / sectorSize
+	}
+
+	d := make([]byte, header+lEA+len(ad))
+	icb := d[16:36]
+	binary.LittleEndian.PutUint16(icb[4:], 4)
+	binary.LittleEndian.PutUint16(icb[8:], 1)
+	icb[11] = udfFileType(f.Mode)
+	flags := adType
+	if f.Mode&fs.ModeSetuid != 0 {
+		flags |= 0x40
+	}
+	if f.Mode&fs.ModeSetgid != 0 {
+		flags |= 0x80
+	}
+	if f.Mode&fs.ModeSticky != 0 {
+		flags |= 0x100
+	}
+	binary.LittleEndian.PutUint16(icb[18:], flags)
+
+	binary.LittleEndian.PutUint32(d[36:], f.UID)
+	binary.LittleEndian.PutUint32(d[40:], f.GID)
+	binary.LittleEndian.PutUint32(d[44:], udfPermissions(f.Mode))
+	nlink := 1 + u.links[n]
+	if n.isDir() {
+		// Each subdirectory's parent entry links back to this directory.
+		nlink = 1
+		for _, c := range n.children {
+			if c.isDir() {
+				nlink++
+			}
+		}
+	}
+	binary.LittleEndian.PutUint16(d[48:], uint16(nlink))
+	binary.LittleEndian.PutUint64(d[56:], size)
+
+	var lengths []byte
+	if u.efe() {
+		binary.LittleEndian.PutUint64(d[64:], size)
+		binary.LittleEndian.PutUint64(d[72:], recorded)
+		for _, off := range []int{80, 92, 104, 116} {
+			putUDFTime(d[off:], f.ModTime)
+		}
+		putRegID(d[168:], "*ISOTEST")
+		binary.LittleEndian.PutUint64(d[200:], u.uniqueID[n])
+		lengths = d[208:216]
+	} else {
+		binary.LittleEndian.PutUint64(d[64:], recorded)
+		for _, off := range []int{72, 84, 96} {
+			putUDFTime(d[off:], f.ModTime)
+		}
+		putRegID(d[128:], "*ISOTEST")
+		binary.LittleEndian.PutUint64(d[160:], u.uniqueID[n])
+		lengths = d[168:176]
+	}
+	binary.LittleEndian.PutUint32(lengths, uint32(lEA))
+	binary.LittleEndian.PutUint32(lengths[4:], uint32(len(ad)))
+
+	if lEA > 0 {
+		ea := d[header : header+lEA]
+		binary.LittleEndian.PutUint32(ea[16:], udfEALength)
+		binary.LittleEndian.PutUint32(ea[20:], udfEALength)
+		udfTag(ea[:24], udfTagEAHD, u.descVersion(), u.fe[n])
+		dev := ea[24:]
+		binary.LittleEndian.PutUint32(dev, 12)
+		dev[4] = 1
+		binary.LittleEndian.PutUint32(dev[8:], 24)
+		binary.LittleEndian.PutUint32(dev[16:], f.Major)
+		binary.LittleEndian.PutUint32(dev[20:], f.Minor)
+	}
+	copy(d[header+lEA:], ad)
+
+	tag := uint16(udfTagFE)
+	if u.efe() {
+		tag = udfTagEFE
+	}
+	udfTag(d, tag, u.descVersion(), u.fe[n])
+	return d
+}
+
+// metadataFileEntry encodes the entry of the metadata file or its mirror,
+// both of which map the whole metadata partition.
+func (u *udfWriter) metadataFileEntry(fileType byte, block uint32) []byte {
+	header := u.headerSize()
+	d := make([]byte, header+8)
+	binary.LittleEndian.PutUint16(d[20:], 4)
+	binary.LittleEndian.PutUint16(d[24:], 1)
+	d[27] = fileType
+	binary.LittleEndian.PutUint32(d[36:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(d[40:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint16(d[48:], 1)
+	size := uint64(u.metaLen) * sectorSize
+	binary.LittleEndian.PutUint64(d[56:], size)
+	binary.LittleEndian.PutUint64(d[64:], size)
+	binary.LittleEndian.PutUint64(d[72:], uint64(u.metaLen))
+	putRegID(d[168:], "*ISOTEST")
+	binary.LittleEndian.PutUint32(d[212:], 8)
+	binary.LittleEndian.PutUint32(d[header:], uint32(size))
+	binary.LittleEndian.PutUint32(d[header+4:], u.metaStart)
+	udfTag(d, udfTagEFE, u.descVersion(), block)
+	return d
+}
+
+// writeDir writes the file identifier descriptors of directory d.
+func (u *udfWriter) writeDir(img []byte, d *node) {
+	buf := img[int(u.sector(u.dirData[d]))*sectorSize:]
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	part := u.entryPartition()
+	off := 0
+	put := func(name string, characteristics byte, target *node) {
+		if target.link != nil {
+			target = target.link
+		}
+		location := u.dirData[d] + uint32(off/sectorSize)
+		fid := udfFID(name, characteristics, u.fe[target], part, uint32(u.uniqueID[target]), u.descVersion(), location)
+		copy(buf[off:], fid)
+		off += len(fid)
+	}
+	put("", 0x0A, parent)
+	for _, c := range d.children {
+		var characteristics byte
+		if c.isDir() {
+			characteristics = 0x02
+		}
+		put(c.name, characteristics, c)
+	}
+}
+
+// udfFID encodes a file identifier descriptor. An empty name makes the
+// parent directory entry.
+func udfFID(name string, characteristics byte, icb uint32, part uint16, uniqueID uint32, version uint16, location uint32) []byte {
+	var id []byte
+	if name != "" {
+		id = cs0(name)
+	}
+	length := (38 + len(id) + 3) &^ 3
+	d := make([]byte, length)
+	binary.LittleEndian.PutUint16(d[16:], 1)
+	d[18] = characteristics
+	d[19] = byte(len(id))
+	putLongAD(d[20:], sectorSize, icb, part)
+	binary.LittleEndian.PutUint32(d[20+12:], uniqueID)
+	copy(d[38:], id)
+	udfTag(d, udfTagFID, version, location)
+	return d
+}
+
+func udfFileType(mode fs.FileMode) byte {
+	switch {
+	case mode.IsDir():
+		return udfTypeDir
+	case mode&fs.ModeSymlink != 0:
+		return udfTypeSymlink
+	case mode&fs.ModeCharDevice != 0:
+		return udfTypeChar
+	case mode&fs.ModeDevice != 0:
+		return udfTypeBlock
+	case mode&fs.ModeNamedPipe != 0:
+		return udfTypeFIFO
+	case mode&fs.ModeSocket != 0:
+		return udfTypeSocket
+	}
+	return udfTypeFile
+}
+
+// udfPermissions converts permission bits to UDF's, which keep the execute,
+// write and read order in five bits per class. The owner may also change
+// attributes and delete.
+func udfPermissions(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	return perm&7 | (perm>>3&7)<<5 | (perm>>6&7)<<10 | 0x18<<10
+}
+
+// udfPathComponents encodes a symlink target as UDF path components.
+func udfPathComponents(target string) []byte {
+	var b []byte
+	parts := strings.Split(target, "/")
+	if strings.HasPrefix(target, "/") {
+		b = append(b, 2, 0, 0, 0)
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		switch part {
+		case "":
+		case ".":
+			b = append(b, 4, 0, 0, 0)
+		case "..":
+			b = append(b, 3, 0, 0, 0)
+		default:
+			id := cs0(part)
+			b = append(b, 5, byte(len(id)), 0, 0)
+			b = append(b, id...)
+		}
+	}
+	return b
+}
+
+// cs0 encodes s in OSTA Compressed Unicode: eight bits per character when
+// that suffices, big-endian UTF-16 otherwise.
+func cs0(s string) []byte {
+	runes := []rune(s)
+	narrow := true
+	for _, r := range runes {
+		if r > 0xFF {
+			narrow = false
+		}
+	}
+	if narrow {
+		b := []byte{8}
+		for _, r := range runes {
+			b = append(b, byte(r))
+		}
+		return b
+	}
+	b := []byte{16}
+	for _, u := range utf16.Encode(runes) {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// putDString stores s in a fixed-size dstring field, whose last byte holds
+// the encoded length.
+func putDString(field []byte, s string) {
+	enc := cs0(s)
+	if len(enc) > len(field)-1 {
+		enc = enc[:len(field)-1]
+	}
+	copy(field, enc)
+	field[len(field)-1] = byte(len(enc))
+}
+
+func putCharspec(b []byte) {
+	b[0] = 0
+	copy(b[1:64], "OSTA Compressed Unicode")
+}
+
+func putRegID(b []byte, id string, suffix ...byte) {
+	copy(b[1:24], id)
+	copy(b[24:32], suffix)
+}
+
+func (u *udfWriter) putDomain(b []byte) {
+	putRegID(b, "*OSTA UDF Compliant", byte(u.rev), byte(u.rev>>8))
+}
+
+// udfSuffix is the identifier suffix of UDF entity identifiers: the
+// revision and a UNIX operating system class.
+func (u *udfWriter) udfSuffix() []byte {
+	return []byte{byte(u.rev), byte(u.rev >> 8), 4, 0}
+}
+
+func putLongAD(b []byte, length, block uint32, part uint16) {
+	binary.LittleEndian.PutUint32(b, length)
+	binary.LittleEndian.PutUint32(b[4:], block)
+	binary.LittleEndian.PutUint16(b[8:], part)
+}
+
+// putUDFTime stores t as a UDF timestamp in UTC.
+func putUDFTime(b []byte, t time.Time) {
+	t = t.UTC()
+	binary.LittleEndian.PutUint16(b, 1<<12)
+	binary.LittleEndian.PutUint16(b[2:], uint16(t.Year()))
+	b[4] = byte(t.Month())
+	b[5] = byte(t.Day())
+	b[6] = byte(t.Hour())
+	b[7] = byte(t.Minute())
+	b[8] = byte(t.Second())
+	ns := t.Nanosecond()
+	b[9] = byte(ns / 1e7)
+	b[10] = byte(ns / 1e5 % 100)
+	b[11] = byte(ns / 1e3 % 100)
+}
+
+// udfTag fills in the descriptor tag at the start of d, whose CRC covers the
+// rest of d.
+func udfTag(d []byte, id, version uint16, location uint32) {
+	binary.LittleEndian.PutUint16(d, id)
+	binary.LittleEndian.PutUint16(d[2:], version)
+	binary.LittleEndian.PutUint16(d[6:], 1)
+	binary.LittleEndian.PutUint16(d[8:], crc16(d[16:]))
+	binary.LittleEndian.PutUint16(d[10:], uint16(len(d)-16))
+	binary.LittleEndian.PutUint32(d[12:], location)
+	var sum byte
+	for i := range 16 {
+		if i != 4 {
+			sum += d[i]
+		}
+	}
+	d[4] = sum
+}
+
+// crc16 is the CRC-ITU-T checksum of descriptor tags.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,72 @@
+package isotest
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestUDFDescriptors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		udf  UDF
+		vrs  []string
+		maps uint32
+	}{
+		{name: "bridge 1.02", udf: UDF{}, vrs: []string{"CD001", "CD001", "BEA01", "NSR02", "TEA01"}, maps: 1},
+		{name: "only 2.50", udf: UDF{Revision: UDF250, Only: true}, vrs: []string{"BEA01", "NSR03", "TEA01"}, maps: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			iso := ISO{Files: []File{Text("setup.exe", "MZ")}, UDF: &tt.udf}
+			img, err := iso.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes() error = %v", err)
+			}
+			for i, want := range tt.vrs {
+				d := img[(systemArea+i)*sectorSize:]
+				if got := string(d[1:6]); got != want {
+					t.Fatalf("volume recognition descriptor %d = %q, want %q", i, got, want)
+				}
+			}
+
+			// Both anchors point at the main volume descriptor sequence.
+			last := len(img)/sectorSize - 1
+			var main uint32
+			for _, s := range []int{udfAnchor, last} {
+				d := img[s*sectorSize:]
+				if binary.LittleEndian.Uint16(d) != udfTagAVDP || binary.LittleEndian.Uint32(d[12:]) != uint32(s) {
+					t.Fatalf("sector %d holds no anchor", s)
+				}
+				if crc := binary.LittleEndian.Uint16(d[8:]); crc != crc16(d[16:512]) {
+					t.Fatalf("anchor at sector %d has CRC %#x", s, crc)
+				}
+				main = binary.LittleEndian.Uint32(d[20:])
+			}
+
+			var tags []uint16
+			for s := main; s < main+udfVDSLength; s++ {
+				tags = append(tags, binary.LittleEndian.Uint16(img[s*sectorSize:]))
+			}
+			want := []uint16{udfTagPVD, udfTagIUVD, udfTagPD, udfTagLVD, udfTagUSD, udfTagTD}
+			for i := range want {
+				if tags[i] != want[i] {
+					t.Fatalf("volume descriptor tags = %v, want %v", tags, want)
+				}
+			}
+			lvd := img[(main+3)*sectorSize:]
+			if got := binary.LittleEndian.Uint32(lvd[268:]); got != tt.maps {
+				t.Fatalf("partition maps = %d, want %d", got, tt.maps)
+			}
+		})
+	}
+}
+
+func TestUDFPathComponents(t *testing.T) {
+	got := udfPathComponents("/usr/../lib")
+	want := []byte{2, 0, 0, 0, 5, 4, 0, 0, 8, 'u', 's', 'r', 3, 0, 0, 0, 5, 4, 0, 0, 8, 'l', 'i', 'b'}
+	if string(got) != string(want) {
+		t.Fatalf("udfPathComponents() = %v, want %v", got, want)
+	}
+	if got := cs0("日本"); got[0] != 16 || len(got) != 5 {
+		t.Fatalf("cs0(日本) = %v, want 16-bit characters", got)
+	}
+}
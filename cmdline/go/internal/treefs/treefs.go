@@ -0,0 +1,281 @@
+// Package treefs serves the file tree of an image or archive through fs.FS,
+// fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS. The readers of the image
+// formats supply their files as Nodes; this package resolves paths, with
+// symlinks resolved inside the tree and absolute targets relative to its
+// root, and opens directories and special files.
+package treefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// maxSymlinks bounds how many symlinks a single lookup follows, like the
+// kernel's limit of 40.
+const maxSymlinks = 40
+
+var (
+	// ErrNotDir reports a path that descends through a file that is not a
+	// directory.
+	ErrNotDir = errors.New("not a directory")
+	// ErrTooManyLinks reports a lookup that followed more than 40 symlinks.
+	ErrTooManyLinks = errors.New("too many levels of symbolic links")
+)
+
+// Node is a file of a tree.
+type Node interface {
+	// Mode returns the type and permission bits of the file.
+	Mode() fs.FileMode
+	// Info describes the file under name.
+	Info(name string) fs.FileInfo
+	// Target returns the target of a symlink.
+	Target() string
+	// Child returns the entry called name of a directory, or nil when there
+	// is none.
+	Child(name string) (Node, error)
+	// Entries returns the entries of a directory, sorted by name.
+	Entries() ([]fs.DirEntry, error)
+	// OpenFile opens a regular file under name.
+	OpenFile(name string) fs.File
+}
+
+// Open opens the named file of the tree at root, following symlinks. Device
+// nodes, named pipes and sockets read as empty files.
+func Open(root Node, name string) (fs.File, error) {
+	n, err := Lookup("open", root, name, true)
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(name)
+	switch mode := n.Mode(); {
+	case mode.IsDir():
+		return &dir{n: n, info: n.Info(base)}, nil
+	case mode.IsRegular():
+		return n.OpenFile(base), nil
+	}
+	return &special{info: n.Info(base)}, nil
+}
+
+// Stat describes the named file, following symlinks.
+func Stat(root Node, name string) (fs.FileInfo, error) {
+	n, err := Lookup("stat", root, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.Info(path.Base(name)), nil
+}
+
+// Lstat describes the named file without following a final symlink.
+func Lstat(root Node, name string) (fs.FileInfo, error) {
+	n, err := Lookup("lstat", root, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.Info(path.Base(name)), nil
+}
+
+// ReadLink returns the target of the named symlink.
+func ReadLink(root Node, name string) (string, error) {
+	n, err := Lookup("readlink", root, name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.Mode().Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return n.Target(), nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func ReadDir(root Node, name string) ([]fs.DirEntry, error) {
+	n, err := Lookup("readdir", root, name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Mode().IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+	entries, err := n.Entries()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Lookup resolves name to its node, following intermediate symlinks and a
+// final one when follow is set. Failures are reported as a *fs.PathError
+// for op.
+func Lookup(op string, root Node, name string, follow bool) (Node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := resolve(root, name, follow)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return n, nil
+}
+
+// Resolve returns the path name has in fsys once the symlinks among its
+// parent directories are resolved as Lookup resolves them. A final symlink is
+// kept. Failures are reported as a *fs.PathError for op.
+func Resolve(op string, fsys fs.FS, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	// dirs holds the resolved directories below the root.
+	var dirs []string
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 0 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		if len(parts) == 0 {
+			dirs = append(dirs, part)
+			break
+		}
+		cur := path.Join(append(dirs, part)...)
+		info, err := fs.Lstat(fsys, cur)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+		}
+		switch {
+		case info.Mode().Type() == fs.ModeSymlink:
+			if links++; links > maxSymlinks {
+				return "", &fs.PathError{Op: op, Path: name, Err: ErrTooManyLinks}
+			}
+			target, err := fs.ReadLink(fsys, cur)
+			if err != nil {
+				return "", &fs.PathError{Op: op, Path: name, Err: unwrapPathError(err)}
+			}
+			if strings.HasPrefix(target, "/") {
+				dirs = dirs[:0]
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+		case info.IsDir():
+			dirs = append(dirs, part)
+		default:
+			return "", &fs.PathError{Op: op, Path: name, Err: ErrNotDir}
+		}
+	}
+	if len(dirs) == 0 {
+		return ".", nil
+	}
+	return path.Join(dirs...), nil
+}
+
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*fs.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+func resolve(root Node, name string, follow bool) (Node, error) {
+	// stack holds the directories from the root down to the current one, so
+	// ".." in symlink targets can climb back up.
+	stack := []Node{root}
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		if !cur.Mode().IsDir() {
+			return nil, ErrNotDir
+		}
+		next, err := cur.Child(part)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		if next.Mode().Type() == fs.ModeSymlink && (len(parts) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return nil, ErrTooManyLinks
+			}
+			target := next.Target()
+			if strings.HasPrefix(target, "/") {
+				stack = stack[:1]
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+			continue
+		}
+		stack = append(stack, next)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// dir is an open directory.
+type dir struct {
+	n       Node
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+	pos     int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.n.Entries()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.info.Name(), Err: err}
+		}
+		d.entries, d.read = entries, true
+	}
+	rest := d.entries[d.pos:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(n, len(rest))]
+	}
+	d.pos += len(rest)
+	return rest, nil
+}
+
+// special is an open device node, named pipe or socket. Trees store no
+// contents for them, so reads see an empty file.
+type special struct {
+	info fs.FileInfo
+}
+
+func (s *special) Stat() (fs.FileInfo, error) { return s.info, nil }
+func (s *special) Close() error               { return nil }
+func (s *special) Read([]byte) (int, error)   { return 0, io.EOF }
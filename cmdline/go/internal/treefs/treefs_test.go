@@ -0,0 +1,186 @@
+package treefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memNode is a file of an in-memory tree.
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	data     string
+	children []*memNode
+}
+
+func (n *memNode) Mode() fs.FileMode            { return n.mode }
+func (n *memNode) Info(name string) fs.FileInfo { return memInfo{name, n} }
+func (n *memNode) Target() string               { return n.data }
+func (n *memNode) OpenFile(name string) fs.File {
+	return &memFile{Reader: strings.NewReader(n.data), info: memInfo{name, n}}
+}
+
+func (n *memNode) Child(name string) (Node, error) {
+	for _, c := range n.children {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (n *memNode) Entries() ([]fs.DirEntry, error) {
+	var out []fs.DirEntry
+	for _, c := range n.children {
+		out = append(out, fs.FileInfoToDirEntry(memInfo{c.name, c}))
+	}
+	return out, nil
+}
+
+type memInfo struct {
+	name string
+	n    *memNode
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return int64(len(fi.n.data)) }
+func (fi memInfo) Mode() fs.FileMode  { return fi.n.mode }
+func (fi memInfo) ModTime() time.Time { return time.Time{} }
+func (fi memInfo) IsDir() bool        { return fi.n.mode.IsDir() }
+func (fi memInfo) Sys() any           { return nil }
+
+type memFile struct {
+	*strings.Reader
+	info memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+func dirNode(name string, children ...*memNode) *memNode {
+	return &memNode{name: name, mode: fs.ModeDir | 0o755, children: children}
+}
+
+func fileNode(name, data string) *memNode { return &memNode{name: name, mode: 0o644, data: data} }
+
+func linkNode(name, target string) *memNode {
+	return &memNode{name: name, mode: fs.ModeSymlink | 0o777, data: target}
+}
+
+func TestTree(t *testing.T) {
+	root := dirNode(".",
+		dirNode("etc",
+			fileNode("hostname", "live\n"),
+			linkNode("mtab", "../proc/mounts"),
+		),
+		dirNode("proc", fileNode("mounts", "rootfs / rootfs rw 0 0\n")),
+		linkNode("abs", "/etc/hostname"),
+		linkNode("loop", "loop"),
+		linkNode("missing", "nowhere"),
+		&memNode{name: "null", mode: fs.ModeDevice | fs.ModeCharDevice | 0o666},
+	)
+
+	for name, want := range map[string]string{
+		"etc/hostname": "live\n",
+		"abs":          "live\n",
+		"etc/mtab":     "rootfs / rootfs rw 0 0\n",
+	} {
+		f, err := Open(root, name)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		if data, err := io.ReadAll(f); err != nil || string(data) != want {
+			t.Fatalf("Open(%q) read %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if target, err := ReadLink(root, "etc/mtab"); err != nil || target != "../proc/mounts" {
+		t.Fatalf("ReadLink(etc/mtab) = %q, %v", target, err)
+	}
+	if info, err := Lstat(root, "missing"); err != nil || info.Mode().Type() != fs.ModeSymlink {
+		t.Fatalf("Lstat(missing) = %v, %v", info, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"missing", fs.ErrNotExist},
+		{"loop", ErrTooManyLinks},
+		{"etc/hostname/x", ErrNotDir},
+		{"/etc", fs.ErrInvalid},
+	} {
+		if _, err := Stat(root, tt.name); !errors.Is(err, tt.err) {
+			t.Fatalf("Stat(%q) = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := ReadLink(root, "etc"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("ReadLink(etc) = %v, want %v", err, fs.ErrInvalid)
+	}
+
+	f, err := Open(root, "null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read of a device node = %d, %v", n, err)
+	}
+
+	f, err = Open(root, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		entries, err := f.(fs.ReadDirFile).ReadDir(1)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, entries[0].Name())
+	}
+	if !slices.Equal(names, []string{"hostname", "mtab"}) {
+		t.Fatalf("ReadDir(etc) in pages = %q", names)
+	}
+}
+
+// memFS serves a memNode tree as an fs.FS.
+type memFS struct{ root *memNode }
+
+func (f memFS) Open(name string) (fs.File, error)          { return Open(f.root, name) }
+func (f memFS) Lstat(name string) (fs.FileInfo, error)     { return Lstat(f.root, name) }
+func (f memFS) ReadLink(name string) (string, error)       { return ReadLink(f.root, name) }
+func (f memFS) ReadDir(name string) ([]fs.DirEntry, error) { return ReadDir(f.root, name) }
+
+func TestResolve(t *testing.T) {
+	fsys := memFS{dirNode(".",
+		dirNode("usr", dirNode("lib", fileNode("os-release", "ID=ubuntu\n"))),
+		dirNode("tmp", dirNode("outside")),
+		linkNode("lib", "usr/lib"),
+		linkNode("evil", "/tmp/outside"),
+		linkNode("up", "../../usr"),
+		fileNode("file", ""),
+	)}
+	for name, want := range map[string]string{
+		"lib/os-release": "usr/lib/os-release",
+		"evil/pwned":     "tmp/outside/pwned",
+		"up/lib":         "usr/lib",
+		"lib":            "lib",
+		".":              ".",
+	} {
+		if got, err := Resolve("extract", fsys, name); err != nil || got != want {
+			t.Fatalf("Resolve(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := Resolve("extract", fsys, "file/x"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("Resolve(file/x) = %v, want %v", err, ErrNotDir)
+	}
+	if _, err := Resolve("extract", fsys, "none/x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Resolve(none/x) = %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -0,0 +1,167 @@
+// Package bootcfg reads the boot menus of GRUB and ISOLINUX/SYSLINUX
+// configuration files through an fs.FS, such as an ISO opened with the
+// iso9660 or udf readers, to find the kernel, initrd and command line of each
+// entry.
+//
+// The parsers follow what the bootloaders do closely enough to list a menu,
+// not to run it. GRUB's source and configfile directives and SYSLINUX's
+// INCLUDE are followed, and GRUB variables set with set are expanded, but
+// conditions are not evaluated: entries from every branch of an if are
+// listed, and variables keep the last value assigned.
+package bootcfg
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Loaders that read the configuration of an Entry.
+const (
+	LoaderGRUB     = "grub"
+	LoaderISOLINUX = "isolinux"
+	LoaderSYSLINUX = "syslinux"
+)
+
+// maxDepth bounds the nesting of included files and submenus.
+const maxDepth = 16
+
+// Configuration files looked for by Parse, in order.
+var (
+	grubConfigs = []string{
+		"boot/grub/grub.cfg",
+		"boot/grub2/grub.cfg",
+		"EFI/BOOT/grub.cfg",
+		"EFI/boot/grub.cfg",
+		"grub.cfg",
+	}
+	syslinuxConfigs = []struct{ name, loader string }{
+		{"isolinux/isolinux.cfg", LoaderISOLINUX},
+		{"boot/isolinux/isolinux.cfg", LoaderISOLINUX},
+		{"isolinux.cfg", LoaderISOLINUX},
+		{"syslinux/syslinux.cfg", LoaderSYSLINUX},
+		{"boot/syslinux/syslinux.cfg", LoaderSYSLINUX},
+		{"syslinux.cfg", LoaderSYSLINUX},
+	}
+)
+
+// ErrNoConfig is returned by Parse when the image has no bootloader
+// configuration it knows.
+var ErrNoConfig = errors.New("bootcfg: no GRUB or ISOLINUX configuration found")
+
+// Entry is a bootable entry of a menu.
+type Entry struct {
+	// Label is the title shown in the menu. Entries of GRUB submenus are
+	// prefixed with the submenu titles, joined by " > ".
+	Label string `json:"label"`
+	// Loader is LoaderGRUB, LoaderISOLINUX or LoaderSYSLINUX.
+	Loader string `json:"loader"`
+	// Config is the configuration file that defines the entry.
+	Config string `json:"config"`
+	// Kernel and Initrd are paths relative to the image root. Kernel is
+	// empty for entries that chain-load or boot the local disk.
+	Kernel string   `json:"kernel"`
+	Initrd []string `json:"initrd"`
+	// Append is the kernel command line.
+	Append string `json:"append"`
+}
+
+// Config is a top-level bootloader configuration file.
+type Config struct {
+	Name string
+	// Loader is LoaderGRUB, LoaderISOLINUX or LoaderSYSLINUX.
+	Loader string
+}
+
+// Configs lists the known bootloader configurations that exist in fsys,
+// GRUB first: the files Parse starts from.
+func Configs(fsys fs.FS) []Config {
+	var configs []Config
+	for _, name := range grubConfigs {
+		if isFile(fsys, name) {
+			configs = append(configs, Config{Name: name, Loader: LoaderGRUB})
+		}
+	}
+	for _, c := range syslinuxConfigs {
+		if isFile(fsys, c.name) {
+			configs = append(configs, Config{Name: c.name, Loader: c.loader})
+		}
+	}
+	return configs
+}
+
+// Parse reads every known bootloader configuration in fsys and returns their
+// entries, GRUB first. Files included by an earlier configuration are not
+// read again.
+func Parse(fsys fs.FS) ([]Entry, error) {
+	configs := Configs(fsys)
+	if len(configs) == 0 {
+		return nil, ErrNoConfig
+	}
+	seen := make(map[string]bool)
+	var entries []Entry
+	for _, c := range configs {
+		if seen[c.Name] {
+			continue
+		}
+		var e []Entry
+		var err error
+		if c.Loader == LoaderGRUB {
+			e, err = parseGRUB(fsys, c.Name, seen)
+		} else {
+			e, err = parseSYSLINUX(fsys, c.Name, c.Loader, seen)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+	return entries, nil
+}
+
+// ParseGRUB returns the entries of the GRUB configuration name in fsys.
+func ParseGRUB(fsys fs.FS, name string) ([]Entry, error) {
+	return parseGRUB(fsys, name, make(map[string]bool))
+}
+
+// ParseSYSLINUX returns the entries of the ISOLINUX or SYSLINUX
+// configuration name in fsys. Relative paths are resolved against its
+// directory, which is where ISOLINUX starts.
+func ParseSYSLINUX(fsys fs.FS, name, loader string) ([]Entry, error) {
+	return parseSYSLINUX(fsys, name, loader, make(map[string]bool))
+}
+
+func isFile(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// readConfig reads an included file. Missing includes are skipped, as the
+// bootloaders do, and report ok false.
+func readConfig(fsys fs.FS, name string, depth int) (string, bool, error) {
+	if depth > maxDepth {
+		return "", false, fmt.Errorf("bootcfg: %s: includes nested more than %d deep", name, maxDepth)
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("bootcfg: %w", err)
+	}
+	return string(data), true, nil
+}
+
+// imagePath turns a path from a configuration into an fs.FS name: dir is
+// the directory relative paths start from.
+func imagePath(dir, p string) string {
+	if p == "" {
+		return ""
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join("/", dir, p)
+	}
+	return strings.TrimPrefix(path.Clean(p), "/")
+}
@@ -0,0 +1,150 @@
+package bootcfg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func file(text string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(text), Mode: 0o644}
+}
+
+func TestParseGRUB(t *testing.T) {
+	fsys := fstest.MapFS{
+		"boot/grub/grub.cfg": file(`# Ubuntu live image
+set timeout=30
+set cmdline="quiet splash"
+loadfont unicode
+
+source $prefix/vars.cfg
+menuentry "Try or Install Ubuntu" --class ubuntu {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz $cmdline ---
+	initrd	/casper/initrd
+}
+if [ "$grub_platform" = "efi" ]; then
+menuentry 'Boot from next volume' { exit 1; }
+fi
+submenu --hotkey=a "Advanced" {
+	menuentry --class ubuntu --hotkey s "Safe graphics" { linux ($root)/casper/vmlinuz nomodeset \
+		'$literal' "${live}" ; initrd /casper/initrd /casper/amd-ucode.img; }
+}
+function unused { menuentry "never" { linux /nope; } }
+`),
+		"boot/grub/vars.cfg": file("set live=boot=casper\n"),
+		"EFI/boot/grub.cfg":  file("search --set=root --file /.disk/info\nset prefix=($root)/boot/grub\nconfigfile $prefix/grub.cfg\n"),
+	}
+	got, err := Parse(fsys)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := []Entry{
+		{Label: "Try or Install Ubuntu", Loader: LoaderGRUB, Config: "boot/grub/grub.cfg", Kernel: "casper/vmlinuz", Initrd: []string{"casper/initrd"}, Append: "quiet splash ---"},
+		{Label: "Boot from next volume", Loader: LoaderGRUB, Config: "boot/grub/grub.cfg"},
+		{Label: "Advanced > Safe graphics", Loader: LoaderGRUB, Config: "boot/grub/grub.cfg", Kernel: "casper/vmlinuz", Initrd: []string{"casper/initrd", "casper/amd-ucode.img"}, Append: "nomodeset $literal boot=casper"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Parse() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseGRUBErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"unclosed brace": "menuentry x {\nlinux /v\n",
+		"stray brace":    "}\n",
+		"open quote":     "set x='abc\n",
+	} {
+		fsys := fstest.MapFS{"grub.cfg": file(text)}
+		if _, err := ParseGRUB(fsys, "grub.cfg"); err == nil {
+			t.Errorf("%s: ParseGRUB() succeeded", name)
+		}
+	}
+	loop := fstest.MapFS{"a.cfg": file("source /b.cfg\n"), "b.cfg": file("source /a.cfg\nmenuentry b { linux /b; }\n")}
+	if got, err := ParseGRUB(loop, "a.cfg"); err != nil || len(got) != 1 {
+		t.Fatalf("ParseGRUB() of sourcing loop = %+v, %v", got, err)
+	}
+}
+
+func TestParseSYSLINUX(t *testing.T) {
+	fsys := fstest.MapFS{
+		"isolinux/isolinux.cfg": file(`# D-I config version 2.0
+path
+include menu.cfg
+default vesamenu.c32
+`),
+		"isolinux/menu.cfg": file(`menu hshift 4
+MENU INCLUDE stdmenu.cfg
+label install
+	menu label ^Install
+	menu default
+	kernel /install.amd/vmlinuz
+	append vga=788 initrd=/install.amd/initrd.gz --- quiet
+TEXT HELP
+ label notanentry
+ENDTEXT
+LABEL rescue
+	LINUX ../install.amd/vmlinuz
+	INITRD ../install.amd/initrd.gz,extra.img
+	APPEND rescue/enable=true
+label hd
+	localboot 0x80
+`),
+		"isolinux/stdmenu.cfg": file("menu background splash.png\n"),
+	}
+	got, err := Parse(fsys)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := []Entry{
+		{Label: "Install", Loader: LoaderISOLINUX, Config: "isolinux/menu.cfg", Kernel: "install.amd/vmlinuz", Initrd: []string{"install.amd/initrd.gz"}, Append: "vga=788 --- quiet"},
+		{Label: "rescue", Loader: LoaderISOLINUX, Config: "isolinux/menu.cfg", Kernel: "install.amd/vmlinuz", Initrd: []string{"install.amd/initrd.gz", "isolinux/extra.img"}, Append: "rescue/enable=true"},
+		{Label: "hd", Loader: LoaderISOLINUX, Config: "isolinux/menu.cfg"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Parse() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseNoConfig(t *testing.T) {
+	if _, err := Parse(fstest.MapFS{"README": file("x")}); !errors.Is(err, ErrNoConfig) {
+		t.Fatalf("Parse() error = %v, want ErrNoConfig", err)
+	}
+}
+
+func TestConfigs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"isolinux/isolinux.cfg":  file("default live\n"),
+		"EFI/BOOT/grub.cfg":      file("set timeout=5\n"),
+		"boot/grub/grub.cfg":     file("set timeout=5\n"),
+		"boot/grub/loopback.cfg": file("source /boot/grub/grub.cfg\n"),
+	}
+	want := []Config{
+		{Name: "boot/grub/grub.cfg", Loader: LoaderGRUB},
+		{Name: "EFI/BOOT/grub.cfg", Loader: LoaderGRUB},
+		{Name: "isolinux/isolinux.cfg", Loader: LoaderISOLINUX},
+	}
+	if got := Configs(fsys); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Configs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExpandGRUB(t *testing.T) {
+	vars := map[string]string{"a": "1", "name": "x y"}
+	for raw, want := range map[string]string{
+		`$a`:          "1",
+		`${a}b`:       "1b",
+		`"$name"`:     "x y",
+		`'$name'`:     "$name",
+		`a\ b`:        "a b",
+		`"\$a \x"`:    `$a \x`,
+		`$missing-z`:  "-z",
+		`cost$`:       "cost$",
+		`pre"$a"post`: "pre1post",
+	} {
+		if got := expandGRUB(raw, vars); got != want {
+			t.Errorf("expandGRUB(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package bootcfg
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// grubCommand is a command of a GRUB script. Words keep their quoting and
+// are expanded when the command runs.
+type grubCommand struct {
+	words []string
+	// body holds the commands of a trailing { } block.
+	body []grubCommand
+}
+
+// grubDevice matches the device prefix of a GRUB path, such as "(hd0,gpt2)"
+// or "($root)" after expansion.
+var grubDevice = regexp.MustCompile(`^\([^)]*\)`)
+
+// grubParser runs a GRUB configuration far enough to collect its entries.
+type grubParser struct {
+	fsys    fs.FS
+	seen    map[string]bool
+	entries []Entry
+}
+
+func parseGRUB(fsys fs.FS, name string, seen map[string]bool) ([]Entry, error) {
+	p := &grubParser{fsys: fsys, seen: seen}
+	vars := map[string]string{"prefix": "/" + path.Dir(name), "root": ""}
+	if err := p.include(name, vars, nil, 0); err != nil {
+		return nil, err
+	}
+	return p.entries, nil
+}
+
+// include runs the script name with vars, as source does.
+func (p *grubParser) include(name string, vars map[string]string, menu []string, depth int) error {
+	if p.seen[name] {
+		return nil
+	}
+	text, ok, err := readConfig(p.fsys, name, depth)
+	if err != nil || !ok {
+		return err
+	}
+	p.seen[name] = true
+	commands, err := parseGRUBScript(text)
+	if err != nil {
+		return fmt.Errorf("bootcfg: %s: %w", name, err)
+	}
+	return p.run(name, commands, vars, menu, depth)
+}
+
+// run executes commands from the file config.
+func (p *grubParser) run(config string, commands []grubCommand, vars map[string]string, menu []string, depth int) error {
+	for _, c := range commands {
+		words := make([]string, len(c.words))
+		for i, w := range c.words {
+			words[i] = expandGRUB(w, vars)
+		}
+		// Keywords of if, while and for are skipped so the commands of every
+		// branch run.
+		for len(words) > 0 && isGRUBKeyword(words[0]) {
+			words = words[1:]
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "if", "elif", "while", "until", "for", "fi", "done", "function":
+			// Conditions are not evaluated and functions never called.
+		case "set":
+			for _, assignment := range words[1:] {
+				if name, value, ok := strings.Cut(assignment, "="); ok {
+					vars[name] = value
+				}
+			}
+		case "unset":
+			for _, name := range words[1:] {
+				delete(vars, name)
+			}
+		case "source":
+			if len(words) > 1 {
+				if err := p.include(grubPath(words[1]), vars, menu, depth+1); err != nil {
+					return err
+				}
+			}
+		case "configfile":
+			if len(words) > 1 {
+				if err := p.include(grubPath(words[1]), maps.Clone(vars), menu, depth+1); err != nil {
+					return err
+				}
+			}
+		case "menuentry":
+			if title, ok := grubTitle(words); ok && c.body != nil {
+				p.menuentry(config, append(menu, title), c.body, maps.Clone(vars))
+			}
+		case "submenu":
+			if title, ok := grubTitle(words); ok && c.body != nil {
+				if depth >= maxDepth {
+					return fmt.Errorf("bootcfg: %s: submenus nested more than %d deep", config, maxDepth)
+				}
+				if err := p.run(config, c.body, maps.Clone(vars), append(menu, title), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// menuentry records the entry whose body is commands.
+func (p *grubParser) menuentry(config string, title []string, commands []grubCommand, vars map[string]string) {
+	entry := Entry{Label: strings.Join(title, " > "), Loader: LoaderGRUB, Config: config}
+	var walk func([]grubCommand)
+	walk = func(commands []grubCommand) {
+		for _, c := range commands {
+			words := make([]string, len(c.words))
+			for i, w := range c.words {
+				words[i] = expandGRUB(w, vars)
+			}
+			for len(words) > 0 && isGRUBKeyword(words[0]) {
+				words = words[1:]
+			}
+			if len(words) == 0 {
+				continue
+			}
+			switch words[0] {
+			case "set":
+				for _, assignment := range words[1:] {
+					if name, value, ok := strings.Cut(assignment, "="); ok {
+						vars[name] = value
+					}
+				}
+			case "linux", "linux16", "linuxefi", "multiboot", "multiboot2":
+				if len(words) > 1 {
+					entry.Kernel = grubPath(words[1])
+					entry.Append = strings.Join(words[2:], " ")
+				}
+			case "initrd", "initrd16", "initrdefi":
+				entry.Initrd = entry.Initrd[:0]
+				for _, w := range words[1:] {
+					entry.Initrd = append(entry.Initrd, grubPath(w))
+				}
+			}
+			walk(c.body)
+		}
+	}
+	walk(commands)
+	p.entries = append(p.entries, entry)
+}
+
+// grubTitle returns the title of a menuentry or submenu command, skipping
+// the options that may come before or after it, such as --class and
+// --hotkey.
+func grubTitle(words []string) (string, bool) {
+	for i := 1; i < len(words); i++ {
+		switch w := words[i]; {
+		case w == "--class", w == "--users", w == "--hotkey", w == "--id":
+			i++
+		case strings.HasPrefix(w, "--"):
+		default:
+			return w, true
+		}
+	}
+	return "", false
+}
+
+func isGRUBKeyword(word string) bool {
+	switch word {
+	case "then", "else", "do", "!":
+		return true
+	}
+	return false
+}
+
+// grubPath turns a GRUB file path into an fs.FS name, dropping the device.
+func grubPath(p string) string {
+	return imagePath("", grubDevice.ReplaceAllString(p, ""))
+}
+
+// parseGRUBScript splits a GRUB script into commands, nesting { } blocks.
+func parseGRUBScript(text string) ([]grubCommand, error) {
+	lex := &grubLexer{text: text, line: 1}
+	commands, closed, err := parseGRUBBlock(lex)
+	if err != nil {
+		return nil, err
+	}
+	if closed {
+		return nil, fmt.Errorf("line %d: unexpected }", lex.line)
+	}
+	return commands, nil
+}
+
+// parseGRUBBlock reads commands up to the end of the script or an unmatched
+// "}", reporting which ended it.
+func parseGRUBBlock(lex *grubLexer) ([]grubCommand, bool, error) {
+	var commands []grubCommand
+	var current grubCommand
+	for {
+		word, sep, err := lex.next()
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case word == "}" && len(current.words) == 0:
+			return commands, true, nil
+		case word == "{":
+			line := lex.line
+			body, closed, err := parseGRUBBlock(lex)
+			if err != nil {
+				return nil, false, err
+			}
+			if !closed {
+				return nil, false, fmt.Errorf("line %d: { is never closed", line)
+			}
+			current.body = body
+			commands = append(commands, current)
+			current = grubCommand{}
+			continue
+		case word != "":
+			current.words = append(current.words, word)
+		}
+		if sep != sepNone && len(current.words) > 0 {
+			commands = append(commands, current)
+			current = grubCommand{}
+		}
+		if sep == sepEOF {
+			return commands, false, nil
+		}
+	}
+}
+
+// Separators returned after a word by grubLexer.next.
+const (
+	sepNone = iota
+	// sepCommand ends a command: a newline or ";".
+	sepCommand
+	sepEOF
+)
+
+// grubLexer splits a GRUB script into raw words, keeping quotes and
+// backslashes for expandGRUB.
+type grubLexer struct {
+	text string
+	pos  int
+	line int
+}
+
+// next returns the next word, which may be empty, and what follows it.
+func (l *grubLexer) next() (string, int, error) {
+	// Skip blanks and comments.
+skip:
+	for l.pos < len(l.text) {
+		c := l.text[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '\\' && strings.HasPrefix(l.text[l.pos:], "\\\n"):
+			l.pos += 2
+			l.line++
+		case c == '#':
+			for l.pos < len(l.text) && l.text[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			break skip
+		}
+	}
+	if l.pos == len(l.text) {
+		return "", sepEOF, nil
+	}
+	switch c := l.text[l.pos]; c {
+	case '\n', ';':
+		l.pos++
+		if c == '\n' {
+			l.line++
+		}
+		return "", sepCommand, nil
+	}
+
+	start, startLine := l.pos, l.line
+	for l.pos < len(l.text) {
+		c := l.text[l.pos]
+		switch c {
+		case ' ', '\t', '\r', '\n', ';':
+			return l.text[start:l.pos], l.separator(), nil
+		case '\\':
+			if l.pos+1 < len(l.text) && l.text[l.pos+1] == '\n' {
+				l.line++
+			}
+			l.pos += 2
+		case '\'', '"':
+			end := l.pos + 1
+			for end < len(l.text) && l.text[end] != c {
+				if c == '"' && l.text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(l.text) {
+				return "", sepNone, fmt.Errorf("line %d: unterminated %c quote", startLine, c)
+			}
+			l.line += strings.Count(l.text[l.pos:end], "\n")
+			l.pos = end + 1
+		default:
+			l.pos++
+		}
+	}
+	l.pos = min(l.pos, len(l.text))
+	return l.text[start:l.pos], sepNone, nil
+}
+
+// separator consumes the blanks after a word and reports whether a command
+// separator or the end of the script follows.
+func (l *grubLexer) separator() int {
+	for l.pos < len(l.text) && (l.text[l.pos] == ' ' || l.text[l.pos] == '\t' || l.text[l.pos] == '\r') {
+		l.pos++
+	}
+	if l.pos == len(l.text) {
+		return sepEOF
+	}
+	switch l.text[l.pos] {
+	case '\n':
+		l.line++
+		l.pos++
+		return sepCommand
+	case ';':
+		l.pos++
+		return sepCommand
+	}
+	return sepNone
+}
+
+// expandGRUB removes the quoting of a raw word and substitutes $name and
+// ${name} from vars outside single quotes. Unset variables expand to
+// nothing.
+func expandGRUB(word string, vars map[string]string) string {
+	var b strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(word):
+			i++
+			switch {
+			case word[i] == '\n':
+			case quote == '"' && !strings.ContainsRune("$\"\\", rune(word[i])):
+				b.WriteByte('\\')
+				b.WriteByte(word[i])
+			default:
+				b.WriteByte(word[i])
+			}
+		case c == '"':
+			if quote == '"' {
+				quote = 0
+			} else {
+				quote = '"'
+			}
+		case c == '\'' && quote == 0:
+			quote = '\''
+		case c == '$':
+			name, n := grubVariable(word[i+1:])
+			if n == 0 {
+				b.WriteByte(c)
+				continue
+			}
+			b.WriteString(vars[name])
+			i += n
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grubVariable parses the variable reference after a "$", returning its name
+// and length.
+func grubVariable(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	n := 0
+	for n < len(s) && (s[n] == '_' || 'a' <= s[n] && s[n] <= 'z' || 'A' <= s[n] && s[n] <= 'Z' || n > 0 && '0' <= s[n] && s[n] <= '9') {
+		n++
+	}
+	if n == 0 && len(s) > 0 && ('0' <= s[0] && s[0] <= '9' || s[0] == '?' || s[0] == '#') {
+		n = 1
+	}
+	return s[:n], n
+}
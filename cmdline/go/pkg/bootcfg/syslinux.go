@@ -0,0 +1,153 @@
+package bootcfg
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// syslinuxParser collects the LABEL entries of an ISOLINUX or SYSLINUX
+// configuration and the files it includes.
+type syslinuxParser struct {
+	fsys    fs.FS
+	loader  string
+	seen    map[string]bool
+	entries []Entry
+	// dir is the directory relative paths start from: that of the top-level
+	// configuration, where ISOLINUX runs.
+	dir string
+	// current is the entry being read, or nil before the first LABEL.
+	current *Entry
+}
+
+func parseSYSLINUX(fsys fs.FS, name, loader string, seen map[string]bool) ([]Entry, error) {
+	p := &syslinuxParser{fsys: fsys, loader: loader, seen: seen, dir: path.Dir(name)}
+	if err := p.include(name, 0); err != nil {
+		return nil, err
+	}
+	p.finish()
+	return p.entries, nil
+}
+
+// include reads the configuration name as part of the current one.
+func (p *syslinuxParser) include(name string, depth int) error {
+	if p.seen[name] {
+		return nil
+	}
+	text, ok, err := readConfig(p.fsys, name, depth)
+	if err != nil || !ok {
+		return err
+	}
+	p.seen[name] = true
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	inText := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		keyword, rest := splitKeyword(line)
+		if inText {
+			inText = keyword != "endtext"
+			continue
+		}
+		switch keyword {
+		case "", "#":
+		case "text":
+			// TEXT HELP blocks run to ENDTEXT.
+			inText = true
+		case "label":
+			p.finish()
+			p.current = &Entry{Label: rest, Loader: p.loader, Config: name}
+		case "menu":
+			sub, arg := splitKeyword(rest)
+			switch sub {
+			case "label":
+				if p.current != nil {
+					p.current.Label = strings.ReplaceAll(arg, "^", "")
+				}
+			case "include":
+				if err := p.includeArg(arg, depth); err != nil {
+					return err
+				}
+			}
+		case "include", "config":
+			if err := p.includeArg(rest, depth); err != nil {
+				return err
+			}
+		case "kernel", "linux":
+			if p.current != nil {
+				p.current.Kernel = imagePath(p.dir, rest)
+			}
+		case "initrd":
+			if p.current != nil {
+				p.current.Initrd = p.initrds(rest)
+			}
+		case "append":
+			if p.current != nil {
+				p.current.Append = p.appendLine(rest)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("bootcfg: %s: %w", name, err)
+	}
+	return nil
+}
+
+// includeArg follows an INCLUDE whose argument is the file and, for MENU
+// INCLUDE, an optional title.
+func (p *syslinuxParser) includeArg(arg string, depth int) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return nil
+	}
+	return p.include(imagePath(p.dir, fields[0]), depth+1)
+}
+
+// appendLine moves initrd= options of an APPEND line into the current
+// entry's Initrd and returns the rest of the command line.
+func (p *syslinuxParser) appendLine(line string) string {
+	var kept []string
+	for _, option := range strings.Fields(line) {
+		if value, ok := strings.CutPrefix(option, "initrd="); ok {
+			p.current.Initrd = append(p.current.Initrd, p.initrds(value)...)
+			continue
+		}
+		kept = append(kept, option)
+	}
+	return strings.Join(kept, " ")
+}
+
+// initrds splits a comma-separated list of initrd files.
+func (p *syslinuxParser) initrds(list string) []string {
+	var files []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, imagePath(p.dir, f))
+		}
+	}
+	return files
+}
+
+// finish records the entry being read.
+func (p *syslinuxParser) finish() {
+	if p.current != nil {
+		p.entries = append(p.entries, *p.current)
+		p.current = nil
+	}
+}
+
+// splitKeyword splits a configuration line into its lower-cased keyword and
+// the rest of the line.
+func splitKeyword(line string) (string, string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	if strings.HasPrefix(fields[0], "#") {
+		return "#", ""
+	}
+	line = strings.TrimSpace(line)
+	return strings.ToLower(fields[0]), strings.TrimSpace(line[len(fields[0]):])
+}
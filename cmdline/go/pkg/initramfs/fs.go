@@ -0,0 +1,182 @@
+package initramfs
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"thatnerdjosh.com/devtools/internal/treefs"
+)
+
+// Stat holds the file details fs.FileInfo cannot express. FileInfo.Sys
+// returns a *Stat for every file of an FS.
+type Stat struct {
+	// Inode identifies the file within the archive. Entries sharing it are
+	// hard links.
+	Inode uint64
+	Nlink uint32
+	UID   uint32
+	GID   uint32
+	// Major and Minor identify the device of a device node.
+	Major, Minor uint32
+}
+
+// FS is the file tree of an archive as the kernel unpacks it: a later entry
+// replaces an earlier one of the same name, and directories missing from
+// the archive are implied by the paths below them. It implements fs.FS,
+// fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS.
+type FS struct {
+	root *node
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadLinkFS = (*FS)(nil)
+)
+
+// node is a file of the tree.
+type node struct {
+	name string
+	e    *Entry
+	// children of a directory, sorted by name.
+	children []*node
+}
+
+// NewFS returns the file tree of a.
+func NewFS(a *Archive) *FS {
+	root := &node{name: ".", e: &Entry{Mode: fs.ModeDir | 0o755}}
+	for _, e := range a.Entries {
+		dir := root
+		parts := strings.Split(e.Name, "/")
+		for _, part := range parts[:len(parts)-1] {
+			next := dir.child(part)
+			if next == nil || !next.e.Mode.IsDir() {
+				next = dir.add(&node{name: part, e: &Entry{Name: path.Join(dir.e.Name, part), Mode: fs.ModeDir | 0o755}})
+			}
+			dir = next
+		}
+		n := &node{name: parts[len(parts)-1], e: e}
+		if old := dir.child(n.name); old != nil && old.e.Mode.IsDir() && e.Mode.IsDir() {
+			// Like mkdir over an existing directory: the contents stay.
+			n.children = old.children
+		}
+		dir.add(n)
+	}
+	return &FS{root: root}
+}
+
+func (n *node) child(name string) *node {
+	i, ok := slices.BinarySearchFunc(n.children, name, func(c *node, name string) int { return strings.Compare(c.name, name) })
+	if !ok {
+		return nil
+	}
+	return n.children[i]
+}
+
+// add inserts c, replacing any child of the same name.
+func (n *node) add(c *node) *node {
+	i, ok := slices.BinarySearchFunc(n.children, c.name, func(c *node, name string) int { return strings.Compare(c.name, name) })
+	if ok {
+		n.children[i] = c
+	} else {
+		n.children = slices.Insert(n.children, i, c)
+	}
+	return c
+}
+
+// Open opens the named file, following symlinks. Symlinks resolve within the
+// archive, with absolute targets relative to its root. Regular files are
+// returned as *File.
+func (f *FS) Open(name string) (fs.File, error) { return treefs.Open(f.root, name) }
+
+// Stat returns a FileInfo describing the named file, following symlinks.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return treefs.Stat(f.root, name) }
+
+// Lstat returns a FileInfo describing the named file without following a
+// final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) { return treefs.Lstat(f.root, name) }
+
+// ReadLink returns the target of the named symlink.
+func (f *FS) ReadLink(name string) (string, error) { return treefs.ReadLink(f.root, name) }
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) { return treefs.ReadDir(f.root, name) }
+
+// The methods below serve a node to treefs.
+
+func (n *node) Mode() fs.FileMode            { return n.e.Mode }
+func (n *node) Info(name string) fs.FileInfo { return fileInfo{name: name, n: n} }
+func (n *node) Target() string               { return string(n.e.Data) }
+
+func (n *node) OpenFile(name string) fs.File {
+	return &File{Reader: bytes.NewReader(n.e.Data), info: fileInfo{name: name, n: n}}
+}
+
+func (n *node) Child(name string) (treefs.Node, error) {
+	if c := n.child(name); c != nil {
+		return c, nil
+	}
+	return nil, nil
+}
+
+func (n *node) Entries() ([]fs.DirEntry, error) {
+	out := make([]fs.DirEntry, len(n.children))
+	for i, c := range n.children {
+		out[i] = dirEntry{n: c}
+	}
+	return out, nil
+}
+
+// File is an open regular file. It implements io.ReaderAt and io.Seeker in
+// addition to fs.File.
+type File struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func (f *File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *File) Close() error               { return nil }
+
+// fileInfo implements fs.FileInfo for a node.
+type fileInfo struct {
+	name string
+	n    *node
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size() }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.n.e.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.n.e.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.n.e.Mode.IsDir() }
+
+func (fi fileInfo) size() int64 {
+	if fi.n.e.Mode.IsRegular() || fi.n.e.Mode.Type() == fs.ModeSymlink {
+		return int64(len(fi.n.e.Data))
+	}
+	return 0
+}
+
+// Sys returns a *Stat.
+func (fi fileInfo) Sys() any {
+	e := fi.n.e
+	st := &Stat{Inode: uint64(e.Inode), Nlink: e.Nlink, UID: e.UID, GID: e.GID}
+	if e.Mode&fs.ModeDevice != 0 {
+		st.Major, st.Minor = e.Major, e.Minor
+	}
+	return st
+}
+
+// dirEntry implements fs.DirEntry.
+type dirEntry struct {
+	n *node
+}
+
+func (d dirEntry) Name() string               { return d.n.name }
+func (d dirEntry) IsDir() bool                { return d.n.e.Mode.IsDir() }
+func (d dirEntry) Type() fs.FileMode          { return d.n.e.Mode.Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return fileInfo{name: d.n.name, n: d.n}, nil }
+func (d dirEntry) String() string             { return fs.FormatDirEntry(d) }
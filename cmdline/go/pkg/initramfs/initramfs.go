@@ -0,0 +1,407 @@
+// Package initramfs reads and writes Linux initramfs images: newc cpio
+// archives, uncompressed or compressed with gzip, xz, zstd or lz4, and
+// concatenated the way the kernel unpacks them, as when uncompressed early
+// microcode archives precede the compressed main one.
+//
+// Images are read into memory whole. Each archive of an image is returned
+// with its entries in archive order and can be browsed through FS.
+package initramfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressions of an archive.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionXZ   = "xz"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+// Compressions lists the compressions Read and Write support.
+var Compressions = []string{CompressionNone, CompressionGzip, CompressionXZ, CompressionZstd, CompressionLZ4}
+
+const (
+	newcMagic    = "070701"
+	newcCRCMagic = "070702"
+	headerSize   = 110
+	trailerName  = "TRAILER!!!"
+)
+
+// Magic numbers of the compressed streams the kernel unpacks.
+var magics = []struct {
+	magic       []byte
+	compression string
+}{
+	{[]byte{0x1F, 0x8B}, CompressionGzip},
+	{[]byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, CompressionXZ},
+	{[]byte{0x28, 0xB5, 0x2F, 0xFD}, CompressionZstd},
+	// lz4 initramfs images use the legacy format; frames are accepted too.
+	{[]byte{0x02, 0x21, 0x4C, 0x18}, CompressionLZ4},
+	{[]byte{0x04, 0x22, 0x4D, 0x18}, CompressionLZ4},
+}
+
+var (
+	// ErrFormat is returned for data that is not a cpio archive or a stream
+	// compressed in a supported way.
+	ErrFormat = errors.New("initramfs: not a newc cpio archive or a supported compressed stream")
+	// ErrCorrupt reports a truncated or malformed archive.
+	ErrCorrupt = errors.New("initramfs: corrupt cpio archive")
+)
+
+// Entry is a file of an archive.
+type Entry struct {
+	// Name is the path of the file, relative to the archive root.
+	Name     string
+	Mode     fs.FileMode
+	UID, GID uint32
+	Nlink    uint32
+	// Inode identifies the file within its archive; regular files sharing it
+	// are hard links.
+	Inode   uint32
+	ModTime time.Time
+	// Major and Minor identify the device of a device node.
+	Major, Minor uint32
+	// Data holds the contents of a regular file or the target of a symlink.
+	Data []byte
+}
+
+// Archive is one cpio archive of an image.
+type Archive struct {
+	// Compression is that of the stream holding the archive.
+	Compression string
+	// Offset is where the archive, or the compressed stream holding it,
+	// starts in the image.
+	Offset  int64
+	Entries []*Entry
+}
+
+// Read reads every archive of the initramfs image r.
+func Read(r io.Reader) ([]*Archive, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("initramfs: %w", err)
+	}
+	var archives []*Archive
+	pos := 0
+	for {
+		pos = skipPadding(data, pos)
+		if pos == len(data) {
+			break
+		}
+		compression := detect(data[pos:])
+		switch compression {
+		case "":
+			if len(archives) == 0 {
+				return nil, ErrFormat
+			}
+			return nil, fmt.Errorf("%w at offset %d", ErrFormat, pos)
+		case CompressionNone:
+			a, n, err := readArchive(data[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("archive at offset %d: %w", pos, err)
+			}
+			a.Compression, a.Offset = CompressionNone, int64(pos)
+			archives = append(archives, a)
+			pos += n
+		default:
+			plain, n, err := decompress(compression, data[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("initramfs: %s stream at offset %d: %w", compression, pos, err)
+			}
+			inner, err := readArchives(plain)
+			if err != nil {
+				return nil, fmt.Errorf("%s stream at offset %d: %w", compression, pos, err)
+			}
+			for _, a := range inner {
+				a.Compression, a.Offset = compression, int64(pos)
+			}
+			archives = append(archives, inner...)
+			pos += n
+		}
+	}
+	if len(archives) == 0 {
+		return nil, ErrFormat
+	}
+	return archives, nil
+}
+
+// readArchives reads the concatenated uncompressed archives of a
+// decompressed stream.
+func readArchives(data []byte) ([]*Archive, error) {
+	var archives []*Archive
+	for pos := skipPadding(data, 0); pos < len(data); pos = skipPadding(data, pos) {
+		if detect(data[pos:]) != CompressionNone {
+			return nil, fmt.Errorf("%w at offset %d of the decompressed data", ErrFormat, pos)
+		}
+		a, n, err := readArchive(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, a)
+		pos += n
+	}
+	return archives, nil
+}
+
+// skipPadding skips the zero bytes padding archives to a block size.
+func skipPadding(data []byte, pos int) int {
+	for pos < len(data) && data[pos] == 0 {
+		pos++
+	}
+	return pos
+}
+
+// detect returns the compression of the stream starting data, or "" when
+// it starts with neither a cpio header nor a known magic number.
+func detect(data []byte) string {
+	if bytes.HasPrefix(data, []byte(newcMagic)) || bytes.HasPrefix(data, []byte(newcCRCMagic)) {
+		return CompressionNone
+	}
+	for _, m := range magics {
+		if bytes.HasPrefix(data, m.magic) {
+			return m.compression
+		}
+	}
+	return ""
+}
+
+// decompress decompresses the stream at the start of data and returns the
+// number of bytes of data it used. Only gzip reports where its stream ends;
+// the other formats are assumed to run to the end of the image, bar zero
+// padding.
+func decompress(compression string, data []byte) ([]byte, int, error) {
+	if compression == CompressionGzip {
+		return gunzip(data)
+	}
+	plain, err := decompressAll(compression, data)
+	if err != nil {
+		// Retry without the zero padding some tools append to the image.
+		trimmed := bytes.TrimRight(data, "\x00")
+		if len(trimmed) == len(data) {
+			return nil, 0, err
+		}
+		if plain, err = decompressAll(compression, trimmed); err != nil {
+			return nil, 0, err
+		}
+	}
+	return plain, len(data), nil
+}
+
+func decompressAll(compression string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch compression {
+	case CompressionXZ:
+		xr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = xr
+	case CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(1<<32))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		r = dec
+	case CompressionLZ4:
+		r = lz4.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	return io.ReadAll(r)
+}
+
+// gunzip decompresses consecutive gzip members, which a bytes.Reader lets
+// the decompressor read without overshooting their end.
+func gunzip(data []byte) ([]byte, int, error) {
+	src := bytes.NewReader(data)
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	var plain bytes.Buffer
+	for {
+		zr.Multistream(false)
+		if _, err := io.Copy(&plain, zr); err != nil {
+			return nil, 0, err
+		}
+		used := len(data) - src.Len()
+		next := skipPadding(data, used)
+		if detect(data[next:]) != CompressionGzip {
+			return plain.Bytes(), used, nil
+		}
+		src.Seek(int64(next), io.SeekStart)
+		if err := zr.Reset(src); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// readArchive reads the archive at the start of data up to its trailer and
+// returns it with the number of bytes it spans.
+func readArchive(data []byte) (*Archive, int, error) {
+	a := &Archive{}
+	pos := 0
+	for {
+		if len(data)-pos < headerSize {
+			return nil, 0, fmt.Errorf("%w: truncated header at offset %d", ErrCorrupt, pos)
+		}
+		h := data[pos : pos+headerSize]
+		magic := string(h[:6])
+		if magic != newcMagic && magic != newcCRCMagic {
+			return nil, 0, fmt.Errorf("%w: bad magic %q at offset %d", ErrCorrupt, magic, pos)
+		}
+		var field [13]uint32
+		for i := range field {
+			v, err := strconv.ParseUint(string(h[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: bad header at offset %d", ErrCorrupt, pos)
+			}
+			field[i] = uint32(v)
+		}
+		ino, mode, uid, gid, nlink, mtime, size := field[0], field[1], field[2], field[3], field[4], field[5], int(field[6])
+		rdevMajor, rdevMinor, nameSize := field[9], field[10], int(field[11])
+
+		nameStart := pos + headerSize
+		dataStart := align4(nameStart + nameSize)
+		end := align4(dataStart + size)
+		if nameSize == 0 || dataStart+size > len(data) {
+			return nil, 0, fmt.Errorf("%w: entry at offset %d runs past the end", ErrCorrupt, pos)
+		}
+		name := strings.TrimRight(string(data[nameStart:nameStart+nameSize]), "\x00")
+		pos = min(end, len(data))
+		if name == trailerName {
+			linkData(a.Entries)
+			return a, pos, nil
+		}
+
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if name == "" {
+			// The archive root, ".".
+			continue
+		}
+		if !fs.ValidPath(name) {
+			return nil, 0, fmt.Errorf("%w: invalid name %q", ErrCorrupt, name)
+		}
+		a.Entries = append(a.Entries, &Entry{
+			Name:    name,
+			Mode:    fileMode(mode),
+			UID:     uid,
+			GID:     gid,
+			Nlink:   nlink,
+			Inode:   ino,
+			ModTime: time.Unix(int64(mtime), 0).UTC(),
+			Major:   rdevMajor,
+			Minor:   rdevMinor,
+			Data:    data[dataStart : dataStart+size],
+		})
+	}
+}
+
+// linkData gives every hard link the contents newc stores with only one of
+// them, the last.
+func linkData(entries []*Entry) {
+	contents := make(map[uint32][]byte)
+	for _, e := range entries {
+		if e.Mode.IsRegular() && e.Nlink > 1 && len(e.Data) > 0 {
+			contents[e.Inode] = e.Data
+		}
+	}
+	for _, e := range entries {
+		if e.Mode.IsRegular() && e.Nlink > 1 && len(e.Data) == 0 {
+			e.Data = contents[e.Inode]
+		}
+	}
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// File type bits of a cpio mode.
+const (
+	modeFmt    = 0o170000
+	modeSocket = 0o140000
+	modeLink   = 0o120000
+	modeReg    = 0o100000
+	modeBlock  = 0o060000
+	modeDir    = 0o040000
+	modeChar   = 0o020000
+	modeFIFO   = 0o010000
+)
+
+// fileMode converts a cpio mode to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	switch mode & modeFmt {
+	case modeSocket:
+		m |= fs.ModeSocket
+	case modeLink:
+		m |= fs.ModeSymlink
+	case modeBlock:
+		m |= fs.ModeDevice
+	case modeDir:
+		m |= fs.ModeDir
+	case modeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case modeFIFO:
+		m |= fs.ModeNamedPipe
+	}
+	return m
+}
+
+// cpioMode converts an fs.FileMode to a cpio mode.
+func cpioMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	switch m.Type() {
+	case fs.ModeSocket:
+		mode |= modeSocket
+	case fs.ModeSymlink:
+		mode |= modeLink
+	case fs.ModeDevice:
+		mode |= modeBlock
+	case fs.ModeDir:
+		mode |= modeDir
+	case fs.ModeDevice | fs.ModeCharDevice:
+		mode |= modeChar
+	case fs.ModeNamedPipe:
+		mode |= modeFIFO
+	default:
+		mode |= modeReg
+	}
+	return mode
+}
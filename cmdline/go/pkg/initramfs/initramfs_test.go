@@ -0,0 +1,142 @@
+package initramfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var modTime = time.Date(2024, 4, 25, 14, 3, 7, 0, time.UTC)
+
+func mainEntries() []*Entry {
+	return []*Entry{
+		{Name: "bin", Mode: fs.ModeDir | 0o755, Nlink: 2, Inode: 1, ModTime: modTime},
+		{Name: "bin/busybox", Mode: 0o755, Nlink: 2, Inode: 2, ModTime: modTime},
+		{Name: "bin/sh", Mode: 0o755, Nlink: 2, Inode: 2, ModTime: modTime, Data: []byte("#!busybox\n")},
+		{Name: "init", Mode: fs.ModeSymlink | 0o777, Nlink: 1, Inode: 3, ModTime: modTime, Data: []byte("bin/sh")},
+		{Name: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Nlink: 1, Inode: 4, ModTime: modTime, Major: 5, Minor: 1},
+		{Name: "etc/initrd-release", Mode: 0o644, Nlink: 1, Inode: 5, UID: 0, GID: 0, ModTime: modTime, Data: []byte("NAME=test\n")},
+	}
+}
+
+func image(t *testing.T, parts ...[]byte) []byte {
+	t.Helper()
+	return bytes.Join(parts, nil)
+}
+
+func archive(t *testing.T, entries []*Entry, compression string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf, entries, compression); err != nil {
+		t.Fatalf("Write(%s) error = %v", compression, err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, compression := range Compressions {
+		t.Run(compression, func(t *testing.T) {
+			data := archive(t, mainEntries(), compression)
+			if again := archive(t, mainEntries(), compression); !bytes.Equal(data, again) {
+				t.Fatal("Write() is not reproducible")
+			}
+			archives, err := Read(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if len(archives) != 1 || archives[0].Compression != compression || len(archives[0].Entries) != len(mainEntries()) {
+				t.Fatalf("Read() = %d archives, first %+v", len(archives), archives[0])
+			}
+
+			fsys := NewFS(archives[0])
+			if data, err := fs.ReadFile(fsys, "bin/busybox"); err != nil || string(data) != "#!busybox\n" {
+				t.Fatalf("hard link bin/busybox = %q, %v", data, err)
+			}
+			if data, err := fs.ReadFile(fsys, "init"); err != nil || string(data) != "#!busybox\n" {
+				t.Fatalf("ReadFile through the init symlink = %q, %v", data, err)
+			}
+			info, err := fs.Stat(fsys, "dev/console")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st := info.Sys().(*Stat); info.Mode() != fs.ModeDevice|fs.ModeCharDevice|0o600 || st.Major != 5 || st.Minor != 1 || !info.ModTime().Equal(modTime) {
+				t.Fatalf("dev/console = %v, %+v", info.Mode(), st)
+			}
+			if err := fstest.TestFS(fsys, "bin/sh", "etc/initrd-release", "dev/console"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReadConcatenated(t *testing.T) {
+	ucode := []*Entry{
+		{Name: "kernel/x86/microcode/AuthenticAMD.bin", Mode: 0o644, Nlink: 1, Inode: 1, Data: []byte("amd")},
+	}
+	intel := []*Entry{
+		{Name: "kernel/x86/microcode/GenuineIntel.bin", Mode: 0o644, Nlink: 1, Inode: 1, Data: []byte("intel")},
+	}
+	early := archive(t, ucode, CompressionNone)
+	padding := make([]byte, 512-len(early)%512)
+	data := image(t, early, padding, archive(t, intel, CompressionNone), archive(t, mainEntries(), CompressionZstd), make([]byte, 8))
+
+	archives, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if len(archives) != 3 {
+		t.Fatalf("Read() = %d archives, want 3", len(archives))
+	}
+	for i, want := range []string{CompressionNone, CompressionNone, CompressionZstd} {
+		if archives[i].Compression != want {
+			t.Fatalf("archive %d compression = %s, want %s", i, archives[i].Compression, want)
+		}
+	}
+	if archives[1].Offset != int64(len(early)+len(padding)) || archives[1].Entries[0].Name != "kernel/x86/microcode/GenuineIntel.bin" {
+		t.Fatalf("second archive = %+v", archives[1])
+	}
+
+	// Multi-member gzip streams, as some tools append to images, are one
+	// stream holding two archives.
+	data = image(t, archive(t, ucode, CompressionGzip), archive(t, intel, CompressionGzip))
+	if archives, err = Read(bytes.NewReader(data)); err != nil || len(archives) != 2 || archives[1].Offset != 0 {
+		t.Fatalf("Read(two gzip members) = %d archives, %v", len(archives), err)
+	}
+}
+
+func TestReadRejects(t *testing.T) {
+	if _, err := Read(bytes.NewReader([]byte("BZh91AY&SY"))); !errors.Is(err, ErrFormat) {
+		t.Fatalf("Read(bzip2) error = %v, want ErrFormat", err)
+	}
+	if _, err := Read(bytes.NewReader(nil)); !errors.Is(err, ErrFormat) {
+		t.Fatalf("Read(empty) error = %v, want ErrFormat", err)
+	}
+	data := archive(t, mainEntries(), CompressionNone)
+	if _, err := Read(bytes.NewReader(data[:200])); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Read(truncated) error = %v, want ErrCorrupt", err)
+	}
+	evil := archive(t, []*Entry{{Name: "../escape", Mode: 0o644, Nlink: 1}}, CompressionNone)
+	if archives, err := Read(bytes.NewReader(evil)); err != nil || archives[0].Entries[0].Name != "escape" {
+		t.Fatalf("Read(../escape) = %v; want the name kept inside the root", err)
+	}
+}
+
+func TestFSReplacesEarlierEntries(t *testing.T) {
+	fsys := NewFS(&Archive{Entries: []*Entry{
+		{Name: "etc/motd", Mode: 0o644, Data: []byte("old")},
+		{Name: "etc", Mode: fs.ModeDir | 0o700},
+		{Name: "etc/motd", Mode: 0o600, Data: []byte("new")},
+	}})
+	if data, err := fs.ReadFile(fsys, "etc/motd"); err != nil || string(data) != "new" {
+		t.Fatalf("etc/motd = %q, %v", data, err)
+	}
+	if info, err := fs.Stat(fsys, "etc"); err != nil || info.Mode() != fs.ModeDir|0o700 {
+		t.Fatalf("etc = %v, %v", info.Mode(), err)
+	}
+	if entries, err := fs.ReadDir(fsys, "."); err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir(.) = %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,118 @@
+package initramfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Write writes entries, in order, as one newc archive compressed with
+// compression. The output depends only on its arguments: compressors run
+// single-threaded and gzip headers carry no name or time. xz streams use
+// CRC32 checks and lz4 the legacy format, as the kernel requires.
+func Write(w io.Writer, entries []*Entry, compression string) error {
+	if !slices.Contains(Compressions, compression) {
+		return fmt.Errorf("initramfs: unsupported compression %q", compression)
+	}
+	out, err := compressor(w, compression)
+	if err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	bw := bufio.NewWriter(out)
+	cw := &cpioWriter{w: bw}
+	for _, e := range entries {
+		if err := cw.entry(e); err != nil {
+			return err
+		}
+	}
+	if err := cw.entry(&Entry{Name: trailerName, Nlink: 1}); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("initramfs: %w", err)
+	}
+	return nil
+}
+
+// compressor wraps w in the compressor for compression.
+func compressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressionXZ:
+		return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case CompressionLZ4:
+		zw := lz4.NewWriter(w)
+		if err := zw.Apply(lz4.LegacyOption(true), lz4.CompressionLevelOption(lz4.Level9), lz4.ConcurrencyOption(1)); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	}
+	return nopCloser{w}, nil
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// cpioWriter writes newc entries, padding names and data to 4 bytes.
+type cpioWriter struct {
+	w   io.Writer
+	off int
+}
+
+func (c *cpioWriter) entry(e *Entry) error {
+	var data []byte
+	if e.Mode.IsRegular() || e.Mode.Type() == fs.ModeSymlink {
+		data = e.Data
+	}
+	var rdevMajor, rdevMinor uint32
+	if e.Mode&fs.ModeDevice != 0 {
+		rdevMajor, rdevMinor = e.Major, e.Minor
+	}
+	mtime := max(e.ModTime.Unix(), 0)
+	mode := cpioMode(e.Mode)
+	if e.Name == trailerName {
+		mode = 0
+	}
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		newcMagic, e.Inode, mode, e.UID, e.GID, e.Nlink, uint32(mtime), len(data),
+		0, 0, rdevMajor, rdevMinor, len(e.Name)+1, 0)
+	if err := c.write([]byte(header), []byte(e.Name), []byte{0}); err != nil {
+		return err
+	}
+	if err := c.pad(); err != nil {
+		return err
+	}
+	if err := c.write(data); err != nil {
+		return err
+	}
+	return c.pad()
+}
+
+func (c *cpioWriter) write(chunks ...[]byte) error {
+	for _, b := range chunks {
+		n, err := c.w.Write(b)
+		c.off += n
+		if err != nil {
+			return fmt.Errorf("initramfs: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *cpioWriter) pad() error {
+	return c.write(make([]byte, align4(c.off)-c.off))
+}
@@ -0,0 +1,514 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+)
+
+// Installers autoinstall knows how to configure, named after the kind of
+// configuration each reads.
+const (
+	// InstallerAutoinstall is Subiquity, the Ubuntu Server and Desktop
+	// installer, reading cloud-init user-data with an autoinstall section.
+	InstallerAutoinstall = "autoinstall"
+	// InstallerPreseed is the Debian installer.
+	InstallerPreseed = "preseed"
+	// InstallerKickstart is Anaconda, the Fedora and RHEL installer.
+	InstallerKickstart = "kickstart"
+)
+
+// Installers lists the installer types.
+var Installers = []string{InstallerKickstart, InstallerAutoinstall, InstallerPreseed}
+
+const (
+	// grubTimeout and syslinuxTimeout replace menus that wait forever, in
+	// seconds and tenths of a second.
+	grubTimeout     = "5"
+	syslinuxTimeout = "50"
+	// nocloudDir holds the user-data and meta-data of Subiquity's NoCloud
+	// data source, as /cdrom/nocloud/ on the running installer.
+	nocloudDir = "nocloud"
+)
+
+// grubSeparator matches the "---" that ends the installer's part of a
+// Debian or Ubuntu kernel command line; what follows it is copied to the
+// installed system.
+var grubSeparator = regexp.MustCompile(`\s---(\s|$)`)
+
+// AutoinstallOptions configures Manager.Autoinstall.
+type AutoinstallOptions struct {
+	// Config is the file holding the installer configuration: autoinstall
+	// user-data, a preseed file or a kickstart file.
+	Config string
+	// Installer is one of Installers. Empty picks the installer of the
+	// distribution the ISO carries.
+	Installer string
+}
+
+// AutoinstallResult describes an ISO written by Manager.Autoinstall.
+type AutoinstallResult struct {
+	// Installer is the installer type configured and Config where the
+	// configuration is on the new ISO.
+	Installer string
+	Config    string
+	// Args are the kernel arguments added to the installer's boot entries.
+	Args string
+	// Entries are the labels of the boot entries that now boot unattended,
+	// and Files the configuration files changed.
+	Entries []string
+	Files   []string
+	// Remaster describes the new ISO.
+	Remaster RemasterResult
+}
+
+// autoinstallPlan is what Autoinstall adds to the tree of an ISO.
+type autoinstallPlan struct {
+	installer string
+	config    string
+	args      string
+	// files holds the new and changed files, by path in the tree.
+	files   map[string][]byte
+	entries []string
+	patched []string
+}
+
+// Autoinstall writes a new ISO to dst, which must not exist, that installs
+// unattended: the configuration in opts.Config is stored where the ISO's
+// installer reads it, and the installer's GRUB and ISOLINUX boot entries get
+// the kernel arguments that point the installer at it. Menus that wait for
+// a choice forever are given a timeout. The image is then written as
+// Remaster writes it.
+func (m *Manager) Autoinstall(ctx context.Context, choice int, dst string, opts AutoinstallOptions) (AutoinstallResult, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return AutoinstallResult{}, err
+	}
+	if m.isDryRun() {
+		return AutoinstallResult{}, errors.New("autoinstall cannot be done as a dry run")
+	}
+	config, err := os.ReadFile(opts.Config)
+	if err != nil {
+		return AutoinstallResult{}, err
+	}
+	d, err := openISO(m.fsys, iso.Name)
+	if err != nil {
+		return AutoinstallResult{}, err
+	}
+	installer, err := isoInstaller(d.FS, d.label(), iso.Name, opts.Installer)
+	var plan *autoinstallPlan
+	if err == nil {
+		plan, err = planAutoinstall(d.FS, installer, config)
+	}
+	d.Close()
+	if err != nil {
+		return AutoinstallResult{}, fmt.Errorf("%s: %w", iso.Name, err)
+	}
+
+	overlay, err := os.MkdirTemp("", "iso2chroot-autoinstall-")
+	if err != nil {
+		return AutoinstallResult{}, err
+	}
+	defer os.RemoveAll(overlay)
+	for name, data := range plan.files {
+		target := filepath.Join(overlay, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return AutoinstallResult{}, err
+		}
+		if err := os.WriteFile(target, data, 0o644); err != nil {
+			return AutoinstallResult{}, err
+		}
+	}
+	remaster, err := m.Remaster(ctx, choice, dst, RemasterOptions{Overlay: overlay})
+	if err != nil {
+		return AutoinstallResult{}, err
+	}
+	if plan.installer == InstallerKickstart && slices.ContainsFunc(remaster.BootImages, func(image BootImage) bool { return image.Platform == BootUEFI }) {
+		remaster.Warnings = append(remaster.Warnings, "UEFI boots from the EFI boot image may read the GRUB menu kept inside it, which is not changed; add "+plan.args+" there by hand if they do not install unattended")
+	}
+	return AutoinstallResult{
+		Installer: plan.installer,
+		Config:    plan.config,
+		Args:      plan.args,
+		Entries:   plan.entries,
+		Files:     plan.patched,
+		Remaster:  remaster,
+	}, nil
+}
+
+// isoInstaller returns the installer of the distribution on the disc tree
+// fsys, labelled label, of the ISO name. The distribution is read from
+// .treeinfo, .disk/info or the os-release of the live root filesystem, and
+// one whose installer is not one of Installers is refused. requested, when
+// set, must match the installer found, and is used as is when the
+// distribution is not known.
+func isoInstaller(fsys fs.FS, label, name, requested string) (string, error) {
+	v, server, ok := installerOS(fsys, label, name)
+	if !ok {
+		if requested == "" {
+			return "", errors.New("cannot tell which distribution the ISO installs; name the installer to configure")
+		}
+		return requested, nil
+	}
+	var installer string
+	switch {
+	case strings.HasPrefix(v.ShortID, "ubuntu"):
+		// Subiquity replaced the Debian installer on server media in 20.04
+		// and Ubiquity on desktop media in 23.04.
+		switch release := strings.TrimPrefix(v.ShortID, "ubuntu"); {
+		case server && versionAtLeast(release, 20, 4), versionAtLeast(release, 23, 4):
+			installer = InstallerAutoinstall
+		case server:
+			installer = InstallerPreseed
+		default:
+			return "", fmt.Errorf("%s desktop media install with Ubiquity, which cannot be configured", v.Name)
+		}
+	case strings.HasPrefix(v.ShortID, "debian"):
+		installer = InstallerPreseed
+	case anacondaOS(v):
+		installer = InstallerKickstart
+	default:
+		return "", fmt.Errorf("%s does not install with Subiquity, the Debian installer or Anaconda", v.Name)
+	}
+	if requested != "" && requested != installer {
+		return "", fmt.Errorf("%s installs with the %s installer, not %s", v.Name, installer, requested)
+	}
+	return installer, nil
+}
+
+// anacondaOS reports whether v is one of the treeinfoDistros, which all
+// install with Anaconda.
+func anacondaOS(v OSVariant) bool {
+	for _, distro := range treeinfoDistros {
+		if strings.HasPrefix(v.ID, distro.uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// installerOS recognises the distribution isoInstaller configures, and
+// whether the ISO is server media.
+func installerOS(fsys fs.FS, label, name string) (v OSVariant, server, ok bool) {
+	if v, ok := releaseOS(fsys, label); ok {
+		info, _ := fs.ReadFile(fsys, ".disk/info")
+		return v, bytes.Contains(info, []byte("-Server")), true
+	}
+	rootfs, _, err := openRootFS(fsys, name)
+	if err != nil {
+		return OSVariant{}, false, false
+	}
+	for _, file := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if data, err := fs.ReadFile(rootfs, file); err == nil {
+			v, ok := osReleaseOS(data)
+			return v, false, ok
+		}
+	}
+	return OSVariant{}, false, false
+}
+
+// versionAtLeast reports whether the release "major.minor" is at least the
+// given one.
+func versionAtLeast(release string, major, minor int) bool {
+	a, b, _ := strings.Cut(release, ".")
+	gotMajor, err := strconv.Atoi(a)
+	if err != nil {
+		return false
+	}
+	gotMinor, _ := strconv.Atoi(b)
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+// installerBoots reports whether the boot entry e starts the installer.
+func installerBoots(installer string, e bootcfg.Entry) bool {
+	switch installer {
+	case InstallerAutoinstall:
+		return strings.HasPrefix(e.Kernel, "casper/")
+	case InstallerPreseed:
+		dir, _, _ := strings.Cut(e.Kernel, "/")
+		return dir == "install" || strings.HasPrefix(dir, "install.")
+	case InstallerKickstart:
+		return slices.ContainsFunc(strings.Fields(e.Append), func(arg string) bool {
+			return strings.HasPrefix(arg, "inst.stage2=") || strings.HasPrefix(arg, "inst.repo=")
+		})
+	}
+	return false
+}
+
+// planAutoinstall works out the files to add to or change in fsys so
+// installer boots unattended with config.
+func planAutoinstall(fsys fs.FS, installer string, config []byte) (*autoinstallPlan, error) {
+	entries, err := bootcfg.Parse(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(Installers, installer) {
+		return nil, fmt.Errorf("unknown installer %q (want one of %s)", installer, strings.Join(Installers, ", "))
+	}
+
+	plan := &autoinstallPlan{installer: installer, files: make(map[string][]byte)}
+	kernels := make(map[string]bool)
+	var booting []bootcfg.Entry
+	for _, e := range entries {
+		if e.Kernel != "" && installerBoots(installer, e) {
+			kernels[e.Kernel] = true
+			booting = append(booting, e)
+		}
+	}
+	if len(booting) == 0 {
+		return nil, fmt.Errorf("no boot entry starts the %s installer", installer)
+	}
+
+	var grubArgs, syslinuxArgs []string
+	switch installer {
+	case InstallerAutoinstall:
+		userData, err := cloudConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		plan.config = path.Join(nocloudDir, "user-data")
+		plan.files[plan.config] = userData
+		if _, err := fs.Stat(fsys, path.Join(nocloudDir, "meta-data")); err != nil {
+			plan.files[path.Join(nocloudDir, "meta-data")] = nil
+		}
+		// GRUB ends a command at an unquoted semicolon.
+		grubArgs = []string{"autoinstall", `ds=nocloud\;s=/cdrom/` + nocloudDir + "/"}
+		syslinuxArgs = []string{"autoinstall", "ds=nocloud;s=/cdrom/" + nocloudDir + "/"}
+	case InstallerPreseed:
+		plan.config = "preseed.cfg"
+		plan.files[plan.config] = config
+		grubArgs = []string{"auto=true", "priority=critical", "preseed/file=/cdrom/" + plan.config}
+		syslinuxArgs = grubArgs
+	case InstallerKickstart:
+		plan.config = "ks.cfg"
+		plan.files[plan.config] = config
+		// The kickstart is found the way the installer finds its second
+		// stage: on the volume with that label, or on the CD.
+		source := "cdrom:/" + plan.config
+		for _, arg := range strings.Fields(booting[0].Append) {
+			if label, ok := strings.CutPrefix(arg, "inst.stage2=hd:LABEL="); ok {
+				source = "hd:LABEL=" + label + ":/" + plan.config
+			}
+		}
+		grubArgs = []string{"inst.ks=" + source}
+		syslinuxArgs = grubArgs
+	}
+	plan.args = strings.Join(syslinuxArgs, " ")
+
+	configs := bootcfg.Configs(fsys)
+	files := make(map[string]string)
+	for _, c := range configs {
+		files[c.Name] = c.Loader
+	}
+	for _, e := range entries {
+		if _, ok := files[e.Config]; !ok {
+			files[e.Config] = e.Loader
+		}
+	}
+	timeouts := map[string]bool{}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		text, patched, timeout := string(data), 0, false
+		if files[name] == bootcfg.LoaderGRUB {
+			text, patched, timeout = patchGRUB(text, kernels, grubArgs)
+		} else {
+			text, patched, timeout = patchSYSLINUX(text, path.Dir(name), kernels, syslinuxArgs)
+		}
+		timeouts[files[name]] = timeouts[files[name]] || timeout
+		if text != string(data) {
+			plan.files[name] = []byte(text)
+		}
+		if patched > 0 {
+			plan.patched = append(plan.patched, name)
+		}
+	}
+	// Menus without any timeout wait for a choice; the top-level files set
+	// one, which the bootloader applies once the whole file has run.
+	for _, c := range configs {
+		if timeouts[c.Loader] || !slices.ContainsFunc(booting, func(e bootcfg.Entry) bool { return e.Loader == c.Loader }) {
+			continue
+		}
+		text := string(plan.files[c.Name])
+		if text == "" {
+			data, err := fs.ReadFile(fsys, c.Name)
+			if err != nil {
+				return nil, err
+			}
+			text = string(data)
+		}
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		if c.Loader == bootcfg.LoaderGRUB {
+			text += "set timeout=" + grubTimeout + "\n"
+		} else {
+			text += "timeout " + syslinuxTimeout + "\n"
+		}
+		plan.files[c.Name] = []byte(text)
+		timeouts[c.Loader] = true
+		if !slices.Contains(plan.patched, c.Name) {
+			plan.patched = append(plan.patched, c.Name)
+		}
+	}
+	for _, e := range booting {
+		plan.entries = append(plan.entries, e.Label)
+	}
+	return plan, nil
+}
+
+// cloudConfig turns an autoinstall configuration into the cloud-init
+// user-data Subiquity reads: a #cloud-config document with an autoinstall
+// section. A bare autoinstall configuration, starting at its version key,
+// is moved under that section.
+func cloudConfig(config []byte) ([]byte, error) {
+	text := string(config)
+	if strings.HasPrefix(text, "#cloud-config") {
+		return config, nil
+	}
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "autoinstall:") {
+			return []byte("#cloud-config\n" + text), nil
+		}
+	}
+	if !slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, "version:") }) {
+		return nil, errors.New("the autoinstall configuration has neither an autoinstall section nor a version key")
+	}
+	var b strings.Builder
+	b.WriteString("#cloud-config\nautoinstall:\n")
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			b.WriteString("  ")
+		}
+		b.WriteString(line + "\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// bootPath turns a kernel path of a boot menu into a path of the tree,
+// relative to dir when it is not absolute.
+func bootPath(dir, p string) string {
+	if i := strings.Index(p, ")"); strings.HasPrefix(p, "(") && i > 0 {
+		p = p[i+1:]
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(dir, p)
+	}
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// addArgs adds to the kernel command line line the arguments it lacks,
+// before a "---" separator when there is one.
+func addArgs(line string, args []string) string {
+	fields := strings.Fields(line)
+	var missing []string
+	for _, arg := range args {
+		if !slices.Contains(fields, arg) {
+			missing = append(missing, arg)
+		}
+	}
+	if len(missing) == 0 {
+		return line
+	}
+	add := " " + strings.Join(missing, " ")
+	if loc := grubSeparator.FindStringIndex(line); loc != nil {
+		before := strings.TrimRight(line[:loc[0]], " \t")
+		return before + add + line[len(before):]
+	}
+	return strings.TrimRight(line, " \t") + add
+}
+
+// patchGRUB adds args to the linux commands of text that load one of
+// kernels, and gives a menu that waits forever a timeout. It returns the
+// new text, the number of commands changed and whether text sets a timeout.
+func patchGRUB(text string, kernels map[string]bool, args []string) (string, int, bool) {
+	lines := strings.Split(text, "\n")
+	patched, timeout := 0, false
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "set" && strings.HasPrefix(fields[1], "timeout=") {
+			timeout = true
+			if value := strings.Trim(strings.TrimPrefix(fields[1], "timeout="), `"'`); value == "-1" {
+				lines[i] = strings.Replace(line, fields[1], "timeout="+grubTimeout, 1)
+			}
+			continue
+		}
+		if len(fields) < 2 || !slices.Contains([]string{"linux", "linuxefi", "linux16"}, fields[0]) || !kernels[bootPath("/", fields[1])] {
+			continue
+		}
+		lines[i] = addArgs(line, args)
+		patched++
+	}
+	return strings.Join(lines, "\n"), patched, timeout
+}
+
+// patchSYSLINUX adds args to the append lines of the labels of text that
+// boot one of kernels, adding the line to labels that have none, and gives
+// a menu that waits forever a timeout. Relative paths start at dir. It
+// returns like patchGRUB.
+func patchSYSLINUX(text, dir string, kernels map[string]bool, args []string) (string, int, bool) {
+	lines := strings.Split(text, "\n")
+	patched, timeout := 0, false
+	// kernel and appendAt are the kernel line and append line of the
+	// current label.
+	kernel, appendAt := -1, -1
+	finish := func() {
+		if kernel < 0 {
+			return
+		}
+		_, name := splitDirective(lines[kernel])
+		if fields := strings.Fields(name); len(fields) > 0 && kernels[bootPath(dir, fields[0])] {
+			if appendAt >= 0 {
+				lines[appendAt] = addArgs(lines[appendAt], args)
+			} else {
+				indent := lines[kernel][:len(lines[kernel])-len(strings.TrimLeft(lines[kernel], " \t"))]
+				lines[kernel] += "\n" + indent + "append " + strings.Join(args, " ")
+			}
+			patched++
+		}
+		kernel, appendAt = -1, -1
+	}
+	for i, line := range lines {
+		switch keyword, value := splitDirective(line); keyword {
+		case "label":
+			finish()
+		case "kernel", "linux":
+			kernel = i
+		case "append":
+			appendAt = i
+		case "timeout":
+			timeout = true
+			if value == "0" {
+				lines[i] = strings.TrimRight(line, " \t0") + " " + syslinuxTimeout
+			}
+		}
+	}
+	finish()
+	return strings.Join(lines, "\n"), patched, timeout
+}
+
+// splitDirective splits a SYSLINUX configuration line into its lowercased
+// keyword and the rest.
+func splitDirective(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	keyword, value, _ := strings.Cut(line, " ")
+	if k, v, ok := strings.Cut(line, "\t"); ok && len(k) < len(keyword) {
+		keyword, value = k, v
+	}
+	return strings.ToLower(keyword), strings.TrimSpace(value)
+}
@@ -0,0 +1,296 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+func TestPlanAutoinstall(t *testing.T) {
+	file := func(text string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(text), Mode: 0o644} }
+	for _, tc := range []struct {
+		name      string
+		fsys      fstest.MapFS
+		installer string
+		config    string
+		entries   []string
+		// files holds the expected contents of the changed files.
+		files map[string]string
+	}{
+		{
+			name: "ubuntu",
+			fsys: fstest.MapFS{
+				"boot/grub/grub.cfg": file(`set timeout=30
+menuentry "Try or Install Ubuntu Server" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz  ---
+	initrd	/casper/initrd
+}
+menuentry "Boot from next volume" {
+	exit 1
+}
+`),
+				"casper/vmlinuz": file("kernel"),
+			},
+			installer: InstallerAutoinstall,
+			config:    "nocloud/user-data",
+			entries:   []string{"Try or Install Ubuntu Server"},
+			files: map[string]string{
+				"boot/grub/grub.cfg": `set timeout=30
+menuentry "Try or Install Ubuntu Server" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz autoinstall ds=nocloud\;s=/cdrom/nocloud/  ---
+	initrd	/casper/initrd
+}
+menuentry "Boot from next volume" {
+	exit 1
+}
+`,
+				"nocloud/user-data": "#cloud-config\nautoinstall:\n  version: 1\n",
+				"nocloud/meta-data": "",
+			},
+		},
+		{
+			name: "debian",
+			fsys: fstest.MapFS{
+				"boot/grub/grub.cfg": file(`menuentry --hotkey=i 'Install' {
+    linux    /install.amd/vmlinuz vga=788 --- quiet
+    initrd   /install.amd/initrd.gz
+}`),
+				"isolinux/isolinux.cfg": file("path \ninclude menu.cfg\ndefault vesamenu.c32\nprompt 0\ntimeout 0\n"),
+				"isolinux/menu.cfg":     file("include txt.cfg\n"),
+				"isolinux/txt.cfg":      file("label install\n\tmenu label ^Install\n\tkernel /install.amd/vmlinuz\n\tappend vga=788 initrd=/install.amd/initrd.gz --- quiet\nlabel expert\n\tkernel /install.amd/vmlinuz\n"),
+			},
+			installer: InstallerPreseed,
+			config:    "preseed.cfg",
+			entries:   []string{"Install", "Install", "expert"},
+			files: map[string]string{
+				"boot/grub/grub.cfg": `menuentry --hotkey=i 'Install' {
+    linux    /install.amd/vmlinuz vga=788 auto=true priority=critical preseed/file=/cdrom/preseed.cfg --- quiet
+    initrd   /install.amd/initrd.gz
+}
+set timeout=5
+`,
+				"isolinux/isolinux.cfg": "path \ninclude menu.cfg\ndefault vesamenu.c32\nprompt 0\ntimeout 50\n",
+				"isolinux/txt.cfg":      "label install\n\tmenu label ^Install\n\tkernel /install.amd/vmlinuz\n\tappend vga=788 initrd=/install.amd/initrd.gz auto=true priority=critical preseed/file=/cdrom/preseed.cfg --- quiet\nlabel expert\n\tkernel /install.amd/vmlinuz\n\tappend auto=true priority=critical preseed/file=/cdrom/preseed.cfg\n",
+				"preseed.cfg":           "version: 1\n",
+			},
+		},
+		{
+			name: "fedora",
+			fsys: fstest.MapFS{
+				"EFI/BOOT/grub.cfg": file(`set default="1"
+set timeout=60
+menuentry 'Install Fedora 40' --class fedora {
+	linuxefi /images/pxeboot/vmlinuz inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet
+	initrdefi /images/pxeboot/initrd.img
+}
+`),
+				"isolinux/isolinux.cfg": file("timeout 600\nlabel linux\n  menu label ^Install Fedora 40\n  kernel vmlinuz\n  append initrd=initrd.img inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet\n"),
+			},
+			installer: InstallerKickstart,
+			config:    "ks.cfg",
+			entries:   []string{"Install Fedora 40", "Install Fedora 40"},
+			files: map[string]string{
+				"EFI/BOOT/grub.cfg": `set default="1"
+set timeout=60
+menuentry 'Install Fedora 40' --class fedora {
+	linuxefi /images/pxeboot/vmlinuz inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet inst.ks=hd:LABEL=Fedora-S-dvd-x86_64-40:/ks.cfg
+	initrdefi /images/pxeboot/initrd.img
+}
+`,
+				"isolinux/isolinux.cfg": "timeout 600\nlabel linux\n  menu label ^Install Fedora 40\n  kernel vmlinuz\n  append initrd=initrd.img inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet inst.ks=hd:LABEL=Fedora-S-dvd-x86_64-40:/ks.cfg\n",
+				"ks.cfg":                "version: 1\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plan, err := planAutoinstall(tc.fsys, tc.installer, []byte("version: 1\n"))
+			if err != nil {
+				t.Fatalf("planAutoinstall() error = %v", err)
+			}
+			if plan.installer != tc.installer || plan.config != tc.config || !reflect.DeepEqual(plan.entries, tc.entries) {
+				t.Fatalf("planAutoinstall() = %s at %s for %q, want %s at %s for %q", plan.installer, plan.config, plan.entries, tc.installer, tc.config, tc.entries)
+			}
+			got := make(map[string]string)
+			for name, data := range plan.files {
+				got[name] = string(data)
+			}
+			if !reflect.DeepEqual(got, tc.files) {
+				t.Fatalf("planAutoinstall() files =\n%q\nwant\n%q", got, tc.files)
+			}
+		})
+	}
+
+	noInstaller := fstest.MapFS{"boot/grub/grub.cfg": file("menuentry 'Live' {\n\tlinux /live/vmlinuz boot=live\n}\n")}
+	if _, err := planAutoinstall(noInstaller, InstallerKickstart, nil); err == nil {
+		t.Fatal("planAutoinstall() with an installer the ISO lacks succeeded")
+	}
+}
+
+func TestISOInstaller(t *testing.T) {
+	file := func(text string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(text), Mode: 0o644} }
+	live := func(osRelease string) *fstest.MapFile {
+		img, err := isotest.Squashfs{Files: []isotest.File{isotest.Text("etc/os-release", osRelease)}}.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fstest.MapFile{Data: img, Mode: 0o644}
+	}
+	for _, tc := range []struct {
+		name      string
+		fsys      fstest.MapFS
+		label     string
+		requested string
+		want      string
+		// err is part of the error expected instead of an installer.
+		err string
+	}{
+		{
+			name: "ubuntu server",
+			fsys: fstest.MapFS{".disk/info": file(`Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827)`)},
+			want: InstallerAutoinstall,
+		},
+		{
+			name: "ubuntu legacy server",
+			fsys: fstest.MapFS{".disk/info": file(`Ubuntu-Server 18.04.6 LTS "Bionic Beaver" - Release amd64 (20210915)`)},
+			want: InstallerPreseed,
+		},
+		{
+			name: "ubuntu desktop",
+			fsys: fstest.MapFS{".disk/info": file(`Ubuntu 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827)`)},
+			want: InstallerAutoinstall,
+		},
+		{
+			name: "ubiquity",
+			fsys: fstest.MapFS{".disk/info": file(`Ubuntu 22.04.4 LTS "Jammy Jellyfish" - Release amd64 (20240220)`)},
+			err:  "Ubuntu 22.04 desktop media install with Ubiquity",
+		},
+		{
+			name: "ubiquity from os-release",
+			fsys: fstest.MapFS{"casper/filesystem.squashfs": live("NAME=\"Ubuntu\"\nID=ubuntu\nVERSION_ID=\"22.04\"\n")},
+			err:  "Ubiquity",
+		},
+		{
+			name: "debian",
+			fsys: fstest.MapFS{".disk/info": file(`Debian GNU/Linux 12.5.0 "Bookworm" - Official amd64 NETINST with firmware 20240210-11:28`)},
+			want: InstallerPreseed,
+		},
+		{
+			name: "fedora",
+			fsys: fstest.MapFS{".treeinfo": file("[release]\nname = Fedora\nversion = 40\n")},
+			want: InstallerKickstart,
+		},
+		{
+			name: "fedora from os-release",
+			fsys: fstest.MapFS{"LiveOS/squashfs.img": live("NAME=\"Fedora Linux\"\nID=fedora\nVERSION_ID=40\n")},
+			want: InstallerKickstart,
+		},
+		{
+			name:      "requested",
+			fsys:      fstest.MapFS{".disk/info": file(`Debian GNU/Linux 12.5.0 "Bookworm" - Official amd64 DVD Binary-1`)},
+			requested: InstallerPreseed,
+			want:      InstallerPreseed,
+		},
+		{
+			name:      "requested another",
+			fsys:      fstest.MapFS{".disk/info": file(`Debian GNU/Linux 12.5.0 "Bookworm" - Official amd64 DVD Binary-1`)},
+			requested: InstallerKickstart,
+			err:       "Debian 12 installs with the preseed installer, not kickstart",
+		},
+		{
+			name:  "unsupported",
+			fsys:  fstest.MapFS{},
+			label: "openSUSE-Leap-15.5-DVD-x86_64",
+			err:   "openSUSE Leap 15.5 does not install with",
+		},
+		{
+			name:      "unknown requested",
+			fsys:      fstest.MapFS{},
+			requested: InstallerKickstart,
+			want:      InstallerKickstart,
+		},
+		{
+			name: "unknown",
+			fsys: fstest.MapFS{},
+			err:  "name the installer",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := isoInstaller(tc.fsys, tc.label, "test.iso", tc.requested)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("isoInstaller() = %q, %v; want error containing %q", got, err, tc.err)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("isoInstaller() = %q, %v; want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestCloudConfig(t *testing.T) {
+	for config, want := range map[string]string{
+		"#cloud-config\nautoinstall:\n  version: 1\n": "#cloud-config\nautoinstall:\n  version: 1\n",
+		"autoinstall:\n  version: 1\n":                "#cloud-config\nautoinstall:\n  version: 1\n",
+		"version: 1\nidentity:\n  hostname: box\n\n":  "#cloud-config\nautoinstall:\n  version: 1\n  identity:\n    hostname: box\n",
+	} {
+		if got, err := cloudConfig([]byte(config)); err != nil || string(got) != want {
+			t.Errorf("cloudConfig(%q) = %q, %v; want %q", config, got, err, want)
+		}
+	}
+	if _, err := cloudConfig([]byte("hostname: box\n")); err == nil {
+		t.Error("cloudConfig() of a plain cloud-config succeeded")
+	}
+}
+
+func TestRunCLIAutoinstall(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, BIOSBoot: "isolinux/isolinux.bin", Files: []isotest.File{
+		{Path: "isolinux/isolinux.bin", Data: bytes.Repeat([]byte{0x90}, 2048)},
+		isotest.Text("boot/grub/grub.cfg", "set timeout=30\nmenuentry \"Try or Install Ubuntu Server\" {\n\tlinux\t/casper/vmlinuz  ---\n\tinitrd\t/casper/initrd\n}\n"),
+		isotest.Text("casper/vmlinuz", "kernel"),
+		isotest.Text("casper/initrd", "initrd"),
+		isotest.Text(".disk/info", `Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827)`),
+	}}})
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+	config := filepath.Join(t.TempDir(), "user-data")
+	if err := os.WriteFile(config, []byte("#cloud-config\nautoinstall:\n  version: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "unattended.iso")
+	code, stdout, stderr := run("autoinstall", "1", "--config", config, "--out", out)
+	if code != ExitOK || !strings.Contains(stdout, "(autoinstall configuration at /nocloud/user-data, ") || !strings.Contains(stdout, "Unattended entries: Try or Install Ubuntu Server\n") {
+		t.Fatalf("autoinstall: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	iso, _ := openRemastered(t, out)
+	if data, err := fs.ReadFile(iso, "nocloud/user-data"); err != nil || !strings.HasPrefix(string(data), "#cloud-config\n") {
+		t.Fatalf("nocloud/user-data = %q, %v", data, err)
+	}
+	if data, err := fs.ReadFile(iso, "boot/grub/grub.cfg"); err != nil || !strings.Contains(string(data), "linux\t/casper/vmlinuz autoinstall ds=nocloud\\;s=/cdrom/nocloud/  ---") {
+		t.Fatalf("boot/grub/grub.cfg = %q, %v", data, err)
+	}
+
+	if code, _, stderr := run("autoinstall", "1", "--installer", "kickstart", "--config", config, "--out", out+".2"); code != ExitFailure || !strings.Contains(stderr, "Ubuntu 24.04 installs with the autoinstall installer, not kickstart") {
+		t.Fatalf("autoinstall --installer kickstart: exit %d, stderr %q", code, stderr)
+	}
+	if code, _, _ := run("autoinstall", "1", "--installer", "yast", "--config", config, "--out", out+".2"); code != ExitUsage {
+		t.Fatalf("autoinstall --installer yast: exit %d, want %d", code, ExitUsage)
+	}
+	if code, _, _ := run("autoinstall", "1", "--out", out+".2"); code != ExitUsage {
+		t.Fatalf("autoinstall without --config: exit %d, want %d", code, ExitUsage)
+	}
+}
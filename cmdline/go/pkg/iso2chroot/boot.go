@@ -0,0 +1,284 @@
+package iso2chroot
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+	"thatnerdjosh.com/devtools/pkg/partition"
+)
+
+// Boot platforms, as info reports them.
+const (
+	BootBIOS = "BIOS"
+	BootUEFI = "UEFI"
+)
+
+// BootImage is an entry of an ISO's El Torito boot catalog.
+type BootImage struct {
+	// Platform is BootBIOS, BootUEFI or the catalog's platform ID, such as
+	// "platform 0x02".
+	Platform  string
+	Bootable  bool
+	Emulation string
+	// Sectors is the number of 512-byte sectors the firmware loads, and LBA
+	// the 2048-byte sector the image starts at.
+	Sectors uint16
+	LBA     uint32
+	// Path is the file of the ISO9660 tree holding the image, or empty when
+	// the image lies outside the tree, as appended EFI partitions do.
+	Path string
+	// Loader names what the image boots, such as "isolinux" or
+	// "grub EFI image".
+	Loader string
+}
+
+// bootImages lists the El Torito boot catalog of d, naming each image's file
+// and loader. UDF-only media have no catalog.
+func (d *disc) bootImages() ([]BootImage, error) {
+	if d.iso == nil {
+		return nil, nil
+	}
+	entries, err := d.iso.BootEntries()
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	files := d.filesByLBA()
+	var images []BootImage
+	for _, e := range entries {
+		image := BootImage{
+			Platform:  bootPlatform(e.Platform),
+			Bootable:  e.Bootable,
+			Emulation: e.Emulation.String(),
+			Sectors:   e.Sectors,
+			LBA:       e.LBA,
+			Path:      files[e.LBA],
+		}
+		image.Loader = d.loader(image)
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func bootPlatform(id byte) string {
+	switch id {
+	case iso9660.PlatformBIOS:
+		return BootBIOS
+	case iso9660.PlatformEFI:
+		return BootUEFI
+	}
+	return fmt.Sprintf("platform 0x%02x", id)
+}
+
+// filesByLBA maps the first sector of each regular file of the ISO9660 tree
+// to its path. Boot images are recorded in the catalog by sector only.
+func (d *disc) filesByLBA() map[uint32]string {
+	files := make(map[uint32]string)
+	fs.WalkDir(d.iso, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if st, ok := info.Sys().(*iso9660.Stat); ok && st.LBA != 0 {
+			if _, seen := files[st.LBA]; !seen {
+				files[st.LBA] = name
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+// loader guesses what a boot image starts from its file name and, for EFI
+// images, which are FAT filesystems, from the bootloader files of the tree.
+func (d *disc) loader(image BootImage) string {
+	base := strings.ToLower(path.Base(image.Path))
+	switch image.Platform {
+	case BootBIOS:
+		switch {
+		case base == "isolinux.bin":
+			return "isolinux"
+		case base == "eltorito.img", strings.HasPrefix(image.Path, "boot/grub/i386-pc/"):
+			return "grub"
+		case base == "etfsboot.com":
+			return "Windows Boot Manager"
+		}
+		return "boot image"
+	case BootUEFI:
+		switch {
+		case strings.HasPrefix(base, "efisys"):
+			return "Windows Boot Manager EFI image"
+		case d.exists("EFI/boot/grubx64.efi"), d.exists("EFI/BOOT/grubx64.efi"), d.exists("boot/grub/grub.cfg"):
+			return "grub EFI image"
+		}
+		return "EFI image"
+	}
+	return "boot image"
+}
+
+func (d *disc) exists(name string) bool {
+	_, err := fs.Stat(d.FS, name)
+	return err == nil
+}
+
+// bootSummary describes how an ISO boots, such as
+// "BIOS: isolinux, UEFI: grub EFI image", from its bootable entries.
+func bootSummary(images []BootImage) string {
+	var parts []string
+	seen := make(map[string]bool)
+	for _, image := range images {
+		desc := image.Platform + ": " + image.Loader
+		if !image.Bootable || seen[desc] {
+			continue
+		}
+		seen[desc] = true
+		parts = append(parts, desc)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BootEntries parses the GRUB and ISOLINUX menus of the chosen ISO and
+// returns their entries, bounded by the Inspect timeout.
+func (m *Manager) BootEntries(ctx context.Context, choice int) ([]bootcfg.Entry, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	return runBlocking(ctx, "read boot menus of "+m.Path(iso), func() ([]bootcfg.Entry, error) {
+		d, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		entries, err := bootcfg.Parse(d.FS)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", iso.Name, err)
+		}
+		return entries, nil
+	})
+}
+
+// BootImageResult describes an EFI system partition image written by
+// Manager.ExtractBootImage.
+type BootImageResult struct {
+	// Source says where the image was found, such as "GPT partition 2" or
+	// "boot/grub/efi.img".
+	Source string
+	Bytes  int64
+}
+
+// ExtractBootImage writes the EFI system partition image of the chosen ISO
+// to the file dst, which must not exist, bounded by the Inspect timeout. The
+// image is taken from the ESP of the hybrid partition table when there is
+// one, otherwise from the UEFI entry of the El Torito boot catalog.
+func (m *Manager) ExtractBootImage(ctx context.Context, choice int, dst string) (BootImageResult, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return BootImageResult{}, err
+	}
+	if m.isDryRun() {
+		return BootImageResult{}, errors.New("extract cannot be done as a dry run")
+	}
+	lock, err := m.lock(ctx, dst)
+	if err != nil {
+		return BootImageResult{}, err
+	}
+	defer lock.Release()
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	return runBlocking(ctx, "extract boot image of "+m.Path(iso), func() (BootImageResult, error) {
+		d, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return BootImageResult{}, err
+		}
+		defer d.Close()
+		result, offset, err := d.espImage()
+		if err != nil {
+			return BootImageResult{}, fmt.Errorf("%s: %w", iso.Name, err)
+		}
+		err = createFile(ctx, "extract boot image", dst, 0o644, func(w io.Writer) error {
+			_, err := io.Copy(w, io.NewSectionReader(d.r, offset, result.Bytes))
+			return err
+		})
+		if err != nil {
+			return BootImageResult{}, err
+		}
+		return result, nil
+	})
+}
+
+// errNoESP reports an ISO without an EFI system partition image.
+var errNoESP = errors.New("no EFI system partition image: the ISO does not boot with UEFI")
+
+// espImage locates the EFI system partition image of d, returning where it
+// came from, its size and its byte offset in the ISO.
+func (d *disc) espImage() (BootImageResult, int64, error) {
+	table, err := partition.Read(d.r)
+	if err != nil && !errors.Is(err, partition.ErrNoTable) {
+		return BootImageResult{}, 0, err
+	}
+	if table != nil {
+		for _, p := range table.Partitions {
+			if p.ESP() && p.Size > 0 && p.Start+p.Size <= d.size {
+				return BootImageResult{Source: fmt.Sprintf("%s partition %d", strings.ToUpper(table.Scheme), p.Number), Bytes: p.Size}, p.Start, nil
+			}
+		}
+	}
+
+	images, err := d.bootImages()
+	if err != nil {
+		return BootImageResult{}, 0, err
+	}
+	for _, image := range images {
+		if image.Platform != BootUEFI {
+			continue
+		}
+		offset := int64(image.LBA) * iso9660.SectorSize
+		if image.Path != "" {
+			if info, err := fs.Stat(d.iso, image.Path); err == nil {
+				return BootImageResult{Source: image.Path, Bytes: info.Size()}, offset, nil
+			}
+		}
+		// Appended images outside the tree carry their size in their FAT
+		// boot sector; the catalog's sector count often reads 0 or 1.
+		size := fatImageSize(d.r, offset)
+		if size == 0 {
+			size = int64(image.Sectors) * partition.SectorSize
+		}
+		if size > 0 && offset+size <= d.size {
+			return BootImageResult{Source: fmt.Sprintf("El Torito UEFI entry at sector %d", image.LBA), Bytes: size}, offset, nil
+		}
+	}
+	return BootImageResult{}, 0, errNoESP
+}
+
+// fatImageSize returns the size a FAT boot sector at offset declares, or 0
+// when there is none.
+func fatImageSize(r io.ReaderAt, offset int64) int64 {
+	bpb := make([]byte, 512)
+	if _, err := r.ReadAt(bpb, offset); err != nil || bpb[510] != 0x55 || bpb[511] != 0xAA {
+		return 0
+	}
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bpb[11:]))
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 {
+		return 0
+	}
+	sectors := int64(binary.LittleEndian.Uint16(bpb[19:]))
+	if sectors == 0 {
+		sectors = int64(binary.LittleEndian.Uint32(bpb[32:]))
+	}
+	return sectors * bytesPerSector
+}
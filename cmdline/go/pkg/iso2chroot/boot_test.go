@@ -0,0 +1,183 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+)
+
+// fatImage returns a FAT boot sector declaring sectors 512-byte sectors,
+// padded to that size.
+func fatImage(sectors uint16) []byte {
+	img := bytes.Repeat([]byte{0xEF}, int(sectors)*512)
+	copy(img, make([]byte, 512))
+	binary.LittleEndian.PutUint16(img[11:], 512)
+	binary.LittleEndian.PutUint16(img[19:], sectors)
+	img[510], img[511] = 0x55, 0xAA
+	return img
+}
+
+// bootLibrary is a hybrid Ubuntu-like ISO, an El Torito-only ISO and one
+// that does not boot.
+func bootLibrary() map[string]isotest.ISO {
+	files := append(discFiles(),
+		isotest.Text("isolinux/isolinux.bin", "bios loader"),
+		isotest.File{Path: "boot/grub/efi.img", Data: fatImage(6), Mode: 0o644},
+		isotest.Text("EFI/boot/grubx64.efi", "grub"),
+	)
+	return map[string]isotest.ISO{
+		"noble.iso": {
+			RockRidge: true,
+			Files:     files,
+			BIOSBoot:  "isolinux/isolinux.bin",
+			EFIBoot:   "boot/grub/efi.img",
+			Hybrid:    isotest.HybridGPT,
+		},
+		"jammy.iso": {RockRidge: true, Files: files, EFIBoot: "boot/grub/efi.img"},
+		"data.iso":  {Files: []isotest.File{isotest.Text("README.TXT", "data\n")}},
+	}
+}
+
+func TestRunCLIInfoBoot(t *testing.T) {
+	manager := newTestManager(t, bootLibrary())
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String() + stderr.String()
+	}
+
+	code, out := run("info", "3")
+	for _, want := range []string{
+		"Boot:             BIOS: isolinux, UEFI: grub EFI image\n",
+		"Boot entry:       BIOS, no emulation, 4 sectors at sector ",
+		", isolinux/isolinux.bin\n",
+		"Boot entry:       UEFI, no emulation, 6 sectors at sector ",
+		", boot/grub/efi.img\n",
+		"Partition table:  gpt\n",
+		"Partition 1:      basic data \"ISO9660\", ",
+		"Partition 2:      EFI system partition \"Appended2\", 3.0 KiB at byte ",
+	} {
+		if code != ExitOK || !strings.Contains(out, want) {
+			t.Fatalf("info noble: exit %d, output %q; want %q", code, out, want)
+		}
+	}
+	code, out = run("info", "1")
+	if code != ExitOK || !strings.Contains(out, "Boot:             not bootable\n") || strings.Contains(out, "Partition") {
+		t.Fatalf("info data: exit %d, output %q", code, out)
+	}
+}
+
+func TestRunCLIExtractBootImage(t *testing.T) {
+	manager := newTestManager(t, bootLibrary())
+	run := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String() + stderr.String()
+	}
+	dir := t.TempDir()
+
+	for _, tt := range []struct {
+		iso, source string
+	}{
+		{"3", "GPT partition 2"},
+		{"2", "boot/grub/efi.img"},
+	} {
+		dst := filepath.Join(dir, tt.iso+".img")
+		code, out := run("extract", "--boot-image", tt.iso, dst)
+		if code != ExitOK || !strings.Contains(out, "("+tt.source+")") {
+			t.Fatalf("extract --boot-image %s: exit %d, output %q; want source %s", tt.iso, code, out, tt.source)
+		}
+		if data, err := os.ReadFile(dst); err != nil || !bytes.Equal(data, fatImage(6)) {
+			t.Fatalf("%s boot image = %d bytes, %v", tt.iso, len(data), err)
+		}
+	}
+
+	if code, out := run("extract", "--boot-image", "3", filepath.Join(dir, "3.img")); code != ExitFailure || !strings.Contains(out, "exists") {
+		t.Fatalf("extract --boot-image over an existing file: exit %d, output %q", code, out)
+	}
+	if code, out := run("extract", "--boot-image", "1", filepath.Join(dir, "data.img")); code != ExitFailure || !strings.Contains(out, "no EFI system partition image") {
+		t.Fatalf("extract --boot-image data: exit %d, output %q", code, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.img")); !os.IsNotExist(err) {
+		t.Fatalf("failed extraction left data.img behind: %v", err)
+	}
+	if code, _ := run("extract", "--boot-image", "--rootfs", "3", filepath.Join(dir, "x.img")); code != ExitUsage {
+		t.Fatalf("extract --boot-image --rootfs: exit %d, want %d", code, ExitUsage)
+	}
+
+	// The destination is locked like the other extractions.
+	held, err := acquireLock(context.Background(), filepath.Join(dir, "held.img"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+	if code, out := run("extract", "--boot-image", "3", filepath.Join(dir, "held.img")); code != ExitBusy {
+		t.Fatalf("extract --boot-image to a locked file: exit %d, output %q", code, out)
+	}
+}
+
+func TestFATImageSize(t *testing.T) {
+	img := fatImage(6)
+	if got := fatImageSize(bytes.NewReader(img), 0); got != 3072 {
+		t.Fatalf("fatImageSize() = %d, want 3072", got)
+	}
+	binary.LittleEndian.PutUint16(img[19:], 0)
+	binary.LittleEndian.PutUint32(img[32:], 20480)
+	if got := fatImageSize(bytes.NewReader(img), 0); got != 20480*512 {
+		t.Fatalf("fatImageSize() with a 32-bit count = %d", got)
+	}
+	if got := fatImageSize(bytes.NewReader(make([]byte, 1024)), 0); got != 0 {
+		t.Fatalf("fatImageSize() without a boot sector = %d, want 0", got)
+	}
+}
+
+func TestRunCLIBootEntries(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{
+		"noble.iso": {RockRidge: true, Files: []isotest.File{
+			isotest.Text("boot/grub/grub.cfg", "set opts=\"quiet splash\"\nmenuentry \"Try or Install Ubuntu\" {\n\tlinux /casper/vmlinuz $opts ---\n\tinitrd /casper/initrd\n}\n"),
+			isotest.Text("isolinux/isolinux.cfg", "label live\n  menu label ^Live\n  kernel /casper/vmlinuz\n  append initrd=/casper/initrd boot=casper\n"),
+		}},
+		"data.iso": {Files: []isotest.File{isotest.Text("README.TXT", "data\n")}},
+	})
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := run("boot-entries", "2")
+	want := `Try or Install Ubuntu (grub, boot/grub/grub.cfg)
+  kernel:  casper/vmlinuz
+  initrd:  casper/initrd
+  append:  quiet splash ---
+
+Live (isolinux, isolinux/isolinux.cfg)
+  kernel:  casper/vmlinuz
+  initrd:  casper/initrd
+  append:  boot=casper
+`
+	if code != ExitOK || out != want {
+		t.Fatalf("boot-entries noble: exit %d, stderr %q, stdout\n%s\nwant\n%s", code, errOut, out, want)
+	}
+
+	code, out, _ = run("boot-entries", "--format", "json", "2")
+	var entries []bootcfg.Entry
+	if err := json.Unmarshal([]byte(out), &entries); code != ExitOK || err != nil || len(entries) != 2 || entries[1].Append != "boot=casper" {
+		t.Fatalf("boot-entries --format json: exit %d, %v, stdout %q", code, err, out)
+	}
+
+	if code, _, errOut = run("boot-entries", "1"); code != ExitFailure || !strings.Contains(errOut, "no GRUB or ISOLINUX configuration") {
+		t.Fatalf("boot-entries data: exit %d, stderr %q", code, errOut)
+	}
+	if code, _, _ = run("boot-entries", "--format", "yaml", "2"); code != ExitUsage {
+		t.Fatalf("boot-entries --format yaml: exit %d, want %d", code, ExitUsage)
+	}
+}
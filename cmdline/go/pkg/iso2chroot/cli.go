@@ -1,18 +1,90 @@
 package iso2chroot
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"net"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+	"thatnerdjosh.com/devtools/pkg/tui"
+)
+
+// Exit codes returned by RunCLI. They are part of the command-line interface
+// and must not be renumbered. 6 is unused.
+const (
+	ExitOK            = 0
+	ExitFailure       = 1
+	ExitUsage         = 2
+	ExitUnsafeTarget  = 3
+	ExitTargetMounted = 4
+	ExitNotFound      = 5
+	ExitPermission    = 7
+	ExitBusy          = 8
+	ExitMismatch      = 9
+	ExitDeclined      = 10
+	ExitTimeout       = 124
+	ExitCancelled     = 130
 )
 
+// exitCodeDocs describes each exit code for WriteExitCodes, in display order.
+var exitCodeDocs = []struct {
+	code int
+	doc  string
+}{
+	{ExitOK, "success"},
+	{ExitFailure, "failure not covered below"},
+	{ExitUsage, "invalid command line"},
+	{ExitUnsafeTarget, "mount target is a system path"},
+	{ExitTargetMounted, "mount target already has a filesystem mounted"},
+	{ExitNotFound, "ISO, choice or instance not found"},
+	{ExitPermission, "permission denied, including sudo refusing to run"},
+	{ExitBusy, "locked by another iso2chroot process or mount in use"},
+	{ExitMismatch, "ISO checksum or other input differs from the lock file"},
+	{ExitDeclined, "a confirmation prompt was answered no"},
+	{ExitTimeout, "an operation exceeded its --timeout"},
+	{ExitCancelled, "interrupted"},
+}
+
+// WriteExitCodes writes the table of exit codes for inclusion in usage text.
+func WriteExitCodes(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range exitCodeDocs {
+		fmt.Fprintf(tw, "    %d\t%s\n", e.code, e.doc)
+	}
+	tw.Flush()
+}
+
 // CLIOptions configures RunCLI behavior.
 type CLIOptions struct {
 	MountDir string
+	// LockPath is where create records its lock file. It defaults to DefaultLockPath(MountDir).
+	LockPath string
 	Stdin    io.Reader
+	// Prompter asks for confirmations. It defaults to reading lines from Stdin.
+	Prompter tui.Prompter
+	// Context bounds long-running commands. It defaults to context.Background();
+	// create additionally stops at SIGINT or SIGTERM and rolls back.
+	Context context.Context
+	// DryRun records the privileged actions of create, enter and destroy instead
+	// of running them, and prints the plan in PlanFormat (PlanShell or PlanJSON).
+	DryRun     bool
+	PlanFormat string
 }
 
 // RunCLI executes the iso2chroot command-line interface against the provided manager.
@@ -26,6 +98,10 @@ func RunCLI(manager *Manager, args []string, stdout, stderr io.Writer, opts CLIO
 	if stdin == nil {
 		stdin = os.Stdin
 	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
 	command := "list"
 	if len(args) > 0 {
@@ -33,109 +109,1416 @@ func RunCLI(manager *Manager, args []string, stdout, stderr io.Writer, opts CLIO
 		args = args[1:]
 	}
 
+	prompter := opts.Prompter
+	if prompter == nil {
+		prompter = tui.NewLinePrompter(stdin, stdout)
+	}
+	if !opts.DryRun {
+		return runCommand(ctx, manager, command, args, stdout, stderr, mountDir, opts.LockPath, prompter)
+	}
+
+	switch command {
+	case "create", "enter", "destroy":
+	case "rename", "extract", "kernel", "initrd", "remaster", "autoinstall", "seed", "virt-xml", "serve-http", "pxe":
+		fmt.Fprintf(stderr, "iso2chroot: %s does not support --dry-run.\n", command)
+		return ExitUsage
+	default:
+		return runCommand(ctx, manager, command, args, stdout, stderr, mountDir, opts.LockPath, prompter)
+	}
+	if opts.PlanFormat != "" && opts.PlanFormat != PlanShell && opts.PlanFormat != PlanJSON {
+		fmt.Fprintf(stderr, "iso2chroot: unknown plan format %q (want %s or %s)\n", opts.PlanFormat, PlanShell, PlanJSON)
+		return ExitUsage
+	}
+
+	recorder := NewRecorder()
+	manager.mu.RLock()
+	previousMounter, previousDryRun := manager.mounter, manager.dryRun
+	manager.mu.RUnlock()
+	manager.SetMounter(recorder)
+	manager.SetDryRun(true)
+	defer func() {
+		manager.SetMounter(previousMounter)
+		manager.SetDryRun(previousDryRun)
+	}()
+
+	// Nothing is changed in a dry run, so confirmations are implied and the
+	// usual progress messages are replaced by the plan itself.
+	code := runCommand(ctx, manager, command, args, io.Discard, stderr, mountDir, opts.LockPath, tui.AssumeYes{})
+
+	plan, err := recorder.Render(opts.PlanFormat)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	fmt.Fprint(stdout, plan)
+	return code
+}
+
+func runCommand(ctx context.Context, manager *Manager, command string, args []string, stdout, stderr io.Writer, mountDir, lockPath string, prompter tui.Prompter) int {
 	switch command {
 	case "list":
-		return runList(manager, stdout, stderr)
+		return runList(ctx, manager, stdout, stderr)
 	case "select":
-		return runSelect(manager, args, stdout, stderr)
+		return runSelect(ctx, manager, args, stdout, stderr)
 	case "create":
-		return runCreate(manager, args, stdout, stderr, mountDir, stdin)
+		if lockPath == "" {
+			lockPath = DefaultLockPath(mountDir)
+		}
+		return runCreate(ctx, manager, args, stdout, stderr, mountDir, lockPath, prompter)
+	case "extract":
+		return runExtract(ctx, manager, args, stdout, stderr)
+	case "info":
+		return runInfo(ctx, manager, args, stdout, stderr)
+	case "boot-entries":
+		return runBootEntries(ctx, manager, args, stdout, stderr)
+	case "kernel":
+		return runKernel(ctx, manager, args, stdout, stderr)
+	case "initrd":
+		return runInitrd(ctx, args, stdout, stderr)
+	case "remaster":
+		return runRemaster(ctx, manager, args, stdout, stderr)
+	case "autoinstall":
+		return runAutoinstall(ctx, manager, args, stdout, stderr)
+	case "seed":
+		return runSeed(ctx, manager, args, stdout, stderr)
+	case "virt-xml":
+		return runVirtXML(ctx, manager, args, stdout, stderr)
+	case "serve-http":
+		return runServeHTTP(ctx, manager, args, stdout, stderr)
+	case "pxe":
+		return runPXE(ctx, manager, args, stdout, stderr)
+	case "ls":
+		// Without arguments ls lists the instances; with an ISO it lists
+		// inside it, like ls-iso.
+		if len(args) == 0 {
+			return runInstances(ctx, manager, stdout, stderr)
+		}
+		return runImageList(ctx, manager, command, args, stdout, stderr)
+	case "ls-iso":
+		return runImageList(ctx, manager, command, args, stdout, stderr)
+	case "cat":
+		return runCat(ctx, manager, args, stdout, stderr)
+	case "find":
+		return runFind(ctx, manager, args, stdout, stderr)
+	case "rename":
+		return runRename(ctx, manager, args, stdout, stderr)
+	case "enter":
+		return runEnter(ctx, manager, args, stderr)
+	case "destroy":
+		return runDestroy(ctx, manager, args, stdout, stderr, prompter)
 	case "help", "-h", "--help":
-		fmt.Fprintln(stderr, "iso2chroot commands: list (default), select <index>, create <index>")
-		return 0
+		fmt.Fprintln(stderr, "iso2chroot commands: list (default), select <iso>, create [--name <instance>] <iso>, create --extract <iso>, create --from-lock <file>, extract [--rootfs] <iso> <dest> [paths...], extract --boot-image <iso> <file>, info <iso>, boot-entries [--format text|json] <iso>, kernel [--entry <label>] --out <dir> <iso>, initrd ls <file>, initrd extract <file> <dest>, initrd repack [--compress <type>] --out <file> <dir>..., remaster [--overlay <dir>] [--label <label>] [--publisher <name>] --out <file> <iso>, autoinstall [--installer <type>] --config <file> --out <file> <iso>, seed --user-data <file> --meta-data <file> [--network-config <file>] --out <file>, seed --from-instance <instance> --out <file>, virt-xml [--memory <size>] [--vcpus <n>] [--disk-size <size>] [--network <net>] [--firmware <type>] [--out <file>] <iso>, serve-http [--listen <addr>] [--rootfs] [--quiet] <iso>, pxe [--listen <addr>] [--http <addr>] [--url <url>] [--entry <label>] [--loaders <dir>] [--quiet] <iso>, ls, ls [--rootfs] <iso> [path], ls-iso [--rootfs] <iso> [path], cat [--rootfs] <iso> <path>, find [--rootfs] [--grep <regexp>] (--all | <iso>) <pattern>, rename <old> <new>, enter <instance> [command...], destroy <instance>")
+		fmt.Fprintln(stderr, "Exit codes:")
+		WriteExitCodes(stderr)
+		return ExitOK
 	default:
 		fmt.Fprintf(stderr, "iso2chroot: unknown command %q\n", command)
 		fmt.Fprintln(stderr, "Run 'iso2chroot --help' for usage.")
-		return 2
+		return ExitUsage
 	}
 }
 
-func runList(manager *Manager, stdout, stderr io.Writer) int {
-	result, err := manager.Load()
+func runList(ctx context.Context, manager *Manager, stdout, stderr io.Writer) int {
+	result, err := manager.Load(ctx)
 	if err != nil {
-		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+		return fail(stderr, err)
 	}
 	printWithTrailingNewline(stdout, result.Display)
-	return 0
+	return ExitOK
 }
 
-func runSelect(manager *Manager, args []string, stdout, stderr io.Writer) int {
+func runSelect(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
 	if len(args) == 0 {
-		fmt.Fprintln(stderr, "iso2chroot: select requires a numeric index argument.")
-		return 2
+		fmt.Fprintln(stderr, "iso2chroot: select requires an ISO index.")
+		return ExitUsage
 	}
-	if _, err := manager.Load(); err != nil {
-		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
 	}
 
-	index, err := strconv.Atoi(args[0])
+	_, iso, err := manager.Resolve(args[0])
 	if err != nil {
-		fmt.Fprintf(stderr, "iso2chroot: invalid index %q\n", args[0])
-		return 2
+		return fail(stderr, err)
+	}
+
+	fmt.Fprintln(stdout, iso.Name)
+	return ExitOK
+}
+
+func runCreate(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer, mountDir, lockPath string, prompter tui.Prompter) int {
+	flagSet := flag.NewFlagSet("create", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	fromLock := flagSet.String("from-lock", "", "Recreate the chroot recorded in this lock file, refusing if any input differs")
+	name := flagSet.String("name", "", "Create a named instance under the instance root instead of mounting into --src")
+	extract := flagSet.Bool("extract", false, "Unpack the ISO's live root filesystem into --src as plain files instead of mounting it; needs no sudo")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	if len(args) == 0 && *fromLock == "" {
+		fmt.Fprintln(stderr, "iso2chroot: create requires an ISO index.")
+		return ExitUsage
+	}
+	if len(args) > 0 && *fromLock != "" {
+		fmt.Fprintln(stderr, "iso2chroot: create --from-lock does not take an index argument.")
+		return ExitUsage
+	}
+	if *extract && *name != "" {
+		fmt.Fprintln(stderr, "iso2chroot: create --extract cannot be combined with --name.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+
+	var (
+		index  int
+		locked LockFile
+	)
+	if *fromLock != "" {
+		locked, err = ReadLockFile(*fromLock)
+		if err != nil {
+			return fail(stderr, err)
+		}
+		index, _, err = manager.SelectName(locked.ISO.Name)
+		if err != nil {
+			return fail(stderr, err)
+		}
+		// A lock file from an extracted build recreates it the same way.
+		if strings.Join(locked.Steps, ",") == strings.Join(extractSteps, ",") && *name == "" {
+			*extract = true
+		}
+	} else {
+		index, _, err = manager.Resolve(args[0])
+		if err != nil {
+			return fail(stderr, err)
+		}
 	}
 
 	iso, err := manager.Select(index)
 	if err != nil {
-		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+		return fail(stderr, err)
 	}
 
-	fmt.Fprintln(stdout, iso.Name)
-	return 0
+	steps := createSteps
+	targetDir := mountDir
+	if targetDir == "" {
+		targetDir = defaultMountDir
+	}
+	if *name != "" {
+		if err := validateInstanceName(*name); err != nil {
+			fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
+			return ExitUsage
+		}
+		steps = instanceSteps
+		targetDir = manager.InstanceDir(*name)
+		lockPath = manager.InstanceLockPath(*name)
+	}
+	if *extract {
+		if manager.isDryRun() {
+			fmt.Fprintln(stderr, "iso2chroot: create --extract does not support --dry-run; it runs no privileged commands.")
+			return ExitUsage
+		}
+		steps = extractSteps
+	}
+
+	lock, err := manager.LockInputs(ctx, index, steps)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	if lock.PackagesUnavailable != "" {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", lock.PackagesUnavailable)
+	}
+	if *fromLock != "" && lock.ISO.SHA256 == "" {
+		fmt.Fprintln(stderr, "iso2chroot: warning: a dry run does not hash the ISO, so its sha256 is not checked against the lock")
+	}
+	if *fromLock != "" {
+		if err := locked.VerifyInputs(lock); err != nil {
+			fmt.Fprintf(stderr, "iso2chroot: refusing to create from %s: %v\n", *fromLock, err)
+			return ExitCode(err)
+		}
+	}
+
+	if *extract {
+		return runCreateExtract(ctx, manager, iso, index, targetDir, lockPath, lock, stdout, stderr)
+	}
+
+	report, err := manager.Preflight(ctx, index, targetDir)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+
+	reuse := ""
+	if report.ExistingMount != "" {
+		fmt.Fprintf(stdout, "%s is already mounted at %s.\n", iso.Name, report.ExistingMount)
+		ok, err := prompter.Confirm("Press Enter to reuse that mount or type 'n' to mount it again: ")
+		if err != nil {
+			return confirmFailed(stderr, "create", err)
+		}
+		if ok {
+			reuse = report.ExistingMount
+		}
+	}
+
+	if reuse != "" && *name == "" {
+		fmt.Fprintf(stdout, "Reusing existing mount of %s at %s\n", iso.Name, reuse)
+	} else {
+		fmt.Fprintf(stdout, "iso2chroot will mount %s into %s using sudo.\n", iso.Name, targetDir)
+		fmt.Fprintln(stdout, "You may be prompted for your sudo password.")
+		ok, err := prompter.Confirm("Press Enter to continue or type 'n' to cancel: ")
+		if err != nil {
+			return confirmFailed(stderr, "create", err)
+		}
+		if !ok {
+			fmt.Fprintln(stderr, "iso2chroot: create cancelled.")
+			return ExitDeclined
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Create(ctx, CreateRequest{
+		Choice:        index,
+		Name:          *name,
+		MountDir:      targetDir,
+		ReuseISOMount: reuse,
+		Preflight:     &report,
+		LockPath:      lockPath,
+		Lock:          lock,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: create failed: %v\n", err)
+		var rollback *RollbackError
+		if errors.As(err, &rollback) {
+			for _, line := range rollback.Summary() {
+				fmt.Fprintf(stderr, "iso2chroot: %s\n", line)
+			}
+			if rollback.Failed != "" && *name != "" {
+				fmt.Fprintf(stderr, "iso2chroot: run 'iso2chroot destroy %s' to finish cleaning up.\n", *name)
+			}
+		}
+		return ExitCode(err)
+	}
+
+	switch {
+	case *name != "":
+		fmt.Fprintf(stdout, "Created instance %s from %s at %s\n", result.Instance.Name, iso.Name, result.ChrootDir)
+	case reuse == "":
+		fmt.Fprintf(stdout, "Mounted %s to %s\n", iso.Name, result.ChrootDir)
+	}
+	fmt.Fprintf(stdout, "Wrote lock file %s\n", lockPath)
+	return ExitOK
 }
 
-func runCreate(manager *Manager, args []string, stdout, stderr io.Writer, mountDir string, stdin io.Reader) int {
-	if len(args) == 0 {
-		fmt.Fprintln(stderr, "iso2chroot: create requires a numeric index argument.")
-		return 2
+// runCreateExtract finishes create --extract. Nothing is mounted and no sudo
+// is used, so unlike a mount it needs no confirmation.
+func runCreateExtract(ctx context.Context, manager *Manager, iso ISOInfo, index int, targetDir, lockPath string, lock LockFile, stdout, stderr io.Writer) int {
+	fmt.Fprintf(stdout, "Extracting the root filesystem of %s into %s\n", iso.Name, targetDir)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Create(ctx, CreateRequest{
+		Choice:   index,
+		MountDir: targetDir,
+		Extract:  true,
+		LockPath: lockPath,
+		Lock:     lock,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: create failed: %v\n", err)
+		var rollback *RollbackError
+		if errors.As(err, &rollback) {
+			for _, line := range rollback.Summary() {
+				fmt.Fprintf(stderr, "iso2chroot: %s\n", line)
+			}
+		}
+		return ExitCode(err)
+	}
+	for _, warning := range result.Extracted.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	fmt.Fprintf(stdout, "Extracted %s from %s to %s (%d entries, %d bytes)\n", result.Extracted.Source, iso.Name, result.ChrootDir, result.Extracted.Entries, result.Extracted.Bytes)
+	fmt.Fprintf(stdout, "Wrote lock file %s\n", lockPath)
+	return ExitOK
+}
+
+func runExtract(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("extract", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	var opts ExtractOptions
+	flagSet.BoolVar(&opts.RootFS, "rootfs", false, "Unpack the live root filesystem inside the ISO instead of the disc layout")
+	flagSet.Var((*stringList)(&opts.Include), "include", "Extract only entries matching this pattern, and everything below matching directories (repeatable)")
+	flagSet.Var((*stringList)(&opts.Exclude), "exclude", "Skip entries matching this pattern, and everything below matching directories (repeatable)")
+	noProgress := flagSet.Bool("no-progress", false, "Do not show progress, even on a terminal")
+	bootImage := flagSet.Bool("boot-image", false, "Write the ISO's EFI system partition image to the destination file instead of unpacking files")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if *bootImage {
+		return runExtractBootImage(ctx, manager, args, opts, stdout, stderr)
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "iso2chroot: extract requires an ISO index and a destination directory.")
+		return ExitUsage
 	}
-	if _, err := manager.Load(); err != nil {
+	if err := validatePatterns(opts.Include, opts.Exclude); err != nil {
 		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+		return ExitUsage
+	}
+	opts.Paths = args[2:]
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, iso, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
 	}
 
-	index, err := strconv.Atoi(args[0])
+	var progress *progressLine
+	if f, ok := stderr.(*os.File); ok && !*noProgress && tui.IsTerminal(f) {
+		progress = &progressLine{w: stderr}
+		opts.Progress = progress.update
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Extract(ctx, index, args[1], opts)
+	if progress != nil {
+		progress.finish()
+	}
 	if err != nil {
-		fmt.Fprintf(stderr, "iso2chroot: invalid index %q\n", args[0])
-		return 2
+		fmt.Fprintf(stderr, "iso2chroot: extract failed: %v\n", err)
+		if result.Entries > 0 {
+			fmt.Fprintf(stderr, "iso2chroot: %d entries already written to %s were left in place.\n", result.Entries, args[1])
+		}
+		return ExitCode(err)
 	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	if result.Source == iso.Name {
+		fmt.Fprintf(stdout, "Extracted %s to %s (%d entries, %s)\n", iso.Name, args[1], result.Entries, formatBytes(result.Bytes))
+	} else {
+		fmt.Fprintf(stdout, "Extracted %s from %s to %s (%d entries, %s)\n", result.Source, iso.Name, args[1], result.Entries, formatBytes(result.Bytes))
+	}
+	return ExitOK
+}
 
-	iso, err := manager.Select(index)
+// runExtractBootImage finishes extract --boot-image.
+func runExtractBootImage(ctx context.Context, manager *Manager, args []string, opts ExtractOptions, stdout, stderr io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "iso2chroot: extract --boot-image requires an ISO index and a destination file.")
+		return ExitUsage
+	}
+	if opts.RootFS || len(opts.Include) > 0 || len(opts.Exclude) > 0 {
+		fmt.Fprintln(stderr, "iso2chroot: extract --boot-image cannot be combined with --rootfs, --include or --exclude.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, iso, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.ExtractBootImage(ctx, index, args[1])
 	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: extract failed: %v\n", err)
+		return ExitCode(err)
+	}
+	fmt.Fprintf(stdout, "Extracted the EFI system partition image (%s) from %s to %s (%s)\n", result.Source, iso.Name, args[1], formatBytes(result.Bytes))
+	return ExitOK
+}
+
+// progressLine redraws a single status line on a terminal, at most a few
+// times a second.
+type progressLine struct {
+	w       io.Writer
+	last    time.Time
+	current ExtractProgress
+}
+
+func (p *progressLine) update(progress ExtractProgress) {
+	p.current = progress
+	if now := time.Now(); now.Sub(p.last) >= 100*time.Millisecond {
+		p.last = now
+		fmt.Fprintf(p.w, "\r\x1b[K%s", formatProgress(progress))
+	}
+}
+
+// finish draws the final state and ends the line so later messages start on
+// their own.
+func (p *progressLine) finish() {
+	fmt.Fprintf(p.w, "\r\x1b[K%s\n", formatProgress(p.current))
+}
+
+// formatProgress renders progress as one status line.
+func formatProgress(progress ExtractProgress) string {
+	line := fmt.Sprintf("%d entries, %s", progress.Entries, formatBytes(progress.Bytes))
+	if progress.TotalBytes > 0 {
+		line += fmt.Sprintf(" of %s (%d%%)", formatBytes(progress.TotalBytes), progress.Bytes*100/progress.TotalBytes)
+	}
+	return line
+}
+
+// formatBytes renders n in binary units, such as "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// sizeValue is a flag.Value for sizes such as 4G, 512MiB or 1.5GB, all in
+// binary units; a bare number counts units of unit bytes.
+type sizeValue struct {
+	n    *int64
+	unit int64
+}
+
+func (v sizeValue) String() string {
+	if v.n == nil {
+		return ""
+	}
+	return qemuSize(*v.n)
+}
+
+func (v sizeValue) Set(value string) error {
+	number := strings.TrimRightFunc(value, unicode.IsLetter)
+	unit, ok := v.unit, true
+	if suffix := strings.ToUpper(value[len(number):]); suffix != "" {
+		unit, ok = sizeUnits[suffix]
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n < 0 || n*float64(unit) > math.MaxInt64 {
+		return fmt.Errorf("invalid size %q (want a number, optionally followed by K, M, G or T)", value)
+	}
+	*v.n = int64(n * float64(unit))
+	return nil
+}
+
+// sizeUnits maps the suffixes of sizeValue to their units.
+var sizeUnits = map[string]int64{
+	"B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+// stringList is a flag.Value collecting every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func runInstances(ctx context.Context, manager *Manager, stdout, stderr io.Writer) int {
+	instances, err := manager.LoadInstances(ctx)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	if len(instances) == 0 {
+		fmt.Fprintf(stdout, "No instances in %s\n", manager.InstanceRoot())
+		return ExitOK
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tISO\tCREATED\tMOUNTS")
+	for _, inst := range instances {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", inst.Name, inst.ISO, inst.Created.Format(time.RFC3339), len(inst.Mounts))
+	}
+	tw.Flush()
+	return ExitOK
+}
+
+// runInfo describes an ISO as the built-in readers see it.
+func runInfo(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: info requires an ISO index.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	details, err := manager.Info(ctx, index)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	rootfs := details.RootFS
+	if rootfs == "" {
+		rootfs = "none"
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", details.ISO.Name)
+	fmt.Fprintf(tw, "Size:\t%s (%d bytes)\n", formatBytes(details.Size), details.Size)
+	fmt.Fprintf(tw, "Label:\t%s\n", details.Label)
+	fmt.Fprintf(tw, "Filesystems:\t%s\n", strings.Join(details.Filesystems, ", "))
+	fmt.Fprintf(tw, "Reading:\t%s\n", details.Filesystem)
+	fmt.Fprintf(tw, "Root filesystem:\t%s\n", rootfs)
+	distribution := "unknown"
+	if details.OSDetected {
+		distribution = fmt.Sprintf("%s (%s)", details.OS.Name, details.OS.ShortID)
+	}
+	fmt.Fprintf(tw, "Distribution:\t%s\n", distribution)
+	boot := details.Boot
+	if boot == "" {
+		boot = "not bootable"
+	}
+	fmt.Fprintf(tw, "Boot:\t%s\n", boot)
+	for _, image := range details.BootImages {
+		where := image.Path
+		if where == "" {
+			where = "outside the ISO9660 tree"
+		}
+		fmt.Fprintf(tw, "Boot entry:\t%s, %s, %d sectors at sector %d, %s\n", image.Platform, image.Emulation, image.Sectors, image.LBA, where)
+	}
+	if details.Partitions != nil {
+		fmt.Fprintf(tw, "Partition table:\t%s\n", details.Partitions.Scheme)
+		for _, p := range details.Partitions.Partitions {
+			desc := p.Description()
+			if p.Name != "" {
+				desc += fmt.Sprintf(" %q", p.Name)
+			}
+			if p.Bootable {
+				desc += ", active"
+			}
+			fmt.Fprintf(tw, "Partition %d:\t%s, %s at byte %d\n", p.Number, desc, formatBytes(p.Size), p.Start)
+		}
+	}
+	tw.Flush()
+	for _, warning := range details.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	return ExitOK
+}
+
+// Output formats of commands that print data for scripts.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// runBootEntries lists the kernel, initrd and command line of each entry of
+// the ISO's boot menus.
+func runBootEntries(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("boot-entries", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: boot-entries requires an ISO index.")
+		return ExitUsage
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fmt.Fprintf(stderr, "iso2chroot: unknown format %q (want %s or %s)\n", *format, FormatText, FormatJSON)
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	entries, err := manager.BootEntries(ctx, index)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	if *format == FormatJSON {
+		for i := range entries {
+			if entries[i].Initrd == nil {
+				entries[i].Initrd = []string{}
+			}
+		}
+		if entries == nil {
+			entries = []bootcfg.Entry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fail(stderr, err)
+		}
+		fmt.Fprintf(stdout, "%s\n", data)
+		return ExitOK
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "%s (%s, %s)\n", entry.Label, entry.Loader, entry.Config)
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		if entry.Kernel != "" {
+			fmt.Fprintf(tw, "  kernel:\t%s\n", entry.Kernel)
+		}
+		if len(entry.Initrd) > 0 {
+			fmt.Fprintf(tw, "  initrd:\t%s\n", strings.Join(entry.Initrd, " "))
+		}
+		if entry.Append != "" {
+			fmt.Fprintf(tw, "  append:\t%s\n", entry.Append)
+		}
+		tw.Flush()
+	}
+	return ExitOK
+}
+
+// runKernel copies the kernel and initramfs out of an ISO for direct boot.
+func runKernel(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("kernel", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "Directory to copy the kernel, initramfs and "+KernelManifestName+" into")
+	var opts KernelOptions
+	flagSet.StringVar(&opts.Entry, "entry", "", "Label of the boot menu entry to use, as boot-entries prints it (default: the first that boots a kernel)")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 || *out == "" {
+		fmt.Fprintln(stderr, "iso2chroot: kernel requires an ISO index and --out <dir>.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	manifest, err := manager.ExtractKernel(ctx, index, *out, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: kernel failed: %v\n", err)
+		return ExitCode(err)
+	}
+	from := manifest.Source
+	if manifest.Entry != "" {
+		from = fmt.Sprintf("%q in %s", manifest.Entry, manifest.Source)
+	}
+	fmt.Fprintf(stdout, "Extracted %s from %s (%s) to %s\n", strings.Join(append([]string{manifest.ISOKernel}, manifest.ISOInitrd...), ", "), manifest.ISO, from, *out)
+	fmt.Fprintf(stdout, "Command line: %s\n", manifest.Cmdline)
+	for _, warning := range manifest.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	return ExitOK
+}
+
+func runRemaster(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("remaster", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "File to write the new ISO to; it must not exist")
+	var opts RemasterOptions
+	flagSet.StringVar(&opts.Overlay, "overlay", "", "Directory whose files are added to the ISO tree, replacing those at the same paths")
+	flagSet.StringVar(&opts.VolumeID, "label", "", "Volume label of the new ISO, at most 32 characters (default: the ISO's)")
+	flagSet.StringVar(&opts.Publisher, "publisher", "", "Publisher of the new ISO (default: the ISO's)")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 || *out == "" {
+		fmt.Fprintln(stderr, "iso2chroot: remaster requires an ISO index and --out <file>.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Remaster(ctx, index, *out, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: remaster failed: %v\n", err)
+		return ExitCode(err)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	fmt.Fprintf(stdout, "Wrote %s from %s (label %q, %d entries, %d from the overlay, %s)\n", result.Out, result.ISO.Name, result.VolumeID, result.Entries, result.Overlaid, formatBytes(result.Bytes))
+	if result.Boot != "" {
+		fmt.Fprintf(stdout, "Boot: %s\n", result.Boot)
+	}
+	if result.Partitions != nil {
+		fmt.Fprintf(stdout, "Partition table: %s with %d partitions\n", result.Partitions.Scheme, len(result.Partitions.Partitions))
+	}
+	fmt.Fprintln(stdout, "Verified by reading the new ISO back.")
+	return ExitOK
+}
+
+func runAutoinstall(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("autoinstall", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "File to write the new ISO to; it must not exist")
+	var opts AutoinstallOptions
+	flagSet.StringVar(&opts.Config, "config", "", "Installer configuration: autoinstall user-data, a preseed file or a kickstart file")
+	flagSet.StringVar(&opts.Installer, "installer", "", "Installer to configure: "+strings.Join(Installers, ", ")+" (default: the installer of the ISO's distribution)")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 || *out == "" || opts.Config == "" {
+		fmt.Fprintln(stderr, "iso2chroot: autoinstall requires an ISO index, --config <file> and --out <file>.")
+		return ExitUsage
+	}
+	if opts.Installer != "" && !slices.Contains(Installers, opts.Installer) {
+		fmt.Fprintf(stderr, "iso2chroot: unknown installer %q (want one of %s)\n", opts.Installer, strings.Join(Installers, ", "))
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Autoinstall(ctx, index, *out, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: autoinstall failed: %v\n", err)
+		return ExitCode(err)
+	}
+	for _, warning := range result.Remaster.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	fmt.Fprintf(stdout, "Wrote %s from %s (%s configuration at /%s, %s)\n", result.Remaster.Out, result.Remaster.ISO.Name, result.Installer, result.Config, formatBytes(result.Remaster.Bytes))
+	fmt.Fprintf(stdout, "Kernel arguments: %s\n", result.Args)
+	fmt.Fprintf(stdout, "Unattended entries: %s\n", strings.Join(result.Entries, ", "))
+	fmt.Fprintf(stdout, "Changed menus: %s\n", strings.Join(result.Files, ", "))
+	return ExitOK
+}
+
+func runSeed(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "File to write the seed ISO to; it must not exist")
+	var opts SeedOptions
+	flagSet.StringVar(&opts.UserData, "user-data", "", "cloud-init user-data file")
+	flagSet.StringVar(&opts.MetaData, "meta-data", "", "cloud-init meta-data file")
+	flagSet.StringVar(&opts.NetworkConfig, "network-config", "", "Optional cloud-init network-config file")
+	flagSet.StringVar(&opts.Instance, "from-instance", "", "Instance whose hostname and SSH authorized keys make up the user-data and meta-data not given")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 0 || *out == "" || opts.Instance == "" && (opts.UserData == "" || opts.MetaData == "") {
+		fmt.Fprintln(stderr, "iso2chroot: seed requires --out <file> and either --user-data <file> and --meta-data <file> or --from-instance <instance>.")
+		return ExitUsage
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := manager.Seed(ctx, *out, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: seed failed: %v\n", err)
+		return ExitCode(err)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	fmt.Fprintf(stdout, "Wrote %s (%s: %s, %s)\n", result.Out, SeedLabel, strings.Join(result.Files, ", "), formatBytes(result.Bytes))
+	if opts.Instance != "" {
+		fmt.Fprintf(stdout, "From instance %s: hostname %s, %d SSH authorized keys\n", opts.Instance, result.Hostname, result.Keys)
+	}
+	return ExitOK
+}
+
+func runVirtXML(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("virt-xml", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "File to write the domain XML to; it must not exist (default: standard output)")
+	opts := VirtXMLOptions{Memory: 4 << 30, VCPUs: 2, DiskSize: 20 << 30}
+	flagSet.StringVar(&opts.Name, "name", "", "Domain name (default: the ISO name without its extension)")
+	flagSet.Var(sizeValue{&opts.Memory, 1 << 20}, "memory", "Memory, such as 8G; a bare number counts MiB")
+	flagSet.IntVar(&opts.VCPUs, "vcpus", opts.VCPUs, "Number of virtual processors")
+	flagSet.Var(sizeValue{&opts.DiskSize, 1 << 30}, "disk-size", "Size of the disk, such as 40G; a bare number counts GiB and 0 leaves the machine without a disk")
+	flagSet.StringVar(&opts.Disk, "disk", "", "Disk image; a .qcow2 name makes it qcow2, anything else raw (default: <name>.qcow2 in "+LibvirtImageDir+")")
+	flagSet.StringVar(&opts.Network, "network", "network=default", "Network: network=<name>, bridge=<name>, user or none")
+	flagSet.StringVar(&opts.Firmware, "firmware", FirmwareAuto, "Firmware: "+FirmwareAuto+" follows the ISO's boot catalog, preferring UEFI; "+FirmwareBIOS+" or "+FirmwareUEFI)
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: virt-xml requires an ISO index.")
+		return ExitUsage
+	}
+	if _, err := parseNetwork(opts.Network); err != nil {
 		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+		return ExitUsage
 	}
+	if !slices.Contains([]string{FirmwareAuto, FirmwareBIOS, FirmwareUEFI}, opts.Firmware) {
+		fmt.Fprintf(stderr, "iso2chroot: unknown firmware %q (want %s, %s or %s)\n", opts.Firmware, FirmwareAuto, FirmwareBIOS, FirmwareUEFI)
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	result, err := manager.VirtXML(ctx, index, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: virt-xml failed: %v\n", err)
+		return ExitCode(err)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	if *out == "" {
+		stdout.Write(result.XML)
+		return ExitOK
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err == nil {
+		_, err = f.Write(result.XML)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: virt-xml failed: %v\n", err)
+		return ExitCode(err)
+	}
+	fmt.Fprintf(stdout, "Wrote %s: domain %s for %s (%s), %s firmware, %s memory, %d vCPUs\n", *out, result.Name, result.OS.Name, result.OS.ShortID, result.Firmware, formatBytes(opts.Memory), opts.VCPUs)
+	if result.DiskCommand != "" {
+		fmt.Fprintf(stdout, "Create the disk with: %s\n", result.DiskCommand)
+	}
+	fmt.Fprintf(stdout, "Define the domain with: virsh define %s\n", shellQuote(*out))
+	return ExitOK
+}
 
-	targetDir := mountDir
-	if targetDir == "" {
-		targetDir = defaultMountDir
+func runServeHTTP(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("serve-http", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	listen := flagSet.String("listen", ":8080", "Address to listen on, as host:port")
+	rootfs := flagSet.Bool("rootfs", false, "Also serve the live root filesystem inside the ISO under "+RootFSPrefix)
+	quiet := flagSet.Bool("quiet", false, "Do not log requests")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: serve-http requires an ISO index.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	opts := ServeOptions{RootFS: *rootfs}
+	if !*quiet {
+		opts.Log = stdout
+	}
+	server, err := manager.NewISOServer(ctx, index, opts)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: serve-http failed: %v\n", err)
+		return ExitCode(err)
+	}
+
+	url := "http://" + ln.Addr().String()
+	fmt.Fprintf(stdout, "Serving %s at %s/\n", server.Disc, url)
+	if server.RootFS != nil {
+		fmt.Fprintf(stdout, "Serving %s at %s%s\n", server.RootFS, url, RootFSPrefix)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Serve(ctx, ln); err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: serve-http failed: %v\n", err)
+		return ExitCode(err)
+	}
+	return ExitOK
+}
+
+func runPXE(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("pxe", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	listen := flagSet.String("listen", ":69", "Address to serve TFTP on, as host:port")
+	httpListen := flagSet.String("http", ":8080", "Address to serve the ISO over HTTP on, as host:port")
+	var opts PXEOptions
+	flagSet.StringVar(&opts.URL, "url", "", "URL clients reach the HTTP server at (default: from --http and this host's address)")
+	flagSet.StringVar(&opts.Entry, "entry", "", "Label of the boot menu entry to offer, as boot-entries prints it (default: every entry that boots a kernel)")
+	flagSet.StringVar(&opts.Loaders, "loaders", "", "Directory of boot loaders to serve over TFTP too, such as pxelinux.0 and ldlinux.c32")
+	quiet := flagSet.Bool("quiet", false, "Do not log transfers and requests")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: pxe requires an ISO index.")
+		return ExitUsage
+	}
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ln, err := net.Listen("tcp", *httpListen)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: pxe failed: %v\n", err)
+		return ExitCode(err)
+	}
+	defer ln.Close()
+	if opts.URL == "" {
+		host, err := advertisedHost(ln.Addr())
+		if err != nil {
+			fmt.Fprintf(stderr, "iso2chroot: pxe failed: %v\n", err)
+			return ExitFailure
+		}
+		opts.URL = "http://" + net.JoinHostPort(host, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)) + "/"
+	}
+	if !*quiet {
+		opts.Log = stdout
+	}
+	server, err := manager.NewPXEServer(ctx, index, opts)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	defer server.Close()
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: pxe failed: %v\n", err)
+		return ExitCode(err)
+	}
+
+	fmt.Fprintf(stdout, "Serving %s over TFTP at %s and HTTP at %s\n", server.HTTP.Disc, conn.LocalAddr(), server.URL)
+	fmt.Fprintf(stdout, "Boot menus: %s\n", strings.Join(server.Menus, ", "))
+	for _, entry := range server.Entries {
+		fmt.Fprintf(stdout, "  %s: %s %s\n", entry.Label, entry.Kernel, entry.Cmdline)
 	}
+	if opts.Loaders == "" {
+		fmt.Fprintln(stdout, "No boot loaders are served; pass --loaders with a directory holding pxelinux.0 or a GRUB netboot image.")
+	}
+	for _, warning := range server.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Serve(ctx, conn, ln); err != nil {
+		fmt.Fprintf(stderr, "iso2chroot: pxe failed: %v\n", err)
+		return ExitCode(err)
+	}
+	return ExitOK
+}
+
+// advertisedHost returns the host clients reach a listener at addr on: its
+// IP, or when it listens on every address the first IPv4 address of this
+// host that is not loopback.
+func advertisedHost(addr net.Addr) (string, error) {
+	if tcp, ok := addr.(*net.TCPAddr); ok && !tcp.IP.IsUnspecified() {
+		return tcp.IP.String(), nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ip, ok := a.(*net.IPNet); ok && ip.IP.To4() != nil && ip.IP.IsGlobalUnicast() {
+			return ip.IP.String(), nil
+		}
+	}
+	return "", errors.New("cannot tell which address clients reach this host at; pass --url")
+}
+
+// openImageArg loads the library and opens the ISO chosen by selector for
+// ls, cat and find. On failure it reports the error and returns the exit code.
+func openImageArg(ctx context.Context, manager *Manager, selector string, rootfs bool, stderr io.Writer) (*Image, int) {
+	if _, err := manager.Load(ctx); err != nil {
+		return nil, fail(stderr, err)
+	}
+	index, _, err := manager.Resolve(selector)
+	if err != nil {
+		return nil, fail(stderr, err)
+	}
+	img, err := manager.OpenImage(ctx, index, rootfs)
+	if err != nil {
+		return nil, fail(stderr, err)
+	}
+	return img, ExitOK
+}
 
-	reader := bufio.NewReader(stdin)
-	fmt.Fprintf(stdout, "iso2chroot will mount %s into %s using sudo.\n", iso.Name, targetDir)
-	fmt.Fprintln(stdout, "You may be prompted for your sudo password.")
-	fmt.Fprint(stdout, "Press Enter to continue or type 'n' to cancel: ")
+// runImageList lists a directory inside an ISO for ls or ls-iso, whichever
+// command names.
+func runImageList(ctx context.Context, manager *Manager, command string, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet(command, flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	rootfs := flagSet.Bool("rootfs", false, "List the live root filesystem inside the ISO instead of the disc layout")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintf(stderr, "iso2chroot: %s requires an ISO index and at most one path.\n", command)
+		return ExitUsage
+	}
+	img, code := openImageArg(ctx, manager, args[0], *rootfs, stderr)
+	if img == nil {
+		return code
+	}
+	defer img.Close()
 
-	response, readErr := reader.ReadString('\n')
-	if readErr != nil && readErr != io.EOF {
-		fmt.Fprintf(stderr, "iso2chroot: read confirmation: %v\n", readErr)
-		return 1
+	name := "."
+	if len(args) == 2 {
+		if name, err = img.Lookup(args[1]); err != nil {
+			return fail(stderr, err)
+		}
 	}
-	choice := strings.TrimSpace(strings.ToLower(response))
-	if choice != "" && choice != "y" && choice != "yes" {
-		fmt.Fprintln(stderr, "iso2chroot: create cancelled.")
-		return 1
+	info, err := fs.Stat(img, name)
+	if err != nil {
+		return fail(stderr, err)
 	}
+	dir, entries := ".", []fs.DirEntry{fs.FileInfoToDirEntry(info)}
+	if info.IsDir() {
+		dir = name
+		if entries, err = fs.ReadDir(img, name); err != nil {
+			return fail(stderr, err)
+		}
+	} else {
+		// Show a file under the name it was asked for.
+		dir, entries = path.Dir(name), []fs.DirEntry{renamedEntry{entries[0], path.Base(name)}}
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return fail(stderr, err)
+		}
+		display := entry.Name()
+		if info.Mode().Type() == fs.ModeSymlink {
+			if target, err := fs.ReadLink(img, path.Join(dir, entry.Name())); err == nil {
+				display += " -> " + target
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", info.Mode(), info.Size(), info.ModTime().UTC().Format("2006-01-02 15:04"), display)
+	}
+	tw.Flush()
+	return ExitOK
+}
+
+// renamedEntry is a DirEntry shown under another name.
+type renamedEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e renamedEntry) Name() string { return e.name }
+
+func runCat(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("cat", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	rootfs := flagSet.Bool("rootfs", false, "Read from the live root filesystem inside the ISO instead of the disc layout")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "iso2chroot: cat requires an ISO index and at least one path.")
+		return ExitUsage
+	}
+	img, code := openImageArg(ctx, manager, args[0], *rootfs, stderr)
+	if img == nil {
+		return code
+	}
+	defer img.Close()
+
+	for _, arg := range args[1:] {
+		name, err := img.Lookup(arg)
+		if err != nil {
+			return fail(stderr, err)
+		}
+		if err := catFile(ctx, img, name, stdout); err != nil {
+			return fail(stderr, err)
+		}
+	}
+	return ExitOK
+}
+
+// catFile copies the named regular file of img to w, following symlinks.
+func catFile(ctx context.Context, img *Image, name string, w io.Writer) error {
+	f, err := img.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s in %s is not a regular file", name, img)
+	}
+	if _, err := io.Copy(w, contextReader{ctx: ctx, r: f}); err != nil {
+		if ctx.Err() != nil {
+			return contextError("read "+name, ctx)
+		}
+		return fmt.Errorf("read %s in %s: %w", name, img, err)
+	}
+	return nil
+}
 
-	if err := manager.Mount(index, targetDir); err != nil {
+func runFind(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("find", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	rootfs := flagSet.Bool("rootfs", false, "Search the live root filesystem inside each ISO instead of the disc layout")
+	all := flagSet.Bool("all", false, "Search every ISO in the library, printing matches as <iso>:<path>")
+	grep := flagSet.String("grep", "", "Report only files with a line matching this regular expression")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	want := 2
+	if *all {
+		want = 1
+	}
+	if len(args) != want {
+		fmt.Fprintln(stderr, "iso2chroot: find requires an ISO index, or --all, followed by a pattern.")
+		return ExitUsage
+	}
+	opts := FindOptions{Pattern: args[len(args)-1]}
+	if err := validatePatterns([]string{opts.Pattern}); err != nil {
 		fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
-		return 1
+		return ExitUsage
+	}
+	if *grep != "" {
+		if opts.Grep, err = compileGrep(*grep); err != nil {
+			fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
+			return ExitUsage
+		}
+	}
+
+	if !*all {
+		img, code := openImageArg(ctx, manager, args[0], *rootfs, stderr)
+		if img == nil {
+			return code
+		}
+		defer img.Close()
+		found, err := img.Find(ctx, opts)
+		for _, name := range found {
+			fmt.Fprintln(stdout, name)
+		}
+		if err != nil {
+			return fail(stderr, err)
+		}
+		return ExitOK
+	}
+
+	if _, err := manager.Load(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	// One unreadable ISO does not stop the search; it is reported and
+	// reflected in the exit code.
+	code := ExitOK
+	for choice := 1; choice <= manager.EntryCount(); choice++ {
+		img, err := manager.OpenImage(ctx, choice, *rootfs)
+		if err != nil {
+			if *rootfs && errors.Is(err, ErrNotFound) {
+				// Installer and other non-live ISOs have no root filesystem to search.
+				continue
+			}
+			code = fail(stderr, err)
+			continue
+		}
+		found, err := img.Find(ctx, opts)
+		img.Close()
+		for _, name := range found {
+			fmt.Fprintf(stdout, "%s:%s\n", img.ISO.Name, name)
+		}
+		if err != nil {
+			if code = fail(stderr, err); ctx.Err() != nil {
+				return code
+			}
+		}
+	}
+	return code
+}
+
+func runRename(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "iso2chroot: rename requires the current and new instance names.")
+		return ExitUsage
+	}
+	if err := manager.RenameInstance(ctx, args[0], args[1]); err != nil {
+		return fail(stderr, err)
+	}
+	fmt.Fprintf(stdout, "Renamed instance %s to %s\n", args[0], args[1])
+	return ExitOK
+}
+
+func runEnter(ctx context.Context, manager *Manager, args []string, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "iso2chroot: enter requires an instance name.")
+		return ExitUsage
+	}
+	if err := manager.Enter(ctx, args[0], args[1:]); err != nil {
+		return fail(stderr, err)
+	}
+	return ExitOK
+}
+
+func runDestroy(ctx context.Context, manager *Manager, args []string, stdout, stderr io.Writer, prompter tui.Prompter) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: destroy requires an instance name.")
+		return ExitUsage
+	}
+	name := args[0]
+	if _, err := manager.LoadInstances(ctx); err != nil {
+		return fail(stderr, err)
+	}
+	if _, err := manager.Instance(name); err != nil {
+		return fail(stderr, err)
 	}
 
-	fmt.Fprintf(stdout, "Mounted %s to %s\n", iso.Name, targetDir)
-	return 0
+	fmt.Fprintf(stdout, "iso2chroot will unmount and delete %s using sudo.\n", manager.InstanceDir(name))
+	ok, err := prompter.ConfirmTyped(fmt.Sprintf("Type the instance name (%s) to confirm: ", name), name)
+	if err != nil {
+		return confirmFailed(stderr, "destroy", err)
+	}
+	if !ok {
+		fmt.Fprintln(stderr, "iso2chroot: destroy cancelled.")
+		return ExitDeclined
+	}
+
+	if err := manager.DestroyInstance(ctx, name); err != nil {
+		return fail(stderr, err)
+	}
+	fmt.Fprintf(stdout, "Destroyed instance %s\n", name)
+	return ExitOK
+}
+
+// ExitCode maps an error returned by the package to the exit code RunCLI
+// reports for it.
+func ExitCode(err error) int {
+	var systemPath *SystemPathError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	case errors.Is(err, ErrCancelled), errors.Is(err, context.Canceled):
+		return ExitCancelled
+	case errors.As(err, &systemPath):
+		return ExitUnsafeTarget
+	case errors.Is(err, ErrAlreadyMounted):
+		return ExitTargetMounted
+	case errors.Is(err, ErrChecksumMismatch):
+		return ExitMismatch
+	case errors.Is(err, ErrBusy):
+		return ExitBusy
+	case errors.Is(err, ErrPermission), errors.Is(err, os.ErrPermission):
+		return ExitPermission
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return ExitNotFound
+	default:
+		return ExitFailure
+	}
+}
+
+// fail reports err on stderr and returns its exit code.
+func fail(stderr io.Writer, err error) int {
+	fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
+	return ExitCode(err)
+}
+
+// confirmFailed reports a confirmation that could not be obtained.
+func confirmFailed(stderr io.Writer, command string, err error) int {
+	if errors.Is(err, tui.ErrNoInput) {
+		fmt.Fprintf(stderr, "iso2chroot: %s needs confirmation but no interactive input is available; rerun with --yes to proceed.\n", command)
+		return ExitFailure
+	}
+	fmt.Fprintf(stderr, "iso2chroot: %v\n", err)
+	return ExitFailure
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional arguments in order.
+func parseInterspersed(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flagSet.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flagSet.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		args = rest
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 func printWithTrailingNewline(w io.Writer, text string) {
@@ -2,22 +2,21 @@ package iso2chroot
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+
+	"thatnerdjosh.com/devtools/pkg/tui"
 )
 
 func TestRunCLIDefaultList(t *testing.T) {
-	dir := t.TempDir()
-	files := []string{"b.iso", "a.iso"}
-	for _, name := range files {
-		if err := os.WriteFile(filepath.Join(dir, name), []byte(""), 0o644); err != nil {
-			t.Fatalf("write file %s: %v", name, err)
-		}
-	}
-
-	manager := NewManager(dir)
+	manager := NewManagerFS("isos", fstest.MapFS{
+		"b.iso": {Data: []byte{}},
+		"a.iso": {Data: []byte{}},
+	})
 	var stdout, stderr bytes.Buffer
 
 	code := RunCLI(manager, nil, &stdout, &stderr, CLIOptions{})
@@ -34,15 +33,10 @@ func TestRunCLIDefaultList(t *testing.T) {
 }
 
 func TestRunCLISelect(t *testing.T) {
-	dir := t.TempDir()
-	files := []string{"b.iso", "a.iso"}
-	for _, name := range files {
-		if err := os.WriteFile(filepath.Join(dir, name), []byte(""), 0o644); err != nil {
-			t.Fatalf("write file %s: %v", name, err)
-		}
-	}
-
-	manager := NewManager(dir)
+	manager := NewManagerFS("isos", fstest.MapFS{
+		"b.iso": {Data: []byte{}},
+		"a.iso": {Data: []byte{}},
+	})
 	var stdout, stderr bytes.Buffer
 
 	code := RunCLI(manager, []string{"select", "2"}, &stdout, &stderr, CLIOptions{})
@@ -109,7 +103,7 @@ func TestRunCLICreate(t *testing.T) {
 	)
 	defer func() { mountFunc = originalMount }()
 	targetDir := filepath.Join(dir, "src")
-	mountFunc = func(isoFile, dstDir string) error {
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
 		mountCalled = true
 		gotISO = isoFile
 		gotDir = dstDir
@@ -159,13 +153,14 @@ func TestRunCLICreateDefaultMountDir(t *testing.T) {
 		gotDir        string
 	)
 	defer func() { mountFunc = originalMount }()
-	mountFunc = func(isoFile, dstDir string) error {
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
 		gotDir = dstDir
 		return nil
 	}
 
 	code := RunCLI(manager, []string{"create", "1"}, &stdout, &stderr, CLIOptions{
-		Stdin: bytes.NewBufferString("\n"),
+		LockPath: filepath.Join(dir, "iso2chroot.lock"),
+		Stdin:    bytes.NewBufferString("\n"),
 	})
 	if code != 0 {
 		t.Fatalf("RunCLI() exit code = %d, want 0", code)
@@ -202,7 +197,7 @@ func TestRunCLICreateCancelled(t *testing.T) {
 		mountCalled   bool
 	)
 	defer func() { mountFunc = originalMount }()
-	mountFunc = func(isoFile, dstDir string) error {
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
 		mountCalled = true
 		return nil
 	}
@@ -210,8 +205,8 @@ func TestRunCLICreateCancelled(t *testing.T) {
 	code := RunCLI(manager, []string{"create", "1"}, &stdout, &stderr, CLIOptions{
 		Stdin: bytes.NewBufferString("n\n"),
 	})
-	if code != 1 {
-		t.Fatalf("RunCLI() exit code = %d, want 1", code)
+	if code != ExitDeclined {
+		t.Fatalf("RunCLI() exit code = %d, want %d", code, ExitDeclined)
 	}
 	if mountCalled {
 		t.Fatal("expected mount not to be called")
@@ -220,3 +215,164 @@ func TestRunCLICreateCancelled(t *testing.T) {
 		t.Fatalf("stderr = %q, want cancellation notice", stderr.String())
 	}
 }
+
+func TestRunCLICreateWritesLockFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "only.iso"), []byte("iso contents"), 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+
+	manager := NewManager(dir)
+	var stdout, stderr bytes.Buffer
+
+	originalMount := mountFunc
+	defer func() { mountFunc = originalMount }()
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error { return nil }
+
+	targetDir := filepath.Join(dir, "src")
+	code := RunCLI(manager, []string{"create", "1"}, &stdout, &stderr, CLIOptions{
+		MountDir: targetDir,
+		Stdin:    bytes.NewBufferString("\n"),
+	})
+	if code != 0 {
+		t.Fatalf("RunCLI() exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+
+	lock, err := ReadLockFile(DefaultLockPath(targetDir))
+	if err != nil {
+		t.Fatalf("ReadLockFile() error = %v", err)
+	}
+	const wantSum = "a5fe3b2670d317e71fe29245df32d915643fa21cc02e23311068211ae95af343"
+	if lock.ISO.Name != "only.iso" || lock.ISO.SHA256 != wantSum {
+		t.Fatalf("lock ISO = %+v, want only.iso with sha256 %s", lock.ISO, wantSum)
+	}
+	if lock.ToolVersion != Version {
+		t.Fatalf("lock tool version = %q, want %q", lock.ToolVersion, Version)
+	}
+	if strings.Join(lock.Steps, ",") != strings.Join(createSteps, ",") {
+		t.Fatalf("lock steps = %v, want %v", lock.Steps, createSteps)
+	}
+}
+
+func TestRunCLICreateFromLockRefusesChangedISO(t *testing.T) {
+	dir := t.TempDir()
+	isoPath := filepath.Join(dir, "only.iso")
+	if err := os.WriteFile(isoPath, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+
+	manager := NewManager(dir)
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	lock, err := manager.LockInputs(context.Background(), 1, createSteps)
+	if err != nil {
+		t.Fatalf("LockInputs() error = %v", err)
+	}
+	lockPath := filepath.Join(dir, "build.lock")
+	if err := WriteLockFile(lockPath, lock); err != nil {
+		t.Fatalf("WriteLockFile() error = %v", err)
+	}
+	if err := os.WriteFile(isoPath, []byte("rebuilt"), 0o644); err != nil {
+		t.Fatalf("rewrite iso: %v", err)
+	}
+
+	var (
+		originalMount = mountFunc
+		mountCalled   bool
+	)
+	defer func() { mountFunc = originalMount }()
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
+		mountCalled = true
+		return nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--from-lock", lockPath}, &stdout, &stderr, CLIOptions{
+		MountDir: filepath.Join(dir, "src"),
+		Stdin:    bytes.NewBufferString("\n"),
+	})
+	if code != ExitMismatch {
+		t.Fatalf("RunCLI() exit code = %d, want %d", code, ExitMismatch)
+	}
+	if mountCalled {
+		t.Fatal("expected mount not to be called")
+	}
+	if !strings.Contains(stderr.String(), "iso sha256") {
+		t.Fatalf("stderr = %q, want sha256 mismatch", stderr.String())
+	}
+}
+
+func TestRunCLICreateNoInput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "only.iso"), []byte(""), 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+
+	var (
+		originalMount = mountFunc
+		mountCalled   bool
+	)
+	defer func() { mountFunc = originalMount }()
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
+		mountCalled = true
+		return nil
+	}
+
+	tests := []struct {
+		name      string
+		prompter  tui.Prompter
+		stdin     string
+		wantCode  int
+		wantMount bool
+	}{
+		{name: "no input", prompter: tui.NoInput{}, wantCode: 1},
+		{name: "closed stdin", stdin: "", wantCode: 1},
+		{name: "assume yes", prompter: tui.AssumeYes{}, wantCode: 0, wantMount: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountCalled = false
+			var stdout, stderr bytes.Buffer
+			code := RunCLI(NewManager(dir), []string{"create", "1"}, &stdout, &stderr, CLIOptions{
+				MountDir: filepath.Join(t.TempDir(), "src"),
+				Stdin:    strings.NewReader(tt.stdin),
+				Prompter: tt.prompter,
+			})
+			if code != tt.wantCode {
+				t.Fatalf("RunCLI() exit code = %d, want %d (stderr %q)", code, tt.wantCode, stderr.String())
+			}
+			if mountCalled != tt.wantMount {
+				t.Fatalf("mount called = %v, want %v", mountCalled, tt.wantMount)
+			}
+			if tt.wantCode != 0 && !strings.Contains(stderr.String(), "--yes") {
+				t.Fatalf("stderr = %q, want a hint about --yes", stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunCLIDestroyRequiresInstanceName(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if _, err := manager.CreateInstance(context.Background(), 1, "dev", InstanceOptions{}); err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	before := len(mounter.Calls())
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"destroy", "dev"}, &stdout, &stderr, CLIOptions{
+		Stdin: strings.NewReader("\n"),
+	})
+	if code != ExitDeclined {
+		t.Fatalf("RunCLI() exit code = %d, want %d", code, ExitDeclined)
+	}
+	if calls := mounter.Calls(); len(calls) != before {
+		t.Fatalf("destroy unmounted without confirmation: %v", calls[before:])
+	}
+	if !strings.Contains(stdout.String(), "Type the instance name (dev)") {
+		t.Fatalf("stdout = %q, want typed-name prompt", stdout.String())
+	}
+}
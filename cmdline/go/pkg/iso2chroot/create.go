@@ -0,0 +1,366 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Steps performed by Create, in the names recorded in lock files.
+const (
+	stepPrepareMountDir = "prepare-mount-dir"
+	stepPrepareInstance = "prepare-instance-dirs"
+	stepMountISO        = "mount-iso-ro"
+	stepMountLower      = "mount-lower"
+	stepMountOverlay    = "mount-overlay"
+	stepExtractRootFS   = "extract-rootfs"
+	stepWriteLock       = "write-lock-file"
+)
+
+var (
+	// createSteps lists, in order, the steps create performs to mount into a directory.
+	createSteps = []string{stepPrepareMountDir, stepMountISO}
+	// instanceSteps lists, in order, the steps create performs for a named instance.
+	instanceSteps = []string{stepPrepareInstance, stepMountISO, stepMountLower, stepMountOverlay}
+	// extractSteps lists, in order, the steps create performs to extract the
+	// root filesystem into a directory.
+	extractSteps = []string{stepPrepareMountDir, stepExtractRootFS}
+)
+
+// CreateRequest describes a chroot build performed by Manager.Create.
+type CreateRequest struct {
+	Choice int
+	// Name selects a named instance under the instance root. When empty the ISO
+	// is mounted directly at MountDir.
+	Name     string
+	MountDir string
+	// Extract unpacks the ISO's live root filesystem into MountDir as plain
+	// files instead of mounting anything. It needs no privileges and cannot be
+	// combined with Name.
+	Extract bool
+	// ReuseISOMount is an existing mount of the ISO to use instead of mounting it again.
+	ReuseISOMount string
+	// Preflight is the report of a Preflight the caller already ran for the
+	// target. When nil, Create runs it.
+	Preflight *PreflightReport
+	// LockPath, when set, receives Lock with the packages installed in the
+	// extracted or overlay root filled in.
+	LockPath string
+	Lock     LockFile
+}
+
+// CreateResult describes a completed chroot build.
+type CreateResult struct {
+	ChrootDir string
+	Instance  Instance
+	Lock      LockFile
+	// Extracted describes the unpacked files of an Extract request.
+	Extracted ExtractResult
+}
+
+// Create builds a chroot as a transaction: every step registers an undo, and if
+// a step fails or ctx ends between steps the completed steps are undone in
+// reverse order. Such failures are reported as a *RollbackError. Each privileged
+// command is bounded by the Command timeout and undo steps still run after ctx
+// has ended.
+func (m *Manager) Create(ctx context.Context, req CreateRequest) (CreateResult, error) {
+	iso, err := m.Select(req.Choice)
+	if err != nil {
+		return CreateResult{}, err
+	}
+
+	target := req.MountDir
+	if target == "" {
+		target = defaultMountDir
+	}
+	if req.Extract && req.Name != "" {
+		return CreateResult{}, errors.New("extracting into a named instance is not supported")
+	}
+	if req.Name != "" {
+		if err := validateInstanceName(req.Name); err != nil {
+			return CreateResult{}, err
+		}
+		target = m.InstanceDir(req.Name)
+	}
+
+	lock, err := m.lock(ctx, target)
+	if err != nil {
+		return CreateResult{}, err
+	}
+	defer lock.Release()
+
+	if req.Preflight == nil {
+		if _, err := m.Preflight(ctx, req.Choice, target); err != nil {
+			return CreateResult{}, err
+		}
+	}
+
+	tx := newTransaction(ctx)
+	var result CreateResult
+	switch {
+	case req.Name != "":
+		result, err = m.createInstance(tx, iso, req)
+	case req.Extract:
+		result, err = m.createExtract(tx, iso, target)
+	default:
+		result, err = m.createMount(tx, iso, target, req)
+	}
+	if err == nil && req.LockPath != "" {
+		err = m.writeCreateLock(tx, &result, req)
+	}
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(err, ErrCancelled) && !errors.Is(err, ErrTimeout) {
+			err = fmt.Errorf("%w: %w", contextCause(ctx), err)
+		}
+		return CreateResult{}, tx.rollback(err)
+	}
+	return result, nil
+}
+
+func (m *Manager) createMount(tx *transaction, iso ISOInfo, target string, req CreateRequest) (CreateResult, error) {
+	if req.ReuseISOMount != "" {
+		return CreateResult{ChrootDir: req.ReuseISOMount}, nil
+	}
+
+	mounter := m.privileged()
+	_, statErr := os.Stat(target)
+	created := errors.Is(statErr, os.ErrNotExist)
+	err := tx.do(stepPrepareMountDir, func() error {
+		if err := mounter.Mkdir(tx.ctx, target); err != nil {
+			return fmt.Errorf("prepare mount dir %s: %w", target, err)
+		}
+		return nil
+	}, func() error {
+		if !created {
+			return nil
+		}
+		return mounter.Rmdir(tx.undoContext(), target)
+	})
+	if err != nil {
+		return CreateResult{}, err
+	}
+
+	err = tx.do(stepMountISO, func() error {
+		return mounter.MountLoop(tx.ctx, m.Path(iso), target, m.mountType(iso))
+	}, func() error {
+		return mounter.Unmount(tx.undoContext(), target)
+	})
+	if err != nil {
+		return CreateResult{}, err
+	}
+	return CreateResult{ChrootDir: target}, nil
+}
+
+// createExtract unpacks the live root filesystem of iso into target, which must
+// be empty or missing. Nothing runs through the Mounter, so no step needs sudo.
+func (m *Manager) createExtract(tx *transaction, iso ISOInfo, target string) (CreateResult, error) {
+	if m.isDryRun() {
+		return CreateResult{}, errors.New("extracting the root filesystem cannot be done as a dry run")
+	}
+	_, statErr := os.Stat(target)
+	created := errors.Is(statErr, os.ErrNotExist)
+	err := tx.do(stepPrepareMountDir, func() error {
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return fmt.Errorf("prepare %s: %w", target, err)
+		}
+		if entries, err := os.ReadDir(target); err != nil {
+			return fmt.Errorf("prepare %s: %w", target, err)
+		} else if len(entries) > 0 {
+			return fmt.Errorf("refusing to extract into %s: directory is not empty (%d entries)", target, len(entries))
+		}
+		return nil
+	}, func() error {
+		if !created {
+			return nil
+		}
+		return os.Remove(target)
+	})
+	if err != nil {
+		return CreateResult{}, err
+	}
+
+	// empty removes everything extracted into target, keeping the directory itself for the
+	// prepare step to undo.
+	empty := func() error {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := removeExtracted(filepath.Join(target, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var extracted ExtractResult
+	err = tx.do(stepExtractRootFS, func() error {
+		disc, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return err
+		}
+		defer disc.Close()
+		rootfs, image, err := openRootFS(disc.FS, iso.Name)
+		if err != nil {
+			return err
+		}
+		extracted, err = extractTree(tx.ctx, rootfs, target, ExtractOptions{})
+		extracted.Source = image
+		if err != nil {
+			empty()
+			return err
+		}
+		return nil
+	}, empty)
+	if err != nil {
+		return CreateResult{}, err
+	}
+	return CreateResult{ChrootDir: target, Extracted: extracted}, nil
+}
+
+func (m *Manager) createInstance(tx *transaction, iso ISOInfo, req CreateRequest) (CreateResult, error) {
+	name := req.Name
+	dir := m.InstanceDir(name)
+	mounter := m.privileged()
+	inst := Instance{
+		Name:    name,
+		ISO:     iso.Name,
+		ISOPath: m.Path(iso),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+
+	err := tx.do(stepPrepareInstance, func() error {
+		return m.updateInstances(tx.ctx, func(instances map[string]Instance) error {
+			if _, exists := instances[name]; exists {
+				return fmt.Errorf("instance %q already exists", name)
+			}
+			if _, err := os.Stat(dir); err == nil {
+				return fmt.Errorf("instance directory %s already exists", dir)
+			}
+			for _, sub := range []string{instanceISODir, instanceLowerDir, instanceUpperDir, instanceWorkDir, instanceRootDir} {
+				if err := mounter.Mkdir(tx.ctx, filepath.Join(dir, sub)); err != nil {
+					mounter.RemoveAll(tx.undoContext(), dir)
+					return fmt.Errorf("prepare instance dir: %w", err)
+				}
+			}
+			instances[name] = inst
+			return nil
+		})
+	}, func() error {
+		// Every mount has been undone by the time this runs.
+		if err := mounter.RemoveAll(tx.undoContext(), dir); err != nil {
+			return fmt.Errorf("remove instance dir: %w", err)
+		}
+		return m.updateInstances(tx.undoContext(), func(instances map[string]Instance) error {
+			delete(instances, name)
+			return nil
+		})
+	})
+	if err != nil {
+		return CreateResult{Instance: inst}, err
+	}
+
+	// mount runs one mount step, then records it in the registry as a step of
+	// its own. The unmount is registered as soon as the mount is in place, so
+	// a failed or cancelled registry update still rolls the mount back; the
+	// record is dropped only once the unmount has succeeded.
+	mount := func(step, sub string, do func(target string) error) error {
+		target := filepath.Join(dir, sub)
+		recorded := false
+		if err := tx.do(step, func() error {
+			return do(target)
+		}, func() error {
+			if err := mounter.Unmount(tx.undoContext(), target); err != nil {
+				return err
+			}
+			if !recorded {
+				return nil
+			}
+			inst.Mounts = inst.Mounts[:len(inst.Mounts)-1]
+			return m.updateInstances(tx.undoContext(), func(instances map[string]Instance) error {
+				instances[name] = inst
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+		return tx.do("record-"+step, func() error {
+			mounts := append(inst.Mounts[:len(inst.Mounts):len(inst.Mounts)], sub)
+			if err := m.updateInstances(tx.undoContext(), func(instances map[string]Instance) error {
+				updated := inst
+				updated.Mounts = mounts
+				instances[name] = updated
+				return nil
+			}); err != nil {
+				return err
+			}
+			inst.Mounts = mounts
+			recorded = true
+			return nil
+		}, nil)
+	}
+
+	if err := mount(stepMountISO, instanceISODir, func(target string) error {
+		if req.ReuseISOMount != "" {
+			return mounter.Bind(tx.ctx, req.ReuseISOMount, target)
+		}
+		return mounter.MountLoop(tx.ctx, inst.ISOPath, target, m.mountType(iso))
+	}); err != nil {
+		return CreateResult{Instance: inst}, err
+	}
+	if err := mount(stepMountLower, instanceLowerDir, func(target string) error {
+		isoDir := filepath.Join(dir, instanceISODir)
+		if image := m.rootfsImage(iso, isoDir); image != "" {
+			return mounter.MountLoop(tx.ctx, image, target, "")
+		}
+		return mounter.Bind(tx.ctx, isoDir, target)
+	}); err != nil {
+		return CreateResult{Instance: inst}, err
+	}
+	if err := mount(stepMountOverlay, instanceRootDir, func(target string) error {
+		return mounter.MountOverlay(
+			tx.ctx,
+			filepath.Join(dir, instanceLowerDir),
+			filepath.Join(dir, instanceUpperDir),
+			filepath.Join(dir, instanceWorkDir),
+			target,
+		)
+	}); err != nil {
+		return CreateResult{Instance: inst}, err
+	}
+
+	return CreateResult{ChrootDir: filepath.Join(dir, instanceRootDir), Instance: inst}, nil
+}
+
+func (m *Manager) writeCreateLock(tx *transaction, result *CreateResult, req CreateRequest) error {
+	return tx.do(stepWriteLock, func() error {
+		lock := req.Lock
+		// The extracted or overlay root is read directly. A plain ISO mount,
+		// or a root without a package database, keeps the packages LockInputs
+		// read from the image inside the ISO.
+		if (req.Extract || req.Name != "") && !m.isDryRun() {
+			packages, err := installedPackages(tx.ctx, os.DirFS(result.ChrootDir))
+			switch {
+			case errors.Is(err, errPackagesUnavailable):
+				lock.Packages, lock.PackagesUnavailable = nil, err.Error()
+			case err != nil:
+				return err
+			case packages != nil:
+				lock.Packages, lock.PackagesUnavailable = packages, ""
+			}
+		}
+		result.Lock = lock
+		if m.isDryRun() {
+			return nil
+		}
+		return WriteLockFile(req.LockPath, lock)
+	}, func() error {
+		if m.isDryRun() {
+			return nil
+		}
+		return os.Remove(req.LockPath)
+	})
+}
@@ -0,0 +1,211 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+	"thatnerdjosh.com/devtools/pkg/partition"
+	"thatnerdjosh.com/devtools/pkg/udf"
+)
+
+// Filesystems of an ISO that the built-in readers understand.
+const (
+	FilesystemISO9660 = "iso9660"
+	FilesystemUDF     = "udf"
+)
+
+// disc is an ISO opened with the built-in readers. FS reads its richest
+// filesystem: ISO9660 when Rock Ridge gives it POSIX names and metadata,
+// otherwise UDF when the image has it, since the ISO9660 tree of UDF bridge
+// media is often empty or limited to Joliet names.
+type disc struct {
+	fs.FS
+	// filesystem names the filesystem FS reads.
+	filesystem string
+	// iso and udf are the volumes found; either may be nil.
+	iso   *iso9660.FS
+	udf   *udf.FS
+	r     io.ReaderAt
+	size  int64
+	close func() error
+	// warnings describes volumes found but not read, such as a damaged UDF
+	// side of a bridge image.
+	warnings []string
+}
+
+// openISO opens the ISO named name in fsys with the reader of its richest
+// filesystem.
+func openISO(fsys fs.FS, name string) (*disc, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("open %s: file does not support random access", name)
+	}
+	d := &disc{r: ra, close: f.Close}
+	if info, err := f.Stat(); err == nil {
+		d.size = info.Size()
+	}
+
+	iso, isoErr := iso9660.Open(ra)
+	if isoErr == nil {
+		d.iso = iso
+	}
+	vol, udfErr := udf.Open(ra)
+	if udfErr == nil {
+		d.udf = vol
+	}
+	switch {
+	case d.iso != nil && (iso.RockRidge() || d.udf == nil):
+		// Without Rock Ridge, ISO9660 still wins when UDF is missing, damaged
+		// or uses features the reader lacks.
+		d.FS, d.filesystem = iso, FilesystemISO9660
+		if udfErr != nil && !errors.Is(udfErr, udf.ErrNotUDF) {
+			d.warnings = append(d.warnings, fmt.Sprintf("%s: reading the ISO9660 tree, as the UDF volume cannot be read: %v", name, udfErr))
+		}
+	case d.udf != nil:
+		d.FS, d.filesystem = vol, FilesystemUDF
+	default:
+		f.Close()
+		err := isoErr
+		if !errors.Is(udfErr, udf.ErrNotUDF) {
+			err = udfErr
+		}
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// Close releases the ISO file.
+func (d *disc) Close() error {
+	return d.close()
+}
+
+// label returns the volume label, preferring the ISO9660 one that mount and
+// blkid report for bridge media.
+func (d *disc) label() string {
+	if d.iso != nil {
+		return d.iso.VolumeID()
+	}
+	return d.udf.VolumeID()
+}
+
+// filesystems describes each volume of the disc, such as
+// "iso9660 (Rock Ridge, Joliet)" or "udf 2.50".
+func (d *disc) filesystems() []string {
+	var out []string
+	if d.iso != nil {
+		var ext []string
+		if d.iso.RockRidge() {
+			ext = append(ext, "Rock Ridge")
+		}
+		if d.iso.Joliet() {
+			ext = append(ext, "Joliet")
+		}
+		desc := FilesystemISO9660
+		if len(ext) > 0 {
+			desc += " (" + strings.Join(ext, ", ") + ")"
+		}
+		out = append(out, desc)
+	}
+	if d.udf != nil {
+		rev := d.udf.Revision()
+		out = append(out, fmt.Sprintf("%s %x.%02x", FilesystemUDF, rev>>8, rev&0xFF))
+	}
+	return out
+}
+
+// mountType returns the filesystem type to mount iso with: "udf" when UDF is
+// the richer filesystem, since mount may otherwise pick the ISO9660 tree of a
+// bridge image, and empty to let mount detect it. ISOs the built-in readers
+// cannot open are left to mount too.
+func (m *Manager) mountType(iso ISOInfo) string {
+	d, err := openISO(m.fsys, iso.Name)
+	if err != nil {
+		return ""
+	}
+	defer d.Close()
+	if d.filesystem == FilesystemUDF {
+		return FilesystemUDF
+	}
+	return ""
+}
+
+// ISODetails describes an ISO as the built-in readers see it.
+type ISODetails struct {
+	ISO   ISOInfo
+	Size  int64
+	Label string
+	// Filesystems describes each filesystem found, such as
+	// "iso9660 (Rock Ridge, Joliet)" or "udf 2.50".
+	Filesystems []string
+	// Filesystem is the one ls, cat, find and extract read:
+	// FilesystemISO9660 or FilesystemUDF.
+	Filesystem string
+	// RootFS is the path of the live root filesystem image inside the ISO,
+	// or empty when it has none.
+	RootFS string
+	// Boot summarises how the ISO boots, such as
+	// "BIOS: isolinux, UEFI: grub EFI image", or is empty when it does not.
+	Boot string
+	// BootImages lists the El Torito boot catalog, the default entry first.
+	BootImages []BootImage
+	// Partitions is the hybrid partition table in the system area, or nil.
+	Partitions *partition.Table
+	// OS is the distribution the ISO holds, and OSDetected reports whether
+	// it was recognised rather than guessed as generic Linux.
+	OS         OSVariant
+	OSDetected bool
+	// Warnings describes problems that did not stop the ISO being read,
+	// such as a damaged UDF volume next to a usable ISO9660 tree.
+	Warnings []string
+}
+
+// Info inspects the chosen ISO without mounting it, bounded by the Inspect
+// timeout.
+func (m *Manager) Info(ctx context.Context, choice int) (ISODetails, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return ISODetails{}, err
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	return runBlocking(ctx, "inspect "+m.Path(iso), func() (ISODetails, error) {
+		d, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return ISODetails{}, err
+		}
+		defer d.Close()
+		details := ISODetails{
+			ISO:         iso,
+			Size:        d.size,
+			Label:       d.label(),
+			Filesystems: d.filesystems(),
+			Filesystem:  d.filesystem,
+			Warnings:    d.warnings,
+		}
+		for _, image := range rootfsImages {
+			if info, err := fs.Stat(d.FS, image); err == nil && info.Mode().IsRegular() {
+				details.RootFS = image
+				break
+			}
+		}
+		if details.BootImages, err = d.bootImages(); err != nil {
+			return ISODetails{}, err
+		}
+		details.Boot = bootSummary(details.BootImages)
+		details.OS, details.OSDetected = detectOS(d.FS, details.Label)
+		if details.Partitions, err = partition.Read(d.r); err != nil && !errors.Is(err, partition.ErrNoTable) {
+			return ISODetails{}, fmt.Errorf("read partition table of %s: %w", iso.Name, err)
+		}
+		return details, nil
+	})
+}
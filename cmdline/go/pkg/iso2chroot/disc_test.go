@@ -0,0 +1,220 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// windowsFiles is what the UDF volume of Windows media holds; its ISO9660
+// tree only carries a README.
+func windowsFiles() []isotest.File {
+	return []isotest.File{
+		isotest.Text("setup.exe", "MZ"),
+		isotest.Text("sources/install.wim", "MSWIM"),
+	}
+}
+
+func TestOpenISOPicksRicherFilesystem(t *testing.T) {
+	readme := []isotest.File{isotest.Text("README.TXT", "This disc contains a UDF file system.\n")}
+	tests := []struct {
+		name string
+		iso  isotest.ISO
+		want string
+		// file is a path only the chosen filesystem has.
+		file        string
+		filesystems string
+	}{
+		{
+			name:        "Rock Ridge with UDF",
+			iso:         isotest.ISO{RockRidge: true, Files: discFiles(), UDF: &isotest.UDF{Files: windowsFiles()}},
+			want:        FilesystemISO9660,
+			file:        "boot/grub/grub.cfg",
+			filesystems: "iso9660 (Rock Ridge), udf 1.02",
+		},
+		{
+			name:        "bridge",
+			iso:         isotest.ISO{Joliet: true, Files: readme, UDF: &isotest.UDF{Revision: isotest.UDF250, Files: windowsFiles()}},
+			want:        FilesystemUDF,
+			file:        "sources/install.wim",
+			filesystems: "iso9660 (Joliet), udf 2.50",
+		},
+		{
+			name:        "UDF only",
+			iso:         isotest.ISO{Files: windowsFiles(), UDF: &isotest.UDF{Revision: isotest.UDF201, Only: true}},
+			want:        FilesystemUDF,
+			file:        "sources/install.wim",
+			filesystems: "udf 2.01",
+		},
+		{
+			name:        "plain ISO9660",
+			iso:         isotest.ISO{Files: readme},
+			want:        FilesystemISO9660,
+			file:        "readme.txt",
+			filesystems: "iso9660",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.iso.VolumeID = "CCCOMA_X64FRE_EN-US_DV9"
+			isotest.WriteISO(t, dir, "disc.iso", tt.iso)
+			d, err := openISO(os.DirFS(dir), "disc.iso")
+			if err != nil {
+				t.Fatalf("openISO() error = %v", err)
+			}
+			defer d.Close()
+			if d.filesystem != tt.want {
+				t.Fatalf("filesystem = %q, want %q", d.filesystem, tt.want)
+			}
+			if _, err := d.Open(tt.file); err != nil {
+				t.Fatalf("Open(%s) error = %v", tt.file, err)
+			}
+			if got := strings.Join(d.filesystems(), ", "); got != tt.filesystems {
+				t.Fatalf("filesystems() = %q, want %q", got, tt.filesystems)
+			}
+			if label, err := volumeLabel(os.DirFS(dir), "disc.iso"); err != nil || label != "CCCOMA_X64FRE_EN-US_DV9" {
+				t.Fatalf("volumeLabel() = %q, %v", label, err)
+			}
+		})
+	}
+}
+
+func TestOpenISODamagedUDF(t *testing.T) {
+	dir := t.TempDir()
+	isotest.WriteISO(t, dir, "disc.iso", isotest.ISO{
+		VolumeID: "BRIDGE",
+		Joliet:   true,
+		Files:    []isotest.File{isotest.Text("README.TXT", "This disc contains a UDF file system.\n")},
+		UDF:      &isotest.UDF{Revision: isotest.UDF250, Files: windowsFiles()},
+	})
+	// Zero the first block of both volume descriptor sequences the anchor
+	// points to, so the UDF side is recognised but cannot be decoded.
+	name := filepath.Join(dir, "disc.iso")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const block = 2048
+	anchor := data[256*block:]
+	for _, off := range []int{20, 28} {
+		start := int(binary.LittleEndian.Uint32(anchor[off:])) * block
+		clear(data[start : start+block])
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := openISO(os.DirFS(dir), "disc.iso")
+	if err != nil {
+		t.Fatalf("openISO() error = %v", err)
+	}
+	defer d.Close()
+	if d.filesystem != FilesystemISO9660 || d.udf != nil {
+		t.Fatalf("filesystem = %q, udf = %v; want the ISO9660 tree alone", d.filesystem, d.udf)
+	}
+	if _, err := fs.Stat(d, "README.TXT"); err != nil {
+		t.Fatalf("Stat(README.TXT) error = %v", err)
+	}
+	if len(d.warnings) != 1 || !strings.Contains(d.warnings[0], "udf: corrupt image") {
+		t.Fatalf("warnings = %q", d.warnings)
+	}
+
+	manager := NewManager(dir)
+	var stdout, stderr bytes.Buffer
+	if code := RunCLI(manager, []string{"info", "1"}, &stdout, &stderr, CLIOptions{}); code != ExitOK {
+		t.Fatalf("info: exit %d, stderr %q", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Reading:          iso9660\n") || !strings.HasPrefix(stderr.String(), "iso2chroot: warning: disc.iso: reading the ISO9660 tree, as the UDF volume cannot be read: udf: corrupt image") {
+		t.Fatalf("info stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+// windowsLibrary is a UDF bridge ISO next to a Linux live ISO.
+func windowsLibrary() map[string]isotest.ISO {
+	return map[string]isotest.ISO{
+		"noble.iso": {RockRidge: true, Files: discFiles(), RootFS: osRelease("24.04")},
+		"win11.iso": {
+			VolumeID: "CCCOMA_X64FRE_EN-US_DV9",
+			Joliet:   true,
+			Files:    []isotest.File{isotest.Text("README.TXT", "This disc contains a UDF file system.\n")},
+			UDF:      &isotest.UDF{Revision: isotest.UDF250, Files: windowsFiles()},
+		},
+	}
+}
+
+func TestRunCLIInfo(t *testing.T) {
+	manager := newTestManager(t, windowsLibrary())
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := run("info", "2")
+	for _, want := range []string{
+		"Name:             win11.iso\n",
+		"Label:            CCCOMA_X64FRE_EN-US_DV9\n",
+		"Filesystems:      iso9660 (Joliet), udf 2.50\n",
+		"Reading:          udf\n",
+		"Root filesystem:  none\n",
+	} {
+		if code != ExitOK || !strings.Contains(out, want) {
+			t.Fatalf("info win11: exit %d, stdout %q, stderr %q; want %q", code, out, errOut, want)
+		}
+	}
+	code, out, _ = run("info", "1")
+	if code != ExitOK || !strings.Contains(out, "Reading:          iso9660\n") || !strings.Contains(out, "Root filesystem:  casper/filesystem.squashfs\n") {
+		t.Fatalf("info noble: exit %d, stdout %q", code, out)
+	}
+	if code, _, _ = run("info"); code != ExitUsage {
+		t.Fatalf("info without an ISO: exit %d, want %d", code, ExitUsage)
+	}
+
+	// ls-iso and extract read the UDF tree of the bridge image.
+	code, out, _ = run("ls-iso", "2", "sources")
+	if code != ExitOK || !strings.HasSuffix(out, " install.wim\n") {
+		t.Fatalf("ls-iso 2 sources: exit %d, stdout %q", code, out)
+	}
+	dest := filepath.Join(t.TempDir(), "win11")
+	if code, _, errOut = run("extract", "--no-progress", "2", dest); code != ExitOK {
+		t.Fatalf("extract win11: exit %d, stderr %q", code, errOut)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "sources/install.wim")); err != nil || string(data) != "MSWIM" {
+		t.Fatalf("extracted install.wim = %q, %v", data, err)
+	}
+}
+
+func TestDryRunMountsUDF(t *testing.T) {
+	manager := newTestManager(t, windowsLibrary())
+	for _, tt := range []struct {
+		iso  string
+		want string
+	}{
+		{"2", "sudo mount -t udf -o loop,ro "},
+		{"1", "sudo mount -o loop,ro "},
+	} {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, []string{"create", tt.iso}, &stdout, &stderr, CLIOptions{
+			MountDir: filepath.Join(t.TempDir(), "src"),
+			Stdin:    strings.NewReader(""),
+			DryRun:   true,
+		})
+		if code != ExitOK || !strings.Contains(stdout.String(), tt.want) {
+			t.Fatalf("create %s: exit %d, plan %q, stderr %q; want %q", tt.iso, code, stdout.String(), stderr.String(), tt.want)
+		}
+	}
+
+	recorder := NewRecorder()
+	recorder.MountLoop(context.Background(), "win11.iso", "/mnt", FilesystemUDF)
+	if got := recorder.Actions()[0].Args; strings.Join(got, " ") != "win11.iso /mnt udf" {
+		t.Fatalf("recorded args = %q", got)
+	}
+}
@@ -0,0 +1,126 @@
+package iso2chroot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Sentinel errors classify failures independently of their message. Every
+// error returned by the package that falls into one of these classes matches
+// it with errors.Is; the typed errors below carry the details.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrPermission       = errors.New("permission denied")
+	ErrAlreadyMounted   = errors.New("already mounted")
+	ErrBusy             = errors.New("busy")
+	ErrCancelled        = errors.New("cancelled")
+	ErrTimeout          = errors.New("timed out")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// NotFoundError reports a missing ISO, menu choice, instance or path inside an
+// ISO.
+type NotFoundError struct {
+	// Kind is "choice", "ISO", "instance", "path" or "boot entry".
+	Kind string
+	Name string
+	// Dir is the directory that was searched, if any.
+	Dir string
+}
+
+func (e *NotFoundError) Error() string {
+	switch {
+	case e.Kind == "choice":
+		return fmt.Sprintf("choice %s not available", e.Name)
+	case e.Dir != "":
+		return fmt.Sprintf("%s %q not found in %s", e.Kind, e.Name, e.Dir)
+	default:
+		return fmt.Sprintf("%s %q not found", e.Kind, e.Name)
+	}
+}
+
+func (e *NotFoundError) Is(target error) bool { return target == ErrNotFound }
+
+// PermissionError reports an operation refused for lack of privileges, such as
+// sudo asking for a password it cannot read.
+type PermissionError struct {
+	Op  string
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s: permission denied: %v", e.Op, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error { return e.Err }
+
+func (e *PermissionError) Is(target error) bool { return target == ErrPermission }
+
+// BusyError reports a mount that cannot be changed because it is in use.
+type BusyError struct {
+	Op  string
+	Err error
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s: target is busy: %v", e.Op, e.Err)
+}
+
+func (e *BusyError) Unwrap() error { return e.Err }
+
+func (e *BusyError) Is(target error) bool { return target == ErrBusy }
+
+// MismatchError reports build inputs that differ from those recorded in a lock file.
+type MismatchError struct {
+	// Diffs describes each differing input.
+	Diffs []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("inputs differ from lock file:\n  %s", strings.Join(e.Diffs, "\n  "))
+}
+
+func (e *MismatchError) Is(target error) bool { return target == ErrChecksumMismatch }
+
+func (e *MountpointError) Is(target error) bool { return target == ErrAlreadyMounted }
+
+func (e *LockedError) Is(target error) bool { return target == ErrBusy }
+
+// Exit statuses of mount(8) and umount(8). Status 1 covers incorrect
+// invocation and missing permissions; a failed umount is almost always a busy
+// target.
+const (
+	mountExitPermission = 1
+	mountExitFailure    = 32
+)
+
+// commandError wraps the failure of the privileged command name, classifying
+// it by how it failed. sudoErr is the result of checking that sudo itself can
+// run without a password, or nil when it can or was not checked. The output is
+// kept in the message only.
+func commandError(op, name string, err, sudoErr error, output string) error {
+	detail := err
+	if output = strings.TrimSpace(output); output != "" {
+		detail = fmt.Errorf("%w: %s", err, output)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return &PermissionError{Op: op, Err: detail}
+	case !errors.As(err, &exitErr):
+		return fmt.Errorf("%s: %w", op, detail)
+	case errors.As(sudoErr, new(*exec.ExitError)):
+		return &PermissionError{Op: op, Err: detail}
+	}
+	switch code := exitErr.ExitCode(); {
+	case (name == "mount" || name == "umount") && code == mountExitPermission:
+		return &PermissionError{Op: op, Err: detail}
+	case name == "umount" && code == mountExitFailure:
+		return &BusyError{Op: op, Err: detail}
+	default:
+		return fmt.Errorf("%s: %w", op, detail)
+	}
+}
@@ -0,0 +1,139 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, ExitOK},
+		{"generic", errors.New("boom"), ExitFailure},
+		{"system path", &SystemPathError{Path: "/usr"}, ExitUnsafeTarget},
+		{"mountpoint", &MountpointError{Path: "/mnt", Source: "/dev/sda1"}, ExitTargetMounted},
+		{"not found choice", &NotFoundError{Kind: "choice", Name: "9"}, ExitNotFound},
+		{"not found instance", fmt.Errorf("enter: %w", &NotFoundError{Kind: "instance", Name: "dev"}), ExitNotFound},
+		{"missing file", fmt.Errorf("read: %w", os.ErrNotExist), ExitNotFound},
+		{"permission", &PermissionError{Op: "mount ISO", Err: errors.New("exit status 1")}, ExitPermission},
+		{"os permission", fmt.Errorf("open: %w", os.ErrPermission), ExitPermission},
+		{"locked", &LockedError{Path: "/tmp/x", PID: 1}, ExitBusy},
+		{"umount busy", &BusyError{Op: "unmount", Err: errors.New("exit status 32")}, ExitBusy},
+		{"mismatch", &MismatchError{Diffs: []string{"iso sha256"}}, ExitMismatch},
+		{"cancelled", fmt.Errorf("before mount-iso-ro: %w", ErrCancelled), ExitCancelled},
+		{"rolled back cancel", &RollbackError{Err: fmt.Errorf("%w: %w", ErrCancelled, ErrBusy)}, ExitCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Fatalf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCodesDocumented(t *testing.T) {
+	var buf bytes.Buffer
+	WriteExitCodes(&buf)
+	for _, code := range []int{ExitOK, ExitFailure, ExitUsage, ExitUnsafeTarget, ExitTargetMounted,
+		ExitNotFound, ExitPermission, ExitBusy, ExitMismatch, ExitDeclined, ExitTimeout, ExitCancelled} {
+		if !strings.Contains(buf.String(), fmt.Sprintf("    %d ", code)) {
+			t.Fatalf("exit code %d missing from table:\n%s", code, buf.String())
+		}
+	}
+}
+
+func TestCommandErrorClassifies(t *testing.T) {
+	exit := func(code int) error {
+		return exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	}
+	tests := []struct {
+		name    string
+		err     error
+		sudoErr error
+		want    error
+	}{
+		{name: "mount", err: exit(1), want: ErrPermission},
+		{name: "umount", err: exit(1), want: ErrPermission},
+		{name: "umount", err: exit(32), want: ErrBusy},
+		{name: "mount", err: exit(32)},
+		{name: "rm", err: exit(1)},
+		{name: "rm", err: exit(1), sudoErr: exit(1), want: ErrPermission},
+		{name: "mount", err: &os.PathError{Op: "fork/exec", Path: "/usr/bin/sudo", Err: os.ErrPermission}, want: ErrPermission},
+		{name: "mount", err: errors.New("exec: \"sudo\": executable file not found in $PATH")},
+	}
+	for _, tt := range tests {
+		err := commandError("mount ISO", tt.name, tt.err, tt.sudoErr, "mount: /mnt: some diagnostic\n")
+		if !strings.HasPrefix(err.Error(), "mount ISO: ") {
+			t.Fatalf("commandError(%s, %v) = %q, want op prefix", tt.name, tt.err, err)
+		}
+		for _, sentinel := range []error{ErrPermission, ErrBusy} {
+			if got, want := errors.Is(err, sentinel), sentinel == tt.want; got != want {
+				t.Fatalf("errors.Is(commandError(%s, %v, %v), %v) = %v, want %v", tt.name, tt.err, tt.sudoErr, sentinel, got, want)
+			}
+		}
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("commandError(%s, %v) does not wrap the command error", tt.name, tt.err)
+		}
+	}
+}
+
+func TestManagerResolve(t *testing.T) {
+	manager, _ := newInstanceManager(t, "debian-12.iso", "ubuntu-22.04.iso", "ubuntu-24.04.iso")
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  error
+	}{
+		{selector: "1", want: "debian-12.iso"},
+		{selector: "3", want: "ubuntu-24.04.iso"},
+		{selector: "ubuntu-24.04.iso", wantErr: ErrNotFound},
+		{selector: "ubuntu", wantErr: ErrNotFound},
+		{selector: "9", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		_, iso, err := manager.Resolve(tt.selector)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("Resolve(%q) error = %v, want %v", tt.selector, err, tt.wantErr)
+		}
+		if iso.Name != tt.want {
+			t.Fatalf("Resolve(%q) = %q, want %q", tt.selector, iso.Name, tt.want)
+		}
+	}
+}
+
+func TestRunCLISelectExitCodes(t *testing.T) {
+	manager, _ := newInstanceManager(t, "ubuntu-22.04.iso", "ubuntu-24.04.iso")
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"select", "2"}, ExitOK},
+		{[]string{"select"}, ExitUsage},
+		{[]string{"select", "7"}, ExitNotFound},
+		{[]string{"select", "debian"}, ExitNotFound},
+		{[]string{"select", "ubuntu-22.04.iso"}, ExitNotFound},
+		{[]string{"destroy", "missing"}, ExitNotFound},
+		{[]string{"enter", "missing"}, ExitNotFound},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := RunCLI(manager, tt.args, &stdout, &stderr, CLIOptions{}); code != tt.want {
+			t.Fatalf("RunCLI(%v) exit code = %d, want %d (stderr %q)", tt.args, code, tt.want, stderr.String())
+		}
+	}
+}
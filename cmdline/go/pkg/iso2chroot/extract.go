@@ -0,0 +1,624 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"thatnerdjosh.com/devtools/internal/treefs"
+	"thatnerdjosh.com/devtools/pkg/initramfs"
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+	"thatnerdjosh.com/devtools/pkg/squashfs"
+	"thatnerdjosh.com/devtools/pkg/udf"
+)
+
+// ExtractOptions selects what Manager.Extract unpacks.
+type ExtractOptions struct {
+	// RootFS unpacks the live root filesystem inside the ISO instead of the
+	// files of the disc itself.
+	RootFS bool
+	// Paths limits extraction to these files and directory trees, given
+	// relative to the image root. They keep their full path under the
+	// destination.
+	Paths []string
+	// Include, when set, keeps only entries matching one of its patterns and
+	// everything below a matching directory. Exclude drops matching entries and
+	// everything below them, and wins over Include. Patterns use path.Match
+	// syntax: one without a slash matches an entry's base name, one with a
+	// slash its whole path.
+	Include []string
+	Exclude []string
+	// Progress, when set, is called as entries and file contents are written.
+	Progress func(ExtractProgress)
+}
+
+// ExtractProgress reports how far an extraction has come.
+type ExtractProgress struct {
+	// Path is the entry being written.
+	Path       string
+	Entries    int
+	Bytes      int64
+	TotalBytes int64
+}
+
+// ExtractResult summarises files unpacked from an image onto disk.
+type ExtractResult struct {
+	// Source is the image the files came from: the ISO's file name, or for its
+	// root filesystem the path of that image inside the ISO.
+	Source  string
+	Entries int
+	Bytes   int64
+	// Warnings lists what could not be reproduced, typically because it needs
+	// root: device nodes, ownership and privileged extended attributes.
+	Warnings []string
+}
+
+// Extract unpacks files from the chosen ISO into dst, creating it if needed,
+// without mounting anything. Entries that already exist in dst are not
+// overwritten; meeting one fails the extraction. Files written before a
+// failure, or before ctx ends, are left in place.
+func (m *Manager) Extract(ctx context.Context, choice int, dst string, opts ExtractOptions) (ExtractResult, error) {
+	if _, err := m.Select(choice); err != nil {
+		return ExtractResult{}, err
+	}
+	if m.isDryRun() {
+		return ExtractResult{}, errors.New("extract cannot be done as a dry run")
+	}
+	if err := validatePatterns(opts.Include, opts.Exclude); err != nil {
+		return ExtractResult{}, err
+	}
+
+	lock, err := m.lock(ctx, dst)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	defer lock.Release()
+
+	img, err := m.OpenImage(ctx, choice, opts.RootFS)
+	if err != nil {
+		return ExtractResult{}, err
+	}
+	defer img.Close()
+	for _, p := range opts.Paths {
+		if _, err := img.Lookup(p); err != nil {
+			return ExtractResult{}, err
+		}
+	}
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return ExtractResult{}, err
+	}
+	result, err := extractTree(ctx, img.FS, dst, opts)
+	result.Source = img.Source
+	return result, err
+}
+
+// validatePatterns reports the first pattern path.Match cannot parse.
+func validatePatterns(lists ...[]string) error {
+	for _, patterns := range lists {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanImagePath turns a user-supplied path inside an image into an fs.FS name.
+func cleanImagePath(p string) string {
+	p = strings.Trim(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// fileStat is the part of an image's FileInfo.Sys that extraction uses.
+type fileStat struct {
+	inode        uint64
+	nlink        uint32
+	uid, gid     uint32
+	major, minor uint32
+}
+
+// statOf returns the inode details of a file from one of the image readers.
+func statOf(info fs.FileInfo) (fileStat, bool) {
+	switch st := info.Sys().(type) {
+	case *squashfs.Stat:
+		return fileStat{uint64(st.Inode), st.Nlink, st.UID, st.GID, st.Major, st.Minor}, true
+	case *iso9660.Stat:
+		return fileStat{st.Inode, st.Nlink, st.UID, st.GID, st.Major, st.Minor}, true
+	case *udf.Stat:
+		return fileStat{st.Inode, st.Nlink, st.UID, st.GID, st.Major, st.Minor}, true
+	case *initramfs.Stat:
+		return fileStat{st.Inode, st.Nlink, st.UID, st.GID, st.Major, st.Minor}, true
+	}
+	return fileStat{}, false
+}
+
+// xattrFS is implemented by image readers that expose extended attributes.
+type xattrFS interface {
+	Xattrs(name string) ([]squashfs.Xattr, error)
+}
+
+// extractor copies a file tree out of an image, keeping what an unprivileged
+// process can keep and counting what it cannot.
+type extractor struct {
+	ctx  context.Context
+	src  fs.FS
+	dst  string
+	opts ExtractOptions
+	root bool
+	uid  int
+	gid  int
+
+	// done records the entries already written, so overlapping Paths are
+	// extracted once.
+	done map[string]bool
+	// pending holds directories not yet created because nothing below them
+	// may match Include.
+	pending map[string]fs.DirEntry
+	// links maps the inode of each extracted multiply-linked file to its path.
+	links map[uint64]string
+	// dirs holds directories in creation order; their modes and times are set
+	// last so read-only directories can still be filled.
+	dirs   []extractedDir
+	result ExtractResult
+	total  int64
+
+	skippedDevices int
+	skippedSockets int
+	skippedOwners  int
+	skippedXattrs  int
+}
+
+type extractedDir struct {
+	path string
+	info fs.FileInfo
+}
+
+// extractTree copies the files of src selected by opts into the existing
+// directory dst, preserving file types, permissions, modification times,
+// symlinks, hard links and extended attributes. Ownership and device nodes
+// are reproduced only when running as root; otherwise they are skipped and
+// reported in the result's warnings. The root directory of src lends dst
+// nothing. It stops when ctx ends.
+func extractTree(ctx context.Context, src fs.FS, dst string, opts ExtractOptions) (ExtractResult, error) {
+	x := &extractor{
+		ctx:     ctx,
+		src:     src,
+		dst:     dst,
+		opts:    opts,
+		root:    os.Geteuid() == 0,
+		uid:     os.Geteuid(),
+		gid:     os.Getegid(),
+		done:    map[string]bool{".": true},
+		pending: make(map[string]fs.DirEntry),
+		links:   make(map[uint64]string),
+	}
+	roots := []string{"."}
+	if len(opts.Paths) > 0 {
+		roots = roots[:0]
+		for _, p := range opts.Paths {
+			// Resolve symlinked parents inside the image, so the entry is
+			// written below real directories rather than through a link.
+			root, err := treefs.Resolve("extract", src, cleanImagePath(p))
+			if err != nil {
+				return x.result, err
+			}
+			roots = append(roots, root)
+		}
+	}
+	if opts.Progress != nil {
+		total, err := x.measure(roots)
+		if err != nil {
+			return x.result, err
+		}
+		x.total = total
+	}
+	for _, root := range roots {
+		if err := x.walk(root, x.extract); err != nil {
+			return x.result, err
+		}
+	}
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := x.finish(x.dirs[i].path, x.dirs[i].info); err != nil {
+			return x.result, err
+		}
+	}
+	x.warn()
+	return x.result, nil
+}
+
+// walk calls fn for every entry below root that the patterns select. A
+// directory that is not itself selected is passed to fn only once something
+// below it is, through ensureParents.
+func (x *extractor) walk(root string, fn func(name string, d fs.DirEntry) error) error {
+	// fs.WalkDir follows a symlink given as its root; extract the link itself.
+	if info, err := fs.Lstat(x.src, root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		if matchAny(x.opts.Exclude, root) || !x.included(root) {
+			return nil
+		}
+		return fn(root, fs.FileInfoToDirEntry(info))
+	}
+	return fs.WalkDir(x.src, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if x.ctx.Err() != nil {
+			return contextError("extract "+name, x.ctx)
+		}
+		if name != "." && matchAny(x.opts.Exclude, name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !x.included(name) {
+			if d.IsDir() {
+				x.pending[name] = d
+			}
+			return nil
+		}
+		return fn(name, d)
+	})
+}
+
+// included reports whether name or one of its parents matches Include.
+func (x *extractor) included(name string) bool {
+	if len(x.opts.Include) == 0 {
+		return true
+	}
+	for p := name; p != "."; p = path.Dir(p) {
+		if matchAny(x.opts.Include, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether name matches one of patterns. Patterns without a
+// slash match the base name only.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// measure returns the number of bytes extracting roots will write.
+func (x *extractor) measure(roots []string) (int64, error) {
+	var total int64
+	seen := make(map[uint64]bool)
+	counted := make(map[string]bool)
+	for _, root := range roots {
+		err := x.walk(root, func(name string, d fs.DirEntry) error {
+			if !d.Type().IsRegular() || counted[name] {
+				return nil
+			}
+			counted[name] = true
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if st, ok := statOf(info); ok && st.nlink > 1 {
+				if seen[st.inode] {
+					return nil
+				}
+				seen[st.inode] = true
+			}
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	clear(x.pending)
+	return total, nil
+}
+
+// ensureParents creates the directories above name that have not been
+// written yet, with the metadata they have in the image. Each must be a
+// directory there; extraction never writes below a symlink.
+func (x *extractor) ensureParents(name string) error {
+	var missing []string
+	for p := path.Dir(name); !x.done[p]; p = path.Dir(p) {
+		missing = append(missing, p)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		p := missing[i]
+		var (
+			info fs.FileInfo
+			err  error
+		)
+		if d, ok := x.pending[p]; ok {
+			info, err = d.Info()
+		} else {
+			info, err = fs.Lstat(x.src, p)
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return &fs.PathError{Op: "extract", Path: p, Err: treefs.ErrNotDir}
+		}
+		if err := x.extractEntry(p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extract(name string, d fs.DirEntry) error {
+	if x.done[name] {
+		return nil
+	}
+	if err := x.ensureParents(name); err != nil {
+		return err
+	}
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	return x.extractEntry(name, info)
+}
+
+func (x *extractor) extractEntry(name string, info fs.FileInfo) error {
+	x.done[name] = true
+	target := filepath.Join(x.dst, filepath.FromSlash(name))
+	st, _ := statOf(info)
+	mode := info.Mode()
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		if err := os.Mkdir(target, 0o700); err != nil {
+			if existing, statErr := os.Lstat(target); statErr == nil && existing.IsDir() {
+				// Leave directories that were already there as they are.
+				return nil
+			}
+			return err
+		}
+		x.dirs = append(x.dirs, extractedDir{target, info})
+		x.progressed(name)
+		return x.setOwnerAndXattrs(name, target, st)
+	case 0:
+		if st.nlink > 1 {
+			if first, ok := x.links[st.inode]; ok {
+				x.progressed(name)
+				return os.Link(first, target)
+			}
+			x.links[st.inode] = target
+		}
+		if err := x.copyFile(name, target); err != nil {
+			return err
+		}
+	case fs.ModeSymlink:
+		link, err := fs.ReadLink(x.src, name)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+	case fs.ModeNamedPipe:
+		if err := unix.Mkfifo(target, 0o600); err != nil {
+			return &fs.PathError{Op: "mkfifo", Path: target, Err: err}
+		}
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		if !x.root {
+			x.skippedDevices++
+			return nil
+		}
+		kind := uint32(unix.S_IFBLK)
+		if mode&fs.ModeCharDevice != 0 {
+			kind = unix.S_IFCHR
+		}
+		if err := unix.Mknod(target, kind|0o600, int(unix.Mkdev(st.major, st.minor))); err != nil {
+			return &fs.PathError{Op: "mknod", Path: target, Err: err}
+		}
+	default:
+		x.skippedSockets++
+		return nil
+	}
+	x.progressed(name)
+	if err := x.setOwnerAndXattrs(name, target, st); err != nil {
+		return err
+	}
+	return x.finish(target, info)
+}
+
+// progressed counts one written entry and reports it.
+func (x *extractor) progressed(name string) {
+	x.result.Entries++
+	x.report(name)
+}
+
+func (x *extractor) report(name string) {
+	if x.opts.Progress != nil {
+		x.opts.Progress(ExtractProgress{Path: name, Entries: x.result.Entries, Bytes: x.result.Bytes, TotalBytes: x.total})
+	}
+}
+
+func (x *extractor) copyFile(name, target string) error {
+	in, err := x.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFile(x.ctx, "extract "+name, target, 0o600, func(w io.Writer) error {
+		_, err := io.Copy(progressWriter{w: w, x: x, name: name}, in)
+		return err
+	})
+}
+
+// createFile creates the file dst, which must not exist, not even as a
+// symlink, with permissions perm and fills it with write, stopping once ctx
+// ends. A file that could not be written in full is removed, and the failure
+// is reported for op.
+func createFile(ctx context.Context, op, dst string, perm fs.FileMode, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, perm)
+	if err != nil {
+		return err
+	}
+	err = write(contextWriter{ctx: ctx, w: f})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		if ctx.Err() != nil {
+			return contextError(op, ctx)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// copyFileOut copies the file name of fsys to the new file dst; see
+// createFile.
+func copyFileOut(ctx context.Context, fsys fs.FS, name, dst string) error {
+	in, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFile(ctx, "extract "+name, dst, 0o644, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// progressWriter counts the bytes written for one file and reports them.
+type progressWriter struct {
+	w    io.Writer
+	x    *extractor
+	name string
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.x.result.Bytes += int64(n)
+	p.x.report(p.name)
+	return n, err
+}
+
+// setOwnerAndXattrs applies ownership and extended attributes. Both come
+// before permissions because changing the owner clears set-user-ID bits and
+// file capabilities.
+func (x *extractor) setOwnerAndXattrs(name, target string, st fileStat) error {
+	if x.root {
+		if err := os.Lchown(target, int(st.uid), int(st.gid)); err != nil {
+			return err
+		}
+	} else if int(st.uid) != x.uid || int(st.gid) != x.gid {
+		x.skippedOwners++
+	}
+
+	xfs, ok := x.src.(xattrFS)
+	if !ok {
+		return nil
+	}
+	attrs, err := xfs.Xattrs(name)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		err := unix.Lsetxattr(target, attr.Name, attr.Value, 0)
+		switch {
+		case err == nil:
+		case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES), errors.Is(err, unix.ENOTSUP):
+			x.skippedXattrs++
+		default:
+			return &fs.PathError{Op: "setxattr " + attr.Name, Path: target, Err: err}
+		}
+	}
+	return nil
+}
+
+// finish applies the permissions and modification time of info to target.
+func (x *extractor) finish(target string, info fs.FileInfo) error {
+	mtime := unix.NsecToTimespec(info.ModTime().UnixNano())
+	if info.Mode().Type() == fs.ModeSymlink {
+		ts := []unix.Timespec{mtime, mtime}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &fs.PathError{Op: "utimes", Path: target, Err: err}
+		}
+		return nil
+	}
+	if err := os.Chmod(target, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// warn records what the extraction skipped.
+func (x *extractor) warn() {
+	if x.skippedDevices > 0 {
+		x.result.Warnings = append(x.result.Warnings, fmt.Sprintf("skipped %d device nodes: creating them needs root", x.skippedDevices))
+	}
+	if x.skippedSockets > 0 {
+		x.result.Warnings = append(x.result.Warnings, fmt.Sprintf("skipped %d sockets", x.skippedSockets))
+	}
+	if x.skippedOwners > 0 {
+		x.result.Warnings = append(x.result.Warnings, fmt.Sprintf("%d entries are owned by the current user instead of their recorded owner: changing owners needs root", x.skippedOwners))
+	}
+	if x.skippedXattrs > 0 {
+		x.result.Warnings = append(x.result.Warnings, fmt.Sprintf("skipped %d extended attributes the current user or filesystem cannot set", x.skippedXattrs))
+	}
+}
+
+// removeExtracted deletes an extracted tree, first making its directories
+// writable so read-only ones can be emptied.
+func removeExtracted(dir string) error {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// openRootFS opens the live root filesystem image inside disc, the ISO named
+// name, returning it with its path inside the ISO.
+func openRootFS(disc fs.FS, name string) (*squashfs.FS, string, error) {
+	for _, image := range rootfsImages {
+		info, err := fs.Stat(disc, image)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		img, err := disc.Open(image)
+		if err != nil {
+			return nil, "", fmt.Errorf("open %s in %s: %w", image, name, err)
+		}
+		ra, ok := img.(io.ReaderAt)
+		if !ok {
+			img.Close()
+			return nil, "", fmt.Errorf("open %s in %s: file does not support random access", image, name)
+		}
+		rootfs, err := squashfs.Open(ra)
+		if err != nil {
+			return nil, "", fmt.Errorf("read %s in %s: %w", image, name, err)
+		}
+		return rootfs, image, nil
+	}
+	return nil, "", fmt.Errorf("%s has no live root filesystem image (looked for %s): %w", name, strings.Join(rootfsImages, ", "), ErrNotFound)
+}
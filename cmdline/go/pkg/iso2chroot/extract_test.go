@@ -0,0 +1,442 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/pkg/squashfs"
+	"thatnerdjosh.com/devtools/pkg/tui"
+)
+
+var rootfsTime = time.Date(2024, 4, 23, 10, 0, 0, 0, time.UTC)
+
+// liveRootFS is a small live root filesystem with a dpkg database.
+func liveRootFS() *isotest.Squashfs {
+	return &isotest.Squashfs{
+		Compression: isotest.Xz,
+		Fragments:   true,
+		ModTime:     rootfsTime,
+		Files: []isotest.File{
+			isotest.Text("etc/hostname", "ubuntu\n"),
+			{Path: dpkgStatusPath, Data: []byte("Package: bash\nStatus: install ok installed\nVersion: 5.2.21-2ubuntu4\n\n"), Mode: 0o644},
+			{Path: "usr/bin/busybox", Data: bytes.Repeat([]byte("busybox"), 5000), Mode: 0o755, ModTime: rootfsTime},
+			isotest.HardLink("usr/bin/sh", "usr/bin/busybox"),
+			isotest.Symlink("bin", "usr/bin"),
+			{Path: "usr/bin/passwd", Data: []byte("passwd"), Mode: 0o755 | fs.ModeSetuid},
+			{Path: "usr/share/readonly", Mode: fs.ModeDir | 0o555},
+			isotest.Text("usr/share/readonly/file", "inside a read-only directory"),
+			{Path: "dev/null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Major: 1, Minor: 3},
+			{Path: "run/initctl", Mode: fs.ModeNamedPipe | 0o600},
+			{Path: "home/ubuntu/notes", Data: []byte("notes"), UID: 1000, GID: 1000,
+				Xattrs: map[string]string{"user.origin": "skel"}},
+		},
+	}
+}
+
+func TestExtractTree(t *testing.T) {
+	data, err := liveRootFS().Bytes()
+	if err != nil {
+		t.Fatalf("generate squashfs: %v", err)
+	}
+	src, err := squashfs.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("squashfs.Open() error = %v", err)
+	}
+	dst := t.TempDir()
+
+	result, err := extractTree(context.Background(), src, dst, ExtractOptions{})
+	if err != nil {
+		t.Fatalf("extractTree() error = %v", err)
+	}
+	if result.Bytes != int64(5000*len("busybox")+len("passwd")+len("notes")+len("ubuntu\n")+len("inside a read-only directory"))+int64(len("Package: bash\nStatus: install ok installed\nVersion: 5.2.21-2ubuntu4\n\n")) {
+		t.Fatalf("Bytes = %d", result.Bytes)
+	}
+
+	busybox := filepath.Join(dst, "usr/bin/busybox")
+	info, err := os.Lstat(busybox)
+	if err != nil {
+		t.Fatalf("Lstat(busybox) error = %v", err)
+	}
+	if info.Mode() != 0o755 || !info.ModTime().Equal(rootfsTime) {
+		t.Fatalf("busybox mode %v mtime %v", info.Mode(), info.ModTime())
+	}
+	if sh, err := os.Lstat(filepath.Join(dst, "usr/bin/sh")); err != nil || !os.SameFile(info, sh) {
+		t.Fatalf("usr/bin/sh is not a hard link to busybox: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "bin")); err != nil || target != "usr/bin" {
+		t.Fatalf("Readlink(bin) = %q, %v", target, err)
+	}
+	srcLink, _ := src.Lstat("bin")
+	if link, err := os.Lstat(filepath.Join(dst, "bin")); err != nil || !link.ModTime().Equal(srcLink.ModTime()) {
+		t.Fatalf("symlink mtime = %v, %v; want %v", link.ModTime(), err, srcLink.ModTime())
+	}
+	if info, err := os.Stat(filepath.Join(dst, "usr/bin/passwd")); err != nil || info.Mode() != 0o755|fs.ModeSetuid {
+		t.Fatalf("passwd mode = %v, %v", info.Mode(), err)
+	}
+	srcDir, _ := src.Stat("usr/share/readonly")
+	if info, err := os.Stat(filepath.Join(dst, "usr/share/readonly")); err != nil || info.Mode() != fs.ModeDir|0o555 || !info.ModTime().Equal(srcDir.ModTime()) {
+		t.Fatalf("read-only dir = %v, %v", info, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "usr/share/readonly/file")); err != nil || string(data) != "inside a read-only directory" {
+		t.Fatalf("file in read-only dir = %q, %v", data, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "run/initctl")); err != nil || info.Mode().Type() != fs.ModeNamedPipe {
+		t.Fatalf("run/initctl = %v, %v; want a named pipe", info, err)
+	}
+
+	warnings := strings.Join(result.Warnings, "\n")
+	if os.Geteuid() == 0 {
+		info, err := os.Lstat(filepath.Join(dst, "dev/null"))
+		if err != nil || info.Mode().Type() != fs.ModeDevice|fs.ModeCharDevice {
+			t.Fatalf("dev/null = %v, %v; want a character device when extracting as root", info, err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); unix.Major(st.Rdev) != 1 || unix.Minor(st.Rdev) != 3 {
+			t.Fatalf("dev/null device %d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+		}
+		if st := mustLstat(t, filepath.Join(dst, "home/ubuntu/notes")).Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+			t.Fatalf("notes owner %d:%d", st.Uid, st.Gid)
+		}
+	} else {
+		if _, err := os.Lstat(filepath.Join(dst, "dev/null")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("dev/null extracted without root: %v", err)
+		}
+		if !strings.Contains(warnings, "skipped 1 device nodes") || !strings.Contains(warnings, "owned by the current user") {
+			t.Fatalf("Warnings = %q, want skipped device and ownership", result.Warnings)
+		}
+	}
+
+	value := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(dst, "home/ubuntu/notes"), "user.origin", value)
+	switch {
+	case errors.Is(err, unix.ENOTSUP):
+		if !strings.Contains(warnings, "extended attributes") {
+			t.Fatalf("Warnings = %q, want skipped extended attributes", result.Warnings)
+		}
+	case err != nil || string(value[:n]) != "skel":
+		t.Fatalf("user.origin = %q, %v", value[:n], err)
+	}
+}
+
+func TestExtractTreeSymlinkedParents(t *testing.T) {
+	// evil points at a host directory by absolute path; inside the image that
+	// names the image's own copy of the directory.
+	outside := t.TempDir()
+	inImage := strings.TrimPrefix(outside, "/")
+	data, err := (&isotest.Squashfs{Files: []isotest.File{
+		isotest.Symlink("evil", outside),
+		isotest.Text(inImage+"/pwned", "inside the image"),
+		isotest.Symlink("lib", "usr/lib"),
+		isotest.Text("usr/lib/os-release", "ID=fedora\n"),
+	}}).Bytes()
+	if err != nil {
+		t.Fatalf("generate squashfs: %v", err)
+	}
+	src, err := squashfs.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("squashfs.Open() error = %v", err)
+	}
+	dst := t.TempDir()
+
+	if _, err := extractTree(context.Background(), src, dst, ExtractOptions{Paths: []string{"evil/pwned", "lib/os-release"}}); err != nil {
+		t.Fatalf("extractTree() error = %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("extraction wrote outside the destination: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, inImage, "pwned")); err != nil || string(data) != "inside the image" {
+		t.Fatalf("%s/pwned = %q, %v", inImage, data, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "usr/lib")); err != nil || !info.IsDir() {
+		t.Fatalf("usr/lib = %v, %v; want a directory", info, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "usr/lib/os-release")); err != nil || string(data) != "ID=fedora\n" {
+		t.Fatalf("usr/lib/os-release = %q, %v", data, err)
+	}
+	for _, link := range []string{"evil", "lib"} {
+		if _, err := os.Lstat(filepath.Join(dst, link)); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s was extracted as a parent: %v", link, err)
+		}
+	}
+}
+
+func mustLstat(t *testing.T, path string) fs.FileInfo {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestRunCLICreateExtract(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {VolumeID: "Ubuntu 24.04", RockRidge: true, RootFS: liveRootFS()}})
+	base := t.TempDir()
+	src := filepath.Join(base, "root")
+	var stdout, stderr bytes.Buffer
+
+	code := RunCLI(manager, []string{"create", "--extract", "1"}, &stdout, &stderr, CLIOptions{MountDir: src, Prompter: tui.NoInput{}})
+	if code != ExitOK {
+		t.Fatalf("RunCLI() exit code = %d, stderr = %q", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Extracted casper/filesystem.squashfs from noble.iso to "+src) {
+		t.Fatalf("stdout = %q", stdout.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(src, "etc/hostname")); err != nil || string(data) != "ubuntu\n" {
+		t.Fatalf("etc/hostname = %q, %v", data, err)
+	}
+	if calls := manager.mounter.(*fakeMounter).Calls(); len(calls) != 0 {
+		t.Fatalf("privileged calls = %q, want none", calls)
+	}
+
+	lock, err := ReadLockFile(DefaultLockPath(src))
+	if err != nil {
+		t.Fatalf("ReadLockFile() error = %v", err)
+	}
+	if strings.Join(lock.Steps, ",") != "prepare-mount-dir,extract-rootfs" {
+		t.Fatalf("lock steps = %q", lock.Steps)
+	}
+	if len(lock.Packages) != 1 || lock.Packages[0] != (LockPackage{Name: "bash", Version: "5.2.21-2ubuntu4"}) {
+		t.Fatalf("lock packages = %+v", lock.Packages)
+	}
+
+	// The lock file alone recreates the extracted tree elsewhere.
+	again := filepath.Join(base, "again")
+	stdout.Reset()
+	stderr.Reset()
+	code = RunCLI(manager, []string{"create", "--from-lock", DefaultLockPath(src)}, &stdout, &stderr, CLIOptions{MountDir: again, Prompter: tui.NoInput{}})
+	if code != ExitOK {
+		t.Fatalf("create --from-lock exit code = %d, stderr = %q", code, stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(again, "usr/bin/busybox")); err != nil {
+		t.Fatalf("from-lock extraction missing busybox: %v", err)
+	}
+
+	// A lock recording another version of a package is refused.
+	lock.Packages[0].Version = "5.2.21-2ubuntu3"
+	stale := filepath.Join(base, "stale.lock")
+	if err := WriteLockFile(stale, lock); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	stderr.Reset()
+	code = RunCLI(manager, []string{"create", "--from-lock", stale}, &stdout, &stderr, CLIOptions{MountDir: filepath.Join(base, "stale"), Prompter: tui.NoInput{}})
+	if code != ExitMismatch || !strings.Contains(stderr.String(), `package bash: lock has "5.2.21-2ubuntu3", found "5.2.21-2ubuntu4"`) {
+		t.Fatalf("create --from-lock of a stale lock exit code = %d, stderr = %q", code, stderr.String())
+	}
+}
+
+func TestRunCLICreateExtractRefusals(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, RootFS: liveRootFS()}})
+
+	occupied := t.TempDir()
+	if err := os.WriteFile(filepath.Join(occupied, "keep"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--extract", "1"}, &stdout, &stderr, CLIOptions{MountDir: occupied})
+	if code != ExitFailure || !strings.Contains(stderr.String(), "not empty") {
+		t.Fatalf("extract into non-empty dir: exit %d, stderr %q", code, stderr.String())
+	}
+	if entries, _ := os.ReadDir(occupied); len(entries) != 1 {
+		t.Fatalf("non-empty target changed: %v", entries)
+	}
+
+	stderr.Reset()
+	code = RunCLI(manager, []string{"create", "--extract", "--name", "noble", "1"}, &stdout, &stderr, CLIOptions{MountDir: t.TempDir()})
+	if code != ExitUsage {
+		t.Fatalf("--extract with --name exit code = %d, want %d", code, ExitUsage)
+	}
+
+	stderr.Reset()
+	code = RunCLI(manager, []string{"create", "--extract", "1"}, &stdout, &stderr, CLIOptions{MountDir: t.TempDir(), DryRun: true})
+	if code != ExitUsage || !strings.Contains(stderr.String(), "--dry-run") {
+		t.Fatalf("--extract with --dry-run: exit %d, stderr %q", code, stderr.String())
+	}
+
+	bare := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, Files: []isotest.File{isotest.Text("README", "no rootfs")}}})
+	target := filepath.Join(t.TempDir(), "root")
+	stderr.Reset()
+	code = RunCLI(bare, []string{"create", "--extract", "1"}, &stdout, &stderr, CLIOptions{MountDir: target})
+	if code != ExitNotFound || !strings.Contains(stderr.String(), "no live root filesystem image") {
+		t.Fatalf("ISO without rootfs: exit %d, stderr %q", code, stderr.String())
+	}
+	if _, err := os.Stat(target); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("rollback left %s behind: %v", target, err)
+	}
+}
+
+func TestCreateExtractCancelledRollsBack(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, RootFS: liveRootFS()}})
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "root")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := manager.Create(ctx, CreateRequest{Choice: 1, MountDir: target, Extract: true})
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("Create() error = %v, want ErrCancelled", err)
+	}
+	if _, err := os.Stat(target); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("cancelled extraction left %s behind: %v", target, err)
+	}
+}
+
+// discFiles is the disc layout around the live root filesystem.
+func discFiles() []isotest.File {
+	return []isotest.File{
+		isotest.Text("README.diskdefines", "#define DISKNAME Ubuntu 24.04\n"),
+		{Path: "casper/vmlinuz", Data: bytes.Repeat([]byte("kernel"), 1000), Mode: 0o644, ModTime: rootfsTime},
+		isotest.Text("boot/grub/grub.cfg", "menuentry \"Try Ubuntu\" {}\n"),
+		isotest.Text("boot/grub/font.pf2", "font"),
+		isotest.Symlink("ubuntu", "."),
+	}
+}
+
+func TestManagerExtract(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, Files: discFiles(), RootFS: liveRootFS()}})
+	ctx := context.Background()
+	if _, err := manager.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "disc")
+	var last ExtractProgress
+	result, err := manager.Extract(ctx, 1, dst, ExtractOptions{
+		Paths:    []string{"boot", "casper/vmlinuz", "ubuntu"},
+		Exclude:  []string{"*.pf2"},
+		Progress: func(p ExtractProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if result.Source != "noble.iso" {
+		t.Fatalf("Source = %q", result.Source)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "casper/vmlinuz")); err != nil || info.Mode() != 0o644 || !info.ModTime().Equal(rootfsTime) {
+		t.Fatalf("casper/vmlinuz = %v, %v", info, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "boot/grub/grub.cfg")); err != nil || string(data) != "menuentry \"Try Ubuntu\" {}\n" {
+		t.Fatalf("grub.cfg = %q, %v", data, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "ubuntu")); err != nil || target != "." {
+		t.Fatalf("Readlink(ubuntu) = %q, %v; want the symlink itself", target, err)
+	}
+	for _, skipped := range []string{"boot/grub/font.pf2", "README.diskdefines", "casper/filesystem.squashfs"} {
+		if _, err := os.Lstat(filepath.Join(dst, skipped)); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s extracted: %v", skipped, err)
+		}
+	}
+	if last.TotalBytes != result.Bytes || last.Bytes != result.Bytes || last.Entries != result.Entries {
+		t.Fatalf("last progress = %+v, result = %+v", last, result)
+	}
+
+	// Include keeps matching trees and the directories leading to them.
+	root := filepath.Join(t.TempDir(), "root")
+	result, err = manager.Extract(ctx, 1, root, ExtractOptions{RootFS: true, Include: []string{"usr/bin", "hostname"}, Exclude: []string{"passwd"}})
+	if err != nil {
+		t.Fatalf("Extract(RootFS) error = %v", err)
+	}
+	if result.Source != "casper/filesystem.squashfs" {
+		t.Fatalf("Source = %q", result.Source)
+	}
+	var got []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if rel, _ := filepath.Rel(root, path); rel != "." {
+			got = append(got, rel)
+		}
+		return err
+	})
+	if want := "etc,etc/hostname,usr,usr/bin,usr/bin/busybox,usr/bin/sh"; strings.Join(got, ",") != want {
+		t.Fatalf("extracted %q, want %q", got, want)
+	}
+	srcDir, _ := fs.Stat(liveRootFSImage(t), "usr/bin")
+	if info, err := os.Stat(filepath.Join(root, "usr/bin")); err != nil || !info.ModTime().Equal(srcDir.ModTime()) {
+		t.Fatalf("usr/bin = %v, %v; want the image's mtime", info, err)
+	}
+
+	if _, err := manager.Extract(ctx, 1, t.TempDir(), ExtractOptions{Paths: []string{"casper/missing"}}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Extract(missing path) error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Extract(ctx, 1, t.TempDir(), ExtractOptions{Include: []string{"["}}); err == nil {
+		t.Fatal("Extract(bad pattern) succeeded")
+	}
+	// Existing files are never overwritten.
+	if _, err := manager.Extract(ctx, 1, dst, ExtractOptions{Paths: []string{"casper/vmlinuz"}}); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Extract over existing file error = %v, want ErrExist", err)
+	}
+}
+
+// liveRootFSImage opens liveRootFS with the squashfs reader.
+func liveRootFSImage(t *testing.T) *squashfs.FS {
+	t.Helper()
+	data, err := liveRootFS().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := squashfs.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestRunCLIExtract(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, Files: discFiles(), RootFS: liveRootFS()}})
+	dst := filepath.Join(t.TempDir(), "root")
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"extract", "--rootfs", "1", dst, "etc", "--exclude", "status"}, &stdout, &stderr, CLIOptions{})
+	if code != ExitOK {
+		t.Fatalf("RunCLI() exit code = %d, stderr = %q", code, stderr.String())
+	}
+	if want := "Extracted casper/filesystem.squashfs from noble.iso to " + dst + " (2 entries, 7 B)\n"; stdout.String() != want {
+		t.Fatalf("stdout = %q, want %q", stdout.String(), want)
+	}
+	if calls := manager.mounter.(*fakeMounter).Calls(); len(calls) != 0 {
+		t.Fatalf("privileged calls = %q, want none", calls)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		opts CLIOptions
+		code int
+	}{
+		{[]string{"extract", "1"}, CLIOptions{}, ExitUsage},
+		{[]string{"extract", "--include", "[", "1", t.TempDir()}, CLIOptions{}, ExitUsage},
+		{[]string{"extract", "1", t.TempDir()}, CLIOptions{DryRun: true}, ExitUsage},
+		{[]string{"extract", "1", t.TempDir(), "no/such/path"}, CLIOptions{}, ExitNotFound},
+		{[]string{"extract", "9", t.TempDir()}, CLIOptions{}, ExitNotFound},
+	} {
+		stderr.Reset()
+		if code := RunCLI(manager, tc.args, &stdout, &stderr, tc.opts); code != tc.code {
+			t.Errorf("RunCLI(%q) exit code = %d, want %d; stderr = %q", tc.args, code, tc.code, stderr.String())
+		}
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	for _, tc := range []struct {
+		progress ExtractProgress
+		want     string
+	}{
+		{ExtractProgress{Entries: 3, Bytes: 512}, "3 entries, 512 B"},
+		{ExtractProgress{Entries: 10, Bytes: 1536, TotalBytes: 3 << 20}, "10 entries, 1.5 KiB of 3.0 MiB (0%)"},
+		{ExtractProgress{Entries: 99, Bytes: 3 << 29, TotalBytes: 3 << 30}, "99 entries, 1.5 GiB of 3.0 GiB (50%)"},
+	} {
+		if got := formatProgress(tc.progress); got != tc.want {
+			t.Errorf("formatProgress(%+v) = %q, want %q", tc.progress, got, tc.want)
+		}
+	}
+}
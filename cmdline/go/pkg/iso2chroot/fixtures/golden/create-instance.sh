@@ -0,0 +1,8 @@
+mkdir -p $ROOT/dev/iso
+mkdir -p $ROOT/dev/lower
+mkdir -p $ROOT/dev/upper
+mkdir -p $ROOT/dev/work
+mkdir -p $ROOT/dev/root
+sudo mount -o loop,ro $ISOS/b.iso $ROOT/dev/iso
+sudo mount --bind -o ro $ROOT/dev/iso $ROOT/dev/lower
+sudo mount -t overlay overlay -o lowerdir=$ROOT/dev/lower,upperdir=$ROOT/dev/upper,workdir=$ROOT/dev/work $ROOT/dev/root
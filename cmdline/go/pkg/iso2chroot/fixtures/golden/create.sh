@@ -0,0 +1,2 @@
+mkdir -p $SRC
+sudo mount -o loop,ro $ISOS/a.iso $SRC
@@ -0,0 +1,4 @@
+sudo umount $ROOT/dev/root
+sudo umount $ROOT/dev/lower
+sudo umount $ROOT/dev/iso
+sudo rm -rf --one-file-system -- $ROOT/dev
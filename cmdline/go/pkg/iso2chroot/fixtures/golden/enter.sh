@@ -0,0 +1 @@
+sudo chroot $ROOT/dev/root /usr/bin/env LANG=C 'dpkg -l'
@@ -0,0 +1,130 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const lockPollInterval = 50 * time.Millisecond
+
+// LockedError reports that another process holds the advisory lock on a path.
+type LockedError struct {
+	Path    string
+	PID     int
+	Command string
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked by another iso2chroot process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by PID %d (%s)", e.Path, e.PID, e.Command)
+}
+
+// pathLock is an advisory flock held on behalf of a path.
+type pathLock struct {
+	file *os.File
+	path string
+}
+
+// lockFilePath returns the hidden sidecar file used to lock target.
+func lockFilePath(target string) string {
+	target = filepath.Clean(target)
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".flock")
+}
+
+// acquireLock takes an exclusive advisory lock on target, polling for up to wait
+// before giving up with a *LockedError naming the current holder. Waiting also
+// stops when ctx ends.
+func acquireLock(ctx context.Context, target string, wait time.Duration) (*pathLock, error) {
+	path := lockFilePath(target)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("prepare lock dir: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open lock %s: %w", path, err)
+		}
+		if err := flockUntil(ctx, f, target, path, deadline); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Release removes the sidecar, so the file locked here may have been
+		// unlinked by the previous holder; lock the one now at path instead.
+		if current(f, path) {
+			owner := fmt.Sprintf("%d %s\n", os.Getpid(), strings.Join(os.Args, " "))
+			if err := f.Truncate(0); err == nil {
+				f.WriteAt([]byte(owner), 0)
+			}
+			return &pathLock{file: f, path: path}, nil
+		}
+		f.Close()
+	}
+}
+
+// flockUntil locks f, polling until deadline or the end of ctx.
+func flockUntil(ctx context.Context, f *os.File, target, path string, deadline time.Time) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			return fmt.Errorf("lock %s: %w", target, err)
+		}
+		if !time.Now().Before(deadline) {
+			return lockHolder(target, path)
+		}
+		select {
+		case <-ctx.Done():
+			return contextError("wait for lock on "+target, ctx)
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// current reports whether f is still the file at path.
+func current(f *os.File, path string) bool {
+	held, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	onDisk, err := os.Stat(path)
+	return err == nil && os.SameFile(held, onDisk)
+}
+
+// Release removes the sidecar file and drops the lock. It is safe to call on
+// a nil lock.
+func (l *pathLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	os.Remove(l.path)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
+
+func lockHolder(target, path string) error {
+	lockErr := &LockedError{Path: target}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lockErr
+	}
+	pid, command, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if n, err := strconv.Atoi(pid); err == nil {
+		lockErr.PID = n
+		lockErr.Command = command
+	}
+	return lockErr
+}
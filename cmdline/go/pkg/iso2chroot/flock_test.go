@@ -0,0 +1,153 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockReportsHolder(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "instance")
+
+	held, err := acquireLock(context.Background(), target, 0)
+	if err != nil {
+		t.Fatalf("acquireLock(context.Background(), ) error = %v", err)
+	}
+
+	_, err = acquireLock(context.Background(), target, 2*lockPollInterval)
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("acquireLock(context.Background(), ) error = %v, want *LockedError", err)
+	}
+	if locked.PID != os.Getpid() || !strings.Contains(locked.Command, os.Args[0]) {
+		t.Fatalf("LockedError = %+v, want PID %d running %s", locked, os.Getpid(), os.Args[0])
+	}
+
+	held.Release()
+	again, err := acquireLock(context.Background(), target, 0)
+	if err != nil {
+		t.Fatalf("acquireLock(context.Background(), ) after release error = %v", err)
+	}
+	again.Release()
+	if _, err := os.Stat(lockFilePath(target)); !os.IsNotExist(err) {
+		t.Fatalf("released lock left %s behind: %v", lockFilePath(target), err)
+	}
+}
+
+// sharedInstanceManager returns a manager that acts like another process
+// working against the same ISO directory, instance root and mounter.
+func sharedInstanceManager(base *Manager, mounter Mounter) *Manager {
+	manager := NewManager(base.Directory())
+	manager.SetInstanceRoot(base.InstanceRoot())
+	manager.mounter = mounter
+	return manager
+}
+
+func TestRunCLIConcurrentCreateSameInstanceFailsFast(t *testing.T) {
+	base, mounter := newInstanceManager(t, "a.iso")
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	mounter.onMount = func(op, target string) {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+	}
+
+	var (
+		wg        sync.WaitGroup
+		firstCode int
+		firstErr  bytes.Buffer
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var stdout bytes.Buffer
+		firstCode = RunCLI(sharedInstanceManager(base, mounter), []string{"create", "--name", "dev", "1"}, &stdout, &firstErr, CLIOptions{
+			Stdin: strings.NewReader("\n"),
+		})
+	}()
+	<-entered
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(sharedInstanceManager(base, mounter), []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin: strings.NewReader("\n"),
+	})
+	close(release)
+	wg.Wait()
+
+	if firstCode != 0 {
+		t.Fatalf("first create exit code = %d, want 0 (stderr %q)", firstCode, firstErr.String())
+	}
+	if code != ExitBusy {
+		t.Fatalf("second create exit code = %d, want %d", code, ExitBusy)
+	}
+	if want := fmt.Sprintf("locked by PID %d", os.Getpid()); !strings.Contains(stderr.String(), want) {
+		t.Fatalf("stderr = %q, want %q", stderr.String(), want)
+	}
+}
+
+func TestRunCLIConcurrentCreateWaitsForLock(t *testing.T) {
+	base, mounter := newInstanceManager(t, "a.iso")
+	mounter.onMount = func(op, target string) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	names := []string{"dev", "dev", "qa", "ci"}
+	codes := make([]int, len(names))
+	stderrs := make([]bytes.Buffer, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			manager := sharedInstanceManager(base, mounter)
+			manager.SetLockWait(10 * time.Second)
+			var stdout bytes.Buffer
+			codes[i] = RunCLI(manager, []string{"create", "--name", name, "1"}, &stdout, &stderrs[i], CLIOptions{
+				Stdin: strings.NewReader("\n"),
+			})
+		}()
+	}
+	wg.Wait()
+
+	failures := 0
+	for i, code := range codes {
+		if code == 0 {
+			continue
+		}
+		failures++
+		if names[i] != "dev" || !strings.Contains(stderrs[i].String(), "already exists") {
+			t.Fatalf("create %s exit code = %d (stderr %q), want only a duplicate dev to fail", names[i], code, stderrs[i].String())
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("failures = %d, want exactly one duplicate create to fail", failures)
+	}
+
+	instances, err := sharedInstanceManager(base, mounter).LoadInstances(context.Background())
+	if err != nil {
+		t.Fatalf("LoadInstances() error = %v", err)
+	}
+	var got []string
+	for _, inst := range instances {
+		got = append(got, inst.Name)
+		if len(inst.Mounts) != 3 {
+			t.Fatalf("instance %s mounts = %v, want 3 entries", inst.Name, inst.Mounts)
+		}
+	}
+	if strings.Join(got, ",") != "ci,dev,qa" {
+		t.Fatalf("instances = %v, want ci,dev,qa", got)
+	}
+	if left, _ := filepath.Glob(filepath.Join(base.InstanceRoot(), ".*.flock")); len(left) != 0 {
+		t.Fatalf("lock files left behind: %v", left)
+	}
+}
@@ -0,0 +1,178 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+// Image is an ISO, or the live root filesystem inside one, opened for reading
+// without mounting it. Names passed to its fs.FS methods are relative to the
+// image root.
+type Image struct {
+	fs.FS
+	ISO ISOInfo
+	// Source is the ISO's file name, or for its root filesystem the path of
+	// that image inside the ISO.
+	Source string
+	close  func() error
+}
+
+var _ fs.ReadLinkFS = (*Image)(nil)
+
+// Close releases the ISO file.
+func (img *Image) Close() error {
+	return img.close()
+}
+
+// ReadLink implements fs.ReadLinkFS.
+func (img *Image) ReadLink(name string) (string, error) {
+	return fs.ReadLink(img.FS, name)
+}
+
+// Lstat implements fs.ReadLinkFS.
+func (img *Image) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Lstat(img.FS, name)
+}
+
+// String names the image for messages, such as "noble.iso" or
+// "noble.iso/casper/filesystem.squashfs".
+func (img *Image) String() string {
+	if img.Source == img.ISO.Name {
+		return img.ISO.Name
+	}
+	return img.ISO.Name + "/" + img.Source
+}
+
+// OpenImage opens the chosen ISO with the built-in readers, reading UDF
+// instead of ISO9660 when that is the richer filesystem. With rootfs set it
+// opens the live root filesystem inside the ISO instead, failing with
+// ErrNotFound when the ISO has none. Opening is bounded by the Inspect
+// timeout.
+func (m *Manager) OpenImage(ctx context.Context, choice int, rootfs bool) (*Image, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	return openBlocking(ctx, "open "+m.Path(iso), func() (*Image, error) {
+		disc, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return nil, err
+		}
+		img := &Image{FS: disc.FS, ISO: iso, Source: iso.Name, close: disc.Close}
+		if rootfs {
+			if img.FS, img.Source, err = openRootFS(disc.FS, iso.Name); err != nil {
+				disc.Close()
+				return nil, err
+			}
+		}
+		return img, nil
+	})
+}
+
+// Lookup checks that name exists in the image and returns its fs.FS name.
+// A missing name is reported as a *NotFoundError.
+func (img *Image) Lookup(name string) (string, error) {
+	clean := cleanImagePath(name)
+	if _, err := fs.Lstat(img, clean); err != nil {
+		return "", &NotFoundError{Kind: "path", Name: name, Dir: img.String()}
+	}
+	return clean, nil
+}
+
+// FindOptions selects the entries Image.Find reports.
+type FindOptions struct {
+	// Pattern matches entries like ExtractOptions.Include: without a slash it
+	// matches the base name, with one the whole path.
+	Pattern string
+	// Grep, when set, keeps only files with a line it matches. Symlinks to
+	// files are searched through.
+	Grep *regexp.Regexp
+}
+
+// Find returns, in walk order, the names of the entries of img that opts
+// selects. It stops when ctx ends. A path without glob metacharacters names
+// at most one entry, which is looked up instead of walking the tree; a bare
+// name still matches in every directory, so it is searched for.
+func (img *Image) Find(ctx context.Context, opts FindOptions) ([]string, error) {
+	if err := validatePatterns([]string{opts.Pattern}); err != nil {
+		return nil, err
+	}
+	if strings.Contains(opts.Pattern, "/") && !strings.ContainsAny(opts.Pattern, `*?[\`) {
+		return img.findPath(ctx, opts)
+	}
+	var found []string
+	err := fs.WalkDir(img, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return contextError("find in "+img.String(), ctx)
+		}
+		if name == "." || !matchAny([]string{opts.Pattern}, name) {
+			return nil
+		}
+		if opts.Grep != nil {
+			if d.IsDir() {
+				return nil
+			}
+			ok, err := img.grep(ctx, name, opts.Grep)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		found = append(found, name)
+		return nil
+	})
+	return found, err
+}
+
+// findPath is Find for a literal path.
+func (img *Image) findPath(ctx context.Context, opts FindOptions) ([]string, error) {
+	name, err := img.Lookup(opts.Pattern)
+	if err != nil || name == "." {
+		return nil, nil
+	}
+	if opts.Grep != nil {
+		if ok, err := img.grep(ctx, name, opts.Grep); err != nil || !ok {
+			return nil, err
+		}
+	}
+	return []string{name}, nil
+}
+
+// grep reports whether a line of the named file matches re. Entries that are
+// not regular files, such as dangling symlinks and devices, never match.
+func (img *Image) grep(ctx context.Context, name string, re *regexp.Regexp) (bool, error) {
+	info, err := fs.Stat(img, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, nil
+	}
+	f, err := img.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(contextReader{ctx: ctx, r: f})
+	if re.MatchReader(r) {
+		return true, nil
+	}
+	if ctx.Err() != nil {
+		return false, contextError("find in "+img.String(), ctx)
+	}
+	return false, nil
+}
+
+// compileGrep compiles a Find expression so ^ and $ match at line boundaries.
+func compileGrep(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?m)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", expr, err)
+	}
+	return re, nil
+}
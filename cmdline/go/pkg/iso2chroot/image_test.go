@@ -0,0 +1,147 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// osRelease is a live root filesystem whose os-release carries version.
+func osRelease(version string) *isotest.Squashfs {
+	return &isotest.Squashfs{
+		Compression: isotest.Gzip,
+		ModTime:     rootfsTime,
+		Files: []isotest.File{
+			isotest.Text("usr/lib/os-release", "NAME=\"Ubuntu\"\nVERSION_ID=\""+version+"\"\n"),
+			isotest.Symlink("etc/os-release", "../usr/lib/os-release"),
+			isotest.Text("usr/share/doc/os-release.txt", "VERSION_ID=\"22.04\" in a comment\n"),
+		},
+	}
+}
+
+// newLibrary returns the manager of a jammy and a noble live ISO and an
+// installer ISO without a root filesystem.
+func newLibrary(t *testing.T) *Manager {
+	t.Helper()
+	manager := newTestManager(t, map[string]isotest.ISO{
+		"jammy.iso":  {RockRidge: true, Files: discFiles(), RootFS: osRelease("22.04")},
+		"noble.iso":  {RockRidge: true, Files: discFiles(), RootFS: osRelease("24.04")},
+		"server.iso": {RockRidge: true, Files: discFiles()},
+	})
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestImageFind(t *testing.T) {
+	manager := newLibrary(t)
+	img, err := manager.OpenImage(context.Background(), 1, true)
+	if err != nil {
+		t.Fatalf("OpenImage() error = %v", err)
+	}
+	defer img.Close()
+	if img.String() != "jammy.iso/casper/filesystem.squashfs" {
+		t.Fatalf("String() = %q", img.String())
+	}
+
+	ctx := context.Background()
+	found, err := img.Find(ctx, FindOptions{Pattern: "os-release"})
+	if err != nil || strings.Join(found, ",") != "etc/os-release,usr/lib/os-release" {
+		t.Fatalf("Find(os-release) = %q, %v", found, err)
+	}
+	re, err := compileGrep(`^VERSION_ID="22.04"$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The symlink is searched through; the comment does not match the anchored expression.
+	found, err = img.Find(ctx, FindOptions{Pattern: "*", Grep: re})
+	if err != nil || strings.Join(found, ",") != "etc/os-release,usr/lib/os-release" {
+		t.Fatalf("Find(grep) = %q, %v", found, err)
+	}
+	if _, err := img.Lookup("/etc/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Lookup(missing) error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := manager.OpenImage(context.Background(), 3, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("OpenImage(server.iso, rootfs) error = %v, want ErrNotFound", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := img.Find(cancelled, FindOptions{Pattern: "*"}); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("Find(cancelled) error = %v, want ErrCancelled", err)
+	}
+}
+
+func TestRunCLIBrowse(t *testing.T) {
+	manager := newLibrary(t)
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := run("ls-iso", "2", "boot/grub")
+	if code != ExitOK || !strings.Contains(out, "-rw-r--r--  26") || !strings.Contains(out, " grub.cfg\n") {
+		t.Fatalf("ls-iso 2 boot/grub: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	if code, out2, _ := run("ls", "2", "boot/grub"); code != ExitOK || out2 != out {
+		t.Fatalf("ls 2 boot/grub: exit %d, stdout %q; want that of ls-iso", code, out2)
+	}
+	code, out, _ = run("ls", "--rootfs", "2", "etc")
+	if code != ExitOK || !strings.Contains(out, "os-release -> ../usr/lib/os-release") {
+		t.Fatalf("ls --rootfs noble etc: exit %d, stdout %q", code, out)
+	}
+	code, out, _ = run("ls-iso", "2", "casper/vmlinuz")
+	if code != ExitOK || !strings.Contains(out, "6000") || !strings.HasSuffix(out, " vmlinuz\n") {
+		t.Fatalf("ls of a file: exit %d, stdout %q", code, out)
+	}
+	if code, out, _ = run("ls"); code != ExitOK || !strings.Contains(out, "No instances") {
+		t.Fatalf("ls: exit %d, stdout %q; want instances", code, out)
+	}
+
+	code, out, _ = run("cat", "--rootfs", "1", "/etc/os-release")
+	if code != ExitOK || out != "NAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\n" {
+		t.Fatalf("cat --rootfs: exit %d, stdout %q", code, out)
+	}
+	if code, _, errOut = run("cat", "1", "boot"); code != ExitFailure || !strings.Contains(errOut, "not a regular file") {
+		t.Fatalf("cat of a directory: exit %d, stderr %q", code, errOut)
+	}
+	if code, _, errOut = run("cat", "1", "nope"); code != ExitNotFound || !strings.Contains(errOut, `path "nope" not found in jammy.iso`) {
+		t.Fatalf("cat of a missing file: exit %d, stderr %q", code, errOut)
+	}
+
+	code, out, _ = run("find", "2", "*.cfg")
+	if code != ExitOK || out != "boot/grub/grub.cfg\n" {
+		t.Fatalf("find noble *.cfg: exit %d, stdout %q", code, out)
+	}
+	// A literal path is looked up rather than searched for.
+	for pattern, want := range map[string]string{"/boot/grub/grub.cfg": "boot/grub/grub.cfg\n", "boot/grub/missing.cfg": ""} {
+		if code, out, _ = run("find", "2", pattern); code != ExitOK || out != want {
+			t.Fatalf("find noble %s: exit %d, stdout %q; want %q", pattern, code, out, want)
+		}
+	}
+	// server.iso has no root filesystem and is skipped.
+	code, out, errOut = run("find", "--all", "--rootfs", "--grep", `^VERSION_ID="?22\.04"?$`, "/usr/lib/os-release")
+	if code != ExitOK || out != "jammy.iso:usr/lib/os-release\n" || errOut != "" {
+		t.Fatalf("find --all: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+
+	for _, args := range [][]string{
+		{"ls-iso", "2", "a", "b"},
+		{"ls", "2", "a", "b"},
+		{"cat", "2"},
+		{"find", "2"},
+		{"find", "--all", "2", "x"},
+		{"find", "2", "["},
+		{"find", "--grep", "(", "2", "x"},
+	} {
+		if code, _, _ := run(args...); code != ExitUsage {
+			t.Errorf("RunCLI(%q) exit code = %d, want %d", args, code, ExitUsage)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"thatnerdjosh.com/devtools/pkg/initramfs"
+)
+
+// repackTime is the modification time of every entry of a repacked
+// initramfs, so the same tree always packs to the same bytes.
+var repackTime = time.Unix(0, 0).UTC()
+
+// runInitrd dispatches the initrd subcommands, which work on initramfs files
+// rather than on ISOs of the library.
+func runInitrd(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "iso2chroot: initrd requires a subcommand: ls, extract or repack.")
+		return ExitUsage
+	}
+	switch args[0] {
+	case "ls":
+		return runInitrdList(args[1:], stdout, stderr)
+	case "extract":
+		return runInitrdExtract(ctx, args[1:], stdout, stderr)
+	case "repack":
+		return runInitrdRepack(args[1:], stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "iso2chroot: unknown initrd subcommand %q (want ls, extract or repack)\n", args[0])
+	return ExitUsage
+}
+
+// readInitrd reads every archive of the initramfs file name.
+func readInitrd(name string) ([]*initramfs.Archive, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	archives, err := initramfs.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return archives, nil
+}
+
+// archiveDirs names the directory each archive of an initramfs is extracted
+// into, as unmkinitramfs does: the only archive goes straight into the
+// destination; otherwise the last is "main" and those before it "early",
+// "early2" and so on.
+func archiveDirs(archives []*initramfs.Archive) []string {
+	if len(archives) == 1 {
+		return []string{"."}
+	}
+	dirs := make([]string, len(archives))
+	for i := range archives[:len(archives)-1] {
+		dirs[i] = "early"
+		if i > 0 {
+			dirs[i] += fmt.Sprint(i + 1)
+		}
+	}
+	dirs[len(dirs)-1] = "main"
+	return dirs
+}
+
+func runInitrdList(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "iso2chroot: initrd ls requires an initramfs file.")
+		return ExitUsage
+	}
+	archives, err := readInitrd(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	dirs := archiveDirs(archives)
+	for i, a := range archives {
+		if len(archives) > 1 {
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			fmt.Fprintf(stdout, "%s (%s, %d entries at byte %d)\n", dirs[i], a.Compression, len(a.Entries), a.Offset)
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		for _, e := range a.Entries {
+			display, size := e.Name, len(e.Data)
+			if e.Mode.Type() == fs.ModeSymlink {
+				display += " -> " + string(e.Data)
+			} else if !e.Mode.IsRegular() {
+				size = 0
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.Mode, size, e.ModTime.UTC().Format("2006-01-02 15:04"), display)
+		}
+		tw.Flush()
+	}
+	return ExitOK
+}
+
+func runInitrdExtract(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 2 {
+		fmt.Fprintln(stderr, "iso2chroot: initrd extract requires an initramfs file and a destination directory.")
+		return ExitUsage
+	}
+	archives, err := readInitrd(args[0])
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var total ExtractResult
+	dirs := archiveDirs(archives)
+	for i, a := range archives {
+		dst := filepath.Join(args[1], dirs[i])
+		if err := os.MkdirAll(dst, 0o755); err != nil {
+			return fail(stderr, err)
+		}
+		result, err := extractTree(ctx, initramfs.NewFS(a), dst, ExtractOptions{})
+		total.Entries += result.Entries
+		total.Bytes += result.Bytes
+		total.Warnings = append(total.Warnings, result.Warnings...)
+		if err != nil {
+			fmt.Fprintf(stderr, "iso2chroot: initrd extract failed: %v\n", err)
+			if total.Entries > 0 {
+				fmt.Fprintf(stderr, "iso2chroot: %d entries already written to %s were left in place.\n", total.Entries, args[1])
+			}
+			return ExitCode(err)
+		}
+	}
+	for _, warning := range total.Warnings {
+		fmt.Fprintf(stderr, "iso2chroot: warning: %s\n", warning)
+	}
+	where := args[1]
+	if len(archives) > 1 {
+		where = fmt.Sprintf("%s (%s)", args[1], strings.Join(dirs, ", "))
+	}
+	fmt.Fprintf(stdout, "Extracted %s to %s (%d entries, %s)\n", args[0], where, total.Entries, formatBytes(total.Bytes))
+	return ExitOK
+}
+
+func runInitrdRepack(args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("initrd repack", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	out := flagSet.String("out", "", "File to write the initramfs to; it must not exist")
+	compression := flagSet.String("compress", initramfs.CompressionGzip, "Compression of the last archive: "+strings.Join(initramfs.Compressions, ", ")+"; earlier ones, such as early microcode, stay uncompressed")
+	args, err := parseInterspersed(flagSet, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(args) == 0 || *out == "" {
+		fmt.Fprintln(stderr, "iso2chroot: initrd repack requires --out <file> and one or more directories, one per archive.")
+		return ExitUsage
+	}
+	if !slices.Contains(initramfs.Compressions, *compression) {
+		fmt.Fprintf(stderr, "iso2chroot: unknown compression %q (want one of %s)\n", *compression, strings.Join(initramfs.Compressions, ", "))
+		return ExitUsage
+	}
+
+	archives := make([][]*initramfs.Entry, len(args))
+	entries := 0
+	for i, dir := range args {
+		if archives[i], err = archiveDir(dir); err != nil {
+			return fail(stderr, err)
+		}
+		entries += len(archives[i])
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	for i, a := range archives {
+		c := initramfs.CompressionNone
+		if i == len(archives)-1 {
+			c = *compression
+		}
+		if err = initramfs.Write(f, a, c); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return fail(stderr, err)
+	}
+	info, err := os.Stat(*out)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	fmt.Fprintf(stdout, "Wrote %s (%d archives, %d entries, %s)\n", *out, len(archives), entries, formatBytes(info.Size()))
+	return ExitOK
+}
+
+// archiveDir collects the tree under dir as initramfs entries, sorted by
+// name. Everything is owned by root and dated repackTime, and inode numbers
+// follow the sorted order, so the archive depends only on names, modes and
+// contents. Hard links become separate files.
+func archiveDir(dir string) ([]*initramfs.Entry, error) {
+	var entries []*initramfs.Entry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := &initramfs.Entry{Name: filepath.ToSlash(rel), Mode: info.Mode(), Nlink: 1, ModTime: repackTime}
+		switch info.Mode().Type() {
+		case 0:
+			if e.Data, err = os.ReadFile(p); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			e.Data = []byte(target)
+		case fs.ModeDir:
+			e.Nlink = 2
+		case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				e.Major, e.Minor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b *initramfs.Entry) int { return strings.Compare(a.Name, b.Name) })
+	for i, e := range entries {
+		e.Inode = uint32(i + 1)
+	}
+	return entries, nil
+}
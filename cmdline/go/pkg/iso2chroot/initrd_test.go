@@ -0,0 +1,119 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/pkg/initramfs"
+)
+
+// writeInitrd writes an Ubuntu-style initramfs: an uncompressed microcode
+// archive followed by a zstd-compressed main one.
+func writeInitrd(t *testing.T, name string) {
+	t.Helper()
+	var buf bytes.Buffer
+	early := []*initramfs.Entry{
+		{Name: "kernel", Mode: fs.ModeDir | 0o755, Nlink: 2, Inode: 1},
+		{Name: "kernel/x86/microcode/GenuineIntel.bin", Mode: 0o644, Nlink: 1, Inode: 2, Data: []byte("intel")},
+	}
+	main := []*initramfs.Entry{
+		{Name: "init", Mode: 0o755, Nlink: 1, Inode: 1, ModTime: rootfsTime, UID: 1000, Data: []byte("#!/bin/sh\n")},
+		{Name: "bin/sh", Mode: fs.ModeSymlink | 0o777, Nlink: 1, Inode: 2, ModTime: rootfsTime, Data: []byte("busybox")},
+		{Name: "bin/busybox", Mode: 0o755, Nlink: 1, Inode: 3, ModTime: rootfsTime, Data: []byte("busybox")},
+	}
+	if err := initramfs.Write(&buf, early, initramfs.CompressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := initramfs.Write(&buf, main, initramfs.CompressionZstd); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunCLIInitrd(t *testing.T) {
+	manager := NewManager(t.TempDir())
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+	dir := t.TempDir()
+	initrd := filepath.Join(dir, "initrd")
+	writeInitrd(t, initrd)
+
+	code, out, errOut := run("initrd", "ls", initrd)
+	for _, want := range []string{
+		"early (none, 2 entries at byte 0)\n",
+		"-rw-r--r--  5  1970-01-01 00:00  kernel/x86/microcode/GenuineIntel.bin\n",
+		"\nmain (zstd, 3 entries at byte ",
+		"Lrwxrwxrwx  7   2024-04-23 10:00  bin/sh -> busybox\n",
+	} {
+		if code != ExitOK || !strings.Contains(out, want) {
+			t.Fatalf("initrd ls: exit %d, stderr %q, stdout\n%s\nwant %q", code, errOut, out, want)
+		}
+	}
+
+	tree := filepath.Join(dir, "tree")
+	if code, out, errOut = run("initrd", "extract", initrd, tree); code != ExitOK || !strings.Contains(out, "(early, main)") {
+		t.Fatalf("initrd extract: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	if data, err := os.ReadFile(filepath.Join(tree, "main/init")); err != nil || string(data) != "#!/bin/sh\n" {
+		t.Fatalf("main/init = %q, %v", data, err)
+	}
+	if target, err := os.Readlink(filepath.Join(tree, "main/bin/sh")); err != nil || target != "busybox" {
+		t.Fatalf("main/bin/sh -> %q, %v", target, err)
+	}
+
+	// Repacking is reproducible whatever the file times on disk.
+	repacked := filepath.Join(dir, "initrd.new")
+	args := []string{"initrd", "repack", "--compress", "xz", "--out", repacked, filepath.Join(tree, "early"), filepath.Join(tree, "main")}
+	if code, out, errOut = run(args...); code != ExitOK || !strings.Contains(out, "(2 archives, 8 entries, ") {
+		t.Fatalf("initrd repack: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	first, err := os.ReadFile(repacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(repacked)
+	os.Chtimes(filepath.Join(tree, "main/init"), rootfsTime, rootfsTime)
+	if code, _, errOut = run(args...); code != ExitOK {
+		t.Fatalf("second initrd repack: exit %d, stderr %q", code, errOut)
+	}
+	if second, _ := os.ReadFile(repacked); !bytes.Equal(first, second) {
+		t.Fatal("repacking the same tree twice gave different images")
+	}
+	if code, _, errOut = run(args...); code != ExitFailure || !strings.Contains(errOut, "exists") {
+		t.Fatalf("initrd repack over an existing file: exit %d, stderr %q", code, errOut)
+	}
+
+	archives, err := initramfs.Read(bytes.NewReader(first))
+	if err != nil {
+		t.Fatalf("read repacked initrd: %v", err)
+	}
+	if len(archives) != 2 || archives[0].Compression != initramfs.CompressionNone || archives[1].Compression != initramfs.CompressionXZ {
+		t.Fatalf("repacked archives = %d, first %+v", len(archives), archives[0])
+	}
+	var names []string
+	for _, e := range archives[1].Entries {
+		names = append(names, e.Name)
+		if e.ModTime.Unix() != 0 || e.UID != 0 || e.GID != 0 {
+			t.Fatalf("repacked %s: mtime %v, owner %d:%d", e.Name, e.ModTime, e.UID, e.GID)
+		}
+	}
+	if want := []string{"bin", "bin/busybox", "bin/sh", "init"}; !slices.Equal(names, want) {
+		t.Fatalf("repacked main entries = %q, want %q", names, want)
+	}
+
+	for _, args := range [][]string{{"initrd"}, {"initrd", "cat"}, {"initrd", "ls"}, {"initrd", "repack", "--compress", "bzip2", "--out", "x", tree}} {
+		if code, _, _ := run(args...); code != ExitUsage {
+			t.Fatalf("%q: exit %d, want %d", args, code, ExitUsage)
+		}
+	}
+}
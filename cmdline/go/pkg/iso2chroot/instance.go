@@ -0,0 +1,389 @@
+package iso2chroot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	registryFile     = "instances.json"
+	instanceLockFile = "iso2chroot.lock"
+
+	instanceISODir   = "iso"
+	instanceLowerDir = "lower"
+	instanceUpperDir = "upper"
+	instanceWorkDir  = "work"
+	instanceRootDir  = "root"
+)
+
+// rootfsImages are the live root filesystem images looked up inside an ISO, in
+// order of preference.
+var rootfsImages = []string{
+	"casper/filesystem.squashfs",
+	"live/filesystem.squashfs",
+	"LiveOS/squashfs.img",
+}
+
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Instance describes a named chroot assembled under the managed instance root.
+type Instance struct {
+	Name    string    `json:"name"`
+	ISO     string    `json:"iso"`
+	ISOPath string    `json:"iso_path"`
+	Created time.Time `json:"created"`
+	// Mounts lists the instance subdirectories that are mounted, in mount order.
+	Mounts []string `json:"mounts"`
+}
+
+// InstanceOptions adjusts how CreateInstance assembles an instance.
+type InstanceOptions struct {
+	// ReuseISOMount, when set, is an existing mount of the ISO that is bind-mounted
+	// into the instance instead of attaching another loop device.
+	ReuseISOMount string
+}
+
+type registry struct {
+	Instances []Instance `json:"instances"`
+}
+
+// SetInstanceRoot changes the directory that holds named instances and the registry.
+func (m *Manager) SetInstanceRoot(root string) {
+	if root == "" {
+		root = defaultInstanceRoot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.instanceRoot = root
+	m.instances = make(map[string]Instance)
+}
+
+// InstanceRoot returns the directory that holds named instances.
+func (m *Manager) InstanceRoot() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.instanceRoot
+}
+
+// InstanceDir returns the directory of the named instance.
+func (m *Manager) InstanceDir(name string) string {
+	return filepath.Join(m.InstanceRoot(), name)
+}
+
+// InstanceLockPath returns the lock file location for the named instance.
+func (m *Manager) InstanceLockPath(name string) string {
+	return filepath.Join(m.InstanceDir(name), instanceLockFile)
+}
+
+// LoadInstances refreshes the tracked instances from the registry.
+// A missing registry yields no instances.
+func (m *Manager) LoadInstances(ctx context.Context) ([]Instance, error) {
+	instances, err := m.readRegistry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.instances = instances
+	m.mu.Unlock()
+	return sortedInstances(instances), nil
+}
+
+// readRegistry reads the registry from disk, bounded by the Load timeout.
+func (m *Manager) readRegistry(ctx context.Context) (map[string]Instance, error) {
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Load)
+	defer cancel()
+	path := filepath.Join(m.InstanceRoot(), registryFile)
+	return runBlocking(ctx, "read instance registry", func() (map[string]Instance, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return make(map[string]Instance), nil
+			}
+			return nil, fmt.Errorf("read instance registry: %w", err)
+		}
+
+		var reg registry
+		if err := json.Unmarshal(data, &reg); err != nil {
+			return nil, fmt.Errorf("parse instance registry: %w", err)
+		}
+		instances := make(map[string]Instance, len(reg.Instances))
+		for _, inst := range reg.Instances {
+			instances[inst.Name] = inst
+		}
+		return instances, nil
+	})
+}
+
+// Instances returns the tracked instances sorted by name.
+func (m *Manager) Instances() []Instance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return sortedInstances(m.instances)
+}
+
+// Instance returns the tracked instance with the provided name.
+func (m *Manager) Instance(name string) (Instance, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	inst, ok := m.instances[name]
+	if !ok {
+		return Instance{}, &NotFoundError{Kind: "instance", Name: name}
+	}
+	return inst, nil
+}
+
+func sortedInstances(instances map[string]Instance) []Instance {
+	list := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// CreateInstance assembles a named chroot from the chosen ISO. The ISO is mounted
+// under iso/, its live root filesystem (or the ISO itself) under lower/, and a
+// writable overlay of the two under root/. The instance is registered before
+// mounting and rolled back if any step fails; see Create.
+func (m *Manager) CreateInstance(ctx context.Context, choice int, name string, opts InstanceOptions) (Instance, error) {
+	if name == "" {
+		return Instance{}, validateInstanceName(name)
+	}
+	result, err := m.Create(ctx, CreateRequest{
+		Choice:        choice,
+		Name:          name,
+		ReuseISOMount: opts.ReuseISOMount,
+	})
+	return result.Instance, err
+}
+
+// RenameInstance moves an instance to a new name, including its directory.
+func (m *Manager) RenameInstance(ctx context.Context, oldName, newName string) error {
+	if err := validateInstanceName(oldName); err != nil {
+		return err
+	}
+	if err := validateInstanceName(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return fmt.Errorf("instance %q already has that name", oldName)
+	}
+
+	// Lock both names in a fixed order so concurrent renames cannot deadlock.
+	first, second := oldName, newName
+	if second < first {
+		first, second = second, first
+	}
+	firstLock, err := m.lockInstance(ctx, first)
+	if err != nil {
+		return err
+	}
+	defer firstLock.Release()
+	secondLock, err := m.lockInstance(ctx, second)
+	if err != nil {
+		return err
+	}
+	defer secondLock.Release()
+
+	return m.updateInstances(ctx, func(instances map[string]Instance) error {
+		inst, ok := instances[oldName]
+		if !ok {
+			return &NotFoundError{Kind: "instance", Name: oldName}
+		}
+		if _, exists := instances[newName]; exists {
+			return fmt.Errorf("instance %q already exists", newName)
+		}
+		if _, err := os.Stat(m.InstanceDir(newName)); err == nil {
+			return fmt.Errorf("instance directory %s already exists", m.InstanceDir(newName))
+		}
+
+		if err := os.Rename(m.InstanceDir(oldName), m.InstanceDir(newName)); err != nil {
+			return fmt.Errorf("rename instance: %w", err)
+		}
+		delete(instances, oldName)
+		inst.Name = newName
+		instances[newName] = inst
+		return nil
+	})
+}
+
+// DestroyInstance unmounts everything the instance mounted, in reverse order,
+// removes its directory and drops it from the registry.
+func (m *Manager) DestroyInstance(ctx context.Context, name string) error {
+	if err := validateInstanceName(name); err != nil {
+		return err
+	}
+	lock, err := m.lockInstance(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if _, err := m.LoadInstances(ctx); err != nil {
+		return err
+	}
+	inst, err := m.Instance(name)
+	if err != nil {
+		return err
+	}
+
+	dir := m.InstanceDir(name)
+	mounter := m.privileged()
+	for len(inst.Mounts) > 0 {
+		sub := inst.Mounts[len(inst.Mounts)-1]
+		if err := mounter.Unmount(ctx, filepath.Join(dir, sub)); err != nil {
+			return fmt.Errorf("destroy %s: %w", name, err)
+		}
+		inst.Mounts = inst.Mounts[:len(inst.Mounts)-1]
+		if err := m.updateInstances(ctx, func(instances map[string]Instance) error {
+			instances[name] = inst
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := mounter.RemoveAll(ctx, dir); err != nil {
+		return fmt.Errorf("remove instance dir: %w", err)
+	}
+	return m.updateInstances(ctx, func(instances map[string]Instance) error {
+		delete(instances, name)
+		return nil
+	})
+}
+
+// Enter runs argv inside the root of the named instance. An empty argv starts
+// an interactive shell.
+func (m *Manager) Enter(ctx context.Context, name string, argv []string) error {
+	root, err := m.instanceRootPath(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(argv) == 0 {
+		argv = []string{"/bin/sh", "-l"}
+		if _, err := os.Stat(filepath.Join(root, "bin", "bash")); err == nil {
+			argv = []string{"/bin/bash", "-l"}
+		}
+	}
+	return m.privileged().Chroot(ctx, root, argv)
+}
+
+// instanceRootPath returns the root directory of the named instance, which
+// must be fully assembled.
+func (m *Manager) instanceRootPath(ctx context.Context, name string) (string, error) {
+	if err := validateInstanceName(name); err != nil {
+		return "", err
+	}
+	if _, err := m.LoadInstances(ctx); err != nil {
+		return "", err
+	}
+	inst, err := m.Instance(name)
+	if err != nil {
+		return "", err
+	}
+	if len(inst.Mounts) == 0 || inst.Mounts[len(inst.Mounts)-1] != instanceRootDir {
+		return "", fmt.Errorf("instance %q is not fully assembled; destroy and create it again", name)
+	}
+	return filepath.Join(m.InstanceDir(name), instanceRootDir), nil
+}
+
+// lockInstance takes the advisory lock guarding the named instance directory.
+func (m *Manager) lockInstance(ctx context.Context, name string) (*pathLock, error) {
+	return m.lock(ctx, m.InstanceDir(name))
+}
+
+// updateInstances applies fn to a copy of the registry while holding the
+// registry lock. The registry is re-read first so changes made by other
+// processes are kept, and is only written back, and the tracked instances
+// replaced, when fn succeeds. In dry-run mode the change is applied to the
+// in-memory registry only.
+func (m *Manager) updateInstances(ctx context.Context, fn func(instances map[string]Instance) error) error {
+	if m.isDryRun() {
+		m.mu.RLock()
+		instances := make(map[string]Instance, len(m.instances))
+		for name, inst := range m.instances {
+			instances[name] = inst
+		}
+		m.mu.RUnlock()
+		if err := fn(instances); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.instances = instances
+		m.mu.Unlock()
+		return nil
+	}
+
+	path := filepath.Join(m.InstanceRoot(), registryFile)
+	lock, err := m.lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	instances, err := m.readRegistry(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(instances); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(registry{Instances: sortedInstances(instances)}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode instance registry: %w", err)
+	}
+	data = append(data, '\n')
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write instance registry: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write instance registry: %w", err)
+	}
+
+	m.mu.Lock()
+	m.instances = instances
+	m.mu.Unlock()
+	return nil
+}
+
+func validateInstanceName(name string) error {
+	if !instanceNamePattern.MatchString(name) || name == registryFile {
+		return fmt.Errorf("invalid instance name %q: use letters, digits, '.', '_' or '-'", name)
+	}
+	return nil
+}
+
+// rootfsImage returns the live root filesystem image of iso as a path under
+// isoDir, where the ISO is mounted, or "" when it has none. The image is looked
+// up in the ISO itself, so a dry run, which mounts nothing, plans the same
+// mounts as a real run; only ISOs the built-in readers cannot open are looked
+// at through the mount.
+func (m *Manager) rootfsImage(iso ISOInfo, isoDir string) string {
+	var fsys fs.FS
+	if d, err := openISO(m.fsys, iso.Name); err == nil {
+		defer d.Close()
+		fsys = d
+	} else {
+		fsys = os.DirFS(isoDir)
+	}
+	for _, rel := range rootfsImages {
+		if info, err := fs.Stat(fsys, rel); err == nil && info.Mode().IsRegular() {
+			return filepath.Join(isoDir, rel)
+		}
+	}
+	return ""
+}
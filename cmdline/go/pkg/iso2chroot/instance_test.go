@@ -0,0 +1,241 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// fakeMounter records mount operations instead of performing them.
+type fakeMounter struct {
+	mu      sync.Mutex
+	calls   []string
+	failOn  string
+	mounted map[string]bool
+	// onMount, when set, runs before each operation is recorded.
+	onMount func(op, target string)
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{mounted: make(map[string]bool)}
+}
+
+// newTestManager writes isos, keyed by file name, to a library and returns
+// its manager with a fake mounter.
+func newTestManager(t *testing.T, isos map[string]isotest.ISO) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	for name, iso := range isos {
+		isotest.WriteISO(t, dir, name, iso)
+	}
+	manager := NewManager(dir)
+	manager.SetMounter(newFakeMounter())
+	return manager
+}
+
+func (f *fakeMounter) record(op, target string, args ...string) error {
+	if f.onMount != nil {
+		f.onMount(op, target)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(append([]string{op}, append(args, target)...), " "))
+	if f.failOn != "" && f.failOn == op {
+		return errors.New("fake " + op + " failure")
+	}
+	if op == "umount" {
+		delete(f.mounted, target)
+	} else {
+		f.mounted[target] = true
+	}
+	return nil
+}
+
+// Directory operations are carried out for real so tests can inspect the layout.
+func (f *fakeMounter) Mkdir(_ context.Context, path string) error     { return os.MkdirAll(path, 0o755) }
+func (f *fakeMounter) Rmdir(_ context.Context, path string) error     { return os.Remove(path) }
+func (f *fakeMounter) RemoveAll(_ context.Context, path string) error { return os.RemoveAll(path) }
+
+func (f *fakeMounter) MountLoop(_ context.Context, image, target, fstype string) error {
+	return f.record("loop", target, image)
+}
+func (f *fakeMounter) Bind(_ context.Context, source, target string) error {
+	return f.record("bind", target, source)
+}
+func (f *fakeMounter) MountOverlay(_ context.Context, lower, upper, work, target string) error {
+	return f.record("overlay", target, lower, upper, work)
+}
+func (f *fakeMounter) Unmount(_ context.Context, target string) error {
+	return f.record("umount", target)
+}
+func (f *fakeMounter) Chroot(_ context.Context, root string, argv []string) error {
+	return f.record("chroot", strings.Join(argv, " "), root)
+}
+
+func (f *fakeMounter) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func newInstanceManager(t *testing.T, isos ...string) (*Manager, *fakeMounter) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range isos {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("write file %s: %v", name, err)
+		}
+	}
+	manager := NewManager(dir)
+	manager.SetInstanceRoot(filepath.Join(t.TempDir(), "root"))
+	mounter := newFakeMounter()
+	manager.mounter = mounter
+	return manager, mounter
+}
+
+func TestCreateInstanceLayout(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	inst, err := manager.CreateInstance(context.Background(), 1, "jammy", InstanceOptions{})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	dir := manager.InstanceDir("jammy")
+	for _, sub := range []string{"iso", "lower", "upper", "work", "root"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			t.Fatalf("expected %s/%s to be a directory (err %v)", dir, sub, err)
+		}
+	}
+	if got := strings.Join(inst.Mounts, ","); got != "iso,lower,root" {
+		t.Fatalf("Mounts = %q, want iso,lower,root", got)
+	}
+
+	want := []string{
+		"loop " + filepath.Join(manager.Directory(), "a.iso") + " " + filepath.Join(dir, "iso"),
+		"bind " + filepath.Join(dir, "iso") + " " + filepath.Join(dir, "lower"),
+		"overlay " + strings.Join([]string{filepath.Join(dir, "lower"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "root")}, " "),
+	}
+	if got := mounter.Calls(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("mount calls = %q, want %q", got, want)
+	}
+
+	reloaded := NewManager(manager.Directory())
+	reloaded.SetInstanceRoot(manager.InstanceRoot())
+	instances, err := reloaded.LoadInstances(context.Background())
+	if err != nil {
+		t.Fatalf("LoadInstances() error = %v", err)
+	}
+	if len(instances) != 1 || instances[0].Name != "jammy" || instances[0].ISO != "a.iso" {
+		t.Fatalf("LoadInstances() = %+v, want jammy from a.iso", instances)
+	}
+}
+
+func TestCreateInstanceRejectsDuplicateAndInvalidNames(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso")
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if _, err := manager.CreateInstance(context.Background(), 1, "one", InstanceOptions{}); err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	if _, err := manager.CreateInstance(context.Background(), 1, "one", InstanceOptions{}); err == nil {
+		t.Fatal("expected duplicate instance name to fail")
+	}
+	for _, name := range []string{"", "../escape", "a/b", ".hidden", registryFile} {
+		if _, err := manager.CreateInstance(context.Background(), 1, name, InstanceOptions{}); err == nil {
+			t.Fatalf("expected instance name %q to be rejected", name)
+		}
+	}
+}
+
+func TestRenameAndDestroyInstance(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if _, err := manager.CreateInstance(context.Background(), 1, "old", InstanceOptions{}); err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+
+	if err := manager.RenameInstance(context.Background(), "old", "new"); err != nil {
+		t.Fatalf("RenameInstance() error = %v", err)
+	}
+	if _, err := os.Stat(manager.InstanceDir("old")); !os.IsNotExist(err) {
+		t.Fatalf("old instance dir still exists (err %v)", err)
+	}
+	if _, err := manager.Instance("new"); err != nil {
+		t.Fatalf("Instance(new) error = %v", err)
+	}
+
+	if err := manager.DestroyInstance(context.Background(), "new"); err != nil {
+		t.Fatalf("DestroyInstance() error = %v", err)
+	}
+	dir := manager.InstanceDir("new")
+	calls := mounter.Calls()
+	wantTail := []string{
+		"umount " + filepath.Join(dir, "root"),
+		"umount " + filepath.Join(dir, "lower"),
+		"umount " + filepath.Join(dir, "iso"),
+	}
+	if got := calls[len(calls)-3:]; strings.Join(got, "\n") != strings.Join(wantTail, "\n") {
+		t.Fatalf("unmount calls = %q, want %q", got, wantTail)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("instance dir still exists (err %v)", err)
+	}
+	if instances, _ := manager.LoadInstances(context.Background()); len(instances) != 0 {
+		t.Fatalf("LoadInstances() = %+v, want none", instances)
+	}
+}
+
+func TestRunCLIInstanceCommands(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso", "b.iso")
+	var stdout, stderr bytes.Buffer
+
+	code := RunCLI(manager, []string{"create", "2", "--name", "dev"}, &stdout, &stderr, CLIOptions{
+		Stdin: bytes.NewBufferString("\n"),
+	})
+	if code != 0 {
+		t.Fatalf("create exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+	if _, err := ReadLockFile(manager.InstanceLockPath("dev")); err != nil {
+		t.Fatalf("ReadLockFile() error = %v", err)
+	}
+
+	stdout.Reset()
+	if code := RunCLI(manager, []string{"ls"}, &stdout, &stderr, CLIOptions{}); code != 0 {
+		t.Fatalf("ls exit code = %d, want 0", code)
+	}
+	if !strings.Contains(stdout.String(), "dev") || !strings.Contains(stdout.String(), "b.iso") {
+		t.Fatalf("ls stdout = %q, want dev instance from b.iso", stdout.String())
+	}
+
+	if code := RunCLI(manager, []string{"rename", "dev", "prod"}, &stdout, &stderr, CLIOptions{}); code != 0 {
+		t.Fatalf("rename exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+
+	code = RunCLI(manager, []string{"destroy", "prod"}, &stdout, &stderr, CLIOptions{
+		Stdin: bytes.NewBufferString("prod\n"),
+	})
+	if code != 0 {
+		t.Fatalf("destroy exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := RunCLI(manager, []string{"ls"}, &stdout, &stderr, CLIOptions{}); code != 0 {
+		t.Fatalf("ls exit code = %d, want 0", code)
+	}
+	if !strings.Contains(stdout.String(), "No instances") {
+		t.Fatalf("ls stdout = %q, want no instances", stdout.String())
+	}
+}
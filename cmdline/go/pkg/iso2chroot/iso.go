@@ -0,0 +1,92 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"thatnerdjosh.com/devtools/pkg/udf"
+)
+
+const (
+	isoSectorSize        = 2048
+	isoPrimaryDescSector = 16
+)
+
+var errNoVolumeLabel = errors.New("no ISO9660 or UDF volume label")
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of the named file in fsys,
+// stopping early once ctx ends.
+func fileSHA256(ctx context.Context, fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx: ctx, r: f}); err != nil {
+		if ctx.Err() != nil {
+			return "", contextError("hash "+name, ctx)
+		}
+		return "", fmt.Errorf("hash %s: %w", name, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// volumeLabel reads the volume identifier from the ISO9660 primary volume
+// descriptor of the named file in fsys, or for UDF-only images from the UDF
+// logical volume. It returns errNoVolumeLabel when the file carries neither.
+func volumeLabel(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	const offset = isoPrimaryDescSector * isoSectorSize
+	if info, err := f.Stat(); err == nil && info.Size() < offset+isoSectorSize {
+		return "", errNoVolumeLabel
+	}
+	desc := make([]byte, isoSectorSize)
+	if err := readAt(f, desc, offset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", errNoVolumeLabel
+		}
+		return "", fmt.Errorf("read volume descriptor %s: %w", name, err)
+	}
+	label, err := parseVolumeLabel(desc)
+	if ra, ok := f.(io.ReaderAt); ok && errors.Is(err, errNoVolumeLabel) {
+		if vol, udfErr := udf.Open(ra); udfErr == nil {
+			return vol.VolumeID(), nil
+		}
+	}
+	return label, err
+}
+
+// parseVolumeLabel extracts the volume identifier from a primary volume descriptor sector.
+func parseVolumeLabel(desc []byte) (string, error) {
+	if len(desc) < 72 || desc[0] != 1 || !bytes.Equal(desc[1:6], []byte("CD001")) {
+		return "", errNoVolumeLabel
+	}
+	return string(bytes.TrimRight(desc[40:72], " \x00")), nil
+}
+
+// readAt fills buf from offset off of f, using ReadAt when the file supports
+// it and otherwise reading forward from the start.
+func readAt(f fs.File, buf []byte, off int64) error {
+	if ra, ok := f.(io.ReaderAt); ok {
+		_, err := ra.ReadAt(buf, off)
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, f, off); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(f, buf)
+	return err
+}
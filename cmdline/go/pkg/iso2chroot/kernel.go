@@ -0,0 +1,216 @@
+package iso2chroot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+)
+
+// KernelManifestName is the file Manager.ExtractKernel describes the
+// extracted files in.
+const KernelManifestName = "manifest.json"
+
+// kernelSourceKnownPath is the KernelManifest.Source of kernels found at a
+// known distribution path rather than through a boot menu.
+const kernelSourceKnownPath = "known path"
+
+// knownKernels lists where distributions keep the installer or live kernel
+// and its initramfs, for ISOs whose boot menus cannot be used.
+var knownKernels = []struct {
+	kernel string
+	initrd []string
+}{
+	{"casper/vmlinuz", []string{"casper/initrd", "casper/initrd.lz", "casper/initrd.gz"}},
+	{"live/vmlinuz", []string{"live/initrd.img"}},
+	{"install.amd/vmlinuz", []string{"install.amd/initrd.gz"}},
+	{"install/vmlinuz", []string{"install/initrd.gz"}},
+	{"images/pxeboot/vmlinuz", []string{"images/pxeboot/initrd.img"}},
+	{"isolinux/vmlinuz", []string{"isolinux/initrd.img"}},
+	{"boot/x86_64/loader/linux", []string{"boot/x86_64/loader/initrd"}},
+	{"arch/boot/x86_64/vmlinuz-linux", []string{"arch/boot/x86_64/initramfs-linux.img"}},
+	{"boot/vmlinuz-lts", []string{"boot/initramfs-lts"}},
+}
+
+// KernelOptions selects what Manager.ExtractKernel copies.
+type KernelOptions struct {
+	// Entry is the label of the boot menu entry to take the kernel from, as
+	// boot-entries prints it. Empty takes the first entry whose kernel is on
+	// the ISO.
+	Entry string
+}
+
+// KernelManifest describes a kernel and initramfs copied out of an ISO for
+// booting them directly, such as with qemu -kernel, -initrd and -append.
+type KernelManifest struct {
+	ISO string `json:"iso"`
+	// Entry is the boot menu entry the files and command line come from, or
+	// empty when they were found at a known path.
+	Entry string `json:"entry,omitempty"`
+	// Source is the configuration file defining Entry, or "known path".
+	Source string `json:"source"`
+	// Kernel and Initrd are the copied files, relative to the output
+	// directory; ISOKernel and ISOInitrd are where they are on the ISO.
+	Kernel    string   `json:"kernel"`
+	Initrd    []string `json:"initrd"`
+	ISOKernel string   `json:"iso_kernel"`
+	ISOInitrd []string `json:"iso_initrd"`
+	// Cmdline is the kernel command line of the entry. For files found at
+	// a known path it is that of the first entry loading a kernel or
+	// initramfs from the same directory, or empty when there is none.
+	Cmdline string `json:"cmdline"`
+	// Warnings explains an empty Cmdline that may not boot the system.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ExtractKernel copies the kernel and initramfs of the chosen ISO into dst,
+// creating it if needed, and writes a KernelManifest there. The files are
+// found through the GRUB and ISOLINUX menus, falling back to the paths
+// distributions are known to use. Nothing is mounted, existing files are not
+// overwritten, and the whole extraction is bounded by the Inspect timeout.
+func (m *Manager) ExtractKernel(ctx context.Context, choice int, dst string, opts KernelOptions) (KernelManifest, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return KernelManifest{}, err
+	}
+	if m.isDryRun() {
+		return KernelManifest{}, errors.New("kernel cannot be done as a dry run")
+	}
+	lock, err := m.lock(ctx, dst)
+	if err != nil {
+		return KernelManifest{}, err
+	}
+	defer lock.Release()
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	return runBlocking(ctx, "extract the kernel of "+m.Path(iso), func() (KernelManifest, error) {
+		d, err := openISO(m.fsys, iso.Name)
+		if err != nil {
+			return KernelManifest{}, err
+		}
+		defer d.Close()
+		manifest, err := findKernel(d.FS, opts)
+		if err != nil {
+			return KernelManifest{}, fmt.Errorf("%s: %w", iso.Name, err)
+		}
+		manifest.ISO = iso.Name
+
+		if err := os.MkdirAll(dst, 0o755); err != nil {
+			return KernelManifest{}, err
+		}
+		used := make(map[string]bool)
+		target := func(name string) (string, error) {
+			base := path.Base(name)
+			if used[base] {
+				return "", fmt.Errorf("%s and another file to extract are both named %s", name, base)
+			}
+			used[base] = true
+			return base, nil
+		}
+		if manifest.Kernel, err = target(manifest.ISOKernel); err != nil {
+			return KernelManifest{}, err
+		}
+		manifest.Initrd = make([]string, len(manifest.ISOInitrd))
+		for i, name := range manifest.ISOInitrd {
+			if manifest.Initrd[i], err = target(name); err != nil {
+				return KernelManifest{}, err
+			}
+		}
+		if err := copyFileOut(ctx, d.FS, manifest.ISOKernel, filepath.Join(dst, manifest.Kernel)); err != nil {
+			return KernelManifest{}, err
+		}
+		for i, name := range manifest.ISOInitrd {
+			if err := copyFileOut(ctx, d.FS, name, filepath.Join(dst, manifest.Initrd[i])); err != nil {
+				return KernelManifest{}, err
+			}
+		}
+
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return KernelManifest{}, err
+		}
+		err = createFile(ctx, "write "+KernelManifestName, filepath.Join(dst, KernelManifestName), 0o644, func(w io.Writer) error {
+			_, err := w.Write(append(data, '\n'))
+			return err
+		})
+		return manifest, err
+	})
+}
+
+// findKernel picks the kernel, initramfs and command line to extract from
+// the ISO tree fsys.
+func findKernel(fsys fs.FS, opts KernelOptions) (KernelManifest, error) {
+	entries, err := bootcfg.Parse(fsys)
+	if err != nil && !errors.Is(err, bootcfg.ErrNoConfig) {
+		return KernelManifest{}, err
+	}
+	for _, entry := range entries {
+		if opts.Entry != "" && entry.Label != opts.Entry {
+			continue
+		}
+		if !isRegularFile(fsys, entry.Kernel) || strings.HasSuffix(entry.Kernel, ".c32") {
+			if opts.Entry != "" {
+				return KernelManifest{}, fmt.Errorf("boot entry %q does not boot a Linux kernel on the ISO", opts.Entry)
+			}
+			continue
+		}
+		if missing := slices.IndexFunc(entry.Initrd, func(name string) bool { return !isRegularFile(fsys, name) }); missing >= 0 {
+			if opts.Entry != "" {
+				return KernelManifest{}, fmt.Errorf("initrd %s of boot entry %q: %w", entry.Initrd[missing], entry.Label, fs.ErrNotExist)
+			}
+			continue
+		}
+		return KernelManifest{
+			Entry:     entry.Label,
+			Source:    entry.Config,
+			ISOKernel: entry.Kernel,
+			ISOInitrd: append([]string{}, entry.Initrd...),
+			Cmdline:   entry.Append,
+		}, nil
+	}
+	if opts.Entry != "" {
+		return KernelManifest{}, &NotFoundError{Kind: "boot entry", Name: opts.Entry}
+	}
+
+	for _, known := range knownKernels {
+		if !isRegularFile(fsys, known.kernel) {
+			continue
+		}
+		dir := path.Dir(known.kernel)
+		i := slices.IndexFunc(entries, func(e bootcfg.Entry) bool {
+			return path.Dir(e.Kernel) == dir || slices.ContainsFunc(e.Initrd, func(name string) bool { return path.Dir(name) == dir })
+		})
+		manifest := KernelManifest{Source: kernelSourceKnownPath, ISOKernel: known.kernel, ISOInitrd: []string{}}
+		if i >= 0 {
+			manifest.Cmdline = entries[i].Append
+		} else {
+			manifest.Warnings = append(manifest.Warnings, fmt.Sprintf("no boot entry loads a kernel or initrd from %s, so the command line is empty; pass the one the system needs to boot", dir))
+		}
+		for _, initrd := range known.initrd {
+			if isRegularFile(fsys, initrd) {
+				manifest.ISOInitrd = append(manifest.ISOInitrd, initrd)
+				break
+			}
+		}
+		return manifest, nil
+	}
+	return KernelManifest{}, errors.New("no Linux kernel found in the boot menus or at known paths")
+}
+
+func isRegularFile(fsys fs.FS, name string) bool {
+	if name == "" {
+		return false
+	}
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,123 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// kernelLibrary is an ISO with boot menus, one whose menu names an initrd
+// the ISO lacks, so its kernel is found at a known path, and one without
+// menus.
+func kernelLibrary() map[string]isotest.ISO {
+	return map[string]isotest.ISO{
+		"noble.iso": {RockRidge: true, Files: []isotest.File{
+			isotest.Text("boot/grub/grub.cfg", `menuentry "Boot from next volume" { exit 1; }
+menuentry "Try or Install Ubuntu" {
+	linux /casper/vmlinuz quiet splash ---
+	initrd /casper/initrd
+}
+menuentry "Missing initrd" {
+	linux /casper/vmlinuz
+	initrd /casper/gone
+}
+`),
+			isotest.Text("isolinux/isolinux.cfg", "label safe\n  menu label Safe graphics\n  kernel /casper/vmlinuz\n  append initrd=/casper/initrd,/casper/ucode.img nomodeset\n"),
+			isotest.Text("casper/vmlinuz", "kernel"),
+			isotest.Text("casper/initrd", "initrd"),
+			isotest.Text("casper/ucode.img", "ucode"),
+		}},
+		"fedora.iso": {RockRidge: true, Files: []isotest.File{
+			isotest.Text("EFI/BOOT/grub.cfg", "menuentry 'Install Fedora 40' {\n\tlinux /images/pxeboot/vmlinuz inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet\n\tinitrd /images/pxeboot/initrd.img.gone\n}\n"),
+			isotest.Text("images/pxeboot/vmlinuz", "fedora kernel"),
+			isotest.Text("images/pxeboot/initrd.img", "fedora initrd"),
+		}},
+		"plain.iso": {RockRidge: true, Files: []isotest.File{
+			isotest.Text("images/pxeboot/vmlinuz", "kernel"),
+		}},
+	}
+}
+
+func TestRunCLIKernel(t *testing.T) {
+	manager := newTestManager(t, kernelLibrary())
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+	readManifest := func(dir string) KernelManifest {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, KernelManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest KernelManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatalf("manifest %s: %v", data, err)
+		}
+		return manifest
+	}
+
+	out := filepath.Join(t.TempDir(), "noble")
+	code, stdout, stderr := run("kernel", "2", "--out", out)
+	if code != ExitOK || !strings.Contains(stdout, "Command line: quiet splash ---\n") {
+		t.Fatalf("kernel noble: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	want := KernelManifest{
+		ISO:       "noble.iso",
+		Entry:     "Try or Install Ubuntu",
+		Source:    "boot/grub/grub.cfg",
+		Kernel:    "vmlinuz",
+		Initrd:    []string{"initrd"},
+		ISOKernel: "casper/vmlinuz",
+		ISOInitrd: []string{"casper/initrd"},
+		Cmdline:   "quiet splash ---",
+	}
+	if got := readManifest(out); !reflect.DeepEqual(got, want) {
+		t.Fatalf("manifest = %+v, want %+v", got, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(out, "vmlinuz")); err != nil || string(data) != "kernel" {
+		t.Fatalf("vmlinuz = %q, %v", data, err)
+	}
+	if code, _, stderr = run("kernel", "2", "--out", out); code == ExitOK || !strings.Contains(stderr, "exists") {
+		t.Fatalf("kernel into a filled directory: exit %d, stderr %q", code, stderr)
+	}
+
+	out = filepath.Join(t.TempDir(), "safe")
+	if code, _, stderr = run("kernel", "--entry", "Safe graphics", "--out", out, "2"); code != ExitOK {
+		t.Fatalf("kernel --entry: exit %d, stderr %q", code, stderr)
+	}
+	if got := readManifest(out); got.Cmdline != "nomodeset" || strings.Join(got.Initrd, ",") != "initrd,ucode.img" {
+		t.Fatalf("manifest of Safe graphics = %+v", got)
+	}
+	for entry, exit := range map[string]int{"Missing initrd": ExitNotFound, "Boot from next volume": ExitFailure, "Nope": ExitNotFound} {
+		if code, _, stderr = run("kernel", "--entry", entry, "--out", t.TempDir(), "2"); code != exit {
+			t.Fatalf("kernel --entry %q: exit %d, want %d; stderr %q", entry, code, exit, stderr)
+		}
+	}
+
+	out = filepath.Join(t.TempDir(), "fedora")
+	if code, _, stderr = run("kernel", "1", "--out", out); code != ExitOK {
+		t.Fatalf("kernel fedora: exit %d, stderr %q", code, stderr)
+	}
+	if got := readManifest(out); got.Source != "known path" || got.Kernel != "vmlinuz" || strings.Join(got.Initrd, ",") != "initrd.img" || got.Entry != "" || got.Cmdline != "inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet" {
+		t.Fatalf("manifest of fedora = %+v", got)
+	}
+	out = filepath.Join(t.TempDir(), "plain")
+	if code, _, stderr = run("kernel", "3", "--out", out); code != ExitOK || !strings.Contains(stderr, "warning: no boot entry loads a kernel or initrd from images/pxeboot") {
+		t.Fatalf("kernel of an ISO without menus: exit %d, stderr %q", code, stderr)
+	}
+	if got := readManifest(out); got.Source != "known path" || got.Cmdline != "" || len(got.Warnings) != 1 {
+		t.Fatalf("manifest of plain = %+v", got)
+	}
+
+	if code, _, _ = run("kernel", "2"); code != ExitUsage {
+		t.Fatalf("kernel without --out: exit %d, want %d", code, ExitUsage)
+	}
+}
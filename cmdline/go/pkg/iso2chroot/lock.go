@@ -0,0 +1,395 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+)
+
+const (
+	lockFileVersion = 1
+	lockFileSuffix  = ".lock"
+	dpkgStatusPath  = "var/lib/dpkg/status"
+	// rpmQueryFormat prints each package as its name and version, the
+	// version written as dpkg writes it: the epoch only when there is one.
+	rpmQueryFormat = `%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\n`
+)
+
+// rpmDBDirs are the places an rpm database lives in a root filesystem, the
+// newer first.
+var rpmDBDirs = []string{"usr/lib/sysimage/rpm", "var/lib/rpm"}
+
+// errPackagesUnavailable reports a package database this host cannot read,
+// such as an rpm database where the rpm command is not installed.
+var errPackagesUnavailable = errors.New("packages not recorded")
+
+// Version identifies the iso2chroot build and is recorded in lock files.
+// Release builds override it with -ldflags "-X ...iso2chroot.Version=...".
+var Version = "dev"
+
+// LockISO identifies the exact ISO image a chroot was built from.
+type LockISO struct {
+	Name        string `json:"name"`
+	SHA256      string `json:"sha256"`
+	VolumeLabel string `json:"volume_label"`
+}
+
+// LockPackage records a package version found in the resulting chroot.
+type LockPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// LockFile records the inputs of a chroot build so it can be reproduced elsewhere.
+type LockFile struct {
+	FormatVersion int           `json:"format_version"`
+	ToolVersion   string        `json:"tool_version"`
+	ISO           LockISO       `json:"iso"`
+	Steps         []string      `json:"steps"`
+	Packages      []LockPackage `json:"packages,omitempty"`
+	// PackagesUnavailable, when set, says why Packages could not be listed.
+	PackagesUnavailable string `json:"packages_unavailable,omitempty"`
+}
+
+// DefaultLockPath returns the lock file location used for a mount directory.
+func DefaultLockPath(mountDir string) string {
+	return filepath.Clean(mountDir) + lockFileSuffix
+}
+
+// LockInputs computes the lock entries that identify a build of the chosen ISO
+// performed with the provided steps. Packages are read from the live root
+// filesystem inside the ISO, and are left empty when it has none; when this
+// host cannot read its package database, PackagesUnavailable says why. The
+// ISO is not hashed in dry-run mode. Hashing and reading the image are
+// bounded by the Inspect timeout.
+func (m *Manager) LockInputs(ctx context.Context, choice int, steps []string) (LockFile, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return LockFile{}, err
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	isoFile := m.Path(iso)
+	var sum string
+	if !m.isDryRun() {
+		sum, err = runBlocking(ctx, "hash "+isoFile, func() (string, error) {
+			return fileSHA256(ctx, m.fsys, iso.Name)
+		})
+		if err != nil {
+			return LockFile{}, err
+		}
+	}
+	label, err := runBlocking(ctx, "read "+isoFile, func() (string, error) {
+		return volumeLabel(m.fsys, iso.Name)
+	})
+	if err != nil && !errors.Is(err, errNoVolumeLabel) {
+		return LockFile{}, err
+	}
+	packages, err := runBlocking(ctx, "read packages in "+isoFile, func() ([]LockPackage, error) {
+		return imagePackages(ctx, m.fsys, iso.Name)
+	})
+	var unavailable string
+	if errors.Is(err, errPackagesUnavailable) {
+		unavailable, err = err.Error(), nil
+	}
+	if err != nil {
+		return LockFile{}, err
+	}
+
+	return LockFile{
+		FormatVersion: lockFileVersion,
+		ToolVersion:   Version,
+		ISO: LockISO{
+			Name:        iso.Name,
+			SHA256:      sum,
+			VolumeLabel: label,
+		},
+		Steps:               append([]string(nil), steps...),
+		Packages:            packages,
+		PackagesUnavailable: unavailable,
+	}, nil
+}
+
+// ReadLockFile loads a lock file from disk.
+func ReadLockFile(path string) (LockFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LockFile{}, fmt.Errorf("read lock file: %w", err)
+	}
+	var lock LockFile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return LockFile{}, fmt.Errorf("parse lock file %s: %w", path, err)
+	}
+	if lock.FormatVersion != lockFileVersion {
+		return LockFile{}, fmt.Errorf("lock file %s: unsupported format version %d", path, lock.FormatVersion)
+	}
+	return lock, nil
+}
+
+// WriteLockFile stores the lock file at path, replacing any previous contents.
+func WriteLockFile(path string, lock LockFile) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode lock file: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("prepare lock dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write lock file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write lock file: %w", err)
+	}
+	return nil
+}
+
+// VerifyInputs compares the build inputs recorded in l against current and
+// returns an error describing every difference, including each package
+// added, removed or at another version. Packages that either side could not
+// list cannot be compared, which is a difference too. An ISO hash missing
+// from current, as in a dry run, is not compared.
+func (l LockFile) VerifyInputs(current LockFile) error {
+	var diffs []string
+	check := func(field, want, got string) {
+		if want != got {
+			diffs = append(diffs, fmt.Sprintf("%s: lock has %q, found %q", field, want, got))
+		}
+	}
+
+	check("tool version", l.ToolVersion, current.ToolVersion)
+	check("iso name", l.ISO.Name, current.ISO.Name)
+	if current.ISO.SHA256 != "" {
+		check("iso sha256", l.ISO.SHA256, current.ISO.SHA256)
+	}
+	check("iso volume label", l.ISO.VolumeLabel, current.ISO.VolumeLabel)
+	check("steps", strings.Join(l.Steps, ","), strings.Join(current.Steps, ","))
+
+	switch {
+	case l.PackagesUnavailable != "":
+		diffs = append(diffs, "packages: the lock records none to compare: "+l.PackagesUnavailable)
+	case current.PackagesUnavailable != "":
+		diffs = append(diffs, "packages: cannot compare with the lock: "+current.PackagesUnavailable)
+	default:
+		diffs = append(diffs, packageDiffs(l.Packages, current.Packages)...)
+	}
+
+	if len(diffs) == 0 {
+		return nil
+	}
+	return &MismatchError{Diffs: diffs}
+}
+
+// packageDiffs describes each package added, removed or at another version
+// between the packages of a lock and those found.
+func packageDiffs(lockedPackages, foundPackages []LockPackage) []string {
+	var diffs []string
+	locked, found := packageVersions(lockedPackages), packageVersions(foundPackages)
+	for _, name := range sortedKeys(locked, found) {
+		want, inLock := locked[name]
+		got, isFound := found[name]
+		switch {
+		case !isFound:
+			diffs = append(diffs, fmt.Sprintf("package %s: lock has %q, not installed", name, want))
+		case !inLock:
+			diffs = append(diffs, fmt.Sprintf("package %s: not in lock, found %q", name, got))
+		case want != got:
+			diffs = append(diffs, fmt.Sprintf("package %s: lock has %q, found %q", name, want, got))
+		}
+	}
+	return diffs
+}
+
+// packageVersions maps package names to their versions. A name installed more
+// than once, as for several architectures, maps to all its versions.
+func packageVersions(packages []LockPackage) map[string]string {
+	versions := make(map[string]string, len(packages))
+	for _, p := range packages {
+		if v, ok := versions[p.Name]; ok {
+			versions[p.Name] = v + ", " + p.Version
+			continue
+		}
+		versions[p.Name] = p.Version
+	}
+	return versions
+}
+
+func sortedKeys(maps ...map[string]string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, m := range maps {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// imagePackages lists the packages installed in the live root filesystem of
+// the ISO named name in fsys. ISOs without one, and files the built-in readers
+// do not recognise as an ISO, yield no packages.
+func imagePackages(ctx context.Context, fsys fs.FS, name string) ([]LockPackage, error) {
+	disc, err := openISO(fsys, name)
+	if errors.Is(err, iso9660.ErrNotISO9660) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer disc.Close()
+	rootfs, _, err := openRootFS(disc.FS, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return installedPackages(ctx, rootfs)
+}
+
+// installedPackages lists the packages installed in the root filesystem
+// fsys, from its dpkg status file or else its rpm database. Roots with neither
+// yield no packages.
+func installedPackages(ctx context.Context, fsys fs.FS) ([]LockPackage, error) {
+	f, err := fsys.Open(dpkgStatusPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rpmPackages(ctx, fsys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read package database: %w", err)
+	}
+	defer f.Close()
+	packages, err := dpkgPackages(f)
+	if err != nil {
+		return nil, fmt.Errorf("read package database: %w", err)
+	}
+	sortPackages(packages)
+	return packages, nil
+}
+
+// dpkgPackages reads the installed packages from a dpkg status file.
+func dpkgPackages(r io.Reader) ([]LockPackage, error) {
+	var (
+		packages []LockPackage
+		current  LockPackage
+		status   string
+	)
+	flush := func() {
+		if current.Name != "" && strings.HasSuffix(status, " installed") {
+			packages = append(packages, current)
+		}
+		current, status = LockPackage{}, ""
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, " ") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Status":
+			status = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return packages, nil
+}
+
+// rpmPackages lists the packages in the rpm database of fsys with the rpm
+// command. The database is copied out first, as it may live inside an image
+// rather than on disk. Without the rpm command the error wraps
+// errPackagesUnavailable.
+func rpmPackages(ctx context.Context, fsys fs.FS) ([]LockPackage, error) {
+	for _, dir := range rpmDBDirs {
+		entries, err := fs.ReadDir(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && len(entries) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read rpm database: %w", err)
+		}
+		dbPath, err := os.MkdirTemp("", "iso2chroot-rpmdb-")
+		if err != nil {
+			return nil, fmt.Errorf("read rpm database: %w", err)
+		}
+		defer os.RemoveAll(dbPath)
+		for _, e := range entries {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			if err := copyFileOut(ctx, fsys, path.Join(dir, e.Name()), filepath.Join(dbPath, e.Name())); err != nil {
+				return nil, fmt.Errorf("read rpm database: %w", err)
+			}
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "rpm", "--dbpath", dbPath, "--query", "--all", "--queryformat", rpmQueryFormat)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%w: reading the rpm database /%s needs the rpm command, which is not installed", errPackagesUnavailable, dir)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError("read rpm database /"+dir, ctx)
+			}
+			return nil, fmt.Errorf("read rpm database /%s: %w: %s", dir, err, strings.TrimSpace(stderr.String()))
+		}
+		var packages []LockPackage
+		for line := range strings.Lines(string(out)) {
+			name, version, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+			if ok && name != "gpg-pubkey" {
+				packages = append(packages, LockPackage{Name: name, Version: version})
+			}
+		}
+		sortPackages(packages)
+		return packages, nil
+	}
+	return nil, nil
+}
+
+func sortPackages(packages []LockPackage) {
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+}
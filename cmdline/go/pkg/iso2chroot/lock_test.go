@@ -0,0 +1,98 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestInstalledPackages(t *testing.T) {
+	status := `Package: zlib1g
+Status: install ok installed
+Version: 1:1.3.dfsg-3
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Description: GNU Bourne Again SHell
+ Version: not a field
+Version: 5.2.21-2
+`
+	got, err := installedPackages(context.Background(), fstest.MapFS{dpkgStatusPath: {Data: []byte(status)}})
+	if err != nil {
+		t.Fatalf("installedPackages() error = %v", err)
+	}
+	want := []LockPackage{{Name: "bash", Version: "5.2.21-2"}, {Name: "zlib1g", Version: "1:1.3.dfsg-3"}}
+	if len(got) != len(want) {
+		t.Fatalf("installedPackages() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("installedPackages()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestInstalledPackagesWithoutRPM(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	_, err := installedPackages(context.Background(), fstest.MapFS{"usr/lib/sysimage/rpm/rpmdb.sqlite": {Data: []byte("db")}})
+	if !errors.Is(err, errPackagesUnavailable) || !strings.Contains(err.Error(), "rpm command") {
+		t.Fatalf("installedPackages() error = %v, want %v", err, errPackagesUnavailable)
+	}
+
+	unavailable := LockFile{PackagesUnavailable: err.Error()}
+	if err := unavailable.VerifyInputs(LockFile{}); err == nil || !strings.Contains(err.Error(), "the lock records none") {
+		t.Fatalf("VerifyInputs() of a lock without packages = %v, want a difference", err)
+	}
+}
+
+func TestLockFileVerifyInputs(t *testing.T) {
+	base := LockFile{
+		FormatVersion: lockFileVersion,
+		ToolVersion:   "1.0.0",
+		ISO:           LockISO{Name: "a.iso", SHA256: "abc", VolumeLabel: "Ubuntu"},
+		Steps:         []string{"prepare-mount-dir", "mount-iso-ro"},
+		Packages:      []LockPackage{{Name: "apt", Version: "2.7.14"}, {Name: "bash", Version: "5.2.21-2"}},
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*LockFile)
+		wantErr string
+	}{
+		{name: "identical", mutate: func(*LockFile) {}},
+		{name: "package version", mutate: func(l *LockFile) { l.Packages[1].Version = "5.2.21-3" }, wantErr: `package bash: lock has "5.2.21-2", found "5.2.21-3"`},
+		{name: "package added", mutate: func(l *LockFile) { l.Packages = append(l.Packages, LockPackage{Name: "zsh", Version: "5.9"}) }, wantErr: `package zsh: not in lock`},
+		{name: "package removed", mutate: func(l *LockFile) { l.Packages = l.Packages[:1] }, wantErr: `package bash: lock has "5.2.21-2", not installed`},
+		{name: "tool version", mutate: func(l *LockFile) { l.ToolVersion = "2.0.0" }, wantErr: "tool version"},
+		{name: "checksum", mutate: func(l *LockFile) { l.ISO.SHA256 = "def" }, wantErr: "iso sha256"},
+		{name: "label", mutate: func(l *LockFile) { l.ISO.VolumeLabel = "Debian" }, wantErr: "iso volume label"},
+		{name: "steps", mutate: func(l *LockFile) { l.Steps = l.Steps[:1] }, wantErr: "steps"},
+		{name: "packages unavailable", mutate: func(l *LockFile) { l.Packages, l.PackagesUnavailable = nil, "no rpm" }, wantErr: "packages: cannot compare with the lock: no rpm"},
+		{name: "not hashed in a dry run", mutate: func(l *LockFile) { l.ISO.SHA256 = "" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := base
+			current.Steps = append([]string(nil), base.Steps...)
+			current.Packages = append([]LockPackage(nil), base.Packages...)
+			tt.mutate(&current)
+			err := base.VerifyInputs(current)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyInputs() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyInputs() error = %v, want mention of %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,24 +1,23 @@
 package iso2chroot
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-const defaultMountDir = "/tmp/iso2chroot"
-
-var mountFunc = func(isoFile, dstDir string) error {
-	cmd := exec.Command("sudo", "mount", "-o", "loop,ro", isoFile, dstDir)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mount ISO: %w: %s", err, strings.TrimSpace(string(output)))
-	}
-	return nil
-}
+const (
+	defaultMountDir     = "/tmp/iso2chroot"
+	defaultInstanceRoot = "/tmp/iso2chroot.d"
+)
 
 // ISOInfo represents a single ISO entry.
 type ISOInfo struct {
@@ -32,18 +31,42 @@ type ListResult struct {
 }
 
 // Manager encapsulates ISO discovery using slice and map structures.
+// Chroot instances are tracked separately from the ISO catalog built by Load.
+// A Manager is safe for concurrent use: Load may refresh the catalog while
+// other goroutines read it.
 type Manager struct {
-	dir         string
-	isoByChoice map[int]ISOInfo
-	ordered     []ISOInfo
+	dir  string
+	fsys fs.FS
+
+	mu           sync.RWMutex
+	isoByChoice  map[int]ISOInfo
+	ordered      []ISOInfo
+	mounter      Mounter
+	instanceRoot string
+	instances    map[string]Instance
+	lockWait     time.Duration
+	dryRun       bool
+	timeouts     Timeouts
 }
 
 // NewManager constructs a Manager rooted at the provided directory.
 func NewManager(dir string) *Manager {
+	return NewManagerFS(dir, os.DirFS(dir))
+}
+
+// NewManagerFS constructs a Manager that discovers and reads ISOs through fsys
+// instead of the disk. dir is where the same ISOs live on disk; it appears in
+// messages and is what privileged commands such as mount are given.
+func NewManagerFS(dir string, fsys fs.FS) *Manager {
 	return &Manager{
-		dir:         dir,
-		isoByChoice: make(map[int]ISOInfo),
-		ordered:     make([]ISOInfo, 0),
+		dir:          dir,
+		fsys:         fsys,
+		isoByChoice:  make(map[int]ISOInfo),
+		ordered:      make([]ISOInfo, 0),
+		mounter:      sudoMounter{},
+		instanceRoot: defaultInstanceRoot,
+		instances:    make(map[string]Instance),
+		timeouts:     DefaultTimeouts,
 	}
 }
 
@@ -52,87 +75,184 @@ func (m *Manager) Directory() string {
 	return m.dir
 }
 
-// Load refreshes ISO entries, populating internal slices and maps.
-func (m *Manager) Load() (ListResult, error) {
-	entries, err := os.ReadDir(m.dir)
+// Load refreshes ISO entries, populating internal slices and maps. Reading the
+// directory is bounded by the Load timeout.
+func (m *Manager) Load(ctx context.Context) (ListResult, error) {
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Load)
+	defer cancel()
+	entries, err := runBlocking(ctx, "read "+m.dir, func() ([]fs.DirEntry, error) {
+		return fs.ReadDir(m.fsys, ".")
+	})
 	if err != nil {
+		if errors.Is(err, ErrCancelled) || errors.Is(err, ErrTimeout) {
+			return ListResult{}, err
+		}
 		return ListResult{}, fmt.Errorf("read %s: %w", m.dir, err)
 	}
 
-	isoEntries := make([]os.DirEntry, 0, len(entries))
+	isoEntries := make([]fs.DirEntry, 0, len(entries))
 	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+		if isISOEntry(entry) {
+			isoEntries = append(isoEntries, entry)
 		}
-		if !strings.HasSuffix(strings.ToLower(entry.Name()), ".iso") {
-			continue
-		}
-		isoEntries = append(isoEntries, entry)
-	}
-
-	if len(isoEntries) == 0 {
-		m.isoByChoice = make(map[int]ISOInfo)
-		m.ordered = m.ordered[:0]
-		return ListResult{
-			Display: fmt.Sprintf("No ISO files found in %s", m.dir),
-			Count:   0,
-		}, nil
-	}
-
-	m.isoByChoice = make(map[int]ISOInfo, len(isoEntries))
-	if cap(m.ordered) < len(isoEntries) {
-		m.ordered = make([]ISOInfo, 0, len(isoEntries))
-	} else {
-		m.ordered = m.ordered[:0]
 	}
 
 	sort.Slice(isoEntries, func(i, j int) bool {
 		return isoEntries[i].Name() < isoEntries[j].Name()
 	})
 
+	// Build the new catalog aside and swap it in, so concurrent readers see
+	// either the old or the new one.
+	isoByChoice := make(map[int]ISOInfo, len(isoEntries))
+	ordered := make([]ISOInfo, 0, len(isoEntries))
 	var b strings.Builder
 	for i, entry := range isoEntries {
 		info := ISOInfo{Name: entry.Name()}
-		m.ordered = append(m.ordered, info)
+		ordered = append(ordered, info)
 		index := i + 1
-		m.isoByChoice[index] = info
+		isoByChoice[index] = info
 		fmt.Fprintf(&b, "%2d. %s\n", index, info.Name)
 	}
 
+	m.mu.Lock()
+	m.isoByChoice = isoByChoice
+	m.ordered = ordered
+	m.mu.Unlock()
+
+	if len(ordered) == 0 {
+		return ListResult{
+			Display: fmt.Sprintf("No ISO files found in %s", m.dir),
+			Count:   0,
+		}, nil
+	}
 	return ListResult{
 		Display: b.String(),
-		Count:   len(m.ordered),
+		Count:   len(ordered),
 	}, nil
 }
 
-func (m *Manager) Mount(choice int, dstDir string) error {
-	iso, err := m.Select(choice)
-	if err != nil {
-		return err
-	}
+// isISOEntry reports whether a directory entry is an ISO image: a non-directory
+// whose name ends in .iso, in any case.
+func isISOEntry(entry fs.DirEntry) bool {
+	return !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".iso")
+}
+
+// Mount attaches the chosen ISO read-only at dstDir once Preflight finds the
+// target safe to use. A failed mount leaves no newly created directory behind.
+func (m *Manager) Mount(ctx context.Context, choice int, dstDir string) error {
+	_, err := m.Create(ctx, CreateRequest{Choice: choice, MountDir: dstDir})
+	return err
+}
 
-	if dstDir == "" {
-		dstDir = defaultMountDir
+// SetTimeouts replaces the per-operation timeouts.
+func (m *Manager) SetTimeouts(timeouts Timeouts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeouts = timeouts
+}
+
+// Timeouts returns the per-operation timeouts.
+func (m *Manager) Timeouts() Timeouts {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.timeouts
+}
+
+// SetLockWait sets how long mutating operations wait for a lock held by another
+// process before failing. Zero fails immediately.
+func (m *Manager) SetLockWait(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lockWait = wait
+}
+
+// SetMounter replaces the Mounter used for privileged operations.
+func (m *Manager) SetMounter(mounter Mounter) {
+	if mounter == nil {
+		mounter = sudoMounter{}
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mounter = mounter
+}
+
+// SetDryRun makes the manager skip every side effect that does not go through
+// its Mounter: advisory locks, registry writes and lock files. Combined with a
+// Recorder it turns mutating operations into a reviewable plan.
+func (m *Manager) SetDryRun(dryRun bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dryRun = dryRun
+}
 
-	if err := os.MkdirAll(dstDir, 0o755); err != nil {
-		return fmt.Errorf("prepare mount dir %s: %w", dstDir, err)
+// isDryRun reports whether SetDryRun is in effect.
+func (m *Manager) isDryRun() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dryRun
+}
+
+// privileged returns the Mounter to use for one operation, with each command
+// bounded by the Command timeout.
+func (m *Manager) privileged() Mounter {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return boundedMounter{Mounter: m.mounter, timeout: m.timeouts.Command}
+}
+
+// lock takes the advisory lock on target, or nothing in dry-run mode.
+func (m *Manager) lock(ctx context.Context, target string) (*pathLock, error) {
+	m.mu.RLock()
+	dryRun, wait := m.dryRun, m.lockWait
+	m.mu.RUnlock()
+	if dryRun {
+		return nil, nil
 	}
+	return acquireLock(ctx, target, wait)
+}
 
-	isoFile := filepath.Join(m.dir, iso.Name)
-	return mountFunc(isoFile, dstDir)
+// Path returns the location of the ISO image on disk.
+func (m *Manager) Path(iso ISOInfo) string {
+	return filepath.Join(m.dir, iso.Name)
 }
 
 // Select returns the ISO associated with the provided choice number.
 func (m *Manager) Select(choice int) (ISOInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	info, ok := m.isoByChoice[choice]
 	if !ok {
-		return ISOInfo{}, fmt.Errorf("choice %d not available", choice)
+		return ISOInfo{}, &NotFoundError{Kind: "choice", Name: strconv.Itoa(choice)}
 	}
 	return info, nil
 }
 
+// SelectName returns the choice number and entry of the ISO with the provided file name.
+func (m *Manager) SelectName(name string) (int, ISOInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i, info := range m.ordered {
+		if info.Name == name {
+			return i + 1, info, nil
+		}
+	}
+	return 0, ISOInfo{}, &NotFoundError{Kind: "ISO", Name: name, Dir: m.dir}
+}
+
+// Resolve returns the choice number and entry selected by selector, a choice
+// number as list prints it.
+func (m *Manager) Resolve(selector string) (int, ISOInfo, error) {
+	choice, err := strconv.Atoi(selector)
+	if err != nil {
+		return 0, ISOInfo{}, &NotFoundError{Kind: "choice", Name: selector}
+	}
+	info, err := m.Select(choice)
+	return choice, info, err
+}
+
 // EntryCount reports the number of cached ISO entries.
 func (m *Manager) EntryCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.ordered)
 }
@@ -1,23 +1,217 @@
 package iso2chroot
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"testing/fstest"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
 )
 
 func TestListISOsOnly(t *testing.T) {
-	// NOTE: Unit tests should not necessarily need to touch the filesystem - however, this will do for now.
-	// TODO: Calculate this dynamically
-	const numISO = 1
-	manager := NewManager("fixtures/isos")
-	res, err := manager.Load()
+	fsys := fstest.MapFS{
+		"test.iso":     {Data: []byte{}},
+		"UPPER.ISO":    {Data: []byte{}},
+		"test.foobar":  {Data: []byte{}},
+		"foo.iso.part": {Data: []byte{}},
+	}
+	manager := NewManagerFS("isos", fsys)
+	res, err := manager.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"UPPER.ISO", "test.iso"}
+	if res.Count != len(want) {
+		t.Fatalf("expected %v, got %v", len(want), res.Count)
+	}
+	for i, name := range want {
+		if iso, err := manager.Select(i + 1); err != nil || iso.Name != name {
+			t.Errorf("Select(%d) = %q, %v, want %q", i+1, iso.Name, err, name)
+		}
+	}
+}
+
+func TestLoadDiscovery(t *testing.T) {
+	tests := []struct {
+		name  string
+		fsys  fstest.MapFS
+		want  []string
+		empty bool
+	}{
+		{
+			name: "sorted by name",
+			fsys: fstest.MapFS{"c.iso": {}, "a.iso": {}, "b.iso": {}},
+			want: []string{"a.iso", "b.iso", "c.iso"},
+		},
+		{
+			name: "suffix is case-insensitive",
+			fsys: fstest.MapFS{"DEBIAN.ISO": {}, "ubuntu.Iso": {}},
+			want: []string{"DEBIAN.ISO", "ubuntu.Iso"},
+		},
+		{
+			name: "other files and directories are skipped",
+			fsys: fstest.MapFS{
+				"a.iso":         {},
+				"a.iso.sha256":  {},
+				"notes.txt":     {},
+				"dir.iso/x.iso": {},
+				"img":           {Mode: fs.ModeDir},
+			},
+			want: []string{"a.iso"},
+		},
+		{
+			name:  "no ISOs",
+			fsys:  fstest.MapFS{"readme": {}},
+			empty: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManagerFS("isos", tt.fsys)
+			res, err := manager.Load(context.Background())
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if res.Count != len(tt.want) || manager.EntryCount() != len(tt.want) {
+				t.Fatalf("Count = %d, EntryCount() = %d, want %d", res.Count, manager.EntryCount(), len(tt.want))
+			}
+			if tt.empty {
+				if res.Display != "No ISO files found in isos" {
+					t.Fatalf("Display = %q, want empty-directory message", res.Display)
+				}
+				return
+			}
+			for i, name := range tt.want {
+				iso, err := manager.Select(i + 1)
+				if err != nil || iso.Name != name {
+					t.Fatalf("Select(%d) = %q, %v, want %q", i+1, iso.Name, err, name)
+				}
+				if line := fmt.Sprintf("%2d. %s\n", i+1, name); !strings.Contains(res.Display, line) {
+					t.Fatalf("Display = %q, want line %q", res.Display, line)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMissingDirectory(t *testing.T) {
+	manager := NewManagerFS("isos", fstest.MapFS{})
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() of an empty FS error = %v", err)
+	}
+
+	manager = NewManager(filepath.Join(t.TempDir(), "missing"))
+	if _, err := manager.Load(context.Background()); !errors.Is(err, ErrNotFound) && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load() error = %v, want not found", err)
+	}
+}
+
+// primaryVolumeDescriptor returns the sector holding an ISO9660 primary volume
+// descriptor with the provided label, padded as mkisofs does.
+func primaryVolumeDescriptor(label string) []byte {
+	desc := make([]byte, isoSectorSize)
+	desc[0] = 1
+	copy(desc[1:6], "CD001")
+	copy(desc[40:72], fmt.Sprintf("%-32s", label))
+	return desc
+}
+
+func TestVolumeLabel(t *testing.T) {
+	image := func(desc []byte) []byte {
+		return append(make([]byte, isoPrimaryDescSector*isoSectorSize), desc...)
+	}
+	wrongType := primaryVolumeDescriptor("X")
+	wrongType[0] = 2
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{name: "label", data: image(primaryVolumeDescriptor("Ubuntu 22.04 LTS amd64")), want: "Ubuntu 22.04 LTS amd64"},
+		{name: "empty label", data: image(primaryVolumeDescriptor("")), want: ""},
+		{name: "full width", data: image(primaryVolumeDescriptor(strings.Repeat("L", 32))), want: strings.Repeat("L", 32)},
+		{name: "not a primary descriptor", data: image(wrongType), wantErr: errNoVolumeLabel},
+		{name: "no magic", data: image(make([]byte, isoSectorSize)), wantErr: errNoVolumeLabel},
+		{name: "truncated", data: make([]byte, isoPrimaryDescSector*isoSectorSize+10), wantErr: errNoVolumeLabel},
+		{name: "empty file", data: nil, wantErr: errNoVolumeLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"x.iso": {Data: tt.data}}
+			got, err := volumeLabel(fsys, "x.iso")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("volumeLabel() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("volumeLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockInputsReadsThroughFS(t *testing.T) {
+	data, err := isotest.ISO{VolumeID: "Debian 12", RockRidge: true, RootFS: liveRootFS()}.Bytes()
 	if err != nil {
-		t.Error(err)
+		t.Fatalf("generate ISO: %v", err)
+	}
+	manager := NewManagerFS("/srv/isos", fstest.MapFS{"debian.iso": {Data: data}})
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
 	}
 
-	if res.Count != numISO {
-		t.Errorf("expected %v, got %v", numISO, res.Count)
+	lock, err := manager.LockInputs(context.Background(), 1, createSteps)
+	if err != nil {
+		t.Fatalf("LockInputs() error = %v", err)
+	}
+	sum := sha256.Sum256(data)
+	want := LockISO{Name: "debian.iso", SHA256: hex.EncodeToString(sum[:]), VolumeLabel: "Debian 12"}
+	if lock.ISO != want {
+		t.Fatalf("LockInputs().ISO = %+v, want %+v", lock.ISO, want)
+	}
+	if len(lock.Packages) != 1 || lock.Packages[0] != (LockPackage{Name: "bash", Version: "5.2.21-2ubuntu4"}) {
+		t.Fatalf("LockInputs().Packages = %+v, want bash from the live root filesystem", lock.Packages)
+	}
+	manager.SetDryRun(true)
+	if lock, err := manager.LockInputs(context.Background(), 1, createSteps); err != nil || lock.ISO.SHA256 != "" {
+		t.Fatalf("LockInputs() in dry-run mode = %+v, %v; want no hash", lock.ISO, err)
+	}
+	if got := manager.Path(ISOInfo{Name: "debian.iso"}); got != "/srv/isos/debian.iso" {
+		t.Fatalf("Path() = %q, want the on-disk location", got)
+	}
+}
+
+func TestVolumeLabelGeneratedISO(t *testing.T) {
+	// A bootable image with Joliet carries a boot record and a supplementary
+	// descriptor besides the primary one.
+	dir := t.TempDir()
+	isotest.WriteISO(t, dir, "ubuntu.iso", isotest.ISO{
+		VolumeID:  "Ubuntu 24.04 LTS amd64",
+		RockRidge: true,
+		Joliet:    true,
+		DiskInfo:  "Ubuntu 24.04 LTS \"Noble Numbat\" - Release amd64",
+		Files:     []isotest.File{isotest.Text("isolinux/isolinux.bin", "bios")},
+		BIOSBoot:  "isolinux/isolinux.bin",
+	})
+	got, err := volumeLabel(os.DirFS(dir), "ubuntu.iso")
+	if err != nil {
+		t.Fatalf("volumeLabel() error = %v", err)
+	}
+	if got != "Ubuntu 24.04 LTS amd64" {
+		t.Fatalf("volumeLabel() = %q, want %q", got, "Ubuntu 24.04 LTS amd64")
 	}
 }
 
@@ -25,14 +219,23 @@ func TestMountISO(t *testing.T) {
 	if os.Geteuid() != 0 {
 		t.Skip("requires root privileges to mount an ISO")
 	}
+	if _, err := exec.LookPath("sudo"); err != nil {
+		t.Skip("requires sudo to mount an ISO")
+	}
 
-	manager := NewManager("fixtures/isos")
-	if _, err := manager.Load(); err != nil {
+	dir := t.TempDir()
+	isotest.WriteISO(t, dir, "test.iso", isotest.ISO{
+		VolumeID:  "TEST",
+		RockRidge: true,
+		DiskInfo:  "Test Linux 1.0",
+	})
+	manager := NewManager(dir)
+	if _, err := manager.Load(context.Background()); err != nil {
 		t.Fatalf("Load failed: %v", err)
 	}
 
 	mountDir := t.TempDir()
-	if err := manager.Mount(1, mountDir); err != nil {
+	if err := manager.Mount(context.Background(), 1, mountDir); err != nil {
 		t.Fatalf("Mount failed: %v", err)
 	}
 
@@ -42,7 +245,11 @@ func TestMountISO(t *testing.T) {
 		}
 	}()
 
-	if _, err := os.ReadDir(mountDir); err != nil {
-		t.Fatalf("ReadDir failed: %v", err)
+	info, err := os.ReadFile(filepath.Join(mountDir, ".disk", "info"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(info) != "Test Linux 1.0" {
+		t.Fatalf(".disk/info = %q, want %q", info, "Test Linux 1.0")
 	}
 }
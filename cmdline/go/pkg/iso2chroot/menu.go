@@ -1,6 +1,7 @@
 package iso2chroot
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,14 +11,26 @@ import (
 
 const isoStatusKey = "iso2chroot.selection"
 
+// MenuOptions configures the iso2chroot menu items.
+type MenuOptions struct {
+	// Context bounds the manager operations started from the menu. It
+	// defaults to context.Background(); the manager's timeouts still apply.
+	Context context.Context
+}
+
 // RegisterMenu wires iso2chroot interactions into the provided TUI menu.
-func RegisterMenu(menu *tui.Menu, manager *Manager) {
+func RegisterMenu(menu *tui.Menu, manager *Manager, opts MenuOptions) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	menu.SetStatus(isoStatusKey, "Selected ISO: (none)")
 	menu.AddItem(tui.MenuItem{
 		Key:   "1",
 		Label: "List ISOs",
 		Action: func(m *tui.Menu) (tui.InputHandler, error) {
-			result, err := manager.Load()
+			result, err := manager.Load(ctx)
 			if err != nil {
 				m.SetContent(fmt.Sprintf("Error: %v", err))
 				return nil, nil
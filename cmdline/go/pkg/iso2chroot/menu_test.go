@@ -26,7 +26,7 @@ func TestRegisterMenuSelection(t *testing.T) {
 	var output bytes.Buffer
 
 	menu := tui.NewMenu("iso2chroot — TUI", input, &output)
-	RegisterMenu(menu, manager)
+	RegisterMenu(menu, manager, MenuOptions{})
 
 	if err := menu.Run(); err != nil {
 		t.Fatalf("Run() error = %v", err)
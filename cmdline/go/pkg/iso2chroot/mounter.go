@@ -0,0 +1,159 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Mounter performs the privileged filesystem operations used to assemble,
+// enter and tear down a chroot. Implementations stop work and return an error
+// once ctx ends.
+type Mounter interface {
+	// Mkdir creates path and any missing parents.
+	Mkdir(ctx context.Context, path string) error
+	// Rmdir removes the empty directory at path.
+	Rmdir(ctx context.Context, path string) error
+	// RemoveAll removes path and everything below it without crossing into
+	// other filesystems.
+	RemoveAll(ctx context.Context, path string) error
+	// MountLoop attaches image read-only through a loop device at target.
+	// fstype names the filesystem to mount, or is empty to let mount detect it.
+	MountLoop(ctx context.Context, image, target, fstype string) error
+	// Bind bind-mounts source read-only at target.
+	Bind(ctx context.Context, source, target string) error
+	// MountOverlay mounts an overlay filesystem at target.
+	MountOverlay(ctx context.Context, lower, upper, work, target string) error
+	// Unmount detaches the filesystem mounted at target.
+	Unmount(ctx context.Context, target string) error
+	// Chroot runs argv inside root, attached to the terminal.
+	Chroot(ctx context.Context, root string, argv []string) error
+}
+
+var mountFunc = func(ctx context.Context, isoFile, dstDir, fstype string) error {
+	return runSudo(ctx, "mount ISO", append(mountTypeArgs(fstype), "-o", "loop,ro", isoFile, dstDir)...)
+}
+
+// mountTypeArgs returns the mount arguments that select fstype, starting with
+// the mount command itself.
+func mountTypeArgs(fstype string) []string {
+	if fstype == "" {
+		return []string{"mount"}
+	}
+	return []string{"mount", "-t", fstype}
+}
+
+// sudoMounter runs mount and umount through sudo.
+type sudoMounter struct{}
+
+func (sudoMounter) Mkdir(ctx context.Context, path string) error {
+	return os.MkdirAll(path, 0o755)
+}
+
+func (sudoMounter) Rmdir(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (sudoMounter) RemoveAll(ctx context.Context, path string) error {
+	// The overlay upper directory holds files owned by root, so removal needs sudo.
+	return runSudo(ctx, "remove", "rm", "-rf", "--one-file-system", "--", path)
+}
+
+func (sudoMounter) MountLoop(ctx context.Context, image, target, fstype string) error {
+	return mountFunc(ctx, image, target, fstype)
+}
+
+func (sudoMounter) Bind(ctx context.Context, source, target string) error {
+	return runSudo(ctx, "bind mount", "mount", "--bind", "-o", "ro", source, target)
+}
+
+func (sudoMounter) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	return runSudo(ctx, "mount overlay", "mount", "-t", "overlay", "overlay", "-o", overlayOptions(lower, upper, work), target)
+}
+
+func (sudoMounter) Unmount(ctx context.Context, target string) error {
+	return runSudo(ctx, "unmount", "umount", target)
+}
+
+func (sudoMounter) Chroot(ctx context.Context, root string, argv []string) error {
+	cmd := exec.CommandContext(ctx, "sudo", append([]string{"chroot", root}, argv...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return contextError("chroot "+root, ctx)
+		}
+		return fmt.Errorf("chroot %s: %w", root, err)
+	}
+	return nil
+}
+
+// boundedMounter gives each call to the wrapped Mounter its own timeout.
+// Chroot runs interactive sessions and is never bounded.
+type boundedMounter struct {
+	Mounter
+	timeout time.Duration
+}
+
+func (b boundedMounter) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := withTimeout(ctx, b.timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+func (b boundedMounter) Mkdir(ctx context.Context, path string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.Mkdir(ctx, path) })
+}
+
+func (b boundedMounter) Rmdir(ctx context.Context, path string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.Rmdir(ctx, path) })
+}
+
+func (b boundedMounter) RemoveAll(ctx context.Context, path string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.RemoveAll(ctx, path) })
+}
+
+func (b boundedMounter) MountLoop(ctx context.Context, image, target, fstype string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.MountLoop(ctx, image, target, fstype) })
+}
+
+func (b boundedMounter) Bind(ctx context.Context, source, target string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.Bind(ctx, source, target) })
+}
+
+func (b boundedMounter) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.MountOverlay(ctx, lower, upper, work, target) })
+}
+
+func (b boundedMounter) Unmount(ctx context.Context, target string) error {
+	return b.run(ctx, func(ctx context.Context) error { return b.Mounter.Unmount(ctx, target) })
+}
+
+func overlayOptions(lower, upper, work string) string {
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+}
+
+// runSudo runs a privileged command, killing it if ctx ends first.
+func runSudo(ctx context.Context, action string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "sudo", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(action, ctx)
+		}
+		var sudoErr error
+		if errors.As(err, new(*exec.ExitError)) {
+			sudoErr = sudoCheck(ctx)
+		}
+		return commandError(action, args[0], err, sudoErr, string(output))
+	}
+	return nil
+}
+
+// sudoCheck reports whether sudo can run commands without asking for a
+// password, so a failed command can be told apart from a refused sudo.
+var sudoCheck = func(ctx context.Context) error {
+	return exec.CommandContext(ctx, "sudo", "--non-interactive", "true").Run()
+}
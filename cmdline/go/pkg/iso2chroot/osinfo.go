@@ -0,0 +1,262 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+// Families of OSVariant.
+const (
+	FamilyLinux   = "linux"
+	FamilyWindows = "windows"
+)
+
+// Architectures of OSVariant, as libvirt names them.
+const (
+	ArchX86_64  = "x86_64"
+	ArchAArch64 = "aarch64"
+)
+
+// OSVariant is the operating system an ISO installs or boots, identified as
+// libosinfo does, which is what virt-install's --os-variant and the
+// libosinfo metadata of a libvirt domain take.
+type OSVariant struct {
+	// ShortID is the libosinfo short ID, such as "ubuntu24.04", and ID its
+	// URI, such as "http://ubuntu.com/ubuntu/24.04".
+	ShortID string
+	ID      string
+	// Name is the release as the ISO names it, such as "Ubuntu 24.04".
+	Name string
+	// Family is FamilyLinux or FamilyWindows.
+	Family string
+	// Arch is the architecture the ISO boots, or empty when it does not
+	// say.
+	Arch string
+}
+
+// genericLinux is the variant of ISOs whose distribution is not recognised.
+var genericLinux = OSVariant{ShortID: "linux2022", ID: "http://libosinfo.org/linux/2022", Name: "Linux", Family: FamilyLinux}
+
+// treeinfoDistros maps the release names of .treeinfo files to the
+// libosinfo short ID prefix and URI prefix of the distribution, and whether
+// its libosinfo versions carry the minor release.
+var treeinfoDistros = map[string]struct {
+	short, uri string
+	minor      bool
+}{
+	"Fedora":                   {"fedora", "http://fedoraproject.org/fedora/", false},
+	"Red Hat Enterprise Linux": {"rhel", "http://redhat.com/rhel/", true},
+	"CentOS Stream":            {"centos-stream", "http://centos.org/centos-stream/", false},
+	"Rocky Linux":              {"rocky", "http://rockylinux.org/rocky/", false},
+	"AlmaLinux":                {"almalinux", "http://almalinux.org/almalinux/", false},
+}
+
+var (
+	// diskInfoRelease matches the start of .disk/info on Debian and Ubuntu
+	// media, such as "Ubuntu-Server 24.04.1 LTS" or "Debian GNU/Linux 12.5.0".
+	diskInfoRelease = regexp.MustCompile(`^(\S*[Uu]buntu\S*|Debian GNU/Linux) (\d+)(\.\d+)?`)
+	// openSUSELabel matches the volume labels of openSUSE media, such as
+	// "openSUSE-Leap-15.5-DVD-x86_64" or "openSUSE-Tumbleweed-DVD-x86_64".
+	openSUSELabel = regexp.MustCompile(`^openSUSE-(Leap-(\d+\.\d+)|Tumbleweed)`)
+)
+
+// detectOS recognises the distribution on the disc tree fsys, whose volume
+// label is label, from the release files installers keep at its root. It
+// reports false, with a generic Linux variant, when nothing matches.
+func detectOS(fsys fs.FS, label string) (OSVariant, bool) {
+	v, ok := releaseOS(fsys, label)
+	if !ok {
+		v = genericLinux
+	}
+	if v.Arch == "" {
+		v.Arch = efiArch(fsys)
+	}
+	return v, ok
+}
+
+func releaseOS(fsys fs.FS, label string) (OSVariant, bool) {
+	if data, err := fs.ReadFile(fsys, ".treeinfo"); err == nil {
+		if v, ok := treeinfoOS(data); ok {
+			return v, true
+		}
+	}
+	if data, err := fs.ReadFile(fsys, ".disk/info"); err == nil {
+		if v, ok := diskInfoOS(string(data)); ok {
+			return v, true
+		}
+	}
+	if data, err := fs.ReadFile(fsys, ".alpine-release"); err == nil {
+		version := strings.TrimSpace(string(data))
+		if major, minor, ok := strings.Cut(version, "."); ok {
+			minor, _, _ = strings.Cut(minor, ".")
+			version = major + "." + minor
+			return OSVariant{ShortID: "alpinelinux" + version, ID: "http://alpinelinux.org/alpinelinux/" + version, Name: "Alpine Linux " + version, Family: FamilyLinux}, true
+		}
+	}
+	if _, err := fs.Stat(fsys, "arch/version"); err == nil || strings.HasPrefix(label, "ARCH_") {
+		return OSVariant{ShortID: "archlinux", ID: "http://archlinux.org/archlinux/rolling", Name: "Arch Linux", Family: FamilyLinux}, true
+	}
+	if m := openSUSELabel.FindStringSubmatch(label); m != nil {
+		if m[2] == "" {
+			return OSVariant{ShortID: "opensusetumbleweed", ID: "http://opensuse.org/opensuse/tumbleweed", Name: "openSUSE Tumbleweed", Family: FamilyLinux, Arch: labelArch(label)}, true
+		}
+		return OSVariant{ShortID: "opensuse" + m[2], ID: "http://opensuse.org/opensuse/" + m[2], Name: "openSUSE Leap " + m[2], Family: FamilyLinux, Arch: labelArch(label)}, true
+	}
+	for _, image := range []string{"sources/install.wim", "sources/install.esd"} {
+		if _, err := fs.Stat(fsys, image); err == nil {
+			// Windows 10 and 11 media look alike; 11 is the one still
+			// released, and a machine fit for it also runs 10.
+			return OSVariant{ShortID: "win11", ID: "http://microsoft.com/win/11", Name: "Windows", Family: FamilyWindows, Arch: labelArch(label)}, true
+		}
+	}
+	return OSVariant{}, false
+}
+
+// treeinfoOS reads the .treeinfo file of Fedora and Red Hat media.
+func treeinfoOS(data []byte) (OSVariant, bool) {
+	ini := readINI(data)
+	name, version := ini["release"]["name"], ini["release"]["version"]
+	if name == "" {
+		// .treeinfo files before format 1.0 only have [general].
+		name, version = ini["general"]["family"], ini["general"]["version"]
+	}
+	arch := ini["tree"]["arch"]
+	if arch == "" {
+		arch = ini["general"]["arch"]
+	}
+	return distroOS(name, version, arch)
+}
+
+// distroOS returns the variant of release version of the treeinfoDistros
+// distribution name.
+func distroOS(name, version, arch string) (OSVariant, bool) {
+	distro, ok := treeinfoDistros[name]
+	if !ok || version == "" {
+		return OSVariant{}, false
+	}
+	if strings.EqualFold(version, "rawhide") {
+		return OSVariant{ShortID: distro.short + "-rawhide", ID: distro.uri + "rawhide", Name: name + " Rawhide", Family: FamilyLinux, Arch: arch}, true
+	}
+	major, minor, _ := strings.Cut(version, ".")
+	minor, _, _ = strings.Cut(minor, ".")
+	version = major
+	if distro.minor && minor != "" {
+		version += "." + minor
+	}
+	return OSVariant{ShortID: distro.short + version, ID: distro.uri + version, Name: name + " " + version, Family: FamilyLinux, Arch: arch}, true
+}
+
+// readINI parses the sections of an INI file into maps of their keys.
+func readINI(data []byte) map[string]map[string]string {
+	sections := make(map[string]map[string]string)
+	var section map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = make(map[string]string)
+			sections[strings.TrimSpace(line[1:len(line)-1])] = section
+		case section != nil:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				section[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return sections
+}
+
+// diskInfoOS reads the .disk/info file of Debian and Ubuntu media.
+func diskInfoOS(info string) (OSVariant, bool) {
+	m := diskInfoRelease.FindStringSubmatch(info)
+	if m == nil {
+		return OSVariant{}, false
+	}
+	var arch string
+	switch {
+	case strings.Contains(info, " amd64"):
+		arch = ArchX86_64
+	case strings.Contains(info, " arm64"):
+		arch = ArchAArch64
+	}
+	if m[1] == "Debian GNU/Linux" {
+		return debianOS(m[2], arch), true
+	}
+	return ubuntuOS(m[2]+m[3], arch), true
+}
+
+func debianOS(major, arch string) OSVariant {
+	return OSVariant{ShortID: "debian" + major, ID: "http://debian.org/debian/" + major, Name: "Debian " + major, Family: FamilyLinux, Arch: arch}
+}
+
+func ubuntuOS(version, arch string) OSVariant {
+	return OSVariant{ShortID: "ubuntu" + version, ID: "http://ubuntu.com/ubuntu/" + version, Name: "Ubuntu " + version, Family: FamilyLinux, Arch: arch}
+}
+
+// osReleaseIDs maps the ID of an os-release file to the release name
+// treeinfoDistros knows the distribution by.
+var osReleaseIDs = map[string]string{
+	"fedora":    "Fedora",
+	"rhel":      "Red Hat Enterprise Linux",
+	"centos":    "CentOS Stream",
+	"rocky":     "Rocky Linux",
+	"almalinux": "AlmaLinux",
+}
+
+// osReleaseOS reads the os-release file of a live root filesystem.
+func osReleaseOS(data []byte) (OSVariant, bool) {
+	fields := make(map[string]string)
+	for line := range strings.Lines(string(data)) {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			fields[key] = strings.Trim(value, `"'`)
+		}
+	}
+	id, version := fields["ID"], fields["VERSION_ID"]
+	switch {
+	case version == "":
+		return OSVariant{}, false
+	case id == "ubuntu":
+		return ubuntuOS(version, ""), true
+	case id == "debian":
+		major, _, _ := strings.Cut(version, ".")
+		return debianOS(major, ""), true
+	}
+	return distroOS(osReleaseIDs[id], version, "")
+}
+
+// labelArch reads the architecture from volume labels such as
+// "CCCOMA_X64FRE_EN-US_DV9" or "openSUSE-Leap-15.5-DVD-aarch64".
+func labelArch(label string) string {
+	upper := strings.ToUpper(label)
+	switch {
+	case strings.Contains(upper, "X86_64") || strings.Contains(upper, "_X64"):
+		return ArchX86_64
+	case strings.Contains(upper, "AARCH64") || strings.Contains(upper, "_A64"):
+		return ArchAArch64
+	}
+	return ""
+}
+
+// efiArch reads the architecture from the removable-media UEFI loader at
+// EFI/BOOT, whose name says what it runs on.
+func efiArch(fsys fs.FS) string {
+	for _, dir := range []string{"EFI/BOOT", "EFI/boot", "efi/boot"} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			switch strings.ToUpper(e.Name()) {
+			case "BOOTX64.EFI":
+				return ArchX86_64
+			case "BOOTAA64.EFI":
+				return ArchAArch64
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package iso2chroot
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestDetectOS(t *testing.T) {
+	file := func(text string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(text), Mode: 0o644} }
+	for _, tc := range []struct {
+		name  string
+		fsys  fstest.MapFS
+		label string
+		want  OSVariant
+		ok    bool
+	}{
+		{
+			name: "ubuntu",
+			fsys: fstest.MapFS{".disk/info": file(`Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827)`)},
+			want: OSVariant{ShortID: "ubuntu24.04", ID: "http://ubuntu.com/ubuntu/24.04", Name: "Ubuntu 24.04", Family: FamilyLinux, Arch: ArchX86_64},
+			ok:   true,
+		},
+		{
+			name: "debian",
+			fsys: fstest.MapFS{".disk/info": file(`Debian GNU/Linux 12.5.0 "Bookworm" - Official arm64 NETINST with firmware 20240210-11:28`)},
+			want: OSVariant{ShortID: "debian12", ID: "http://debian.org/debian/12", Name: "Debian 12", Family: FamilyLinux, Arch: ArchAArch64},
+			ok:   true,
+		},
+		{
+			name: "fedora",
+			fsys: fstest.MapFS{
+				".treeinfo":             file("[header]\ntype = productmd.treeinfo\nversion = 1.2\n\n[release]\nname = Fedora\nshort = Fedora\nversion = 40\n\n[tree]\narch = x86_64\n"),
+				"EFI/BOOT/BOOTAA64.EFI": file("MZ"),
+			},
+			want: OSVariant{ShortID: "fedora40", ID: "http://fedoraproject.org/fedora/40", Name: "Fedora 40", Family: FamilyLinux, Arch: ArchX86_64},
+			ok:   true,
+		},
+		{
+			name: "rhel",
+			fsys: fstest.MapFS{".treeinfo": file("[general]\nfamily = Red Hat Enterprise Linux\nversion = 9.4\narch = aarch64\n")},
+			want: OSVariant{ShortID: "rhel9.4", ID: "http://redhat.com/rhel/9.4", Name: "Red Hat Enterprise Linux 9.4", Family: FamilyLinux, Arch: ArchAArch64},
+			ok:   true,
+		},
+		{
+			name: "alpine",
+			fsys: fstest.MapFS{".alpine-release": file("3.19.1\n"), "efi/boot/bootx64.efi": file("MZ")},
+			want: OSVariant{ShortID: "alpinelinux3.19", ID: "http://alpinelinux.org/alpinelinux/3.19", Name: "Alpine Linux 3.19", Family: FamilyLinux, Arch: ArchX86_64},
+			ok:   true,
+		},
+		{
+			name:  "arch",
+			fsys:  fstest.MapFS{},
+			label: "ARCH_202405",
+			want:  OSVariant{ShortID: "archlinux", ID: "http://archlinux.org/archlinux/rolling", Name: "Arch Linux", Family: FamilyLinux},
+			ok:    true,
+		},
+		{
+			name:  "opensuse",
+			fsys:  fstest.MapFS{},
+			label: "openSUSE-Leap-15.5-DVD-x86_64",
+			want:  OSVariant{ShortID: "opensuse15.5", ID: "http://opensuse.org/opensuse/15.5", Name: "openSUSE Leap 15.5", Family: FamilyLinux, Arch: ArchX86_64},
+			ok:    true,
+		},
+		{
+			name:  "windows",
+			fsys:  fstest.MapFS{"sources/install.wim": file("MSWIM")},
+			label: "CCCOMA_X64FRE_EN-US_DV9",
+			want:  OSVariant{ShortID: "win11", ID: "http://microsoft.com/win/11", Name: "Windows", Family: FamilyWindows, Arch: ArchX86_64},
+			ok:    true,
+		},
+		{
+			name:  "unknown",
+			fsys:  fstest.MapFS{"EFI/BOOT/BOOTAA64.EFI": file("MZ"), ".treeinfo": file("[release]\nname = Slackware\nversion = 15\n")},
+			label: "LIVE",
+			want:  OSVariant{ShortID: "linux2022", ID: "http://libosinfo.org/linux/2022", Name: "Linux", Family: FamilyLinux, Arch: ArchAArch64},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := detectOS(tc.fsys, tc.label)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("detectOS() = %+v, %t; want %+v, %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
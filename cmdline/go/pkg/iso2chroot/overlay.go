@@ -0,0 +1,197 @@
+package iso2chroot
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+)
+
+var (
+	_ fs.ReadDirFS  = overlayFS{}
+	_ fs.ReadLinkFS = overlayFS{}
+)
+
+// overlayFS lays the tree upper over the tree lower, as remaster builds a
+// new ISO from an old one: files of upper replace those at the same paths,
+// and a directory on both sides is merged, keeping the attributes of the one
+// in lower. Nothing is removed. Every FileInfo's Sys is an *iso9660.Stat, so
+// owners, links and device numbers of lower survive; files of upper are
+// owned by root.
+type overlayFS struct {
+	lower fs.FS
+	// upper may be nil, leaving lower as it is.
+	upper fs.FS
+}
+
+// overlayInfo is a FileInfo of an overlayFS.
+type overlayInfo struct {
+	fs.FileInfo
+	st *iso9660.Stat
+	// upper reports whether the file comes from the upper tree.
+	upper bool
+}
+
+func (i overlayInfo) Sys() any { return i.st }
+
+// Lstat describes the named file without following a final symlink.
+func (o overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+	if o.upper != nil {
+		info, err := fs.Lstat(o.upper, name)
+		switch {
+		case err == nil && !info.IsDir():
+			return upperInfo(info), nil
+		case err == nil:
+			if lower, err := fs.Lstat(o.lower, name); err == nil && lower.IsDir() {
+				return lowerInfo(lower), nil
+			}
+			return upperInfo(info), nil
+		case errors.Is(err, syscall.ENOTDIR):
+			// A file of upper replaces a directory of lower, and
+			// everything below it.
+			return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+	info, err := fs.Lstat(o.lower, name)
+	if err != nil {
+		return nil, err
+	}
+	return lowerInfo(info), nil
+}
+
+func lowerInfo(info fs.FileInfo) overlayInfo {
+	st := &iso9660.Stat{Nlink: 1}
+	if s, ok := statOf(info); ok {
+		st = &iso9660.Stat{Inode: s.inode, Nlink: s.nlink, UID: s.uid, GID: s.gid, Major: s.major, Minor: s.minor}
+	}
+	return overlayInfo{FileInfo: info, st: st}
+}
+
+func upperInfo(info fs.FileInfo) overlayInfo {
+	st := &iso9660.Stat{Nlink: 1}
+	if s, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&fs.ModeDevice != 0 {
+		st.Major, st.Minor = unix.Major(uint64(s.Rdev)), unix.Minor(uint64(s.Rdev))
+	}
+	return overlayInfo{FileInfo: info, st: st, upper: true}
+}
+
+// layer returns the tree the named file is read from.
+func (o overlayFS) layer(info fs.FileInfo) fs.FS {
+	if info.(overlayInfo).upper {
+		return o.upper
+	}
+	return o.lower
+}
+
+// ReadDir lists the merged directory name, sorted by name.
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := o.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	var names []string
+	for _, layer := range []fs.FS{o.lower, o.upper} {
+		if layer == nil {
+			continue
+		}
+		if info, err := fs.Lstat(layer, name); err != nil || !info.IsDir() {
+			continue
+		}
+		entries, err := fs.ReadDir(layer, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, n := range names {
+		info, err := o.Lstat(path.Join(name, n))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (o overlayFS) ReadLink(name string) (string, error) {
+	info, err := o.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	return fs.ReadLink(o.layer(info), name)
+}
+
+// Open opens the named file from the tree that provides it. Directories are
+// opened merged.
+func (o overlayFS) Open(name string) (fs.File, error) {
+	info, err := o.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return o.layer(info).Open(name)
+	}
+	return &overlayDir{fsys: o, name: name, info: info}, nil
+}
+
+// overlayDir is a merged directory opened from an overlayFS.
+type overlayDir struct {
+	fsys    overlayFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *overlayDir) Close() error { return nil }
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
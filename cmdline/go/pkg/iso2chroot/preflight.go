@@ -0,0 +1,245 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	mountInfoPath = "/proc/self/mountinfo"
+	sysBlockDir   = "/sys/block"
+)
+
+// systemPaths are directories that must never be used as a mount target.
+var systemPaths = []string{
+	"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib32", "/lib64", "/libx32",
+	"/media", "/mnt", "/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys", "/tmp",
+	"/usr", "/var", "/var/lib", "/var/log", "/var/tmp",
+}
+
+// systemTrees are directories whose entire subtree is off limits.
+var systemTrees = []string{"/boot", "/dev", "/etc", "/proc", "/run", "/sys", "/usr"}
+
+// SystemPathError reports a mount target that is, or lies inside, a system directory.
+type SystemPathError struct {
+	Path string
+}
+
+func (e *SystemPathError) Error() string {
+	return fmt.Sprintf("refusing to mount over system path %s", e.Path)
+}
+
+// MountpointError reports a mount target that already has a filesystem mounted on it.
+type MountpointError struct {
+	Path   string
+	Source string
+}
+
+func (e *MountpointError) Error() string {
+	return fmt.Sprintf("refusing to mount over %s: %s is already mounted there", e.Path, e.Source)
+}
+
+// PreflightReport describes conditions found before mounting that do not block it.
+type PreflightReport struct {
+	// Warnings lists non-fatal concerns, such as a non-empty target directory.
+	Warnings []string
+	// ExistingMount is where the selected ISO is already mounted, if anywhere.
+	ExistingMount string
+}
+
+type mountEntry struct {
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// Preflight checks that dstDir is a safe place to mount the chosen ISO. It refuses
+// system paths with a *SystemPathError and existing mountpoints with a
+// *MountpointError, and reports other concerns without failing.
+//
+// The checks touch the filesystem and are bounded by the Load timeout.
+func (m *Manager) Preflight(ctx context.Context, choice int, dstDir string) (PreflightReport, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return PreflightReport{}, err
+	}
+	if dstDir == "" {
+		dstDir = defaultMountDir
+	}
+
+	ctx, cancel := withTimeout(ctx, m.Timeouts().Load)
+	defer cancel()
+	return runBlocking(ctx, "check "+dstDir, func() (PreflightReport, error) {
+		return preflight(m.Path(iso), dstDir)
+	})
+}
+
+func preflight(isoFile, dstDir string) (PreflightReport, error) {
+
+	target, err := resolveTarget(dstDir)
+	if err != nil {
+		return PreflightReport{}, err
+	}
+	if isSystemPath(target) {
+		return PreflightReport{}, &SystemPathError{Path: target}
+	}
+
+	mounts, err := readMountTable()
+	if err != nil {
+		return PreflightReport{}, err
+	}
+	for _, entry := range mounts {
+		if entry.MountPoint == target {
+			return PreflightReport{}, &MountpointError{Path: target, Source: entry.Source}
+		}
+	}
+
+	var report PreflightReport
+	if entries, err := os.ReadDir(target); err == nil && len(entries) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%s is not empty (%d entries); its contents will be hidden while the ISO is mounted", target, len(entries)))
+	}
+	report.ExistingMount = findISOMount(mounts, isoFile)
+	return report, nil
+}
+
+// resolveTarget returns the absolute, symlink-free form of path. Components that do
+// not exist yet are kept as given.
+func resolveTarget(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", path, err)
+	}
+
+	existing, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+func isSystemPath(path string) bool {
+	for _, sys := range systemPaths {
+		if path == sys {
+			return true
+		}
+	}
+	for _, tree := range systemTrees {
+		if strings.HasPrefix(path, tree+"/") {
+			return true
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil && path == filepath.Clean(home) {
+		return true
+	}
+	return false
+}
+
+// readMountTable parses the mount table of the current process.
+var readMountTable = func() ([]mountEntry, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("read mount table: %w", err)
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// parseMountInfo reads the proc(5) mountinfo format.
+func parseMountInfo(r io.Reader) ([]mountEntry, error) {
+	var entries []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || len(fields) < sep+3 {
+			continue
+		}
+		entries = append(entries, mountEntry{
+			MountPoint: unescapeMountField(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountField(fields[sep+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read mount table: %w", err)
+	}
+	return entries, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 and friends) used in mountinfo.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// findISOMount returns the mountpoint of a loop device backed by isoFile.
+func findISOMount(mounts []mountEntry, isoFile string) string {
+	want, err := filepath.Abs(isoFile)
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(want); err == nil {
+		want = resolved
+	}
+
+	for _, entry := range mounts {
+		if !strings.HasPrefix(entry.Source, "/dev/loop") {
+			continue
+		}
+		backing, err := loopBackingFile(filepath.Base(entry.Source))
+		if err != nil {
+			continue
+		}
+		if backing == want {
+			return entry.MountPoint
+		}
+	}
+	return ""
+}
+
+// loopBackingFile returns the file attached to the named loop device.
+var loopBackingFile = func(device string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysBlockDir, device, "loop", "backing_file"))
+	if err != nil {
+		return "", err
+	}
+	backing := strings.TrimSpace(string(data))
+	if backing == "" {
+		return "", errors.New("loop device has no backing file")
+	}
+	return backing, nil
+}
@@ -0,0 +1,189 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMountTable replaces the mount table and loop device lookups for one test.
+func fakeMountTable(t *testing.T, mounts []mountEntry, loops map[string]string) {
+	t.Helper()
+	originalTable, originalLoop := readMountTable, loopBackingFile
+	t.Cleanup(func() {
+		readMountTable, loopBackingFile = originalTable, originalLoop
+	})
+	readMountTable = func() ([]mountEntry, error) {
+		return mounts, nil
+	}
+	loopBackingFile = func(device string) (string, error) {
+		backing, ok := loops[device]
+		if !ok {
+			return "", os.ErrNotExist
+		}
+		return backing, nil
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	input := `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+61 22 7:0 / /tmp/iso\0402chroot ro,relatime shared:30 - iso9660 /dev/loop0 ro
+bogus line
+`
+	got, err := parseMountInfo(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseMountInfo() error = %v", err)
+	}
+	want := []mountEntry{
+		{MountPoint: "/", FSType: "ext4", Source: "/dev/nvme0n1p2"},
+		{MountPoint: "/tmp/iso 2chroot", FSType: "iso9660", Source: "/dev/loop0"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseMountInfo() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("parseMountInfo()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestIsSystemPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/usr", true},
+		{"/usr/local/chroot", true},
+		{"/proc/self", true},
+		{"/tmp", true},
+		{"/tmp/iso2chroot", false},
+		{"/var/lib/iso2chroot", false},
+		{"/srv/chroots/jammy", false},
+	}
+	for _, tt := range tests {
+		if got := isSystemPath(tt.path); got != tt.want {
+			t.Errorf("isSystemPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.iso"), nil, 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+	manager := NewManager(dir)
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	busy := filepath.Join(dir, "busy")
+	full := filepath.Join(dir, "full")
+	if err := os.MkdirAll(filepath.Join(full, "leftover"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	elsewhere := filepath.Join(dir, "elsewhere")
+	fakeMountTable(t, []mountEntry{
+		{MountPoint: busy, FSType: "ext4", Source: "/dev/sda1"},
+		{MountPoint: elsewhere, FSType: "iso9660", Source: "/dev/loop7"},
+	}, map[string]string{"loop7": filepath.Join(dir, "a.iso")})
+
+	t.Run("system path", func(t *testing.T) {
+		_, err := manager.Preflight(context.Background(), 1, "/usr")
+		var sysErr *SystemPathError
+		if !errors.As(err, &sysErr) {
+			t.Fatalf("Preflight() error = %v, want *SystemPathError", err)
+		}
+	})
+	t.Run("mountpoint", func(t *testing.T) {
+		_, err := manager.Preflight(context.Background(), 1, busy)
+		var mpErr *MountpointError
+		if !errors.As(err, &mpErr) || mpErr.Source != "/dev/sda1" {
+			t.Fatalf("Preflight() error = %v, want *MountpointError from /dev/sda1", err)
+		}
+	})
+	t.Run("non-empty warning and existing mount", func(t *testing.T) {
+		report, err := manager.Preflight(context.Background(), 1, full)
+		if err != nil {
+			t.Fatalf("Preflight() error = %v", err)
+		}
+		if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "not empty") {
+			t.Fatalf("Warnings = %q, want a non-empty warning", report.Warnings)
+		}
+		if report.ExistingMount != elsewhere {
+			t.Fatalf("ExistingMount = %q, want %q", report.ExistingMount, elsewhere)
+		}
+	})
+}
+
+func TestRunCLICreateRefusesUnsafeTargets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.iso"), nil, 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+	busy := filepath.Join(dir, "busy")
+	fakeMountTable(t, []mountEntry{{MountPoint: busy, Source: "/dev/sda1"}}, nil)
+
+	originalMount := mountFunc
+	defer func() { mountFunc = originalMount }()
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
+		t.Fatalf("unexpected mount of %s at %s", isoFile, dstDir)
+		return nil
+	}
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/usr", ExitUnsafeTarget},
+		{busy, ExitTargetMounted},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(NewManager(dir), []string{"create", "1"}, &stdout, &stderr, CLIOptions{
+			MountDir: tt.target,
+			Stdin:    strings.NewReader("\n"),
+		})
+		if code != tt.want {
+			t.Fatalf("create into %s exit code = %d, want %d (stderr %q)", tt.target, code, tt.want, stderr.String())
+		}
+	}
+}
+
+func TestRunCLICreateReusesExistingMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.iso"), nil, 0o644); err != nil {
+		t.Fatalf("write iso: %v", err)
+	}
+	elsewhere := filepath.Join(dir, "elsewhere")
+	fakeMountTable(t, []mountEntry{{MountPoint: elsewhere, Source: "/dev/loop3"}}, map[string]string{"loop3": filepath.Join(dir, "a.iso")})
+
+	var mountCalled bool
+	originalMount := mountFunc
+	defer func() { mountFunc = originalMount }()
+	mountFunc = func(_ context.Context, isoFile, dstDir, fstype string) error {
+		mountCalled = true
+		return nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(NewManager(dir), []string{"create", "1"}, &stdout, &stderr, CLIOptions{
+		MountDir: filepath.Join(dir, "src"),
+		Stdin:    strings.NewReader("\n"),
+	})
+	if code != 0 {
+		t.Fatalf("RunCLI() exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+	if mountCalled {
+		t.Fatal("expected the existing mount to be reused")
+	}
+	if !strings.Contains(stdout.String(), "Reusing existing mount of a.iso at "+elsewhere) {
+		t.Fatalf("stdout = %q, want reuse notice", stdout.String())
+	}
+}
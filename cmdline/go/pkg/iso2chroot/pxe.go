@@ -0,0 +1,388 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"thatnerdjosh.com/devtools/pkg/bootcfg"
+	"thatnerdjosh.com/devtools/pkg/tftp"
+)
+
+// Boot menus PXEServer generates, served over TFTP in place of any file of
+// the ISO at the same path. PXELINUX reads PXELinuxMenu after the
+// per-client files it looks for first; GRUB netboot images read
+// GRUBNetMenu, or GRUBMenu when built with the ISO's prefix.
+const (
+	PXELinuxMenu = "pxelinux.cfg/default"
+	GRUBNetMenu  = "grub/grub.cfg"
+	GRUBMenu     = "boot/grub/grub.cfg"
+)
+
+// pxeTimeout is how long the generated menus wait before booting the first
+// entry, in seconds.
+const pxeTimeout = 5
+
+// PXEOptions configures Manager.NewPXEServer.
+type PXEOptions struct {
+	// URL is where clients reach the HTTP server, such as
+	// "http://192.0.2.1:8080/". The kernel command lines point there for
+	// the rest of the install.
+	URL string
+	// Entry is the label of the boot menu entry to offer, as boot-entries
+	// prints it. Empty offers every entry that boots a kernel on the ISO.
+	Entry string
+	// Loaders is a directory also served over TFTP, for the boot loaders
+	// ISOs do not carry: pxelinux.0 and ldlinux.c32, or a GRUB netboot
+	// image. Files of the ISO at the same paths are hidden.
+	Loaders string
+	// Log, when set, receives a line for each TFTP transfer and HTTP
+	// request.
+	Log io.Writer
+}
+
+// PXEEntry is a boot entry of the generated menus.
+type PXEEntry struct {
+	Label  string
+	Kernel string
+	Initrd []string
+	// Cmdline is the entry's command line, changed to fetch the rest of the
+	// system from the HTTP server.
+	Cmdline string
+}
+
+// PXEServer boots the kernels of an ISO over the network: it serves the
+// kernel, initramfs and generated boot menus over TFTP, and the ISO over
+// HTTP for the installer or live system to fetch the rest from.
+type PXEServer struct {
+	// HTTP serves the ISO, and the ISO file itself, at URL.
+	HTTP *ISOServer
+	URL  string
+	// Entries are those of the generated menus, the first being the
+	// default.
+	Entries []PXEEntry
+	// Menus lists the generated files.
+	Menus []string
+	// Warnings lists entries whose command line could not be pointed at
+	// the HTTP server and so still look for the ISO on a local disk.
+	Warnings []string
+
+	tftp    *tftp.Server
+	loaders *os.Root
+}
+
+// NewPXEServer opens the chosen ISO to boot over the network. Opening it
+// and reading its boot menus are bounded by the Inspect timeout. Close the
+// server to release it.
+func (m *Manager) NewPXEServer(ctx context.Context, choice int, opts PXEOptions) (*PXEServer, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid HTTP server URL %q", opts.URL)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	var log io.Writer
+	if opts.Log != nil {
+		log = &syncWriter{w: opts.Log}
+	}
+	httpServer, err := m.NewISOServer(ctx, choice, ServeOptions{ISOFile: true, Log: log})
+	if err != nil {
+		return nil, err
+	}
+	s := &PXEServer{HTTP: httpServer, URL: base.String()}
+	disc := httpServer.Disc
+	readCtx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+	defer cancel()
+	type menu struct {
+		entries  []PXEEntry
+		warnings []string
+	}
+	read, err := runBlocking(readCtx, "read the boot menus of "+m.Path(disc.ISO), func() (menu, error) {
+		var read menu
+		var err error
+		if read.entries, err = pxeEntries(disc, opts.Entry); err != nil {
+			return menu{}, fmt.Errorf("%s: %w", disc, err)
+		}
+		for i, entry := range read.entries {
+			cmdline, ok := netbootCmdline(disc, disc.ISO.Name, entry, s.URL)
+			if !ok {
+				read.warnings = append(read.warnings, fmt.Sprintf("boot entry %q: no known way to fetch the system from %s; its command line is unchanged", entry.Label, s.URL))
+			}
+			read.entries[i].Cmdline = cmdline
+		}
+		return read, nil
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Entries, s.Warnings = read.entries, read.warnings
+
+	menus := pxeFS{
+		files: map[string][]byte{
+			PXELinuxMenu: pxelinuxMenu(disc.ISO.Name, s.Entries),
+			GRUBNetMenu:  grubNetMenu(disc.ISO.Name, s.Entries),
+			GRUBMenu:     grubNetMenu(disc.ISO.Name, s.Entries),
+		},
+		disc: servedFS{disc},
+	}
+	s.Menus = []string{PXELinuxMenu, GRUBNetMenu, GRUBMenu}
+	if opts.Loaders != "" {
+		if s.loaders, err = os.OpenRoot(opts.Loaders); err != nil {
+			s.Close()
+			return nil, err
+		}
+		menus.loaders = s.loaders.FS()
+	}
+	s.tftp = &tftp.Server{FS: menus, Log: log}
+	return s, nil
+}
+
+// Close releases the ISO.
+func (s *PXEServer) Close() error {
+	err := s.HTTP.Close()
+	if s.loaders != nil {
+		err = errors.Join(err, s.loaders.Close())
+	}
+	return err
+}
+
+// Serve answers TFTP requests arriving on conn and HTTP requests arriving
+// on ln until ctx ends or either fails.
+func (s *PXEServer) Serve(ctx context.Context, conn net.PacketConn, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var tftpErr, httpErr error
+	wg.Go(func() {
+		tftpErr = s.tftp.Serve(ctx, conn)
+		cancel()
+	})
+	wg.Go(func() {
+		httpErr = s.HTTP.Serve(ctx, ln)
+		cancel()
+	})
+	wg.Wait()
+	return errors.Join(tftpErr, httpErr)
+}
+
+// pxeEntries returns the entries of the ISO tree fsys that boot a kernel on
+// it, or the one labelled entry. Entries of later menus with the label of
+// an earlier one are left out, as ISOs give their GRUB and ISOLINUX menus
+// the same entries. Without boot menus the kernel is looked for at known
+// paths.
+func pxeEntries(fsys fs.FS, entry string) ([]PXEEntry, error) {
+	parsed, err := bootcfg.Parse(fsys)
+	if err != nil && !errors.Is(err, bootcfg.ErrNoConfig) {
+		return nil, err
+	}
+	var entries []PXEEntry
+	for _, e := range parsed {
+		if entry != "" && e.Label != entry || slices.ContainsFunc(entries, func(p PXEEntry) bool { return p.Label == e.Label }) {
+			continue
+		}
+		if !isRegularFile(fsys, e.Kernel) || strings.HasSuffix(e.Kernel, ".c32") || slices.ContainsFunc(e.Initrd, func(name string) bool { return !isRegularFile(fsys, name) }) {
+			continue
+		}
+		entries = append(entries, PXEEntry{Label: e.Label, Kernel: e.Kernel, Initrd: append([]string{}, e.Initrd...), Cmdline: e.Append})
+	}
+	if len(entries) > 0 {
+		return entries, nil
+	}
+	// findKernel explains why the entry cannot be used, or finds a kernel
+	// at a known path.
+	manifest, err := findKernel(fsys, KernelOptions{Entry: entry})
+	if err != nil {
+		return nil, err
+	}
+	label := manifest.Entry
+	if label == "" {
+		label = manifest.ISOKernel
+	}
+	return []PXEEntry{{Label: label, Kernel: manifest.ISOKernel, Initrd: manifest.ISOInitrd, Cmdline: manifest.Cmdline}}, nil
+}
+
+// netbootCmdline returns the command line of entry changed to fetch the
+// live system or installer from the HTTP server at base, which serves the
+// ISO tree of fsys and the ISO file isoName, rather than look for the ISO
+// on a local disk. It reports false, returning the command line unchanged,
+// when the distribution is not recognized.
+func netbootCmdline(fsys fs.FS, isoName string, entry PXEEntry, base string) (string, bool) {
+	args := strings.Fields(entry.Cmdline)
+	has := func(prefix string) bool {
+		return slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, prefix) })
+	}
+	var drop, add []string
+	switch {
+	case has("boot=casper") || strings.HasPrefix(entry.Kernel, "casper/"):
+		// Casper downloads the whole ISO into memory. Cloud-init would
+		// otherwise read url= as where to fetch its configuration.
+		drop = []string{"iso-scan/filename=", "url=", "cloud-config-url="}
+		add = []string{"url=" + pxeURL(base, isoName), "cloud-config-url=/dev/null"}
+	case has("boot=live"):
+		squashfs, _ := fs.Glob(fsys, "live/*.squashfs")
+		if len(squashfs) == 0 {
+			return entry.Cmdline, false
+		}
+		drop = []string{"findiso=", "fetch="}
+		add = []string{"fetch=" + pxeURL(base, squashfs[0])}
+	case has("root=live:"):
+		if !isRegularFile(fsys, "LiveOS/squashfs.img") {
+			return entry.Cmdline, false
+		}
+		drop = []string{"root=live:", "rd.neednet="}
+		add = []string{"root=live:" + pxeURL(base, "LiveOS/squashfs.img"), "rd.neednet=1"}
+	case has("inst.stage2=") || has("inst.repo=") || strings.HasPrefix(entry.Kernel, "images/pxeboot/"):
+		drop = []string{"inst.stage2=", "inst.repo="}
+		add = []string{"inst.repo=" + base}
+	case has("archisobasedir="):
+		drop = []string{"archisolabel=", "archisodevice=", "archisosearchuuid=", "archisosearchfilename=", "archiso_http_srv="}
+		add = []string{"archiso_http_srv=" + base}
+	case isRegularFile(fsys, ".alpine-release"):
+		modloop := path.Join(path.Dir(entry.Kernel), "modloop-"+strings.TrimPrefix(path.Base(entry.Kernel), "vmlinuz-"))
+		if !isRegularFile(fsys, modloop) {
+			return entry.Cmdline, false
+		}
+		drop = []string{"modloop=", "alpine_repo="}
+		add = []string{"modloop=" + pxeURL(base, modloop), "alpine_repo=" + pxeURL(base, "apks")}
+	default:
+		return entry.Cmdline, false
+	}
+	args = slices.DeleteFunc(args, func(arg string) bool {
+		return strings.HasPrefix(arg, "ip=") || slices.ContainsFunc(drop, func(prefix string) bool { return strings.HasPrefix(arg, prefix) })
+	})
+	// Arguments after "---" are for the installed system.
+	at := slices.Index(args, "---")
+	if at < 0 {
+		at = len(args)
+	}
+	args = slices.Insert(args, at, append([]string{"ip=dhcp"}, add...)...)
+	return strings.Join(args, " "), true
+}
+
+// pxeURL returns the URL of the file name of the ISO tree served at base.
+func pxeURL(base, name string) string {
+	return base + (&url.URL{Path: name}).EscapedPath()
+}
+
+// pxelinuxMenu returns a PXELINUX configuration booting entries. It needs
+// no menu module: the labels are numbered and listed at the prompt.
+func pxelinuxMenu(iso string, entries []PXEEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by iso2chroot from %s.\n", iso)
+	fmt.Fprintf(&b, "DEFAULT 1\nPROMPT 1\nTIMEOUT %d\n", pxeTimeout*10)
+	fmt.Fprintf(&b, "SAY Booting %s; type a number to choose another entry:\n", iso)
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "SAY   %d: %s\n", i+1, entry.Label)
+	}
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "\nLABEL %d\n  MENU LABEL %s\n  KERNEL %s\n", i+1, entry.Label, entry.Kernel)
+		if len(entry.Initrd) > 0 {
+			fmt.Fprintf(&b, "  INITRD %s\n", strings.Join(entry.Initrd, ","))
+		}
+		if entry.Cmdline != "" {
+			fmt.Fprintf(&b, "  APPEND %s\n", entry.Cmdline)
+		}
+	}
+	return b.Bytes()
+}
+
+// grubNetMenu returns a GRUB configuration booting entries from the TFTP
+// server GRUB was loaded from.
+func grubNetMenu(iso string, entries []PXEEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by iso2chroot from %s.\n", iso)
+	fmt.Fprintf(&b, "set default=0\nset timeout=%d\n", pxeTimeout)
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "\nmenuentry %s {\n\tlinux /%s", grubQuote(entry.Label), entry.Kernel)
+		for _, arg := range strings.Fields(entry.Cmdline) {
+			b.WriteString(" " + grubWord(arg))
+		}
+		b.WriteString("\n")
+		if len(entry.Initrd) > 0 {
+			b.WriteString("\tinitrd")
+			for _, initrd := range entry.Initrd {
+				b.WriteString(" /" + initrd)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.Bytes()
+}
+
+// grubQuote quotes s as a single GRUB word, with nothing expanded.
+func grubQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// grubWord returns s as a GRUB word, quoted only when it holds characters
+// GRUB would read specially.
+func grubWord(s string) string {
+	if strings.ContainsAny(s, "\"'\\$;&|<>{}# \t") {
+		return grubQuote(s)
+	}
+	return s
+}
+
+// pxeFS is the tree a PXEServer serves over TFTP: the generated menus, then
+// the boot loaders directory, then the ISO.
+type pxeFS struct {
+	files   map[string][]byte
+	loaders fs.FS
+	disc    fs.FS
+}
+
+func (p pxeFS) Open(name string) (fs.File, error) {
+	if data, ok := p.files[name]; ok {
+		return &menuFile{Reader: bytes.NewReader(data), name: path.Base(name)}, nil
+	}
+	if p.loaders != nil {
+		f, err := servedFS{p.loaders}.Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return p.disc.Open(name)
+}
+
+// menuFile is an open generated menu.
+type menuFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *menuFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *menuFile) Close() error               { return nil }
+
+// menuFile is its own fs.FileInfo.
+func (f *menuFile) Name() string       { return f.name }
+func (f *menuFile) Mode() fs.FileMode  { return 0o444 }
+func (f *menuFile) ModTime() time.Time { return time.Time{} }
+func (f *menuFile) IsDir() bool        { return false }
+func (f *menuFile) Sys() any           { return nil }
+
+// syncWriter serializes the writes of the TFTP and HTTP servers sharing a
+// log.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,275 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/pkg/tftp"
+)
+
+func TestNetbootCmdline(t *testing.T) {
+	const base = "http://192.0.2.1:8080/"
+	file := &fstest.MapFile{Data: []byte("x")}
+	for _, tc := range []struct {
+		name  string
+		fsys  fstest.MapFS
+		entry PXEEntry
+		want  string
+		ok    bool
+	}{
+		{
+			name:  "casper",
+			fsys:  fstest.MapFS{"casper/vmlinuz": file},
+			entry: PXEEntry{Kernel: "casper/vmlinuz", Cmdline: "iso-scan/filename=/noble.iso quiet --- console=ttyS0"},
+			want:  "quiet ip=dhcp url=http://192.0.2.1:8080/my%20noble.iso cloud-config-url=/dev/null --- console=ttyS0",
+			ok:    true,
+		},
+		{
+			name:  "live-boot",
+			fsys:  fstest.MapFS{"live/vmlinuz": file, "live/filesystem.squashfs": file},
+			entry: PXEEntry{Kernel: "live/vmlinuz", Cmdline: "boot=live components findiso=/d.iso ip=frommedia"},
+			want:  "boot=live components ip=dhcp fetch=http://192.0.2.1:8080/live/filesystem.squashfs",
+			ok:    true,
+		},
+		{
+			name:  "fedora live",
+			fsys:  fstest.MapFS{"LiveOS/squashfs.img": file},
+			entry: PXEEntry{Kernel: "images/pxeboot/vmlinuz", Cmdline: "root=live:CDLABEL=Fedora-WS-Live-40 rd.live.image quiet"},
+			want:  "rd.live.image quiet ip=dhcp root=live:http://192.0.2.1:8080/LiveOS/squashfs.img rd.neednet=1",
+			ok:    true,
+		},
+		{
+			name:  "anaconda",
+			entry: PXEEntry{Kernel: "images/pxeboot/vmlinuz", Cmdline: "inst.stage2=hd:LABEL=Fedora-S-dvd-x86_64-40 quiet"},
+			want:  "quiet ip=dhcp inst.repo=http://192.0.2.1:8080/",
+			ok:    true,
+		},
+		{
+			name:  "archiso",
+			entry: PXEEntry{Kernel: "arch/boot/x86_64/vmlinuz-linux", Cmdline: "archisobasedir=arch archisosearchuuid=2024-05-01-17-44-44-00"},
+			want:  "archisobasedir=arch ip=dhcp archiso_http_srv=http://192.0.2.1:8080/",
+			ok:    true,
+		},
+		{
+			name:  "alpine",
+			fsys:  fstest.MapFS{".alpine-release": file, "boot/modloop-lts": file},
+			entry: PXEEntry{Kernel: "boot/vmlinuz-lts", Cmdline: "modules=loop,squashfs,sd-mod,usb-storage quiet"},
+			want:  "modules=loop,squashfs,sd-mod,usb-storage quiet ip=dhcp modloop=http://192.0.2.1:8080/boot/modloop-lts alpine_repo=http://192.0.2.1:8080/apks",
+			ok:    true,
+		},
+		{
+			name:  "live-boot without a squashfs",
+			entry: PXEEntry{Kernel: "live/vmlinuz", Cmdline: "boot=live"},
+			want:  "boot=live",
+		},
+		{
+			name:  "debian installer",
+			entry: PXEEntry{Kernel: "install.amd/vmlinuz", Cmdline: "vga=788 --- quiet"},
+			want:  "vga=788 --- quiet",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := tc.fsys
+			if fsys == nil {
+				fsys = fstest.MapFS{}
+			}
+			got, ok := netbootCmdline(fsys, "my noble.iso", tc.entry, base)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("netbootCmdline() = %q, %t; want %q, %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestGRUBNetMenu(t *testing.T) {
+	got := string(grubNetMenu("noble.iso", []PXEEntry{
+		{Label: "Ubuntu's installer", Kernel: "casper/vmlinuz", Initrd: []string{"casper/initrd", "casper/ucode.img"}, Cmdline: "ip=dhcp ds=nocloud;s=http://h/ ---"},
+		{Label: "No initrd", Kernel: "boot/linux"},
+	}))
+	want := `# Generated by iso2chroot from noble.iso.
+set default=0
+set timeout=5
+
+menuentry 'Ubuntu'\''s installer' {
+	linux /casper/vmlinuz ip=dhcp 'ds=nocloud;s=http://h/' ---
+	initrd /casper/initrd /casper/ucode.img
+}
+
+menuentry 'No initrd' {
+	linux /boot/linux
+}
+`
+	if got != want {
+		t.Fatalf("grubNetMenu() = %s\nwant %s", got, want)
+	}
+}
+
+func TestRunCLIPXE(t *testing.T) {
+	kernel := bytes.Repeat([]byte("netboot kernel "), 7000)
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, Files: []isotest.File{
+		isotest.Text("boot/grub/grub.cfg", `menuentry "Try or Install Ubuntu Server" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz  ---
+	initrd	/casper/initrd
+}
+menuentry "Ubuntu Server with the HWE kernel" {
+	linux /casper/hwe-vmlinuz ---
+	initrd /casper/hwe-initrd
+}
+`),
+		isotest.Text("isolinux/isolinux.cfg", "label live\n  menu label Try or Install Ubuntu Server\n  kernel /casper/vmlinuz\n  append initrd=/casper/initrd ---\n"+
+			"label safe\n  menu label Safe graphics\n  kernel /casper/vmlinuz\n  append initrd=/casper/initrd nomodeset iso-scan/filename=/noble.iso ---\n"),
+		{Path: "casper/vmlinuz", Data: kernel, Mode: 0o644},
+		isotest.Text("casper/initrd", "initrd"),
+		isotest.Text("pxelinux.cfg/default", "DEFAULT cdrom\n"),
+	}}})
+	loaders := t.TempDir()
+	if err := os.WriteFile(filepath.Join(loaders, "pxelinux.0"), []byte("pxelinux"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	exit := make(chan int, 1)
+	go func() {
+		exit <- RunCLI(manager, []string{"pxe", "--listen", "127.0.0.1:0", "--http", "127.0.0.1:0", "--loaders", loaders, "1"}, pw, &stderr, CLIOptions{Context: ctx})
+		pw.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("pxe exited early: stderr %q", stderr.String())
+			}
+			return line
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for pxe output")
+		}
+		return ""
+	}
+
+	first := next()
+	rest, ok := strings.CutPrefix(first, "Serving noble.iso over TFTP at ")
+	tftpAddr, url, found := strings.Cut(rest, " and HTTP at ")
+	if !ok || !found || !strings.HasPrefix(url, "http://127.0.0.1:") || !strings.HasSuffix(url, "/") {
+		t.Fatalf("first line = %q", first)
+	}
+	if line := next(); line != "Boot menus: pxelinux.cfg/default, grub/grub.cfg, boot/grub/grub.cfg" {
+		t.Fatalf("menus line = %q", line)
+	}
+	cmdline := "ip=dhcp url=" + url + "noble.iso cloud-config-url=/dev/null ---"
+	for _, want := range []string{
+		"  Try or Install Ubuntu Server: casper/vmlinuz " + cmdline,
+		"  Safe graphics: casper/vmlinuz nomodeset " + cmdline,
+	} {
+		if line := next(); line != want {
+			t.Fatalf("entry line = %q, want %q", line, want)
+		}
+	}
+
+	resp, err := tftp.Get(ctx, tftpAddr, "/casper/vmlinuz", tftp.GetOptions{BlockSize: 1468, Size: true})
+	if err != nil {
+		t.Fatalf("TFTP get of the kernel: %v", err)
+	}
+	if !bytes.Equal(resp.Data, kernel) || resp.Options["blksize"] != "1468" || resp.Options["tsize"] != "105000" {
+		t.Fatalf("TFTP get of the kernel = %d bytes, options %v", len(resp.Data), resp.Options)
+	}
+	if line := next(); line != "127.0.0.1 RRQ /casper/vmlinuz 105000" {
+		t.Fatalf("log line = %q", line)
+	}
+	resp, err = tftp.Get(ctx, tftpAddr, "pxelinux.cfg/default", tftp.GetOptions{})
+	if err != nil {
+		t.Fatalf("TFTP get of the PXELINUX menu: %v", err)
+	}
+	want := `# Generated by iso2chroot from noble.iso.
+DEFAULT 1
+PROMPT 1
+TIMEOUT 50
+SAY Booting noble.iso; type a number to choose another entry:
+SAY   1: Try or Install Ubuntu Server
+SAY   2: Safe graphics
+
+LABEL 1
+  MENU LABEL Try or Install Ubuntu Server
+  KERNEL casper/vmlinuz
+  INITRD casper/initrd
+  APPEND ` + cmdline + `
+
+LABEL 2
+  MENU LABEL Safe graphics
+  KERNEL casper/vmlinuz
+  INITRD casper/initrd
+  APPEND nomodeset ` + cmdline + "\n"
+	if string(resp.Data) != want {
+		t.Fatalf("PXELINUX menu = %s\nwant %s", resp.Data, want)
+	}
+	next()
+	for name, wantData := range map[string]string{"pxelinux.0": "pxelinux", "casper/initrd": "initrd"} {
+		if resp, err := tftp.Get(ctx, tftpAddr, name, tftp.GetOptions{Size: true}); err != nil || string(resp.Data) != wantData {
+			t.Fatalf("TFTP get of %s = %q, %v", name, resp.Data, err)
+		}
+		next()
+	}
+	var tftpErr *tftp.Error
+	if _, err := tftp.Get(ctx, tftpAddr, "casper/missing", tftp.GetOptions{}); !errors.As(err, &tftpErr) || tftpErr.Code != tftp.ErrFileNotFound {
+		t.Fatalf("TFTP get of a missing file error = %v", err)
+	}
+	next()
+
+	iso, err := os.ReadFile(filepath.Join(manager.Directory(), "noble.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpResp, body := get(t, url+"noble.iso", http.Header{"Range": {"bytes=32768-32775"}})
+	if httpResp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, iso[32768:32776]) {
+		t.Fatalf("GET of the ISO file = %s %q", httpResp.Status, body)
+	}
+	if line := next(); line != "127.0.0.1 GET /noble.iso 206 8" {
+		t.Fatalf("log line = %q", line)
+	}
+	if httpResp, body := get(t, url+"boot/grub/grub.cfg", nil); httpResp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "menuentry") {
+		t.Fatalf("GET of the ISO's own GRUB menu = %s %q", httpResp.Status, body)
+	}
+
+	cancel()
+	for range lines {
+	}
+	if code := <-exit; code != ExitOK {
+		t.Fatalf("pxe exit %d, stderr %q", code, stderr.String())
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("stderr = %q", stderr.String())
+	}
+
+	for _, args := range [][]string{
+		{"pxe"},
+		{"pxe", "--entry", "Missing", "--url", "http://192.0.2.1/", "--http", "127.0.0.1:0", "1"},
+		{"pxe", "--url", "ftp://192.0.2.1/", "--http", "127.0.0.1:0", "1"},
+	} {
+		if code := RunCLI(manager, args, io.Discard, io.Discard, CLIOptions{}); code == ExitOK {
+			t.Fatalf("%v: exit %d", args, code)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package iso2chroot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Plan output formats understood by Recorder.Render.
+const (
+	PlanShell = "shell"
+	PlanJSON  = "json"
+)
+
+// PlannedAction is one privileged operation captured by a Recorder.
+type PlannedAction struct {
+	Op      string   `json:"op"`
+	Args    []string `json:"args"`
+	Command []string `json:"command"`
+}
+
+// Recorder is a Mounter that records every privileged operation, together with
+// the command that would carry it out, instead of executing it.
+type Recorder struct {
+	mu      sync.Mutex
+	actions []PlannedAction
+}
+
+// NewRecorder constructs an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Actions returns the recorded operations in order.
+func (r *Recorder) Actions() []PlannedAction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]PlannedAction(nil), r.actions...)
+}
+
+// Reset discards the recorded operations.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions = nil
+}
+
+// Render formats the recorded plan as shell commands or JSON.
+func (r *Recorder) Render(format string) (string, error) {
+	actions := r.Actions()
+	switch format {
+	case "", PlanShell:
+		var b strings.Builder
+		for _, action := range actions {
+			quoted := make([]string, len(action.Command))
+			for i, arg := range action.Command {
+				quoted[i] = shellQuote(arg)
+			}
+			b.WriteString(strings.Join(quoted, " "))
+			b.WriteByte('\n')
+		}
+		return b.String(), nil
+	case PlanJSON:
+		if actions == nil {
+			actions = []PlannedAction{}
+		}
+		data, err := json.MarshalIndent(actions, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("encode plan: %w", err)
+		}
+		return string(data) + "\n", nil
+	default:
+		return "", fmt.Errorf("unknown plan format %q (want %s or %s)", format, PlanShell, PlanJSON)
+	}
+}
+
+func (r *Recorder) record(op string, args []string, command ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions = append(r.actions, PlannedAction{Op: op, Args: args, Command: command})
+	return nil
+}
+
+func (r *Recorder) Mkdir(ctx context.Context, path string) error {
+	return r.record("mkdir", []string{path}, "mkdir", "-p", path)
+}
+
+func (r *Recorder) Rmdir(ctx context.Context, path string) error {
+	return r.record("rmdir", []string{path}, "rmdir", path)
+}
+
+func (r *Recorder) RemoveAll(ctx context.Context, path string) error {
+	return r.record("remove", []string{path}, "sudo", "rm", "-rf", "--one-file-system", "--", path)
+}
+
+func (r *Recorder) MountLoop(ctx context.Context, image, target, fstype string) error {
+	args := []string{image, target}
+	if fstype != "" {
+		args = append(args, fstype)
+	}
+	command := append([]string{"sudo"}, mountTypeArgs(fstype)...)
+	return r.record("loop", args, append(command, "-o", "loop,ro", image, target)...)
+}
+
+func (r *Recorder) Bind(ctx context.Context, source, target string) error {
+	return r.record("bind", []string{source, target}, "sudo", "mount", "--bind", "-o", "ro", source, target)
+}
+
+func (r *Recorder) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	return r.record("overlay", []string{lower, upper, work, target},
+		"sudo", "mount", "-t", "overlay", "overlay", "-o", overlayOptions(lower, upper, work), target)
+}
+
+func (r *Recorder) Unmount(ctx context.Context, target string) error {
+	return r.record("unmount", []string{target}, "sudo", "umount", target)
+}
+
+func (r *Recorder) Chroot(ctx context.Context, root string, argv []string) error {
+	return r.record("chroot", append([]string{root}, argv...), append([]string{"sudo", "chroot", root}, argv...)...)
+}
+
+// shellQuote quotes s for POSIX shells when it contains special characters.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./=,:+@%", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,162 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden plan fixtures")
+
+// assertGolden compares got against fixtures/golden/name, rewriting the fixture
+// when the test binary runs with -update.
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("fixtures", "golden", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir golden dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatalf("write golden %s: %v", path, err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden %s: %v (run go test -update to create it)", path, err)
+	}
+	if got != string(want) {
+		t.Fatalf("plan mismatch for %s\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/tmp/iso2chroot":     "/tmp/iso2chroot",
+		"lowerdir=/a,upper=b": "lowerdir=/a,upper=b",
+		"my iso.iso":          "'my iso.iso'",
+		"it's":                `'it'\''s'`,
+		"":                    "''",
+	}
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRunCLIDryRunPlans(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		format string
+		// existing creates the named instance for real before the dry run.
+		existing string
+	}{
+		{name: "create.sh", args: []string{"create", "1"}},
+		{name: "create-instance.sh", args: []string{"create", "--name", "dev", "2"}},
+		{name: "create-instance.json", args: []string{"create", "--name", "dev", "2"}, format: PlanJSON},
+		{name: "enter.sh", args: []string{"enter", "dev", "/usr/bin/env", "LANG=C", "dpkg -l"}, existing: "dev"},
+		{name: "destroy.sh", args: []string{"destroy", "dev"}, existing: "dev"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, mounter := newInstanceManager(t, "a.iso", "b.iso")
+			src := filepath.Join(t.TempDir(), "src")
+			if tt.existing != "" {
+				if _, err := manager.Load(context.Background()); err != nil {
+					t.Fatalf("Load() error = %v", err)
+				}
+				if _, err := manager.CreateInstance(context.Background(), 1, tt.existing, InstanceOptions{}); err != nil {
+					t.Fatalf("CreateInstance() error = %v", err)
+				}
+			}
+			before := len(mounter.Calls())
+
+			var stdout, stderr bytes.Buffer
+			code := RunCLI(manager, tt.args, &stdout, &stderr, CLIOptions{
+				MountDir:   src,
+				Stdin:      strings.NewReader(""),
+				DryRun:     true,
+				PlanFormat: tt.format,
+			})
+			if code != 0 {
+				t.Fatalf("RunCLI() exit code = %d, want 0 (stderr %q)", code, stderr.String())
+			}
+			if calls := mounter.Calls(); len(calls) != before {
+				t.Fatalf("dry run reached the real mounter: %v", calls[before:])
+			}
+			if _, err := os.Stat(src); !os.IsNotExist(err) {
+				t.Fatalf("dry run created %s (err %v)", src, err)
+			}
+			instances, err := manager.LoadInstances(context.Background())
+			if err != nil {
+				t.Fatalf("LoadInstances() error = %v", err)
+			}
+			want := 0
+			if tt.existing != "" {
+				want = 1
+			}
+			if len(instances) != want {
+				t.Fatalf("instances after dry run = %+v, want %d", instances, want)
+			}
+
+			got := strings.NewReplacer(
+				manager.Directory(), "$ISOS",
+				manager.InstanceRoot(), "$ROOT",
+				src, "$SRC",
+			).Replace(stdout.String())
+			assertGolden(t, tt.name, got)
+		})
+	}
+}
+
+func TestRunCLIDryRunPlansSquashfsLower(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, RootFS: liveRootFS()}})
+	manager.SetInstanceRoot(filepath.Join(t.TempDir(), "root"))
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin:  strings.NewReader(""),
+		DryRun: true,
+	})
+	if code != 0 {
+		t.Fatalf("RunCLI() exit code = %d, want 0 (stderr %q)", code, stderr.String())
+	}
+	got := strings.NewReplacer(
+		manager.Directory(), "$ISOS",
+		manager.InstanceRoot(), "$ROOT",
+	).Replace(stdout.String())
+	assertGolden(t, "create-instance-squashfs.sh", got)
+}
+
+func TestRunCLIDryRunRefusesUnsupportedCommands(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso")
+	for _, command := range []string{"rename", "extract", "kernel", "initrd", "remaster", "autoinstall", "seed", "virt-xml", "serve-http", "pxe"} {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, []string{command, "1"}, &stdout, &stderr, CLIOptions{DryRun: true})
+		if code != ExitUsage || !strings.Contains(stderr.String(), command+" does not support --dry-run") {
+			t.Errorf("%s --dry-run: exit %d, stderr %q", command, code, stderr.String())
+		}
+	}
+}
+
+func TestRunCLIDryRunRejectsUnknownFormat(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso")
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "1"}, &stdout, &stderr, CLIOptions{
+		DryRun:     true,
+		PlanFormat: "yaml",
+	})
+	if code != 2 {
+		t.Fatalf("RunCLI() exit code = %d, want 2", code)
+	}
+}
@@ -0,0 +1,572 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+	"thatnerdjosh.com/devtools/pkg/partition"
+)
+
+const (
+	// systemAreaSize is the part of an ISO before its volume descriptors,
+	// where hybrid images keep their MBR and GPT.
+	systemAreaSize = 16 * iso9660.SectorSize
+
+	mbrTable      = 446
+	mbrProtective = 0xEE
+	// mbrBootLBA is where the isohybrid and GRUB MBRs record the 512-byte
+	// sector of the BIOS boot image, as a 64-bit value.
+	mbrBootLBA = 0x1b0
+	// writeBuffer is the buffer between the image writer and the file.
+	writeBuffer = 1 << 20
+)
+
+// RemasterOptions configures Manager.Remaster.
+type RemasterOptions struct {
+	// Overlay is a directory laid over the ISO's tree: its files replace
+	// those at the same paths and its directories are merged with the ISO's.
+	// Empty rebuilds the tree unchanged.
+	Overlay string
+	// VolumeID and Publisher replace those of the ISO when set.
+	VolumeID  string
+	Publisher string
+}
+
+// RemasterResult describes an ISO written by Manager.Remaster.
+type RemasterResult struct {
+	ISO ISOInfo
+	// Out is the new ISO and Bytes its size.
+	Out      string
+	Bytes    int64
+	VolumeID string
+	// Entries counts the files, directories and links of the new tree, and
+	// Overlaid those taken from the overlay.
+	Entries  int
+	Overlaid int
+	// Boot and BootImages describe the El Torito boot catalog of the new
+	// ISO, as read back from it.
+	Boot       string
+	BootImages []BootImage
+	// Partitions is the hybrid partition table of the new ISO, or nil.
+	Partitions *partition.Table
+	// Warnings lists what could not be carried over.
+	Warnings []string
+}
+
+// Remaster writes a new ISO to dst, which must not exist, from the tree of
+// the chosen ISO with opts.Overlay laid over it. The new ISO has Rock Ridge
+// and Joliet trees and keeps the El Torito boot images and the hybrid MBR or
+// GPT of the old one, moved to where the new layout puts them. It is read
+// back with the built-in reader before Remaster returns, and removed when it
+// does not match what was planned.
+func (m *Manager) Remaster(ctx context.Context, choice int, dst string, opts RemasterOptions) (RemasterResult, error) {
+	iso, err := m.Select(choice)
+	if err != nil {
+		return RemasterResult{}, err
+	}
+	if m.isDryRun() {
+		return RemasterResult{}, errors.New("remaster cannot be done as a dry run")
+	}
+	d, err := openISO(m.fsys, iso.Name)
+	if err != nil {
+		return RemasterResult{}, err
+	}
+	defer d.Close()
+	if d.iso == nil {
+		return RemasterResult{}, fmt.Errorf("%s has no ISO9660 volume to remaster", iso.Name)
+	}
+
+	src := overlayFS{lower: d.FS}
+	if opts.Overlay != "" {
+		info, err := os.Stat(opts.Overlay)
+		if err != nil {
+			return RemasterResult{}, err
+		}
+		if !info.IsDir() {
+			return RemasterResult{}, fmt.Errorf("overlay %s is not a directory", opts.Overlay)
+		}
+		src.upper = os.DirFS(opts.Overlay)
+	}
+	plan, err := planRemaster(d, src)
+	if err != nil {
+		return RemasterResult{}, fmt.Errorf("%s: %w", iso.Name, err)
+	}
+
+	wopts := iso9660.WriteOptions{
+		VolumeID:    d.iso.VolumeID(),
+		Publisher:   d.iso.Publisher(),
+		RockRidge:   true,
+		Joliet:      true,
+		Boot:        plan.boot,
+		CatalogPath: plan.catalog,
+	}
+	if opts.VolumeID != "" {
+		wopts.VolumeID = opts.VolumeID
+	}
+	if opts.Publisher != "" {
+		wopts.Publisher = opts.Publisher
+	}
+	for _, r := range plan.appended {
+		wopts.Appended = append(wopts.Appended, io.NewSectionReader(d.r, r.start, r.size))
+	}
+	img, err := iso9660.NewImage(src, wopts)
+	if err != nil {
+		return RemasterResult{}, err
+	}
+	backup, err := plan.systemArea(img)
+	if err != nil {
+		return RemasterResult{}, fmt.Errorf("%s: %w", iso.Name, err)
+	}
+
+	if err := writeImage(ctx, "remaster", dst, img, backup); err != nil {
+		return RemasterResult{}, err
+	}
+	result := RemasterResult{ISO: iso, Out: dst, VolumeID: wopts.VolumeID, Warnings: plan.warnings}
+	if d.udf != nil {
+		result.Warnings = append(result.Warnings, "the UDF filesystem of the ISO is not carried over; the new ISO has ISO9660 with Rock Ridge and Joliet only")
+	}
+	if err := plan.verify(ctx, dst, img, &result); err != nil {
+		os.Remove(dst)
+		return RemasterResult{}, fmt.Errorf("verify %s: %w", dst, err)
+	}
+	return result, nil
+}
+
+// region is a byte range of the old ISO.
+type region struct {
+	start, size int64
+}
+
+// remasterPlan records how the boot images and partitions of an ISO map
+// onto its remastered tree.
+type remasterPlan struct {
+	d   *disc
+	src overlayFS
+	// files maps the first sector of each file of the old ISO to its path.
+	files map[uint32]string
+	// volume is the size of the old ISO9660 volume in bytes.
+	volume int64
+	table  *partition.Table
+	boot   []iso9660.BootImage
+	// bootLBA holds the old sector of each entry of boot.
+	bootLBA []uint32
+	catalog string
+	// appended lists the data after the old volume that is carried over,
+	// such as an EFI system partition outside the tree.
+	appended []region
+	// patched holds the boot image files whose boot info is rewritten.
+	patched  map[string]bool
+	warnings []string
+}
+
+// planRemaster works out what of d besides its tree goes into the new ISO:
+// boot images, the boot catalog file and data appended after the volume.
+func planRemaster(d *disc, src overlayFS) (*remasterPlan, error) {
+	p := &remasterPlan{d: d, src: src, files: d.filesByLBA(), volume: d.iso.Size(), patched: make(map[string]bool)}
+	table, err := partition.Read(d.r)
+	if err != nil && !errors.Is(err, partition.ErrNoTable) {
+		return nil, fmt.Errorf("read partition table: %w", err)
+	}
+	p.table = table
+	if table != nil {
+		for _, part := range table.Partitions {
+			if part.Start >= p.volume {
+				if _, err := p.appendRegion(part.Start, part.Size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	entries, err := d.iso.BootEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		b := iso9660.BootImage{Platform: e.Platform, Emulation: e.Emulation, Sectors: e.Sectors}
+		offset := int64(e.LBA) * iso9660.SectorSize
+		if name, ok := p.files[e.LBA]; ok {
+			info, err := fs.Stat(d.iso, name)
+			if err != nil {
+				return nil, err
+			}
+			// A sector count covering the whole image is recounted, so a
+			// replaced image still loads in full.
+			if int64(e.Sectors) == min((info.Size()+partition.SectorSize-1)/partition.SectorSize, 0xFFFF) {
+				b.Sectors = 0
+			}
+			b.Path = name
+			b.InfoTable, b.GRUB2Info = bootInfo(d.r, e.LBA, info.Size())
+			if b.InfoTable || b.GRUB2Info {
+				p.patched[name] = true
+			}
+		} else if offset >= p.volume {
+			size := fatImageSize(d.r, offset)
+			if size == 0 {
+				size = int64(e.Sectors) * partition.SectorSize
+			}
+			if b.Appended, err = p.appendRegion(offset, size); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("boot image at sector %d is neither a file of the ISO nor data appended after it", e.LBA)
+		}
+		p.boot = append(p.boot, b)
+		p.bootLBA = append(p.bootLBA, e.LBA)
+	}
+	if len(p.boot) > 0 {
+		p.catalog = p.files[d.iso.BootCatalog()]
+	}
+	return p, nil
+}
+
+// appendRegion adds the data at offset of the old ISO to what is carried
+// over after the volume, returning its index. Data already added keeps its
+// larger known size.
+func (p *remasterPlan) appendRegion(offset, size int64) (int, error) {
+	for i, r := range p.appended {
+		if r.start == offset {
+			p.appended[i].size = max(r.size, size)
+			return i, nil
+		}
+	}
+	if size <= 0 || offset+size > p.d.size {
+		return 0, fmt.Errorf("data appended at byte %d has no size or runs past the end of the ISO", offset)
+	}
+	p.appended = append(p.appended, region{offset, size})
+	return len(p.appended) - 1, nil
+}
+
+// bootInfo reports whether the boot image at sector lba carries a boot info
+// table or GRUB's boot info, which must be rewritten when the image moves.
+func bootInfo(r io.ReaderAt, lba uint32, size int64) (infoTable, grub2 bool) {
+	offset := int64(lba) * iso9660.SectorSize
+	head := make([]byte, 24)
+	if size >= 64 {
+		if _, err := r.ReadAt(head, offset); err == nil {
+			infoTable = binary.LittleEndian.Uint32(head[8:]) == 16 &&
+				binary.LittleEndian.Uint32(head[12:]) == lba &&
+				int64(binary.LittleEndian.Uint32(head[16:])) == size
+		}
+	}
+	if size >= 2548+8 {
+		if _, err := r.ReadAt(head[:8], offset+2548); err == nil {
+			grub2 = binary.LittleEndian.Uint64(head) == uint64(lba)*4+5
+		}
+	}
+	return infoTable, grub2
+}
+
+// systemArea sets the system area of img from the old ISO's, with the
+// partitions and the MBR's boot image address moved to the new layout. For
+// a GPT it returns the backup GPT to write after the image.
+func (p *remasterPlan) systemArea(img *iso9660.Image) ([]byte, error) {
+	sys := make([]byte, systemAreaSize)
+	if _, err := p.d.r.ReadAt(sys, 0); err != nil {
+		return nil, fmt.Errorf("read system area: %w", err)
+	}
+	img.SystemArea = sys
+	if string(sys[:2]) == "ER" && string(sys[2048:2050]) == "PM" {
+		p.warnings = append(p.warnings, "the Apple partition map was copied unchanged and no longer matches the new layout")
+	}
+	if p.table == nil {
+		return nil, nil
+	}
+
+	end := img.Size()
+	sectors := end / partition.SectorSize
+	var gptEntries []byte
+	if p.table.Scheme == partition.SchemeGPT {
+		header := sys[partition.SectorSize:]
+		at := int64(binary.LittleEndian.Uint64(header[72:])) * partition.SectorSize
+		size := int64(binary.LittleEndian.Uint32(header[80:])) * int64(binary.LittleEndian.Uint32(header[84:]))
+		if at+size > systemAreaSize {
+			return nil, errors.New("the GPT entries lie outside the system area")
+		}
+		gptEntries = sys[at : at+size]
+		// The backup entries and header follow the image.
+		sectors += (size+partition.SectorSize-1)/partition.SectorSize + 1
+	}
+
+	for i := range 4 {
+		e := sys[mbrTable+16*i:]
+		start, size := binary.LittleEndian.Uint32(e[8:]), binary.LittleEndian.Uint32(e[12:])
+		if e[4] == 0 && size == 0 {
+			continue
+		}
+		newStart, newSize := int64(start)*partition.SectorSize, int64(size)*partition.SectorSize
+		if e[4] == mbrProtective {
+			newSize = (sectors - int64(start)) * partition.SectorSize
+		} else {
+			var err error
+			if newStart, newSize, err = p.relocate(img, newStart, newSize); err != nil {
+				return nil, fmt.Errorf("MBR partition %d: %w", i+1, err)
+			}
+		}
+		first, count := newStart/partition.SectorSize, newSize/partition.SectorSize
+		if first+count > 0xFFFFFFFF {
+			if e[4] != mbrProtective {
+				return nil, fmt.Errorf("MBR partition %d: the new ISO is too large for an MBR", i+1)
+			}
+			count = 0xFFFFFFFF - first
+		}
+		binary.LittleEndian.PutUint32(e[8:], uint32(first))
+		binary.LittleEndian.PutUint32(e[12:], uint32(count))
+		chs(e[1:4], uint32(first))
+		chs(e[5:8], uint32(first+count-1))
+	}
+	p.patchMBRBoot(img, sys)
+
+	if gptEntries == nil {
+		return nil, nil
+	}
+	return p.patchGPT(img, sys, gptEntries, sectors)
+}
+
+// patchGPT moves the partitions of the GPT in sys to the new layout of an
+// image of sectors 512-byte sectors, and returns its backup copy.
+func (p *remasterPlan) patchGPT(img *iso9660.Image, sys, entries []byte, sectors int64) ([]byte, error) {
+	header := sys[partition.SectorSize : 2*partition.SectorSize]
+	entrySize := int(binary.LittleEndian.Uint32(header[84:]))
+	for i := 0; i+entrySize <= len(entries); i += entrySize {
+		e := entries[i:]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+		start, size, err := p.relocate(img, int64(first)*partition.SectorSize, int64(last-first+1)*partition.SectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("GPT partition %d: %w", i/entrySize+1, err)
+		}
+		binary.LittleEndian.PutUint64(e[32:], uint64(start/partition.SectorSize))
+		binary.LittleEndian.PutUint64(e[40:], uint64((start+size)/partition.SectorSize-1))
+	}
+	entrySectors := int64(len(entries)+partition.SectorSize-1) / partition.SectorSize
+	binary.LittleEndian.PutUint64(header[32:], uint64(sectors-1))
+	binary.LittleEndian.PutUint64(header[48:], uint64(sectors-entrySectors-2))
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	gptChecksum(header)
+
+	backup := make([]byte, (entrySectors+1)*partition.SectorSize)
+	copy(backup, entries)
+	backupHeader := backup[entrySectors*partition.SectorSize:]
+	copy(backupHeader, header)
+	binary.LittleEndian.PutUint64(backupHeader[24:], uint64(sectors-1))
+	binary.LittleEndian.PutUint64(backupHeader[32:], 1)
+	binary.LittleEndian.PutUint64(backupHeader[72:], uint64(sectors-entrySectors-1))
+	gptChecksum(backupHeader)
+	return backup, nil
+}
+
+// gptChecksum sets the CRC of a GPT header.
+func gptChecksum(header []byte) {
+	size := binary.LittleEndian.Uint32(header[12:])
+	clear(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:size]))
+}
+
+// relocate maps a partition of the old ISO onto the new one. A partition
+// starting in the system area covers the volume, and the appended data too
+// when it reached the end of the old ISO; others must start at a file of the
+// tree or at data appended after the volume.
+func (p *remasterPlan) relocate(img *iso9660.Image, start, size int64) (int64, int64, error) {
+	switch {
+	case start <= systemAreaSize:
+		switch end := start + size; {
+		case end >= p.d.size:
+			return start, img.Size() - start, nil
+		case end >= p.volume:
+			return start, img.VolumeSize() - start, nil
+		}
+		return 0, 0, fmt.Errorf("partition at byte %d ends inside the ISO9660 volume", start)
+	case start >= p.volume:
+		for i, r := range p.appended {
+			if r.start == start {
+				return int64(img.AppendedLBA(i)) * iso9660.SectorSize, size, nil
+			}
+		}
+	case start%iso9660.SectorSize == 0 && p.files[uint32(start/iso9660.SectorSize)] != "":
+		name := p.files[uint32(start/iso9660.SectorSize)]
+		lba, ok := img.FileLBA(name)
+		info, err := fs.Stat(p.src, name)
+		if !ok || err != nil {
+			return 0, 0, fmt.Errorf("partition at byte %d covers %s, which is no longer a regular file", start, name)
+		}
+		return int64(lba) * iso9660.SectorSize, max((info.Size()+partition.SectorSize-1)/partition.SectorSize, 1) * partition.SectorSize, nil
+	}
+	return 0, 0, fmt.Errorf("partition at byte %d is neither the volume, a file of it nor data appended after it", start)
+}
+
+// patchMBRBoot rewrites where the MBR boot code of sys finds the BIOS boot
+// image, as isohybrid and GRUB's hybrid MBR record it.
+func (p *remasterPlan) patchMBRBoot(img *iso9660.Image, sys []byte) {
+	if bytes.Equal(sys[:mbrBootLBA], make([]byte, mbrBootLBA)) {
+		return
+	}
+	for i, b := range p.boot {
+		if b.Platform != iso9660.PlatformBIOS || b.Path == "" {
+			continue
+		}
+		old, addr := uint64(p.bootLBA[i])*4, binary.LittleEndian.Uint64(sys[mbrBootLBA:])
+		if addr >= old && addr <= old+4 {
+			binary.LittleEndian.PutUint64(sys[mbrBootLBA:], uint64(img.BootLBA(i))*4+addr-old)
+			return
+		}
+	}
+	p.warnings = append(p.warnings, "the MBR boot code was copied unchanged and may not find the BIOS boot image")
+}
+
+// chs stores the cylinder-head-sector address of a 512-byte sector in the
+// geometry of 64 heads and 32 sectors that isohybrid and xorriso use.
+func chs(b []byte, sector uint32) {
+	const heads, perTrack = 64, 32
+	c := sector / (heads * perTrack)
+	if c > 1023 {
+		b[0], b[1], b[2] = heads-1, perTrack|0xC0, 0xFF
+		return
+	}
+	b[0] = byte(sector / perTrack % heads)
+	b[1] = byte(sector%perTrack+1) | byte(c>>8)<<6
+	b[2] = byte(c)
+}
+
+// writeImage writes img, followed by trailer, to the new file dst for the
+// command op. The file is removed when anything fails.
+func writeImage(ctx context.Context, op, dst string, img *iso9660.Image, trailer []byte) error {
+	return createFile(ctx, op+" "+dst, dst, 0o644, func(f io.Writer) error {
+		w := bufio.NewWriterSize(f, writeBuffer)
+		if _, err := img.WriteTo(w); err != nil {
+			return err
+		}
+		if _, err := w.Write(trailer); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+// verify reads the ISO written to dst back and checks its boot catalog,
+// partition table and tree against the plan, filling in result.
+func (p *remasterPlan) verify(ctx context.Context, dst string, img *iso9660.Image, result *RemasterResult) error {
+	out, err := openISO(os.DirFS(filepath.Dir(dst)), filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	result.Bytes = out.size
+	if out.iso == nil || !out.iso.RockRidge() {
+		return errors.New("no Rock Ridge tree")
+	}
+	if out.iso.VolumeID() != result.VolumeID {
+		return fmt.Errorf("volume ID %q, want %q", out.iso.VolumeID(), result.VolumeID)
+	}
+
+	if result.BootImages, err = out.bootImages(); err != nil {
+		return err
+	}
+	if len(result.BootImages) != len(p.boot) {
+		return fmt.Errorf("%d boot images, want %d", len(result.BootImages), len(p.boot))
+	}
+	for i, image := range result.BootImages {
+		if image.Platform != bootPlatform(p.boot[i].Platform) || image.LBA != img.BootLBA(i) {
+			return fmt.Errorf("boot image %d is a %s image at sector %d, want %s at sector %d", i+1, image.Platform, image.LBA, bootPlatform(p.boot[i].Platform), img.BootLBA(i))
+		}
+	}
+	result.Boot = bootSummary(result.BootImages)
+
+	if p.table != nil {
+		if result.Partitions, err = partition.Read(out.r); err != nil {
+			return fmt.Errorf("read partition table: %w", err)
+		}
+		if result.Partitions.Scheme != p.table.Scheme || len(result.Partitions.Partitions) != len(p.table.Partitions) {
+			return fmt.Errorf("%s partition table with %d partitions, want %s with %d", result.Partitions.Scheme, len(result.Partitions.Partitions), p.table.Scheme, len(p.table.Partitions))
+		}
+	}
+
+	return fs.WalkDir(p.src, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return contextError("verify "+dst, ctx)
+		}
+		want, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		got, err := out.iso.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if got.Mode().Type() != want.Mode().Type() {
+			return fmt.Errorf("%s is %v, want %v", name, got.Mode().Type(), want.Mode().Type())
+		}
+		upper := want.(overlayInfo).upper
+		result.Entries++
+		if upper {
+			result.Overlaid++
+		}
+		switch {
+		case name == p.catalog:
+		case want.Mode().IsRegular():
+			if got.Size() != want.Size() {
+				return fmt.Errorf("%s has %d bytes, want %d", name, got.Size(), want.Size())
+			}
+			if upper && !p.patched[name] {
+				if err := sameContents(p.src, out.iso, name); err != nil {
+					return err
+				}
+			}
+		case want.Mode().Type() == fs.ModeSymlink:
+			wantTarget, err := p.src.ReadLink(name)
+			if err != nil {
+				return err
+			}
+			if target, err := out.iso.ReadLink(name); err != nil || target != wantTarget {
+				return fmt.Errorf("%s links to %q, want %q", name, target, wantTarget)
+			}
+		}
+		return nil
+	})
+}
+
+// sameContents checks that the file name has the same contents in a and b.
+func sameContents(a, b fs.FS, name string) error {
+	fa, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+	ba, bb := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, ba)
+		nb, errB := io.ReadFull(fb, bb)
+		if na != nb || !bytes.Equal(ba[:na], bb[:nb]) {
+			return fmt.Errorf("%s differs from the overlay", name)
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if errA != nil {
+			return errA
+		}
+		if errB != nil {
+			return errB
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+	"thatnerdjosh.com/devtools/pkg/partition"
+)
+
+// remasterFiles is the tree of the bootable ISOs remaster tests start from.
+func remasterFiles() []isotest.File {
+	return []isotest.File{
+		{Path: "isolinux/isolinux.bin", Data: bytes.Repeat([]byte("isolinux"), 512)},
+		isotest.Text("isolinux/isolinux.cfg", "default live\n"),
+		{Path: "boot/grub/efi.img", Data: bytes.Repeat([]byte("ESP!"), 1024)},
+		isotest.Text("boot/grub/grub.cfg", "menuentry \"Try Ubuntu\" {}\n"),
+		isotest.Text("casper/vmlinuz", "kernel"),
+		isotest.HardLink("casper/vmlinuz.efi", "casper/vmlinuz"),
+		isotest.Text("casper/initrd", "initrd"),
+		isotest.Symlink("ubuntu", "."),
+		{Path: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5, Minor: 1},
+	}
+}
+
+// writeOverlay creates the overlay directory the remaster tests lay over
+// the ISO: a replaced file, a new one in an existing directory, a new
+// directory and a symlink.
+func writeOverlay(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"casper/initrd":              "new initrd",
+		"boot/grub/grub.cfg":         "menuentry \"Install\" {}\n",
+		"preseed/custom.seed":        "d-i debian-installer/locale string en_US\n",
+		"preseed/late/commands.sh":   "#!/bin/sh\n",
+		"boot/grub/themes/theme.txt": "title-text: \"\"\n",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("custom.seed", filepath.Join(dir, "preseed", "default.seed")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// openRemastered opens the ISO written by remaster.
+func openRemastered(t *testing.T, name string) (*iso9660.FS, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := iso9660.Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("iso9660.Open(%s) error = %v", name, err)
+	}
+	return out, data
+}
+
+func TestRemasterHybrid(t *testing.T) {
+	for _, hybrid := range []string{isotest.HybridMBR, isotest.HybridGPT} {
+		t.Run(hybrid, func(t *testing.T) {
+			dir := t.TempDir()
+			isotest.WriteISO(t, dir, "noble.iso", isotest.ISO{
+				VolumeID:  "Ubuntu 24.04 LTS amd64",
+				Publisher: "Canonical",
+				RockRidge: true,
+				Joliet:    true,
+				Files:     remasterFiles(),
+				BIOSBoot:  "isolinux/isolinux.bin",
+				EFIBoot:   "boot/grub/efi.img",
+				Hybrid:    hybrid,
+			})
+			manager := NewManager(dir)
+			if _, err := manager.Load(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(t.TempDir(), "custom.iso")
+			result, err := manager.Remaster(context.Background(), 1, dst, RemasterOptions{Overlay: writeOverlay(t), VolumeID: "NOBLE_CUSTOM"})
+			if err != nil {
+				t.Fatalf("Remaster() error = %v", err)
+			}
+			if result.VolumeID != "NOBLE_CUSTOM" || result.Boot != "BIOS: isolinux, UEFI: grub EFI image" || result.Overlaid != 9 || len(result.Warnings) != 0 {
+				t.Fatalf("Remaster() = %+v", result)
+			}
+
+			out, data := openRemastered(t, dst)
+			if out.VolumeID() != "NOBLE_CUSTOM" || out.Publisher() != "Canonical" || !out.RockRidge() || int64(len(data)) != result.Bytes {
+				t.Fatalf("new ISO: VolumeID() = %q, Publisher() = %q, RockRidge() = %t, %d bytes", out.VolumeID(), out.Publisher(), out.RockRidge(), len(data))
+			}
+			for name, want := range map[string]string{
+				"casper/initrd":         "new initrd",
+				"casper/vmlinuz.efi":    "kernel",
+				"isolinux/isolinux.cfg": "default live\n",
+				"preseed/default.seed":  "d-i debian-installer/locale string en_US\n",
+				"boot/grub/grub.cfg":    "menuentry \"Install\" {}\n",
+			} {
+				if got, err := fs.ReadFile(out, name); err != nil || string(got) != want {
+					t.Errorf("ReadFile(%s) = %q, %v; want %q", name, got, err, want)
+				}
+			}
+			if info, err := out.Lstat("dev/console"); err != nil || info.Mode().Type() != fs.ModeDevice|fs.ModeCharDevice || info.Sys().(*iso9660.Stat).Major != 5 {
+				t.Errorf("dev/console = %v, %v", info, err)
+			}
+
+			table := result.Partitions
+			if table == nil || table.Scheme != hybrid || len(table.Partitions) != 2 {
+				t.Fatalf("Partitions = %+v", table)
+			}
+			efi, _ := out.Lstat("boot/grub/efi.img")
+			esp := table.Partitions[1]
+			if !esp.ESP() || esp.Start != int64(efi.Sys().(*iso9660.Stat).LBA)*iso9660.SectorSize || esp.Size != efi.Size() {
+				t.Errorf("ESP partition = %+v, want the %d bytes of efi.img at sector %d", esp, efi.Size(), efi.Sys().(*iso9660.Stat).LBA)
+			}
+			whole := table.Partitions[0]
+			if end := whole.Start + whole.Size; end != out.Size() {
+				t.Errorf("partition 1 ends at byte %d, want the volume end %d", end, out.Size())
+			}
+			if hybrid == isotest.HybridGPT {
+				// The backup GPT header is the last sector, pointing back
+				// at the primary one.
+				backup := data[len(data)-partition.SectorSize:]
+				if string(backup[:8]) != "EFI PART" || binary.LittleEndian.Uint64(backup[24:]) != uint64(len(data)/partition.SectorSize-1) || binary.LittleEndian.Uint64(backup[32:]) != 1 {
+					t.Errorf("no backup GPT header at the end of the image")
+				}
+			}
+		})
+	}
+}
+
+// TestRemasterAppended covers images shaped like those of xorriso: the ESP
+// is appended after the volume, the BIOS image carries a boot info table and
+// the MBR boot code records where it is.
+func TestRemasterAppended(t *testing.T) {
+	loader := make([]byte, 4096)
+	for i := range loader {
+		loader[i] = byte(i * 7)
+	}
+	esp := make([]byte, 64*1024)
+	binary.LittleEndian.PutUint16(esp[11:], 512)
+	binary.LittleEndian.PutUint16(esp[19:], uint16(len(esp)/512))
+	esp[510], esp[511] = 0x55, 0xAA
+	src := fstest.MapFS{
+		"boot/grub/i386-pc/eltorito.img": {Data: loader, Mode: 0o644},
+		"boot/grub/grub.cfg":             {Data: []byte("menuentry \"Live\" {}\n"), Mode: 0o644},
+		"boot.catalog":                   {Data: []byte("catalog"), Mode: 0o644},
+		"EFI/boot/grubx64.efi":           {Data: []byte("grub"), Mode: 0o644},
+	}
+	img, err := iso9660.NewImage(src, iso9660.WriteOptions{
+		VolumeID:    "LIVE",
+		RockRidge:   true,
+		CatalogPath: "boot.catalog",
+		Appended:    []*io.SectionReader{io.NewSectionReader(bytes.NewReader(esp), 0, int64(len(esp)))},
+		Boot: []iso9660.BootImage{
+			{Platform: iso9660.PlatformBIOS, Sectors: 4, Path: "boot/grub/i386-pc/eltorito.img", InfoTable: true, GRUB2Info: true},
+			{Platform: iso9660.PlatformEFI},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbr := make([]byte, 512)
+	copy(mbr, "\xeb\x63\x90 GRUB hybrid MBR boot code")
+	oldBIOS, _ := img.FileLBA("boot/grub/i386-pc/eltorito.img")
+	binary.LittleEndian.PutUint64(mbr[mbrBootLBA:], uint64(oldBIOS)*4+4)
+	putPart := func(i int, typ byte, start, size int64) {
+		e := mbr[mbrTable+16*i:]
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:], uint32(start/512))
+		binary.LittleEndian.PutUint32(e[12:], uint32(size/512))
+	}
+	putPart(0, 0x00, 0, img.VolumeSize())
+	mbr[mbrTable+4] = 0xcd
+	putPart(1, 0xef, int64(img.AppendedLBA(0))*iso9660.SectorSize, int64(len(esp)))
+	mbr[510], mbr[511] = 0x55, 0xAA
+	img.SystemArea = mbr
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "live.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	manager := NewManager(dir)
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	overlay := t.TempDir()
+	if err := os.WriteFile(filepath.Join(overlay, "a-file-sorting-before-the-loader"), bytes.Repeat([]byte("x"), 10000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "live-custom.iso")
+	result, err := manager.Remaster(context.Background(), 1, dst, RemasterOptions{Overlay: overlay, Publisher: "Example"})
+	if err != nil {
+		t.Fatalf("Remaster() error = %v", err)
+	}
+	if result.Boot != "BIOS: grub, UEFI: grub EFI image" || len(result.Warnings) != 0 {
+		t.Fatalf("Remaster() = %+v", result)
+	}
+
+	out, data := openRemastered(t, dst)
+	images := result.BootImages
+	newBIOS := images[0].LBA
+	if newBIOS == oldBIOS || images[1].Path != "" || images[1].LBA*iso9660.SectorSize != uint32(out.Size()) {
+		t.Fatalf("boot images = %+v; want the BIOS image moved and the ESP appended at byte %d", images, out.Size())
+	}
+	if got := data[int64(images[1].LBA)*iso9660.SectorSize:][:len(esp)]; !bytes.Equal(got, esp) {
+		t.Error("appended ESP differs")
+	}
+	if got := binary.LittleEndian.Uint64(data[mbrBootLBA:]); got != uint64(newBIOS)*4+4 {
+		t.Errorf("MBR boot image address = %d, want %d", got, uint64(newBIOS)*4+4)
+	}
+	patched, err := fs.ReadFile(out, "boot/grub/i386-pc/eltorito.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(patched[12:]) != newBIOS || binary.LittleEndian.Uint64(patched[2548:]) != uint64(newBIOS)*4+5 {
+		t.Error("boot info of eltorito.img was not moved with it")
+	}
+	if catalog, err := out.Lstat("boot.catalog"); err != nil || catalog.Sys().(*iso9660.Stat).LBA != out.BootCatalog() {
+		t.Errorf("boot.catalog = %v, %v; want the boot catalog", catalog, err)
+	}
+	parts := result.Partitions.Partitions
+	if parts[0].Start != 0 || parts[0].Size != out.Size() || parts[1].Start != int64(images[1].LBA)*iso9660.SectorSize || parts[1].Size != int64(len(esp)) {
+		t.Errorf("partitions = %+v", parts)
+	}
+}
+
+func TestRunCLIRemaster(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{
+		"noble.iso":  {RockRidge: true, Files: remasterFiles(), BIOSBoot: "isolinux/isolinux.bin"},
+		"bridge.iso": {Joliet: true, Files: remasterFiles(), UDF: &isotest.UDF{}},
+	})
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+
+	out := filepath.Join(t.TempDir(), "custom.iso")
+	code, stdout, stderr := run("remaster", "2", "--label", "CUSTOM", "--out", out)
+	if code != ExitOK || !strings.Contains(stdout, `Wrote `+out+` from noble.iso (label "CUSTOM", `) || !strings.Contains(stdout, "Boot: BIOS: isolinux\n") || !strings.Contains(stdout, "Verified") {
+		t.Fatalf("remaster: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if code, _, stderr := run("remaster", "2", "--out", out); code != ExitFailure || !strings.Contains(stderr, "exists") {
+		t.Fatalf("remaster over an existing file: exit %d, stderr %q", code, stderr)
+	}
+	if code, _, stderr := run("remaster", "2", "--label", strings.Repeat("X", 33), "--out", out+".2"); code == ExitOK || !strings.Contains(stderr, "longer than 32 bytes") {
+		t.Fatalf("remaster with a long label: exit %d, stderr %q", code, stderr)
+	}
+	if _, err := os.Stat(out + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("failed remaster left %s.2 behind: %v", out, err)
+	}
+
+	bridge := filepath.Join(t.TempDir(), "bridge.iso")
+	if code, _, stderr := run("remaster", "1", "--out", bridge); code != ExitOK || !strings.Contains(stderr, "UDF filesystem of the ISO is not carried over") {
+		t.Fatalf("remaster of UDF bridge media: exit %d, stderr %q", code, stderr)
+	}
+	if code, _, _ := run("remaster", "2"); code != ExitUsage {
+		t.Fatalf("remaster without --out: exit %d, want %d", code, ExitUsage)
+	}
+	var stdout2, stderr2 bytes.Buffer
+	if code := RunCLI(manager, []string{"remaster", "2", "--out", out + ".3"}, &stdout2, &stderr2, CLIOptions{DryRun: true}); code != ExitUsage {
+		t.Fatalf("remaster --dry-run: exit %d, want %d", code, ExitUsage)
+	}
+}
@@ -0,0 +1,245 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+)
+
+// SeedLabel is the volume label cloud-init's NoCloud datasource looks for.
+const SeedLabel = "cidata"
+
+// Files of a NoCloud seed, in the order they are listed.
+const (
+	seedUserData      = "user-data"
+	seedMetaData      = "meta-data"
+	seedNetworkConfig = "network-config"
+)
+
+// SeedOptions configures Manager.Seed.
+type SeedOptions struct {
+	// UserData, MetaData and NetworkConfig are files copied into the seed.
+	// NetworkConfig is optional.
+	UserData      string
+	MetaData      string
+	NetworkConfig string
+	// Instance names an instance whose hostname and SSH authorized keys
+	// make up the user-data and meta-data that are not given as files.
+	Instance string
+}
+
+// SeedResult describes a seed ISO written by Manager.Seed.
+type SeedResult struct {
+	// Out is the new ISO and Bytes its size.
+	Out   string
+	Bytes int64
+	// Files lists the files of the seed.
+	Files []string
+	// Hostname and Keys are what was taken from SeedOptions.Instance.
+	Hostname string
+	Keys     int
+	// Warnings lists what cloud-init is likely to ignore.
+	Warnings []string
+}
+
+// Seed writes a NoCloud seed ISO to dst, which must not exist: an ISO
+// labelled cidata with Rock Ridge and Joliet trees holding user-data,
+// meta-data and, when given, network-config at the root. It is read back
+// with the built-in reader before Seed returns, and removed when it does not
+// match.
+func (m *Manager) Seed(ctx context.Context, dst string, opts SeedOptions) (SeedResult, error) {
+	if m.isDryRun() {
+		return SeedResult{}, errors.New("seed cannot be done as a dry run")
+	}
+	var result SeedResult
+	files := make(map[string][]byte)
+	if opts.Instance != "" {
+		root, err := m.instanceRootPath(ctx, opts.Instance)
+		if err != nil {
+			return SeedResult{}, err
+		}
+		seed, err := instanceSeed(root, opts.Instance)
+		if err != nil {
+			return SeedResult{}, fmt.Errorf("instance %q: %w", opts.Instance, err)
+		}
+		files[seedUserData], files[seedMetaData] = seed.userData, seed.metaData
+		result.Hostname, result.Keys, result.Warnings = seed.hostname, len(seed.keys), seed.warnings
+	}
+	for name, file := range map[string]string{seedUserData: opts.UserData, seedMetaData: opts.MetaData, seedNetworkConfig: opts.NetworkConfig} {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return SeedResult{}, err
+		}
+		files[name] = data
+	}
+	if files[seedUserData] == nil || files[seedMetaData] == nil {
+		return SeedResult{}, errors.New("a seed needs user-data and meta-data")
+	}
+	result.Warnings = append(result.Warnings, checkSeed(files)...)
+
+	dir, err := os.MkdirTemp("", "iso2chroot-seed-")
+	if err != nil {
+		return SeedResult{}, err
+	}
+	defer os.RemoveAll(dir)
+	// The tree's root becomes that of the ISO; MkdirTemp leaves it private.
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return SeedResult{}, err
+	}
+	for _, name := range []string{seedUserData, seedMetaData, seedNetworkConfig} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return SeedResult{}, err
+		}
+		result.Files = append(result.Files, name)
+	}
+	img, err := iso9660.NewImage(os.DirFS(dir), iso9660.WriteOptions{VolumeID: SeedLabel, RockRidge: true, Joliet: true})
+	if err != nil {
+		return SeedResult{}, err
+	}
+	if err := writeImage(ctx, "seed", dst, img, nil); err != nil {
+		return SeedResult{}, err
+	}
+	if err := verifySeed(dst, files); err != nil {
+		os.Remove(dst)
+		return SeedResult{}, fmt.Errorf("verify %s: %w", dst, err)
+	}
+	result.Out, result.Bytes = dst, img.Size()
+	return result, nil
+}
+
+// verifySeed reads the seed ISO at dst back and checks its label and files.
+func verifySeed(dst string, files map[string][]byte) error {
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	iso, err := iso9660.Open(f)
+	if err != nil {
+		return err
+	}
+	if iso.VolumeID() != SeedLabel {
+		return fmt.Errorf("volume label is %q, want %q", iso.VolumeID(), SeedLabel)
+	}
+	for name, want := range files {
+		got, err := fs.ReadFile(iso, name)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("%s differs from what was written", name)
+		}
+	}
+	return nil
+}
+
+// checkSeed warns about seed files cloud-init is likely to ignore.
+func checkSeed(files map[string][]byte) []string {
+	var warnings []string
+	userData := files[seedUserData]
+	// cloud-init acts on user-data by its first line: #cloud-config, a
+	// script, an include list, a MIME multipart message or gzip data.
+	if len(bytes.TrimSpace(userData)) > 0 && !bytes.HasPrefix(userData, []byte("#")) &&
+		!bytes.HasPrefix(userData, []byte("Content-Type:")) && !bytes.HasPrefix(userData, []byte{0x1f, 0x8b}) {
+		warnings = append(warnings, "user-data does not start with #cloud-config or another header cloud-init knows; it will be ignored")
+	}
+	if !bytes.Contains(files[seedMetaData], []byte("instance-id")) {
+		warnings = append(warnings, "meta-data has no instance-id; cloud-init may treat every boot as a new instance")
+	}
+	return warnings
+}
+
+// seedFromInstance is the user-data and meta-data made from an instance.
+type seedFromInstance struct {
+	userData, metaData []byte
+	hostname           string
+	keys               []string
+	warnings           []string
+}
+
+// instanceSeed reads the hostname and the SSH authorized keys of root and
+// of every user under /home from the instance tree at dir. Symlinks that
+// lead out of the tree are not followed.
+func instanceSeed(dir, name string) (*seedFromInstance, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	seed := &seedFromInstance{hostname: name}
+	hostname, err := root.ReadFile("etc/hostname")
+	switch {
+	case err == nil:
+		if line, _, _ := strings.Cut(strings.TrimSpace(string(hostname)), "\n"); line != "" {
+			seed.hostname = line
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	default:
+		seed.warnings = append(seed.warnings, "the instance has no /etc/hostname; using the instance name as the hostname")
+	}
+
+	keyFiles := []string{"root/.ssh/authorized_keys"}
+	homes, err := fs.Glob(root.FS(), "home/*/.ssh/authorized_keys")
+	if err != nil {
+		return nil, err
+	}
+	keyFiles = append(keyFiles, homes...)
+	for _, file := range keyFiles {
+		data, err := root.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			seed.warnings = append(seed.warnings, fmt.Sprintf("skipping /%s: %v", file, err))
+			continue
+		}
+		for line := range strings.Lines(string(data)) {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") && !slices.Contains(seed.keys, line) {
+				seed.keys = append(seed.keys, line)
+			}
+		}
+	}
+	if len(seed.keys) == 0 {
+		seed.warnings = append(seed.warnings, "the instance has no SSH authorized keys; nobody will be able to log in over SSH")
+	}
+
+	seed.metaData = fmt.Appendf(nil, "instance-id: %s\nlocal-hostname: %s\n", yamlString("iid-"+name), yamlString(seed.hostname))
+	var b strings.Builder
+	fmt.Fprintf(&b, "#cloud-config\nhostname: %s\n", yamlString(seed.hostname))
+	if len(seed.keys) > 0 {
+		b.WriteString("ssh_authorized_keys:\n")
+		for _, key := range seed.keys {
+			fmt.Fprintf(&b, "  - %s\n", yamlString(key))
+		}
+	}
+	seed.userData = []byte(b.String())
+	return seed, nil
+}
+
+// yamlString quotes s as a YAML double-quoted scalar, which JSON strings
+// are.
+func yamlString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
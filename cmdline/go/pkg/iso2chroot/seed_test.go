@@ -0,0 +1,156 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+)
+
+// readSeed opens the seed ISO at name and returns its files.
+func readSeed(t *testing.T, name string) (*iso9660.FS, map[string]string) {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	iso, err := iso9660.Open(f)
+	if err != nil {
+		t.Fatalf("iso9660.Open(%s) error = %v", name, err)
+	}
+	entries, err := fs.ReadDir(iso, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		data, err := fs.ReadFile(iso, e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = string(data)
+	}
+	return iso, files
+}
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInstanceSeed(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"etc/hostname":                    "jammy-dev\n",
+		"root/.ssh/authorized_keys":       "# admin\nssh-ed25519 AAAAC3Nz root@host\n\n",
+		"home/ann/.ssh/authorized_keys":   "ssh-ed25519 AAAAC3Nz root@host\nssh-rsa AAAAB3Nz ann: \"laptop\"\n",
+		"home/bob/.ssh/authorized_keys.d": "ssh-rsa AAAAB3Nz ignored\n",
+	})
+	outside := filepath.Join(t.TempDir(), "authorized_keys")
+	writeTree(t, filepath.Dir(outside), map[string]string{"authorized_keys": "ssh-rsa AAAAB3Nz host\n"})
+	if err := os.MkdirAll(filepath.Join(dir, "home/eve/.ssh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "home/eve/.ssh/authorized_keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := instanceSeed(dir, "dev")
+	if err != nil {
+		t.Fatalf("instanceSeed() error = %v", err)
+	}
+	if want := "instance-id: \"iid-dev\"\nlocal-hostname: \"jammy-dev\"\n"; string(seed.metaData) != want {
+		t.Errorf("meta-data = %q, want %q", seed.metaData, want)
+	}
+	want := "#cloud-config\nhostname: \"jammy-dev\"\nssh_authorized_keys:\n  - \"ssh-ed25519 AAAAC3Nz root@host\"\n  - \"ssh-rsa AAAAB3Nz ann: \\\"laptop\\\"\"\n"
+	if string(seed.userData) != want {
+		t.Errorf("user-data = %q, want %q", seed.userData, want)
+	}
+	if len(seed.warnings) != 1 || !strings.Contains(seed.warnings[0], "home/eve/.ssh/authorized_keys") {
+		t.Errorf("warnings = %q, want one about the link out of the tree", seed.warnings)
+	}
+
+	empty, err := instanceSeed(t.TempDir(), "bare")
+	if err != nil {
+		t.Fatalf("instanceSeed() of an empty tree error = %v", err)
+	}
+	if empty.hostname != "bare" || len(empty.keys) != 0 || len(empty.warnings) != 2 {
+		t.Errorf("instanceSeed() of an empty tree = %q with %d keys, warnings %q", empty.hostname, len(empty.keys), empty.warnings)
+	}
+}
+
+func TestRunCLISeed(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso")
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+	input := t.TempDir()
+	writeTree(t, input, map[string]string{
+		"user-data":      "#cloud-config\npassword: ubuntu\n",
+		"meta-data":      "instance-id: vm-1\n",
+		"network-config": "version: 2\n",
+	})
+	file := func(name string) string { return filepath.Join(input, name) }
+
+	out := filepath.Join(t.TempDir(), "seed.iso")
+	code, stdout, stderr := run("seed", "--user-data", file("user-data"), "--meta-data", file("meta-data"), "--network-config", file("network-config"), "--out", out)
+	if code != ExitOK || !strings.HasPrefix(stdout, "Wrote "+out+" (cidata: user-data, meta-data, network-config, ") || stderr != "" {
+		t.Fatalf("seed: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	iso, files := readSeed(t, out)
+	if iso.VolumeID() != "cidata" || !iso.RockRidge() {
+		t.Fatalf("seed volume = %q, Rock Ridge %v; want cidata with Rock Ridge names", iso.VolumeID(), iso.RockRidge())
+	}
+	if files["user-data"] != "#cloud-config\npassword: ubuntu\n" || files["meta-data"] != "instance-id: vm-1\n" || files["network-config"] != "version: 2\n" || len(files) != 3 {
+		t.Fatalf("seed files = %q", files)
+	}
+
+	if code, _, stderr := run("seed", "--user-data", file("user-data"), "--meta-data", file("meta-data"), "--out", out); code != ExitFailure || !strings.Contains(stderr, "exists") {
+		t.Fatalf("seed over an existing file: exit %d, stderr %q", code, stderr)
+	}
+	if code, _, _ := run("seed", "--user-data", file("user-data"), "--out", out+".2"); code != ExitUsage {
+		t.Fatalf("seed without --meta-data: exit %d, want %d", code, ExitUsage)
+	}
+
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.CreateInstance(context.Background(), 1, "dev", InstanceOptions{}); err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	writeTree(t, filepath.Join(manager.InstanceDir("dev"), instanceRootDir), map[string]string{
+		"etc/hostname":              "devbox\n",
+		"root/.ssh/authorized_keys": "ssh-ed25519 AAAAC3Nz me@host\n",
+	})
+	out = filepath.Join(t.TempDir(), "dev.iso")
+	code, stdout, stderr = run("seed", "--from-instance", "dev", "--meta-data", file("meta-data"), "--out", out)
+	if code != ExitOK || !strings.Contains(stdout, "From instance dev: hostname devbox, 1 SSH authorized keys\n") {
+		t.Fatalf("seed --from-instance: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	_, files = readSeed(t, out)
+	if files["user-data"] != "#cloud-config\nhostname: \"devbox\"\nssh_authorized_keys:\n  - \"ssh-ed25519 AAAAC3Nz me@host\"\n" || files["meta-data"] != "instance-id: vm-1\n" || len(files) != 2 {
+		t.Fatalf("seed --from-instance files = %q", files)
+	}
+	if code, _, stderr := run("seed", "--from-instance", "nope", "--out", out+".2"); code == ExitOK || !strings.Contains(stderr, "nope") {
+		t.Fatalf("seed --from-instance nope: exit %d, stderr %q", code, stderr)
+	}
+	if code := RunCLI(manager, []string{"seed", "--from-instance", "dev", "--out", out + ".2"}, &bytes.Buffer{}, &bytes.Buffer{}, CLIOptions{DryRun: true}); code != ExitUsage {
+		t.Fatalf("--dry-run seed: exit %d, want %d", code, ExitUsage)
+	}
+}
@@ -0,0 +1,204 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RootFSPrefix is the URL path under which an ISOServer serves the live root
+// filesystem of its ISO.
+const RootFSPrefix = "/rootfs/"
+
+const (
+	// serveHeaderTimeout bounds how long a client may take to send the
+	// headers of a request.
+	serveHeaderTimeout = 10 * time.Second
+	// serveShutdownTimeout is how long ISOServer.Serve lets downloads in
+	// progress finish once it is asked to stop.
+	serveShutdownTimeout = 5 * time.Second
+)
+
+// ServeOptions configures Manager.NewISOServer.
+type ServeOptions struct {
+	// RootFS also serves the live root filesystem inside the ISO, under
+	// RootFSPrefix.
+	RootFS bool
+	// ISOFile also serves the ISO file itself, under its name at the root,
+	// for installers that download the whole image.
+	ISOFile bool
+	// Log, when set, receives a line for each request.
+	Log io.Writer
+}
+
+// ISOServer serves the files of an ISO over HTTP, read with the built-in
+// readers rather than from a mount, for network installs. It answers range
+// requests, lists directories that have no index.html, and refuses device
+// nodes, pipes and sockets. It is safe for concurrent use.
+type ISOServer struct {
+	// Disc is the ISO served, and RootFS its live root filesystem when
+	// ServeOptions.RootFS is set.
+	Disc    *Image
+	RootFS  *Image
+	handler http.Handler
+	// file is the ISO file when ServeOptions.ISOFile is set.
+	file *disc
+
+	logMu sync.Mutex
+	log   io.Writer
+}
+
+// NewISOServer opens the chosen ISO to serve, each open bounded by the
+// Inspect timeout. Close the server to release it.
+func (m *Manager) NewISOServer(ctx context.Context, choice int, opts ServeOptions) (*ISOServer, error) {
+	img, err := m.OpenImage(ctx, choice, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &ISOServer{Disc: img, log: opts.Log}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServerFS(servedFS{img}))
+	if opts.RootFS {
+		prefix := strings.Trim(RootFSPrefix, "/")
+		if _, err := fs.Lstat(img, prefix); err == nil {
+			img.Close()
+			return nil, fmt.Errorf("%s has its own /%s, which the live root filesystem would hide", img, prefix)
+		}
+		if s.RootFS, err = m.OpenImage(ctx, choice, true); err != nil {
+			img.Close()
+			return nil, err
+		}
+		mux.Handle(RootFSPrefix, http.StripPrefix("/"+prefix, http.FileServerFS(servedFS{s.RootFS})))
+	}
+	s.handler = mux
+	if opts.ISOFile {
+		name := img.ISO.Name
+		if _, err := fs.Lstat(img, name); err == nil {
+			s.Close()
+			return nil, fmt.Errorf("%s has its own /%s, which the ISO file would hide", img, name)
+		}
+		openCtx, cancel := withTimeout(ctx, m.Timeouts().Inspect)
+		s.file, err = openBlocking(openCtx, "open "+m.Path(img.ISO), func() (*disc, error) {
+			return openISO(m.fsys, name)
+		})
+		cancel()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		modTime := time.Time{}
+		if info, err := fs.Stat(m.fsys, name); err == nil {
+			modTime = info.ModTime()
+		}
+		s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/"+name {
+				mux.ServeHTTP(w, r)
+				return
+			}
+			http.ServeContent(w, r, name, modTime, io.NewSectionReader(s.file.r, 0, s.file.size))
+		})
+	}
+	return s, nil
+}
+
+// Close releases the ISO.
+func (s *ISOServer) Close() error {
+	err := s.Disc.Close()
+	if s.RootFS != nil {
+		err = errors.Join(err, s.RootFS.Close())
+	}
+	if s.file != nil {
+		err = errors.Join(err, s.file.Close())
+	}
+	return err
+}
+
+// ServeHTTP implements http.Handler.
+func (s *ISOServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		lw.Header().Set("Allow", "GET, HEAD")
+		http.Error(lw, "method not allowed", http.StatusMethodNotAllowed)
+	} else {
+		s.handler.ServeHTTP(lw, r)
+	}
+	if s.log != nil {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		s.logMu.Lock()
+		fmt.Fprintf(s.log, "%s %s %s %d %d\n", client, r.Method, r.URL.RequestURI(), lw.status, lw.bytes)
+		s.logMu.Unlock()
+	}
+}
+
+// Serve answers requests arriving on ln until ctx ends, then lets downloads
+// in progress finish for a few seconds before closing their connections.
+func (s *ISOServer) Serve(ctx context.Context, ln net.Listener) error {
+	server := &http.Server{Handler: s, ReadHeaderTimeout: serveHeaderTimeout}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(ln) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdown); err != nil {
+		server.Close()
+	}
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// servedFS is the tree of an Image as an ISOServer serves it: only
+// directories and regular files can be opened.
+type servedFS struct {
+	fs.FS
+}
+
+func (s servedFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f, nil
+}
+
+// loggingWriter records the status and size of a response.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,209 @@
+package iso2chroot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+func newServeManager(t *testing.T) *Manager {
+	t.Helper()
+	files := append(discFiles(), isotest.Text("boot/grub/x86_64-efi/normal.mod", "module"))
+	return newTestManager(t, map[string]isotest.ISO{"noble.iso": {RockRidge: true, Files: files, RootFS: liveRootFS()}})
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return resp, body
+}
+
+// checkServedFiles compares every regular file extracted to dir with what
+// the server at url serves for it.
+func checkServedFiles(t *testing.T, url, dir string) int {
+	t.Helper()
+	files := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		want, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		resp, body := get(t, url+"/"+filepath.ToSlash(rel), nil)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, want) {
+			t.Errorf("GET /%s = %s, %d bytes; want the %d extracted bytes", rel, resp.Status, len(body), len(want))
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestISOServer(t *testing.T) {
+	manager := newServeManager(t)
+	ctx := context.Background()
+	if _, err := manager.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	disc, root := filepath.Join(t.TempDir(), "disc"), filepath.Join(t.TempDir(), "root")
+	if _, err := manager.Extract(ctx, 1, disc, ExtractOptions{}); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if _, err := manager.Extract(ctx, 1, root, ExtractOptions{RootFS: true}); err != nil {
+		t.Fatalf("Extract() of the root filesystem error = %v", err)
+	}
+
+	var log bytes.Buffer
+	server, err := manager.NewISOServer(context.Background(), 1, ServeOptions{RootFS: true, Log: &log})
+	if err != nil {
+		t.Fatalf("NewISOServer() error = %v", err)
+	}
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	if n := checkServedFiles(t, ts.URL, disc); n < 5 {
+		t.Fatalf("checked %d files of the disc, want at least 5", n)
+	}
+	if n := checkServedFiles(t, ts.URL+"/rootfs", root); n < 5 {
+		t.Fatalf("checked %d files of the root filesystem, want at least 5", n)
+	}
+
+	kernel, err := os.ReadFile(filepath.Join(disc, "casper/vmlinuz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := get(t, ts.URL+"/casper/vmlinuz", http.Header{"Range": {"bytes=4090-4105"}})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, kernel[4090:4106]) || resp.Header.Get("Content-Range") != "bytes 4090-4105/6000" {
+		t.Fatalf("range request = %s %q, Content-Range %q", resp.Status, body, resp.Header.Get("Content-Range"))
+	}
+	busybox, err := os.ReadFile(filepath.Join(root, "usr/bin/busybox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := get(t, ts.URL+"/rootfs/usr/bin/busybox", http.Header{"Range": {"bytes=-7"}}); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, busybox[len(busybox)-7:]) {
+		t.Fatalf("suffix range request in the root filesystem = %s %q", resp.Status, body)
+	}
+
+	resp, body = get(t, ts.URL+"/boot/grub/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `<a href="grub.cfg">grub.cfg</a>`) || !strings.Contains(string(body), `<a href="x86_64-efi/">x86_64-efi/</a>`) {
+		t.Fatalf("directory listing = %s %q", resp.Status, body)
+	}
+	if resp, body := get(t, ts.URL+"/rootfs/bin/sh", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, busybox) {
+		t.Fatalf("GET through a symlink = %s, %d bytes", resp.Status, len(body))
+	}
+	for path, status := range map[string]int{
+		"/rootfs/dev/null":    http.StatusForbidden,
+		"/rootfs/run/initctl": http.StatusForbidden,
+		"/missing":            http.StatusNotFound,
+		"/rootfs/missing":     http.StatusNotFound,
+	} {
+		if resp, _ := get(t, ts.URL+path, nil); resp.StatusCode != status {
+			t.Errorf("GET %s = %s, want %d", path, resp.Status, status)
+		}
+	}
+	resp, err = http.Post(ts.URL+"/casper/vmlinuz", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("POST = %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+	// Close waits for the requests in flight, and so for their log lines.
+	ts.Close()
+	if !strings.Contains(log.String(), " GET /casper/vmlinuz 206 16\n") || !strings.Contains(log.String(), " POST /casper/vmlinuz 405 ") {
+		t.Fatalf("log = %q", log.String())
+	}
+
+	plain, err := manager.NewISOServer(context.Background(), 1, ServeOptions{})
+	if err != nil {
+		t.Fatalf("NewISOServer() error = %v", err)
+	}
+	defer plain.Close()
+	rec := httptest.NewRecorder()
+	plain.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rootfs/etc/hostname", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("GET /rootfs/etc/hostname without RootFS = %d, want 404", rec.Code)
+	}
+}
+
+func TestRunCLIServeHTTP(t *testing.T) {
+	manager := newServeManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	exit := make(chan int, 1)
+	go func() {
+		exit <- RunCLI(manager, []string{"serve-http", "--listen", "127.0.0.1:0", "--rootfs", "1"}, pw, &stderr, CLIOptions{Context: ctx})
+		pw.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	first := <-lines
+	url, ok := strings.CutPrefix(first, "Serving noble.iso at ")
+	if !ok || !strings.HasPrefix(url, "http://127.0.0.1:") {
+		t.Fatalf("first line = %q", first)
+	}
+	if second := <-lines; second != "Serving noble.iso/casper/filesystem.squashfs at "+url+"rootfs/" {
+		t.Fatalf("second line = %q", second)
+	}
+	if resp, body := get(t, url+"rootfs/etc/hostname", nil); resp.StatusCode != http.StatusOK || string(body) != "ubuntu\n" {
+		t.Fatalf("GET /rootfs/etc/hostname = %s %q", resp.Status, body)
+	}
+	if line := <-lines; !strings.HasPrefix(line, "127.0.0.1 GET /rootfs/etc/hostname 200 7") {
+		t.Fatalf("log line = %q", line)
+	}
+	cancel()
+	for range lines {
+	}
+	if code := <-exit; code != ExitOK {
+		t.Fatalf("serve-http exit %d, stderr %q", code, stderr.String())
+	}
+
+	if code := RunCLI(manager, []string{"serve-http"}, io.Discard, io.Discard, CLIOptions{}); code != ExitUsage {
+		t.Fatalf("serve-http without an ISO: exit %d, want %d", code, ExitUsage)
+	}
+	if code := RunCLI(manager, []string{"serve-http", "--listen", "127.0.0.1:-1", "1"}, io.Discard, io.Discard, CLIOptions{}); code != ExitFailure {
+		t.Fatalf("serve-http on a bad address: exit %d, want %d", code, ExitFailure)
+	}
+}
@@ -0,0 +1,169 @@
+package iso2chroot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeouts bounds individual Manager operations. A zero duration means no limit.
+type Timeouts struct {
+	// Load bounds reading the ISO directory, the instance registry and the
+	// filesystem checks made before mounting.
+	Load time.Duration
+	// Inspect bounds hashing an ISO and reading its metadata.
+	Inspect time.Duration
+	// Command bounds each privileged command, such as one mount or umount,
+	// including any sudo password prompt. Commands run by enter are not bounded.
+	Command time.Duration
+}
+
+// DefaultTimeouts are the limits used by NewManager.
+var DefaultTimeouts = Timeouts{
+	Load:    30 * time.Second,
+	Inspect: 10 * time.Minute,
+	Command: 2 * time.Minute,
+}
+
+// String formats t in the syntax accepted by ParseTimeouts.
+func (t Timeouts) String() string {
+	return fmt.Sprintf("load=%s,inspect=%s,command=%s", t.Load, t.Inspect, t.Command)
+}
+
+// ParseTimeouts applies a comma-separated list of op=duration pairs, such as
+// "load=5s,command=1m", on top of base. Valid ops are load, inspect and command.
+func ParseTimeouts(spec string, base Timeouts) (Timeouts, error) {
+	t := base
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		op, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return base, fmt.Errorf("invalid timeout %q: want op=duration", field)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return base, fmt.Errorf("invalid timeout %q: want a non-negative duration such as 30s", field)
+		}
+		switch strings.TrimSpace(op) {
+		case "load":
+			t.Load = d
+		case "inspect":
+			t.Inspect = d
+		case "command":
+			t.Command = d
+		default:
+			return base, fmt.Errorf("invalid timeout %q: op must be load, inspect or command", field)
+		}
+	}
+	return t, nil
+}
+
+// withTimeout derives a context bounded by d, or leaves ctx unbounded when d is zero.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// contextCause explains why ctx ended: ErrTimeout for a deadline, ErrCancelled otherwise.
+func contextCause(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrCancelled
+}
+
+// contextError reports that op stopped because ctx ended.
+func contextError(op string, ctx context.Context) error {
+	return fmt.Errorf("%s: %w", op, contextCause(ctx))
+}
+
+// runBlocking runs fn and returns its result, or gives up when ctx ends first.
+// Calls that can block in the kernel, such as reading an unresponsive NFS
+// mount, cannot be interrupted; fn is left to finish in the background.
+func runBlocking[T any](ctx context.Context, op string, fn func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, contextError(op, ctx)
+	}
+}
+
+// openBlocking is runBlocking for fn that opens something, such as an ISO.
+// When ctx ends first, whatever fn opens once it finishes is closed.
+func openBlocking[T io.Closer](ctx context.Context, op string, fn func() (T, error)) (T, error) {
+	var (
+		mu        sync.Mutex
+		opened    T
+		ok        bool
+		abandoned bool
+	)
+	value, err := runBlocking(ctx, op, func() (T, error) {
+		value, err := fn()
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			if abandoned {
+				value.Close()
+			}
+			opened, ok = value, true
+		}
+		return value, err
+	})
+	if err != nil && ctx.Err() != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		abandoned = true
+		if ok {
+			opened.Close()
+		}
+	}
+	return value, err
+}
+
+// contextReader fails reads once ctx has ended, so long copies stop promptly.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once ctx has ended, so long copies stop
+// promptly.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,243 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestParseTimeouts(t *testing.T) {
+	base := Timeouts{Load: time.Second, Inspect: time.Minute, Command: time.Hour}
+	tests := []struct {
+		spec    string
+		want    Timeouts
+		wantErr bool
+	}{
+		{spec: "", want: base},
+		{spec: "load=5s", want: Timeouts{Load: 5 * time.Second, Inspect: time.Minute, Command: time.Hour}},
+		{spec: " command=0 , inspect=2m ", want: Timeouts{Load: time.Second, Inspect: 2 * time.Minute}},
+		{spec: "load", wantErr: true},
+		{spec: "load=soon", wantErr: true},
+		{spec: "load=-1s", wantErr: true},
+		{spec: "mount=1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeouts(tt.spec, base)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseTimeouts(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			if got != base {
+				t.Fatalf("ParseTimeouts(%q) = %+v on error, want base unchanged", tt.spec, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Fatalf("ParseTimeouts(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+
+	if got, err := ParseTimeouts(DefaultTimeouts.String(), Timeouts{}); err != nil || got != DefaultTimeouts {
+		t.Fatalf("ParseTimeouts(DefaultTimeouts.String()) = %+v, %v, want round trip", got, err)
+	}
+}
+
+func TestRunBlockingGivesUpWhenContextEnds(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := runBlocking(ctx, "read /stuck", func() (int, error) {
+		<-release
+		return 1, nil
+	})
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "read /stuck") {
+		t.Fatalf("runBlocking() error = %v, want ErrTimeout naming the operation", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := runBlocking(ctx, "read /stuck", func() (int, error) {
+		<-release
+		return 1, nil
+	}); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("runBlocking() error = %v, want ErrCancelled", err)
+	}
+}
+
+// closeRecorder records that it was closed.
+type closeRecorder chan struct{}
+
+func (c closeRecorder) Close() error {
+	close(c)
+	return nil
+}
+
+func TestOpenBlockingClosesWhatItGaveUpOn(t *testing.T) {
+	release := make(chan struct{})
+	opened := make(closeRecorder)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := openBlocking(ctx, "open /stuck.iso", func() (closeRecorder, error) {
+		<-release
+		return opened, nil
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("openBlocking() error = %v, want ErrTimeout", err)
+	}
+	close(release)
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("openBlocking() did not close what it opened after giving up")
+	}
+}
+
+// stuckFS is an ISO directory whose ISOs never open, like one on an
+// unresponsive NFS mount.
+type stuckFS struct {
+	fstest.MapFS
+	release chan struct{}
+}
+
+func (s stuckFS) Open(name string) (fs.File, error) {
+	if strings.HasSuffix(name, ".iso") {
+		<-s.release
+	}
+	return s.MapFS.Open(name)
+}
+
+func TestReadingAnISOHonoursInspectTimeout(t *testing.T) {
+	fsys := stuckFS{MapFS: fstest.MapFS{"stuck.iso": {Data: []byte("iso")}}, release: make(chan struct{})}
+	defer close(fsys.release)
+	manager := NewManagerFS(t.TempDir(), fsys)
+	manager.SetTimeouts(Timeouts{Inspect: 10 * time.Millisecond})
+	ctx := context.Background()
+	if _, err := manager.Load(ctx); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if _, err := manager.OpenImage(ctx, 1, false); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("OpenImage() error = %v, want ErrTimeout", err)
+	}
+	if _, err := manager.NewISOServer(ctx, 1, ServeOptions{}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("NewISOServer() error = %v, want ErrTimeout", err)
+	}
+	if _, err := manager.NewPXEServer(ctx, 1, PXEOptions{URL: "http://192.0.2.1/"}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("NewPXEServer() error = %v, want ErrTimeout", err)
+	}
+	if _, err := manager.ExtractKernel(ctx, 1, filepath.Join(t.TempDir(), "kernel"), KernelOptions{}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("ExtractKernel() error = %v, want ErrTimeout", err)
+	}
+}
+
+func TestLoadHonoursCancelledContext(t *testing.T) {
+	manager, _ := newInstanceManager(t, "a.iso")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := manager.Load(ctx); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("Load() error = %v, want ErrCancelled", err)
+	}
+}
+
+// stuckMounter never finishes mounting the ISO until its context ends, like a
+// sudo password prompt nobody answers.
+type stuckMounter struct {
+	*fakeMounter
+}
+
+func (s stuckMounter) MountLoop(ctx context.Context, image, target, fstype string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCreateTimesOutStuckCommandAndRollsBack(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	manager.SetMounter(stuckMounter{mounter})
+	manager.SetTimeouts(Timeouts{Command: 20 * time.Millisecond})
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin: strings.NewReader("\n"),
+	})
+	if code != ExitTimeout {
+		t.Fatalf("RunCLI() exit code = %d, want %d (stderr %q)", code, ExitTimeout, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "rolled back: prepare-instance-dirs") {
+		t.Fatalf("stderr = %q, want rollback of the prepared instance", stderr.String())
+	}
+	if instances, err := manager.LoadInstances(context.Background()); err != nil || len(instances) != 0 {
+		t.Fatalf("LoadInstances() = %+v, %v, want none after rollback", instances, err)
+	}
+}
+
+func TestAcquireLockStopsWaitingWhenContextEnds(t *testing.T) {
+	target := t.TempDir() + "/target"
+	held, err := acquireLock(context.Background(), target, 0)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	defer held.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*lockPollInterval)
+	defer cancel()
+	start := time.Now()
+	if _, err := acquireLock(ctx, target, time.Hour); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("acquireLock() error = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("acquireLock() waited %v after its context ended", elapsed)
+	}
+}
+
+func TestManagerConcurrentRefreshAndReads(t *testing.T) {
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("image-%02d.iso", i))
+	}
+	manager, _ := newInstanceManager(t, names...)
+	if _, err := manager.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if _, err := manager.Load(ctx); err != nil && ctx.Err() == nil {
+				t.Errorf("Load() error = %v", err)
+				return
+			}
+			if _, err := manager.LoadInstances(ctx); err != nil && ctx.Err() == nil {
+				t.Errorf("LoadInstances() error = %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if _, err := manager.Select(i%20 + 1); err != nil {
+			t.Fatalf("Select(%d) error = %v", i%20+1, err)
+		}
+		if _, _, err := manager.Resolve("7"); err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		if got := manager.EntryCount(); got != len(names) {
+			t.Fatalf("EntryCount() = %d, want %d", got, len(names))
+		}
+		manager.Instances()
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package iso2chroot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// RollbackError reports a failed or cancelled operation together with what was
+// undone afterwards. Errors from the failed step are reachable through Unwrap.
+type RollbackError struct {
+	Err error
+	// RolledBack lists the steps that were undone, most recent first. Steps
+	// without an undo are not listed.
+	RolledBack []string
+	// Failed names the step whose undo failed, if any; rollback stops there.
+	Failed    string
+	FailedErr error
+	// Remaining lists the completed steps left in place after a failed undo.
+	Remaining []string
+}
+
+func (e *RollbackError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// Summary describes what the rollback undid and what it left behind.
+func (e *RollbackError) Summary() []string {
+	var lines []string
+	if len(e.RolledBack) > 0 {
+		lines = append(lines, "rolled back: "+strings.Join(e.RolledBack, ", "))
+	}
+	if e.Failed != "" {
+		lines = append(lines, fmt.Sprintf("could not roll back %s: %v", e.Failed, e.FailedErr))
+	}
+	if len(e.Remaining) > 0 {
+		lines = append(lines, "left in place: "+strings.Join(e.Remaining, ", "))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "nothing to roll back")
+	}
+	return lines
+}
+
+type txStep struct {
+	name string
+	undo func() error
+}
+
+// transaction runs named steps in order and remembers how to undo each one.
+type transaction struct {
+	ctx   context.Context
+	steps []txStep
+}
+
+func newTransaction(ctx context.Context) *transaction {
+	return &transaction{ctx: ctx}
+}
+
+// undoContext is the context undo steps run under. Rollback usually follows
+// cancellation, so it keeps ctx's values but not its cancellation.
+func (t *transaction) undoContext() context.Context {
+	return context.WithoutCancel(t.ctx)
+}
+
+// do runs action unless the transaction has been cancelled and, on success,
+// registers undo for rollback. A step whose undo is nil, such as one undone by
+// an earlier step's undo, has nothing to roll back.
+func (t *transaction) do(name string, action func() error, undo func() error) error {
+	if t.ctx.Err() != nil {
+		return contextError("before "+name, t.ctx)
+	}
+	if err := action(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	t.steps = append(t.steps, txStep{name: name, undo: undo})
+	return nil
+}
+
+// rollback undoes completed steps in reverse order, stopping at the first undo
+// that fails so later cleanup never runs on top of a step still in place.
+func (t *transaction) rollback(cause error) *RollbackError {
+	result := &RollbackError{Err: cause}
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if step.undo == nil {
+			continue
+		}
+		if err := step.undo(); err != nil {
+			result.Failed = step.name
+			result.FailedErr = err
+			for j := i; j >= 0; j-- {
+				result.Remaining = append(result.Remaining, t.steps[j].name)
+			}
+			break
+		}
+		result.RolledBack = append(result.RolledBack, step.name)
+	}
+	t.steps = nil
+	return result
+}
@@ -0,0 +1,176 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransactionRollbackOrder(t *testing.T) {
+	tx := newTransaction(context.Background())
+	var undone []string
+	for _, name := range []string{"one", "two", "three"} {
+		if err := tx.do(name, func() error { return nil }, func() error {
+			undone = append(undone, name)
+			return nil
+		}); err != nil {
+			t.Fatalf("do(%s) error = %v", name, err)
+		}
+	}
+	// A step without an undo has nothing to roll back and is not reported.
+	if err := tx.do("record", func() error { return nil }, nil); err != nil {
+		t.Fatalf("do(record) error = %v", err)
+	}
+
+	cause := errors.New("boom")
+	if err := tx.do("four", func() error { return cause }, nil); !errors.Is(err, cause) {
+		t.Fatalf("do(four) error = %v, want %v", err, cause)
+	}
+	result := tx.rollback(cause)
+	if strings.Join(undone, ",") != "three,two,one" {
+		t.Fatalf("undo order = %v, want three,two,one", undone)
+	}
+	if strings.Join(result.RolledBack, ",") != "three,two,one" || result.Failed != "" {
+		t.Fatalf("rollback = %+v, want all three rolled back", result)
+	}
+	if !errors.Is(result, cause) {
+		t.Fatalf("rollback error does not wrap cause")
+	}
+}
+
+func TestTransactionRollbackStopsAtFailedUndo(t *testing.T) {
+	tx := newTransaction(context.Background())
+	undoErr := errors.New("device busy")
+	tx.do("mkdir", func() error { return nil }, func() error { return nil })
+	tx.do("mount", func() error { return nil }, func() error { return undoErr })
+	tx.do("overlay", func() error { return nil }, func() error { return nil })
+
+	result := tx.rollback(errors.New("later step failed"))
+	if strings.Join(result.RolledBack, ",") != "overlay" {
+		t.Fatalf("RolledBack = %v, want [overlay]", result.RolledBack)
+	}
+	if result.Failed != "mount" || !errors.Is(result.FailedErr, undoErr) {
+		t.Fatalf("Failed = %q (%v), want mount", result.Failed, result.FailedErr)
+	}
+	if strings.Join(result.Remaining, ",") != "mount,mkdir" {
+		t.Fatalf("Remaining = %v, want mount,mkdir", result.Remaining)
+	}
+}
+
+func TestTransactionStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tx := newTransaction(ctx)
+	tx.do("first", func() error { return nil }, nil)
+	cancel()
+
+	ran := false
+	err := tx.do("second", func() error { ran = true; return nil }, nil)
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("do() error = %v, want ErrCancelled", err)
+	}
+	if ran {
+		t.Fatal("expected cancelled step not to run")
+	}
+}
+
+func TestRunCLICreateRollsBackFailedInstance(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	mounter.failOn = "overlay"
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin: strings.NewReader("\n"),
+	})
+	if code != 1 {
+		t.Fatalf("RunCLI() exit code = %d, want 1", code)
+	}
+
+	dir := manager.InstanceDir("dev")
+	calls := mounter.Calls()
+	wantTail := []string{"umount " + dir + "/lower", "umount " + dir + "/iso"}
+	if got := calls[len(calls)-2:]; strings.Join(got, "\n") != strings.Join(wantTail, "\n") {
+		t.Fatalf("rollback calls = %q, want %q", got, wantTail)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("instance dir still exists (err %v)", err)
+	}
+	if instances, _ := manager.LoadInstances(context.Background()); len(instances) != 0 {
+		t.Fatalf("instances = %+v, want none after rollback", instances)
+	}
+	want := "rolled back: mount-lower, mount-iso-ro, prepare-instance-dirs"
+	if !strings.Contains(stderr.String(), want) {
+		t.Fatalf("stderr = %q, want %q", stderr.String(), want)
+	}
+}
+
+func TestRunCLICreateRollsBackWhenInterrupted(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mounter.onMount = func(op, target string) {
+		if op == "bind" {
+			cancel()
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin:   strings.NewReader("\n"),
+		Context: ctx,
+	})
+	if code != ExitCancelled {
+		t.Fatalf("RunCLI() exit code = %d, want %d (stderr %q)", code, ExitCancelled, stderr.String())
+	}
+	for _, call := range mounter.Calls() {
+		if strings.HasPrefix(call, "overlay") {
+			t.Fatalf("unexpected overlay mount after cancellation: %v", mounter.Calls())
+		}
+	}
+	if !strings.Contains(stderr.String(), "rolled back: mount-lower, mount-iso-ro, prepare-instance-dirs") {
+		t.Fatalf("stderr = %q, want rollback summary", stderr.String())
+	}
+	if _, err := os.Stat(manager.InstanceDir("dev")); !os.IsNotExist(err) {
+		t.Fatalf("instance dir still exists (err %v)", err)
+	}
+}
+
+func TestRunCLICreateUnmountsWhenRecordFails(t *testing.T) {
+	manager, mounter := newInstanceManager(t, "a.iso")
+	// A directory in the way of the registry's temporary file makes the
+	// update after the lower mount fail, until rollback starts unmounting.
+	blocker := filepath.Join(manager.InstanceRoot(), registryFile+".tmp")
+	mounter.onMount = func(op, target string) {
+		switch op {
+		case "bind":
+			if err := os.Mkdir(blocker, 0o755); err != nil {
+				t.Error(err)
+			}
+		case "umount":
+			os.Remove(blocker)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := RunCLI(manager, []string{"create", "--name", "dev", "1"}, &stdout, &stderr, CLIOptions{
+		Stdin: strings.NewReader("\n"),
+	})
+	if code != 1 {
+		t.Fatalf("RunCLI() exit code = %d, want 1 (stderr %q)", code, stderr.String())
+	}
+	dir := manager.InstanceDir("dev")
+	calls := mounter.Calls()
+	wantTail := []string{"umount " + dir + "/lower", "umount " + dir + "/iso"}
+	if got := calls[len(calls)-2:]; strings.Join(got, "\n") != strings.Join(wantTail, "\n") {
+		t.Fatalf("rollback calls = %q, want %q", got, wantTail)
+	}
+	if !strings.Contains(stderr.String(), "rolled back: mount-lower, mount-iso-ro, prepare-instance-dirs") {
+		t.Fatalf("stderr = %q, want rollback summary", stderr.String())
+	}
+	if instances, _ := manager.LoadInstances(context.Background()); len(instances) != 0 {
+		t.Fatalf("instances = %+v, want none after rollback", instances)
+	}
+}
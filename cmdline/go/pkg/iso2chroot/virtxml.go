@@ -0,0 +1,491 @@
+package iso2chroot
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LibvirtImageDir is where libvirt's default storage pool keeps disk images.
+const LibvirtImageDir = "/var/lib/libvirt/images"
+
+// Firmware choices of VirtXMLOptions.
+const (
+	FirmwareAuto = "auto"
+	FirmwareBIOS = "bios"
+	FirmwareUEFI = "uefi"
+)
+
+const (
+	gib = 1 << 30
+	// libosinfoNS is the namespace of the libosinfo metadata of a domain.
+	libosinfoNS = "http://libosinfo.org/xmlns/libvirt/domain/1.0"
+)
+
+// VirtXMLOptions configures Manager.VirtXML.
+type VirtXMLOptions struct {
+	// Name is the domain name. Empty uses the ISO name without its
+	// extension.
+	Name string
+	// Memory is the memory of the machine in bytes, and VCPUs its
+	// processors.
+	Memory int64
+	VCPUs  int
+	// DiskSize is the size of the machine's disk in bytes; 0 leaves the
+	// machine without one, to run a live ISO. Disk is the disk image, by
+	// default Name.qcow2 in LibvirtImageDir; a .qcow2 name makes it a qcow2
+	// image and anything else a raw one.
+	DiskSize int64
+	Disk     string
+	// Network is "network=<name>", "bridge=<name>", "user" or "none".
+	Network string
+	// Firmware is FirmwareBIOS, FirmwareUEFI, or FirmwareAuto or empty to
+	// follow the boot catalog of the ISO.
+	Firmware string
+}
+
+// VirtXMLResult is a libvirt domain written by Manager.VirtXML.
+type VirtXMLResult struct {
+	ISO  ISOInfo
+	Name string
+	// OS is the distribution the domain is tuned for, and OSDetected
+	// reports whether it was recognised on the ISO.
+	OS         OSVariant
+	OSDetected bool
+	// Firmware is BootBIOS or BootUEFI.
+	Firmware string
+	// Disk is the disk image the domain uses, which must be created before
+	// it starts, and DiskCommand the command that creates it. Both are empty
+	// without a disk.
+	Disk        string
+	DiskCommand string
+	// XML is the domain definition, ready for virsh define.
+	XML []byte
+	// Warnings lists choices the machine may not cope with.
+	Warnings []string
+}
+
+// VirtXML writes a libvirt domain that boots the chosen ISO from a CD-ROM.
+// The firmware follows the El Torito boot catalog, preferring UEFI, and the
+// devices suit the distribution detected on the ISO. The domain is only
+// written, not defined, so no libvirt daemon is needed.
+func (m *Manager) VirtXML(ctx context.Context, choice int, opts VirtXMLOptions) (VirtXMLResult, error) {
+	details, err := m.Info(ctx, choice)
+	if err != nil {
+		return VirtXMLResult{}, err
+	}
+	isoPath, err := filepath.Abs(m.Path(details.ISO))
+	if err != nil {
+		return VirtXMLResult{}, err
+	}
+	return domainFor(details, isoPath, opts)
+}
+
+// domainFor builds the domain of VirtXML for the ISO described by details,
+// found at isoPath.
+func domainFor(details ISODetails, isoPath string, opts VirtXMLOptions) (VirtXMLResult, error) {
+	result := VirtXMLResult{ISO: details.ISO, Name: opts.Name, OS: details.OS, OSDetected: details.OSDetected}
+	if result.Name == "" {
+		result.Name = domainName(details.ISO.Name)
+	}
+	if strings.ContainsRune(result.Name, '/') {
+		return VirtXMLResult{}, fmt.Errorf("invalid domain name %q: it must not contain /", result.Name)
+	}
+	if opts.Memory < 1<<20 || opts.VCPUs < 1 {
+		return VirtXMLResult{}, errors.New("a machine needs at least 1 MiB of memory and one processor")
+	}
+	iface, err := parseNetwork(opts.Network)
+	if err != nil {
+		return VirtXMLResult{}, err
+	}
+	if !details.OSDetected {
+		result.Warnings = append(result.Warnings, "the distribution was not recognised; the domain is set up for generic Linux")
+	}
+	arch := result.OS.Arch
+	if arch == "" {
+		arch = ArchX86_64
+	}
+	if host := hostArch(); host != "" && host != arch {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("the ISO is for %s but this host is %s; KVM cannot run it, so change the domain type to qemu to emulate it", arch, host))
+	}
+	windows := result.OS.Family == FamilyWindows
+
+	var hasBIOS, hasUEFI bool
+	for _, image := range details.BootImages {
+		hasBIOS = hasBIOS || image.Platform == BootBIOS
+		hasUEFI = hasUEFI || image.Platform == BootUEFI
+	}
+	switch opts.Firmware {
+	case FirmwareBIOS:
+		result.Firmware = BootBIOS
+	case FirmwareUEFI:
+		result.Firmware = BootUEFI
+	case "", FirmwareAuto:
+		switch {
+		case hasUEFI || hasBIOS && arch == ArchAArch64:
+			result.Firmware = BootUEFI
+		case hasBIOS:
+			result.Firmware = BootBIOS
+		default:
+			return VirtXMLResult{}, fmt.Errorf("%s has no El Torito boot image, so it does not boot from a CD-ROM; choose --firmware to write a domain anyway", details.ISO.Name)
+		}
+	default:
+		return VirtXMLResult{}, fmt.Errorf("unknown firmware %q (want %s, %s or %s)", opts.Firmware, FirmwareAuto, FirmwareBIOS, FirmwareUEFI)
+	}
+	if result.Firmware == BootUEFI && !hasUEFI {
+		result.Warnings = append(result.Warnings, details.ISO.Name+" has no UEFI boot image; the machine may not boot from it")
+	}
+	if result.Firmware == BootBIOS && !hasBIOS {
+		result.Warnings = append(result.Warnings, details.ISO.Name+" has no BIOS boot image; the machine may not boot from it")
+	}
+	if result.Firmware == BootBIOS && arch == ArchAArch64 {
+		return VirtXMLResult{}, errors.New("aarch64 machines boot with UEFI only")
+	}
+
+	domain := domainXML{
+		Type:     "kvm",
+		Name:     result.Name,
+		Metadata: metadataXML{Libosinfo: libosinfoXML{NS: libosinfoNS, OS: libosinfoOSXML{ID: result.OS.ID}}},
+		Memory:   memoryXML{Unit: "KiB", Value: opts.Memory >> 10},
+		VCPU:     opts.VCPUs,
+		OS:       osXML{Type: osTypeXML{Arch: arch, Machine: "q35", Value: "hvm"}},
+		Features: featuresXML{ACPI: &struct{}{}, APIC: &struct{}{}},
+		CPU:      cpuXML{Mode: "host-passthrough"},
+		Clock:    clockXML{Offset: "utc"},
+	}
+	// Windows keeps the hardware clock in local time, and without drivers
+	// only sees SATA disks and Intel network cards.
+	diskBus, diskDev, nicModel := "virtio", "vda", "virtio"
+	if windows {
+		domain.Clock.Offset = "localtime"
+		diskBus, diskDev, nicModel = "sata", "sda", "e1000e"
+	}
+	cdromBus := "sata"
+	if arch == ArchAArch64 {
+		// The virt machine of aarch64 has no SATA controller.
+		domain.OS.Type.Machine = "virt"
+		domain.Features.APIC = nil
+		domain.Features.GIC = &gicXML{Version: "3"}
+		cdromBus = "scsi"
+		domain.Devices.Controllers = append(domain.Devices.Controllers, controllerXML{Type: "scsi", Model: "virtio-scsi"})
+		if windows {
+			diskBus, diskDev = "virtio", "vda"
+		}
+	}
+	if result.Firmware == BootUEFI {
+		domain.OS.Firmware = "efi"
+		// Windows 11 insists on Secure Boot and a TPM; distributions whose
+		// loaders are not signed do not boot with it.
+		secureBoot := "no"
+		if windows {
+			secureBoot = "yes"
+			domain.Features.SMM = &smmXML{State: "on"}
+		}
+		domain.OS.FirmwareFeatures = &firmwareXML{Features: []firmwareFeatureXML{{Enabled: secureBoot, Name: "secure-boot"}}}
+	}
+	if windows {
+		domain.Devices.TPM = &tpmXML{Model: "tpm-crb", Backend: tpmBackendXML{Type: "emulator", Version: "2.0"}}
+	}
+
+	if opts.DiskSize > 0 {
+		result.Disk = opts.Disk
+		if result.Disk == "" {
+			result.Disk = filepath.Join(LibvirtImageDir, result.Name+".qcow2")
+		}
+		if result.Disk, err = filepath.Abs(result.Disk); err != nil {
+			return VirtXMLResult{}, err
+		}
+		format := "raw"
+		if strings.HasSuffix(result.Disk, ".qcow2") {
+			format = "qcow2"
+		}
+		result.DiskCommand = fmt.Sprintf("qemu-img create -f %s %s %s", format, shellQuote(result.Disk), qemuSize(opts.DiskSize))
+		if !strings.Contains(result.DiskCommand, "--") {
+			domain.Comment = " Create the disk first: " + result.DiskCommand + " "
+		}
+		domain.OS.Boot = append(domain.OS.Boot, bootXML{Dev: "hd"})
+		domain.Devices.Disks = append(domain.Devices.Disks, diskXML{
+			Type:   "file",
+			Device: "disk",
+			Driver: driverXML{Name: "qemu", Type: format, Discard: "unmap"},
+			Source: sourceXML{File: result.Disk},
+			Target: targetXML{Dev: diskDev, Bus: diskBus},
+		})
+		if windows && opts.DiskSize < 64*gib {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Windows 11 needs a disk of 64 GiB; this one has %s", formatBytes(opts.DiskSize)))
+		}
+	}
+	if windows && opts.Memory < 4*gib {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Windows 11 needs 4 GiB of memory; this machine has %s", formatBytes(opts.Memory)))
+	}
+	cdromDev := "sda"
+	if opts.DiskSize > 0 && diskBus == cdromBus {
+		cdromDev = "sdb"
+	}
+	domain.OS.Boot = append(domain.OS.Boot, bootXML{Dev: "cdrom"})
+	domain.Devices.Disks = append(domain.Devices.Disks, diskXML{
+		Type:     "file",
+		Device:   "cdrom",
+		Driver:   driverXML{Name: "qemu", Type: "raw"},
+		Source:   sourceXML{File: isoPath},
+		Target:   targetXML{Dev: cdromDev, Bus: cdromBus},
+		ReadOnly: &struct{}{},
+	})
+	if iface != nil {
+		iface.Model = modelXML{Type: nicModel}
+		domain.Devices.Interfaces = append(domain.Devices.Interfaces, *iface)
+	}
+	domain.Devices.Serials = []charXML{{Type: "pty"}}
+	domain.Devices.Consoles = []charXML{{Type: "pty"}}
+	domain.Devices.Inputs = []inputXML{{Type: "tablet", Bus: "usb"}}
+	domain.Devices.Graphics = &graphicsXML{Type: "vnc", Port: "-1", AutoPort: "yes"}
+	domain.Devices.Video = &videoXML{Model: modelXML{Type: "virtio"}}
+	domain.Devices.RNG = &rngXML{Model: "virtio", Backend: rngBackendXML{Model: "random", Value: "/dev/urandom"}}
+
+	out, err := xml.MarshalIndent(domain, "", "  ")
+	if err != nil {
+		return VirtXMLResult{}, err
+	}
+	result.XML = append(out, '\n')
+	return result, nil
+}
+
+// domainName makes a domain name from the file name of an ISO.
+func domainName(iso string) string {
+	name := strings.TrimSuffix(iso, filepath.Ext(iso))
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._+-", r) {
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// parseNetwork reads a network option of VirtXMLOptions. It returns nil for
+// "none".
+func parseNetwork(network string) (*interfaceXML, error) {
+	kind, name, _ := strings.Cut(network, "=")
+	switch {
+	case network == "none":
+		return nil, nil
+	case network == "user":
+		return &interfaceXML{Type: "user"}, nil
+	case kind == "network" && name != "":
+		return &interfaceXML{Type: "network", Source: &interfaceSourceXML{Network: name}}, nil
+	case kind == "bridge" && name != "":
+		return &interfaceXML{Type: "bridge", Source: &interfaceSourceXML{Bridge: name}}, nil
+	}
+	return nil, fmt.Errorf("unknown network %q (want network=<name>, bridge=<name>, user or none)", network)
+}
+
+// qemuSize renders n bytes as qemu-img takes sizes.
+func qemuSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n%unit.size == 0 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprint(n)
+}
+
+// hostArch is the architecture of this host as libvirt names it, or empty
+// when the ISOs it can boot are not recognised.
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return ArchX86_64
+	case "arm64":
+		return ArchAArch64
+	}
+	return ""
+}
+
+// The types below mirror the parts of the libvirt domain format that
+// VirtXML writes; see https://libvirt.org/formatdomain.html.
+
+type domainXML struct {
+	XMLName  xml.Name    `xml:"domain"`
+	Type     string      `xml:"type,attr"`
+	Comment  string      `xml:",comment"`
+	Name     string      `xml:"name"`
+	Metadata metadataXML `xml:"metadata"`
+	Memory   memoryXML   `xml:"memory"`
+	VCPU     int         `xml:"vcpu"`
+	OS       osXML       `xml:"os"`
+	Features featuresXML `xml:"features"`
+	CPU      cpuXML      `xml:"cpu"`
+	Clock    clockXML    `xml:"clock"`
+	Devices  devicesXML  `xml:"devices"`
+}
+
+// metadataXML holds the libosinfo element with the prefix libvirt itself
+// writes, which encoding/xml only produces from literal names.
+type metadataXML struct {
+	Libosinfo libosinfoXML `xml:"libosinfo:libosinfo"`
+}
+
+type libosinfoXML struct {
+	NS string         `xml:"xmlns:libosinfo,attr"`
+	OS libosinfoOSXML `xml:"libosinfo:os"`
+}
+
+type libosinfoOSXML struct {
+	ID string `xml:"id,attr"`
+}
+
+type memoryXML struct {
+	Unit  string `xml:"unit,attr"`
+	Value int64  `xml:",chardata"`
+}
+
+type osXML struct {
+	Firmware         string       `xml:"firmware,attr,omitempty"`
+	Type             osTypeXML    `xml:"type"`
+	FirmwareFeatures *firmwareXML `xml:"firmware"`
+	Boot             []bootXML    `xml:"boot"`
+}
+
+type osTypeXML struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type firmwareXML struct {
+	Features []firmwareFeatureXML `xml:"feature"`
+}
+
+type firmwareFeatureXML struct {
+	Enabled string `xml:"enabled,attr"`
+	Name    string `xml:"name,attr"`
+}
+
+type bootXML struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type featuresXML struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+	GIC  *gicXML   `xml:"gic"`
+	SMM  *smmXML   `xml:"smm"`
+}
+
+type gicXML struct {
+	Version string `xml:"version,attr"`
+}
+
+type smmXML struct {
+	State string `xml:"state,attr"`
+}
+
+type cpuXML struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type clockXML struct {
+	Offset string `xml:"offset,attr"`
+}
+
+type devicesXML struct {
+	Disks       []diskXML       `xml:"disk"`
+	Controllers []controllerXML `xml:"controller"`
+	Interfaces  []interfaceXML  `xml:"interface"`
+	Serials     []charXML       `xml:"serial"`
+	Consoles    []charXML       `xml:"console"`
+	Inputs      []inputXML      `xml:"input"`
+	Graphics    *graphicsXML    `xml:"graphics"`
+	Video       *videoXML       `xml:"video"`
+	TPM         *tpmXML         `xml:"tpm"`
+	RNG         *rngXML         `xml:"rng"`
+}
+
+type diskXML struct {
+	Type     string    `xml:"type,attr"`
+	Device   string    `xml:"device,attr"`
+	Driver   driverXML `xml:"driver"`
+	Source   sourceXML `xml:"source"`
+	Target   targetXML `xml:"target"`
+	ReadOnly *struct{} `xml:"readonly"`
+}
+
+type driverXML struct {
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
+	Discard string `xml:"discard,attr,omitempty"`
+}
+
+type sourceXML struct {
+	File string `xml:"file,attr"`
+}
+
+type targetXML struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type controllerXML struct {
+	Type  string `xml:"type,attr"`
+	Model string `xml:"model,attr"`
+}
+
+type interfaceXML struct {
+	Type   string              `xml:"type,attr"`
+	Source *interfaceSourceXML `xml:"source"`
+	Model  modelXML            `xml:"model"`
+}
+
+type interfaceSourceXML struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+}
+
+type modelXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type charXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type inputXML struct {
+	Type string `xml:"type,attr"`
+	Bus  string `xml:"bus,attr"`
+}
+
+type graphicsXML struct {
+	Type     string `xml:"type,attr"`
+	Port     string `xml:"port,attr"`
+	AutoPort string `xml:"autoport,attr"`
+}
+
+type videoXML struct {
+	Model modelXML `xml:"model"`
+}
+
+type tpmXML struct {
+	Model   string        `xml:"model,attr"`
+	Backend tpmBackendXML `xml:"backend"`
+}
+
+type tpmBackendXML struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr"`
+}
+
+type rngXML struct {
+	Model   string        `xml:"model,attr"`
+	Backend rngBackendXML `xml:"backend"`
+}
+
+type rngBackendXML struct {
+	Model string `xml:"model,attr"`
+	Value string `xml:",chardata"`
+}
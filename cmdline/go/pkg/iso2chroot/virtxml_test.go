@@ -0,0 +1,248 @@
+package iso2chroot
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// parsedDomain is what the tests read back from a domain written by
+// VirtXML.
+type parsedDomain struct {
+	Name   string `xml:"name"`
+	Memory int64  `xml:"memory"`
+	VCPU   int    `xml:"vcpu"`
+	OS     struct {
+		Firmware string `xml:"firmware,attr"`
+		Type     struct {
+			Arch    string `xml:"arch,attr"`
+			Machine string `xml:"machine,attr"`
+		} `xml:"type"`
+		Features []struct {
+			Enabled string `xml:"enabled,attr"`
+		} `xml:"firmware>feature"`
+		Boot []struct {
+			Dev string `xml:"dev,attr"`
+		} `xml:"boot"`
+	} `xml:"os"`
+	Libosinfo struct {
+		ID string `xml:"id,attr"`
+	} `xml:"metadata>libosinfo>os"`
+	Disks []struct {
+		Device string `xml:"device,attr"`
+		Driver struct {
+			Type string `xml:"type,attr"`
+		} `xml:"driver"`
+		Source struct {
+			File string `xml:"file,attr"`
+		} `xml:"source"`
+		Target struct {
+			Bus string `xml:"bus,attr"`
+		} `xml:"target"`
+	} `xml:"devices>disk"`
+	Interfaces []struct {
+		Type   string `xml:"type,attr"`
+		Source struct {
+			Network string `xml:"network,attr"`
+			Bridge  string `xml:"bridge,attr"`
+		} `xml:"source"`
+		Model struct {
+			Type string `xml:"type,attr"`
+		} `xml:"model"`
+	} `xml:"devices>interface"`
+	TPM *struct{} `xml:"devices>tpm"`
+}
+
+// secureBoot returns the secure-boot firmware feature, or empty.
+func (d parsedDomain) secureBoot() string {
+	if len(d.OS.Features) == 0 {
+		return ""
+	}
+	return d.OS.Features[0].Enabled
+}
+
+func parseDomain(t *testing.T, data []byte) parsedDomain {
+	t.Helper()
+	var d parsedDomain
+	if err := xml.Unmarshal(data, &d); err != nil {
+		t.Fatalf("domain XML is not well-formed: %v\n%s", err, data)
+	}
+	return d
+}
+
+func TestDomainFor(t *testing.T) {
+	ubuntu := OSVariant{ShortID: "ubuntu24.04", ID: "http://ubuntu.com/ubuntu/24.04", Name: "Ubuntu 24.04", Family: FamilyLinux, Arch: ArchX86_64}
+	windows := OSVariant{ShortID: "win11", ID: "http://microsoft.com/win/11", Name: "Windows", Family: FamilyWindows, Arch: ArchX86_64}
+	hybrid := []BootImage{{Platform: BootBIOS}, {Platform: BootUEFI}}
+	defaults := VirtXMLOptions{Memory: 4 << 30, VCPUs: 2, DiskSize: 20 << 30, Network: "network=default"}
+
+	result, err := domainFor(ISODetails{ISO: ISOInfo{Name: "noble server.iso"}, OS: ubuntu, OSDetected: true, BootImages: hybrid}, "/isos/noble server.iso", defaults)
+	if err != nil {
+		t.Fatalf("domainFor() error = %v", err)
+	}
+	d := parseDomain(t, result.XML)
+	if d.Name != "noble-server" || d.Memory != 4<<20 || d.VCPU != 2 || d.OS.Firmware != "efi" || d.secureBoot() != "no" || d.OS.Type.Machine != "q35" || d.Libosinfo.ID != ubuntu.ID || d.TPM != nil {
+		t.Fatalf("domain = %+v", d)
+	}
+	var boot []string
+	for _, b := range d.OS.Boot {
+		boot = append(boot, b.Dev)
+	}
+	if !reflect.DeepEqual(boot, []string{"hd", "cdrom"}) {
+		t.Fatalf("boot order = %q, want hd, cdrom", boot)
+	}
+	wantDisk := filepath.Join(LibvirtImageDir, "noble-server.qcow2")
+	if len(d.Disks) != 2 || d.Disks[0].Source.File != wantDisk || d.Disks[0].Driver.Type != "qcow2" || d.Disks[0].Target.Bus != "virtio" ||
+		d.Disks[1].Device != "cdrom" || d.Disks[1].Source.File != "/isos/noble server.iso" || d.Disks[1].Target.Bus != "sata" {
+		t.Fatalf("disks = %+v", d.Disks)
+	}
+	if len(d.Interfaces) != 1 || d.Interfaces[0].Type != "network" || d.Interfaces[0].Source.Network != "default" || d.Interfaces[0].Model.Type != "virtio" {
+		t.Fatalf("interfaces = %+v", d.Interfaces)
+	}
+	if want := "qemu-img create -f qcow2 " + wantDisk + " 20G"; result.DiskCommand != want || !bytes.Contains(result.XML, []byte("<!-- Create the disk first: "+want+" -->")) {
+		t.Fatalf("DiskCommand = %q, want %q in a comment", result.DiskCommand, want)
+	}
+	if !bytes.Contains(result.XML, []byte(`<libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0">`)) {
+		t.Fatalf("domain has no libosinfo metadata:\n%s", result.XML)
+	}
+
+	live := defaults
+	live.DiskSize, live.Network, live.Disk = 0, "bridge=br0", "ignored.img"
+	result, err = domainFor(ISODetails{ISO: ISOInfo{Name: "live.iso"}, OS: genericLinux, BootImages: hybrid[:1]}, "/isos/live.iso", live)
+	if err != nil {
+		t.Fatalf("domainFor() of a BIOS live ISO error = %v", err)
+	}
+	d = parseDomain(t, result.XML)
+	if d.OS.Firmware != "" || len(d.Disks) != 1 || len(d.OS.Boot) != 1 || d.Interfaces[0].Source.Bridge != "br0" || result.Disk != "" || len(result.Warnings) != 1 {
+		t.Fatalf("BIOS live domain = %+v, warnings %q", d, result.Warnings)
+	}
+
+	raw := defaults
+	raw.Disk, raw.Network = "/srv/vm/win.img", "none"
+	result, err = domainFor(ISODetails{ISO: ISOInfo{Name: "win11.iso"}, OS: windows, OSDetected: true, BootImages: hybrid}, "/isos/win11.iso", raw)
+	if err != nil {
+		t.Fatalf("domainFor() of Windows error = %v", err)
+	}
+	d = parseDomain(t, result.XML)
+	if d.secureBoot() != "yes" || d.TPM == nil || d.Disks[0].Driver.Type != "raw" || d.Disks[0].Target.Bus != "sata" || len(d.Interfaces) != 0 || len(result.Warnings) != 1 {
+		t.Fatalf("Windows domain = %+v, warnings %q", d, result.Warnings)
+	}
+
+	arm := ubuntu
+	arm.Arch = ArchAArch64
+	result, err = domainFor(ISODetails{ISO: ISOInfo{Name: "arm.iso"}, OS: arm, OSDetected: true, BootImages: hybrid[1:]}, "/isos/arm.iso", defaults)
+	if err != nil {
+		t.Fatalf("domainFor() of aarch64 error = %v", err)
+	}
+	if d = parseDomain(t, result.XML); d.OS.Type.Arch != ArchAArch64 || d.OS.Type.Machine != "virt" || d.Disks[1].Target.Bus != "scsi" {
+		t.Fatalf("aarch64 domain = %+v", d)
+	}
+	if hostArch() == ArchX86_64 && len(result.Warnings) != 1 {
+		t.Fatalf("aarch64 domain on an x86_64 host warnings = %q", result.Warnings)
+	}
+
+	if _, err := domainFor(ISODetails{ISO: ISOInfo{Name: "data.iso"}, OS: genericLinux}, "/isos/data.iso", defaults); err == nil || !strings.Contains(err.Error(), "no El Torito boot image") {
+		t.Fatalf("domainFor() of an unbootable ISO error = %v", err)
+	}
+	forced := defaults
+	forced.Firmware = FirmwareUEFI
+	if result, err := domainFor(ISODetails{ISO: ISOInfo{Name: "data.iso"}, OS: genericLinux, OSDetected: true}, "/isos/data.iso", forced); err != nil || len(result.Warnings) != 1 {
+		t.Fatalf("domainFor() of an unbootable ISO with UEFI firmware = %q, %v", result.Warnings, err)
+	}
+}
+
+func TestSizeValue(t *testing.T) {
+	for value, want := range map[string]int64{
+		"4096": 4096 << 20,
+		"8G":   8 << 30,
+		"8gib": 8 << 30,
+		"1.5G": 3 << 29,
+		"512M": 512 << 20,
+		"100B": 100,
+		"0":    0,
+	} {
+		var n int64
+		if err := (sizeValue{&n, 1 << 20}).Set(value); err != nil || n != want {
+			t.Errorf("Set(%q) = %d, %v; want %d", value, n, err, want)
+		}
+	}
+	for _, value := range []string{"", "G", "8X", "-1G", "8iB", "1e30T"} {
+		var n int64
+		if err := (sizeValue{&n, 1 << 20}).Set(value); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", value, n)
+		}
+	}
+}
+
+func TestRunCLIVirtXML(t *testing.T) {
+	manager := newTestManager(t, map[string]isotest.ISO{
+		"noble.iso": {
+			RockRidge: true,
+			DiskInfo:  `Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827)`,
+			BIOSBoot:  "isolinux/isolinux.bin",
+			EFIBoot:   "boot/grub/efi.img",
+			Files: []isotest.File{
+				{Path: "isolinux/isolinux.bin", Data: bytes.Repeat([]byte{0x90}, 2048)},
+				{Path: "boot/grub/efi.img", Data: bytes.Repeat([]byte{0}, 4096)},
+			},
+		},
+		"data.iso": {Files: []isotest.File{isotest.Text("README", "data")}},
+	})
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := RunCLI(manager, args, &stdout, &stderr, CLIOptions{})
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, stdout, stderr := run("virt-xml", "--memory", "8G", "--vcpus", "4", "--disk-size", "40", "2")
+	if code != ExitOK || stderr != "" {
+		t.Fatalf("virt-xml: exit %d, stderr %q", code, stderr)
+	}
+	d := parseDomain(t, []byte(stdout))
+	if d.Name != "noble" || d.Memory != 8<<20 || d.VCPU != 4 || d.OS.Firmware != "efi" || d.Libosinfo.ID != "http://ubuntu.com/ubuntu/24.04" || d.Disks[1].Source.File != filepath.Join(manager.Directory(), "noble.iso") {
+		t.Fatalf("virt-xml domain = %+v", d)
+	}
+	if !strings.Contains(stdout, "qemu-img create -f qcow2 "+filepath.Join(LibvirtImageDir, "noble.qcow2")+" 40G") {
+		t.Fatalf("virt-xml domain lacks the disk command:\n%s", stdout)
+	}
+
+	out := filepath.Join(t.TempDir(), "noble.xml")
+	code, stdout, stderr = run("virt-xml", "--firmware", "bios", "--name", "noble-bios", "--out", out, "2")
+	if code != ExitOK || !strings.HasPrefix(stdout, "Wrote "+out+": domain noble-bios for Ubuntu 24.04 (ubuntu24.04), BIOS firmware, 4.0 GiB memory, 2 vCPUs\n") {
+		t.Fatalf("virt-xml --out: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := parseDomain(t, data); d.Name != "noble-bios" || d.OS.Firmware != "" {
+		t.Fatalf("virt-xml --out domain = %+v", d)
+	}
+	if code, _, _ := run("virt-xml", "--out", out, "2"); code != ExitFailure {
+		t.Fatalf("virt-xml over an existing file: exit %d, want %d", code, ExitFailure)
+	}
+
+	if code, _, stderr := run("virt-xml", "1"); code != ExitFailure || !strings.Contains(stderr, "no El Torito boot image") {
+		t.Fatalf("virt-xml data: exit %d, stderr %q", code, stderr)
+	}
+	for _, args := range [][]string{
+		{"virt-xml"},
+		{"virt-xml", "--network", "vde", "2"},
+		{"virt-xml", "--firmware", "coreboot", "2"},
+		{"virt-xml", "--memory", "lots", "2"},
+	} {
+		if code, _, _ := run(args...); code != ExitUsage {
+			t.Fatalf("%q: exit %d, want %d", args, code, ExitUsage)
+		}
+	}
+
+	if code, stdout, _ := run("info", "2"); code != ExitOK || !strings.Contains(stdout, "Distribution:     Ubuntu 24.04 (ubuntu24.04)\n") {
+		t.Fatalf("info noble: exit %d, stdout %q", code, stdout)
+	}
+}
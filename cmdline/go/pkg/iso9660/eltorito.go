@@ -0,0 +1,128 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Platform IDs of El Torito boot catalog sections.
+const (
+	PlatformBIOS = 0x00
+	PlatformPPC  = 0x01
+	PlatformMac  = 0x02
+	PlatformEFI  = 0xEF
+)
+
+// Emulation is the media type an El Torito boot image presents to the
+// firmware.
+type Emulation byte
+
+const (
+	NoEmulation Emulation = iota
+	Floppy12
+	Floppy144
+	Floppy288
+	HardDisk
+)
+
+func (e Emulation) String() string {
+	switch e {
+	case NoEmulation:
+		return "no emulation"
+	case Floppy12:
+		return "1.2M floppy"
+	case Floppy144:
+		return "1.44M floppy"
+	case Floppy288:
+		return "2.88M floppy"
+	case HardDisk:
+		return "hard disk"
+	}
+	return fmt.Sprintf("emulation %d", byte(e))
+}
+
+const (
+	// maxCatalogSectors bounds how much of a boot catalog is read.
+	maxCatalogSectors = 4
+
+	catalogEntrySize = 32
+	headerMore       = 0x90
+	headerFinal      = 0x91
+	entryExtension   = 0x44
+	entryBootable    = 0x88
+)
+
+var elToritoID = []byte("EL TORITO SPECIFICATION")
+
+// BootEntry is a boot image listed in the El Torito boot catalog.
+type BootEntry struct {
+	// Platform is the platform ID of the entry's section, such as
+	// PlatformBIOS or PlatformEFI.
+	Platform  byte
+	Bootable  bool
+	Emulation Emulation
+	// Sectors is the number of 512-byte sectors the firmware loads. EFI
+	// images larger than the field can express often record 0 or 1.
+	Sectors uint16
+	// LBA is the sector where the boot image starts.
+	LBA uint32
+}
+
+// BootCatalog returns the sector of the El Torito boot catalog, or 0 when
+// the image has none.
+func (f *FS) BootCatalog() uint32 { return f.catalog }
+
+// BootEntries returns the entries of the El Torito boot catalog, the
+// default entry first, or nil when the image has no catalog.
+func (f *FS) BootEntries() ([]BootEntry, error) {
+	if f.catalog == 0 {
+		return nil, nil
+	}
+	cat := make([]byte, maxCatalogSectors*SectorSize)
+	n, err := f.r.ReadAt(cat, int64(f.catalog)*SectorSize)
+	if n < catalogEntrySize*2 {
+		return nil, fmt.Errorf("read boot catalog at sector %d: %w", f.catalog, err)
+	}
+	cat = cat[:n-n%catalogEntrySize]
+
+	validation := cat[:catalogEntrySize]
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(validation[i:])
+	}
+	if validation[0] != 1 || validation[30] != 0x55 || validation[31] != 0xAA || sum != 0 {
+		return nil, fmt.Errorf("%w: bad boot catalog validation entry", ErrCorrupt)
+	}
+
+	entries := []BootEntry{bootEntry(cat[catalogEntrySize:], validation[1])}
+	for off := 2 * catalogEntrySize; off+catalogEntrySize <= len(cat); {
+		header := cat[off:]
+		if header[0] != headerMore && header[0] != headerFinal {
+			break
+		}
+		platform, count := header[1], int(binary.LittleEndian.Uint16(header[2:]))
+		off += catalogEntrySize
+		for count > 0 && off+catalogEntrySize <= len(cat) {
+			if cat[off] != entryExtension {
+				entries = append(entries, bootEntry(cat[off:], platform))
+				count--
+			}
+			off += catalogEntrySize
+		}
+		if header[0] == headerFinal {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// bootEntry decodes the initial or a section entry of a boot catalog.
+func bootEntry(e []byte, platform byte) BootEntry {
+	return BootEntry{
+		Platform:  platform,
+		Bootable:  e[0] == entryBootable,
+		Emulation: Emulation(e[1] & 0x0F),
+		Sectors:   binary.LittleEndian.Uint16(e[6:]),
+		LBA:       binary.LittleEndian.Uint32(e[8:]),
+	}
+}
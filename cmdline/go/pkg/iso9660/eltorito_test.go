@@ -0,0 +1,41 @@
+package iso9660
+
+import (
+	"io/fs"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+func TestBootEntries(t *testing.T) {
+	fsys := openISO(t, isotest.ISO{RockRidge: true, BIOSBoot: "casper/vmlinuz", EFIBoot: "dists/noble/Release"})
+	entries, err := fsys.BootEntries()
+	if err != nil {
+		t.Fatalf("BootEntries() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("BootEntries() = %+v, want a BIOS and an EFI entry", entries)
+	}
+	lba := func(name string) uint32 {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		return info.Sys().(*Stat).LBA
+	}
+	bios, efi := entries[0], entries[1]
+	if bios.Platform != PlatformBIOS || !bios.Bootable || bios.Emulation != NoEmulation || bios.LBA != lba("casper/vmlinuz") {
+		t.Fatalf("BIOS entry = %+v", bios)
+	}
+	if efi.Platform != PlatformEFI || !efi.Bootable || efi.Sectors != 1 || efi.LBA != lba("dists/noble/Release") {
+		t.Fatalf("EFI entry = %+v", efi)
+	}
+
+	plain := openISO(t, isotest.ISO{RockRidge: true})
+	if entries, err := plain.BootEntries(); entries != nil || err != nil {
+		t.Fatalf("BootEntries() without a catalog = %+v, %v", entries, err)
+	}
+	if got := Floppy144.String(); got != "1.44M floppy" {
+		t.Fatalf("Floppy144.String() = %q", got)
+	}
+}
@@ -0,0 +1,217 @@
+// Package iso9660 reads ISO9660 images through an io.ReaderAt, without
+// mounting them, and writes new ones from a file tree.
+//
+// An FS implements fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS over one
+// directory tree of the image, picked the way Linux picks it: the primary tree
+// with Rock Ridge extensions when present, otherwise the Joliet tree, otherwise
+// the plain primary tree with version suffixes stripped and names lowercased.
+// Rock Ridge supplies POSIX modes, owners, timestamps, symlinks, device nodes
+// and relocated deep directories; FileInfo.Sys returns a *Stat with the
+// details fs.FileInfo cannot express. BootEntries decodes the El Torito boot
+// catalog of bootable images.
+//
+// NewImage lays out an image of any fs.FS with Rock Ridge and Joliet trees
+// and an El Torito boot catalog, and Image.WriteTo streams it.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf16"
+)
+
+const (
+	// SectorSize is the logical block size of every image this package reads.
+	SectorSize = 2048
+
+	firstDescriptor = 16
+	maxDescriptors  = 64
+
+	descBoot          = 0
+	descPrimary       = 1
+	descSupplementary = 2
+	descTerminator    = 255
+)
+
+var (
+	// ErrNotISO9660 is returned by Open when the image has no primary volume
+	// descriptor.
+	ErrNotISO9660 = errors.New("iso9660: no primary volume descriptor")
+	// ErrCorrupt reports a structure of the image that cannot be decoded.
+	ErrCorrupt = errors.New("iso9660: corrupt image")
+)
+
+var standardID = []byte("CD001")
+
+// FS is an open ISO9660 image.
+type FS struct {
+	r         io.ReaderAt
+	volumeID  string
+	publisher string
+	rockRidge bool
+	joliet    bool
+	// suspSkip is the number of bytes to skip at the start of every System
+	// Use area, from the root's SP entry.
+	suspSkip int
+	root     *entry
+	// sectors is the volume space size of the primary volume descriptor.
+	sectors uint32
+	// catalog is the sector of the El Torito boot catalog, or 0.
+	catalog uint32
+
+	mu       sync.Mutex
+	listings map[uint32][]*entry
+}
+
+// Open reads the volume descriptors of the image in r and returns its file
+// system. It returns ErrNotISO9660 when r does not hold an ISO9660 image.
+func Open(r io.ReaderAt) (*FS, error) {
+	var primary, joliet []byte
+	var catalog uint32
+	for i := 0; i < maxDescriptors; i++ {
+		desc := make([]byte, SectorSize)
+		if _, err := r.ReadAt(desc, int64(firstDescriptor+i)*SectorSize); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, fmt.Errorf("read volume descriptor: %w", err)
+		}
+		if !bytes.Equal(desc[1:6], standardID) {
+			break
+		}
+		switch desc[0] {
+		case descBoot:
+			if bytes.HasPrefix(desc[7:39], elToritoID) {
+				catalog = binary.LittleEndian.Uint32(desc[71:])
+			}
+		case descPrimary:
+			if primary == nil {
+				primary = desc
+			}
+		case descSupplementary:
+			if joliet == nil && isJoliet(desc) {
+				joliet = desc
+			}
+		}
+		if desc[0] == descTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, ErrNotISO9660
+	}
+	if size := binary.LittleEndian.Uint16(primary[128:]); size != SectorSize {
+		return nil, fmt.Errorf("%w: logical block size %d", ErrCorrupt, size)
+	}
+
+	f := &FS{
+		r:         r,
+		volumeID:  dString(primary[40:72]),
+		publisher: dString(primary[318:446]),
+		sectors:   binary.LittleEndian.Uint32(primary[80:]),
+		catalog:   catalog,
+		listings:  make(map[uint32][]*entry),
+	}
+	root, err := f.rootEntry(primary)
+	if err != nil {
+		return nil, err
+	}
+	if skip, ok, err := f.detectSUSP(root); err != nil {
+		return nil, err
+	} else if ok {
+		f.rockRidge, f.suspSkip = true, skip
+	}
+	if !f.rockRidge && joliet != nil {
+		f.joliet = true
+		if root, err = f.rootEntry(joliet); err != nil {
+			return nil, err
+		}
+	}
+	f.root = root
+	if f.rockRidge {
+		// The root's own Rock Ridge attributes live in its "." record.
+		self, err := f.readSelf(root)
+		if err != nil {
+			return nil, err
+		}
+		f.root = self
+	}
+	return f, nil
+}
+
+// VolumeID returns the volume label from the primary volume descriptor.
+func (f *FS) VolumeID() string { return f.volumeID }
+
+// Publisher returns the publisher from the primary volume descriptor.
+func (f *FS) Publisher() string { return f.publisher }
+
+// Size returns the size of the volume in bytes, as its primary volume
+// descriptor records it. Data appended after the volume, such as the EFI
+// system partition of some hybrid images, is not part of it.
+func (f *FS) Size() int64 { return int64(f.sectors) * SectorSize }
+
+// RockRidge reports whether names and attributes come from Rock Ridge.
+func (f *FS) RockRidge() bool { return f.rockRidge }
+
+// Joliet reports whether names come from the Joliet tree.
+func (f *FS) Joliet() bool { return f.joliet }
+
+// isJoliet reports whether a supplementary volume descriptor declares one of
+// the UCS-2 escape sequences of Joliet.
+func isJoliet(desc []byte) bool {
+	esc := desc[88:120]
+	return bytes.Contains(esc, []byte("%/@")) || bytes.Contains(esc, []byte("%/C")) || bytes.Contains(esc, []byte("%/E"))
+}
+
+// rootEntry decodes the root directory record of a volume descriptor.
+func (f *FS) rootEntry(desc []byte) (*entry, error) {
+	rec := desc[156:190]
+	if rec[0] != 34 {
+		return nil, fmt.Errorf("%w: root directory record of %d bytes", ErrCorrupt, rec[0])
+	}
+	e := &entry{
+		name:    ".",
+		dir:     true,
+		extents: []extent{{lba: binary.LittleEndian.Uint32(rec[2:]), size: binary.LittleEndian.Uint32(rec[10:])}},
+		mtime:   recordTime(rec[18:25]),
+	}
+	e.size = int64(e.extents[0].size)
+	e.setDefaults()
+	return e, nil
+}
+
+// detectSUSP looks for the SP entry that marks System Use Sharing Protocol
+// extensions, such as Rock Ridge, at the start of the root's "." record.
+func (f *FS) detectSUSP(root *entry) (skip int, ok bool, err error) {
+	sector := make([]byte, SectorSize)
+	if _, err := f.r.ReadAt(sector, int64(root.extents[0].lba)*SectorSize); err != nil {
+		return 0, false, fmt.Errorf("read root directory: %w", err)
+	}
+	n := int(sector[0])
+	if n < 34 || n > len(sector) {
+		return 0, false, fmt.Errorf("%w: root directory has no \".\" record", ErrCorrupt)
+	}
+	su := systemUse(sector[:n])
+	if len(su) >= 7 && su[0] == 'S' && su[1] == 'P' && su[4] == 0xBE && su[5] == 0xEF {
+		return int(su[6]), true, nil
+	}
+	return 0, false, nil
+}
+
+// dString trims the padding of a d-characters or a-characters field.
+func dString(b []byte) string {
+	return string(bytes.TrimRight(b, " \x00"))
+}
+
+// ucs2 decodes a big-endian UCS-2 Joliet name.
+func ucs2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
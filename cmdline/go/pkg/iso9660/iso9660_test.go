@@ -0,0 +1,226 @@
+package iso9660
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ulikunitz/xz"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+var modTime = time.Date(2024, 4, 25, 14, 3, 7, 0, time.UTC)
+
+func files() []isotest.File {
+	return []isotest.File{
+		isotest.Text("README.diskdefines", "#define DISKNAME Ubuntu 24.04\n"),
+		{Path: "casper/vmlinuz", Data: bytes.Repeat([]byte("kernel"), 2000), Mode: 0o644, ModTime: modTime},
+		isotest.HardLink("casper/vmlinuz.efi", "casper/vmlinuz"),
+		isotest.Text("boot/grub/grub.cfg", "menuentry \"Try Ubuntu\" {}\n"),
+		isotest.Symlink("ubuntu", "."),
+		isotest.Symlink("boot/grub/x86_64-efi/grub.cfg", "../grub.cfg"),
+		{Path: "dists/noble/Release", Data: []byte("Suite: noble\n"), Mode: 0o600, UID: 1000, GID: 100},
+		{Path: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5, Minor: 1},
+		isotest.Text("pool/main/l/linux-signed/Linux Signed Image Long Name.deb", "deb"),
+	}
+}
+
+func openISO(t *testing.T, iso isotest.ISO) *FS {
+	t.Helper()
+	iso.Files = files()
+	data, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("generate ISO: %v", err)
+	}
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	return fsys
+}
+
+func TestOpenRockRidge(t *testing.T) {
+	fsys := openISO(t, isotest.ISO{VolumeID: "Ubuntu 24.04 LTS amd64", Publisher: "Canonical", RockRidge: true, Joliet: true})
+	if !fsys.RockRidge() || fsys.Joliet() {
+		t.Fatalf("RockRidge() = %t, Joliet() = %t; want Rock Ridge preferred", fsys.RockRidge(), fsys.Joliet())
+	}
+	if fsys.VolumeID() != "Ubuntu 24.04 LTS amd64" || fsys.Publisher() != "Canonical" {
+		t.Fatalf("VolumeID() = %q, Publisher() = %q", fsys.VolumeID(), fsys.Publisher())
+	}
+
+	data, err := fs.ReadFile(fsys, "casper/vmlinuz")
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte("kernel"), 2000)) {
+		t.Fatalf("ReadFile(casper/vmlinuz) = %d bytes, %v", len(data), err)
+	}
+	if data, err := fs.ReadFile(fsys, "pool/main/l/linux-signed/Linux Signed Image Long Name.deb"); err != nil || string(data) != "deb" {
+		t.Fatalf("ReadFile of a long mixed-case name = %q, %v", data, err)
+	}
+
+	info, err := fsys.Lstat("casper/vmlinuz")
+	if err != nil {
+		t.Fatalf("Lstat() error = %v", err)
+	}
+	if info.Mode() != 0o644 || !info.ModTime().Equal(modTime) {
+		t.Fatalf("casper/vmlinuz mode %v mtime %v", info.Mode(), info.ModTime())
+	}
+	kernel := info.Sys().(*Stat)
+	efi, _ := fsys.Lstat("casper/vmlinuz.efi")
+	if link := efi.Sys().(*Stat); link.Inode != kernel.Inode || kernel.Nlink != 2 {
+		t.Fatalf("hard link inode %d, target inode %d nlink %d", link.Inode, kernel.Inode, kernel.Nlink)
+	}
+
+	release, _ := fsys.Lstat("dists/noble/Release")
+	if st := release.Sys().(*Stat); release.Mode() != 0o600 || st.UID != 1000 || st.GID != 100 {
+		t.Fatalf("Release mode %v owner %d:%d", release.Mode(), st.UID, st.GID)
+	}
+	console, _ := fsys.Lstat("dev/console")
+	if st := console.Sys().(*Stat); console.Mode() != fs.ModeDevice|fs.ModeCharDevice|0o600 || st.Major != 5 || st.Minor != 1 {
+		t.Fatalf("dev/console mode %v device %d:%d", console.Mode(), st.Major, st.Minor)
+	}
+
+	if target, err := fsys.ReadLink("boot/grub/x86_64-efi/grub.cfg"); err != nil || target != "../grub.cfg" {
+		t.Fatalf("ReadLink() = %q, %v", target, err)
+	}
+	if data, err := fs.ReadFile(fsys, "ubuntu/ubuntu/boot/grub/x86_64-efi/grub.cfg"); err != nil || string(data) != "menuentry \"Try Ubuntu\" {}\n" {
+		t.Fatalf("ReadFile through symlinks = %q, %v", data, err)
+	}
+
+	if err := fstest.TestFS(fsys, "README.diskdefines", "casper/vmlinuz", "dists/noble/Release", "dev/console"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenJoliet(t *testing.T) {
+	fsys := openISO(t, isotest.ISO{Joliet: true})
+	if fsys.RockRidge() || !fsys.Joliet() {
+		t.Fatalf("RockRidge() = %t, Joliet() = %t; want Joliet", fsys.RockRidge(), fsys.Joliet())
+	}
+	if data, err := fs.ReadFile(fsys, "pool/main/l/linux-signed/Linux Signed Image Long Name.deb"); err != nil || string(data) != "deb" {
+		t.Fatalf("ReadFile of a Joliet name = %q, %v", data, err)
+	}
+	info, err := fsys.Stat("dists/noble/Release")
+	if err != nil || info.Mode() != 0o444 {
+		t.Fatalf("Stat() = %v, %v; want read-only default mode", info, err)
+	}
+	if err := fstest.TestFS(fsys, "README.diskdefines", "casper/vmlinuz", "dists/noble/Release"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenPlain(t *testing.T) {
+	fsys := openISO(t, isotest.ISO{})
+	if fsys.RockRidge() || fsys.Joliet() {
+		t.Fatalf("RockRidge() = %t, Joliet() = %t; want the plain tree", fsys.RockRidge(), fsys.Joliet())
+	}
+	// Plain names are lowercased and lose their version suffix.
+	if data, err := fs.ReadFile(fsys, "boot/grub/grub.cfg"); err != nil || string(data) != "menuentry \"Try Ubuntu\" {}\n" {
+		t.Fatalf("ReadFile(boot/grub/grub.cfg) = %q, %v", data, err)
+	}
+	if err := fstest.TestFS(fsys, "boot/grub/grub.cfg", "casper/vmlinuz"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileReadAt(t *testing.T) {
+	fsys := openISO(t, isotest.ISO{RockRidge: true})
+	f, err := fsys.Open("casper/vmlinuz")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	want := bytes.Repeat([]byte("kernel"), 2000)
+	file := f.(*File)
+	buf := make([]byte, 100)
+	if n, err := file.ReadAt(buf, 2000); n != 100 || err != nil || !bytes.Equal(buf, want[2000:2100]) {
+		t.Fatalf("ReadAt across a sector boundary = %d, %v", n, err)
+	}
+	if n, err := file.ReadAt(buf, int64(len(want))-10); n != 10 || err != io.EOF {
+		t.Fatalf("ReadAt at the end = %d, %v; want 10, EOF", n, err)
+	}
+	if _, err := file.Seek(-6, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if rest, err := io.ReadAll(file); err != nil || string(rest) != "kernel" {
+		t.Fatalf("ReadAll after Seek = %q, %v", rest, err)
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	if _, err := Open(bytes.NewReader(make([]byte, 40*SectorSize))); !errors.Is(err, ErrNotISO9660) {
+		t.Fatalf("Open(zeros) error = %v, want ErrNotISO9660", err)
+	}
+	if _, err := Open(bytes.NewReader(nil)); !errors.Is(err, ErrNotISO9660) {
+		t.Fatalf("Open(empty) error = %v, want ErrNotISO9660", err)
+	}
+}
+
+func TestSystemUseDecoding(t *testing.T) {
+	var l linkBuilder
+	// "/usr/" continued into "lib/ld.so" across two SL entries.
+	l.add([]byte{0x08, 0, 0, 3, 'u', 's', 'r', 0x01, 2, 'l', 'i'})
+	l.add([]byte{0, 1, 'b', 0x04, 0, 0, 5, 'l', 'd', '.', 's', 'o'})
+	if got := l.String(); got != "/usr/lib/../ld.so" {
+		t.Fatalf("linkBuilder = %q", got)
+	}
+
+	long := append([]byte{0x80 | 0x02 | 0x01}, "2001010100000000\x00"...)
+	long = append(long, "2024042514030700\x04"...)
+	if got, ok := tfModTime(long); !ok || !got.Equal(modTime.Add(-time.Hour)) {
+		t.Fatalf("tfModTime(long form) = %v, %t", got, ok)
+	}
+
+	for raw, want := range map[string]string{"VMLINUZ.;1": "vmlinuz", "GRUB.CFG;1": "grub.cfg", "DIR": "dir"} {
+		if got := plainName(raw); got != want {
+			t.Fatalf("plainName(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+// TestOpenXorrisoImage reads testdata/rockridge.iso.xz, made by xorriso rather
+// than isotest; see testdata/README.md.
+func TestOpenXorrisoImage(t *testing.T) {
+	file, err := os.Open("testdata/rockridge.iso.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	xr, err := xz.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(xr)
+	if err != nil {
+		t.Fatalf("decompress fixture: %v", err)
+	}
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !fsys.RockRidge() {
+		t.Fatal("RockRidge() = false, want true")
+	}
+
+	for name, want := range map[string]string{
+		"README.md":                       "README\n",
+		"foo/filename_75":                 "filename_75\n",
+		"deep/a/b/c/d/e/f/g/h/i/j/k/file": "file\n",
+	} {
+		if got, err := fs.ReadFile(fsys, name); err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if entries, err := fs.ReadDir(fsys, "foo"); err != nil || len(entries) != 76 {
+		t.Errorf("ReadDir(foo) = %d entries, %v; want 76", len(entries), err)
+	}
+	if info, err := fs.Stat(fsys, "bar/largefile"); err != nil || info.Size() != 5<<20 {
+		t.Errorf("Stat(bar/largefile) = %v, %v; want 5 MiB", info, err)
+	}
+	if target, err := fsys.ReadLink("link"); err != nil || target != "/a/b/c/d/ef/g/h" {
+		t.Errorf("ReadLink(link) = %q, %v", target, err)
+	}
+}
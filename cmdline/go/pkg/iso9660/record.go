@@ -0,0 +1,483 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	flagDirectory   = 0x02
+	flagMultiExtent = 0x80
+
+	// maxCachedListings bounds the directory listing cache.
+	maxCachedListings = 256
+	// maxContinuations bounds the CE chain of one System Use area.
+	maxContinuations = 32
+)
+
+// POSIX file type bits of Rock Ridge PX entries.
+const (
+	sIFMT   = 0o170000
+	sIFSOCK = 0o140000
+	sIFLNK  = 0o120000
+	sIFREG  = 0o100000
+	sIFBLK  = 0o060000
+	sIFDIR  = 0o040000
+	sIFCHR  = 0o020000
+	sIFIFO  = 0o010000
+)
+
+// extent is one contiguous run of a file's data.
+type extent struct {
+	lba  uint32
+	size uint32
+}
+
+// entry is a decoded directory record, with any Rock Ridge attributes applied.
+type entry struct {
+	name    string
+	dir     bool
+	extents []extent
+	size    int64
+	mode    fs.FileMode
+	nlink   uint32
+	uid     uint32
+	gid     uint32
+	ino     uint64
+	mtime   time.Time
+	target  string
+	major   uint32
+	minor   uint32
+	// pos is the byte position of the record, identifying files without data.
+	pos int64
+	// relocated marks a Rock Ridge RE entry, which only exists to hold a
+	// directory that a CL entry elsewhere links into place.
+	relocated bool
+	// child is the location of the directory a Rock Ridge CL entry links in.
+	child uint32
+	// hasPX records whether the mode came from Rock Ridge.
+	hasPX bool
+}
+
+func (e *entry) isSymlink() bool { return e.mode.Type() == fs.ModeSymlink }
+
+// setDefaults fills in the attributes of an entry without Rock Ridge.
+func (e *entry) setDefaults() {
+	if e.hasPX {
+		return
+	}
+	e.nlink = 1
+	e.mode = 0o444
+	if e.dir {
+		e.mode, e.nlink = fs.ModeDir|0o555, 2
+	}
+}
+
+// inode returns the entry's inode number: the Rock Ridge serial number when
+// the image records one, otherwise the position of its data or, for entries
+// without data, of its record. Hard links share their data and so their inode.
+func (e *entry) inode() uint64 {
+	if e.ino != 0 {
+		return e.ino
+	}
+	if len(e.extents) > 0 && e.extents[0].lba != 0 && (e.dir || e.size > 0) {
+		return uint64(e.extents[0].lba) * SectorSize
+	}
+	return uint64(e.pos)
+}
+
+// readDir returns the entries of directory d sorted by name, without "." and
+// ".." and without relocated directories.
+func (f *FS) readDir(d *entry) ([]*entry, error) {
+	key := d.extents[0].lba
+	f.mu.Lock()
+	cached, ok := f.listings[key]
+	f.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	data := make([]byte, d.size)
+	if _, err := f.r.ReadAt(data, int64(key)*SectorSize); err != nil {
+		return nil, fmt.Errorf("read directory at sector %d: %w", key, err)
+	}
+	var (
+		entries []*entry
+		partial *entry
+	)
+	for pos := 0; pos < len(data); {
+		n := int(data[pos])
+		if n == 0 {
+			// Records never cross sectors; the rest of this one is padding.
+			pos += SectorSize - pos%SectorSize
+			continue
+		}
+		if n < 34 || pos+n > len(data) {
+			return nil, fmt.Errorf("%w: directory record of %d bytes at sector %d", ErrCorrupt, n, key)
+		}
+		rec := data[pos : pos+n]
+		recPos := int64(key)*SectorSize + int64(pos)
+		pos += n
+
+		rawName := rec[33 : 33+int(rec[32])]
+		if len(rawName) == 1 && rawName[0] <= 1 {
+			continue // "." and ".."
+		}
+		ext := extent{lba: binary.LittleEndian.Uint32(rec[2:]), size: binary.LittleEndian.Uint32(rec[10:])}
+		if partial != nil {
+			// The remaining extents of a multi-extent file follow its first record.
+			partial.extents = append(partial.extents, ext)
+			partial.size += int64(ext.size)
+			if rec[25]&flagMultiExtent == 0 {
+				partial = nil
+			}
+			continue
+		}
+
+		e := &entry{
+			dir:     rec[25]&flagDirectory != 0,
+			extents: []extent{ext},
+			size:    int64(ext.size),
+			mtime:   recordTime(rec[18:25]),
+			pos:     recPos,
+		}
+		switch {
+		case f.joliet:
+			e.name = stripVersion(ucs2(rawName))
+		default:
+			e.name = plainName(string(rawName))
+		}
+		if f.rockRidge {
+			if err := f.applySystemUse(e, f.systemUse(rec)); err != nil {
+				return nil, err
+			}
+		}
+		e.setDefaults()
+		if rec[25]&flagMultiExtent != 0 {
+			partial = e
+		}
+		if e.relocated || e.name == "" || e.name == "." || e.name == ".." {
+			continue
+		}
+		if e.child != 0 {
+			moved, err := f.readSelf(&entry{extents: []extent{{lba: e.child, size: SectorSize}}, size: SectorSize})
+			if err != nil {
+				return nil, err
+			}
+			moved.name, moved.pos = e.name, e.pos
+			e = moved
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	f.mu.Lock()
+	if len(f.listings) >= maxCachedListings {
+		clear(f.listings)
+	}
+	f.listings[key] = entries
+	f.mu.Unlock()
+	return entries, nil
+}
+
+// readSelf decodes the "." record of directory d, which carries the
+// directory's own extent and, with Rock Ridge, its attributes.
+func (f *FS) readSelf(d *entry) (*entry, error) {
+	lba := d.extents[0].lba
+	sector := make([]byte, SectorSize)
+	if _, err := f.r.ReadAt(sector, int64(lba)*SectorSize); err != nil {
+		return nil, fmt.Errorf("read directory at sector %d: %w", lba, err)
+	}
+	n := int(sector[0])
+	if n < 34 || sector[32] != 1 || sector[33] != 0 {
+		return nil, fmt.Errorf("%w: directory at sector %d has no \".\" record", ErrCorrupt, lba)
+	}
+	rec := sector[:n]
+	e := &entry{
+		name:    ".",
+		dir:     true,
+		extents: []extent{{lba: binary.LittleEndian.Uint32(rec[2:]), size: binary.LittleEndian.Uint32(rec[10:])}},
+		mtime:   recordTime(rec[18:25]),
+		pos:     int64(lba) * SectorSize,
+	}
+	e.size = int64(e.extents[0].size)
+	if f.rockRidge {
+		if err := f.applySystemUse(e, f.systemUse(rec)); err != nil {
+			return nil, err
+		}
+	}
+	e.dir = true
+	e.setDefaults()
+	return e, nil
+}
+
+// systemUse returns the System Use area of a directory record, past the
+// bytes the SP entry says to skip.
+func (f *FS) systemUse(rec []byte) []byte {
+	su := systemUse(rec)
+	if f.suspSkip > len(su) {
+		return nil
+	}
+	return su[f.suspSkip:]
+}
+
+func systemUse(rec []byte) []byte {
+	start := 33 + int(rec[32])
+	if rec[32]%2 == 0 {
+		start++ // padding after an even-length name
+	}
+	if start >= len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// applySystemUse applies the Rock Ridge entries of a System Use area to e,
+// following CE continuation areas.
+func (f *FS) applySystemUse(e *entry, su []byte) error {
+	var (
+		name    strings.Builder
+		hasName bool
+		link    linkBuilder
+	)
+	for hops := 0; ; hops++ {
+		var ce []byte
+		for len(su) >= 4 {
+			n := int(su[2])
+			if n < 4 || n > len(su) {
+				break
+			}
+			body := su[4:n]
+			switch string(su[:2]) {
+			case "PX":
+				if len(body) >= 32 {
+					e.hasPX = true
+					e.mode = posixMode(binary.LittleEndian.Uint32(body))
+					e.nlink = binary.LittleEndian.Uint32(body[8:])
+					e.uid = binary.LittleEndian.Uint32(body[16:])
+					e.gid = binary.LittleEndian.Uint32(body[24:])
+					if len(body) >= 40 {
+						e.ino = uint64(binary.LittleEndian.Uint32(body[32:]))
+					}
+				}
+			case "PN":
+				if len(body) >= 16 {
+					high, low := binary.LittleEndian.Uint32(body), binary.LittleEndian.Uint32(body[8:])
+					if high == 0 && low&^0xFF != 0 {
+						// Old-style 16-bit device numbers in the low word.
+						high, low = low>>8, low&0xFF
+					}
+					e.major, e.minor = high, low
+				}
+			case "NM":
+				if len(body) >= 1 {
+					switch {
+					case body[0]&0x02 != 0:
+						name.WriteString(".")
+					case body[0]&0x04 != 0:
+						name.WriteString("..")
+					default:
+						name.Write(body[1:])
+					}
+					// Continued names simply concatenate.
+					hasName = true
+				}
+			case "SL":
+				if len(body) >= 1 {
+					link.add(body[1:])
+				}
+			case "TF":
+				if t, ok := tfModTime(body); ok {
+					e.mtime = t
+				}
+			case "CE":
+				if len(body) >= 24 {
+					ce = body
+				}
+			case "CL":
+				if len(body) >= 8 {
+					e.child = binary.LittleEndian.Uint32(body)
+				}
+			case "RE":
+				e.relocated = true
+			case "ST":
+				su = nil
+				continue
+			}
+			su = su[n:]
+		}
+		if ce == nil {
+			break
+		}
+		if hops >= maxContinuations {
+			return fmt.Errorf("%w: System Use continuation chain too long", ErrCorrupt)
+		}
+		block, offset, length := binary.LittleEndian.Uint32(ce), binary.LittleEndian.Uint32(ce[8:]), binary.LittleEndian.Uint32(ce[16:])
+		if length > SectorSize {
+			return fmt.Errorf("%w: System Use continuation of %d bytes", ErrCorrupt, length)
+		}
+		su = make([]byte, length)
+		if _, err := f.r.ReadAt(su, int64(block)*SectorSize+int64(offset)); err != nil {
+			return fmt.Errorf("read System Use continuation: %w", err)
+		}
+	}
+	if hasName {
+		e.name = name.String()
+	}
+	if e.isSymlink() {
+		e.target = link.String()
+	}
+	if e.mode.IsDir() {
+		e.dir = true
+	}
+	return nil
+}
+
+// linkBuilder assembles a symlink target from the components of SL entries.
+type linkBuilder struct {
+	absolute bool
+	parts    []string
+	cur      strings.Builder
+	open     bool
+}
+
+func (l *linkBuilder) add(comps []byte) {
+	for len(comps) >= 2 {
+		flags, n := comps[0], int(comps[1])
+		if 2+n > len(comps) {
+			return
+		}
+		content := comps[2 : 2+n]
+		comps = comps[2+n:]
+		switch {
+		case flags&0x08 != 0:
+			l.absolute, l.parts = true, nil
+			continue
+		case flags&0x02 != 0:
+			l.cur.WriteString(".")
+		case flags&0x04 != 0:
+			l.cur.WriteString("..")
+		default:
+			l.cur.Write(content)
+		}
+		l.open = flags&0x01 != 0
+		if !l.open {
+			l.parts = append(l.parts, l.cur.String())
+			l.cur.Reset()
+		}
+	}
+}
+
+func (l *linkBuilder) String() string {
+	parts := l.parts
+	if l.open {
+		parts = append(parts, l.cur.String())
+	}
+	target := strings.Join(parts, "/")
+	if l.absolute {
+		return "/" + target
+	}
+	return target
+}
+
+// posixMode converts a POSIX st_mode to an fs.FileMode.
+func posixMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0o777)
+	switch m & sIFMT {
+	case sIFDIR:
+		mode |= fs.ModeDir
+	case sIFLNK:
+		mode |= fs.ModeSymlink
+	case sIFBLK:
+		mode |= fs.ModeDevice
+	case sIFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case sIFIFO:
+		mode |= fs.ModeNamedPipe
+	case sIFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if m&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// plainName converts an ISO9660 file identifier the way Linux does by
+// default: the version suffix and a trailing dot are dropped and the name is
+// lowercased.
+func plainName(name string) string {
+	name = strings.TrimSuffix(stripVersion(name), ".")
+	return strings.ToLower(name)
+}
+
+// stripVersion drops a ";1" style version suffix.
+func stripVersion(name string) string {
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// recordTime decodes the 7-byte recording time of a directory record.
+func recordTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 && b[2] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone).UTC()
+}
+
+// longTime decodes a 17-byte volume descriptor style timestamp.
+func longTime(b []byte) time.Time {
+	digits := string(b[:16])
+	if strings.Trim(digits, "0 \x00") == "" {
+		return time.Time{}
+	}
+	num := func(s string) int {
+		v, _ := strconv.Atoi(s)
+		return v
+	}
+	zone := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(num(digits[0:4]), time.Month(num(digits[4:6])), num(digits[6:8]),
+		num(digits[8:10]), num(digits[10:12]), num(digits[12:14]), num(digits[14:16])*10_000_000, zone).UTC()
+}
+
+// tfModTime returns the modification time of a TF entry.
+func tfModTime(body []byte) (time.Time, bool) {
+	if len(body) < 1 {
+		return time.Time{}, false
+	}
+	flags := body[0]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17
+	}
+	stamps := body[1:]
+	if flags&0x02 == 0 {
+		return time.Time{}, false
+	}
+	skip := 0
+	if flags&0x01 != 0 {
+		skip = size // creation time comes first
+	}
+	if len(stamps) < skip+size {
+		return time.Time{}, false
+	}
+	b := stamps[skip : skip+size]
+	if size == 17 {
+		return longTime(b), true
+	}
+	return recordTime(b), true
+}
@@ -0,0 +1,1186 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// systemAreaSize is the size of the 16 sectors before the volume
+	// descriptors, which ISO9660 leaves to the system.
+	systemAreaSize = firstDescriptor * SectorSize
+	// maxRecordSize is the largest directory record, kept even.
+	maxRecordSize = 254
+	// maxExtentSize is the largest extent of a multi-extent file: the most
+	// whole sectors a 32-bit size can hold.
+	maxExtentSize = 0xFFFFF800
+	// ceEntrySize is the size of a SUSP CE entry.
+	ceEntrySize = 28
+	// maxPathTableDirs is the most directories a path table can number.
+	maxPathTableDirs = 0xFFFF
+	// maxCatalogEntries is the most entries a one-sector boot catalog holds.
+	maxCatalogEntries = SectorSize / catalogEntrySize
+
+	// bootInfoOffset is where mkisofs -boot-info-table patches a boot image,
+	// and grub2BootInfoOffset where xorriso --grub2-boot-info does.
+	bootInfoOffset      = 8
+	bootInfoSize        = 56
+	grub2BootInfoOffset = 2548
+
+	applicationID = "ISO2CHROOT"
+)
+
+// Rock Ridge extension reference of the root directory, in the words
+// mkisofs and xorriso use.
+const (
+	rripID     = "RRIP_1991A"
+	rripDesc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rripSource = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// WriteOptions configures NewImage.
+type WriteOptions struct {
+	// VolumeID is the volume label, at most 32 bytes.
+	VolumeID string
+	// Publisher is the publisher of the primary volume descriptor, at most
+	// 128 bytes.
+	Publisher string
+	// RockRidge records POSIX names, modes, owners, timestamps, symlinks
+	// and device nodes in the primary tree. Without it, symlinks and special
+	// files are left out.
+	RockRidge bool
+	// Joliet adds a second tree with the Unicode names Windows reads.
+	Joliet bool
+	// ModTime stamps the volume descriptors. Zero uses the current time.
+	ModTime time.Time
+	// Boot lists the images of the El Torito boot catalog, the default one
+	// first.
+	Boot []BootImage
+	// CatalogPath, when set, names a file of the tree that is replaced by
+	// the boot catalog, as with the -c option of mkisofs and xorriso.
+	CatalogPath string
+	// Appended holds data written after the volume, such as an EFI system
+	// partition kept outside the tree. Image.AppendedLBA says where each
+	// one lands.
+	Appended []*io.SectionReader
+}
+
+// BootImage is an entry for WriteOptions.Boot.
+type BootImage struct {
+	// Platform is the platform ID of the entry, such as PlatformBIOS.
+	Platform  byte
+	Emulation Emulation
+	// Sectors is the number of 512-byte sectors the firmware loads. Zero
+	// loads the whole image, as far as the field can count.
+	Sectors uint16
+	// Path names the regular file of the tree holding the image. When it is
+	// empty, the image is WriteOptions.Appended[Appended] instead.
+	Path     string
+	Appended int
+	// InfoTable patches a boot info table into the image, as
+	// -boot-info-table does for isolinux.bin and GRUB's eltorito.img.
+	InfoTable bool
+	// GRUB2Info patches the address GRUB's eltorito.img finds the rest of
+	// itself by, as --grub2-boot-info does.
+	GRUB2Info bool
+}
+
+// Image is the layout of a new ISO9660 image over a file tree. NewImage
+// plans where everything goes; WriteTo then streams the image, reading file
+// contents from the tree as it goes.
+type Image struct {
+	// SystemArea is written to the first 16 sectors, such as the MBR and GPT
+	// of a hybrid image. It is at most 32 KiB and can be set once the
+	// layout is known.
+	SystemArea []byte
+
+	fsys   fs.FS
+	opts   WriteOptions
+	root   *wnode
+	byPath map[string]*wnode
+	trees  []*wtree
+	// boot holds the file of each entry of opts.Boot, nil for appended ones.
+	boot []*wnode
+	// files lists the regular files with data, in the order they are written.
+	files    []*wnode
+	catalog  uint32
+	data     uint32
+	volume   uint32
+	appended []uint32
+	end      uint32
+	modTime  time.Time
+}
+
+// wnode is a file of the tree being written.
+type wnode struct {
+	name     string
+	path     string
+	mode     fs.FileMode
+	size     int64
+	mtime    time.Time
+	st       Stat
+	target   string
+	parent   *wnode
+	children []*wnode
+	// link is the file whose data a hard link shares.
+	link *wnode
+	// links counts the hard links to a file, itself included.
+	links  uint32
+	serial uint32
+	lba    uint32
+	// catalog marks the file standing for the boot catalog.
+	catalog bool
+	// infoTable and grub2Info are the boot image patches to apply.
+	infoTable, grub2Info bool
+}
+
+func (n *wnode) isDir() bool { return n.mode.IsDir() }
+
+// data returns the file holding n's contents: the one a hard link points at.
+func (n *wnode) data() *wnode {
+	if n.link != nil {
+		return n.link
+	}
+	return n
+}
+
+// wtree is one directory hierarchy of the image: the primary tree or the
+// Joliet tree. Both describe the same files and share their data.
+type wtree struct {
+	joliet   bool
+	names    map[*wnode][]byte
+	children map[*wnode][]*wnode
+	// dirs lists directories in path table order.
+	dirs    []*wnode
+	dirNum  map[*wnode]int
+	extent  map[*wnode]uint32
+	size    map[*wnode]uint32
+	pathLen uint32
+	lPath   uint32
+	mPath   uint32
+}
+
+// NewImage lays out an image of the tree fsys. File attributes come from
+// FileInfo.Sys when it is a *Stat; files without one are owned by root and
+// hard links are recognised by Stat.Inode. Files larger than 4 GiB are split
+// into multiple extents. The tree must not change until WriteTo is done.
+func NewImage(fsys fs.FS, opts WriteOptions) (*Image, error) {
+	if len(opts.VolumeID) > 32 {
+		return nil, fmt.Errorf("iso9660: volume ID %q is longer than 32 bytes", opts.VolumeID)
+	}
+	if len(opts.Publisher) > 128 {
+		return nil, fmt.Errorf("iso9660: publisher %q is longer than 128 bytes", opts.Publisher)
+	}
+	img := &Image{fsys: fsys, opts: opts, byPath: make(map[string]*wnode), modTime: opts.ModTime}
+	if img.modTime.IsZero() {
+		img.modTime = time.Now()
+	}
+	info, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	img.root = newNode(".", ".", nil, info)
+	if err := img.scan(img.root); err != nil {
+		return nil, err
+	}
+	img.linkFiles()
+	if err := img.bootFiles(); err != nil {
+		return nil, err
+	}
+
+	img.trees = append(img.trees, img.newTree(false))
+	if opts.Joliet {
+		img.trees = append(img.trees, img.newTree(true))
+	}
+	for _, t := range img.trees {
+		if len(t.dirs) > maxPathTableDirs {
+			return nil, fmt.Errorf("iso9660: %d directories are more than a path table can number", len(t.dirs))
+		}
+	}
+	img.layout()
+	return img, nil
+}
+
+func newNode(name, p string, parent *wnode, info fs.FileInfo) *wnode {
+	n := &wnode{name: name, path: p, parent: parent, mode: info.Mode(), mtime: info.ModTime(), st: Stat{Nlink: 1}}
+	if st, ok := info.Sys().(*Stat); ok {
+		n.st = *st
+	}
+	if n.mode.IsRegular() {
+		n.size = info.Size()
+	}
+	return n
+}
+
+// scan reads the tree below dir.
+func (img *Image) scan(dir *wnode) error {
+	entries, err := fs.ReadDir(img.fsys, dir.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		n := newNode(e.Name(), path.Join(dir.path, e.Name()), dir, info)
+		switch n.mode.Type() {
+		case fs.ModeDir:
+			if err := img.scan(n); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			if n.target, err = fs.ReadLink(img.fsys, n.path); err != nil {
+				return err
+			}
+		}
+		img.byPath[n.path] = n
+		dir.children = append(dir.children, n)
+	}
+	return nil
+}
+
+// walk calls fn for n and every file below it, parents first.
+func (n *wnode) walk(fn func(*wnode)) {
+	fn(n)
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+// linkFiles pairs up hard links and numbers the files for Rock Ridge.
+func (img *Image) linkFiles() {
+	first := make(map[uint64]*wnode)
+	var serial uint32
+	img.root.walk(func(n *wnode) {
+		if n.mode.IsRegular() && n.st.Nlink > 1 && n.st.Inode != 0 {
+			if f, ok := first[n.st.Inode]; ok {
+				n.link = f
+				f.links++
+				return
+			}
+			first[n.st.Inode] = n
+		}
+		serial++
+		n.serial, n.links = serial, 1
+	})
+}
+
+// bootFiles finds the boot images and the boot catalog file in the tree.
+func (img *Image) bootFiles() error {
+	if n := catalogEntries(img.opts.Boot); n > maxCatalogEntries {
+		return fmt.Errorf("iso9660: %d boot images do not fit in a boot catalog", len(img.opts.Boot))
+	}
+	if img.opts.CatalogPath != "" {
+		n := img.byPath[cleanPath(img.opts.CatalogPath)]
+		if n == nil || !n.mode.IsRegular() || n.link != nil || n.links > 1 {
+			return fmt.Errorf("iso9660: boot catalog %s is not a regular file of the tree", img.opts.CatalogPath)
+		}
+		if len(img.opts.Boot) == 0 {
+			return errors.New("iso9660: a boot catalog file needs boot images")
+		}
+		n.catalog, n.size = true, SectorSize
+	}
+	for _, b := range img.opts.Boot {
+		if b.Path == "" {
+			if b.Appended < 0 || b.Appended >= len(img.opts.Appended) {
+				return fmt.Errorf("iso9660: boot image refers to appended data %d of %d", b.Appended, len(img.opts.Appended))
+			}
+			if b.InfoTable || b.GRUB2Info {
+				return errors.New("iso9660: boot info can only be patched into files of the tree")
+			}
+			img.boot = append(img.boot, nil)
+			continue
+		}
+		n := img.byPath[cleanPath(b.Path)]
+		if n == nil || !n.mode.IsRegular() || n.catalog || n.data().size == 0 {
+			return fmt.Errorf("iso9660: boot image %s is not a regular file of the tree", b.Path)
+		}
+		n = n.data()
+		if b.InfoTable && n.size < bootInfoOffset+bootInfoSize || b.GRUB2Info && n.size < grub2BootInfoOffset+8 {
+			return fmt.Errorf("iso9660: boot image %s is too small to patch", b.Path)
+		}
+		n.infoTable = n.infoTable || b.InfoTable
+		n.grub2Info = n.grub2Info || b.GRUB2Info
+		img.boot = append(img.boot, n)
+	}
+	return nil
+}
+
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (img *Image) newTree(joliet bool) *wtree {
+	t := &wtree{
+		joliet:   joliet,
+		names:    make(map[*wnode][]byte),
+		children: make(map[*wnode][]*wnode),
+		dirNum:   make(map[*wnode]int),
+		extent:   make(map[*wnode]uint32),
+		size:     make(map[*wnode]uint32),
+	}
+	img.root.walk(func(n *wnode) {
+		if !n.isDir() {
+			return
+		}
+		used := make(map[string]bool)
+		var kids []*wnode
+		for _, c := range n.children {
+			if (joliet || !img.opts.RockRidge) && !c.isDir() && !c.mode.IsRegular() {
+				// Only Rock Ridge can describe symlinks and special files.
+				continue
+			}
+			if joliet {
+				t.names[c] = []byte(uniqueJolietName(c.name, c.isDir(), used))
+			} else {
+				t.names[c] = []byte(uniqueISOName(c.name, c.isDir(), used))
+			}
+			kids = append(kids, c)
+		}
+		sort.Slice(kids, func(i, j int) bool {
+			return bytes.Compare(t.names[kids[i]], t.names[kids[j]]) < 0
+		})
+		t.children[n] = kids
+	})
+
+	// Path tables list directories level by level, ordered by parent number
+	// and then by name, which a breadth-first walk of sorted children yields.
+	queue := []*wnode{img.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		t.dirs = append(t.dirs, n)
+		t.dirNum[n] = len(t.dirs)
+		for _, c := range t.children[n] {
+			if c.isDir() {
+				queue = append(queue, c)
+			}
+		}
+	}
+	for _, d := range t.dirs {
+		nameLen := uint32(len(t.names[d]))
+		if d == img.root {
+			nameLen = 1
+		}
+		t.pathLen += 8 + nameLen + nameLen%2
+	}
+	return t
+}
+
+// layout assigns sectors to every structure of the image. Directory sizes
+// do not depend on where anything is, so the directories are encoded once
+// here to measure them and again by WriteTo.
+func (img *Image) layout() {
+	next := uint32(firstDescriptor)
+	next++ // primary volume descriptor
+	if img.bootable() {
+		next++ // boot record
+	}
+	if img.opts.Joliet {
+		next++ // supplementary volume descriptor
+	}
+	next++ // terminator
+	if img.bootable() {
+		img.catalog = next
+		next++
+	}
+	for _, t := range img.trees {
+		sectors := sectorsFor(int64(t.pathLen))
+		t.lPath = next
+		next += sectors
+		t.mPath = next
+		next += sectors
+	}
+	for _, t := range img.trees {
+		for _, d := range t.dirs {
+			records, continuation := img.directory(t, d)
+			t.extent[d] = next
+			t.size[d] = uint32(len(records))
+			next += t.size[d]/SectorSize + sectorsFor(int64(len(continuation)))
+		}
+	}
+
+	img.data = next
+	img.root.walk(func(n *wnode) {
+		switch {
+		case n.catalog:
+			n.lba = img.catalog
+		case n.mode.IsRegular() && n.link == nil && n.size > 0:
+			n.lba = next
+			next += sectorsFor(n.size)
+			img.files = append(img.files, n)
+		}
+	})
+	img.volume = next
+	for _, a := range img.opts.Appended {
+		img.appended = append(img.appended, next)
+		next += sectorsFor(a.Size())
+	}
+	img.end = next
+}
+
+func (img *Image) bootable() bool { return len(img.opts.Boot) > 0 }
+
+func sectorsFor(size int64) uint32 {
+	return uint32((size + SectorSize - 1) / SectorSize)
+}
+
+// Size returns the size of the image in bytes, appended data included.
+func (img *Image) Size() int64 { return int64(img.end) * SectorSize }
+
+// VolumeSize returns the size of the ISO9660 volume in bytes: the image
+// without the appended data.
+func (img *Image) VolumeSize() int64 { return int64(img.volume) * SectorSize }
+
+// FileLBA returns the sector where the data of the regular file name starts,
+// or false when the tree has no such file or it is empty.
+func (img *Image) FileLBA(name string) (uint32, bool) {
+	n := img.byPath[cleanPath(name)]
+	if n == nil || !n.mode.IsRegular() || n.data().lba == 0 {
+		return 0, false
+	}
+	return n.data().lba, true
+}
+
+// AppendedLBA returns the sector where WriteOptions.Appended[i] starts.
+func (img *Image) AppendedLBA(i int) uint32 { return img.appended[i] }
+
+// BootLBA returns the sector where the image of WriteOptions.Boot[i] starts.
+func (img *Image) BootLBA(i int) uint32 {
+	if n := img.boot[i]; n != nil {
+		return n.lba
+	}
+	return img.appended[img.opts.Boot[i].Appended]
+}
+
+// WriteTo writes the image to w. It fails if a file of the tree no longer
+// has the size NewImage saw.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	if len(img.SystemArea) > systemAreaSize {
+		return 0, fmt.Errorf("iso9660: system area of %d bytes is larger than %d", len(img.SystemArea), systemAreaSize)
+	}
+	cw := &countingWriter{w: w}
+	system := make([]byte, systemAreaSize)
+	copy(system, img.SystemArea)
+	cw.Write(system)
+	cw.Write(img.metadata())
+	for _, n := range img.files {
+		if cw.err != nil {
+			break
+		}
+		if err := img.writeFile(cw, n); err != nil {
+			return cw.n, err
+		}
+	}
+	for _, a := range img.opts.Appended {
+		if cw.err != nil {
+			break
+		}
+		if _, err := io.Copy(cw, io.NewSectionReader(a, 0, a.Size())); err != nil && cw.err == nil {
+			return cw.n, fmt.Errorf("iso9660: read appended data: %w", err)
+		}
+		cw.pad()
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	if cw.n != img.Size() {
+		return cw.n, fmt.Errorf("iso9660: wrote %d bytes of a %d-byte image", cw.n, img.Size())
+	}
+	return cw.n, nil
+}
+
+// writeFile copies the data of n, patching boot images.
+func (img *Image) writeFile(cw *countingWriter, n *wnode) error {
+	f, err := img.fsys.Open(n.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if n.infoTable || n.grub2Info {
+		data, err := io.ReadAll(io.LimitReader(f, n.size+1))
+		if err != nil {
+			return fmt.Errorf("iso9660: read %s: %w", n.path, err)
+		}
+		if int64(len(data)) != n.size {
+			return fmt.Errorf("iso9660: %s changed size while writing", n.path)
+		}
+		img.patchBootImage(n, data)
+		cw.Write(data)
+	} else if copied, err := io.CopyN(cw, f, n.size); err != nil {
+		if cw.err != nil {
+			return cw.err
+		}
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("iso9660: %s shrank to %d bytes while writing", n.path, copied)
+		}
+		return fmt.Errorf("iso9660: read %s: %w", n.path, err)
+	}
+	cw.pad()
+	return cw.err
+}
+
+// patchBootImage applies the boot info patches of n to its data.
+func (img *Image) patchBootImage(n *wnode, data []byte) {
+	if n.infoTable {
+		table := data[bootInfoOffset : bootInfoOffset+bootInfoSize]
+		clear(table)
+		binary.LittleEndian.PutUint32(table, firstDescriptor)
+		binary.LittleEndian.PutUint32(table[4:], n.lba)
+		binary.LittleEndian.PutUint32(table[8:], uint32(len(data)))
+		var sum uint32
+		for i := 64; i+4 <= len(data); i += 4 {
+			sum += binary.LittleEndian.Uint32(data[i:])
+		}
+		if rest := len(data) % 4; rest != 0 && len(data) > 64 {
+			var last [4]byte
+			copy(last[:], data[len(data)-rest:])
+			sum += binary.LittleEndian.Uint32(last[:])
+		}
+		binary.LittleEndian.PutUint32(table[12:], sum)
+	}
+	if n.grub2Info {
+		binary.LittleEndian.PutUint64(data[grub2BootInfoOffset:], uint64(n.lba)*4+5)
+	}
+}
+
+// countingWriter counts what it writes and keeps the first error, so a run
+// of writes can be checked once.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// pad writes zeros up to the next sector boundary.
+func (c *countingWriter) pad() {
+	if rest := c.n % SectorSize; rest != 0 {
+		c.Write(make([]byte, SectorSize-rest))
+	}
+}
+
+// metadata encodes the sectors from the volume descriptors up to the first
+// file's data.
+func (img *Image) metadata() []byte {
+	buf := make([]byte, int64(img.data-firstDescriptor)*SectorSize)
+	at := func(lba uint32) []byte {
+		return buf[int64(lba-firstDescriptor)*SectorSize:]
+	}
+
+	next := uint32(firstDescriptor)
+	img.volumeDescriptor(at(next), img.trees[0])
+	next++
+	if img.bootable() {
+		boot := at(next)
+		boot[0] = descBoot
+		copy(boot[1:], standardID)
+		boot[6] = 1
+		copy(boot[7:], elToritoID)
+		binary.LittleEndian.PutUint32(boot[71:], img.catalog)
+		next++
+	}
+	if img.opts.Joliet {
+		img.volumeDescriptor(at(next), img.trees[1])
+		next++
+	}
+	term := at(next)
+	term[0] = descTerminator
+	copy(term[1:], standardID)
+	term[6] = 1
+
+	if img.bootable() {
+		img.bootCatalog(at(img.catalog)[:SectorSize])
+	}
+	for _, t := range img.trees {
+		img.pathTable(at(t.lPath), t, binary.LittleEndian)
+		img.pathTable(at(t.mPath), t, binary.BigEndian)
+	}
+	for _, t := range img.trees {
+		for _, d := range t.dirs {
+			records, continuation := img.directory(t, d)
+			copy(at(t.extent[d]), records)
+			copy(at(t.extent[d]+t.size[d]/SectorSize), continuation)
+		}
+	}
+	return buf
+}
+
+func (img *Image) volumeDescriptor(d []byte, t *wtree) {
+	d[0] = descPrimary
+	if t.joliet {
+		d[0] = descSupplementary
+	}
+	copy(d[1:], standardID)
+	d[6] = 1
+	text := func(field []byte, s string) {
+		if t.joliet {
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			enc := encodeUCS2(s)
+			copy(field, enc[:min(len(enc), len(field)&^1)])
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+	}
+	text(d[8:40], "LINUX")
+	text(d[40:72], img.opts.VolumeID)
+	putBoth32(d[80:], img.volume)
+	if t.joliet {
+		copy(d[88:], "%/E")
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], SectorSize)
+	putBoth32(d[132:], t.pathLen)
+	binary.LittleEndian.PutUint32(d[140:], t.lPath)
+	binary.BigEndian.PutUint32(d[148:], t.mPath)
+	copy(d[156:190], dirRecord([]byte{0}, t.extent[img.root], t.size[img.root], img.root.mtime, flagDirectory, nil))
+	text(d[190:318], "")
+	text(d[318:446], img.opts.Publisher)
+	text(d[446:574], "")
+	text(d[574:702], applicationID)
+	text(d[702:739], "")
+	text(d[739:776], "")
+	text(d[776:813], "")
+	stamp := []byte(img.modTime.UTC().Format("20060102150405") + "00")
+	copy(d[813:], stamp)
+	copy(d[830:], stamp)
+	copy(d[847:], "0000000000000000")
+	copy(d[864:], "0000000000000000")
+	d[881] = 1
+}
+
+func (img *Image) pathTable(buf []byte, t *wtree, order binary.ByteOrder) {
+	off := 0
+	for _, d := range t.dirs {
+		name, parent := t.names[d], 1
+		if d == img.root {
+			name = []byte{0}
+		} else {
+			parent = t.dirNum[d.parent]
+		}
+		buf[off] = byte(len(name))
+		order.PutUint32(buf[off+2:], t.extent[d])
+		order.PutUint16(buf[off+6:], uint16(parent))
+		copy(buf[off+8:], name)
+		off += 8 + len(name) + len(name)%2
+	}
+}
+
+// bootCatalog encodes the catalog: the validation entry, the default entry
+// and a section per run of entries of the same platform.
+func (img *Image) bootCatalog(cat []byte) {
+	boot := img.opts.Boot
+	validation := cat[:catalogEntrySize]
+	validation[0] = 1
+	validation[1] = boot[0].Platform
+	copy(validation[4:28], applicationID)
+	validation[30], validation[31] = 0x55, 0xAA
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(validation[i:])
+	}
+	binary.LittleEndian.PutUint16(validation[28:], -sum)
+
+	img.catalogEntry(cat[catalogEntrySize:], 0)
+	off := 2 * catalogEntrySize
+	for i := 1; i < len(boot); {
+		j := i
+		for j < len(boot) && boot[j].Platform == boot[i].Platform {
+			j++
+		}
+		header := cat[off:]
+		header[0] = headerMore
+		if j == len(boot) {
+			header[0] = headerFinal
+		}
+		header[1] = boot[i].Platform
+		binary.LittleEndian.PutUint16(header[2:], uint16(j-i))
+		off += catalogEntrySize
+		for ; i < j; i++ {
+			img.catalogEntry(cat[off:], i)
+			off += catalogEntrySize
+		}
+	}
+}
+
+// catalogEntries counts the catalog entries boot needs: the validation and
+// default entries, then a section header and an entry per image for each
+// run of images of the same platform.
+func catalogEntries(boot []BootImage) int {
+	n := 2
+	for i := 1; i < len(boot); i++ {
+		if i == 1 || boot[i].Platform != boot[i-1].Platform {
+			n++
+		}
+		n++
+	}
+	return n
+}
+
+func (img *Image) catalogEntry(e []byte, i int) {
+	b := img.opts.Boot[i]
+	e[0] = entryBootable
+	e[1] = byte(b.Emulation)
+	sectors := b.Sectors
+	if sectors == 0 {
+		var size int64
+		if n := img.boot[i]; n != nil {
+			size = n.size
+		} else {
+			size = img.opts.Appended[b.Appended].Size()
+		}
+		sectors = uint16(min((size+511)/512, 0xFFFF))
+	}
+	binary.LittleEndian.PutUint16(e[6:], sectors)
+	binary.LittleEndian.PutUint32(e[8:], img.BootLBA(i))
+}
+
+// directory encodes the extent of directory d, its records packed into
+// sectors without crossing sector boundaries, and the continuation areas of
+// the Rock Ridge entries that do not fit in the records, which follow the
+// extent as mkisofs places them.
+func (img *Image) directory(t *wtree, d *wnode) (records, continuation []byte) {
+	ce := &ceArea{start: t.extent[d] + t.size[d]/SectorSize}
+	var buf []byte
+	add := func(rec []byte) {
+		if rest := SectorSize - len(buf)%SectorSize; len(rec) > rest {
+			buf = append(buf, make([]byte, rest)...)
+		}
+		buf = append(buf, rec...)
+	}
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	rr := img.opts.RockRidge && !t.joliet
+	var self, up []byte
+	if rr {
+		self = ce.systemUse(img.selfSU(d), maxRecordSize-34)
+		up = ce.systemUse([][]byte{img.px(parent), tf(parent.mtime)}, maxRecordSize-34)
+	}
+	add(dirRecord([]byte{0}, t.extent[d], t.size[d], d.mtime, flagDirectory, self))
+	add(dirRecord([]byte{1}, t.extent[parent], t.size[parent], parent.mtime, flagDirectory, up))
+	for _, c := range t.children[d] {
+		name := t.names[c]
+		var su []byte
+		if rr {
+			su = ce.systemUse(img.entrySU(c), maxRecordSize-recordBase(name))
+		}
+		switch {
+		case c.isDir():
+			add(dirRecord(name, t.extent[c], t.size[c], c.mtime, flagDirectory, su))
+		case c.mode.IsRegular() && c.data().size > 0:
+			data := c.data()
+			lba, rest := data.lba, data.size
+			for {
+				size := min(rest, maxExtentSize)
+				rest -= size
+				var flags byte
+				if rest > 0 {
+					flags = flagMultiExtent
+				}
+				add(dirRecord(name, lba, uint32(size), c.mtime, flags, su))
+				if rest == 0 {
+					break
+				}
+				// Only the first record of a multi-extent file carries
+				// Rock Ridge entries.
+				lba += uint32(size / SectorSize)
+				su = nil
+			}
+		default:
+			add(dirRecord(name, 0, 0, c.mtime, 0, su))
+		}
+	}
+	if rest := len(buf) % SectorSize; rest != 0 || len(buf) == 0 {
+		buf = append(buf, make([]byte, SectorSize-rest)...)
+	}
+	return buf, ce.buf
+}
+
+// recordBase returns the size of a directory record before its System Use
+// area.
+func recordBase(name []byte) int {
+	n := 33 + len(name)
+	if len(name)%2 == 0 {
+		n++
+	}
+	return n
+}
+
+func dirRecord(name []byte, lba, size uint32, mtime time.Time, flags byte, su []byte) []byte {
+	base := recordBase(name)
+	length := base + len(su)
+	length += length % 2
+	rec := make([]byte, length)
+	rec[0] = byte(length)
+	putBoth32(rec[2:], lba)
+	putBoth32(rec[10:], size)
+	putRecordTime(rec[18:], mtime)
+	rec[25] = flags
+	putBoth16(rec[28:], 1)
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	copy(rec[base:], su)
+	return rec
+}
+
+// ceArea collects the SUSP continuation areas of a directory's records.
+type ceArea struct {
+	start uint32
+	buf   []byte
+}
+
+// systemUse packs entries into a System Use area of at most room bytes,
+// moving those that do not fit into continuation areas chained by CE
+// entries.
+func (c *ceArea) systemUse(entries [][]byte, room int) []byte {
+	total := 0
+	for _, e := range entries {
+		total += len(e)
+	}
+	var area []byte
+	if total <= room {
+		for _, e := range entries {
+			area = append(area, e...)
+		}
+		return area
+	}
+
+	var su []byte
+	i := 0
+	for i < len(entries) && len(su)+len(entries[i]) <= room-ceEntrySize {
+		su = append(su, entries[i]...)
+		i++
+	}
+	su = append(su, make([]byte, ceEntrySize)...)
+	// ceAt locates the CE entry to fill in next: in su until the first
+	// continuation area is placed, then in the last area.
+	ceAt, inSU := len(su)-ceEntrySize, true
+	for i < len(entries) {
+		area = area[:0]
+		for i < len(entries) && len(area)+len(entries[i]) <= SectorSize-ceEntrySize {
+			area = append(area, entries[i]...)
+			i++
+		}
+		if i < len(entries) {
+			area = append(area, make([]byte, ceEntrySize)...)
+		}
+		if rest := SectorSize - len(c.buf)%SectorSize; len(area) > rest {
+			c.buf = append(c.buf, make([]byte, rest)...)
+		}
+		block, offset := c.start+uint32(len(c.buf)/SectorSize), uint32(len(c.buf)%SectorSize)
+		pos := len(c.buf)
+		c.buf = append(c.buf, area...)
+		target := c.buf[ceAt:]
+		if inSU {
+			target = su[ceAt:]
+		}
+		putCE(target, block, offset, uint32(len(area)))
+		ceAt, inSU = pos+len(area)-ceEntrySize, false
+	}
+	return su
+}
+
+func putCE(b []byte, block, offset, length uint32) {
+	copy(b, []byte{'C', 'E', ceEntrySize, 1})
+	putBoth32(b[4:], block)
+	putBoth32(b[12:], offset)
+	putBoth32(b[20:], length)
+}
+
+// selfSU returns the Rock Ridge entries of the "." record of d. The root's
+// starts with the SP entry that announces SUSP and ends with the ER entry
+// that names Rock Ridge, which lands in a continuation area.
+func (img *Image) selfSU(d *wnode) [][]byte {
+	if d != img.root {
+		return [][]byte{img.px(d), tf(d.mtime)}
+	}
+	er := []byte{'E', 'R', byte(8 + len(rripID) + len(rripDesc) + len(rripSource)), 1, byte(len(rripID)), byte(len(rripDesc)), byte(len(rripSource)), 1}
+	er = append(er, rripID+rripDesc+rripSource...)
+	return [][]byte{{'S', 'P', 7, 1, 0xBE, 0xEF, 0}, img.px(d), tf(d.mtime), er}
+}
+
+// entrySU returns the Rock Ridge entries of a named record.
+func (img *Image) entrySU(n *wnode) [][]byte {
+	entries := [][]byte{img.px(n), tf(n.mtime)}
+	entries = append(entries, nm(n.name)...)
+	if n.mode.Type() == fs.ModeSymlink {
+		entries = append(entries, sl(n.target)...)
+	}
+	if n.mode&fs.ModeDevice != 0 {
+		pn := make([]byte, 20)
+		copy(pn, []byte{'P', 'N', 20, 1})
+		putBoth32(pn[4:], n.st.Major)
+		putBoth32(pn[12:], n.st.Minor)
+		entries = append(entries, pn)
+	}
+	return entries
+}
+
+// px encodes the RRIP 1.12 PX entry of n, with its file serial number.
+func (img *Image) px(n *wnode) []byte {
+	data := n.data()
+	nlink := data.links
+	if n.isDir() {
+		nlink = 2
+		for _, c := range n.children {
+			if c.isDir() {
+				nlink++
+			}
+		}
+	}
+	px := make([]byte, 44)
+	copy(px, []byte{'P', 'X', 44, 1})
+	putBoth32(px[4:], posixBits(n.mode))
+	putBoth32(px[12:], nlink)
+	putBoth32(px[20:], data.st.UID)
+	putBoth32(px[28:], data.st.GID)
+	putBoth32(px[36:], data.serial)
+	return px
+}
+
+// tf encodes a TF entry with t as the modification, access and attribute
+// change times.
+func tf(t time.Time) []byte {
+	entry := make([]byte, 5+3*7)
+	copy(entry, []byte{'T', 'F', byte(len(entry)), 1, 0x02 | 0x04 | 0x08})
+	for i := range 3 {
+		putRecordTime(entry[5+7*i:], t)
+	}
+	return entry
+}
+
+// nm encodes a name as NM entries, continued across entries when long.
+func nm(name string) [][]byte {
+	const maxPart = 255 - 5
+	var entries [][]byte
+	for {
+		part := name[:min(len(name), maxPart)]
+		name = name[len(part):]
+		var flags byte
+		if name != "" {
+			flags = 0x01
+		}
+		entries = append(entries, append([]byte{'N', 'M', byte(5 + len(part)), 1, flags}, part...))
+		if name == "" {
+			return entries
+		}
+	}
+}
+
+// sl encodes a symlink target as SL entries, splitting long components and
+// long targets across entries.
+func sl(target string) [][]byte {
+	const maxComponent = 255 - 5 - 2
+	var comps [][]byte
+	parts := strings.Split(target, "/")
+	if strings.HasPrefix(target, "/") {
+		comps = append(comps, []byte{0x08, 0})
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		switch part {
+		case "":
+			continue
+		case ".":
+			comps = append(comps, []byte{0x02, 0})
+		case "..":
+			comps = append(comps, []byte{0x04, 0})
+		default:
+			for len(part) > 0 {
+				chunk := part[:min(len(part), maxComponent)]
+				part = part[len(chunk):]
+				var flags byte
+				if part != "" {
+					flags = 0x01
+				}
+				comps = append(comps, append([]byte{flags, byte(len(chunk))}, chunk...))
+			}
+		}
+	}
+	var entries [][]byte
+	entry := []byte{'S', 'L', 0, 1, 0}
+	for _, comp := range comps {
+		if len(entry)+len(comp) > 255 {
+			entry[4] = 0x01 // continued in the next SL entry
+			entries = append(entries, entry)
+			entry = []byte{'S', 'L', 0, 1, 0}
+		}
+		entry = append(entry, comp...)
+	}
+	entries = append(entries, entry)
+	for _, e := range entries {
+		e[2] = byte(len(e))
+	}
+	return entries
+}
+
+// posixBits converts an fs.FileMode to a POSIX st_mode.
+func posixBits(m fs.FileMode) uint32 {
+	bits := uint32(m.Perm())
+	switch m.Type() {
+	case fs.ModeDir:
+		bits |= sIFDIR
+	case fs.ModeSymlink:
+		bits |= sIFLNK
+	case fs.ModeDevice:
+		bits |= sIFBLK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		bits |= sIFCHR
+	case fs.ModeNamedPipe:
+		bits |= sIFIFO
+	case fs.ModeSocket:
+		bits |= sIFSOCK
+	default:
+		bits |= sIFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// uniqueISOName maps name to an ISO9660 level 2 identifier not yet in used.
+func uniqueISOName(name string, dir bool, used map[string]bool) string {
+	clean := func(s string, max int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if b.Len() == max {
+				break
+			}
+			if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+				b.WriteRune(r)
+			} else {
+				b.WriteByte('_')
+			}
+		}
+		return b.String()
+	}
+
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+		ext = clean(ext, 8)
+	}
+	limit := 31
+	if !dir {
+		limit = 30 - len(ext)
+	}
+	base = clean(base, limit)
+
+	format := func(base string) string {
+		if dir {
+			return base
+		}
+		return base + "." + ext + ";1"
+	}
+	candidate := format(base)
+	for i := 1; used[candidate]; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		candidate = format(base[:min(len(base), limit-len(suffix))] + suffix)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// uniqueJolietName maps name to a Joliet identifier of at most 64 UCS-2
+// characters, version suffix included, that is not yet in used.
+func uniqueJolietName(name string, dir bool, used map[string]bool) string {
+	const maxUnits = 64
+	limit := maxUnits
+	if !dir {
+		limit -= 2 // ";1"
+	}
+	truncate := func(s string, units int) []byte {
+		enc := encodeUCS2(s)
+		if len(enc) <= 2*units {
+			return enc
+		}
+		enc = enc[:2*units]
+		if last := binary.BigEndian.Uint16(enc[len(enc)-2:]); utf16.IsSurrogate(rune(last)) {
+			enc = enc[:len(enc)-2] // keep surrogate pairs whole
+		}
+		return enc
+	}
+	candidate := string(truncate(name, limit))
+	for i := 1; used[candidate]; i++ {
+		suffix := encodeUCS2(fmt.Sprintf("~%d", i))
+		candidate = string(truncate(name, limit-len(suffix)/2)) + string(suffix)
+	}
+	used[candidate] = true
+	if !dir {
+		return candidate + string(encodeUCS2(";1"))
+	}
+	return candidate
+}
+
+// encodeUCS2 encodes s as big-endian UTF-16, as Joliet names are stored.
+func encodeUCS2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(buf[2*i:], u)
+	}
+	return buf
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// putRecordTime encodes t as the 7-byte recording time of a directory
+// record, in UTC. The zero time is left as zeros, meaning unknown.
+func putRecordTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	t = t.UTC()
+	year := min(max(t.Year(), 1900), 1900+255)
+	b[0] = byte(year - 1900)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
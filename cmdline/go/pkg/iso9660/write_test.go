@@ -0,0 +1,197 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+// writeImage writes an image of fsys and opens it.
+func writeImage(t *testing.T, fsys fs.FS, opts WriteOptions) (*FS, []byte) {
+	t.Helper()
+	img, err := NewImage(fsys, opts)
+	if err != nil {
+		t.Fatalf("NewImage() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if n, err := img.WriteTo(&buf); err != nil || n != img.Size() {
+		t.Fatalf("WriteTo() = %d, %v; want %d bytes", n, err, img.Size())
+	}
+	out, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Open() of the written image error = %v", err)
+	}
+	return out, buf.Bytes()
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	src := openISO(t, isotest.ISO{RockRidge: true})
+	out, _ := writeImage(t, src, WriteOptions{VolumeID: "Remastered", Publisher: "Example", RockRidge: true, Joliet: true, ModTime: modTime})
+	if !out.RockRidge() || out.VolumeID() != "Remastered" || out.Publisher() != "Example" {
+		t.Fatalf("RockRidge() = %t, VolumeID() = %q, Publisher() = %q", out.RockRidge(), out.VolumeID(), out.Publisher())
+	}
+
+	err := fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		want, _ := d.Info()
+		got, err := out.Lstat(name)
+		if err != nil {
+			t.Errorf("Lstat(%s) error = %v", name, err)
+			return nil
+		}
+		ws, gs := want.Sys().(*Stat), got.Sys().(*Stat)
+		if got.Mode() != want.Mode() || got.Size() != want.Size() || !got.ModTime().Equal(want.ModTime()) ||
+			gs.UID != ws.UID || gs.GID != ws.GID || gs.Nlink != ws.Nlink || gs.Major != ws.Major || gs.Minor != ws.Minor {
+			t.Errorf("%s = %v %d %v %+v, want %v %d %v %+v", name, got.Mode(), got.Size(), got.ModTime(), gs, want.Mode(), want.Size(), want.ModTime(), ws)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel, _ := out.Lstat("casper/vmlinuz")
+	efi, _ := out.Lstat("casper/vmlinuz.efi")
+	if kernel.Sys().(*Stat).LBA != efi.Sys().(*Stat).LBA {
+		t.Fatal("hard links do not share their data")
+	}
+	if err := fstest.TestFS(out, "README.diskdefines", "casper/vmlinuz", "dists/noble/Release", "dev/console", "ubuntu"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteLongNamesAndJoliet(t *testing.T) {
+	longName := strings.Repeat("a very long file name ", 12)[:255]
+	longTarget := strings.Repeat("../deep/", 40) + strings.Repeat("x", 300)
+	src := fstest.MapFS{
+		"docs/" + longName:   {Data: []byte("long"), Mode: 0o644},
+		"docs/Straße.txt":    {Data: []byte("unicode"), Mode: 0o644},
+		"docs/link":          {Data: []byte(longTarget), Mode: fs.ModeSymlink | 0o777},
+		"docs/empty":         {Mode: 0o600},
+		"docs/similar-1.txt": {Data: []byte("1")},
+		"docs/similar_1.txt": {Data: []byte("2")},
+	}
+	out, _ := writeImage(t, src, WriteOptions{VolumeID: "LONG", RockRidge: true, Joliet: true})
+	if data, err := fs.ReadFile(out, "docs/"+longName); err != nil || string(data) != "long" {
+		t.Fatalf("ReadFile of a 255-byte name = %q, %v", data, err)
+	}
+	if target, err := out.ReadLink("docs/link"); err != nil || target != longTarget {
+		t.Fatalf("ReadLink() = %d bytes, %v; want %d", len(target), err, len(longTarget))
+	}
+	for _, name := range []string{"docs/similar-1.txt", "docs/similar_1.txt", "docs/Straße.txt", "docs/empty"} {
+		if data, err := fs.ReadFile(out, name); err != nil || !bytes.Equal(data, src[name].Data) {
+			t.Fatalf("ReadFile(%s) = %q, %v", name, data, err)
+		}
+	}
+
+	joliet, _ := writeImage(t, src, WriteOptions{VolumeID: "LONG", Joliet: true})
+	if joliet.RockRidge() || !joliet.Joliet() {
+		t.Fatalf("RockRidge() = %t, Joliet() = %t; want Joliet", joliet.RockRidge(), joliet.Joliet())
+	}
+	if data, err := fs.ReadFile(joliet, "docs/Straße.txt"); err != nil || string(data) != "unicode" {
+		t.Fatalf("ReadFile of a Joliet name = %q, %v", data, err)
+	}
+	if _, err := joliet.Lstat("docs/link"); err == nil {
+		t.Fatal("Joliet tree has a symlink")
+	}
+}
+
+func TestWriteBoot(t *testing.T) {
+	loader := make([]byte, 4096)
+	for i := range loader {
+		loader[i] = byte(i)
+	}
+	esp := bytes.Repeat([]byte("ESP!"), 1000)
+	src := fstest.MapFS{
+		"boot/eltorito.img": {Data: loader},
+		"boot.catalog":      {Data: []byte("stale")},
+		"README":            {Data: []byte("readme")},
+	}
+	opts := WriteOptions{
+		VolumeID:    "BOOT",
+		RockRidge:   true,
+		CatalogPath: "boot.catalog",
+		Appended:    []*io.SectionReader{io.NewSectionReader(bytes.NewReader(esp), 0, int64(len(esp)))},
+		Boot: []BootImage{
+			{Platform: PlatformBIOS, Sectors: 4, Path: "boot/eltorito.img", InfoTable: true, GRUB2Info: true},
+			{Platform: PlatformEFI},
+		},
+	}
+	img, err := NewImage(src, opts)
+	if err != nil {
+		t.Fatalf("NewImage() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	data := buf.Bytes()
+	out, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	entries, err := out.BootEntries()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("BootEntries() = %+v, %v", entries, err)
+	}
+	biosLBA, _ := img.FileLBA("boot/eltorito.img")
+	if e := entries[0]; e.Platform != PlatformBIOS || e.LBA != biosLBA || e.Sectors != 4 || img.BootLBA(0) != biosLBA {
+		t.Fatalf("BIOS entry = %+v, want sector %d", e, biosLBA)
+	}
+	if e := entries[1]; e.Platform != PlatformEFI || e.LBA != img.AppendedLBA(0) || e.Sectors != uint16(len(esp)/512+1) {
+		t.Fatalf("EFI entry = %+v, want sector %d", e, img.AppendedLBA(0))
+	}
+	if got := data[int64(img.AppendedLBA(0))*SectorSize:][:len(esp)]; !bytes.Equal(got, esp) {
+		t.Fatal("appended data differs")
+	}
+	if out.Size() != img.VolumeSize() || img.VolumeSize() != int64(img.AppendedLBA(0))*SectorSize {
+		t.Fatalf("volume size %d, image VolumeSize() %d, appended at sector %d", out.Size(), img.VolumeSize(), img.AppendedLBA(0))
+	}
+
+	patched, err := fs.ReadFile(out, "boot/eltorito.img")
+	if err != nil {
+		t.Fatalf("ReadFile(boot/eltorito.img) error = %v", err)
+	}
+	var sum uint32
+	for i := 64; i < len(loader); i += 4 {
+		sum += binary.LittleEndian.Uint32(loader[i:])
+	}
+	if pvd, lba, size, check := binary.LittleEndian.Uint32(patched[8:]), binary.LittleEndian.Uint32(patched[12:]), binary.LittleEndian.Uint32(patched[16:]), binary.LittleEndian.Uint32(patched[20:]); pvd != 16 || lba != biosLBA || size != uint32(len(loader)) || check != sum {
+		t.Fatalf("boot info table = %d %d %d %#x, want 16 %d %d %#x", pvd, lba, size, check, biosLBA, len(loader), sum)
+	}
+	if got := binary.LittleEndian.Uint64(patched[2548:]); got != uint64(biosLBA)*4+5 {
+		t.Fatalf("GRUB boot info = %d, want %d", got, uint64(biosLBA)*4+5)
+	}
+	if !bytes.Equal(patched[2556:], loader[2556:]) || !bytes.Equal(patched[64:2548], loader[64:2548]) {
+		t.Fatal("boot image changed outside the patched fields")
+	}
+
+	catalog, err := out.Lstat("boot.catalog")
+	if err != nil || catalog.Sys().(*Stat).LBA != out.BootCatalog() || catalog.Size() != SectorSize {
+		t.Fatalf("boot.catalog = %v, %v; want the catalog at sector %d", catalog, err, out.BootCatalog())
+	}
+}
+
+func TestWriteRejects(t *testing.T) {
+	src := fstest.MapFS{"README": {Data: []byte("readme")}, "empty": {}}
+	for name, opts := range map[string]WriteOptions{
+		"long volume ID":     {VolumeID: strings.Repeat("X", 33)},
+		"missing boot image": {Boot: []BootImage{{Path: "isolinux/isolinux.bin"}}},
+		"empty boot image":   {Boot: []BootImage{{Path: "empty"}}},
+		"small info table":   {Boot: []BootImage{{Path: "README", InfoTable: true}}},
+		"catalog unbooted":   {CatalogPath: "README"},
+		"missing appended":   {Boot: []BootImage{{Appended: 1}}},
+	} {
+		if _, err := NewImage(src, opts); err == nil {
+			t.Errorf("NewImage() with %s succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package partition reads MBR and GPT partition tables through an
+// io.ReaderAt, such as those isohybrid and xorriso embed in the system area
+// of bootable ISOs so they also boot from USB sticks.
+//
+// Tables are read with 512-byte sectors. A GPT is only trusted when its
+// header and entry array pass their CRC checks; a protective MBR without a
+// valid GPT behind it is reported as ErrCorrupt.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// SectorSize is the sector size the tables are read with.
+const SectorSize = 512
+
+// Partition table schemes.
+const (
+	SchemeMBR = "mbr"
+	SchemeGPT = "gpt"
+)
+
+const (
+	mbrTableOffset = 446
+	mbrProtective  = 0xEE
+	gptSignature   = "EFI PART"
+	// maxGPTEntries bounds the entry array read into memory.
+	maxGPTEntries = 1024
+)
+
+// GPT partition type GUIDs, in their usual text form.
+const (
+	TypeESP       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	TypeBasicData = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	TypeLinux     = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	TypeBIOSBoot  = "21686148-6449-6E6F-744E-656564454649"
+	TypeHFSPlus   = "48465300-0000-11AA-AA11-00306543ECAC"
+)
+
+var (
+	// ErrNoTable is returned by Read when the image has no partition table.
+	ErrNoTable = errors.New("partition: no partition table")
+	// ErrCorrupt reports a partition table that cannot be decoded.
+	ErrCorrupt = errors.New("partition: corrupt partition table")
+)
+
+// Table is a decoded partition table.
+type Table struct {
+	// Scheme is SchemeMBR or SchemeGPT.
+	Scheme     string
+	Partitions []Partition
+}
+
+// Partition is one used slot of a partition table.
+type Partition struct {
+	// Number is the 1-based slot of the partition in its table.
+	Number int
+	// Type is the MBR type byte, such as "0xef", or the GPT type GUID.
+	Type string
+	// Name is the GPT partition name; MBR partitions have none.
+	Name string
+	// Start and Size locate the partition in the image, in bytes.
+	Start, Size int64
+	// Bootable is the MBR active flag or the GPT legacy BIOS bootable
+	// attribute.
+	Bootable bool
+}
+
+// ESP reports whether p is an EFI system partition.
+func (p Partition) ESP() bool {
+	return p.Type == TypeESP || p.Type == "0xef"
+}
+
+// Description names the partition type, such as "EFI system partition",
+// falling back to Type for types it does not know.
+func (p Partition) Description() string {
+	switch p.Type {
+	case TypeESP, "0xef":
+		return "EFI system partition"
+	case TypeBasicData:
+		return "basic data"
+	case TypeLinux, "0x83":
+		return "Linux filesystem"
+	case TypeBIOSBoot:
+		return "BIOS boot"
+	case TypeHFSPlus, "0xaf":
+		return "HFS+"
+	case "0x00":
+		return "empty"
+	case "0x17", "0xcd":
+		return "ISO9660"
+	case "0x0c", "0x0b", "0x0e", "0x06", "0x01":
+		return "FAT"
+	}
+	return p.Type
+}
+
+// Read decodes the partition table at the start of r. It returns ErrNoTable
+// when sector 0 carries no MBR signature or only empty slots.
+func Read(r io.ReaderAt) (*Table, error) {
+	mbr := make([]byte, SectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNoTable
+		}
+		return nil, fmt.Errorf("read MBR: %w", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil, ErrNoTable
+	}
+
+	t := &Table{Scheme: SchemeMBR}
+	protective := false
+	for i := range 4 {
+		e := mbr[mbrTableOffset+16*i:]
+		typ := e[4]
+		start := binary.LittleEndian.Uint32(e[8:])
+		size := binary.LittleEndian.Uint32(e[12:])
+		if typ == 0 && size == 0 {
+			continue
+		}
+		if typ == mbrProtective {
+			protective = true
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Number:   i + 1,
+			Type:     fmt.Sprintf("0x%02x", typ),
+			Start:    int64(start) * SectorSize,
+			Size:     int64(size) * SectorSize,
+			Bootable: e[0]&0x80 != 0,
+		})
+	}
+	if protective {
+		return readGPT(r)
+	}
+	if len(t.Partitions) == 0 {
+		return nil, ErrNoTable
+	}
+	return t, nil
+}
+
+// readGPT decodes the GPT whose header is in sector 1.
+func readGPT(r io.ReaderAt) (*Table, error) {
+	header := make([]byte, SectorSize)
+	if _, err := r.ReadAt(header, SectorSize); err != nil {
+		return nil, fmt.Errorf("read GPT header: %w", err)
+	}
+	if string(header[:8]) != gptSignature {
+		return nil, fmt.Errorf("%w: protective MBR without a GPT header", ErrCorrupt)
+	}
+	size := binary.LittleEndian.Uint32(header[12:])
+	if size < 92 || size > SectorSize {
+		return nil, fmt.Errorf("%w: GPT header size %d", ErrCorrupt, size)
+	}
+	check := bytes.Clone(header[:size])
+	clear(check[16:20])
+	if crc32.ChecksumIEEE(check) != binary.LittleEndian.Uint32(header[16:]) {
+		return nil, fmt.Errorf("%w: GPT header fails its CRC", ErrCorrupt)
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	count := binary.LittleEndian.Uint32(header[80:])
+	entrySize := binary.LittleEndian.Uint32(header[84:])
+	if count > maxGPTEntries || entrySize < 128 || entrySize > 4096 || entrySize%8 != 0 {
+		return nil, fmt.Errorf("%w: %d GPT entries of %d bytes", ErrCorrupt, count, entrySize)
+	}
+	entries := make([]byte, int(count)*int(entrySize))
+	if _, err := r.ReadAt(entries, int64(entriesLBA)*SectorSize); err != nil {
+		return nil, fmt.Errorf("read GPT entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		return nil, fmt.Errorf("%w: GPT entries fail their CRC", ErrCorrupt)
+	}
+
+	t := &Table{Scheme: SchemeGPT}
+	for i := range int(count) {
+		e := entries[i*int(entrySize):]
+		typ := guid(e[:16])
+		if typ == "00000000-0000-0000-0000-000000000000" {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		if last < first {
+			return nil, fmt.Errorf("%w: GPT partition %d ends before it starts", ErrCorrupt, i+1)
+		}
+		t.Partitions = append(t.Partitions, Partition{
+			Number:   i + 1,
+			Type:     typ,
+			Name:     utf16Name(e[56:128]),
+			Start:    int64(first) * SectorSize,
+			Size:     int64(last-first+1) * SectorSize,
+			Bootable: binary.LittleEndian.Uint64(e[48:])&(1<<2) != 0,
+		})
+	}
+	return t, nil
+}
+
+// guid formats a GUID stored in the mixed-endian GPT layout.
+func guid(b []byte) string {
+	return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16]))
+}
+
+// utf16Name decodes a NUL-padded UTF-16LE partition name.
+func utf16Name(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,94 @@
+package partition
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/pkg/iso9660"
+)
+
+// hybridISO returns an ISO with an embedded table and the byte offset of
+// its EFI boot image.
+func hybridISO(t *testing.T, hybrid string) ([]byte, int64) {
+	t.Helper()
+	iso := isotest.ISO{
+		Files: []isotest.File{
+			isotest.Text("isolinux/isolinux.bin", "bios loader"),
+			isotest.Text("boot/grub/efi.img", string(bytes.Repeat([]byte{0xEF}, 3000))),
+		},
+		BIOSBoot: "isolinux/isolinux.bin",
+		EFIBoot:  "boot/grub/efi.img",
+		Hybrid:   hybrid,
+	}
+	img, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("generate ISO: %v", err)
+	}
+	fsys, err := iso9660.Open(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("iso9660.Open() error = %v", err)
+	}
+	info, err := fs.Stat(fsys, "boot/grub/efi.img")
+	if err != nil {
+		t.Fatalf("Stat(efi.img) error = %v", err)
+	}
+	return img, int64(info.Sys().(*iso9660.Stat).LBA) * iso9660.SectorSize
+}
+
+func TestReadMBR(t *testing.T) {
+	img, efi := hybridISO(t, isotest.HybridMBR)
+	table, err := Read(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if table.Scheme != SchemeMBR || len(table.Partitions) != 2 {
+		t.Fatalf("Read() = %+v, want two MBR partitions", table)
+	}
+	iso, esp := table.Partitions[0], table.Partitions[1]
+	if iso.Number != 1 || iso.Type != "0x17" || !iso.Bootable || iso.Start != 0 || iso.Size != int64(len(img)) || iso.Description() != "ISO9660" {
+		t.Fatalf("partition 1 = %+v", iso)
+	}
+	if esp.Number != 2 || !esp.ESP() || esp.Bootable || esp.Start != efi || esp.Size != 3072 {
+		t.Fatalf("partition 2 = %+v, want the ESP at %d", esp, efi)
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	img, efi := hybridISO(t, isotest.HybridGPT)
+	table, err := Read(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if table.Scheme != SchemeGPT || len(table.Partitions) != 2 {
+		t.Fatalf("Read() = %+v, want two GPT partitions", table)
+	}
+	data, esp := table.Partitions[0], table.Partitions[1]
+	if data.Type != TypeBasicData || data.Name != "ISO9660" || data.Start != 64*SectorSize || data.Description() != "basic data" {
+		t.Fatalf("partition 1 = %+v", data)
+	}
+	if esp.Type != TypeESP || esp.Name != "Appended2" || esp.Start != efi || esp.Size != 3072 || esp.Description() != "EFI system partition" {
+		t.Fatalf("partition 2 = %+v, want the ESP at %d", esp, efi)
+	}
+
+	img[2*SectorSize+56] ^= 0xFF
+	if _, err := Read(bytes.NewReader(img)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Read() with a damaged entry error = %v, want ErrCorrupt", err)
+	}
+	img[SectorSize] = 'X'
+	if _, err := Read(bytes.NewReader(img)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Read() without a GPT header error = %v, want ErrCorrupt", err)
+	}
+}
+
+func TestReadNoTable(t *testing.T) {
+	img, _ := hybridISO(t, "")
+	if _, err := Read(bytes.NewReader(img)); !errors.Is(err, ErrNoTable) {
+		t.Fatalf("Read() error = %v, want ErrNoTable", err)
+	}
+	if _, err := Read(bytes.NewReader(nil)); !errors.Is(err, ErrNoTable) {
+		t.Fatalf("Read(empty) error = %v, want ErrNoTable", err)
+	}
+}
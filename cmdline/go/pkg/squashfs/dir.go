@@ -0,0 +1,99 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// maxCachedListings bounds the directory listing cache.
+const maxCachedListings = 256
+
+// dirent is one entry of a directory listing.
+type dirent struct {
+	name   string
+	ref    uint64
+	typ    uint16
+	number uint32
+}
+
+// readDir returns the entries of directory inode in, sorted by name as
+// squashfs stores them.
+func (f *FS) readDir(in *inode) ([]dirent, error) {
+	key := uint64(in.dirBlock)<<16 | uint64(in.dirOffset)
+	f.mu.Lock()
+	entries, ok := f.listings[key]
+	f.mu.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	// The stored size counts 3 bytes for the implicit "." and ".." entries.
+	remaining := int(in.size) - 3
+	if remaining <= 0 {
+		return nil, nil
+	}
+	m, err := f.newMetaReader(f.sb.DirectoryTable+uint64(in.dirBlock), int(in.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	for remaining > 0 {
+		header, err := m.read(12)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= 12
+		count := le.Uint32(header) + 1
+		start := le.Uint32(header[4:])
+		base := le.Uint32(header[8:])
+		if count > 256 {
+			return nil, fmt.Errorf("%w: directory header with %d entries", ErrCorrupt, count)
+		}
+		for i := uint32(0); i < count; i++ {
+			b, err := m.read(8)
+			if err != nil {
+				return nil, err
+			}
+			nameLen := int(le.Uint16(b[6:])) + 1
+			name, err := m.read(nameLen)
+			if err != nil {
+				return nil, err
+			}
+			remaining -= 8 + nameLen
+			entries = append(entries, dirent{
+				name:   string(name),
+				ref:    uint64(start)<<16 | uint64(le.Uint16(b)),
+				typ:    le.Uint16(b[4:]),
+				number: uint32(int64(base) + int64(int16(le.Uint16(b[2:])))),
+			})
+		}
+	}
+	if remaining < 0 {
+		return nil, fmt.Errorf("%w: directory listing overruns its size", ErrCorrupt)
+	}
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].name < entries[j].name }) {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	}
+
+	f.mu.Lock()
+	if len(f.listings) >= maxCachedListings {
+		clear(f.listings)
+	}
+	f.listings[key] = entries
+	f.mu.Unlock()
+	return entries, nil
+}
+
+// child finds name in directory inode dir.
+func (f *FS) child(dir *inode, name string) (*inode, error) {
+	entries, err := f.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].name >= name })
+	if i == len(entries) || entries[i].name != name {
+		return nil, nil
+	}
+	return f.readInode(entries[i].ref)
+}
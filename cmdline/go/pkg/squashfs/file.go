@@ -0,0 +1,216 @@
+package squashfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// maxCachedFragments bounds the fragment block cache. Small files packed
+// into the same fragment block are usually read one after another.
+const maxCachedFragments = 16
+
+// File is an open regular file. It implements io.ReaderAt and io.Seeker in
+// addition to fs.File.
+type File struct {
+	fs   *FS
+	in   *inode
+	info fileInfo
+	// starts holds the image offset of every data block.
+	starts []uint64
+
+	mu     sync.Mutex
+	offset int64
+	cached int
+	block  []byte
+}
+
+func (f *FS) openFile(name string, in *inode) *File {
+	file := &File{fs: f, in: in, info: fileInfo{name: name, in: in}, cached: -1}
+	file.starts = make([]uint64, len(in.blockSizes))
+	pos := in.blocksStart
+	for i, size := range in.blockSizes {
+		file.starts[i] = pos
+		pos += uint64(size &^ dataUncompressed)
+	}
+	return file
+}
+
+// Stat returns the file's FileInfo.
+func (file *File) Stat() (fs.FileInfo, error) {
+	return file.info, nil
+}
+
+// Close is a no-op; the image stays open.
+func (file *File) Close() error {
+	return nil
+}
+
+// Read reads from the current offset.
+func (file *File) Read(p []byte) (int, error) {
+	file.mu.Lock()
+	off := file.offset
+	file.mu.Unlock()
+	n, err := file.ReadAt(p, off)
+	file.mu.Lock()
+	file.offset = off + int64(n)
+	file.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (file *File) Seek(offset int64, whence int) (int64, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += int64(file.in.size)
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: file.info.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: file.info.name, Err: fs.ErrInvalid}
+	}
+	file.offset = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes at off.
+func (file *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: file.info.name, Err: fs.ErrInvalid}
+	}
+	size := int64(file.in.size)
+	bs := int64(file.fs.sb.BlockSize)
+	n := 0
+	for n < len(p) && off < size {
+		data, err := file.blockAt(int(off / bs))
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: file.info.name, Err: err}
+		}
+		copied := copy(p[n:], data[off%bs:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blockAt returns the decompressed contents of the i-th block of the file,
+// which is the tail fragment when i is past the last full block.
+func (file *File) blockAt(i int) ([]byte, error) {
+	file.mu.Lock()
+	if file.cached == i {
+		block := file.block
+		file.mu.Unlock()
+		return block, nil
+	}
+	file.mu.Unlock()
+
+	bs := uint64(file.fs.sb.BlockSize)
+	want := int(min(bs, file.in.size-uint64(i)*bs))
+	var (
+		data []byte
+		err  error
+	)
+	if i < len(file.in.blockSizes) {
+		data, err = file.fs.readBlock(file.starts[i], file.in.blockSizes[i], want)
+	} else {
+		data, err = file.fs.fragmentData(file.in, want)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file.mu.Lock()
+	file.cached, file.block = i, data
+	file.mu.Unlock()
+	return data, nil
+}
+
+// readBlock reads a data block whose size word is word and which decompresses
+// to want bytes. A zero size word marks a sparse block of zeros.
+func (f *FS) readBlock(pos uint64, word uint32, want int) ([]byte, error) {
+	if word == 0 {
+		return make([]byte, want), nil
+	}
+	size := word &^ dataUncompressed
+	if size > f.sb.BlockSize {
+		return nil, fmt.Errorf("%w: data block of %d bytes", ErrCorrupt, size)
+	}
+	raw := make([]byte, size)
+	if _, err := f.r.ReadAt(raw, int64(pos)); err != nil {
+		return nil, fmt.Errorf("read data block at %d: %w", pos, err)
+	}
+	data := raw
+	if word&dataUncompressed == 0 {
+		var err error
+		if data, err = f.decompress(make([]byte, 0, f.sb.BlockSize), raw); err != nil {
+			return nil, fmt.Errorf("%w: data block at %d: %v", ErrCorrupt, pos, err)
+		}
+	}
+	if len(data) < want {
+		return nil, fmt.Errorf("%w: data block at %d holds %d bytes, want %d", ErrCorrupt, pos, len(data), want)
+	}
+	return data[:want], nil
+}
+
+// fragmentData returns the tail of a file stored in a fragment block.
+func (f *FS) fragmentData(in *inode, want int) ([]byte, error) {
+	if in.fragment == noFragment || int(in.fragment) >= len(f.fragments) {
+		return nil, fmt.Errorf("%w: missing fragment for the tail of inode %d", ErrCorrupt, in.number)
+	}
+
+	f.mu.Lock()
+	block, ok := f.fragCache[in.fragment]
+	f.mu.Unlock()
+	if !ok {
+		frag := f.fragments[in.fragment]
+		var err error
+		// The whole fragment block is needed; its decompressed length is
+		// only bounded by the block size.
+		if block, err = f.readFragmentBlock(frag); err != nil {
+			return nil, err
+		}
+		f.mu.Lock()
+		if len(f.fragCache) >= maxCachedFragments {
+			clear(f.fragCache)
+		}
+		f.fragCache[in.fragment] = block
+		f.mu.Unlock()
+	}
+
+	end := uint64(in.fragOffset) + uint64(want)
+	if end > uint64(len(block)) {
+		return nil, fmt.Errorf("%w: fragment %d is shorter than inode %d needs", ErrCorrupt, in.fragment, in.number)
+	}
+	return block[in.fragOffset:end], nil
+}
+
+func (f *FS) readFragmentBlock(frag fragment) ([]byte, error) {
+	size := frag.size &^ dataUncompressed
+	if size > f.sb.BlockSize {
+		return nil, fmt.Errorf("%w: fragment block of %d bytes", ErrCorrupt, size)
+	}
+	raw := make([]byte, size)
+	if _, err := f.r.ReadAt(raw, int64(frag.start)); err != nil {
+		return nil, fmt.Errorf("read fragment block at %d: %w", frag.start, err)
+	}
+	if frag.size&dataUncompressed != 0 {
+		return raw, nil
+	}
+	data, err := f.decompress(make([]byte, 0, f.sb.BlockSize), raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fragment block at %d: %v", ErrCorrupt, frag.start, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,136 @@
+package squashfs
+
+import (
+	"io/fs"
+	"time"
+
+	"thatnerdjosh.com/devtools/internal/treefs"
+)
+
+// Stat holds the inode details fs.FileInfo cannot express. FileInfo.Sys
+// returns a *Stat for every file of an FS.
+type Stat struct {
+	// Inode is the inode number. Entries sharing it are hard links.
+	Inode uint32
+	Nlink uint32
+	UID   uint32
+	GID   uint32
+	// Major and Minor identify the device of a device node.
+	Major, Minor uint32
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadLinkFS = (*FS)(nil)
+)
+
+// Open opens the named file, following symlinks. Symlinks resolve within the
+// image, with absolute targets relative to its root. Regular files are
+// returned as *File.
+func (f *FS) Open(name string) (fs.File, error) { return treefs.Open(f.node(f.root), name) }
+
+// Stat returns a FileInfo describing the named file, following symlinks.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return treefs.Stat(f.node(f.root), name) }
+
+// Lstat returns a FileInfo describing the named file without following a
+// final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) { return treefs.Lstat(f.node(f.root), name) }
+
+// ReadLink returns the target of the named symlink.
+func (f *FS) ReadLink(name string) (string, error) { return treefs.ReadLink(f.node(f.root), name) }
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return treefs.ReadDir(f.node(f.root), name)
+}
+
+// lookup resolves name to its inode, following intermediate symlinks and a
+// final one when follow is set.
+func (f *FS) lookup(op, name string, follow bool) (*inode, error) {
+	n, err := treefs.Lookup(op, f.node(f.root), name, follow)
+	if err != nil {
+		return nil, err
+	}
+	return n.(treeNode).in, nil
+}
+
+// treeNode serves an inode to treefs.
+type treeNode struct {
+	fs *FS
+	in *inode
+}
+
+func (f *FS) node(in *inode) treeNode { return treeNode{fs: f, in: in} }
+
+func (n treeNode) Mode() fs.FileMode            { return n.in.mode() }
+func (n treeNode) Info(name string) fs.FileInfo { return fileInfo{name: name, in: n.in} }
+func (n treeNode) Target() string               { return n.in.target }
+func (n treeNode) OpenFile(name string) fs.File { return n.fs.openFile(name, n.in) }
+
+func (n treeNode) Child(name string) (treefs.Node, error) {
+	in, err := n.fs.child(n.in, name)
+	if err != nil || in == nil {
+		return nil, err
+	}
+	return n.fs.node(in), nil
+}
+
+func (n treeNode) Entries() ([]fs.DirEntry, error) {
+	entries, err := n.fs.readDir(n.in)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		out[i] = dirEntry{fs: n.fs, e: e}
+	}
+	return out, nil
+}
+
+// fileInfo implements fs.FileInfo for an inode.
+type fileInfo struct {
+	name string
+	in   *inode
+}
+
+func (fi fileInfo) Name() string {
+	if fi.name == "." || fi.name == "/" {
+		return "."
+	}
+	return fi.name
+}
+func (fi fileInfo) Size() int64        { return fi.in.fileSize() }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.in.mode() }
+func (fi fileInfo) ModTime() time.Time { return fi.in.modTime() }
+func (fi fileInfo) IsDir() bool        { return fi.in.isDir() }
+
+// Sys returns a *Stat.
+func (fi fileInfo) Sys() any {
+	major, minor := fi.in.devNumbers()
+	st := &Stat{Inode: fi.in.number, Nlink: fi.in.nlink, UID: fi.in.uid, GID: fi.in.gid}
+	if fi.in.basicType() == typeBlockDev || fi.in.basicType() == typeCharDev {
+		st.Major, st.Minor = major, minor
+	}
+	return st
+}
+
+// dirEntry implements fs.DirEntry, reading the inode only when Info is called.
+type dirEntry struct {
+	fs *FS
+	e  dirent
+}
+
+func (d dirEntry) Name() string { return d.e.name }
+func (d dirEntry) IsDir() bool  { return d.e.typ == typeDir }
+func (d dirEntry) Type() fs.FileMode {
+	return (&inode{typ: d.e.typ}).mode().Type()
+}
+func (d dirEntry) Info() (fs.FileInfo, error) {
+	in, err := d.fs.readInode(d.e.ref)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: d.e.name, Err: err}
+	}
+	return fileInfo{name: d.e.name, in: in}, nil
+}
+func (d dirEntry) String() string { return fs.FormatDirEntry(d) }
@@ -0,0 +1,264 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// Inode types. Extended types add fields such as a link count or an xattr
+// index to their basic counterpart.
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlockDev
+	typeCharDev
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+	typeExtSymlink
+	typeExtBlockDev
+	typeExtCharDev
+	typeExtFifo
+	typeExtSocket
+)
+
+// inode is a decoded inode of any type.
+type inode struct {
+	typ    uint16
+	perm   uint16
+	uid    uint32
+	gid    uint32
+	mtime  uint32
+	number uint32
+	nlink  uint32
+	size   uint64
+	xattr  uint32
+
+	// Directories.
+	dirBlock  uint32
+	dirOffset uint16
+	parent    uint32
+
+	// Regular files.
+	blocksStart uint64
+	fragment    uint32
+	fragOffset  uint32
+	blockSizes  []uint32
+
+	target string
+	rdev   uint32
+}
+
+// readInode decodes the inode referenced by ref: the offset of its metadata
+// block within the inode table in the upper bits and its offset inside the
+// decompressed block in the lower 16.
+func (f *FS) readInode(ref uint64) (*inode, error) {
+	m, err := f.newMetaReader(f.sb.InodeTable+ref>>16, int(ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	header, err := m.read(16)
+	if err != nil {
+		return nil, err
+	}
+	in := &inode{
+		typ:    binary.LittleEndian.Uint16(header),
+		perm:   binary.LittleEndian.Uint16(header[2:]),
+		mtime:  binary.LittleEndian.Uint32(header[8:]),
+		number: binary.LittleEndian.Uint32(header[12:]),
+		nlink:  1,
+		xattr:  noXattr,
+	}
+	if in.uid, err = f.id(binary.LittleEndian.Uint16(header[4:])); err != nil {
+		return nil, err
+	}
+	if in.gid, err = f.id(binary.LittleEndian.Uint16(header[6:])); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	switch in.typ {
+	case typeDir:
+		b, err := m.read(16)
+		if err != nil {
+			return nil, err
+		}
+		in.dirBlock = le.Uint32(b)
+		in.nlink = le.Uint32(b[4:])
+		in.size = uint64(le.Uint16(b[8:]))
+		in.dirOffset = le.Uint16(b[10:])
+		in.parent = le.Uint32(b[12:])
+	case typeExtDir:
+		b, err := m.read(24)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(b)
+		in.size = uint64(le.Uint32(b[4:]))
+		in.dirBlock = le.Uint32(b[8:])
+		in.parent = le.Uint32(b[12:])
+		// The directory index that follows (b[16:18] entries) only speeds up
+		// lookups in large directories, so it is not read.
+		in.dirOffset = le.Uint16(b[18:])
+		in.xattr = le.Uint32(b[20:])
+	case typeFile:
+		b, err := m.read(16)
+		if err != nil {
+			return nil, err
+		}
+		in.blocksStart = uint64(le.Uint32(b))
+		in.fragment = le.Uint32(b[4:])
+		in.fragOffset = le.Uint32(b[8:])
+		in.size = uint64(le.Uint32(b[12:]))
+		if err := f.readBlockSizes(m, in); err != nil {
+			return nil, err
+		}
+	case typeExtFile:
+		b, err := m.read(40)
+		if err != nil {
+			return nil, err
+		}
+		in.blocksStart = le.Uint64(b)
+		in.size = le.Uint64(b[8:])
+		// b[16:24] counts the sparse bytes saved, which readers do not need.
+		in.nlink = le.Uint32(b[24:])
+		in.fragment = le.Uint32(b[28:])
+		in.fragOffset = le.Uint32(b[32:])
+		in.xattr = le.Uint32(b[36:])
+		if err := f.readBlockSizes(m, in); err != nil {
+			return nil, err
+		}
+	case typeSymlink, typeExtSymlink:
+		b, err := m.read(8)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(b)
+		n := le.Uint32(b[4:])
+		if n > 4096 {
+			return nil, fmt.Errorf("%w: symlink target of %d bytes", ErrCorrupt, n)
+		}
+		target, err := m.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		in.target = string(target)
+		in.size = uint64(n)
+		if in.typ == typeExtSymlink {
+			if in.xattr, err = m.u32(); err != nil {
+				return nil, err
+			}
+		}
+	case typeBlockDev, typeCharDev, typeExtBlockDev, typeExtCharDev:
+		b, err := m.read(8)
+		if err != nil {
+			return nil, err
+		}
+		in.nlink = le.Uint32(b)
+		in.rdev = le.Uint32(b[4:])
+		if in.typ >= typeExtDir {
+			if in.xattr, err = m.u32(); err != nil {
+				return nil, err
+			}
+		}
+	case typeFifo, typeSocket, typeExtFifo, typeExtSocket:
+		if in.nlink, err = m.u32(); err != nil {
+			return nil, err
+		}
+		if in.typ >= typeExtDir {
+			if in.xattr, err = m.u32(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown inode type %d", ErrCorrupt, in.typ)
+	}
+	return in, nil
+}
+
+// readBlockSizes reads the size word of every data block of a file. The tail
+// of the file is a block of its own unless it lives in a fragment.
+func (f *FS) readBlockSizes(m *metaReader, in *inode) error {
+	blocks := in.size / uint64(f.sb.BlockSize)
+	if in.fragment == noFragment && in.size%uint64(f.sb.BlockSize) != 0 {
+		blocks++
+	}
+	if blocks > 1<<32 {
+		return fmt.Errorf("%w: file of %d blocks", ErrCorrupt, blocks)
+	}
+	b, err := m.read(4 * int(blocks))
+	if err != nil {
+		return err
+	}
+	in.blockSizes = make([]uint32, blocks)
+	for i := range in.blockSizes {
+		in.blockSizes[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return nil
+}
+
+// basicType folds extended inode types onto the basic ones.
+func (in *inode) basicType() uint16 {
+	if in.typ >= typeExtDir {
+		return in.typ - 7
+	}
+	return in.typ
+}
+
+func (in *inode) isDir() bool {
+	return in.basicType() == typeDir
+}
+
+// mode returns the inode's permissions and type as an fs.FileMode.
+func (in *inode) mode() fs.FileMode {
+	mode := fs.FileMode(in.perm & 0o777)
+	if in.perm&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if in.perm&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if in.perm&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch in.basicType() {
+	case typeDir:
+		mode |= fs.ModeDir
+	case typeSymlink:
+		mode |= fs.ModeSymlink
+	case typeBlockDev:
+		mode |= fs.ModeDevice
+	case typeCharDev:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case typeFifo:
+		mode |= fs.ModeNamedPipe
+	case typeSocket:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+func (in *inode) modTime() time.Time {
+	return time.Unix(int64(in.mtime), 0)
+}
+
+// fileSize is the size reported by Stat: the listing size for directories,
+// which squashfs stores with 3 extra bytes for "." and "..".
+func (in *inode) fileSize() int64 {
+	if in.isDir() {
+		if in.size < 3 {
+			return 0
+		}
+		return int64(in.size - 3)
+	}
+	return int64(in.size)
+}
+
+// devNumbers decodes rdev the way Linux's new_decode_dev does.
+func (in *inode) devNumbers() (major, minor uint32) {
+	return (in.rdev & 0xFFF00) >> 8, in.rdev&0xFF | (in.rdev>>12)&0xFFF00
+}
@@ -0,0 +1,109 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxCachedBlocks bounds the metadata block cache. Inode and directory
+// lookups revisit the same few blocks, so a small cache avoids most
+// decompression while keeping memory flat for large images.
+const maxCachedBlocks = 1024
+
+// metaBlock is a decompressed metadata block and the position of the block
+// following it.
+type metaBlock struct {
+	data []byte
+	next uint64
+}
+
+// metadataBlock returns the decompressed metadata block stored at pos.
+func (f *FS) metadataBlock(pos uint64) (metaBlock, error) {
+	f.mu.Lock()
+	block, ok := f.meta[pos]
+	f.mu.Unlock()
+	if ok {
+		return block, nil
+	}
+
+	header := make([]byte, 2)
+	if _, err := f.r.ReadAt(header, int64(pos)); err != nil {
+		return metaBlock{}, fmt.Errorf("read metadata block at %d: %w", pos, err)
+	}
+	word := binary.LittleEndian.Uint16(header)
+	size := int(word &^ metadataUncompressed)
+	if size == 0 || size > metadataSize {
+		return metaBlock{}, fmt.Errorf("%w: metadata block at %d has size %d", ErrCorrupt, pos, size)
+	}
+	raw := make([]byte, size)
+	if _, err := f.r.ReadAt(raw, int64(pos)+2); err != nil {
+		return metaBlock{}, fmt.Errorf("read metadata block at %d: %w", pos, err)
+	}
+	data := raw
+	if word&metadataUncompressed == 0 {
+		var err error
+		if data, err = f.decompress(make([]byte, 0, metadataSize), raw); err != nil {
+			return metaBlock{}, fmt.Errorf("%w: metadata block at %d: %v", ErrCorrupt, pos, err)
+		}
+	}
+	block = metaBlock{data: data, next: pos + 2 + uint64(size)}
+
+	f.mu.Lock()
+	if len(f.meta) >= maxCachedBlocks {
+		clear(f.meta)
+	}
+	f.meta[pos] = block
+	f.mu.Unlock()
+	return block, nil
+}
+
+// metaReader reads a byte stream that continues across metadata blocks.
+type metaReader struct {
+	f     *FS
+	block metaBlock
+	off   int
+}
+
+// newMetaReader positions a reader at offset bytes into the metadata block
+// stored at pos.
+func (f *FS) newMetaReader(pos uint64, offset int) (*metaReader, error) {
+	block, err := f.metadataBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(block.data) {
+		return nil, fmt.Errorf("%w: offset %d past metadata block at %d", ErrCorrupt, offset, pos)
+	}
+	return &metaReader{f: f, block: block, off: offset}, nil
+}
+
+// read returns the next n bytes.
+func (m *metaReader) read(n int) ([]byte, error) {
+	if m.off+n <= len(m.block.data) {
+		b := m.block.data[m.off : m.off+n]
+		m.off += n
+		return b, nil
+	}
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if m.off == len(m.block.data) {
+			next, err := m.f.metadataBlock(m.block.next)
+			if err != nil {
+				return nil, err
+			}
+			m.block, m.off = next, 0
+		}
+		take := min(n-len(out), len(m.block.data)-m.off)
+		out = append(out, m.block.data[m.off:m.off+take]...)
+		m.off += take
+	}
+	return out, nil
+}
+
+func (m *metaReader) u32() (uint32, error) {
+	b, err := m.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
@@ -0,0 +1,320 @@
+// Package squashfs reads squashfs 4.0 images, the format live ISOs use for
+// their root filesystem, without mounting them.
+//
+// An FS implements io/fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS.
+// FileInfo.Sys returns a *Stat carrying inode numbers, owners and device
+// numbers, and FS.Xattrs lists extended attributes. Images compressed with
+// gzip, xz, lz4 and zstd are supported; lzo and legacy lzma are not.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	magic          = 0x73717368
+	superSize      = 96
+	metadataSize   = 8192
+	invalidTable   = ^uint64(0)
+	noFragment     = ^uint32(0)
+	noXattr        = ^uint32(0)
+	idsPerBlock    = metadataSize / 4
+	fragsPerBlock  = metadataSize / 16
+	xattrsPerBlock = metadataSize / 16
+
+	metadataUncompressed = 0x8000
+	dataUncompressed     = 1 << 24
+)
+
+// Compressor identifiers stored in the superblock.
+const (
+	compGzip = 1
+	compLZMA = 2
+	compLZO  = 3
+	compXz   = 4
+	compLZ4  = 5
+	compZstd = 6
+)
+
+var compressorNames = map[uint16]string{
+	compGzip: "gzip",
+	compLZMA: "lzma",
+	compLZO:  "lzo",
+	compXz:   "xz",
+	compLZ4:  "lz4",
+	compZstd: "zstd",
+}
+
+var (
+	// ErrNotSquashfs is returned by Open when the image has no squashfs 4.0 superblock.
+	ErrNotSquashfs = errors.New("not a squashfs 4.0 image")
+	// ErrUnsupportedCompression is returned by Open for images compressed with
+	// an algorithm this package cannot decompress.
+	ErrUnsupportedCompression = errors.New("unsupported squashfs compression")
+	// ErrCorrupt reports an image whose structures are inconsistent.
+	ErrCorrupt = errors.New("corrupt squashfs image")
+)
+
+// superblock is the fixed header at the start of an image.
+type superblock struct {
+	Inodes         uint32
+	ModTime        uint32
+	BlockSize      uint32
+	Fragments      uint32
+	Compressor     uint16
+	BlockLog       uint16
+	Flags          uint16
+	IDs            uint16
+	Major, Minor   uint16
+	RootInode      uint64
+	BytesUsed      uint64
+	IDTable        uint64
+	XattrTable     uint64
+	InodeTable     uint64
+	DirectoryTable uint64
+	FragmentTable  uint64
+	ExportTable    uint64
+}
+
+// FS is an open squashfs image. It is safe for concurrent use.
+type FS struct {
+	r          io.ReaderAt
+	sb         superblock
+	decompress func(dst, src []byte) ([]byte, error)
+	ids        []uint32
+	fragments  []fragment
+	xattrStart uint64
+	xattrIDs   []xattrID
+	root       *inode
+
+	mu        sync.Mutex
+	meta      map[uint64]metaBlock
+	listings  map[uint64][]dirent
+	fragCache map[uint32][]byte
+}
+
+type fragment struct {
+	start uint64
+	size  uint32
+}
+
+// Open reads the superblock and lookup tables of the image in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	buf := make([]byte, superSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotSquashfs
+		}
+		return nil, fmt.Errorf("read squashfs superblock: %w", err)
+	}
+	if binary.LittleEndian.Uint32(buf) != magic {
+		return nil, ErrNotSquashfs
+	}
+	var sb superblock
+	if err := binary.Read(bytes.NewReader(buf[4:]), binary.LittleEndian, &sb); err != nil {
+		return nil, fmt.Errorf("read squashfs superblock: %w", err)
+	}
+	if sb.Major != 4 || sb.Minor != 0 {
+		return nil, fmt.Errorf("%w: version %d.%d", ErrNotSquashfs, sb.Major, sb.Minor)
+	}
+	if sb.BlockSize < 4096 || sb.BlockSize > 1<<20 || sb.BlockSize != 1<<sb.BlockLog {
+		return nil, fmt.Errorf("%w: block size %d", ErrCorrupt, sb.BlockSize)
+	}
+
+	f := &FS{
+		r:         r,
+		sb:        sb,
+		meta:      make(map[uint64]metaBlock),
+		listings:  make(map[uint64][]dirent),
+		fragCache: make(map[uint32][]byte),
+	}
+	var err error
+	if f.decompress, err = decompressor(sb.Compressor, max(sb.BlockSize, metadataSize)); err != nil {
+		return nil, err
+	}
+	if err := f.readIDs(); err != nil {
+		return nil, err
+	}
+	if err := f.readFragments(); err != nil {
+		return nil, err
+	}
+	if err := f.readXattrIDs(); err != nil {
+		return nil, err
+	}
+	if f.root, err = f.readInode(sb.RootInode); err != nil {
+		return nil, fmt.Errorf("read root inode: %w", err)
+	}
+	if !f.root.isDir() {
+		return nil, fmt.Errorf("%w: root inode is not a directory", ErrCorrupt)
+	}
+	return f, nil
+}
+
+// Compression returns the name of the image's compression algorithm.
+func (f *FS) Compression() string {
+	return compressorNames[f.sb.Compressor]
+}
+
+// BlockSize returns the size of the image's data blocks.
+func (f *FS) BlockSize() int {
+	return int(f.sb.BlockSize)
+}
+
+// ModTime returns the time the image was created.
+func (f *FS) ModTime() time.Time {
+	return time.Unix(int64(f.sb.ModTime), 0)
+}
+
+// Size returns the number of bytes the image occupies.
+func (f *FS) Size() int64 {
+	return int64(f.sb.BytesUsed)
+}
+
+// decompressor returns the function decompressing blocks compressed with
+// algorithm id. Callers size dst's capacity to the most a block may hold, and
+// a block decompressing to more is reported as corrupt rather than allowed to
+// grow without bound; limit is the largest such capacity.
+func decompressor(id uint16, limit uint32) (func(dst, src []byte) ([]byte, error), error) {
+	switch id {
+	case compGzip:
+		return func(dst, src []byte) ([]byte, error) {
+			zr, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return readLimited(dst, zr)
+		}, nil
+	case compXz:
+		return func(dst, src []byte) ([]byte, error) {
+			xr, err := xz.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readLimited(dst, xr)
+		}, nil
+	case compLZ4:
+		// Blocks are raw LZ4 blocks, so the output buffer must already be as
+		// large as the biggest block the image can hold.
+		return func(dst, src []byte) ([]byte, error) {
+			n, err := lz4.UncompressBlock(src, dst[:cap(dst)])
+			if err != nil {
+				return nil, err
+			}
+			return dst[:n], nil
+		}, nil
+	case compZstd:
+		dec, err := zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(uint64(limit)),
+			zstd.WithDecoderMaxWindow(uint64(limit)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return func(dst, src []byte) ([]byte, error) {
+			out, err := dec.DecodeAll(src, dst[:0])
+			if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+				return nil, errOverflow(cap(dst))
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(out) > cap(dst) {
+				return nil, errOverflow(cap(dst))
+			}
+			return out, nil
+		}, nil
+	}
+	if name, ok := compressorNames[id]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, name)
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrUnsupportedCompression, id)
+}
+
+// readLimited reads r into dst, failing once it holds more than dst's
+// capacity.
+func readLimited(dst []byte, r io.Reader) ([]byte, error) {
+	out := bytes.NewBuffer(dst[:0])
+	n, err := io.Copy(out, io.LimitReader(r, int64(cap(dst))+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(cap(dst)) {
+		return nil, errOverflow(cap(dst))
+	}
+	return out.Bytes(), nil
+}
+
+func errOverflow(size int) error {
+	return fmt.Errorf("%w: block decompresses to more than %d bytes", ErrCorrupt, size)
+}
+
+// readIDs loads the table mapping inode owner indexes to uids and gids.
+func (f *FS) readIDs() error {
+	data, err := f.readLookupTable(f.sb.IDTable, int(f.sb.IDs), 4, idsPerBlock)
+	if err != nil {
+		return fmt.Errorf("read id table: %w", err)
+	}
+	f.ids = make([]uint32, f.sb.IDs)
+	for i := range f.ids {
+		f.ids[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return nil
+}
+
+func (f *FS) readFragments() error {
+	if f.sb.Fragments == 0 || f.sb.FragmentTable == invalidTable {
+		return nil
+	}
+	data, err := f.readLookupTable(f.sb.FragmentTable, int(f.sb.Fragments), 16, fragsPerBlock)
+	if err != nil {
+		return fmt.Errorf("read fragment table: %w", err)
+	}
+	f.fragments = make([]fragment, f.sb.Fragments)
+	for i := range f.fragments {
+		e := data[16*i:]
+		f.fragments[i] = fragment{start: binary.LittleEndian.Uint64(e), size: binary.LittleEndian.Uint32(e[8:])}
+	}
+	return nil
+}
+
+// readLookupTable reads count fixed-size entries stored in metadata blocks
+// whose absolute positions are listed at indexStart.
+func (f *FS) readLookupTable(indexStart uint64, count, entrySize, perBlock int) ([]byte, error) {
+	blocks := (count + perBlock - 1) / perBlock
+	index := make([]byte, 8*blocks)
+	if _, err := f.r.ReadAt(index, int64(indexStart)); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, count*entrySize)
+	for i := 0; i < blocks; i++ {
+		block, err := f.metadataBlock(binary.LittleEndian.Uint64(index[8*i:]))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block.data...)
+	}
+	if len(out) < count*entrySize {
+		return nil, fmt.Errorf("%w: lookup table holds %d bytes, want %d", ErrCorrupt, len(out), count*entrySize)
+	}
+	return out, nil
+}
+
+func (f *FS) id(index uint16) (uint32, error) {
+	if int(index) >= len(f.ids) {
+		return 0, fmt.Errorf("%w: id index %d out of range", ErrCorrupt, index)
+	}
+	return f.ids[index], nil
+}
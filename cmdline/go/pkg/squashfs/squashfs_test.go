@@ -0,0 +1,318 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+	"thatnerdjosh.com/devtools/internal/treefs"
+)
+
+// rootfs is a small live root filesystem exercising every inode type.
+func rootfs() []isotest.File {
+	files := []isotest.File{
+		isotest.Text("etc/os-release", "NAME=\"Ubuntu\"\nVERSION_ID=\"24.04\"\n"),
+		isotest.Text("etc/hostname", "ubuntu\n"),
+		{Path: "usr/bin/busybox", Data: bytes.Repeat([]byte("\x7fELF busybox "), 3000), Mode: 0o755},
+		isotest.HardLink("usr/bin/sh", "usr/bin/busybox"),
+		isotest.Symlink("bin", "usr/bin"),
+		isotest.Symlink("lib64/ld-linux-x86-64.so.2", "../usr/lib/ld.so"),
+		isotest.Text("usr/lib/ld.so", "loader"),
+		{Path: "usr/bin/ping", Data: []byte("ping"), Mode: 0o755 | fs.ModeSetuid,
+			Xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02 cap_net_raw"}},
+		{Path: "dev/null", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Major: 1, Minor: 3},
+		{Path: "dev/sda1", Mode: fs.ModeDevice | 0o660, Major: 8, Minor: 1, GID: 6},
+		{Path: "run/initctl", Mode: fs.ModeNamedPipe | 0o600},
+		{Path: "tmp", Mode: fs.ModeDir | fs.ModeSticky | 0o777},
+		{Path: "home/ubuntu/.profile", Data: []byte("# profile\n"), UID: 1000, GID: 1000,
+			Xattrs: map[string]string{"user.origin": "skel", "trusted.overlay.opaque": "y"}},
+	}
+	for i := 0; i < 200; i++ {
+		files = append(files, isotest.Text(fmt.Sprintf("usr/share/doc/pkg%03d/copyright", i), strings.Repeat("license text ", i)))
+	}
+	return files
+}
+
+func openImage(t *testing.T, image isotest.Squashfs) *FS {
+	t.Helper()
+	data, err := image.Bytes()
+	if err != nil {
+		t.Fatalf("generate squashfs: %v", err)
+	}
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	return fsys
+}
+
+func TestOpenCompressions(t *testing.T) {
+	files := rootfs()
+	for _, tt := range []struct {
+		compression isotest.Compression
+		name        string
+	}{
+		{isotest.Gzip, "gzip"},
+		{isotest.Uncompressed, "gzip"},
+		{isotest.Xz, "xz"},
+		{isotest.LZ4, "lz4"},
+		{isotest.Zstd, "zstd"},
+	} {
+		for _, fragments := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/fragments=%t", tt.name, fragments), func(t *testing.T) {
+				fsys := openImage(t, isotest.Squashfs{Files: files, Compression: tt.compression, BlockSize: 8192, Fragments: fragments})
+				if got := fsys.Compression(); got != tt.name {
+					t.Fatalf("Compression() = %q, want %q", got, tt.name)
+				}
+				for _, f := range files {
+					if f.Mode.Type() != 0 || f.Link != "" {
+						continue
+					}
+					got, err := fs.ReadFile(fsys, f.Path)
+					if err != nil {
+						t.Fatalf("ReadFile(%s) error = %v", f.Path, err)
+					}
+					if !bytes.Equal(got, f.Data) {
+						t.Fatalf("ReadFile(%s) returned %d bytes that differ from the %d written", f.Path, len(got), len(f.Data))
+					}
+				}
+				if err := fstest.TestFS(fsys, "etc/os-release", "usr/bin/busybox", "usr/bin/sh", "home/ubuntu/.profile", "usr/share/doc/pkg199/copyright"); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	fsys := openImage(t, isotest.Squashfs{Files: append(rootfs(), isotest.Symlink("etc/mtab", "/proc/self/mounts"))})
+
+	if target, err := fsys.ReadLink("bin"); err != nil || target != "usr/bin" {
+		t.Fatalf("ReadLink(bin) = %q, %v", target, err)
+	}
+	if info, err := fsys.Lstat("bin"); err != nil || info.Mode().Type() != fs.ModeSymlink {
+		t.Fatalf("Lstat(bin) = %v, %v; want a symlink", info, err)
+	}
+	if info, err := fsys.Stat("bin"); err != nil || !info.IsDir() {
+		t.Fatalf("Stat(bin) = %v, %v; want the usr/bin directory", info, err)
+	}
+	// Relative targets resolve from the link's directory.
+	if data, err := fs.ReadFile(fsys, "lib64/ld-linux-x86-64.so.2"); err != nil || string(data) != "loader" {
+		t.Fatalf("ReadFile through relative symlink = %q, %v", data, err)
+	}
+	if _, err := fs.ReadFile(fsys, "bin/busybox"); err != nil {
+		t.Fatalf("ReadFile through directory symlink error = %v", err)
+	}
+	// Absolute targets resolve from the image root, never the host's.
+	if _, err := fsys.Stat("etc/mtab"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat(etc/mtab) error = %v, want not exist inside the image", err)
+	}
+	if _, err := fsys.ReadLink("etc/hostname"); err == nil {
+		t.Fatal("ReadLink of a regular file succeeded")
+	}
+
+	loops := openImage(t, isotest.Squashfs{Files: []isotest.File{isotest.Symlink("a", "b"), isotest.Symlink("b", "a")}})
+	if _, err := loops.Stat("a"); !errors.Is(err, treefs.ErrTooManyLinks) {
+		t.Fatalf("Stat of a symlink loop error = %v", err)
+	}
+}
+
+func TestInodeDetails(t *testing.T) {
+	fsys := openImage(t, isotest.Squashfs{Files: rootfs(), Fragments: true})
+	stat := func(name string) (fs.FileInfo, *Stat) {
+		t.Helper()
+		info, err := fsys.Lstat(name)
+		if err != nil {
+			t.Fatalf("Lstat(%s) error = %v", name, err)
+		}
+		return info, info.Sys().(*Stat)
+	}
+
+	_, busybox := stat("usr/bin/busybox")
+	_, sh := stat("usr/bin/sh")
+	if busybox.Inode != sh.Inode || busybox.Nlink != 2 {
+		t.Fatalf("busybox inode %d nlink %d, sh inode %d; want shared inode with 2 links", busybox.Inode, busybox.Nlink, sh.Inode)
+	}
+
+	info, null := stat("dev/null")
+	if info.Mode() != fs.ModeDevice|fs.ModeCharDevice|0o666 || null.Major != 1 || null.Minor != 3 {
+		t.Fatalf("dev/null mode %v device %d:%d", info.Mode(), null.Major, null.Minor)
+	}
+	info, sda := stat("dev/sda1")
+	if info.Mode() != fs.ModeDevice|0o660 || sda.Major != 8 || sda.Minor != 1 || sda.GID != 6 {
+		t.Fatalf("dev/sda1 mode %v device %d:%d gid %d", info.Mode(), sda.Major, sda.Minor, sda.GID)
+	}
+	if info, _ := stat("run/initctl"); info.Mode().Type() != fs.ModeNamedPipe {
+		t.Fatalf("run/initctl mode %v", info.Mode())
+	}
+	if info, _ := stat("tmp"); info.Mode() != fs.ModeDir|fs.ModeSticky|0o777 {
+		t.Fatalf("tmp mode %v", info.Mode())
+	}
+	if info, _ := stat("usr/bin/ping"); info.Mode() != fs.ModeSetuid|0o755 {
+		t.Fatalf("usr/bin/ping mode %v", info.Mode())
+	}
+	if _, profile := stat("home/ubuntu/.profile"); profile.UID != 1000 || profile.GID != 1000 {
+		t.Fatalf(".profile owner %d:%d", profile.UID, profile.GID)
+	}
+
+	attrs, err := fsys.Xattrs("home/ubuntu/.profile")
+	if err != nil {
+		t.Fatalf("Xattrs() error = %v", err)
+	}
+	want := []Xattr{{"trusted.overlay.opaque", []byte("y")}, {"user.origin", []byte("skel")}}
+	if fmt.Sprint(attrs) != fmt.Sprint(want) {
+		t.Fatalf("Xattrs(.profile) = %q, want %q", attrs, want)
+	}
+	if attrs, err := fsys.Xattrs("usr/bin/ping"); err != nil || len(attrs) != 1 || attrs[0].Name != "security.capability" {
+		t.Fatalf("Xattrs(ping) = %q, %v", attrs, err)
+	}
+	if attrs, err := fsys.Xattrs("etc/hostname"); err != nil || len(attrs) != 0 {
+		t.Fatalf("Xattrs(hostname) = %q, %v; want none", attrs, err)
+	}
+}
+
+func TestFileReadAtAndSeek(t *testing.T) {
+	data := make([]byte, 3*4096+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	fsys := openImage(t, isotest.Squashfs{Files: []isotest.File{{Path: "blob", Data: data}}, BlockSize: 4096, Fragments: true})
+	f, err := fsys.Open("blob")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	file := f.(*File)
+
+	buf := make([]byte, 200)
+	if n, err := file.ReadAt(buf, 4000); n != 200 || err != nil || !bytes.Equal(buf, data[4000:4200]) {
+		t.Fatalf("ReadAt across a block boundary = %d, %v", n, err)
+	}
+	if n, err := file.ReadAt(buf, int64(len(data))-50); n != 50 || err != io.EOF || !bytes.Equal(buf[:50], data[len(data)-50:]) {
+		t.Fatalf("ReadAt into the fragment tail = %d, %v", n, err)
+	}
+	if _, err := file.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	rest, err := io.ReadAll(file)
+	if err != nil || !bytes.Equal(rest, data[len(data)-100:]) {
+		t.Fatalf("ReadAll after Seek = %d bytes, %v", len(rest), err)
+	}
+}
+
+func TestOpenRejectsBadImages(t *testing.T) {
+	if _, err := Open(bytes.NewReader(nil)); !errors.Is(err, ErrNotSquashfs) {
+		t.Fatalf("Open(empty) error = %v, want ErrNotSquashfs", err)
+	}
+	if _, err := Open(bytes.NewReader(make([]byte, 4096))); !errors.Is(err, ErrNotSquashfs) {
+		t.Fatalf("Open(zeros) error = %v, want ErrNotSquashfs", err)
+	}
+
+	data, err := isotest.Squashfs{Files: rootfs()}.Bytes()
+	if err != nil {
+		t.Fatalf("generate squashfs: %v", err)
+	}
+	lzo := bytes.Clone(data)
+	binary.LittleEndian.PutUint16(lzo[20:], compLZO)
+	if _, err := Open(bytes.NewReader(lzo)); !errors.Is(err, ErrUnsupportedCompression) || !strings.Contains(err.Error(), "lzo") {
+		t.Fatalf("Open(lzo) error = %v, want ErrUnsupportedCompression naming lzo", err)
+	}
+
+	// Overwrite the metadata block holding the root inode.
+	corrupt := bytes.Clone(data)
+	rootBlock := binary.LittleEndian.Uint64(data[64:]) + binary.LittleEndian.Uint64(data[32:])>>16
+	copy(corrupt[rootBlock:], bytes.Repeat([]byte{0xFF}, 64))
+	if _, err := Open(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("Open() of a corrupt inode table succeeded")
+	}
+}
+
+// TestOpenMksquashfsImage reads testdata/dir_read.sqs, made by mksquashfs
+// rather than isotest; see testdata/README.md.
+func TestOpenMksquashfsImage(t *testing.T) {
+	file, err := os.Open("testdata/dir_read.sqs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fsys, err := Open(file)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if fsys.Compression() != "zstd" || fsys.BlockSize() != 4096 {
+		t.Fatalf("compression %s, block size %d, want zstd and 4096", fsys.Compression(), fsys.BlockSize())
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 300 || entries[0].Name() != "file_001" || entries[299].Name() != "file_300" {
+		t.Fatalf("ReadDir() = %d entries, want file_001 to file_300", len(entries))
+	}
+	xattrs, err := fsys.Xattrs("file_150")
+	if err != nil {
+		t.Fatalf("Xattrs() error = %v", err)
+	}
+	if len(xattrs) != 1 || xattrs[0].Name != "user.test" || string(xattrs[0].Value) != "150" {
+		t.Fatalf("Xattrs(file_150) = %+v, want user.test=150", xattrs)
+	}
+}
+
+func TestDecompressorRejectsOversizeBlocks(t *testing.T) {
+	const limit = 8192
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress := func(data []byte) map[uint16][]byte {
+		var gz, x bytes.Buffer
+		zw := zlib.NewWriter(&gz)
+		zw.Write(data)
+		zw.Close()
+		xw, err := xz.NewWriter(&x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xw.Write(data)
+		xw.Close()
+		return map[uint16][]byte{
+			compGzip: gz.Bytes(),
+			compXz:   x.Bytes(),
+			compZstd: enc.EncodeAll(data, nil),
+		}
+	}
+
+	fits := compress(bytes.Repeat([]byte{'a'}, limit))
+	bomb := compress(make([]byte, 64*limit))
+	for id, name := range compressorNames {
+		if fits[id] == nil {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			decompress, err := decompressor(id, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err := decompress(make([]byte, 0, limit), fits[id]); err != nil || len(out) != limit {
+				t.Fatalf("decompress(full block) = %d bytes, %v", len(out), err)
+			}
+			if _, err := decompress(make([]byte, 0, limit), bomb[id]); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("decompress(oversize block) error = %v, want ErrCorrupt", err)
+			}
+			if _, err := decompress(make([]byte, 0, limit/2), fits[id]); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("decompress(block past dst) error = %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
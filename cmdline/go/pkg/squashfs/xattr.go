@@ -0,0 +1,129 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+)
+
+// xattrOutOfLine marks an xattr whose value is stored elsewhere in the table,
+// shared between inodes.
+const xattrOutOfLine = 0x100
+
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// Xattr is one extended attribute of a file.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// xattrID locates the attributes of one inode in the key/value table.
+type xattrID struct {
+	ref   uint64
+	count uint32
+}
+
+func (f *FS) readXattrIDs() error {
+	if f.sb.XattrTable == invalidTable {
+		return nil
+	}
+	header := make([]byte, 16)
+	if _, err := f.r.ReadAt(header, int64(f.sb.XattrTable)); err != nil {
+		return fmt.Errorf("read xattr table: %w", err)
+	}
+	f.xattrStart = binary.LittleEndian.Uint64(header)
+	count := binary.LittleEndian.Uint32(header[8:])
+	if count == 0 {
+		return nil
+	}
+	data, err := f.readLookupTable(f.sb.XattrTable+16, int(count), 16, xattrsPerBlock)
+	if err != nil {
+		return fmt.Errorf("read xattr table: %w", err)
+	}
+	f.xattrIDs = make([]xattrID, count)
+	for i := range f.xattrIDs {
+		e := data[16*i:]
+		f.xattrIDs[i] = xattrID{ref: binary.LittleEndian.Uint64(e), count: binary.LittleEndian.Uint32(e[8:])}
+	}
+	return nil
+}
+
+// Xattrs returns the extended attributes of the named file, without
+// following a final symlink.
+func (f *FS) Xattrs(name string) ([]Xattr, error) {
+	in, err := f.lookup("getxattr", name, false)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := f.xattrs(in)
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+	return attrs, nil
+}
+
+func (f *FS) xattrs(in *inode) ([]Xattr, error) {
+	if in.xattr == noXattr {
+		return nil, nil
+	}
+	if int(in.xattr) >= len(f.xattrIDs) {
+		return nil, fmt.Errorf("%w: xattr index %d out of range", ErrCorrupt, in.xattr)
+	}
+	id := f.xattrIDs[in.xattr]
+	m, err := f.newMetaReader(f.xattrStart+id.ref>>16, int(id.ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]Xattr, 0, id.count)
+	for i := uint32(0); i < id.count; i++ {
+		b, err := m.read(4)
+		if err != nil {
+			return nil, err
+		}
+		typ := binary.LittleEndian.Uint16(b)
+		name, err := m.read(int(binary.LittleEndian.Uint16(b[2:])))
+		if err != nil {
+			return nil, err
+		}
+		prefix := int(typ &^ xattrOutOfLine)
+		if prefix >= len(xattrPrefixes) {
+			return nil, fmt.Errorf("%w: xattr type %d", ErrCorrupt, typ)
+		}
+
+		value, err := readXattrValue(m)
+		if err != nil {
+			return nil, err
+		}
+		if typ&xattrOutOfLine != 0 {
+			if len(value) != 8 {
+				return nil, fmt.Errorf("%w: out-of-line xattr reference of %d bytes", ErrCorrupt, len(value))
+			}
+			ref := binary.LittleEndian.Uint64(value)
+			vm, err := f.newMetaReader(f.xattrStart+ref>>16, int(ref&0xFFFF))
+			if err != nil {
+				return nil, err
+			}
+			if value, err = readXattrValue(vm); err != nil {
+				return nil, err
+			}
+		}
+		attrs = append(attrs, Xattr{
+			Name:  xattrPrefixes[prefix] + string(name),
+			Value: append([]byte(nil), value...),
+		})
+	}
+	return attrs, nil
+}
+
+func readXattrValue(m *metaReader) ([]byte, error) {
+	size, err := m.u32()
+	if err != nil {
+		return nil, err
+	}
+	if size > 64<<10 {
+		return nil, fmt.Errorf("%w: xattr value of %d bytes", ErrCorrupt, size)
+	}
+	return m.read(int(size))
+}
@@ -0,0 +1,161 @@
+package tftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetOptions configures Get.
+type GetOptions struct {
+	// Mode is ModeOctet, the default, or ModeNetASCII. Netascii data is
+	// returned as received, without converting line endings back.
+	Mode string
+	// BlockSize, when set, asks for that block size.
+	BlockSize int
+	// Size asks the server for the size of the file with the tsize option.
+	Size bool
+	// Timeout and Retries override DefaultTimeout and DefaultRetries.
+	Timeout time.Duration
+	Retries int
+}
+
+// Response is a file fetched by Get.
+type Response struct {
+	Data []byte
+	// Options are those the server acknowledged, empty when it ignored the
+	// option extension.
+	Options map[string]string
+}
+
+// Get fetches the file name from the TFTP server at addr, a host:port. A
+// server refusing the request is reported as an *Error.
+func Get(ctx context.Context, addr, name string, opts GetOptions) (Response, error) {
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return Response{}, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	mode := opts.Mode
+	if mode == "" {
+		mode = ModeOctet
+	}
+	var options [][2]string
+	if opts.BlockSize != 0 {
+		options = append(options, [2]string{OptionBlockSize, strconv.Itoa(opts.BlockSize)})
+	}
+	if opts.Size {
+		options = append(options, [2]string{OptionSize, "0"})
+	}
+	t := &transfer{conn: conn, peer: server, timeout: opts.Timeout, retries: opts.Retries}
+	if t.timeout <= 0 {
+		t.timeout = DefaultTimeout
+	}
+	if t.retries <= 0 {
+		t.retries = DefaultRetries
+	}
+
+	resp := Response{Options: map[string]string{}}
+	blksize := DefaultBlockSize
+	packet := appendRequest(nil, name, mode, options)
+	// The server answers from the port the rest of the transfer uses.
+	established := false
+	for block := uint16(1); ; {
+		p, err := t.await(packet, !established, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Response{}, ctx.Err()
+			}
+			return Response{}, err
+		}
+		established = true
+		switch binary.BigEndian.Uint16(p) {
+		case opOACK:
+			if block != 1 || len(resp.Data) != 0 {
+				continue
+			}
+			if resp.Options, err = parseOACK(p); err != nil {
+				return Response{}, err
+			}
+			if value, ok := resp.Options[OptionBlockSize]; ok {
+				n, ok := blockSize(value)
+				if !ok || opts.BlockSize == 0 || n > opts.BlockSize {
+					conn.WriteTo(appendError(nil, ErrOptionRefused, "bad block size"), t.peer)
+					return Response{}, fmt.Errorf("tftp: server chose block size %q", value)
+				}
+				blksize = n
+			}
+			packet = appendACK(nil, 0)
+		case opDATA:
+			if len(p) < 4 {
+				return Response{}, errors.New("tftp: short data packet")
+			}
+			if binary.BigEndian.Uint16(p[2:]) != block {
+				// A block sent again because its acknowledgement was lost:
+				// going round the loop acknowledges it again.
+				continue
+			}
+			resp.Data = append(resp.Data, p[4:]...)
+			packet = appendACK(nil, block)
+			if len(p)-4 < blksize {
+				conn.WriteTo(packet, t.peer)
+				return resp, nil
+			}
+			block++
+		case opERROR:
+			return Response{}, parseError(p)
+		default:
+			return Response{}, fmt.Errorf("tftp: unexpected opcode %d", binary.BigEndian.Uint16(p))
+		}
+	}
+}
+
+// await sends packet until a packet arrives from the peer, sending it again
+// whenever the timeout passes. When adopt is set, the first packet from the
+// host of server sets the peer's address, as the server picks a new port for
+// the transfer.
+func (t *transfer) await(packet []byte, adopt bool, server *net.UDPAddr) ([]byte, error) {
+	for range t.retries + 1 {
+		if _, err := t.conn.WriteTo(packet, t.peer); err != nil {
+			return nil, err
+		}
+		if !adopt {
+			p, err := t.receive(time.Now().Add(t.timeout))
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			return p, err
+		}
+		if err := t.conn.SetReadDeadline(time.Now().Add(t.timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := t.conn.ReadFrom(t.buf[:])
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if addr, ok := from.(*net.UDPAddr); ok && addr.IP.Equal(server.IP) || server.IP.IsUnspecified() {
+				if n >= 2 {
+					t.peer = from
+					return t.buf[:n], nil
+				}
+			}
+		}
+	}
+	return nil, errTimeout
+}
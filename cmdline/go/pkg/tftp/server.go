@@ -0,0 +1,308 @@
+package tftp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server answers read requests with the files of FS. Each transfer runs
+// from its own UDP port, as RFC 1350 asks, so transfers proceed
+// concurrently. A Server must not be copied after first use.
+type Server struct {
+	// FS holds the files served. Names are looked up with leading slashes
+	// removed and backslashes read as slashes, as some firmware sends them;
+	// names leaving the root are refused.
+	FS fs.FS
+	// Log, when set, receives a line for each transfer.
+	Log io.Writer
+	// Timeout and Retries override DefaultTimeout and DefaultRetries. A
+	// client's timeout option takes precedence over Timeout.
+	Timeout time.Duration
+	Retries int
+
+	logMu sync.Mutex
+}
+
+// Serve answers requests arriving on conn until ctx ends, then closes conn
+// and waits for the transfers in progress to stop.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	buf := make([]byte, maxPacket)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		req, err := parseRequest(buf[:n])
+		switch {
+		case err != nil:
+			conn.WriteTo(appendError(nil, ErrIllegalOperation, err.Error()), peer)
+			continue
+		case req.op == opWRQ:
+			conn.WriteTo(appendError(nil, ErrAccessViolation, "server is read-only"), peer)
+			s.logf(peer, "WRQ %s refused", req.name)
+			continue
+		case req.mode != ModeOctet && req.mode != ModeNetASCII:
+			conn.WriteTo(appendError(nil, ErrIllegalOperation, "unsupported mode "+req.mode), peer)
+			s.logf(peer, "RRQ %s refused: mode %s", req.name, req.mode)
+			continue
+		}
+		wg.Go(func() { s.send(ctx, conn.LocalAddr(), peer, req) })
+	}
+}
+
+// send runs the transfer req asks for, from a new port on the address
+// local.
+func (s *Server) send(ctx context.Context, local, peer net.Addr, req request) {
+	host := ""
+	if addr, ok := local.(*net.UDPAddr); ok && addr.IP != nil {
+		host = addr.IP.String()
+	}
+	conn, err := net.ListenPacket(local.Network(), net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.logf(peer, "RRQ %s failed: %v", req.name, err)
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	t := &transfer{conn: conn, peer: peer, timeout: s.Timeout, retries: s.Retries}
+	if t.timeout <= 0 {
+		t.timeout = DefaultTimeout
+	}
+	if t.retries <= 0 {
+		t.retries = DefaultRetries
+	}
+
+	f, size, err := s.open(req.name)
+	if err != nil {
+		code, msg := uint16(ErrFileNotFound), "file not found"
+		if errors.Is(err, fs.ErrPermission) {
+			code, msg = ErrAccessViolation, "access violation"
+		}
+		conn.WriteTo(appendError(nil, code, msg), peer)
+		s.logf(peer, "RRQ %s failed: %s", req.name, msg)
+		return
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if req.mode == ModeNetASCII {
+		r = &netasciiReader{r: bufio.NewReader(f)}
+	}
+
+	blksize := DefaultBlockSize
+	var acked [][2]string
+	for _, name := range req.order {
+		value := req.options[name]
+		switch name {
+		case OptionBlockSize:
+			if n, ok := blockSize(value); ok {
+				blksize = n
+				acked = append(acked, [2]string{name, strconv.Itoa(n)})
+			}
+		case OptionTimeout:
+			if d, ok := timeout(value); ok {
+				t.timeout = d
+				acked = append(acked, [2]string{name, value})
+			}
+		case OptionSize:
+			// The size of a netascii transfer is not known before it is
+			// converted, so the option goes unanswered.
+			if req.mode == ModeOctet {
+				acked = append(acked, [2]string{name, strconv.FormatInt(size, 10)})
+			}
+		}
+	}
+	if len(acked) > 0 {
+		if err := t.exchange(appendOACK(nil, acked), 0); err != nil {
+			s.logf(peer, "RRQ %s failed: %v", req.name, err)
+			return
+		}
+	}
+
+	var sent int64
+	data := make([]byte, blksize)
+	packet := make([]byte, 0, 4+blksize)
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(r, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			conn.WriteTo(appendError(nil, ErrUndefined, "read error"), peer)
+			s.logf(peer, "RRQ %s failed: %v", req.name, err)
+			return
+		}
+		packet = appendData(packet[:0], block, data[:n])
+		if err := t.exchange(packet, block); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			s.logf(peer, "RRQ %s failed after %d bytes: %v", req.name, sent, err)
+			return
+		}
+		sent += int64(n)
+		if n < blksize {
+			break
+		}
+	}
+	s.logf(peer, "RRQ %s %d", req.name, sent)
+}
+
+// open opens the file name of a request and returns its size.
+func (s *Server) open(name string) (fs.File, int64, error) {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))[1:]
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f, info.Size(), nil
+}
+
+func (s *Server) logf(peer net.Addr, format string, args ...any) {
+	if s.Log == nil {
+		return
+	}
+	client := peer.String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	fmt.Fprintf(s.Log, "%s %s\n", client, fmt.Sprintf(format, args...))
+}
+
+// transfer is one side of a transfer, talking to peer from conn.
+type transfer struct {
+	conn    net.PacketConn
+	peer    net.Addr
+	timeout time.Duration
+	retries int
+	buf     [maxPacket]byte
+}
+
+// exchange sends packet until the peer acknowledges block, sending it again
+// whenever the timeout passes without an answer. Duplicate acknowledgements
+// of earlier blocks are ignored rather than answered, which would double
+// the traffic for the rest of the transfer.
+func (t *transfer) exchange(packet []byte, block uint16) error {
+	for range t.retries + 1 {
+		if _, err := t.conn.WriteTo(packet, t.peer); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			p, err := t.receive(deadline)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			switch binary.BigEndian.Uint16(p) {
+			case opACK:
+				if len(p) >= 4 && binary.BigEndian.Uint16(p[2:]) == block {
+					return nil
+				}
+			case opERROR:
+				return parseError(p)
+			default:
+				t.conn.WriteTo(appendError(nil, ErrIllegalOperation, "expected an acknowledgement"), t.peer)
+				return fmt.Errorf("tftp: unexpected opcode %d", binary.BigEndian.Uint16(p))
+			}
+		}
+	}
+	return errTimeout
+}
+
+// receive returns the next packet of at least two bytes from the peer,
+// answering packets from any other address with an error.
+func (t *transfer) receive(deadline time.Time) ([]byte, error) {
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		n, from, err := t.conn.ReadFrom(t.buf[:])
+		if err != nil {
+			return nil, err
+		}
+		if from.String() != t.peer.String() {
+			t.conn.WriteTo(appendError(nil, ErrUnknownTransferID, "unknown transfer ID"), from)
+			continue
+		}
+		if n >= 2 {
+			return t.buf[:n], nil
+		}
+	}
+}
+
+// netasciiReader converts text to netascii: line feeds become CR LF and
+// carriage returns CR NUL.
+type netasciiReader struct {
+	r *bufio.Reader
+	// pending is the second byte of a pair, emitted by the next Read when
+	// the previous one ended between the two.
+	pending    byte
+	hasPending bool
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if n.hasPending {
+			p[i], n.hasPending = n.pending, false
+			i++
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		p[i] = c
+		switch c {
+		case '\n':
+			p[i], n.pending, n.hasPending = '\r', '\n', true
+		case '\r':
+			n.pending, n.hasPending = 0, true
+		}
+		i++
+	}
+	return i, nil
+}
@@ -0,0 +1,207 @@
+// Package tftp implements the read side of the Trivial File Transfer
+// Protocol (RFC 1350) for network booting: a server answering read requests
+// from an fs.FS, and a small client for fetching files from one.
+//
+// The blksize (RFC 2348), timeout and tsize (RFC 2349) options are
+// negotiated through the option extension (RFC 2347). Files are sent in
+// octet or netascii mode; write requests are refused. Block numbers wrap
+// around after 65535, as most clients expect, so files are not limited to
+// 32 MiB.
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Packet opcodes.
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+)
+
+// Error codes sent in ERROR packets.
+const (
+	ErrUndefined         = 0
+	ErrFileNotFound      = 1
+	ErrAccessViolation   = 2
+	ErrDiskFull          = 3
+	ErrIllegalOperation  = 4
+	ErrUnknownTransferID = 5
+	ErrFileExists        = 6
+	ErrNoSuchUser        = 7
+	ErrOptionRefused     = 8
+)
+
+// Transfer modes.
+const (
+	ModeOctet    = "octet"
+	ModeNetASCII = "netascii"
+)
+
+// Options negotiated through the option extension.
+const (
+	OptionBlockSize = "blksize"
+	OptionTimeout   = "timeout"
+	OptionSize      = "tsize"
+)
+
+const (
+	// DefaultBlockSize is the size of data blocks when blksize is not
+	// negotiated.
+	DefaultBlockSize = 512
+	// MinBlockSize and MaxBlockSize bound the blksize option.
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+	// DefaultTimeout is how long a packet is waited for before the last one
+	// is sent again, unless the timeout option says otherwise.
+	DefaultTimeout = time.Second
+	// DefaultRetries is how many times a packet is sent again before a
+	// transfer is abandoned.
+	DefaultRetries = 5
+)
+
+// maxPacket is the largest packet either side sends: a DATA packet of the
+// largest block size.
+const maxPacket = 4 + MaxBlockSize
+
+// Error is an ERROR packet, received from or sent to the other side.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp: %s (error %d)", e.Message, e.Code)
+}
+
+// errTimeout is returned when the other side stops answering.
+var errTimeout = errors.New("tftp: timed out waiting for the other side")
+
+// request is a parsed RRQ or WRQ packet.
+type request struct {
+	op      uint16
+	name    string
+	mode    string
+	options map[string]string
+	// order lists the option names as the client sent them.
+	order []string
+}
+
+// parseRequest parses an RRQ or WRQ packet. Mode and option names are
+// lowercased; option names the client repeats keep their first value.
+func parseRequest(p []byte) (request, error) {
+	if len(p) < 2 {
+		return request{}, errors.New("short packet")
+	}
+	req := request{op: binary.BigEndian.Uint16(p), options: make(map[string]string)}
+	if req.op != opRRQ && req.op != opWRQ {
+		return request{}, fmt.Errorf("unexpected opcode %d", req.op)
+	}
+	fields := bytes.Split(p[2:], []byte{0})
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return request{}, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	req.name, req.mode = string(fields[0]), strings.ToLower(string(fields[1]))
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		if _, ok := req.options[name]; ok {
+			continue
+		}
+		req.options[name] = string(fields[i+1])
+		req.order = append(req.order, name)
+	}
+	return req, nil
+}
+
+// appendRequest appends an RRQ for name to p, with the options in order.
+func appendRequest(p []byte, name, mode string, options [][2]string) []byte {
+	p = binary.BigEndian.AppendUint16(p, opRRQ)
+	p = append(append(p, name...), 0)
+	p = append(append(p, mode...), 0)
+	for _, o := range options {
+		p = append(append(p, o[0]...), 0)
+		p = append(append(p, o[1]...), 0)
+	}
+	return p
+}
+
+func appendData(p []byte, block uint16, data []byte) []byte {
+	p = binary.BigEndian.AppendUint16(p, opDATA)
+	p = binary.BigEndian.AppendUint16(p, block)
+	return append(p, data...)
+}
+
+func appendACK(p []byte, block uint16) []byte {
+	p = binary.BigEndian.AppendUint16(p, opACK)
+	return binary.BigEndian.AppendUint16(p, block)
+}
+
+func appendError(p []byte, code uint16, msg string) []byte {
+	p = binary.BigEndian.AppendUint16(p, opERROR)
+	p = binary.BigEndian.AppendUint16(p, code)
+	return append(append(p, msg...), 0)
+}
+
+func appendOACK(p []byte, options [][2]string) []byte {
+	p = binary.BigEndian.AppendUint16(p, opOACK)
+	for _, o := range options {
+		p = append(append(p, o[0]...), 0)
+		p = append(append(p, o[1]...), 0)
+	}
+	return p
+}
+
+// parseError returns the *Error an ERROR packet carries.
+func parseError(p []byte) *Error {
+	e := &Error{}
+	if len(p) >= 4 {
+		e.Code = binary.BigEndian.Uint16(p[2:])
+		e.Message, _, _ = strings.Cut(string(p[4:]), "\x00")
+	}
+	return e
+}
+
+// parseOACK returns the options of an OACK packet, lowercased.
+func parseOACK(p []byte) (map[string]string, error) {
+	options := make(map[string]string)
+	if len(p) == 2 {
+		return options, nil
+	}
+	fields := bytes.Split(p[2:], []byte{0})
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, errors.New("tftp: malformed option acknowledgement")
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return options, nil
+}
+
+// blockSize parses a blksize option value.
+func blockSize(value string) (int, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < MinBlockSize {
+		return 0, false
+	}
+	return min(n, MaxBlockSize), true
+}
+
+// timeout parses a timeout option value, in seconds from 1 to 255.
+func timeout(value string) (time.Duration, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > 255 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
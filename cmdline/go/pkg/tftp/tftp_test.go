@@ -0,0 +1,247 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent transfers of a
+// Server to log to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// startServer runs s on a loopback port until the test ends and
+// returns its address.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, conn) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestGet(t *testing.T) {
+	fsys := fstest.MapFS{
+		"boot/vmlinuz":    {Data: pattern(1500)},
+		"boot/initrd":     {Data: pattern(1024)},
+		"boot/big":        {Data: pattern(70000)},
+		"pxelinux.cfg/de": {Data: []byte("DEFAULT a\nLABEL a\r\n")},
+	}
+	var log syncBuffer
+	addr := startServer(t, &Server{FS: fsys, Log: &log})
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name    string
+		file    string
+		opts    GetOptions
+		want    []byte
+		options map[string]string
+	}{
+		{"default", "boot/vmlinuz", GetOptions{}, pattern(1500), map[string]string{}},
+		{"options", "boot/vmlinuz", GetOptions{BlockSize: 1024, Size: true}, pattern(1500), map[string]string{"blksize": "1024", "tsize": "1500"}},
+		{"block multiple", "boot/initrd", GetOptions{}, pattern(1024), map[string]string{}},
+		{"largest block", "boot/big", GetOptions{BlockSize: 100000}, pattern(70000), map[string]string{"blksize": "65464"}},
+		{"absolute", `/boot\vmlinuz`, GetOptions{Size: true}, pattern(1500), map[string]string{"tsize": "1500"}},
+		{"netascii", "pxelinux.cfg/de", GetOptions{Mode: ModeNetASCII, Size: true, BlockSize: 8}, []byte("DEFAULT a\r\nLABEL a\r\x00\r\n"), map[string]string{"blksize": "8"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := Get(ctx, addr, tc.file, tc.opts)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if !bytes.Equal(resp.Data, tc.want) {
+				t.Fatalf("Get() = %d bytes %.40q, want %d bytes %.40q", len(resp.Data), resp.Data, len(tc.want), tc.want)
+			}
+			if len(resp.Options) != len(tc.options) {
+				t.Fatalf("acknowledged options = %v, want %v", resp.Options, tc.options)
+			}
+			for k, v := range tc.options {
+				if resp.Options[k] != v {
+					t.Fatalf("acknowledged options = %v, want %v", resp.Options, tc.options)
+				}
+			}
+		})
+	}
+
+	for file, code := range map[string]uint16{
+		"missing":          ErrFileNotFound,
+		"../boot/missing":  ErrFileNotFound,
+		"boot":             ErrAccessViolation,
+		"boot/vmlinuz/sub": ErrFileNotFound,
+	} {
+		_, err := Get(ctx, addr, file, GetOptions{})
+		var tftpErr *Error
+		if !errors.As(err, &tftpErr) || tftpErr.Code != code {
+			t.Errorf("Get(%q) error = %v, want code %d", file, err, code)
+		}
+	}
+	if _, err := Get(ctx, addr, "boot/vmlinuz", GetOptions{Mode: "mail"}); !errors.As(err, new(*Error)) {
+		t.Errorf("Get() in mail mode error = %v, want an *Error", err)
+	}
+	if !strings.Contains(log.String(), "127.0.0.1 RRQ boot/big 70000\n") || !strings.Contains(log.String(), "127.0.0.1 RRQ missing failed: file not found\n") {
+		t.Fatalf("log = %q", log.String())
+	}
+}
+
+func TestGetBlockRollover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends 65537 blocks")
+	}
+	data := pattern(MinBlockSize*65536 + 5)
+	addr := startServer(t, &Server{FS: fstest.MapFS{"big": {Data: data}}})
+	resp, err := Get(context.Background(), addr, "big", GetOptions{BlockSize: MinBlockSize})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(resp.Data, data) {
+		t.Fatalf("Get() = %d bytes, want %d", len(resp.Data), len(data))
+	}
+}
+
+// exchange sends p from conn to addr and returns the next packet conn
+// receives, and where from.
+func exchange(t *testing.T, conn net.PacketConn, addr net.Addr, p []byte) ([]byte, net.Addr) {
+	t.Helper()
+	if p != nil {
+		if _, err := conn.WriteTo(p, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxPacket)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n], from
+}
+
+func TestServerProtocol(t *testing.T) {
+	addr := startServer(t, &Server{FS: fstest.MapFS{"file": {Data: pattern(600)}}, Timeout: 50 * time.Millisecond, Retries: 2})
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	wrq := binary.BigEndian.AppendUint16(nil, opWRQ)
+	wrq = append(wrq, "file\x00octet\x00"...)
+	if p, _ := exchange(t, conn, server, wrq); binary.BigEndian.Uint16(p) != opERROR || parseError(p).Code != ErrAccessViolation {
+		t.Fatalf("answer to a write request = %q", p)
+	}
+	if p, _ := exchange(t, conn, server, []byte{0, opRRQ, 'f'}); binary.BigEndian.Uint16(p) != opERROR || parseError(p).Code != ErrIllegalOperation {
+		t.Fatalf("answer to a malformed request = %q", p)
+	}
+
+	// The first block is sent again while it goes unacknowledged, and the
+	// transfer answers other ports with an error.
+	first, tid := exchange(t, conn, server, appendRequest(nil, "file", ModeOctet, nil))
+	if tid.String() == addr || !bytes.Equal(first, appendData(nil, 1, pattern(512))) {
+		t.Fatalf("first block = %d bytes from %s", len(first), tid)
+	}
+	if again, _ := exchange(t, conn, nil, nil); !bytes.Equal(again, first) {
+		t.Fatalf("retransmitted block = %q", again)
+	}
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	if p, _ := exchange(t, stranger, tid, appendACK(nil, 1)); binary.BigEndian.Uint16(p) != opERROR || parseError(p).Code != ErrUnknownTransferID {
+		t.Fatalf("answer to another port = %q", p)
+	}
+	// A late duplicate of the first block may still arrive; skip it.
+	second, _ := exchange(t, conn, tid, appendACK(nil, 1))
+	for bytes.Equal(second, first) {
+		second, _ = exchange(t, conn, nil, nil)
+	}
+	if !bytes.Equal(second, appendData(nil, 2, pattern(600)[512:])) {
+		t.Fatalf("second block = %q", second)
+	}
+	if _, err := conn.WriteTo(appendACK(nil, 2), tid); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transfer is abandoned once the retries run out.
+	start := time.Now()
+	exchange(t, conn, server, appendRequest(nil, "file", ModeOctet, nil))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxPacket)
+	copies := 1
+	for {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			break
+		}
+		copies++
+	}
+	if copies != 3 {
+		t.Fatalf("block sent %d times in %v, want 3", copies, time.Since(start))
+	}
+}
+
+func TestServeStops(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- (&Server{FS: fstest.MapFS{}}).Serve(ctx, conn) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serve() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after its context ended")
+	}
+	if _, err := Get(context.Background(), conn.LocalAddr().String(), "file", GetOptions{Timeout: 10 * time.Millisecond, Retries: 1}); err == nil {
+		t.Fatal("Get() from a stopped server succeeded")
+	}
+}
@@ -0,0 +1,101 @@
+package tui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNoInput is returned by prompters that cannot ask the user anything.
+var ErrNoInput = errors.New("confirmation required but no interactive input is available")
+
+// Prompter asks the user to confirm actions. The CLI and tests share it.
+type Prompter interface {
+	// Confirm shows prompt and reports whether the user agreed. An empty
+	// answer counts as agreement.
+	Confirm(prompt string) (bool, error)
+	// ConfirmTyped shows prompt and reports whether the user typed expected exactly.
+	ConfirmTyped(prompt, expected string) (bool, error)
+}
+
+// LinePrompter reads answers one line at a time from a reader.
+type LinePrompter struct {
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+// NewLinePrompter constructs a LinePrompter that writes prompts to w and reads answers from r.
+func NewLinePrompter(r io.Reader, w io.Writer) *LinePrompter {
+	return &LinePrompter{reader: bufio.NewReader(r), writer: w}
+}
+
+// Confirm implements Prompter.
+func (p *LinePrompter) Confirm(prompt string) (bool, error) {
+	answer, err := p.readAnswer(prompt)
+	if err != nil {
+		return false, err
+	}
+	return isAffirmative(answer), nil
+}
+
+// ConfirmTyped implements Prompter.
+func (p *LinePrompter) ConfirmTyped(prompt, expected string) (bool, error) {
+	answer, err := p.readAnswer(prompt)
+	if err != nil {
+		return false, err
+	}
+	return answer == expected, nil
+}
+
+func (p *LinePrompter) readAnswer(prompt string) (string, error) {
+	fmt.Fprint(p.writer, prompt)
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("read confirmation: %w", err)
+		}
+		if line == "" {
+			return "", ErrNoInput
+		}
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// AssumeYes is a Prompter that agrees to everything without asking.
+type AssumeYes struct{}
+
+// Confirm implements Prompter.
+func (AssumeYes) Confirm(string) (bool, error) { return true, nil }
+
+// ConfirmTyped implements Prompter.
+func (AssumeYes) ConfirmTyped(string, string) (bool, error) { return true, nil }
+
+// NoInput is a Prompter for non-interactive sessions; every confirmation fails with ErrNoInput.
+type NoInput struct{}
+
+// Confirm implements Prompter.
+func (NoInput) Confirm(string) (bool, error) { return false, ErrNoInput }
+
+// ConfirmTyped implements Prompter.
+func (NoInput) ConfirmTyped(string, string) (bool, error) { return false, ErrNoInput }
+
+// IsTerminal reports whether f is attached to a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func isAffirmative(answer string) bool {
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "", "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,49 @@
+package tui
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLinePrompterConfirm(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    bool
+		wantErr error
+	}{
+		{input: "\n", want: true},
+		{input: "yes\n", want: true},
+		{input: "Y\n", want: true},
+		{input: "n\n", want: false},
+		{input: "nope\n", want: false},
+		{input: "y", want: true},
+		{input: "", wantErr: ErrNoInput},
+	}
+	for _, tt := range tests {
+		var output bytes.Buffer
+		got, err := NewLinePrompter(strings.NewReader(tt.input), &output).Confirm("Continue? ")
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("Confirm(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Fatalf("Confirm(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+		if output.String() != "Continue? " {
+			t.Fatalf("prompt output = %q, want %q", output.String(), "Continue? ")
+		}
+	}
+}
+
+func TestLinePrompterConfirmTyped(t *testing.T) {
+	var output bytes.Buffer
+	prompter := NewLinePrompter(strings.NewReader("\njammy\n"), &output)
+
+	if ok, err := prompter.ConfirmTyped("Name: ", "jammy"); err != nil || ok {
+		t.Fatalf("ConfirmTyped(empty) = %v, %v, want false", ok, err)
+	}
+	if ok, err := prompter.ConfirmTyped("Name: ", "jammy"); err != nil || !ok {
+		t.Fatalf("ConfirmTyped(jammy) = %v, %v, want true", ok, err)
+	}
+}
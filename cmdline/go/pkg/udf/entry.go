@@ -0,0 +1,393 @@
+package udf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxCachedListings bounds the directory listing cache.
+	maxCachedListings = 256
+	// maxContinuations bounds the allocation extent chain of one file.
+	maxContinuations = 1024
+	// maxDirSize bounds the size of a directory read into memory.
+	maxDirSize = 64 << 20
+)
+
+// ICB file types.
+const (
+	typeDir     = 4
+	typeBlock   = 6
+	typeChar    = 7
+	typeFIFO    = 9
+	typeSocket  = 10
+	typeSymlink = 12
+)
+
+// File characteristics of file identifier descriptors.
+const (
+	fidDeleted = 0x04
+	fidParent  = 0x08
+)
+
+// noID is the UID and GID of files whose owner is not recorded.
+const noID = 0xFFFFFFFF
+
+// entry is a decoded file entry, named by the identifier that led to it.
+type entry struct {
+	name  string
+	loc   location
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+	nlink uint32
+	uid   uint32
+	gid   uint32
+	major uint32
+	minor uint32
+	// Contents are either embedded in the file entry or stored in extents.
+	embedded []byte
+	extents  []extent
+	target   string
+}
+
+// extent is a run of blocks holding file contents. Sparse extents are not
+// recorded and read as zeros.
+type extent struct {
+	part   uint16
+	block  uint32
+	length uint32
+	sparse bool
+}
+
+func (e *entry) isSymlink() bool { return e.mode.Type() == fs.ModeSymlink }
+
+// inode identifies the file by the location of its file entry, which all of
+// its hard links share.
+func (e *entry) inode() uint64 {
+	return uint64(e.loc.part)<<32 | uint64(e.loc.block)
+}
+
+// readEntry decodes the file entry or extended file entry at loc.
+func (f *FS) readEntry(loc location) (*entry, error) {
+	d, err := f.readDescriptor(loc)
+	if err != nil {
+		return nil, err
+	}
+	var header, lEAOff, mtimeOff int
+	switch id := binary.LittleEndian.Uint16(d); id {
+	case tagFE:
+		header, lEAOff, mtimeOff = 176, 168, 84
+	case tagEFE:
+		header, lEAOff, mtimeOff = 216, 208, 92
+	default:
+		return nil, fmt.Errorf("%w: descriptor %d where a file entry belongs at block %d", ErrCorrupt, id, loc.block)
+	}
+	lEA := int(binary.LittleEndian.Uint32(d[lEAOff:]))
+	lAD := int(binary.LittleEndian.Uint32(d[lEAOff+4:]))
+	if lEA < 0 || lAD < 0 || header+lEA+lAD > len(d) {
+		return nil, fmt.Errorf("%w: file entry at block %d overflows its block", ErrCorrupt, loc.block)
+	}
+
+	fileType := d[27]
+	flags := binary.LittleEndian.Uint16(d[34:])
+	e := &entry{
+		loc:   loc,
+		size:  int64(binary.LittleEndian.Uint64(d[56:])),
+		mtime: timestamp(d[mtimeOff:]),
+		nlink: uint32(binary.LittleEndian.Uint16(d[48:])),
+		uid:   binary.LittleEndian.Uint32(d[36:]),
+		gid:   binary.LittleEndian.Uint32(d[40:]),
+	}
+	if e.size < 0 {
+		return nil, fmt.Errorf("%w: file entry at block %d has a negative size", ErrCorrupt, loc.block)
+	}
+	if e.uid == noID {
+		e.uid = 0
+	}
+	if e.gid == noID {
+		e.gid = 0
+	}
+	e.mode = permissions(binary.LittleEndian.Uint32(d[44:]), flags)
+	switch fileType {
+	case typeDir:
+		e.mode |= fs.ModeDir
+		// Links count the parent's identifier and the subdirectories' parent
+		// entries; POSIX also counts the directory's own ".".
+		e.nlink++
+	case typeSymlink:
+		e.mode |= fs.ModeSymlink
+	case typeBlock:
+		e.mode |= fs.ModeDevice
+	case typeChar:
+		e.mode |= fs.ModeDevice | fs.ModeCharDevice
+	case typeFIFO:
+		e.mode |= fs.ModeNamedPipe
+	case typeSocket:
+		e.mode |= fs.ModeSocket
+	}
+	if e.mode&fs.ModeDevice != 0 {
+		e.major, e.minor = deviceNumbers(d[header:header+lEA], loc.block)
+	}
+
+	ads := d[header+lEA : header+lEA+lAD]
+	if flags&7 == 3 {
+		e.embedded = ads
+	} else if e.extents, err = f.allocation(ads, flags&7, loc); err != nil {
+		return nil, err
+	}
+
+	if e.isSymlink() {
+		data, err := f.contents(e)
+		if err != nil {
+			return nil, err
+		}
+		if e.target, err = symlinkTarget(data); err != nil {
+			return nil, fmt.Errorf("symlink at block %d: %w", loc.block, err)
+		}
+		e.size = int64(len(e.target))
+	}
+	return e, nil
+}
+
+// allocation decodes allocation descriptors of the given type, following
+// continuation extents.
+func (f *FS) allocation(ads []byte, adType uint16, loc location) ([]extent, error) {
+	var size int
+	switch adType {
+	case 0:
+		size = 8
+	case 1:
+		size = 16
+	case 2:
+		size = 20
+	default:
+		return nil, fmt.Errorf("%w: allocation descriptor type %d", ErrCorrupt, adType)
+	}
+	var extents []extent
+	for range maxContinuations {
+		var next *location
+		for len(ads) >= size {
+			var ext extent
+			raw := binary.LittleEndian.Uint32(ads)
+			switch adType {
+			case 0:
+				ext = extent{part: loc.part, block: binary.LittleEndian.Uint32(ads[4:])}
+			case 1:
+				ext = extent{part: binary.LittleEndian.Uint16(ads[8:]), block: binary.LittleEndian.Uint32(ads[4:])}
+			case 2:
+				ext = extent{part: binary.LittleEndian.Uint16(ads[16:]), block: binary.LittleEndian.Uint32(ads[12:])}
+			}
+			ads = ads[size:]
+			ext.length = raw & 0x3FFFFFFF
+			if ext.length == 0 {
+				break
+			}
+			// The two high bits give the extent type: recorded, allocated
+			// but not recorded, neither, or the next extent of descriptors.
+			switch raw >> 30 {
+			case 1, 2:
+				ext.sparse = true
+			case 3:
+				next = &location{part: ext.part, block: ext.block}
+			}
+			if next != nil {
+				break
+			}
+			extents = append(extents, ext)
+		}
+		if next == nil {
+			return extents, nil
+		}
+		d, err := f.readDescriptor(*next)
+		if err != nil {
+			return nil, fmt.Errorf("read allocation extent: %w", err)
+		}
+		if id := binary.LittleEndian.Uint16(d); id != tagAED {
+			return nil, fmt.Errorf("%w: descriptor %d where allocation descriptors belong at block %d", ErrCorrupt, id, next.block)
+		}
+		n := int(binary.LittleEndian.Uint32(d[20:]))
+		if 24+n > len(d) {
+			return nil, fmt.Errorf("%w: allocation extent at block %d overflows its block", ErrCorrupt, next.block)
+		}
+		ads, loc = d[24:24+n], *next
+	}
+	return nil, fmt.Errorf("%w: too many allocation extents at block %d", ErrCorrupt, loc.block)
+}
+
+// permissions converts UDF permissions, five bits per class of which the
+// low three are execute, write and read, and the setuid, setgid and sticky
+// flags of the ICB tag to a file mode.
+func permissions(perm uint32, flags uint16) fs.FileMode {
+	mode := fs.FileMode(perm>>10&7<<6 | perm>>5&7<<3 | perm&7)
+	if flags&0x40 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if flags&0x80 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if flags&0x100 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// deviceNumbers finds the device specification extended attribute among
+// the extended attributes ea of the file entry at block.
+func deviceNumbers(ea []byte, block uint32) (major, minor uint32) {
+	if len(ea) < 24 {
+		return 0, 0
+	}
+	if id, err := checkTag(ea[:24], block); err != nil || id != tagEAHD {
+		return 0, 0
+	}
+	for off := 24; off+12 <= len(ea); {
+		length := int(binary.LittleEndian.Uint32(ea[off+8:]))
+		if length < 12 || off+length > len(ea) {
+			break
+		}
+		if binary.LittleEndian.Uint32(ea[off:]) == 12 && length >= 24 {
+			return binary.LittleEndian.Uint32(ea[off+16:]), binary.LittleEndian.Uint32(ea[off+20:])
+		}
+		off += length
+	}
+	return 0, 0
+}
+
+// symlinkTarget decodes the path components of a symlink.
+func symlinkTarget(data []byte) (string, error) {
+	var parts []string
+	absolute := false
+	for len(data) > 0 {
+		if len(data) < 4 || 4+int(data[1]) > len(data) {
+			return "", fmt.Errorf("%w: truncated path component", ErrCorrupt)
+		}
+		id := data[4 : 4+int(data[1])]
+		switch data[0] {
+		case 1, 2:
+			parts, absolute = nil, true
+		case 3:
+			parts = append(parts, "..")
+		case 4:
+			parts = append(parts, ".")
+		case 5:
+			parts = append(parts, cs0(id))
+		default:
+			return "", fmt.Errorf("%w: path component type %d", ErrCorrupt, data[0])
+		}
+		data = data[4+len(id):]
+	}
+	target := strings.Join(parts, "/")
+	if absolute {
+		target = "/" + target
+	}
+	return target, nil
+}
+
+// contents reads all of e's data.
+func (f *FS) contents(e *entry) ([]byte, error) {
+	if e.embedded != nil {
+		return e.embedded[:min(int64(len(e.embedded)), e.size)], nil
+	}
+	if e.size > maxDirSize {
+		return nil, fmt.Errorf("%w: %d bytes at block %d is too large to read whole", ErrCorrupt, e.size, e.loc.block)
+	}
+	data := make([]byte, e.size)
+	if _, err := f.readData(e, data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readData fills p from byte off of e's extents and returns how many bytes
+// it read, which is less than len(p) only at the end of the extents.
+func (f *FS) readData(e *entry, p []byte, off int64) (int, error) {
+	n := 0
+	start := int64(0)
+	for _, ext := range e.extents {
+		end := start + int64(ext.length)
+		if n < len(p) && off+int64(n) < end {
+			pos := off + int64(n) - start
+			chunk := p[n : n+int(min(int64(len(p)-n), int64(ext.length)-pos))]
+			if ext.sparse {
+				clear(chunk)
+			} else if err := f.readAt(chunk, location{ext.part, ext.block}, pos); err != nil {
+				return n, err
+			}
+			n += len(chunk)
+		}
+		start = end
+	}
+	return n, nil
+}
+
+// readDir returns the entries of directory d, sorted by name. Deleted
+// entries and names fs.FS cannot express are left out.
+func (f *FS) readDir(d *entry) ([]*entry, error) {
+	f.mu.Lock()
+	cached, ok := f.listings[d.loc]
+	f.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	data, err := f.contents(d)
+	if err != nil {
+		return nil, fmt.Errorf("read directory at block %d: %w", d.loc.block, err)
+	}
+	var entries []*entry
+	seen := make(map[string]bool)
+	for len(data) >= 38 {
+		if id := binary.LittleEndian.Uint16(data); id != tagFID || !tagChecksum(data) {
+			return nil, fmt.Errorf("%w: bad file identifier in directory at block %d", ErrCorrupt, d.loc.block)
+		}
+		characteristics := data[18]
+		lFI := int(data[19])
+		lIU := int(binary.LittleEndian.Uint16(data[36:]))
+		length := (38 + lIU + lFI + 3) &^ 3
+		if 38+lIU+lFI > len(data) {
+			return nil, fmt.Errorf("%w: truncated file identifier in directory at block %d", ErrCorrupt, d.loc.block)
+		}
+		name := cs0(data[38+lIU : 38+lIU+lFI])
+		icb := longAD(data[20:])
+		data = data[min(length, len(data)):]
+
+		if characteristics&(fidDeleted|fidParent) != 0 || name == "" || name == "." || name == ".." ||
+			strings.ContainsAny(name, "/\x00") || seen[name] {
+			continue
+		}
+		e, err := f.readEntry(icb)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		e.name = name
+		seen[name] = true
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	f.mu.Lock()
+	if len(f.listings) >= maxCachedListings {
+		clear(f.listings)
+	}
+	f.listings[d.loc] = entries
+	f.mu.Unlock()
+	return entries, nil
+}
+
+// tagChecksum checks the checksum of the descriptor tag at the start of d.
+// Identifiers are not checked against their location, which mastering tools
+// record inconsistently.
+func tagChecksum(d []byte) bool {
+	var sum byte
+	for i := range 16 {
+		if i != 4 {
+			sum += d[i]
+		}
+	}
+	return sum == d[4]
+}
@@ -0,0 +1,199 @@
+package udf
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"thatnerdjosh.com/devtools/internal/treefs"
+)
+
+// Stat holds the file details fs.FileInfo cannot express. FileInfo.Sys
+// returns a *Stat for every file of an FS.
+type Stat struct {
+	// Inode identifies the file within the image. Entries sharing it are
+	// hard links.
+	Inode uint64
+	Nlink uint32
+	UID   uint32
+	GID   uint32
+	// Major and Minor identify the device of a device node.
+	Major, Minor uint32
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadLinkFS = (*FS)(nil)
+)
+
+// Open opens the named file, following symlinks. Symlinks resolve within the
+// image, with absolute targets relative to its root. Regular files are
+// returned as *File.
+func (f *FS) Open(name string) (fs.File, error) { return treefs.Open(f.node(f.root), name) }
+
+// Stat returns a FileInfo describing the named file, following symlinks.
+func (f *FS) Stat(name string) (fs.FileInfo, error) { return treefs.Stat(f.node(f.root), name) }
+
+// Lstat returns a FileInfo describing the named file without following a
+// final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) { return treefs.Lstat(f.node(f.root), name) }
+
+// ReadLink returns the target of the named symlink.
+func (f *FS) ReadLink(name string) (string, error) { return treefs.ReadLink(f.node(f.root), name) }
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return treefs.ReadDir(f.node(f.root), name)
+}
+
+// treeNode serves an entry to treefs.
+type treeNode struct {
+	fs *FS
+	e  *entry
+}
+
+func (f *FS) node(e *entry) treeNode { return treeNode{fs: f, e: e} }
+
+func (n treeNode) Mode() fs.FileMode            { return n.e.mode }
+func (n treeNode) Info(name string) fs.FileInfo { return fileInfo{name: name, e: n.e} }
+func (n treeNode) Target() string               { return n.e.target }
+
+func (n treeNode) OpenFile(name string) fs.File {
+	return &File{fs: n.fs, e: n.e, info: fileInfo{name: name, e: n.e}}
+}
+
+func (n treeNode) Child(name string) (treefs.Node, error) {
+	entries, err := n.fs.readDir(n.e)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].name >= name })
+	if i == len(entries) || entries[i].name != name {
+		return nil, nil
+	}
+	return n.fs.node(entries[i]), nil
+}
+
+func (n treeNode) Entries() ([]fs.DirEntry, error) {
+	entries, err := n.fs.readDir(n.e)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		out[i] = dirEntry{e: e}
+	}
+	return out, nil
+}
+
+// File is an open regular file. It implements io.ReaderAt and io.Seeker in
+// addition to fs.File.
+type File struct {
+	fs   *FS
+	e    *entry
+	info fileInfo
+	off  int64
+}
+
+var (
+	_ io.ReaderAt = (*File)(nil)
+	_ io.Seeker   = (*File)(nil)
+)
+
+func (f *File) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *File) Close() error               { return nil }
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt, reading across the extents of the file.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	if off >= f.e.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if rest := f.e.size - off; int64(want) > rest {
+		want = int(rest)
+	}
+	var n int
+	if f.e.embedded != nil {
+		if off < int64(len(f.e.embedded)) {
+			n = copy(p[:want], f.e.embedded[off:])
+		}
+	} else {
+		var err error
+		if n, err = f.fs.readData(f.e, p[:want], off); err != nil {
+			return n, fmt.Errorf("read %s: %w", f.info.name, err)
+		}
+	}
+	if n < want {
+		return n, fmt.Errorf("read %s: %w", f.info.name, io.ErrUnexpectedEOF)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.e.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// fileInfo implements fs.FileInfo for an entry.
+type fileInfo struct {
+	name string
+	e    *entry
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.e.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.e.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.e.mtime }
+func (fi fileInfo) IsDir() bool        { return fi.e.mode.IsDir() }
+
+// Sys returns a *Stat.
+func (fi fileInfo) Sys() any {
+	st := &Stat{Inode: fi.e.inode(), Nlink: fi.e.nlink, UID: fi.e.uid, GID: fi.e.gid}
+	if fi.e.mode&fs.ModeDevice != 0 {
+		st.Major, st.Minor = fi.e.major, fi.e.minor
+	}
+	return st
+}
+
+// dirEntry implements fs.DirEntry.
+type dirEntry struct {
+	e *entry
+}
+
+func (d dirEntry) Name() string               { return d.e.name }
+func (d dirEntry) IsDir() bool                { return d.e.mode.IsDir() }
+func (d dirEntry) Type() fs.FileMode          { return d.e.mode.Type() }
+func (d dirEntry) Info() (fs.FileInfo, error) { return fileInfo{name: d.e.name, e: d.e}, nil }
+func (d dirEntry) String() string             { return fs.FormatDirEntry(d) }
@@ -0,0 +1,523 @@
+// Package udf reads UDF file systems, revisions 1.02 to 2.60, through an
+// io.ReaderAt without mounting them.
+//
+// UDF is the file system of DVD and Blu-ray media and of many vendor and
+// Windows installation images, often next to an ISO9660 tree that is empty or
+// incomplete. An FS implements fs.FS, fs.ReadDirFS, fs.StatFS and
+// fs.ReadLinkFS over the image's file set, including file sets kept in the
+// metadata partition introduced by UDF 2.50. Physical and sparable
+// partitions are read as laid out; the virtual partitions of incrementally
+// written media are not supported. FileInfo.Sys returns a *Stat with the
+// details fs.FileInfo cannot express.
+package udf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	anchorBlock = 256
+	// vrsStart is the byte offset of the volume recognition sequence, whose
+	// descriptors are 2048 bytes long whatever the block size.
+	vrsStart       = 32768
+	vrsSize        = 2048
+	maxVRS         = 64
+	maxDescriptors = 256
+)
+
+// Descriptor tag identifiers of ECMA-167.
+const (
+	tagPVD  = 1
+	tagAVDP = 2
+	tagVDP  = 3
+	tagPD   = 5
+	tagLVD  = 6
+	tagTD   = 8
+	tagFSD  = 256
+	tagFID  = 257
+	tagAED  = 258
+	tagFE   = 261
+	tagEAHD = 262
+	tagEFE  = 266
+)
+
+var (
+	// ErrNotUDF is returned by Open when the image has no UDF volume.
+	ErrNotUDF = errors.New("udf: no UDF volume")
+	// ErrCorrupt reports a structure of the image that cannot be decoded.
+	ErrCorrupt = errors.New("udf: corrupt image")
+	// ErrUnsupported reports a valid image using a feature this package
+	// does not implement.
+	ErrUnsupported = errors.New("udf: unsupported feature")
+)
+
+// FS is an open UDF file system.
+type FS struct {
+	r         io.ReaderAt
+	blockSize int64
+	revision  uint16
+	volumeID  string
+	// partitions are indexed by partition reference number, the position of
+	// their map in the logical volume descriptor.
+	partitions []partition
+	root       *entry
+
+	mu       sync.Mutex
+	listings map[location][]*entry
+}
+
+// partition maps the logical blocks of one partition reference onto the image.
+type partition struct {
+	number uint16
+	// start and length locate a physical partition, in blocks.
+	start, length uint32
+	// metadata holds, for a metadata partition, the extents of the metadata
+	// file, which store its blocks in a physical partition.
+	metadata []extent
+	isMeta   bool
+}
+
+// location addresses a logical block.
+type location struct {
+	part  uint16
+	block uint32
+}
+
+// Open finds the UDF volume of the image in r and returns its file set. It
+// returns ErrNotUDF when r holds no UDF volume.
+func Open(r io.ReaderAt) (*FS, error) {
+	if err := recognize(r); err != nil {
+		return nil, err
+	}
+	f := &FS{r: r, listings: make(map[location][]*entry)}
+	anchor, err := f.findAnchor()
+	if err != nil {
+		return nil, err
+	}
+
+	var vds *volumeDescriptors
+	for _, off := range []int{16, 24} {
+		length := binary.LittleEndian.Uint32(anchor[off:])
+		start := binary.LittleEndian.Uint32(anchor[off+4:])
+		if vds, err = f.readVDS(start, length); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.loadVolume(vds); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// VolumeID returns the logical volume identifier, the label most tools show.
+func (f *FS) VolumeID() string { return f.volumeID }
+
+// Revision returns the UDF revision the volume claims, in binary-coded
+// decimal: 0x0250 for UDF 2.50.
+func (f *FS) Revision() uint16 { return f.revision }
+
+// BlockSize returns the logical block size of the volume.
+func (f *FS) BlockSize() int { return int(f.blockSize) }
+
+// recognize checks the volume recognition sequence for an NSR descriptor,
+// which announces an ECMA-167 volume such as UDF.
+func recognize(r io.ReaderAt) error {
+	desc := make([]byte, 7)
+	for i := range maxVRS {
+		if _, err := r.ReadAt(desc, vrsStart+int64(i)*vrsSize); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrNotUDF
+			}
+			return fmt.Errorf("read volume recognition sequence: %w", err)
+		}
+		switch string(desc[1:6]) {
+		case "NSR02", "NSR03":
+			return nil
+		case "BEA01", "TEA01", "CD001", "BOOT2", "CDW02":
+		default:
+			return ErrNotUDF
+		}
+	}
+	return ErrNotUDF
+}
+
+// findAnchor locates an anchor volume descriptor pointer, trying the usual
+// block sizes at block 256 and then at the last block.
+func (f *FS) findAnchor() ([]byte, error) {
+	var size int64
+	switch r := f.r.(type) {
+	case interface{ Size() int64 }:
+		size = r.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	for _, bs := range []int64{2048, 512, 1024, 4096} {
+		blocks := []int64{anchorBlock}
+		for _, block := range []int64{size/bs - 1, size/bs - 1 - anchorBlock} {
+			if block > anchorBlock {
+				blocks = append(blocks, block)
+			}
+		}
+		for _, block := range blocks {
+			d := make([]byte, 512)
+			if _, err := f.r.ReadAt(d, block*bs); err != nil {
+				continue
+			}
+			if id, err := checkTag(d, uint32(block)); err == nil && id == tagAVDP {
+				f.blockSize = bs
+				return d, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no anchor volume descriptor pointer", ErrNotUDF)
+}
+
+// volumeDescriptors are the prevailing descriptors of a volume descriptor
+// sequence that Open uses.
+type volumeDescriptors struct {
+	primary    []byte
+	logical    []byte
+	partitions map[uint16][]byte
+}
+
+// readVDS reads the volume descriptor sequence of length bytes at block start,
+// following volume descriptor pointers.
+func (f *FS) readVDS(start, length uint32) (*volumeDescriptors, error) {
+	vds := &volumeDescriptors{partitions: make(map[uint16][]byte)}
+	block, end := start, start+length/uint32(f.blockSize)
+	for range maxDescriptors {
+		if block >= end {
+			break
+		}
+		d, err := f.readBlock(int64(block))
+		if err != nil {
+			return nil, err
+		}
+		id, err := checkTag(d, block)
+		if err != nil {
+			return nil, err
+		}
+		block++
+		switch id {
+		case tagPVD:
+			vds.primary = d
+		case tagLVD:
+			vds.logical = d
+		case tagPD:
+			vds.partitions[binary.LittleEndian.Uint16(d[22:])] = d
+		case tagVDP:
+			length = binary.LittleEndian.Uint32(d[20:])
+			block = binary.LittleEndian.Uint32(d[24:])
+			end = block + length/uint32(f.blockSize)
+		case tagTD:
+			block = end
+		}
+	}
+	if vds.logical == nil || len(vds.partitions) == 0 {
+		return nil, fmt.Errorf("%w: volume descriptor sequence lacks a logical volume or partition", ErrCorrupt)
+	}
+	return vds, nil
+}
+
+// loadVolume sets up the partitions of the logical volume and reads its file
+// set descriptor.
+func (f *FS) loadVolume(vds *volumeDescriptors) error {
+	lvd := vds.logical
+	if bs := binary.LittleEndian.Uint32(lvd[212:]); int64(bs) != f.blockSize {
+		return fmt.Errorf("%w: logical block size %d on %d-byte blocks", ErrUnsupported, bs, f.blockSize)
+	}
+	f.revision = binary.LittleEndian.Uint16(lvd[216+24:])
+	f.volumeID = dString(lvd[84:212])
+	if f.volumeID == "" && vds.primary != nil {
+		f.volumeID = dString(vds.primary[24:56])
+	}
+
+	tableLen := binary.LittleEndian.Uint32(lvd[264:])
+	count := binary.LittleEndian.Uint32(lvd[268:])
+	if int(440+tableLen) > len(lvd) {
+		return fmt.Errorf("%w: partition map table of %d bytes", ErrCorrupt, tableLen)
+	}
+	maps := lvd[440 : 440+tableLen]
+	// physical returns the physical partition a map refers to by number.
+	physical := func(number uint16) (partition, error) {
+		pd, ok := vds.partitions[number]
+		if !ok {
+			return partition{}, fmt.Errorf("%w: no partition descriptor numbered %d", ErrCorrupt, number)
+		}
+		return partition{
+			number: number,
+			start:  binary.LittleEndian.Uint32(pd[188:]),
+			length: binary.LittleEndian.Uint32(pd[192:]),
+		}, nil
+	}
+	// metadata maps a metadata partition reference to the blocks of its
+	// metadata file and of the file's mirror.
+	metadata := make(map[int][2]uint32)
+	for i := range count {
+		if len(maps) < 2 || maps[1] < 2 || int(maps[1]) > len(maps) {
+			return fmt.Errorf("%w: partition map %d", ErrCorrupt, i)
+		}
+		m := maps[:maps[1]]
+		maps = maps[maps[1]:]
+		switch {
+		case m[0] == 1 && len(m) == 6:
+			p, err := physical(binary.LittleEndian.Uint16(m[4:]))
+			if err != nil {
+				return err
+			}
+			f.partitions = append(f.partitions, p)
+		case m[0] == 2 && len(m) == 64:
+			number := binary.LittleEndian.Uint16(m[38:])
+			switch id := regID(m[4:36]); id {
+			case "*UDF Sparable Partition":
+				// Sparing only remaps defective packets of rewritable media;
+				// images read as written.
+				p, err := physical(number)
+				if err != nil {
+					return err
+				}
+				f.partitions = append(f.partitions, p)
+			case "*UDF Metadata Partition":
+				metadata[len(f.partitions)] = [2]uint32{binary.LittleEndian.Uint32(m[40:]), binary.LittleEndian.Uint32(m[44:])}
+				f.partitions = append(f.partitions, partition{number: number, isMeta: true})
+			default:
+				return fmt.Errorf("%w: %q partitions", ErrUnsupported, id)
+			}
+		default:
+			return fmt.Errorf("%w: partition map type %d", ErrCorrupt, m[0])
+		}
+	}
+
+	for ref, files := range metadata {
+		base := -1
+		for i, p := range f.partitions {
+			if !p.isMeta && p.number == f.partitions[ref].number {
+				base = i
+				break
+			}
+		}
+		if base < 0 {
+			return fmt.Errorf("%w: metadata partition %d has no physical partition", ErrCorrupt, ref)
+		}
+		// The mirror stands in for a damaged metadata file.
+		var err error
+		for _, block := range files {
+			var e *entry
+			if e, err = f.readEntry(location{uint16(base), block}); err == nil {
+				f.partitions[ref].metadata = e.extents
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("read metadata file: %w", err)
+		}
+	}
+
+	fsd, err := f.readDescriptor(longAD(lvd[248:]))
+	if err != nil {
+		return fmt.Errorf("read file set descriptor: %w", err)
+	}
+	if id := binary.LittleEndian.Uint16(fsd); id != tagFSD {
+		return fmt.Errorf("%w: descriptor %d where the file set descriptor belongs", ErrCorrupt, id)
+	}
+	root, err := f.readEntry(longAD(fsd[400:]))
+	if err != nil {
+		return fmt.Errorf("read root directory: %w", err)
+	}
+	if !root.mode.IsDir() {
+		return fmt.Errorf("%w: root is not a directory", ErrCorrupt)
+	}
+	root.name = "."
+	f.root = root
+	return nil
+}
+
+// readBlock reads the block at an absolute block number of the image.
+func (f *FS) readBlock(block int64) ([]byte, error) {
+	d := make([]byte, f.blockSize)
+	if _, err := f.r.ReadAt(d, block*f.blockSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read block %d: %w", block, err)
+	}
+	return d, nil
+}
+
+// physical returns the image byte offset of byte off of logical block loc,
+// and how many bytes follow it contiguously.
+func (f *FS) physical(loc location, off int64) (int64, int64, error) {
+	if int(loc.part) >= len(f.partitions) {
+		return 0, 0, fmt.Errorf("%w: partition reference %d", ErrCorrupt, loc.part)
+	}
+	p := f.partitions[loc.part]
+	pos := int64(loc.block)*f.blockSize + off
+	if !p.isMeta {
+		if p.length > 0 && pos >= int64(p.length)*f.blockSize {
+			return 0, 0, fmt.Errorf("%w: block %d beyond partition %d", ErrCorrupt, loc.block, loc.part)
+		}
+		return int64(p.start)*f.blockSize + pos, int64(p.length)*f.blockSize - pos, nil
+	}
+	// The metadata partition is the contents of the metadata file.
+	for _, ext := range p.metadata {
+		if pos < int64(ext.length) {
+			if ext.sparse {
+				return 0, 0, fmt.Errorf("%w: metadata block %d is not recorded", ErrCorrupt, loc.block)
+			}
+			start, _, err := f.physical(location{ext.part, ext.block}, pos)
+			return start, int64(ext.length) - pos, err
+		}
+		pos -= int64(ext.length)
+	}
+	return 0, 0, fmt.Errorf("%w: block %d beyond the metadata partition", ErrCorrupt, loc.block)
+}
+
+// readAt fills p from byte off of the extent starting at block loc.
+func (f *FS) readAt(p []byte, loc location, off int64) error {
+	for len(p) > 0 {
+		pos, avail, err := f.physical(loc, off)
+		if err != nil {
+			return err
+		}
+		n := int64(len(p))
+		if avail > 0 && avail < n {
+			n = avail
+		}
+		if _, err := f.r.ReadAt(p[:n], pos); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		p, off = p[n:], off+n
+	}
+	return nil
+}
+
+// readDescriptor reads and checks the descriptor at loc.
+func (f *FS) readDescriptor(loc location) ([]byte, error) {
+	d := make([]byte, f.blockSize)
+	if err := f.readAt(d, loc, 0); err != nil {
+		return nil, fmt.Errorf("read block %d of partition %d: %w", loc.block, loc.part, err)
+	}
+	if _, err := checkTag(d, loc.block); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// checkTag verifies the descriptor tag at the start of d, recorded at block
+// location, and returns its identifier.
+func checkTag(d []byte, location uint32) (uint16, error) {
+	if len(d) < 16 {
+		return 0, fmt.Errorf("%w: short descriptor", ErrCorrupt)
+	}
+	id := binary.LittleEndian.Uint16(d)
+	if !tagChecksum(d) || id == 0 {
+		return 0, fmt.Errorf("%w: bad descriptor tag at block %d", ErrCorrupt, location)
+	}
+	if got := binary.LittleEndian.Uint32(d[12:]); got != location {
+		return 0, fmt.Errorf("%w: descriptor %d at block %d claims block %d", ErrCorrupt, id, location, got)
+	}
+	if n := int(binary.LittleEndian.Uint16(d[10:])); 16+n <= len(d) {
+		if crc16(d[16:16+n]) != binary.LittleEndian.Uint16(d[8:]) {
+			return 0, fmt.Errorf("%w: descriptor %d at block %d fails its CRC", ErrCorrupt, id, location)
+		}
+	}
+	return id, nil
+}
+
+// longAD decodes the location of a long allocation descriptor.
+func longAD(b []byte) location {
+	return location{part: binary.LittleEndian.Uint16(b[8:]), block: binary.LittleEndian.Uint32(b[4:])}
+}
+
+// regID returns the identifier of an entity identifier.
+func regID(b []byte) string {
+	id := b[1:24]
+	for i, c := range id {
+		if c == 0 {
+			return string(id[:i])
+		}
+	}
+	return string(id)
+}
+
+// dString decodes a fixed-size dstring field, whose last byte holds the
+// length of its contents.
+func dString(b []byte) string {
+	n := int(b[len(b)-1])
+	if n == 0 || n > len(b)-1 {
+		return ""
+	}
+	return cs0(b[:n])
+}
+
+// cs0 decodes OSTA Compressed Unicode: a compression identifier followed by
+// 8- or 16-bit characters.
+func cs0(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch b[0] {
+	case 8, 254:
+		r := make([]rune, len(b)-1)
+		for i, c := range b[1:] {
+			r[i] = rune(c)
+		}
+		return string(r)
+	case 16, 255:
+		u := make([]uint16, (len(b)-1)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[1+2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
+
+// timestamp decodes a UDF timestamp.
+func timestamp(b []byte) time.Time {
+	typeTZ := binary.LittleEndian.Uint16(b)
+	year := int(binary.LittleEndian.Uint16(b[2:]))
+	if year == 0 {
+		return time.Time{}
+	}
+	loc := time.UTC
+	if typeTZ>>12 == 1 {
+		// The offset is a signed 12-bit count of minutes; -2047 means unknown.
+		if tz := int(int16(typeTZ<<4) >> 4); tz != -2047 && tz != 0 {
+			loc = time.FixedZone("", tz*60)
+		}
+	}
+	ns := int(b[9])*1e7 + int(b[10])*1e5 + int(b[11])*1e3
+	return time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), ns, loc).UTC()
+}
+
+// crc16 is the CRC-ITU-T checksum of descriptor tags.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
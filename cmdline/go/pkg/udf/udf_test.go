@@ -0,0 +1,188 @@
+package udf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"thatnerdjosh.com/devtools/internal/isotest"
+)
+
+var modTime = time.Date(2024, 4, 25, 14, 3, 7, 0, time.UTC)
+
+func files() []isotest.File {
+	return []isotest.File{
+		isotest.Text("README.diskdefines", "#define DISKNAME Ubuntu 24.04\n"),
+		{Path: "casper/vmlinuz", Data: bytes.Repeat([]byte("kernel"), 2000), Mode: 0o644, ModTime: modTime},
+		isotest.HardLink("casper/vmlinuz.efi", "casper/vmlinuz"),
+		isotest.Text("boot/grub/grub.cfg", "menuentry \"Try Ubuntu\" {}\n"),
+		isotest.Symlink("ubuntu", "."),
+		isotest.Symlink("boot/grub/x86_64-efi/grub.cfg", "../grub.cfg"),
+		{Path: "dists/noble/Release", Data: []byte("Suite: noble\n"), Mode: 0o600, UID: 1000, GID: 100},
+		{Path: "dev/console", Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5, Minor: 1},
+		{Path: "usr/bin/sudo", Data: []byte("#!"), Mode: fs.ModeSetuid | 0o755},
+		isotest.Text("sources/Instalación Ünïcode 日本語.txt", "wide"),
+	}
+}
+
+func openUDF(t *testing.T, iso isotest.ISO) *FS {
+	t.Helper()
+	data, err := iso.Bytes()
+	if err != nil {
+		t.Fatalf("generate ISO: %v", err)
+	}
+	fsys, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	return fsys
+}
+
+func TestOpenRevisions(t *testing.T) {
+	for _, rev := range []uint16{isotest.UDF102, isotest.UDF150, isotest.UDF201, isotest.UDF250, isotest.UDF260} {
+		t.Run(fmt.Sprintf("%x", rev), func(t *testing.T) {
+			fsys := openUDF(t, isotest.ISO{VolumeID: "Ubuntu 24.04 LTS amd64", Files: files(), UDF: &isotest.UDF{Revision: rev, Only: true}})
+			if fsys.VolumeID() != "Ubuntu 24.04 LTS amd64" || fsys.Revision() != rev || fsys.BlockSize() != 2048 {
+				t.Fatalf("VolumeID() = %q, Revision() = %x, BlockSize() = %d", fsys.VolumeID(), fsys.Revision(), fsys.BlockSize())
+			}
+
+			data, err := fs.ReadFile(fsys, "casper/vmlinuz")
+			if err != nil || !bytes.Equal(data, bytes.Repeat([]byte("kernel"), 2000)) {
+				t.Fatalf("ReadFile(casper/vmlinuz) = %d bytes, %v", len(data), err)
+			}
+			if data, err := fs.ReadFile(fsys, "sources/Instalación Ünïcode 日本語.txt"); err != nil || string(data) != "wide" {
+				t.Fatalf("ReadFile of a UTF-16 name = %q, %v", data, err)
+			}
+
+			info, err := fsys.Lstat("casper/vmlinuz")
+			if err != nil {
+				t.Fatalf("Lstat() error = %v", err)
+			}
+			if info.Mode() != 0o644 || !info.ModTime().Equal(modTime) {
+				t.Fatalf("casper/vmlinuz mode %v mtime %v", info.Mode(), info.ModTime())
+			}
+			kernel := info.Sys().(*Stat)
+			efi, _ := fsys.Lstat("casper/vmlinuz.efi")
+			if link := efi.Sys().(*Stat); link.Inode != kernel.Inode || kernel.Nlink != 2 {
+				t.Fatalf("hard link inode %d, target inode %d nlink %d", link.Inode, kernel.Inode, kernel.Nlink)
+			}
+
+			release, _ := fsys.Lstat("dists/noble/Release")
+			if st := release.Sys().(*Stat); release.Mode() != 0o600 || st.UID != 1000 || st.GID != 100 {
+				t.Fatalf("Release mode %v owner %d:%d", release.Mode(), st.UID, st.GID)
+			}
+			console, _ := fsys.Lstat("dev/console")
+			if st := console.Sys().(*Stat); console.Mode() != fs.ModeDevice|fs.ModeCharDevice|0o600 || st.Major != 5 || st.Minor != 1 {
+				t.Fatalf("dev/console mode %v device %d:%d", console.Mode(), st.Major, st.Minor)
+			}
+			if sudo, _ := fsys.Lstat("usr/bin/sudo"); sudo.Mode() != fs.ModeSetuid|0o755 {
+				t.Fatalf("usr/bin/sudo mode %v", sudo.Mode())
+			}
+			if casper, _ := fsys.Stat("casper"); casper.Sys().(*Stat).Nlink != 2 {
+				t.Fatalf("casper nlink %d, want 2", casper.Sys().(*Stat).Nlink)
+			}
+
+			if target, err := fsys.ReadLink("boot/grub/x86_64-efi/grub.cfg"); err != nil || target != "../grub.cfg" {
+				t.Fatalf("ReadLink() = %q, %v", target, err)
+			}
+			if data, err := fs.ReadFile(fsys, "ubuntu/ubuntu/boot/grub/x86_64-efi/grub.cfg"); err != nil || string(data) != "menuentry \"Try Ubuntu\" {}\n" {
+				t.Fatalf("ReadFile through symlinks = %q, %v", data, err)
+			}
+
+			if err := fstest.TestFS(fsys, "README.diskdefines", "casper/vmlinuz", "dists/noble/Release", "dev/console"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOpenBridge(t *testing.T) {
+	// Windows media: the ISO9660 tree only holds a README, UDF the installer.
+	fsys := openUDF(t, isotest.ISO{
+		VolumeID: "CCCOMA_X64FRE_EN-US_DV9",
+		Joliet:   true,
+		Files:    []isotest.File{isotest.Text("README.TXT", "This disc contains a UDF file system.\n")},
+		UDF: &isotest.UDF{Revision: isotest.UDF102, Files: []isotest.File{
+			isotest.Text("setup.exe", "MZ"),
+			isotest.Text("sources/install.wim", "MSWIM"),
+		}},
+	})
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "setup.exe" || entries[1].Name() != "sources" {
+		t.Fatalf("ReadDir(.) = %v, %v", entries, err)
+	}
+	if data, err := fs.ReadFile(fsys, "sources/install.wim"); err != nil || string(data) != "MSWIM" {
+		t.Fatalf("ReadFile(sources/install.wim) = %q, %v", data, err)
+	}
+}
+
+func TestFileReadAt(t *testing.T) {
+	fsys := openUDF(t, isotest.ISO{Files: files(), UDF: &isotest.UDF{Revision: isotest.UDF250}})
+	f, err := fsys.Open("casper/vmlinuz")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	want := bytes.Repeat([]byte("kernel"), 2000)
+	file := f.(*File)
+	buf := make([]byte, 100)
+	if n, err := file.ReadAt(buf, 2000); n != 100 || err != nil || !bytes.Equal(buf, want[2000:2100]) {
+		t.Fatalf("ReadAt across a block boundary = %d, %v", n, err)
+	}
+	if n, err := file.ReadAt(buf, int64(len(want))-10); n != 10 || err != io.EOF {
+		t.Fatalf("ReadAt at the end = %d, %v; want 10, EOF", n, err)
+	}
+	if _, err := file.Seek(-6, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if rest, err := io.ReadAll(file); err != nil || string(rest) != "kernel" {
+		t.Fatalf("ReadAll after Seek = %q, %v", rest, err)
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	plain, err := isotest.ISO{RockRidge: true, Files: files()}.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"ISO9660": plain, "zeros": make([]byte, 300*2048), "empty": nil} {
+		if _, err := Open(bytes.NewReader(data)); !errors.Is(err, ErrNotUDF) {
+			t.Errorf("Open(%s) error = %v, want ErrNotUDF", name, err)
+		}
+	}
+
+	data, err := isotest.ISO{Files: files(), UDF: &isotest.UDF{Only: true}}.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A damaged anchor at block 256 leaves the one in the last block.
+	data[256*2048+20]++
+	if _, err := Open(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Open(bad first anchor) error = %v", err)
+	}
+	clear(data[len(data)-2048:])
+	if _, err := Open(bytes.NewReader(data)); !errors.Is(err, ErrNotUDF) {
+		t.Fatalf("Open(no anchor) error = %v, want ErrNotUDF", err)
+	}
+}
+
+func TestSymlinkTarget(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		want string
+	}{
+		{[]byte{2, 0, 0, 0, 5, 4, 0, 0, 8, 'u', 's', 'r', 3, 0, 0, 0, 4, 0, 0, 0}, "/usr/../."},
+		{[]byte{5, 3, 0, 0, 16, 0, 'x'}, "x"},
+	} {
+		if got, err := symlinkTarget(tc.data); err != nil || got != tc.want {
+			t.Errorf("symlinkTarget(%v) = %q, %v; want %q", tc.data, got, err, tc.want)
+		}
+	}
+	if _, err := symlinkTarget([]byte{5, 9, 0, 0, 8}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("symlinkTarget(truncated) error = %v, want ErrCorrupt", err)
+	}
+}